@@ -0,0 +1,6 @@
+//go:build noinput
+
+package main
+
+// inputSimulationBuilt is false in builds tagged noinput, which can never type, poll the keyboard or write the clipboard
+const inputSimulationBuilt = false
@@ -0,0 +1,6 @@
+//go:build !noinput
+
+package main
+
+// inputSimulationBuilt is true unless the build is tagged noinput
+const inputSimulationBuilt = true
@@ -1,25 +1,58 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"html"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 	"unsafe"
 
 	"fyne.io/systray"
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	_ "modernc.org/sqlite"
 )
 
 // OpenAI API structures
@@ -30,7 +63,7 @@ type Tool struct {
 
 type Function struct {
 	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
+	Description string                 `json:"description,omitempty"`
 	Parameters  map[string]interface{} `json:"parameters,omitempty"`
 	Arguments   json.RawMessage        `json:"arguments,omitempty"`
 }
@@ -40,6 +73,89 @@ type Message struct {
 	Content    string     `json:"content"`
 	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
 	ToolCallId string     `json:"tool_call_id,omitempty"`
+
+	// URLs of image_url content parts, input_audio clips and IDs of file parts, in order; the text parts are
+	// joined into Content
+	Images []string       `json:"-"`
+	Audio  []MessageAudio `json:"-"`
+	Files  []string       `json:"-"` // Uploaded through /v1/files
+}
+
+// MessageAudio is an input_audio content part: base64 audio in a format such as wav or mp3
+type MessageAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+// UnmarshalJSON accepts content as a string, null, or an array of content parts. Text and refusal parts are
+// joined into Content, image_url, input_audio and file parts are kept for the Khoj request, and other parts are
+// skipped.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	var raw struct {
+		message
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.message)
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Content, &m.Content); err == nil {
+		return nil
+	}
+
+	var parts []struct {
+		Type       string          `json:"type"`
+		Text       string          `json:"text"`
+		Refusal    string          `json:"refusal"`
+		ImageURL   json.RawMessage `json:"image_url"`
+		InputAudio *MessageAudio   `json:"input_audio"`
+		File       *struct {
+			FileID string `json:"file_id"`
+		} `json:"file"`
+	}
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+	var texts []string
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "refusal":
+			texts = append(texts, part.Refusal)
+		case "input_audio":
+			if part.InputAudio == nil || part.InputAudio.Data == "" {
+				return fmt.Errorf("input_audio content part has no data")
+			}
+			m.Audio = append(m.Audio, *part.InputAudio)
+		case "file":
+			if part.File == nil || part.File.FileID == "" {
+				return fmt.Errorf("file content part has no file_id (upload the file to /v1/files first)")
+			}
+			m.Files = append(m.Files, part.File.FileID)
+		case "image_url":
+			var image struct {
+				URL string `json:"url"`
+			}
+			if err := json.Unmarshal(part.ImageURL, &image.URL); err != nil {
+				if err := json.Unmarshal(part.ImageURL, &image); err != nil {
+					return fmt.Errorf("invalid image_url content part")
+				}
+			}
+			if image.URL == "" {
+				return fmt.Errorf("image_url content part has no url")
+			}
+			m.Images = append(m.Images, image.URL)
+		default:
+			log.Printf("Skipping unsupported %q content part", part.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
 }
 
 type ToolCall struct {
@@ -55,26 +171,276 @@ type ChatCompletionResponse struct {
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
 	Usage   Usage    `json:"usage"`
+
+	// Changes when the wrapper version, agent or agent's chat model changes, see systemFingerprint
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+
+	// Extension: how attached files were reduced to fit the agent's token budget
+	KhojBudget *BudgetReport `json:"khoj_budget,omitempty"`
+
+	// Extension: request metadata, only when asked for with X-Khoj-Annotate or the annotate setting
+	XKhoj *KhojAnnotation `json:"x_khoj,omitempty"`
+}
+
+// KhojAnnotation tells a client how its chat completion was served
+type KhojAnnotation struct {
+	Agent             string `json:"agent"`
+	ConversationID    string `json:"conversation_id"`
+	UpstreamLatencyMs int64  `json:"upstream_latency_ms"` // Time spent waiting on Khoj, as in X-Khoj-Upstream-Latency
+	Attempts          int    `json:"attempts"`
+	Retries           int    `json:"retries"`
+	Hedged            bool   `json:"hedged"`
+	Cached            bool   `json:"cached"`                // Chat completions are not cached yet, so this is always false
+	LocalModel        string `json:"local_model,omitempty"` // The local model that answered instead of Khoj, as in X-Khoj-Local-Model
+	RequestID         string `json:"request_id,omitempty"`  // As in X-Request-Id
+}
+
+// BudgetReport describes how attached files were fitted into a token budget
+type BudgetReport struct {
+	Agent           string             `json:"agent"`
+	Budget          int                `json:"budget"`
+	EstimatedTokens int                `json:"estimated_tokens"` // Prompt plus files before reduction
+	FinalTokens     int                `json:"final_tokens"`
+	Strategy        string             `json:"strategy"` // truncate, summarize, map_reduce, or over_budget
+	Files           []BudgetFileReport `json:"files"`
+}
+
+// BudgetFileReport is the per-file part of a BudgetReport
+type BudgetFileReport struct {
+	Name           string `json:"name"`
+	OriginalTokens int    `json:"original_tokens"`
+	FinalTokens    int    `json:"final_tokens"`
+	Strategy       string `json:"strategy"` // kept, truncate, summarize, or map_reduce
+	Chunks         int    `json:"chunks,omitempty"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason string  `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs"`
+	FinishReason string          `json:"finish_reason"`
+}
+
+// ChoiceLogprobs are the token logprobs of a chat choice, see synthesizedLogprobs
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+	Refusal []TokenLogprob `json:"refusal"` // Always null
+}
+
+// TokenLogprob is one token of an answer with its logprob and the most likely alternatives
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+// TopLogprob is an alternative for a token
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
 }
 
+// CompletionLogprobs are the logprobs of a text completion choice in the legacy format
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+// Usage counts tokens with the tokenizer of the requested model's family, see countTokens
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
 }
 
+// StreamOptions are the stream_options of a chat or text completion request
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ModelList is the response of GET /v1/models
+type ModelList struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+// ModelObject is a Khoj agent listed as an OpenAI model, with the agent slug as its ID
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"` // Khoj doesn't report when agents were created, so this is 0
+	OwnedBy string `json:"owned_by"`
+
+	// Extension: the agent behind the model
+	XKhoj *ModelAnnotation `json:"x_khoj,omitempty"`
+}
+
+// ModelAnnotation describes the Khoj agent behind a model
+type ModelAnnotation struct {
+	Name      string `json:"name"`
+	ChatModel string `json:"chat_model,omitempty"`
+	Current   bool   `json:"current"` // The agent of the active conversation
+}
+
+// EmbeddingRequest is an OpenAI embeddings request; input is a string or an array of strings
+type EmbeddingRequest struct {
+	Input          json.RawMessage `json:"input"`
+	Model          string          `json:"model,omitempty"`
+	EncodingFormat string          `json:"encoding_format,omitempty"` // "float" (default) or "base64"
+	Dimensions     int             `json:"dimensions,omitempty"`
+}
+
+// EmbeddingResponse is the response of POST /v1/embeddings
+type EmbeddingResponse struct {
+	Object string            `json:"object"`
+	Data   []EmbeddingObject `json:"data"`
+	Model  string            `json:"model"`
+	Usage  EmbeddingUsage    `json:"usage"`
+}
+
+// EmbeddingObject is the vector for one input
+type EmbeddingObject struct {
+	Object    string      `json:"object"`
+	Index     int         `json:"index"`
+	Embedding interface{} `json:"embedding"` // []float64, or base64 of little-endian float32s
+}
+
+// EmbeddingUsage is the estimated size of the inputs
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ModerationRequest is an OpenAI moderation request
+type ModerationRequest struct {
+	Input json.RawMessage `json:"input"`
+	Model string          `json:"model,omitempty"` // Accepted but not used; the configured filters and agent decide
+}
+
+// ModerationResponse is the response of POST /v1/moderations
+type ModerationResponse struct {
+	ID      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
+
+// ModerationResult is the verdict for one input, with every category listed as OpenAI does
+type ModerationResult struct {
+	Flagged                   bool                `json:"flagged"`
+	Categories                map[string]bool     `json:"categories"`
+	CategoryScores            map[string]float64  `json:"category_scores"`
+	CategoryAppliedInputTypes map[string][]string `json:"category_applied_input_types"`
+}
+
+// SpeechRequest is an OpenAI text-to-speech request. Khoj speaks with the voice model picked in its settings, so voice
+// and speed are accepted but not applied.
+type SpeechRequest struct {
+	Model          string  `json:"model,omitempty"`
+	Input          string  `json:"input"`
+	Voice          string  `json:"voice,omitempty"`
+	ResponseFormat string  `json:"response_format,omitempty"` // Only mp3, the format Khoj produces
+	Speed          float64 `json:"speed,omitempty"`
+}
+
+// ImageGenerationRequest is an OpenAI image generation request. Khoj draws with the text-to-image model picked in
+// its settings, so model, size, quality and style are accepted but not applied.
+type ImageGenerationRequest struct {
+	Model          string `json:"model,omitempty"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`               // Only 1, since Khoj draws one image per request
+	ResponseFormat string `json:"response_format,omitempty"` // url (the default) or b64_json
+	Size           string `json:"size,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	Style          string `json:"style,omitempty"`
+	User           string `json:"user,omitempty"`
+}
+
+// ImageData is one generated image in an ImageGenerationResponse
+type ImageData struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+// ImageGenerationResponse is an OpenAI images response
+type ImageGenerationResponse struct {
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
+
+// CompletionRequest is a legacy OpenAI text completion request; prompt and stop are a string or an array of strings
+type CompletionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	Suffix      string          `json:"suffix,omitempty"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	Stop        json.RawMessage `json:"stop,omitempty"`
+	Echo        bool            `json:"echo,omitempty"`
+	N           int             `json:"n,omitempty"`
+	BestOf      int             `json:"best_of,omitempty"`
+	User        string          `json:"user,omitempty"`
+	Purpose     string          `json:"purpose,omitempty"`
+	Seed        *int64          `json:"seed,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	// Alternatives per token, up to maxCompletionLogprobs; the logprobs are synthesized as for chat completions
+	Logprobs *int `json:"logprobs,omitempty"`
+
+	// Extension: as for chat completions; defaults to first_code when suffix is set
+	Output string `json:"khoj_output,omitempty"`
+}
+
+// CompletionResponse is the response of POST /v1/completions
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   Usage              `json:"usage"`
+
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+
+	KhojBudget *BudgetReport   `json:"khoj_budget,omitempty"`
+	XKhoj      *KhojAnnotation `json:"x_khoj,omitempty"`
+}
+
+// CompletionChoice is the completed text; logprobs are null unless the request asked for them
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+// KhojAgent is an agent as listed by Khoj's /api/agents
+type KhojAgent struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	Creator   string `json:"creator"`
+	ChatModel string `json:"chat_model"`
+}
+
 type KhojRequest struct {
 	Q              string     `json:"q"`
 	ConversationID string     `json:"conversation_id,omitempty"`
 	Stream         bool       `json:"stream"`
 	ClientID       string     `json:"client_id,omitempty"`
 	Files          []KhojFile `json:"files,omitempty"`
+	Images         []string   `json:"images,omitempty"` // Base64 data URLs, for vision-capable chat models
+
+	// Sampling parameters, ignored by Khoj servers and chat models that do not take them; see samplingSupport
+	Seed        *int64   `json:"seed,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
 }
 
 type KhojFile struct {
@@ -93,6 +459,13 @@ type KhojResponse struct {
 	ByKhoj         bool                     `json:"by_khoj"`
 	Intent         map[string]interface{}   `json:"intent,omitempty"`
 	Detail         map[string]interface{}   `json:"detail,omitempty"`
+
+	// Generated images, as URLs or data URLs, from the stream's generated assets
+	Images []string `json:"images,omitempty"`
+	// Older servers send a generated image as image, a URL or base64 depending on intentType
+	Image           string   `json:"image,omitempty"`
+	IntentType      string   `json:"intentType,omitempty"`
+	InferredQueries []string `json:"inferredQueries,omitempty"`
 }
 
 type SessionRequest struct {
@@ -104,9 +477,13 @@ type SessionResponse struct {
 }
 
 type ConversationState struct {
-	LastConversationID string    `json:"last_conversation_id"`
-	AgentSlug          string    `json:"agent_slug"`
-	CreatedAt          time.Time `json:"created_at"`
+	LastConversationID string            `json:"last_conversation_id"`
+	AgentSlug          string            `json:"agent_slug"`
+	CreatedAt          time.Time         `json:"created_at"`
+	Instructions       map[string]string `json:"instructions,omitempty"` // Custom instructions keyed by conversation ID
+	UpdatedAt          time.Time         `json:"updated_at"`
+	UpdatedBy          string            `json:"updated_by,omitempty"` // Host name of the machine that saved it
+	Revision           int64             `json:"revision,omitempty"`   // Bumped by every write to the state_sync store
 }
 
 type MCPTool struct {
@@ -115,2555 +492,23060 @@ type MCPTool struct {
 	InputSchema map[string]interface{} `json:"input_schema"`
 }
 
-type MCPSession struct {
-	Name    string    `json:"name"`
-	Command string    `json:"command"`
-	Tools   []MCPTool `json:"tools"`
-	Process *exec.Cmd `json:"-"`
+type MCPResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
 }
 
-type KhojProvider struct {
-	APIBase    string
-	APIKey     string
-	HTTPClient *http.Client
-	MCPManager *MCPToolManager
+type MCPPromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
 }
 
-type MCPToolManager struct {
-	Sessions map[string]*MCPSession
+type MCPPrompt struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Arguments   []MCPPromptArgument `json:"arguments,omitempty"`
 }
 
-// Global variables for conversation management
-var (
-	conversationID   string
-	currentAgentSlug string
-	newConversation  bool
-)
+type MCPSession struct {
+	Name      string          `json:"name"`
+	Command   string          `json:"command"`
+	Tools     []MCPTool       `json:"tools"`
+	Resources []MCPResource   `json:"resources"`
+	Prompts   []MCPPrompt     `json:"prompts"`
+	Process   *exec.Cmd       `json:"-"`
+	Config    MCPServerConfig `json:"-"`
+	stdin     io.WriteCloser
+	stdout    io.ReadCloser
+
+	// JSON-RPC state
+	nextID  int64
+	pending map[int64]chan mcpRPCMessage
+	rpcMu   sync.Mutex
+	writeMu sync.Mutex
+	done    chan struct{}
+	stopped bool // Set when the wrapper intentionally stops the process
+}
 
-// Command-line flags
-var (
-	flagNewConversation = flag.Bool("n", false, "Start a new conversation")
-	flagConversationID  = flag.String("conversation-id", "", "Override conversation ID")
-)
+// mcpRPCMessage is a JSON-RPC 2.0 message exchanged with MCP servers over stdio
+type mcpRPCMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *mcpRPCError    `json:"error,omitempty"`
+}
 
-const (
-	conversationStateFile = "conversation_state.json"
-	defaultAgentSlug      = "sonnet-short-025716"
-	clipboardTimeout      = 30 * time.Second
-)
+type mcpRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
 
-// Windows API declarations for clipboard and keyboard monitoring
-var (
-	user32               *syscall.LazyDLL
-	kernel32             *syscall.LazyDLL
-	procGetClipboardData *syscall.LazyProc
-	procOpenClipboard    *syscall.LazyProc
-	procCloseClipboard   *syscall.LazyProc
-	procGlobalLock       *syscall.LazyProc
-	procGlobalUnlock     *syscall.LazyProc
-	procSendInput        *syscall.LazyProc
-	procMessageBox       *syscall.LazyProc
-)
+// MCPResourceRef references an MCP resource to attach to a chat request
+type MCPResourceRef struct {
+	Server string `json:"server"`
+	URI    string `json:"uri"`
+}
 
-func init() {
-	if runtime.GOOS == "windows" {
-		user32 = syscall.NewLazyDLL("user32.dll")
-		kernel32 = syscall.NewLazyDLL("kernel32.dll")
-		procGetClipboardData = user32.NewProc("GetClipboardData")
-		procOpenClipboard = user32.NewProc("OpenClipboard")
-		procCloseClipboard = user32.NewProc("CloseClipboard")
-		procGlobalLock = kernel32.NewProc("GlobalLock")
-		procGlobalUnlock = kernel32.NewProc("GlobalUnlock")
-		procSendInput = user32.NewProc("SendInput")
-		procMessageBox = user32.NewProc("MessageBoxW")
-	}
+// MCPServerConfig describes an MCP server child process launched by the wrapper
+type MCPServerConfig struct {
+	Name      string            `json:"name"`
+	Command   string            `json:"command"`
+	Args      []string          `json:"args,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	SecretEnv []string          `json:"secret_env,omitempty"` // Injected from the secret store at launch
 }
 
-// Cross-platform safe syscall wrappers
-func safeUTF16PtrFromString(s string) (uintptr, error) {
-	if runtime.GOOS != "windows" {
-		return 0, fmt.Errorf("Windows-only function")
-	}
-	ptr, err := syscall.UTF16PtrFromString(s)
-	return uintptr(unsafe.Pointer(ptr)), err
+// ToolOutputConfig limits how much tool output is fed back into a conversation
+type ToolOutputConfig struct {
+	MaxChars     int            `json:"max_chars,omitempty"`     // Default limit for every tool (0 = unlimited)
+	PerTool      map[string]int `json:"per_tool,omitempty"`      // Overrides keyed by tool name
+	SummaryAgent string         `json:"summary_agent,omitempty"` // Agent used to summarize oversized output; truncates when empty
 }
 
-func safeUTF16ToString(p uintptr, maxLen int) string {
-	if runtime.GOOS != "windows" {
-		return ""
-	}
-	return syscall.UTF16ToString((*[1 << 20]uint16)(unsafe.Pointer(p))[:maxLen])
+// AccessLogConfig writes an access log of the OpenAI-compatible API in Apache's log formats
+type AccessLogConfig struct {
+	Enabled   bool   `json:"enabled,omitempty"`
+	Path      string `json:"path,omitempty"`        // Defaults to access.log
+	Format    string `json:"format,omitempty"`      // "combined" (the default, followed by the duration in ms) or "common"
+	MaxSizeMB int    `json:"max_size_mb,omitempty"` // The log is rotated at this size; defaults to 10
+	MaxFiles  int    `json:"max_files,omitempty"`   // Rotated logs kept as access.log.1 to access.log.N; defaults to 5
 }
 
-func safeStringToUTF16(s string) []uint16 {
-	if runtime.GOOS != "windows" {
-		return nil
-	}
-	return syscall.StringToUTF16(s)
+// ToolExecutionConfig lets the agent call the tools of MCP servers, which the wrapper runs itself
+type ToolExecutionConfig struct {
+	Enabled     bool   `json:"enabled,omitempty"`
+	MaxParallel int    `json:"max_parallel,omitempty"` // Tool calls running at once across all requests; defaults to 4
+	MaxRounds   int    `json:"max_rounds,omitempty"`   // Rounds of tool calls per request before the agent must answer; defaults to 5
+	Timeout     string `json:"timeout,omitempty"`      // Per call; defaults to 30s
 }
 
-// Windows constants
-const (
-	VK_Q            = 0x51
-	VK_CONTROL      = 0x11
-	CF_UNICODETEXT  = 13
-	INPUT_KEYBOARD  = 1
-	KEYEVENTF_KEYUP = 0x0002
-)
+// URLFetchConfig guards downloads of URLs that clients send, such as image_url images
+type URLFetchConfig struct {
+	AllowPrivate bool     `json:"allow_private,omitempty"` // Allow loopback, private and link-local addresses
+	AllowedHosts []string `json:"allowed_hosts,omitempty"` // Host names, IPs or CIDR ranges reachable even when private
+	MaxSizeMB    int      `json:"max_size_mb,omitempty"`   // Defaults to 20
+	Timeout      string   `json:"timeout,omitempty"`       // Per download; defaults to 30s
+	ImageTypes   []string `json:"image_types,omitempty"`   // Content types accepted as images, such as "image/png" or "image/*"
+}
 
-// Windows structures
-type INPUT struct {
-	Type uint32
-	Ki   KEYBDINPUT
+// TokenBudgetConfig caps the estimated prompt size per agent, shrinking attached files to fit
+type TokenBudgetConfig struct {
+	Default      int            `json:"default,omitempty"`       // Budget for agents without an override (0 = unlimited)
+	PerAgent     map[string]int `json:"per_agent,omitempty"`     // Overrides keyed by agent slug
+	SummaryAgent string         `json:"summary_agent,omitempty"` // Agent used to summarize files; truncates when empty
+	ChunkTokens  int            `json:"chunk_tokens,omitempty"`  // Map step chunk size (default 2000)
 }
 
-type KEYBDINPUT struct {
-	WVk         uint16
-	WScan       uint16
-	DwFlags     uint32
-	Time        uint32
-	DwExtraInfo uintptr
+// InsertionConfig controls how long Clipboard AI responses are typed at the cursor
+type InsertionConfig struct {
+	ChunkChars int    `json:"chunk_chars,omitempty"` // Responses longer than this are inserted in paragraph chunks (default 1500, -1 disables)
+	Pause      string `json:"pause,omitempty"`       // Pause between chunks (default 700ms)
+	StopKey    string `json:"stop_key,omitempty"`    // Key that aborts insertion during a pause (default Esc)
+
+	// Before a paste keystroke the clipboard is read back until it holds the new text
+	ClipboardRetries int    `json:"clipboard_retries,omitempty"` // Writes retried when the clipboard does not settle (default 3, -1 disables the check)
+	ClipboardSettle  string `json:"clipboard_settle,omitempty"`  // How long each write may take to settle (default 250ms)
+
+	// Process or window class name -> "terminal", "form" or "editor", overriding paste target detection
+	Targets map[string]string `json:"targets,omitempty"`
+
+	// Process or window class names that keep the formatting of pasted HTML, added to the built-in Office apps
+	RichTextApps []string `json:"rich_text_apps,omitempty"`
 }
 
-// Global variables for clipboard monitoring
-var (
-	clipboardActive bool
-)
+// OutputFilterConfig screens responses against wordlists and regexes before they reach the user
+type OutputFilterConfig struct {
+	Words     []string `json:"words,omitempty"`     // Case-insensitive whole words
+	Wordlists []string `json:"wordlists,omitempty"` // Files with one word per line (# comments allowed)
+	Patterns  []string `json:"patterns,omitempty"`  // Regular expressions
+	Action    string   `json:"action,omitempty"`    // "mask" (default) or "block"
+	Mask      string   `json:"mask,omitempty"`      // Replacement text; defaults to asterisks of equal length
+}
 
-// loadConversationState loads the conversation state from JSON file
-func loadConversationState() (*ConversationState, error) {
-	data, err := os.ReadFile(conversationStateFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &ConversationState{}, nil // Return empty state if file doesn't exist
-		}
-		return nil, fmt.Errorf("failed to read conversation state file: %w", err)
-	}
+// FooterConfig controls footers appended to or stripped from Khoj responses
+type FooterConfig struct {
+	Text     string   `json:"text,omitempty"`     // Appended to every response; {agent} and {conversation} are replaced
+	Sources  bool     `json:"sources,omitempty"`  // Append the sources Khoj cited
+	Suppress []string `json:"suppress,omitempty"` // Regular expressions for footers to strip from responses
+	Targets  []string `json:"targets,omitempty"`  // "api" and/or "clipboard"; defaults to both
+}
 
-	var state ConversationState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, fmt.Errorf("failed to parse conversation state: %w", err)
-	}
+// TemplateConfig is a clipboard prompt template defined in config.json
+type TemplateConfig struct {
+	Name      string   `json:"name"`
+	Prompt    string   `json:"prompt"`
+	Output    string   `json:"output,omitempty"`    // "full" (default), "code" or "first_code"
+	Verbosity string   `json:"verbosity,omitempty"` // "one-liner", "short" or "detailed"
+	MaxChars  int      `json:"max_chars,omitempty"` // Overrides the verbosity preset's length limit
+	Languages []string `json:"languages,omitempty"` // ISO 639-1 codes; the template becomes the default for clipboard text in these languages
+	Rewrite   bool     `json:"rewrite,omitempty"`   // Review a word diff against the clipboard text before inserting
+	Citations string   `json:"citations,omitempty"` // "footnotes", "inline" or "none"; default leaves links as Khoj wrote them
+	RichText  string   `json:"rich_text,omitempty"` // "auto" (default) pastes Markdown answers as HTML into rich text apps, "off" never does
+
+	PostProcess *PostProcessConfig `json:"post_process,omitempty"` // Command the response is piped through before insertion
+}
 
-	return &state, nil
+// TemplatePacksConfig lists the publishers whose template packs are accepted
+type TemplatePacksConfig struct {
+	TrustedKeys []string `json:"trusted_keys,omitempty"` // Base64 Ed25519 public keys; installing a pack from the dashboard can add its key
 }
 
-// saveConversationState saves the conversation state to JSON file
-func saveConversationState(state *ConversationState) error {
-	data, err := json.MarshalIndent(state, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal conversation state: %w", err)
-	}
+// PostProcessConfig runs a template's response through an external command: stdin is the response, stdout replaces it
+type PostProcessConfig struct {
+	Command    string            `json:"command"`
+	Args       []string          `json:"args,omitempty"`
+	Timeout    string            `json:"timeout,omitempty"`          // Default 10s; the command is killed when it runs over
+	Env        map[string]string `json:"env,omitempty"`              // Extra variables for the command
+	InheritEnv bool              `json:"inherit_env,omitempty"`      // Pass the wrapper's whole environment instead of only PATH and system variables
+	Dir        string            `json:"dir,omitempty"`              // Working directory; defaults to an empty temporary directory removed afterwards
+	MaxOutput  int               `json:"max_output_bytes,omitempty"` // Default 1 MiB; more output fails the command
+	OnError    string            `json:"on_error,omitempty"`         // "fail" (default) inserts nothing, "keep" inserts the unprocessed response
+}
 
-	if err := os.WriteFile(conversationStateFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write conversation state file: %w", err)
-	}
+// LanguageConfig controls language detection of clipboard text
+type LanguageConfig struct {
+	Disabled   bool `json:"disabled,omitempty"`
+	KeepAnswer bool `json:"keep_answer_language,omitempty"` // Don't ask Khoj to answer in the detected language
+}
 
-	return nil
+// TerminalSafetyConfig controls the destructive command check before inserting into a terminal
+type TerminalSafetyConfig struct {
+	Disabled      bool     `json:"disabled,omitempty"`
+	Patterns      []string `json:"patterns,omitempty"`       // Extra regular expressions to flag
+	WindowClasses []string `json:"window_classes,omitempty"` // Extra window classes treated as terminals
 }
 
-// createNewConversation creates a new conversation session via Khoj API
-func createNewConversation(apiBase, apiKey string) (string, error) {
-	agentSlug := currentAgentSlug
-	if agentSlug == "" {
-		agentSlug = defaultAgentSlug
-	}
+// PriorityConfig limits concurrent Khoj requests and how background requests yield to interactive ones
+type PriorityConfig struct {
+	MaxConcurrent     int  `json:"max_concurrent,omitempty"`     // Khoj requests in flight; defaults to 4
+	MaxBackground     int  `json:"max_background,omitempty"`     // Of those, background requests; defaults to max_concurrent - 1
+	DisablePreemption bool `json:"disable_preemption,omitempty"` // Make interactive requests wait instead of preempting background ones
+}
 
-	sessionReq := SessionRequest{
-		AgentSlug: agentSlug,
-	}
+// APIConversationsConfig picks the conversation OpenAI-compatible requests go to
+type APIConversationsConfig struct {
+	Mode          string `json:"mode,omitempty"`           // "shared" (the default), "stateless" or "per_client"
+	KeepStateless bool   `json:"keep_stateless,omitempty"` // Keep stateless conversations on Khoj instead of deleting them after the answer
+}
 
-	jsonData, err := json.Marshal(sessionReq)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal session request: %w", err)
-	}
+// ClientConversationsConfig gives each identified client its own Khoj conversation
+type ClientConversationsConfig struct {
+	Enabled      bool `json:"enabled,omitempty"`
+	GCAfterDays  int  `json:"gc_after_days,omitempty"` // Forget mappings unused this long; 0 keeps them forever
+	DeleteRemote bool `json:"delete_remote,omitempty"` // Also delete the Khoj conversation when its mapping is collected
+}
 
-	req, err := http.NewRequest("POST", apiBase+"/api/chat/sessions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create session request: %w", err)
-	}
+// ClipboardSessionConfig keeps consecutive clipboard AI requests in a temporary conversation of their own
+type ClipboardSessionConfig struct {
+	Enabled      bool   `json:"enabled,omitempty"`
+	Idle         string `json:"idle,omitempty"`          // The session ends after this long without a request; defaults to 10m
+	DeleteRemote bool   `json:"delete_remote,omitempty"` // Also delete the session's Khoj conversation when it ends
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "KhojProvider/1.0")
-	if apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-	}
+// LauncherConfig tunes the launcher endpoints used by Raycast, Alfred and PowerToys Run extensions
+type LauncherConfig struct {
+	Timeout string `json:"timeout,omitempty"` // Per-query limit; defaults to 15s so the launcher never hangs
+}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to create session: %w", err)
-	}
-	defer resp.Body.Close()
+// WarmPromptConfig is a prompt run in the background at startup so its answer is ready the moment it is opened
+type WarmPromptConfig struct {
+	Name    string `json:"name"`
+	Prompt  string `json:"prompt"`            // May use {{date}} and {{username}}
+	Hotkey  string `json:"hotkey,omitempty"`  // Shows the cached answer, e.g. "Ctrl+Alt+B"
+	Refresh string `json:"refresh,omitempty"` // Re-run this often, e.g. "1h"; empty runs it once per start
+	Output  string `json:"output,omitempty"`  // "code" or "first_code" keeps only code blocks
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("session creation failed with status %d: %s", resp.StatusCode, string(body))
-	}
+// LeaderConfig turns one hotkey into a prefix: press it, then a second key picks the action
+type LeaderConfig struct {
+	Key     string            `json:"key,omitempty"`     // Leader hotkey; defaults to the clipboard AI hotkey
+	Timeout string            `json:"timeout,omitempty"` // How long to wait for the second key, e.g. "2s"
+	Actions map[string]string `json:"actions"`           // Second key -> action, e.g. "S": "template:summarize"
+}
 
-	var sessionResp SessionResponse
-	if err := json.NewDecoder(resp.Body).Decode(&sessionResp); err != nil {
-		return "", fmt.Errorf("failed to decode session response: %w", err)
-	}
+// ThemeConfig sets the look of the dashboard and popup windows
+type ThemeConfig struct {
+	Mode   string `json:"mode,omitempty"`   // "system" (default) follows the OS dark-mode setting; "light" or "dark" fixes it
+	Accent string `json:"accent,omitempty"` // Hex color for primary buttons, links, focus rings and checkboxes, e.g. "#2b7de9"
+}
 
-	return sessionResp.ConversationID, nil
+// DigestConfig schedules a daily summary from Khoj; the digest runs only when this section is present
+type DigestConfig struct {
+	Time    string   `json:"time,omitempty"`    // Local time of day, e.g. "07:30"; defaults to 08:00
+	Prompt  string   `json:"prompt,omitempty"`  // May use {{date}} and {{username}}; defaults to a notes and automations summary
+	Deliver []string `json:"deliver,omitempty"` // notification, dashboard and/or file; defaults to notification and dashboard
+	Dir     string   `json:"dir,omitempty"`     // Folder for file delivery; defaults to "digests"
+	Format  string   `json:"format,omitempty"`  // File format: markdown (default) or html
 }
 
-// initializeConversationID sets up the conversation ID based on command-line flags and saved state
-func initializeConversationID() error {
-	// Parse command-line flags
-	flag.Parse()
+// RetryConfig bounds how often a failed Khoj call is retried
+type RetryConfig struct {
+	MaxAttempts int `json:"max_attempts,omitempty"` // Attempts per Khoj call, including the first; defaults to 3
+}
 
-	// Check for conversation ID override from command line
-	if *flagConversationID != "" {
-		conversationID = *flagConversationID
-		log.Printf("Using conversation ID from command line: %s", conversationID)
-		return nil
-	}
+// HedgeConfig sends a second Khoj request when the first is slow to respond, keeping whichever answers first
+type HedgeConfig struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Delay   string `json:"delay,omitempty"` // Wait this long for the first response byte before hedging; defaults to 10s
+}
 
-	// Check for new conversation flag
-	newConversation = *flagNewConversation
-	if newConversation {
-		log.Printf("Will create new conversation when server starts")
-		return nil
-	}
+// PrivacyConfig keeps prompts and responses off the disk and out of the logs
+type PrivacyConfig struct {
+	Enabled bool `json:"enabled,omitempty"` // Start in privacy mode; the tray toggle lasts until the app quits
+}
 
-	// Load conversation state from file
-	state, err := loadConversationState()
-	if err != nil {
-		return fmt.Errorf("failed to load conversation state: %w", err)
-	}
+// LocalModelConfig answers with a local OpenAI-compatible server, such as llama.cpp's, when Khoj can't be used
+type LocalModelConfig struct {
+	URL     string `json:"url"`               // Base URL of the server's OpenAI API, e.g. http://127.0.0.1:8080/v1
+	Model   string `json:"model,omitempty"`   // Model name sent to the server and shown when it answers (default "local")
+	APIKey  string `json:"api_key,omitempty"` // Bearer token, for servers started with one
+	Privacy bool   `json:"privacy,omitempty"` // Answer every request locally while privacy mode is on, never calling Khoj
+	Timeout string `json:"timeout,omitempty"` // Per-request timeout (default 5m); answers on a CPU are slow
+}
 
-	if state.LastConversationID == "" {
-		log.Printf("No saved conversation found, will create new conversation when server starts")
-		newConversation = true
-		// Set default agent slug if not set
-		if currentAgentSlug == "" {
-			currentAgentSlug = defaultAgentSlug
-		}
-		return nil
-	}
+// StateSyncConfig shares the conversation state between machines through a synced folder or a remote KV endpoint
+type StateSyncConfig struct {
+	Folder   string `json:"folder,omitempty"`   // A folder synced by Dropbox, OneDrive or similar
+	URL      string `json:"url,omitempty"`      // GET returns the state with an ETag; PUT with If-Match stores it or answers 412
+	Token    string `json:"token,omitempty"`    // Bearer token for url
+	Interval string `json:"interval,omitempty"` // How often to check for changes from other machines (default 30s)
+}
 
-	conversationID = state.LastConversationID
-	if state.AgentSlug != "" {
-		currentAgentSlug = state.AgentSlug
-	} else {
-		currentAgentSlug = defaultAgentSlug
-	}
-	log.Printf("Using saved conversation ID: %s (created: %s)", conversationID, state.CreatedAt.Format(time.RFC3339))
-	log.Printf("Using agent slug: %s", currentAgentSlug)
-	return nil
+// TeamConfig fetches a signed overlay a team admin publishes: read-only templates, agent aliases and deny rules
+type TeamConfig struct {
+	URL       string `json:"url"`               // HTTPS URL of the signed overlay file
+	PublicKey string `json:"public_key"`        // Base64 Ed25519 key the overlay must be signed with
+	Refresh   string `json:"refresh,omitempty"` // How often to fetch it again (default 1h)
 }
 
-// createNewConversationFromMenu creates a new conversation and updates the menu
-func createNewConversationFromMenu() error {
-	apiBase := os.Getenv("KHOJ_API_BASE")
-	if apiBase == "" {
-		apiBase = "https://app.khoj.dev"
-	}
+// AppPromptConfig adds instructions to clipboard AI prompts made from matching applications
+type AppPromptConfig struct {
+	Apps   []string `json:"apps,omitempty"`   // Process or window class names, as in insertion.targets
+	Target string   `json:"target,omitempty"` // Or a paste target kind: terminal, form, editor or unknown
+	Prefix string   `json:"prefix,omitempty"` // Put before the prompt; template variables are expanded
+	Suffix string   `json:"suffix,omitempty"` // Put after the prompt
+}
 
-	apiKey := os.Getenv("KHOJ_API_KEY")
-	if apiKey == "" {
-		return fmt.Errorf("KHOJ_API_KEY not set")
-	}
+// WorkspaceConfig limits where reviewed edits may be written
+type WorkspaceConfig struct {
+	Roots []string `json:"roots,omitempty"` // Absolute directories; relative edit paths resolve against the first
+}
 
-	newConvID, err := createNewConversation(apiBase, apiKey)
-	if err != nil {
-		return fmt.Errorf("failed to create new conversation: %w", err)
-	}
+// AgentPreset holds default chat completion parameters for one agent; values the request sets win
+type AgentPreset struct {
+	Temperature *float64 `json:"temperature,omitempty"` // 0.3 or lower asks for precise answers, 1.2 or higher for creative ones
+	TopP        *float64 `json:"top_p,omitempty"`       // Passed on to Khoj; only chat models listed in sampling take it
+	Research    bool     `json:"research,omitempty"`    // Send requests in Khoj research mode
+	Verbosity   string   `json:"verbosity,omitempty"`   // one-liner, short or detailed
+	MaxTokens   int      `json:"max_tokens,omitempty"`  // Answers are cut after this many tokens, as with max_tokens in a request
+
+	// Sampling parameters the agent's chat model takes from Khoj: temperature, top_p and seed. A listed temperature is
+	// no longer approximated with an instruction.
+	Sampling []string `json:"sampling,omitempty"`
+}
 
-	conversationID = newConvID
+// IndexConfig controls indexing files to Khoj from the drop window
+type IndexConfig struct {
+	ChunkBytes int `json:"chunk_bytes,omitempty"` // Text files larger than this are indexed in parts; defaults to 1 MiB
+}
 
-	// Save the new conversation state
-	state := &ConversationState{
-		LastConversationID: conversationID,
-		AgentSlug:          currentAgentSlug,
-		CreatedAt:          time.Now(),
-	}
-	if err := saveConversationState(state); err != nil {
-		log.Printf("Warning: Failed to save conversation state: %v", err)
-	}
+// TrayPreviewConfig controls the progress and answer preview shown in the tray tooltip while a response is generated
+type TrayPreviewConfig struct {
+	Disabled bool `json:"disabled,omitempty"` // Keep the tray tooltip static
+	Chars    int  `json:"chars,omitempty"`    // Characters of the answer shown; defaults to 60
+}
 
-	log.Printf("✅ New conversation created from menu: %s", conversationID)
-	return nil
+// TrayStatusConfig controls the live request counts shown in the tray title and tooltip between responses
+type TrayStatusConfig struct {
+	Disabled bool `json:"disabled,omitempty"` // Show the plain app name instead
 }
 
-// getConversationDisplayID returns the last 4 characters of the conversation ID for display
-func getConversationDisplayID() string {
-	if conversationID == "" {
-		return "None"
-	}
-	if len(conversationID) <= 4 {
-		return conversationID
-	}
-	return "..." + conversationID[len(conversationID)-4:]
+// StreamConfig controls how streaming chat completions are relayed from Khoj
+type StreamConfig struct {
+	Buffered bool   `json:"buffered,omitempty"` // Wait for the whole answer and send it in small deltas
+	Status   string `json:"status,omitempty"`   // How Khoj's progress updates reach clients: comment (default), delta or off
+	Journal  bool   `json:"journal,omitempty"`  // Append streamed answers to stream_journal.jsonl as they arrive, for recovery after a crash
 }
 
-// updateConversationID updates the current conversation ID and saves state
-func updateConversationID(newID string) error {
-	if newID == "" {
-		return fmt.Errorf("conversation ID cannot be empty")
-	}
+// LogprobsConfig controls the logprobs synthesized for clients that ask for them
+type LogprobsConfig struct {
+	Disabled bool `json:"disabled,omitempty"` // Return null logprobs even when asked for
+}
 
-	conversationID = newID
+// EmbeddingsConfig picks the backend behind /v1/embeddings
+type EmbeddingsConfig struct {
+	Backend    string `json:"backend,omitempty"`    // local, huggingface or openai; defaults to huggingface when url is set, otherwise local
+	URL        string `json:"url,omitempty"`        // Inference endpoint of Khoj's search model, as set in Khoj's admin panel
+	Token      string `json:"token,omitempty"`      // Bearer token for url
+	Model      string `json:"model,omitempty"`      // Sent to openai endpoints and reported in responses
+	Dimensions int    `json:"dimensions,omitempty"` // Vector size of the local backend; defaults to 384
+}
 
-	// Save the updated conversation state
-	state := &ConversationState{
-		LastConversationID: conversationID,
-		AgentSlug:          currentAgentSlug,
-		CreatedAt:          time.Now(),
-	}
-	if err := saveConversationState(state); err != nil {
-		return fmt.Errorf("failed to save conversation state: %w", err)
-	}
+// ModerationConfig backs /v1/moderations with local filters and, optionally, a Khoj agent
+type ModerationConfig struct {
+	Categories map[string]ModerationFilterConfig `json:"categories,omitempty"` // Keyed by OpenAI category, e.g. "harassment" or "self-harm/intent"
+	Agent      string                            `json:"agent,omitempty"`      // Agent slug that scores inputs no filter flagged
+	Threshold  float64                           `json:"threshold,omitempty"`  // Agent scores at or above this flag an input (default 0.5)
+}
 
-	log.Printf("✅ Conversation ID updated: %s", conversationID)
-	return nil
+// ModerationFilterConfig flags inputs for one moderation category
+type ModerationFilterConfig struct {
+	Words     []string `json:"words,omitempty"`     // Case-insensitive whole words
+	Wordlists []string `json:"wordlists,omitempty"` // Files with one word per line (# comments allowed)
+	Patterns  []string `json:"patterns,omitempty"`  // Regular expressions
 }
 
-// updateAgentSlug updates the current agent slug and saves state
-func updateAgentSlug(newSlug string) error {
-	if newSlug == "" {
-		newSlug = defaultAgentSlug
-	}
+// ScratchpadConfig appends answers to a Markdown file per foreground application or per workspace; it is on only
+// when this section is present
+type ScratchpadConfig struct {
+	Dir        string   `json:"dir,omitempty"`        // Folder for the files; defaults to "scratchpads"
+	By         string   `json:"by,omitempty"`         // "app" (default) or "workspace"
+	Sources    []string `json:"sources,omitempty"`    // clipboard, quick_ask and/or api; defaults to all three
+	Workspaces []string `json:"workspaces,omitempty"` // Absolute project folders; defaults to workspace.roots
+}
 
-	currentAgentSlug = newSlug
+// DedupConfig controls skipping uploads of files Khoj already has from this client
+type DedupConfig struct {
+	Disabled bool `json:"disabled,omitempty"` // Always upload and attach files, even when unchanged
+}
 
-	// Save the updated conversation state
-	state := &ConversationState{
-		LastConversationID: conversationID,
-		AgentSlug:          currentAgentSlug,
-		CreatedAt:          time.Now(),
+// AppConfig holds optional settings loaded from config.json
+type AppConfig struct {
+	Timeout             string                    `json:"timeout,omitempty"`           // Khoj request timeout, e.g. "2m"; KHOJ_TIMEOUT takes precedence
+	ClipboardTimeout    string                    `json:"clipboard_timeout,omitempty"` // Clipboard AI request timeout
+	Hotkey              string                    `json:"hotkey,omitempty"`            // Clipboard AI hotkey, e.g. "Ctrl+Shift+K"
+	QuickAskHotkey      string                    `json:"quick_ask_hotkey,omitempty"`  // Quick-ask popup hotkey, e.g. "Alt+Space"
+	FollowUpHotkey      string                    `json:"follow_up_hotkey,omitempty"`  // Follow-up on the last clipboard AI answer
+	MCPServers          []MCPServerConfig         `json:"mcp_servers,omitempty"`
+	ToolOutput          ToolOutputConfig          `json:"tool_output,omitempty"`
+	ToolExecution       ToolExecutionConfig       `json:"tool_execution,omitempty"`
+	TokenBudget         TokenBudgetConfig         `json:"token_budget,omitempty"`
+	Insertion           InsertionConfig           `json:"insertion,omitempty"`
+	OutputFilter        *OutputFilterConfig       `json:"output_filter,omitempty"`
+	Footer              *FooterConfig             `json:"footer,omitempty"`
+	Templates           []TemplateConfig          `json:"templates,omitempty"`
+	TemplatePacks       TemplatePacksConfig       `json:"template_packs,omitempty"`
+	TerminalSafety      TerminalSafetyConfig      `json:"terminal_safety,omitempty"`
+	Priority            PriorityConfig            `json:"priority,omitempty"`
+	ClientConversations ClientConversationsConfig `json:"client_conversations,omitempty"`
+	APIConversations    APIConversationsConfig    `json:"api_conversations,omitempty"`
+	ClipboardSession    ClipboardSessionConfig    `json:"clipboard_session,omitempty"`
+	Language            LanguageConfig            `json:"language,omitempty"`
+	Launcher            LauncherConfig            `json:"launcher,omitempty"`
+	WarmPrompts         []WarmPromptConfig        `json:"warm_prompts,omitempty"`
+	Digest              *DigestConfig             `json:"digest,omitempty"`
+	Retry               RetryConfig               `json:"retry,omitempty"`
+	Hedge               HedgeConfig               `json:"hedge,omitempty"`
+	Privacy             PrivacyConfig             `json:"privacy,omitempty"`
+	LocalModel          *LocalModelConfig         `json:"local_model,omitempty"`
+	NoInputSimulation   bool                      `json:"no_input_simulation,omitempty"`
+	Dedup               DedupConfig               `json:"dedup,omitempty"`
+	Index               IndexConfig               `json:"index,omitempty"`
+	Annotate            bool                      `json:"annotate,omitempty"`       // Add x_khoj metadata to every chat completion response
+	FallbackAgent       string                    `json:"fallback_agent,omitempty"` // Agent slug used when the current agent fails, e.g. after it was deleted
+	AgentPresets        map[string]AgentPreset    `json:"agent_presets,omitempty"`  // Keyed by agent slug
+	AppPrompts          []AppPromptConfig         `json:"app_prompts,omitempty"`    // The first entry matching the foreground app applies
+	Workspace           WorkspaceConfig           `json:"workspace,omitempty"`
+	StateSync           *StateSyncConfig          `json:"state_sync,omitempty"`
+	Team                *TeamConfig               `json:"team,omitempty"`
+	Leader              *LeaderConfig             `json:"leader,omitempty"`
+	Theme               ThemeConfig               `json:"theme,omitempty"`
+	TrayPreview         TrayPreviewConfig         `json:"tray_preview,omitempty"`
+	TrayStatus          TrayStatusConfig          `json:"tray_status,omitempty"`
+	Stream              StreamConfig              `json:"stream,omitempty"`
+	Logprobs            LogprobsConfig            `json:"logprobs,omitempty"`
+	Embeddings          EmbeddingsConfig          `json:"embeddings,omitempty"`
+	Moderation          ModerationConfig          `json:"moderation,omitempty"`
+	Scratchpad          *ScratchpadConfig         `json:"scratchpad,omitempty"`
+	AccessLog           AccessLogConfig           `json:"access_log,omitempty"`
+	URLFetch            URLFetchConfig            `json:"url_fetch,omitempty"`
+	Features            map[string]bool           `json:"features,omitempty"` // Subsystems switched off with false, keyed by knownFeatures
+}
+
+// configDiagnostic is a problem found in the config or .env file, located by line, column and field path
+type configDiagnostic struct {
+	File    string // Defaults to config.json
+	Line    int
+	Column  int
+	Field   string
+	Message string
+}
+
+func (d configDiagnostic) String() string {
+	file := d.File
+	if file == "" {
+		file = configFile
 	}
-	if err := saveConversationState(state); err != nil {
-		return fmt.Errorf("failed to save conversation state: %w", err)
+	field := d.Field
+	if field == "" {
+		field = "(root)"
+	}
+	if d.File != "" && d.Field == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", file, d.Line, d.Column, d.Message)
+	}
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", file, field, d.Message)
 	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", file, d.Line, d.Column, field, d.Message)
+}
 
-	log.Printf("✅ Agent slug updated: %s", currentAgentSlug)
-	return nil
+// hotkeySpec is a parsed key combination such as Ctrl+Q
+type hotkeySpec struct {
+	Name string
+	Keys []uint16
 }
 
-// openBrowser opens a URL in the default browser across different platforms
-func openBrowser(url string) error {
-	var cmd *exec.Cmd
+// activeHotkey triggers the clipboard AI flow
+var activeHotkey = hotkeySpec{Name: defaultHotkey, Keys: []uint16{VK_CONTROL, VK_Q}}
 
-	switch runtime.GOOS {
-	case "windows":
-		cmd = exec.Command("cmd", "/c", "start", url)
-	case "darwin": // macOS
-		cmd = exec.Command("open", url)
-	case "linux":
-		cmd = exec.Command("xdg-open", url)
-	default:
-		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+// activeFollowUpHotkey asks a follow-up about the last clipboard AI exchange
+var activeFollowUpHotkey = hotkeySpec{Name: defaultFollowUpHotkey, Keys: []uint16{VK_CONTROL, 0x10, VK_Q}}
+
+// activeQuickAskHotkey opens the quick-ask popup
+var activeQuickAskHotkey = hotkeySpec{Name: defaultQuickAskHotkey, Keys: []uint16{VK_CONTROL, 0x10, 0x20}}
+
+// hotkeysMu guards the active hotkeys, which the hotkey API can replace while the poller runs
+var hotkeysMu sync.RWMutex
+
+// configuredHotkeys parses the clipboard, quick ask and follow-up hotkeys from cfg, using defaults for unset ones
+func configuredHotkeys(cfg *AppConfig) (clipboard, quickAsk, followUp hotkeySpec, err error) {
+	parse := func(value, fallback, what string) hotkeySpec {
+		if value == "" {
+			value = fallback
+		}
+		spec, parseErr := parseHotkey(value)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("invalid %s hotkey: %w", what, parseErr)
+		}
+		return spec
 	}
+	clipboard = parse(cfg.Hotkey, defaultHotkey, "clipboard AI")
+	quickAsk = parse(cfg.QuickAskHotkey, defaultQuickAskHotkey, "quick ask")
+	followUp = parse(cfg.FollowUpHotkey, defaultFollowUpHotkey, "follow-up")
+	return clipboard, quickAsk, followUp, err
+}
 
-	return cmd.Run()
+// setActiveHotkeys replaces the hotkeys the poller listens for
+func setActiveHotkeys(clipboard, quickAsk, followUp hotkeySpec) {
+	hotkeysMu.Lock()
+	defer hotkeysMu.Unlock()
+	activeHotkey, activeQuickAskHotkey, activeFollowUpHotkey = clipboard, quickAsk, followUp
 }
 
-// showInputDialog creates a temporary web server to show an input dialog
-func showInputDialog(title, prompt, defaultValue string) (string, error) {
-	// Find an available port
-	listener, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return "", fmt.Errorf("failed to find available port: %w", err)
+// currentHotkeys returns the clipboard, quick ask and follow-up hotkeys in effect
+func currentHotkeys() (clipboard, quickAsk, followUp hotkeySpec) {
+	hotkeysMu.RLock()
+	defer hotkeysMu.RUnlock()
+	return activeHotkey, activeQuickAskHotkey, activeFollowUpHotkey
+}
+
+// warmHotkey binds a hotkey to the cached answer of a warm prompt
+type warmHotkey struct {
+	Prompt string
+	Spec   hotkeySpec
+}
+
+// configuredWarmHotkeys parses the warm prompt hotkeys from cfg, skipping prompts without a valid one
+func configuredWarmHotkeys(cfg *AppConfig) []warmHotkey {
+	var keys []warmHotkey
+	for _, p := range cfg.WarmPrompts {
+		if p.Hotkey == "" {
+			continue
+		}
+		if spec, err := parseHotkey(p.Hotkey); err == nil {
+			keys = append(keys, warmHotkey{Prompt: p.Name, Spec: spec})
+		}
 	}
-	port := listener.Addr().(*net.TCPAddr).Port
-	listener.Close()
+	return keys
+}
 
-	// Channel to receive the result
-	resultCh := make(chan string, 1)
-	errorCh := make(chan error, 1)
+// outputFilter is the compiled form of OutputFilterConfig
+type outputFilter struct {
+	patterns []*textFilter
+	block    bool
+	mask     string
+}
 
-	// Create HTTP server
-	mux := http.NewServeMux()
+// activeOutputFilter is nil when no output filter is configured
+var activeOutputFilter *outputFilter
 
-	// Serve the input form
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		html := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head>
-    <title>%s</title>
-    <style>
-        body { font-family: Arial, sans-serif; margin: 50px; background: #f5f5f5; }
-        .container { background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); max-width: 500px; margin: 0 auto; }
-        h2 { color: #333; margin-bottom: 20px; }
-        input[type="text"] { width: 100%%; padding: 10px; border: 1px solid #ddd; border-radius: 4px; font-size: 16px; margin: 10px 0; }
-        button { background: #007cba; color: white; padding: 12px 24px; border: none; border-radius: 4px; cursor: pointer; font-size: 16px; margin-right: 10px; }
-        button:hover { background: #005a87; }
-        .cancel { background: #666; }
-        .cancel:hover { background: #444; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h2>%s</h2>
-        <form method="POST" action="/submit">
-            <p>%s</p>
-            <input type="text" name="value" value="%s" required autofocus>
-            <br><br>
-            <button type="submit">OK</button>
-            <button type="button" class="cancel" onclick="window.close()">Cancel</button>
-        </form>
-    </div>
-    <script>
-        // Auto-select the input text
-        document.querySelector('input[name="value"]').select();
-        // Handle form submission
-        document.querySelector('form').onsubmit = function(e) {
-            e.preventDefault();
-            fetch('/submit', {
-                method: 'POST',
-                body: new FormData(this)
-            }).then(() => {
-                window.close();
-            });
-        };
-    </script>
-</body>
-</html>`, title, title, prompt, defaultValue)
+// activeModerationFilters holds the compiled moderation filters by category
+var activeModerationFilters map[string][]*textFilter
 
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(html))
-	})
+// responseFooter is the compiled form of FooterConfig
+type responseFooter struct {
+	text     string
+	sources  bool
+	suppress []*regexp.Regexp
+	targets  map[string]bool
+}
 
-	// Handle form submission
-	mux.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			value := r.FormValue("value")
-			resultCh <- value
-			w.Write([]byte("OK - You can close this window"))
-		}
-	})
+// activeFooter is nil when no footer handling is configured
+var activeFooter *responseFooter
 
-	server := &http.Server{
-		Addr:    ":" + strconv.Itoa(port),
-		Handler: mux,
-	}
+// Output modes that reduce a response to its code blocks
+const (
+	outputModeFull      = "full"
+	outputModeCode      = "code"       // All code blocks, concatenated
+	outputModeFirstCode = "first_code" // Only the first code block
+	outputModeJSON      = "json"       // A single JSON value, repaired if truncated
+)
 
-	// Start server in background
-	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			errorCh <- err
-		}
-	}()
+// Post-process hook error handling and limits
+const (
+	postProcessFail           = "fail"
+	postProcessKeep           = "keep"
+	defaultPostProcessTimeout = 10 * time.Second
+	defaultPostProcessOutput  = 1 << 20
+)
 
-	// Open browser
-	url := fmt.Sprintf("http://localhost:%d", port)
-	go func() {
-		time.Sleep(100 * time.Millisecond) // Give server time to start
-		if err := openBrowser(url); err != nil {
-			log.Printf("Failed to open browser: %v", err)
-		}
-	}()
+// postProcessEnvAllowlist is the environment a post-process command gets without inherit_env; API keys stay out
+var postProcessEnvAllowlist = []string{"PATH", "PATHEXT", "SYSTEMROOT", "WINDIR", "COMSPEC", "TEMP", "TMP", "TMPDIR", "HOME", "USERPROFILE", "LANG", "LC_ALL", "LC_CTYPE"}
 
-	// Wait for result or timeout
-	select {
-	case result := <-resultCh:
-		server.Close()
-		return result, nil
-	case err := <-errorCh:
-		server.Close()
-		return "", err
-	case <-time.After(5 * time.Minute): // 5 minute timeout
-		server.Close()
-		return "", fmt.Errorf("input dialog timed out")
-	}
+// verbosityPreset adjusts the instruction sent with a prompt and caps the answer's length
+type verbosityPreset struct {
+	Instruction string
+	MaxChars    int
 }
 
-// editConversationIDDialog shows a dialog to edit the conversation ID
-func editConversationIDDialog() error {
-	currentID := conversationID
-	if currentID == "" {
-		currentID = "No conversation ID set"
+// withAgentPreset returns a copy of req with the agent's preset filling in the parameters the request left unset
+func withAgentPreset(req *ChatCompletionRequest, agent string) *ChatCompletionRequest {
+	preset, ok := appConfig().AgentPresets[agent]
+	if !ok {
+		return req
 	}
-
-	newID, err := showInputDialog(
-		"Edit Conversation ID",
-		"Enter the new conversation ID:",
-		currentID,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to show input dialog: %w", err)
+	merged := *req
+	if merged.Temperature == nil {
+		merged.Temperature = preset.Temperature
 	}
-
-	if newID == "" || newID == currentID {
-		return nil // User cancelled or no change
+	if merged.TopP == nil {
+		merged.TopP = preset.TopP
+	}
+	merged.Research = merged.Research || preset.Research
+	if merged.Verbosity == "" {
+		merged.Verbosity = preset.Verbosity
 	}
+	if merged.MaxTokens == 0 {
+		merged.MaxTokens = preset.MaxTokens
+	}
+	return &merged
+}
 
-	return updateConversationID(newID)
+// temperatureInstruction approximates a sampling temperature with an instruction, for chat models that do not take one
+func temperatureInstruction(temperature *float64) string {
+	switch {
+	case temperature == nil:
+	case *temperature <= 0.3:
+		return "Answer precisely and consistently, without speculating."
+	case *temperature >= 1.2:
+		return "Feel free to be creative and to explore unusual ideas."
+	}
+	return ""
 }
 
-// editAgentSlugDialog shows a dialog to edit the agent slug
-func editAgentSlugDialog() error {
-	currentSlug := currentAgentSlug
-	if currentSlug == "" {
-		currentSlug = defaultAgentSlug
-	}
+// Sampling parameters a chat completion can pass on to Khoj
+const (
+	samplingTemperature = "temperature"
+	samplingTopP        = "top_p"
+	samplingSeed        = "seed"
+)
 
-	newSlug, err := showInputDialog(
-		"Edit Agent Slug",
-		"Enter the new agent slug (e.g., sonnet-short-025716, gpt-4o-mini):",
-		currentSlug,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to show input dialog: %w", err)
+// Ways the wrapper handles a request parameter for an agent, as reported by /status
+const (
+	paramForwarded    = "forwarded"    // Passed on to Khoj, and the agent's chat model takes it
+	paramApproximated = "approximated" // Turned into an instruction in the prompt
+	paramEnforced     = "enforced"     // Applied by the wrapper to Khoj's answer
+	paramIgnored      = "ignored"      // Passed on to Khoj, which does not apply it for the agent
+)
+
+// agentSamples reports whether the agent's preset lists a sampling parameter its chat model takes
+func agentSamples(agent, param string) bool {
+	for _, p := range appConfig().AgentPresets[agent].Sampling {
+		if p == param {
+			return true
+		}
 	}
+	return false
+}
 
-	if newSlug == "" || newSlug == currentSlug {
-		return nil // User cancelled or no change
+// samplingSupport maps each parameter affecting an answer to how the wrapper honors it for an agent
+func samplingSupport(agent string) map[string]string {
+	support := map[string]string{
+		samplingTemperature: paramApproximated,
+		samplingTopP:        paramIgnored,
+		samplingSeed:        paramIgnored,
+		"max_tokens":        paramEnforced,
+		"stop":              paramEnforced,
+	}
+	for _, param := range []string{samplingTemperature, samplingTopP, samplingSeed} {
+		if agentSamples(agent, param) {
+			support[param] = paramForwarded
+		}
 	}
+	return support
+}
 
-	return updateAgentSlug(newSlug)
+// StatusResponse is the body of GET /status
+type StatusResponse struct {
+	Status   string                       `json:"status"`
+	Version  string                       `json:"version"`
+	Agent    string                       `json:"agent"`
+	Sampling map[string]map[string]string `json:"sampling"` // Agent slug -> parameter -> forwarded, approximated, enforced or ignored
+	Team     *TeamStatus                  `json:"team,omitempty"`
+	Local    *LocalModelStatus            `json:"local_model,omitempty"`
 }
 
-// Windows-specific clipboard and keyboard functions
-func getClipboardText() (string, error) {
-	if runtime.GOOS != "windows" {
-		return "", fmt.Errorf("clipboard functionality only available on Windows")
-	}
+// LocalModelStatus describes the configured local model and whether it is answering in Khoj's place
+type LocalModelStatus struct {
+	Model     string     `json:"model"`
+	Answering bool       `json:"answering"`
+	Reason    string     `json:"reason,omitempty"` // unreachable or privacy, while answering
+	Since     *time.Time `json:"since,omitempty"`
+}
 
-	r1, _, err := procOpenClipboard.Call(0)
-	if r1 == 0 {
-		return "", fmt.Errorf("failed to open clipboard: %v", err)
-	}
-	defer procCloseClipboard.Call()
+// TeamStatus describes the team overlay in effect
+type TeamStatus struct {
+	Name      string    `json:"name,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Templates int       `json:"templates"`
+	Agents    int       `json:"agents"`
+	DenyRules int       `json:"deny_rules"`
+}
 
-	h, _, err := procGetClipboardData.Call(CF_UNICODETEXT)
-	if h == 0 {
-		return "", fmt.Errorf("failed to get clipboard data: %v", err)
+// serverStatus reports the current agent and, for it, the listed agents and those with a preset, how the request
+// parameters are honored
+func serverStatus() StatusResponse {
+	status := StatusResponse{
+		Status:   "healthy",
+		Version:  version,
+		Agent:    currentAgentSlug,
+		Sampling: map[string]map[string]string{currentAgentSlug: samplingSupport(currentAgentSlug)},
 	}
-
-	l, _, err := procGlobalLock.Call(h)
-	if l == 0 {
-		return "", fmt.Errorf("failed to lock global memory: %v", err)
+	agentListMu.Lock()
+	for _, a := range agentList {
+		status.Sampling[a.Slug] = samplingSupport(a.Slug)
 	}
-	defer procGlobalUnlock.Call(h)
-
-	text := safeUTF16ToString(l, 1<<20)
-	return text, nil
+	agentListMu.Unlock()
+	for agent := range appConfig().AgentPresets {
+		status.Sampling[agent] = samplingSupport(agent)
+	}
+	if team := currentTeam(); team != nil {
+		status.Team = &TeamStatus{Name: team.Name, Version: team.Version, FetchedAt: team.FetchedAt, Templates: len(team.Templates), Agents: len(team.Agents), DenyRules: len(team.Deny)}
+	}
+	if lm := appConfig().LocalModel; lm != nil {
+		status.Local = &LocalModelStatus{Model: lm.model()}
+		if reason, since := localModelAnswering(); reason != "" {
+			status.Local.Answering, status.Local.Reason, status.Local.Since = true, reason, &since
+		}
+	}
+	return status
 }
 
-func sendText(text string) error {
-	if runtime.GOOS != "windows" {
-		return fmt.Errorf("text sending only available on Windows")
+// samplingError checks temperature and top_p against OpenAI's ranges
+func (req *ChatCompletionRequest) samplingError() error {
+	switch {
+	case req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2):
+		return fmt.Errorf("temperature must be between 0 and 2, got %g", *req.Temperature)
+	case req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1):
+		return fmt.Errorf("top_p must be between 0 and 1, got %g", *req.TopP)
 	}
+	return nil
+}
 
-	log.Printf("📝 Sending %d characters to cursor position...", len(text))
+// maxAnswerChars is the length cap of a verbosity preset; 0 means no cap. max_tokens is enforced separately, see
+// truncateToTokens.
+func maxAnswerChars(verbosity string) int {
+	return verbosityPresets[verbosity].MaxChars
+}
 
-	// Try multiple approaches for better reliability
+// verbosityPresets are selected per template or with a slash command of the same name
+var verbosityPresets = map[string]verbosityPreset{
+	"one-liner": {Instruction: "Answer in a single sentence.", MaxChars: 240},
+	"short":     {Instruction: "Answer briefly, in at most three sentences.", MaxChars: 600},
+	"detailed":  {Instruction: "Give a detailed, thorough answer.", MaxChars: 8000},
+}
 
-	// Method 1: Try clipboard + Ctrl+V approach
-	log.Printf("🔄 Trying clipboard + Ctrl+V method...")
-	err := setClipboardText(text)
-	if err != nil {
-		log.Printf("⚠️ Failed to set clipboard: %v", err)
-	} else {
-		// Small delay to ensure clipboard is set
-		time.Sleep(100 * time.Millisecond)
+// Response targets that post-processing can be limited to
+const (
+	responseTargetAPI       = "api"
+	responseTargetClipboard = "clipboard"
+)
 
-		err = simulateCtrlV()
-		if err != nil {
-			log.Printf("⚠️ Failed to simulate Ctrl+V: %v", err)
-		} else {
-			log.Printf("✅ Clipboard + Ctrl+V method succeeded")
-			return nil
-		}
-	}
+type KhojProvider struct {
+	APIBase    string
+	APIKey     string
+	HTTPClient *http.Client
+	MCPManager *MCPToolManager
 
-	// Method 2: Try direct window message approach
-	log.Printf("🔄 Trying direct window message method...")
-	err = sendTextViaWindowMessage(text)
-	if err != nil {
-		log.Printf("⚠️ Window message method failed: %v", err)
-	} else {
-		log.Printf("✅ Window message method succeeded")
-		return nil
-	}
+	// toolSlots bounds the MCP tool calls running at once; see runToolCalls
+	toolSlots chan struct{}
 
-	// Method 3: Fallback to character-by-character typing
-	log.Printf("🔄 Falling back to character-by-character typing...")
-	return sendTextCharByChar(text)
+	// Scratch conversations keyed by agent slug, used for side tasks like summarization
+	scratchConversations map[string]string
+	scratchMu            sync.Mutex
 }
 
-func setClipboardText(text string) error {
-	// Open clipboard
-	r1, _, err := procOpenClipboard.Call(0)
-	if r1 == 0 {
-		return fmt.Errorf("failed to open clipboard: %v", err)
-	}
-	defer procCloseClipboard.Call()
+type MCPToolManager struct {
+	Sessions map[string]*MCPSession
+	Status   map[string]*MCPServerStatus
+	mu       sync.Mutex
+	closed   bool // Set by StopAll to suppress pending restarts
+}
 
-	// Clear clipboard
-	user32.NewProc("EmptyClipboard").Call()
+// MCPServerStatus reports the health of a supervised MCP server
+type MCPServerStatus struct {
+	Name    string
+	State   string // starting, running, restarting, failed, stopped
+	Tools   int
+	Crashes int // Consecutive crashes since the last stable run
+	LastErr string
+}
 
-	// Convert text to UTF16
-	utf16Text := safeStringToUTF16(text)
+// Custom instructions prepended to every request in a conversation, independent of the agent persona
+var (
+	instructionsMu           sync.Mutex
+	conversationInstructions = make(map[string]string)
+)
 
-	// Allocate global memory
-	globalAlloc := kernel32.NewProc("GlobalAlloc")
-	globalLock := kernel32.NewProc("GlobalLock")
-	globalUnlock := kernel32.NewProc("GlobalUnlock")
+// Global variables for conversation management
+var (
+	conversationID   string
+	currentAgentSlug string
+	newConversation  bool
+)
 
-	size := len(utf16Text) * 2                            // 2 bytes per UTF16 character
-	hMem, _, _ := globalAlloc.Call(0x2000, uintptr(size)) // GMEM_MOVEABLE
-	if hMem == 0 {
-		return fmt.Errorf("failed to allocate global memory")
-	}
+// activeConfig holds the loaded config. Live settings saves replace it while handlers, the tray and schedulers read
+// it, so it is only read through appConfig and only replaced with Store, never changed in place.
+var activeConfig atomic.Pointer[AppConfig]
 
-	pMem, _, _ := globalLock.Call(hMem)
-	if pMem == 0 {
-		return fmt.Errorf("failed to lock global memory")
+// appConfig() returns the active config, or an empty one before config.json is loaded. Callers must not modify it.
+func appConfig() *AppConfig {
+	if cfg := activeConfig.Load(); cfg != nil {
+		return cfg
 	}
+	return &emptyAppConfig
+}
 
-	// Copy text to global memory
-	for i, char := range utf16Text {
-		*(*uint16)(unsafe.Pointer(pMem + uintptr(i*2))) = char
-	}
+var emptyAppConfig AppConfig
 
-	globalUnlock.Call(hMem)
+// version is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
 
-	// Set clipboard data
-	setClipboardData := user32.NewProc("SetClipboardData")
-	r2, _, _ := setClipboardData.Call(CF_UNICODETEXT, hMem)
-	if r2 == 0 {
-		return fmt.Errorf("failed to set clipboard data")
-	}
+// Command-line flags
+var (
+	flagNewConversation = flag.Bool("n", false, "Start a new conversation")
+	flagConversationID  = flag.String("conversation-id", "", "Override conversation ID")
 
-	return nil
-}
+	flagNoInputSimulation = flag.Bool("no-input-simulation", false, "Disable typing, keyboard hooks and clipboard writes; only serve the HTTP API")
+)
 
-func simulateCtrlV() error {
-	log.Printf("🔄 Simulating Ctrl+V keypress...")
+const (
+	conversationStateFile    = "conversation_state.json"
+	configFile               = "config.json"
+	envFile                  = ".env" // Optional KEY=VALUE file next to config.json
+	sharedLinksFile          = "shared_links.json"
+	clientMappingsFile       = "client_conversations.db" // SQLite table of per-client conversations
+	legacyClientMappingsFile = "client_conversations.json"
+	digestFile               = "digest.json"           // Latest daily digest, shown on the dashboard
+	uploadedFilesFile        = "uploaded_files.json"   // Content hashes of files indexed to Khoj
+	apiFilesFile             = "api_files.json"        // Files uploaded through /v1/files, by ID
+	apiFilesDir              = "api_files"             // Their content, kept for attaching to chat requests
+	streamJournalFile        = "stream_journal.jsonl"  // Answers being streamed, with stream.journal
+	interruptedFile          = "interrupted.json"      // Answers recovered from the stream journal, kept for the transcript
+	windowPlacementsFile     = "window_placement.json" // Popup positions and sizes per monitor
+	secretTargetPrefix       = "khoj-wrapper/"
+	defaultAgentSlug         = "sonnet-short-025716"
+	clipboardTimeout         = 30 * time.Second
+	clipboardSessionIdle     = 10 * time.Minute
+	launcherTimeout          = 15 * time.Second
+	defaultMaxAttempts       = 3
+	defaultHedgeDelay        = 10 * time.Second
+	defaultIndexChunkBytes   = 1 << 20
+	defaultStateSyncInterval = 30 * time.Second
+	defaultTeamRefresh       = time.Hour
+	defaultTeamValidity      = 30 * 24 * time.Hour // How long `team sign` makes an overlay apply
+	defaultLocalModelTimeout = 5 * time.Minute
+	defaultTimeout           = 120 * time.Second
+	defaultHotkey            = "Ctrl+Q"
+	defaultQuickAskHotkey    = "Ctrl+Shift+Space"
+	defaultFollowUpHotkey    = "Ctrl+Shift+Q"
+	quickAskTitle            = "Khoj Quick Ask" // Popup page title, used to find its window
+	diffPreviewTitle         = "Khoj Diff Preview"
+	warmAnswerTitle          = "Khoj Warm Answer"
+	aiClipboardTitle         = "Khoj AI Clipboard"
+	diffPreviewTimeout       = 5 * time.Minute
+	defaultChunkTokens       = 2000
+	defaultInsertChunk       = 1500
+	defaultInsertPause       = 700 * time.Millisecond
+	defaultStopKey           = "Esc"
+	defaultClipboardRetries  = 3
+	defaultClipboardSettle   = 250 * time.Millisecond
+	clipboardPollInterval    = 20 * time.Millisecond
+	defaultLeaderTimeout     = 1500 * time.Millisecond
+	defaultThemeMode         = "system"
+	defaultAccent            = "#2b7de9"
+	defaultTrayPreviewChars  = 60
+	maxTrayPreviewChars      = 100                    // Leaves room for the source label in the tooltip
+	maxTrayTooltipBytes      = 127                    // Windows tooltips hold 127 UTF-16 units, never more than the UTF-8 bytes
+	trayPreviewInterval      = 250 * time.Millisecond // Preview updates of one response are throttled to this
+	trayPreviewLinger        = 5 * time.Second        // A finished answer stays in the tooltip as long as a notification
+	khojResearchCommand      = "/research"            // Khoj's own query prefix for research mode
+
+	// Request prioritization
+	defaultMaxConcurrent = 4
+	maxPreemptions       = 5 // Requeues before a background request gives up
+
+	// Per-subscriber event bus buffer
+	eventBufferSize = 64
+
+	// Background workers get this long to return after Quit
+	workerShutdownTimeout = 5 * time.Second
+
+	// MCP supervision
+	mcpStableRunTime     = 2 * time.Minute // Uptime after which the crash counter resets
+	mcpMaxRestarts       = 10
+	mcpCrashNotifyAfter  = 3
+	mcpMaxRestartBackoff = time.Minute
+)
 
-	// Simulate Ctrl+V keypress with proper key sequence
+// Windows API declarations for clipboard and keyboard monitoring
+var (
+	user32               *lazyDLL
+	kernel32             *lazyDLL
+	procGetClipboardData *lazyProc
+	procOpenClipboard    *lazyProc
+	procClipboardSeq     *lazyProc
+	procCloseClipboard   *lazyProc
+	procGlobalLock       *lazyProc
+	procGlobalUnlock     *lazyProc
+	procSendInput        *lazyProc
+	procMessageBox       *lazyProc
+	advapi32             *lazyDLL
+	procCredReadW        *lazyProc
+	procCredWriteW       *lazyProc
+	procCredFree         *lazyProc
+	iphlpapi             *lazyDLL
+	shcore               *lazyDLL
+	procNotifyAddrChange *lazyProc
+)
 
-	// Key down: Ctrl
-	ctrlDown := INPUT{
-		Type: INPUT_KEYBOARD,
-		Ki: KEYBDINPUT{
-			WVk:     VK_CONTROL,
-			DwFlags: 0, // Key down
-		},
+func init() {
+	if runtime.GOOS == "windows" {
+		user32 = newLazyDLL("user32.dll")
+		kernel32 = newLazyDLL("kernel32.dll")
+		procGetClipboardData = user32.NewProc("GetClipboardData")
+		procOpenClipboard = user32.NewProc("OpenClipboard")
+		procClipboardSeq = user32.NewProc("GetClipboardSequenceNumber")
+		procCloseClipboard = user32.NewProc("CloseClipboard")
+		procGlobalLock = kernel32.NewProc("GlobalLock")
+		procGlobalUnlock = kernel32.NewProc("GlobalUnlock")
+		procSendInput = user32.NewProc("SendInput")
+		procMessageBox = user32.NewProc("MessageBoxW")
+		advapi32 = newLazyDLL("advapi32.dll")
+		procCredReadW = advapi32.NewProc("CredReadW")
+		procCredWriteW = advapi32.NewProc("CredWriteW")
+		procCredFree = advapi32.NewProc("CredFree")
+		iphlpapi = newLazyDLL("iphlpapi.dll")
+		procNotifyAddrChange = iphlpapi.NewProc("NotifyAddrChange")
+		shcore = newLazyDLL("shcore.dll")
 	}
+}
 
-	// Key down: V
-	vDown := INPUT{
-		Type: INPUT_KEYBOARD,
-		Ki: KEYBDINPUT{
-			WVk:     0x56, // V key
-			DwFlags: 0,    // Key down
-		},
+// Cross-platform safe syscall wrappers
+func safeUTF16PtrFromString(s string) (uintptr, error) {
+	if runtime.GOOS != "windows" {
+		return 0, fmt.Errorf("Windows-only function")
 	}
+	ptr, err := utf16PtrFromString(s)
+	return uintptr(unsafe.Pointer(ptr)), err
+}
 
-	// Key up: V
-	vUp := INPUT{
-		Type: INPUT_KEYBOARD,
-		Ki: KEYBDINPUT{
-			WVk:     0x56, // V key
-			DwFlags: KEYEVENTF_KEYUP,
-		},
+func safeUTF16ToString(p uintptr, maxLen int) string {
+	if runtime.GOOS != "windows" {
+		return ""
 	}
+	return utf16ToString((*[1 << 20]uint16)(unsafe.Pointer(p))[:maxLen])
+}
 
-	// Key up: Ctrl
-	ctrlUp := INPUT{
-		Type: INPUT_KEYBOARD,
-		Ki: KEYBDINPUT{
-			WVk:     VK_CONTROL,
-			DwFlags: KEYEVENTF_KEYUP,
-		},
+func safeStringToUTF16(s string) []uint16 {
+	if runtime.GOOS != "windows" {
+		return nil
 	}
+	return utf16.Encode([]rune(s + "\x00"))
+}
 
-	// Send Ctrl down
-	ret1, _, _ := procSendInput.Call(1, uintptr(unsafe.Pointer(&ctrlDown)), unsafe.Sizeof(ctrlDown))
-	log.Printf("🔄 Ctrl down result: %d", ret1)
+// utf16PtrFromString returns a NUL-terminated UTF-16 copy of s without depending on the Windows-only syscall helpers
+func utf16PtrFromString(s string) (*uint16, error) {
+	if strings.IndexByte(s, 0) >= 0 {
+		return nil, fmt.Errorf("string contains a NUL byte")
+	}
+	encoded := utf16.Encode([]rune(s + "\x00"))
+	return &encoded[0], nil
+}
 
-	// Small delay
-	time.Sleep(50 * time.Millisecond)
+// utf16ToString decodes s up to its first NUL
+func utf16ToString(s []uint16) string {
+	for i, v := range s {
+		if v == 0 {
+			s = s[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(s))
+}
 
-	// Send V down
-	ret2, _, _ := procSendInput.Call(1, uintptr(unsafe.Pointer(&vDown)), unsafe.Sizeof(vDown))
-	log.Printf("🔄 V down result: %d", ret2)
+// Windows constants
+const (
+	VK_Q                  = 0x51
+	VK_CONTROL            = 0x11
+	VK_SHIFT              = 0x10
+	VK_INSERT             = 0x2D
+	CF_UNICODETEXT        = 13
+	INPUT_KEYBOARD        = 1
+	KEYEVENTF_EXTENDEDKEY = 0x0001
+	KEYEVENTF_KEYUP       = 0x0002
+)
 
-	// Small delay
-	time.Sleep(50 * time.Millisecond)
+// Windows structures
+type INPUT struct {
+	Type uint32
+	Ki   KEYBDINPUT
+}
 
-	// Send V up
-	ret3, _, _ := procSendInput.Call(1, uintptr(unsafe.Pointer(&vUp)), unsafe.Sizeof(vUp))
-	log.Printf("🔄 V up result: %d", ret3)
+type KEYBDINPUT struct {
+	WVk         uint16
+	WScan       uint16
+	DwFlags     uint32
+	Time        uint32
+	DwExtraInfo uintptr
+}
 
-	// Small delay
-	time.Sleep(50 * time.Millisecond)
+// CREDENTIALW structure used by the Windows Credential Manager
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        [2]uint32 // FILETIME
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
 
-	// Send Ctrl up
-	ret4, _, _ := procSendInput.Call(1, uintptr(unsafe.Pointer(&ctrlUp)), unsafe.Sizeof(ctrlUp))
-	log.Printf("🔄 Ctrl up result: %d", ret4)
+// Global variables for clipboard monitoring
+var (
+	clipboardActive bool
 
-	if ret1 == 0 || ret2 == 0 || ret3 == 0 || ret4 == 0 {
-		return fmt.Errorf("SendInput failed - results: %d,%d,%d,%d", ret1, ret2, ret3, ret4)
-	}
+	// lastExchange is the most recent answered clipboard AI request, reused by the follow-up hotkey
+	lastExchange   clipboardExchange
+	lastExchangeMu sync.Mutex
+)
 
-	log.Printf("✅ Ctrl+V simulation completed successfully")
-	return nil
+// clipboardRequest is a prompt ready to send from the clipboard AI flow, with how to treat the answer
+type clipboardRequest struct {
+	Prompt     string
+	Commands   promptCommands
+	OutputMode string
+	MaxChars   int
+	Exchange   clipboardExchange // Remembered for follow-ups once answered
+	Review     bool              // Show a word diff against Exchange.Content before inserting
+	Language   languageGuess
+	Window     uintptr // Foreground window when the hotkey was pressed, refocused after the preview
+
+	PostProcess *PostProcessConfig
 }
 
-func sendTextViaWindowMessage(text string) error {
-	log.Printf("🔄 Sending text via window messages...")
+// clipboardExchange is one clipboard AI request and the answer that was inserted
+type clipboardExchange struct {
+	Content   string // Clipboard text, empty for follow-ups
+	Request   string // Instructions typed into the dialog
+	Response  string
+	Origin    scratchpadOrigin // Where the request was made; follow-ups keep the original's
+	Citations string           // Citation style of the template used; follow-ups keep the original's
+	RichText  string           // Rich text mode of the template used; follow-ups keep the original's
+}
 
-	// Get the foreground window (where the cursor is)
-	getForegroundWindow := user32.NewProc("GetForegroundWindow")
-	sendMessage := user32.NewProc("SendMessageW")
+// loadConversationState loads the conversation state from JSON file
+func loadConversationState() (*ConversationState, error) {
+	data, err := os.ReadFile(conversationStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ConversationState{}, nil // Return empty state if file doesn't exist
+		}
+		return nil, fmt.Errorf("failed to read conversation state file: %w", err)
+	}
 
-	hwnd, _, _ := getForegroundWindow.Call()
-	if hwnd == 0 {
-		return fmt.Errorf("no foreground window found")
+	var state ConversationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse conversation state: %w", err)
 	}
 
-	log.Printf("🔄 Found foreground window: %v", hwnd)
+	return &state, nil
+}
 
-	// Send each character as WM_CHAR message
-	const WM_CHAR = 0x0102
-
-	runes := []rune(text)
-	for i, char := range runes {
-		if i%100 == 0 {
-			log.Printf("🔄 Sending char %d/%d via message", i, len(runes))
-		}
-
-		sendMessage.Call(hwnd, WM_CHAR, uintptr(char), 0)
-		// Suppress individual character failure messages for cleaner output
-
-		// Small delay
-		time.Sleep(1 * time.Millisecond)
+// saveConversationState saves the conversation state to JSON file and queues it for state sync
+func saveConversationState(state *ConversationState) error {
+	// Custom instructions are owned by the in-memory store; always persist the current set
+	instructionsMu.Lock()
+	state.Instructions = make(map[string]string, len(conversationInstructions))
+	for id, text := range conversationInstructions {
+		state.Instructions[id] = text
 	}
+	instructionsMu.Unlock()
+	state.UpdatedAt, state.UpdatedBy = time.Now(), stateSyncHost
 
-	log.Printf("✅ Window message method completed")
+	if err := writeConversationStateFile(state); err != nil {
+		return err
+	}
+	if stateSync != nil {
+		stateSync.changed()
+	}
 	return nil
 }
 
-func sendTextCharByChar(text string) error {
-	log.Printf("🔄 Sending text character by character (%d chars)...", len(text))
-
-	// Convert to runes for proper Unicode handling
-	runes := []rune(text)
-
-	for i, char := range runes {
-		if i%100 == 0 {
-			log.Printf("🔄 Progress: %d/%d characters", i, len(runes))
-		}
-
-		// Use Unicode input for better character support
-		input := INPUT{
-			Type: INPUT_KEYBOARD,
-			Ki: KEYBDINPUT{
-				WVk:         0, // Use 0 for Unicode input
-				WScan:       uint16(char),
-				DwFlags:     4, // KEYEVENTF_UNICODE
-				Time:        0,
-				DwExtraInfo: 0,
-			},
-		}
-
-		// Send the character
-		procSendInput.Call(1, uintptr(unsafe.Pointer(&input)), unsafe.Sizeof(input))
-		// Suppress individual character failure messages for cleaner output
+// writeConversationStateFile writes the conversation state to conversation_state.json as is
+func writeConversationStateFile(state *ConversationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation state: %w", err)
+	}
 
-		// Small delay between characters (adjust if too slow)
-		time.Sleep(2 * time.Millisecond)
+	if err := os.WriteFile(conversationStateFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write conversation state file: %w", err)
 	}
 
-	log.Printf("✅ Character-by-character sending completed")
 	return nil
 }
 
-// bringToForeground aggressively brings windows to foreground
-func bringToForeground() {
-	if runtime.GOOS != "windows" {
-		return
-	}
-
-	// Get Windows API functions
-	getCurrentThreadId := kernel32.NewProc("GetCurrentThreadId")
-	getForegroundWindow := user32.NewProc("GetForegroundWindow")
-	getWindowThreadProcessId := user32.NewProc("GetWindowThreadProcessId")
-	attachThreadInput := user32.NewProc("AttachThreadInput")
-	allowSetForegroundWindow := user32.NewProc("AllowSetForegroundWindow")
+// stateSyncTimeout bounds one round trip to the state_sync store
+const stateSyncTimeout = 10 * time.Second
 
-	// Get current thread ID
-	currentThreadId, _, _ := getCurrentThreadId.Call()
+// stateSyncAttempts is how often a push is retried when another machine writes in between
+const stateSyncAttempts = 3
 
-	// Get foreground window and its thread
-	foregroundWindow, _, _ := getForegroundWindow.Call()
-	if foregroundWindow != 0 {
-		foregroundThreadId, _, _ := getWindowThreadProcessId.Call(foregroundWindow, 0)
+// stateSyncHost names this machine in synced state
+var stateSyncHost, _ = os.Hostname()
 
-		if foregroundThreadId != currentThreadId {
-			// Attach to foreground thread to bypass focus stealing prevention
-			attachThreadInput.Call(currentThreadId, foregroundThreadId, 1)
+// errStateConflict reports that the stored state changed since it was last read
+var errStateConflict = errors.New("conversation state changed on another machine")
 
-			// Allow our process to set foreground window
-			allowSetForegroundWindow.Call(uintptr(0xFFFFFFFF)) // ASFW_ANY
+// stateStore holds the shared copy of the conversation state. Fetch returns a nil state when nothing is stored yet,
+// and a token that changes with every write; Store writes only while the stored token is still token.
+type stateStore interface {
+	Fetch(ctx context.Context) (*ConversationState, string, error)
+	Store(ctx context.Context, state *ConversationState, token string) (string, error)
+	String() string
+}
 
-			// Small delay
-			time.Sleep(10 * time.Millisecond)
+// folderStateStore keeps the shared state in a folder a sync client such as Dropbox or OneDrive replicates
+type folderStateStore struct {
+	dir string
+}
 
-			// Detach from foreground thread
-			attachThreadInput.Call(currentThreadId, foregroundThreadId, 0)
-		}
-	}
+func (f folderStateStore) String() string { return f.dir }
 
-	// Also allow our process specifically
-	allowSetForegroundWindow.Call(uintptr(0xFFFFFFFF))
+func (f folderStateStore) file() string { return filepath.Join(f.dir, conversationStateFile) }
 
-	log.Printf("🔄 Aggressively prepared foreground permissions")
+// stateToken identifies a state written to a folder store
+func stateToken(state *ConversationState) string {
+	return fmt.Sprintf("%d@%d", state.Revision, state.UpdatedAt.UnixNano())
 }
 
-// forceWindowToForeground uses multiple techniques to force window to front
-func forceWindowToForeground() {
-	if runtime.GOOS != "windows" {
-		return
+// readStateFile parses a conversation state file, returning nil when it does not exist
+func readStateFile(path string) (*ConversationState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var state ConversationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &state, nil
+}
 
-	// Find our MessageBox window and force it to foreground
-	findWindow := user32.NewProc("FindWindowW")
-	setForegroundWindow := user32.NewProc("SetForegroundWindow")
-	showWindow := user32.NewProc("ShowWindow")
-	bringWindowToTop := user32.NewProc("BringWindowToTop")
-	setWindowPos := user32.NewProc("SetWindowPos")
-
-	// Try to find MessageBox window (class name "#32770")
-	className, _ := safeUTF16PtrFromString("#32770")
-	hwnd, _, _ := findWindow.Call(className, 0)
+// writeStateFile replaces path with state through a sibling file, so a sync client never uploads half a file
+func writeStateFile(path string, state *ConversationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation state: %w", err)
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
 
-	if hwnd != 0 {
-		// Multiple attempts to bring window to front
-		showWindow.Call(hwnd, 9) // SW_RESTORE
-		showWindow.Call(hwnd, 5) // SW_SHOW
-		bringWindowToTop.Call(hwnd)
-		setForegroundWindow.Call(hwnd)
+// Fetch reads the shared state. Sync clients keep both versions when two machines write before syncing, as
+// "conversation_state (PC's conflicted copy).json" or "conversation_state-PC.json"; the newest version wins and the
+// copies are removed.
+func (f folderStateStore) Fetch(ctx context.Context) (*ConversationState, string, error) {
+	state, err := readStateFile(f.file())
+	if err != nil {
+		return nil, "", err
+	}
 
-		// Set window as topmost temporarily
-		setWindowPos.Call(hwnd, uintptr(0xFFFFFFFF), 0, 0, 0, 0, 0x0001|0x0002|0x0040) // HWND_TOPMOST, SWP_NOMOVE|SWP_NOSIZE|SWP_SHOWWINDOW
+	copies, _ := filepath.Glob(filepath.Join(f.dir, strings.TrimSuffix(conversationStateFile, ".json")+"*.json"))
+	for _, path := range copies {
+		if path == f.file() {
+			continue
+		}
+		conflicted, err := readStateFile(path)
+		if err != nil || conflicted == nil {
+			continue
+		}
+		if state == nil || conflicted.UpdatedAt.After(state.UpdatedAt) {
+			if err := writeStateFile(f.file(), conflicted); err != nil {
+				return nil, "", err
+			}
+			state = conflicted
+		}
+		os.Remove(path)
+		log.Printf("🔀 Resolved conflicted copy %s, keeping the state saved by %s at %s", filepath.Base(path), state.UpdatedBy, state.UpdatedAt.Format(time.RFC3339))
+	}
 
-		log.Printf("🔄 Forced MessageBox window to foreground")
+	if state == nil {
+		return nil, "", nil
 	}
+	return state, stateToken(state), nil
 }
 
-// showModernInputDialog shows a simple but reliable input dialog
-func showModernInputDialog(title, prompt, defaultValue string) (string, bool) {
-	if runtime.GOOS != "windows" {
-		return defaultValue, false
+func (f folderStateStore) Store(ctx context.Context, state *ConversationState, token string) (string, error) {
+	if _, current, err := f.Fetch(ctx); err != nil {
+		return "", err
+	} else if current != token {
+		return "", errStateConflict
 	}
+	if err := writeStateFile(f.file(), state); err != nil {
+		return "", err
+	}
+	return stateToken(state), nil
+}
 
-	log.Printf("🔔 Showing input dialog for user prompt")
-
-	// Force current process to foreground
-	bringToForeground()
-
-	// Get desktop window as parent
-	getDesktopWindow := user32.NewProc("GetDesktopWindow")
-	desktopWindow, _, _ := getDesktopWindow.Call()
+// remoteStateStore keeps the shared state at a KV endpoint with ETag based optimistic locking
+type remoteStateStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
 
-	// First, show a choice dialog
-	titlePtr, _ := safeUTF16PtrFromString(title)
-	promptPtr, _ := safeUTF16PtrFromString(fmt.Sprintf("%s\n\nDefault: \"%s\"\n\nYES = Use default prompt\nNO = Enter custom prompt\nCANCEL = Abort", prompt, defaultValue))
+func (rs remoteStateStore) String() string { return rs.url }
 
-	// Start a goroutine to force the dialog to foreground after a short delay
-	go func() {
-		time.Sleep(100 * time.Millisecond) // Wait for dialog to appear
-		forceWindowToForeground()
-	}()
+func (rs remoteStateStore) request(ctx context.Context, method string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rs.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rs.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rs.token)
+	}
+	return req, nil
+}
 
-	// MB_YESNOCANCEL = 3, MB_ICONQUESTION = 32, MB_TOPMOST = 0x40000, MB_SETFOREGROUND = 0x10000, MB_SYSTEMMODAL = 0x1000
-	ret, _, _ := procMessageBox.Call(desktopWindow, promptPtr, titlePtr, 3|32|0x40000|0x10000|0x1000)
+func (rs remoteStateStore) Fetch(ctx context.Context) (*ConversationState, string, error) {
+	req, err := rs.request(ctx, http.MethodGet, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch conversation state: %w", err)
+	}
+	defer resp.Body.Close()
 
-	switch ret {
-	case 6: // YES - use default
-		log.Printf("✅ User chose default prompt: %s", defaultValue)
-		return defaultValue, false
-	case 7: // NO - get custom input
-		log.Printf("🔄 User wants to enter custom prompt")
-		return showSimpleTextInput(title, "Enter your custom prompt:", defaultValue)
-	default: // CANCEL or close
-		log.Printf("ℹ️ User cancelled the dialog")
-		return "", true
+	body, _ := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, "", nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("state store returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return nil, "", fmt.Errorf("state store returned no ETag")
+	}
+	var state ConversationState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, "", fmt.Errorf("failed to parse conversation state: %w", err)
 	}
+	return &state, etag, nil
 }
 
-// showSimpleTextInput shows a working text input dialog
-func showSimpleTextInput(title, prompt, defaultValue string) (string, bool) {
-	if runtime.GOOS != "windows" {
-		return defaultValue, false
+func (rs remoteStateStore) Store(ctx context.Context, state *ConversationState, token string) (string, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal conversation state: %w", err)
 	}
+	req, err := rs.request(ctx, http.MethodPut, data)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", token)
+	}
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to store conversation state: %w", err)
+	}
+	defer resp.Body.Close()
 
-	// Force to foreground before showing input dialog
-	bringToForeground()
-
-	// Create a VBScript that forces the dialog to foreground
-	script := fmt.Sprintf(`
-Set objShell = CreateObject("WScript.Shell")
+	body, _ := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return "", errStateConflict
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("state store returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	_, etag, err := rs.Fetch(ctx)
+	return etag, err
+}
 
-' Bring the script window to foreground first
-objShell.AppActivate "Windows Script Host"
+// stateSyncer keeps conversation_state.json in step with a stateStore shared by other machines
+type stateSyncer struct {
+	store    stateStore
+	interval time.Duration
+	pending  chan struct{} // Signals a local change to push
+	dirty    atomic.Bool   // A local change has not reached the store yet
+
+	mu      sync.Mutex
+	base    *ConversationState // Last state read from or written to the store
+	token   string
+	lastErr string // Last error logged, so an unreachable store is reported once
+}
 
-' Show InputBox and force it to foreground
-strInput = InputBox("%s", "%s", "%s")
+// stateSync is set when state_sync is configured
+var stateSync *stateSyncer
 
-' Force the dialog to stay on top
-objShell.AppActivate "%s"
+// startStateSync pulls the shared conversation state into conversation_state.json, keeping whichever copy was saved
+// last, and starts checking for changes. It runs before the saved conversation is read.
+func startStateSync(cfg *StateSyncConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	var store stateStore = folderStateStore{dir: cfg.Folder}
+	if cfg.URL != "" {
+		store = remoteStateStore{url: cfg.URL, token: cfg.Token, client: &http.Client{}}
+	}
+	s := &stateSyncer{store: store, interval: durationOrDefault(cfg.Interval, defaultStateSyncInterval), pending: make(chan struct{}, 1)}
+	stateSync = s
+	workers.Go("state-sync", s.run)
 
-If strInput <> "" Then
-    Set objFSO = CreateObject("Scripting.FileSystemObject")
-    Set objFile = objFSO.CreateTextFile("temp_input_result.txt", True)
-    objFile.WriteLine "OK:" & strInput
-    objFile.Close
-Else
-    Set objFSO = CreateObject("Scripting.FileSystemObject")
-    Set objFile = objFSO.CreateTextFile("temp_input_result.txt", True)
-    objFile.WriteLine "CANCEL:"
-    objFile.Close
-End If
-`, prompt, title, defaultValue, title)
+	ctx, cancel := context.WithTimeout(context.Background(), stateSyncTimeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Write VBScript to file
-	scriptFile := "temp_input_dialog.vbs"
-	err := os.WriteFile(scriptFile, []byte(script), 0644)
+	local, err := loadConversationState()
 	if err != nil {
-		log.Printf("⚠️ Failed to write VBScript: %v", err)
-		return defaultValue, false
+		return err
 	}
-
-	// Execute VBScript with wscript (shows GUI)
-	cmd := exec.Command("wscript", scriptFile)
-	err = cmd.Run()
+	remote, token, err := store.Fetch(ctx)
 	if err != nil {
-		log.Printf("⚠️ Failed to run VBScript: %v", err)
-		os.Remove(scriptFile)
-		return defaultValue, false
+		s.dirty.Store(local.LastConversationID != "")
+		return fmt.Errorf("failed to reach %s: %w", store, err)
 	}
+	s.base, s.token = remote, token
 
-	// Read result from file
-	resultFile := "temp_input_result.txt"
-	output, err := os.ReadFile(resultFile)
-	if err != nil {
-		log.Printf("⚠️ Failed to read input result: %v", err)
-		os.Remove(scriptFile)
-		return defaultValue, false
+	switch {
+	case remote != nil && remote.UpdatedAt.After(local.UpdatedAt):
+		if err := writeConversationStateFile(remote); err != nil {
+			return err
+		}
+		log.Printf("🔄 Using conversation state from %s, saved by %s at %s", store, remote.UpdatedBy, remote.UpdatedAt.Format(time.RFC3339))
+	case local.LastConversationID != "" && (remote == nil || local.UpdatedAt.After(remote.UpdatedAt)):
+		s.dirty.Store(true)
+		s.wake()
 	}
+	log.Printf("🔄 Syncing conversation state with %s every %v", store, s.interval)
+	return nil
+}
 
-	// Clean up
-	os.Remove(scriptFile)
-	os.Remove(resultFile)
-
-	// Parse result
-	result := strings.TrimSpace(string(output))
-	if strings.HasPrefix(result, "OK:") {
-		userInput := strings.TrimPrefix(result, "OK:")
-		log.Printf("✅ User entered custom prompt: %s", userInput)
-		return userInput, false
-	} else {
-		log.Printf("ℹ️ User cancelled custom input")
-		return "", true
-	}
+// changed queues the saved local state for the store
+func (s *stateSyncer) changed() {
+	s.dirty.Store(true)
+	s.wake()
 }
 
-func showNotification(title, message string) {
-	if runtime.GOOS != "windows" {
-		log.Printf("%s: %s", title, message)
-		return
+// wake signals the sync worker without blocking
+func (s *stateSyncer) wake() {
+	select {
+	case s.pending <- struct{}{}:
+	default:
 	}
+}
 
-	// Log the notification (works in both console and windowsgui mode)
-	log.Printf("📢 %s: %s", title, message)
+// run pushes local changes as they happen and checks the store for changes from other machines
+func (s *stateSyncer) run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-s.pending:
+		}
+		s.sync(ctx)
+	}
+}
 
-	// Update systray tooltip with notification
-	notificationText := fmt.Sprintf("🔔 %s: %s", title, message)
-	systray.SetTooltip(notificationText)
+// sync pushes a pending local change, or adopts a newer state another machine stored
+func (s *stateSyncer) sync(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, stateSyncTimeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.pullLocked(ctx)
+	if err == nil && s.dirty.Swap(false) {
+		if err = s.pushLocked(ctx); err != nil {
+			s.dirty.Store(true)
+		}
+	}
+	switch {
+	case err != nil && err.Error() != s.lastErr:
+		log.Printf("⚠️ Conversation state sync with %s failed, retrying every %v: %v", s.store, s.interval, err)
+	case err == nil && s.lastErr != "":
+		log.Printf("🔄 Conversation state sync with %s restored", s.store)
+	}
+	s.lastErr = ""
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+}
 
-	// Show Windows notification - different approach for windowsgui vs console mode
-	go func() {
-		log.Printf("🔔 Attempting to show notification: %s - %s", title, message)
+// pullLocked adopts the stored state when another machine changed it; a pending local change is merged into it
+func (s *stateSyncer) pullLocked(ctx context.Context) error {
+	remote, token, err := s.store.Fetch(ctx)
+	if err != nil || remote == nil || token == s.token {
+		return err
+	}
+	if s.dirty.Load() {
+		return nil // pushLocked merges the remote change with the local one
+	}
+	s.base, s.token = remote, token
+	adoptConversationState(remote, remote.UpdatedBy)
+	return nil
+}
 
-		// Try toast library first (works in console mode)
-		if showToastNotification(title, message) {
-			log.Printf("✅ Toast notification shown successfully")
+// pushLocked stores the local state, merging it with changes another machine stored since the last sync
+func (s *stateSyncer) pushLocked(ctx context.Context) error {
+	for attempt := 0; attempt < stateSyncAttempts; attempt++ {
+		local, err := loadConversationState()
+		if err != nil {
+			return err
+		}
+		remote, token, err := s.store.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+
+		next, merged := local, false
+		if remote != nil && token != s.token {
+			next, merged = mergeConversationState(s.base, local, remote), true
+		}
+		next.Revision = 1
+		if remote != nil {
+			next.Revision = remote.Revision + 1
+		}
+		next.UpdatedAt, next.UpdatedBy = time.Now(), stateSyncHost
+
+		newToken, err := s.store.Store(ctx, next, token)
+		if errors.Is(err, errStateConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.base, s.token = next, newToken
+		if merged {
+			log.Printf("🔀 Merged the conversation state with changes saved by %s", remote.UpdatedBy)
+			adoptConversationState(next, remote.UpdatedBy)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w %d times in a row", errStateConflict, stateSyncAttempts)
+}
+
+// mergeConversationState applies the fields local changed since base on top of remote; where both machines changed
+// the same field, this machine's change wins
+func mergeConversationState(base, local, remote *ConversationState) *ConversationState {
+	if base == nil {
+		base = &ConversationState{}
+	}
+	merged := *remote
+	merged.Instructions = make(map[string]string, len(remote.Instructions))
+	for id, text := range remote.Instructions {
+		merged.Instructions[id] = text
+	}
+
+	if local.LastConversationID != base.LastConversationID {
+		merged.LastConversationID, merged.CreatedAt = local.LastConversationID, local.CreatedAt
+	}
+	if local.AgentSlug != base.AgentSlug {
+		merged.AgentSlug = local.AgentSlug
+	}
+	for id, text := range local.Instructions {
+		if base.Instructions[id] != text {
+			merged.Instructions[id] = text
+		}
+	}
+	for id := range base.Instructions {
+		if _, ok := local.Instructions[id]; !ok {
+			delete(merged.Instructions, id)
+		}
+	}
+	return &merged
+}
+
+// adoptConversationState writes a state synced from another machine to conversation_state.json and switches to its
+// conversation, agent and custom instructions. A conversation given with -conversation-id stays in use.
+func adoptConversationState(state *ConversationState, from string) {
+	if err := writeConversationStateFile(state); err != nil {
+		log.Printf("Warning: Failed to save synced conversation state: %v", err)
+	}
+
+	instructionsMu.Lock()
+	for id := range conversationInstructions {
+		delete(conversationInstructions, id)
+	}
+	for id, text := range state.Instructions {
+		conversationInstructions[id] = text
+	}
+	instructionsMu.Unlock()
+
+	changed := false
+	if state.LastConversationID != "" && state.LastConversationID != conversationID && *flagConversationID == "" {
+		conversationID = state.LastConversationID
+		changed = true
+	}
+	if state.AgentSlug != "" && state.AgentSlug != currentAgentSlug {
+		currentAgentSlug = state.AgentSlug
+		clearAgentFallbacks()
+		changed = true
+	}
+	if changed {
+		log.Printf("🔄 Conversation state synced from %s: conversation %s, agent %s", from, conversationID, currentAgentSlug)
+	}
+	bus.Publish(topicConversation, "synced", currentConversationEvent())
+}
+
+// loadConfig loads optional application settings from JSON file
+func loadConfig() (*AppConfig, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &AppConfig{}, nil // Return defaults if file doesn't exist
+		}
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	cfg, diags := checkConfig(data)
+	if len(diags) > 0 {
+		lines := make([]string, len(diags))
+		for i, d := range diags {
+			lines[i] = d.String()
+		}
+		return nil, fmt.Errorf("invalid config file (run `khoj-wrapper config validate` for details):\n%s", strings.Join(lines, "\n"))
+	}
+
+	return cfg, nil
+}
+
+// checkConfig parses config data and returns every syntax, unknown-key, type and value problem found
+func checkConfig(data []byte) (*AppConfig, []configDiagnostic) {
+	walker := &configWalker{data: data, offsets: make(map[string]int64)}
+	walker.dec = json.NewDecoder(bytes.NewReader(data))
+	walker.dec.UseNumber()
+	if err := walker.walk(reflect.TypeOf(AppConfig{}), ""); err != nil {
+		return nil, walker.diags
+	}
+	if walker.dec.More() {
+		walker.report(walker.dec.InputOffset(), "", "unexpected data after the top-level object")
+		return nil, walker.diags
+	}
+	if len(walker.diags) > 0 {
+		return nil, walker.diags
+	}
+
+	var cfg AppConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, []configDiagnostic{{Message: err.Error()}}
+	}
+
+	var diags []configDiagnostic
+	problems := expandConfigEnv(reflect.ValueOf(&cfg).Elem(), "")
+	problems = append(problems, cfg.validate()...)
+	for _, problem := range problems {
+		d := configDiagnostic{Field: problem[0], Message: problem[1]}
+		if offset, ok := walker.offsets[problem[0]]; ok {
+			d.Line, d.Column = offsetPosition(data, offset)
+		}
+		diags = append(diags, d)
+	}
+	if len(diags) > 0 {
+		sort.SliceStable(diags, func(i, j int) bool {
+			if diags[i].Line != diags[j].Line {
+				return diags[i].Line < diags[j].Line
+			}
+			return diags[i].Column < diags[j].Column
+		})
+		return nil, diags
+	}
+	return &cfg, nil
+}
+
+// configDocument is config.json's top-level object with its key order kept, so API edits leave the rest of the file as written
+type configDocument struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+// configFileMu serializes read-modify-write updates of config.json
+var configFileMu sync.Mutex
+
+// readConfigDocument reads config.json without expanding ${VAR} references; a missing file is an empty document
+func readConfigDocument() (*configDocument, error) {
+	doc := &configDocument{values: make(map[string]json.RawMessage)}
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) || (err == nil && len(bytes.TrimSpace(data)) == 0) {
+		return doc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("failed to parse config file: expected a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if _, ok := doc.values[key]; !ok {
+			doc.keys = append(doc.keys, key)
+		}
+		doc.values[key] = raw
+	}
+	return doc, nil
+}
+
+// Get decodes the value of a top-level key into v, leaving v untouched when the key is absent
+func (d *configDocument) Get(key string, v interface{}) error {
+	raw, ok := d.values[key]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", key, err)
+	}
+	return nil
+}
+
+// Set replaces the value of a top-level key, appending the key if it is new
+func (d *configDocument) Set(key string, v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // Keep <, > and & in prompts readable
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", key, err)
+	}
+	if _, ok := d.values[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.values[key] = bytes.TrimSpace(buf.Bytes())
+	return nil
+}
+
+// Delete removes a top-level key so its default applies
+func (d *configDocument) Delete(key string) {
+	if _, ok := d.values[key]; !ok {
+		return
+	}
+	delete(d.values, key)
+	for i, k := range d.keys {
+		if k == key {
+			d.keys = append(d.keys[:i], d.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Bytes renders the document as indented JSON
+func (d *configDocument) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range d.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(d.values[key])
+	}
+	buf.WriteByte('}')
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, fmt.Errorf("failed to format config: %w", err)
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// updateConfigFile applies edit to config.json, validates the result like a fresh load and saves it.
+// Templates and hotkeys from the saved file take effect immediately; diagnostics mean nothing was written.
+func updateConfigFile(edit func(doc *configDocument) error) ([]configDiagnostic, error) {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+
+	doc, err := readConfigDocument()
+	if err != nil {
+		return nil, err
+	}
+	if err := edit(doc); err != nil {
+		return nil, err
+	}
+	data, err := doc.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	cfg, diags := checkConfig(data)
+	if len(diags) > 0 {
+		return diags, nil
+	}
+
+	// Write a sibling file and rename it over config.json so a crash never leaves it half written
+	tmp := configFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp, configFile); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to replace config file: %w", err)
+	}
+
+	applyLiveSettings(cfg)
+	return nil, nil
+}
+
+// applyLiveSettings swaps in the templates, hotkeys and theme from a validated config; other settings wait for a restart
+func applyLiveSettings(cfg *AppConfig) {
+	next := *appConfig()
+	next.Templates = cfg.Templates
+	next.TemplatePacks = cfg.TemplatePacks
+	next.Theme = cfg.Theme
+	next.Hotkey, next.QuickAskHotkey, next.FollowUpHotkey = cfg.Hotkey, cfg.QuickAskHotkey, cfg.FollowUpHotkey
+	activeConfig.Store(&next)
+
+	clipboardKey, quickAskKey, followUpKey, err := configuredHotkeys(cfg)
+	if err != nil {
+		log.Printf("⚠️ Keeping the previous hotkeys: %v", err)
+		return
+	}
+	setActiveHotkeys(clipboardKey, quickAskKey, followUpKey)
+	log.Printf("🔄 Reloaded %d template(s); hotkeys %s, %s, %s", len(cfg.Templates), clipboardKey.Name, quickAskKey.Name, followUpKey.Name)
+	bus.Publish(topicConfig, "changed", ConfigEvent{
+		Hotkey:         clipboardKey.Name,
+		QuickAskHotkey: quickAskKey.Name,
+		FollowUpHotkey: followUpKey.Name,
+		Templates:      len(cfg.Templates),
+	})
+}
+
+// expandConfigEnv replaces ${VAR} and ${VAR:-default} references in every string value, returning {field path, message} pairs for undefined variables
+func expandConfigEnv(v reflect.Value, path string) [][2]string {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	var problems [][2]string
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			problems = expandConfigEnv(v.Elem(), path)
+		}
+	case reflect.Struct:
+		for name, i := range configFieldIndexes(v.Type()) {
+			problems = append(problems, expandConfigEnv(v.Field(i), join(name))...)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			problems = append(problems, expandConfigEnv(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			break
+		}
+		for _, key := range v.MapKeys() {
+			expanded, err := expandEnvRefs(v.MapIndex(key).String())
+			if err != nil {
+				problems = append(problems, [2]string{join(key.String()), err.Error()})
+				continue
+			}
+			v.SetMapIndex(key, reflect.ValueOf(expanded).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		expanded, err := expandEnvRefs(v.String())
+		if err != nil {
+			problems = append(problems, [2]string{path, err.Error()})
 		} else {
-			log.Printf("⚠️ Toast notification failed, trying PowerShell method...")
-			// Fallback to PowerShell method for windowsgui mode
-			showPowerShellNotification(title, message)
+			v.SetString(expanded)
 		}
+	}
+	return problems
+}
 
-		// Keep the tooltip notification visible for 5 seconds
-		time.Sleep(5 * time.Second)
-		systray.SetTooltip("Khoj OpenAI Wrapper Server")
-	}()
+// expandEnvRefs expands ${VAR} and ${VAR:-default}; $${ yields a literal ${ and bare $VAR is left alone
+func expandEnvRefs(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], "$${") {
+			out.WriteString("${")
+			i += 3
+			continue
+		}
+		if !strings.HasPrefix(s[i:], "${") {
+			out.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		name, fallback, hasDefault := strings.Cut(ref, ":-")
+		if !envNamePattern.MatchString(name) {
+			return "", fmt.Errorf("invalid variable name %q in ${%s}", name, ref)
+		}
+
+		value, ok := os.LookupEnv(name)
+		switch {
+		case value == "" && hasDefault:
+			value = fallback
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set (define it in %s or use ${%s:-default})", name, envFile, name)
+		}
+		out.WriteString(value)
+		i += end + 1
+	}
+	return out.String(), nil
 }
 
-// showToastNotification tries to show notification using PowerShell (cross-platform compatible)
-func showToastNotification(title, message string) bool {
-	if runtime.GOOS != "windows" {
-		return false
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadEnvFile sets variables from a .env file without overriding ones already in the environment.
+// It returns the number of variables applied and any malformed lines.
+func loadEnvFile(path string) (int, []configDiagnostic, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil, nil
+		}
+		return 0, nil, fmt.Errorf("failed to read %s: %w", path, err)
 	}
 
-	// Use PowerShell with Windows.UI.Notifications for proper toast
-	script := fmt.Sprintf(`
-		try {
-			[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
-			[Windows.UI.Notifications.ToastNotification, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
-			[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+	applied := 0
+	var diags []configDiagnostic
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimSpace(strings.TrimSuffix(raw, "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
 
-			$APP_ID = 'Microsoft.Windows.Computer'
-			$template = @"
-<toast>
-    <visual>
-        <binding template="ToastGeneric">
-            <text>%s</text>
-            <text>%s</text>
-        </binding>
-    </visual>
-    <audio src="ms-winsoundevent:Notification.Default" />
-</toast>
-"@
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !envNamePattern.MatchString(name) {
+			diags = append(diags, configDiagnostic{File: path, Line: i + 1, Column: 1, Message: "expected KEY=VALUE"})
+			continue
+		}
 
-			$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
-			$xml.LoadXml($template)
-			$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
-			[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($APP_ID).Show($toast)
-			exit 0
-		} catch {
-			exit 1
+		value, err := parseEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			diags = append(diags, configDiagnostic{File: path, Line: i + 1, Column: strings.IndexByte(raw, '=') + 2, Field: name, Message: err.Error()})
+			continue
 		}
-	`, title, message)
 
-	// Execute PowerShell script silently
-	cmd := exec.Command("powershell", "-WindowStyle", "Hidden", "-ExecutionPolicy", "Bypass", "-Command", script)
-	err := cmd.Run()
+		if _, exists := os.LookupEnv(name); exists {
+			continue // The real environment wins
+		}
+		os.Setenv(name, value)
+		applied++
+	}
+	return applied, diags, nil
+}
+
+// parseEnvValue unquotes a .env value: "double" supports \n, \t, \" and \\ escapes, 'single' is literal, and unquoted values may end in a # comment
+func parseEnvValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := -1
+		for i := 1; i < len(value); i++ {
+			if value[i] == '\\' {
+				i++
+				continue
+			}
+			if value[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated double-quoted value")
+		}
+		replacer := strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`)
+		return replacer.Replace(value[1:end]), nil
+	case strings.HasPrefix(value, "'"):
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single-quoted value")
+		}
+		return value[1 : end+1], nil
+	default:
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = value[:i]
+		}
+		return strings.TrimSpace(value), nil
+	}
+}
+
+// validate checks field values, returning {field path, message} pairs
+func (cfg *AppConfig) validate() [][2]string {
+	var problems [][2]string
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, [2]string{field, fmt.Sprintf(format, args...)})
+	}
+
+	for field, value := range map[string]string{"timeout": cfg.Timeout, "clipboard_timeout": cfg.ClipboardTimeout, "clipboard_session.idle": cfg.ClipboardSession.Idle, "insertion.pause": cfg.Insertion.Pause, "insertion.clipboard_settle": cfg.Insertion.ClipboardSettle, "launcher.timeout": cfg.Launcher.Timeout, "tool_execution.timeout": cfg.ToolExecution.Timeout, "url_fetch.timeout": cfg.URLFetch.Timeout, "hedge.delay": cfg.Hedge.Delay} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil {
+			add(field, "invalid duration %q (use e.g. \"90s\" or \"2m\")", value)
+		} else if d <= 0 {
+			add(field, "duration must be positive, got %q", value)
+		}
+	}
+	if cfg.Hotkey != "" {
+		if _, err := parseHotkey(cfg.Hotkey); err != nil {
+			add("hotkey", "%v", err)
+		}
+	}
+	for field, value := range map[string]string{"quick_ask_hotkey": cfg.QuickAskHotkey, "follow_up_hotkey": cfg.FollowUpHotkey} {
+		if value == "" {
+			continue
+		}
+		if spec, err := parseHotkey(value); err != nil {
+			add(field, "%v", err)
+		} else if clipboard, err := parseHotkey(cfg.Hotkey); err == nil && spec.Name == clipboard.Name {
+			add(field, "%s is already the clipboard AI hotkey", spec.Name)
+		}
+	}
+	if cfg.QuickAskHotkey != "" && cfg.FollowUpHotkey != "" {
+		quickAsk, err1 := parseHotkey(cfg.QuickAskHotkey)
+		followUp, err2 := parseHotkey(cfg.FollowUpHotkey)
+		if err1 == nil && err2 == nil && quickAsk.Name == followUp.Name {
+			add("follow_up_hotkey", "%s is already the quick ask hotkey", followUp.Name)
+		}
+	}
+	if cfg.Insertion.StopKey != "" {
+		if _, err := parseKeyCombo(cfg.Insertion.StopKey); err != nil {
+			add("insertion.stop_key", "%v", err)
+		}
+	}
+	for name, kind := range cfg.Insertion.Targets {
+		switch kind {
+		case targetTerminal, targetForm, targetEditor:
+		default:
+			add("insertion.targets."+name, "unknown target %q (expected terminal, form or editor)", kind)
+		}
+	}
+	if cfg.Insertion.ChunkChars < -1 {
+		add("insertion.chunk_chars", "must be -1 (disabled), 0 (default) or positive")
+	}
+	if cfg.Insertion.ClipboardRetries < -1 {
+		add("insertion.clipboard_retries", "must be -1 (no check), 0 (default) or positive")
+	}
+
+	names := make(map[string]bool)
+	for i, server := range cfg.MCPServers {
+		field := fmt.Sprintf("mcp_servers[%d]", i)
+		if server.Name == "" {
+			add(field, "name is required")
+		} else if names[server.Name] {
+			add(field+".name", "duplicate MCP server name %q", server.Name)
+		}
+		names[server.Name] = true
+		if server.Command == "" {
+			add(field, "command is required")
+		}
+	}
+
+	if cfg.ToolOutput.MaxChars < 0 {
+		add("tool_output.max_chars", "must not be negative")
+	}
+	for tool, limit := range cfg.ToolOutput.PerTool {
+		if limit < 0 {
+			add("tool_output.per_tool."+tool, "must not be negative")
+		}
+	}
+	if cfg.ToolExecution.MaxParallel < 0 {
+		add("tool_execution.max_parallel", "must not be negative")
+	}
+	if cfg.ToolExecution.MaxRounds < 0 {
+		add("tool_execution.max_rounds", "must not be negative")
+	}
+	if f := cfg.AccessLog.Format; f != "" && f != accessLogCombined && f != accessLogCommon {
+		add("access_log.format", "must be combined or common, got %q", f)
+	}
+	if cfg.AccessLog.MaxSizeMB < 0 {
+		add("access_log.max_size_mb", "must not be negative")
+	}
+	if cfg.AccessLog.MaxFiles < 0 {
+		add("access_log.max_files", "must not be negative")
+	}
+	for name := range cfg.Features {
+		if !slices.Contains(knownFeatures, name) {
+			add("features."+name, "unknown feature (expected one of %s)", strings.Join(knownFeatures, ", "))
+		}
+	}
+	if cfg.URLFetch.MaxSizeMB < 0 {
+		add("url_fetch.max_size_mb", "must not be negative")
+	}
+	for i, host := range cfg.URLFetch.AllowedHosts {
+		if _, _, err := net.ParseCIDR(host); strings.Contains(host, "/") && err != nil {
+			add(fmt.Sprintf("url_fetch.allowed_hosts[%d]", i), "invalid CIDR range %q", host)
+		} else if strings.TrimSpace(host) == "" {
+			add(fmt.Sprintf("url_fetch.allowed_hosts[%d]", i), "must not be empty")
+		}
+	}
+	for i, contentType := range cfg.URLFetch.ImageTypes {
+		if !strings.Contains(contentType, "/") {
+			add(fmt.Sprintf("url_fetch.image_types[%d]", i), "invalid content type %q (expected e.g. \"image/png\" or \"image/*\")", contentType)
+		}
+	}
+
+	if cfg.TokenBudget.Default < 0 {
+		add("token_budget.default", "must not be negative")
+	}
+	for agent, budget := range cfg.TokenBudget.PerAgent {
+		if budget < 0 {
+			add("token_budget.per_agent."+agent, "must not be negative")
+		}
+	}
+	if cfg.TokenBudget.ChunkTokens < 0 {
+		add("token_budget.chunk_tokens", "must not be negative")
+	}
+
+	if ss := cfg.StateSync; ss != nil {
+		switch {
+		case (ss.Folder == "") == (ss.URL == ""):
+			add("state_sync", "set either folder or url")
+		case ss.Folder != "" && !filepath.IsAbs(ss.Folder):
+			add("state_sync.folder", "must be an absolute path, got %q", ss.Folder)
+		case ss.URL != "" && !strings.HasPrefix(ss.URL, "http://") && !strings.HasPrefix(ss.URL, "https://"):
+			add("state_sync.url", "must be an http or https URL, got %q", ss.URL)
+		}
+		if d, err := time.ParseDuration(ss.Interval); ss.Interval != "" && (err != nil || d < time.Second) {
+			add("state_sync.interval", "invalid interval %q (use e.g. \"30s\", at least 1s)", ss.Interval)
+		}
+	}
+
+	if team := cfg.Team; team != nil {
+		switch u, err := url.Parse(team.URL); {
+		case team.URL == "":
+			add("team.url", "is required")
+		case err != nil || u.Host == "":
+			add("team.url", "invalid URL %q", team.URL)
+		case u.Scheme != "https" && !(u.Scheme == "http" && (u.Hostname() == "localhost" || net.ParseIP(u.Hostname()).IsLoopback())):
+			// Plain http only reaches a server on this machine, e.g. while testing an overlay
+			add("team.url", "must be an https URL, got %q", team.URL)
+		}
+		if _, err := parsePackKey(team.PublicKey); err != nil {
+			add("team.public_key", "%v", err)
+		}
+		if d, err := time.ParseDuration(team.Refresh); team.Refresh != "" && (err != nil || d < time.Minute) {
+			add("team.refresh", "invalid interval %q (use e.g. \"1h\", at least 1m)", team.Refresh)
+		}
+	}
+
+	if lm := cfg.LocalModel; lm != nil {
+		switch u, err := url.Parse(lm.URL); {
+		case lm.URL == "":
+			add("local_model.url", "is required")
+		case err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https"):
+			add("local_model.url", "must be an http or https URL, got %q", lm.URL)
+		}
+		if d, err := time.ParseDuration(lm.Timeout); lm.Timeout != "" && (err != nil || d < time.Second) {
+			add("local_model.timeout", "invalid timeout %q (use e.g. \"5m\", at least 1s)", lm.Timeout)
+		}
+	}
+
+	if sp := cfg.Scratchpad; sp != nil {
+		if sp.By != "" && sp.By != scratchpadByApp && sp.By != scratchpadByWorkspace {
+			add("scratchpad.by", "invalid value %q (expected app or workspace)", sp.By)
+		}
+		for i, source := range sp.Sources {
+			if source != scratchpadClipboard && source != scratchpadQuickAsk && source != scratchpadAPI {
+				add(fmt.Sprintf("scratchpad.sources[%d]", i), "unknown source %q (expected clipboard, quick_ask or api)", source)
+			}
+		}
+		for i, folder := range sp.Workspaces {
+			if !filepath.IsAbs(folder) {
+				add(fmt.Sprintf("scratchpad.workspaces[%d]", i), "must be an absolute path, got %q", folder)
+			}
+		}
+	}
+
+	switch backend := cfg.Embeddings.Backend; {
+	case backend != "" && backend != embeddingsLocal && backend != embeddingsHuggingFace && backend != embeddingsOpenAI:
+		add("embeddings.backend", "invalid backend %q (expected local, huggingface or openai)", backend)
+	case backend != "" && backend != embeddingsLocal && cfg.Embeddings.URL == "":
+		add("embeddings.url", "is required for the %s backend", backend)
+	case cfg.Embeddings.URL != "" && !strings.HasPrefix(cfg.Embeddings.URL, "http://") && !strings.HasPrefix(cfg.Embeddings.URL, "https://"):
+		add("embeddings.url", "must be an http or https URL, got %q", cfg.Embeddings.URL)
+	}
+	if d := cfg.Embeddings.Dimensions; d < 0 || d > maxLocalEmbeddingDims {
+		add("embeddings.dimensions", "must be between 1 and %d, got %d", maxLocalEmbeddingDims, d)
+	}
+
+	categories := slices.Sorted(maps.Keys(cfg.Moderation.Categories))
+	for _, category := range categories {
+		if !slices.Contains(moderationCategories, category) {
+			add("moderation.categories."+category, "unknown category (expected one of %s)", strings.Join(moderationCategories, ", "))
+		}
+		for i, pattern := range cfg.Moderation.Categories[category].Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				add(fmt.Sprintf("moderation.categories.%s.patterns[%d]", category, i), "invalid regex: %v", err)
+			}
+		}
+	}
+	if t := cfg.Moderation.Threshold; t < 0 || t > 1 {
+		add("moderation.threshold", "must be between 0 and 1, got %g", t)
+	}
+
+	for i, root := range cfg.Workspace.Roots {
+		if !filepath.IsAbs(root) {
+			add(fmt.Sprintf("workspace.roots[%d]", i), "must be an absolute path, got %q", root)
+		}
+	}
+
+	switch cfg.Theme.Mode {
+	case "", "system", "light", "dark":
+	default:
+		add("theme.mode", "unknown theme mode %q (expected system, light or dark)", cfg.Theme.Mode)
+	}
+	if cfg.Theme.Accent != "" && !accentPattern.MatchString(cfg.Theme.Accent) {
+		add("theme.accent", "invalid color %q (use a hex color such as \"#2b7de9\" or \"#e44\")", cfg.Theme.Accent)
+	}
+
+	for i, ap := range cfg.AppPrompts {
+		field := fmt.Sprintf("app_prompts[%d]", i)
+		switch ap.Target {
+		case "", targetTerminal, targetForm, targetEditor, targetUnknown:
+		default:
+			add(field+".target", "unknown target %q (expected terminal, form, editor or unknown)", ap.Target)
+		}
+		if len(ap.Apps) == 0 && ap.Target == "" {
+			add(field, "needs apps or a target")
+		}
+		if strings.TrimSpace(ap.Prefix) == "" && strings.TrimSpace(ap.Suffix) == "" {
+			add(field, "needs a prefix or a suffix")
+		}
+		for _, text := range []string{ap.Prefix, ap.Suffix} {
+			for _, m := range templateVariablePattern.FindAllStringSubmatch(text, -1) {
+				if !knownTemplateVariable(m[1]) {
+					add(field, "unknown variable {{%s}} (expected %s)", m[1], strings.Join(templateVariableNames, ", "))
+				}
+			}
+		}
+	}
+
+	for agent, preset := range cfg.AgentPresets {
+		if t := preset.Temperature; t != nil && (*t < 0 || *t > 2) {
+			add("agent_presets."+agent+".temperature", "must be between 0 and 2")
+		}
+		if _, ok := verbosityPresets[preset.Verbosity]; preset.Verbosity != "" && !ok {
+			add("agent_presets."+agent+".verbosity", "unknown verbosity %q (expected one-liner, short or detailed)", preset.Verbosity)
+		}
+		if p := preset.TopP; p != nil && (*p < 0 || *p > 1) {
+			add("agent_presets."+agent+".top_p", "must be between 0 and 1")
+		}
+		if preset.MaxTokens < 0 {
+			add("agent_presets."+agent+".max_tokens", "must not be negative")
+		}
+		for _, param := range preset.Sampling {
+			if param != samplingTemperature && param != samplingTopP && param != samplingSeed {
+				add("agent_presets."+agent+".sampling", "unknown parameter %q (expected temperature, top_p or seed)", param)
+			}
+		}
+	}
+
+	if cfg.ClientConversations.GCAfterDays < 0 {
+		add("client_conversations.gc_after_days", "must not be negative")
+	}
+	switch cfg.APIConversations.Mode {
+	case "", apiConversationsShared, apiConversationsStateless, apiConversationsPerClient:
+		if cfg.ClientConversations.Enabled && cfg.APIConversations.Mode != "" && cfg.APIConversations.Mode != apiConversationsPerClient {
+			add("api_conversations.mode", "%q conflicts with client_conversations.enabled", cfg.APIConversations.Mode)
+		}
+	default:
+		add("api_conversations.mode", "must be shared, stateless or per_client, got %q", cfg.APIConversations.Mode)
+	}
+
+	switch cfg.Stream.Status {
+	case "", streamStatusComment, streamStatusDelta, streamStatusOff:
+	default:
+		add("stream.status", "must be comment, delta or off, got %q", cfg.Stream.Status)
+	}
+
+	if cfg.Retry.MaxAttempts < 0 {
+		add("retry.max_attempts", "must not be negative")
+	}
+
+	if cfg.Index.ChunkBytes < 0 {
+		add("index.chunk_bytes", "must not be negative")
+	}
+
+	if cfg.TrayPreview.Chars < 0 || cfg.TrayPreview.Chars > maxTrayPreviewChars {
+		add("tray_preview.chars", "must be between 0 and %d", maxTrayPreviewChars)
+	}
+
+	if cfg.Priority.MaxConcurrent < 0 {
+		add("priority.max_concurrent", "must not be negative")
+	}
+	limit := cfg.Priority.MaxConcurrent
+	if limit <= 0 {
+		limit = defaultMaxConcurrent
+	}
+	if cfg.Priority.MaxBackground < 0 {
+		add("priority.max_background", "must not be negative")
+	} else if limit > 1 && cfg.Priority.MaxBackground >= limit {
+		add("priority.max_background", "must be less than max_concurrent (%d), so background requests never take the last slot", limit)
+	}
+
+	for i, pattern := range cfg.TerminalSafety.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			add(fmt.Sprintf("terminal_safety.patterns[%d]", i), "invalid regex: %v", err)
+		}
+	}
+
+	for i, key := range cfg.TemplatePacks.TrustedKeys {
+		if _, err := parsePackKey(key); err != nil {
+			add(fmt.Sprintf("template_packs.trusted_keys[%d]", i), "%v", err)
+		}
+	}
+
+	for i, t := range cfg.Templates {
+		field := fmt.Sprintf("templates[%d]", i)
+		if t.Name == "" {
+			add(field+".name", "must not be empty")
+		}
+		if t.Prompt == "" {
+			add(field+".prompt", "must not be empty")
+		}
+		if !validOutputMode(t.Output) {
+			add(field+".output", "invalid output mode %q (expected full, code or first_code)", t.Output)
+		}
+		if _, ok := verbosityPresets[t.Verbosity]; t.Verbosity != "" && !ok {
+			add(field+".verbosity", "unknown verbosity %q (expected one-liner, short or detailed)", t.Verbosity)
+		}
+		if t.MaxChars < 0 {
+			add(field+".max_chars", "must not be negative")
+		}
+		if !validCitationStyle(t.Citations) {
+			add(field+".citations", "invalid style %q (expected footnotes, inline or none)", t.Citations)
+		}
+		switch t.RichText {
+		case "", richTextAuto, richTextOff:
+		default:
+			add(field+".rich_text", "invalid mode %q (expected auto or off)", t.RichText)
+		}
+		if pp := t.PostProcess; pp != nil {
+			if strings.TrimSpace(pp.Command) == "" {
+				add(field+".post_process.command", "must not be empty")
+			}
+			if pp.Timeout != "" {
+				if d, err := time.ParseDuration(pp.Timeout); err != nil || d <= 0 {
+					add(field+".post_process.timeout", "invalid duration %q (use e.g. \"5s\")", pp.Timeout)
+				}
+			}
+			if pp.MaxOutput < 0 {
+				add(field+".post_process.max_output_bytes", "must not be negative")
+			}
+			if pp.OnError != "" && pp.OnError != postProcessFail && pp.OnError != postProcessKeep {
+				add(field+".post_process.on_error", "invalid value %q (expected fail or keep)", pp.OnError)
+			}
+		}
+		for _, m := range templateVariablePattern.FindAllStringSubmatch(t.Prompt, -1) {
+			if !knownTemplateVariable(m[1]) {
+				add(field+".prompt", "unknown variable {{%s}} (expected %s)", m[1], strings.Join(templateVariableNames, ", "))
+			}
+		}
+		for j, code := range t.Languages {
+			if _, ok := languageNames[strings.ToLower(code)]; !ok {
+				add(fmt.Sprintf("%s.languages[%d]", field, j), "unknown language %q (expected a code such as en, de or ja)", code)
+			}
+		}
+	}
+
+	taken := make(map[string]string)
+	if clipboard, quickAsk, followUp, err := configuredHotkeys(cfg); err == nil {
+		taken[clipboard.Name], taken[quickAsk.Name], taken[followUp.Name] = "the clipboard AI hotkey", "the quick ask hotkey", "the follow-up hotkey"
+	}
+	warmNames := make(map[string]bool)
+	for i, p := range cfg.WarmPrompts {
+		field := fmt.Sprintf("warm_prompts[%d]", i)
+		if p.Name == "" {
+			add(field+".name", "must not be empty")
+		} else if warmNames[p.Name] {
+			add(field+".name", "duplicate warm prompt name %q", p.Name)
+		}
+		warmNames[p.Name] = true
+		if strings.TrimSpace(p.Prompt) == "" {
+			add(field+".prompt", "must not be empty")
+		}
+		for _, m := range templateVariablePattern.FindAllStringSubmatch(p.Prompt, -1) {
+			if m[1] != "date" && m[1] != "username" {
+				add(field+".prompt", "unsupported variable {{%s}} (expected date or username)", m[1])
+			}
+		}
+		if p.Hotkey != "" {
+			if spec, err := parseHotkey(p.Hotkey); err != nil {
+				add(field+".hotkey", "%v", err)
+			} else if owner, ok := taken[spec.Name]; ok {
+				add(field+".hotkey", "%s is already %s", spec.Name, owner)
+			} else {
+				taken[spec.Name] = fmt.Sprintf("the hotkey of warm prompt %q", p.Name)
+			}
+		}
+		if p.Refresh != "" {
+			if d, err := time.ParseDuration(p.Refresh); err != nil {
+				add(field+".refresh", "invalid duration %q (use e.g. \"30m\" or \"1h\")", p.Refresh)
+			} else if d < time.Minute {
+				add(field+".refresh", "must be at least 1m, got %q", p.Refresh)
+			}
+		}
+		if !validOutputMode(p.Output) {
+			add(field+".output", "invalid output mode %q (expected full, code or first_code)", p.Output)
+		}
+	}
+
+	if l := cfg.Leader; l != nil {
+		if l.Key != "" {
+			if spec, err := parseHotkey(l.Key); err != nil {
+				add("leader.key", "%v", err)
+			} else if owner, ok := taken[spec.Name]; ok && owner != "the clipboard AI hotkey" {
+				add("leader.key", "%s is already %s", spec.Name, owner)
+			}
+		}
+		if l.Timeout != "" {
+			if d, err := time.ParseDuration(l.Timeout); err != nil {
+				add("leader.timeout", "invalid duration %q (use e.g. \"1500ms\" or \"2s\")", l.Timeout)
+			} else if d <= 0 {
+				add("leader.timeout", "duration must be positive, got %q", l.Timeout)
+			}
+		}
+		if len(l.Actions) == 0 {
+			add("leader.actions", "must not be empty")
+		}
+
+		templateNames := make(map[string]bool)
+		for _, t := range builtinClipboardTemplates() {
+			templateNames[t.Name] = true
+		}
+		for _, t := range cfg.Templates {
+			templateNames[t.Name] = true
+		}
+		bound := make(map[string]string)
+		for key, action := range l.Actions {
+			field := "leader.actions." + key
+			if spec, err := parseKeyCombo(key); err != nil {
+				add(field, "%v", err)
+			} else if other, ok := bound[spec.Name]; ok {
+				add(field, "%s is already bound as %q", spec.Name, other)
+			} else {
+				bound[spec.Name] = key
+			}
+
+			kind, arg, _ := strings.Cut(action, ":")
+			switch {
+			case action == "clipboard" || action == "follow_up" || action == "quick_ask":
+			case kind == "template":
+				// MCP prompts (server/name) are only known once their servers are running
+				if !templateNames[arg] && !strings.Contains(arg, "/") {
+					add(field, "unknown template %q", arg)
+				}
+			case kind == "warm":
+				if arg == "" || !warmNames[arg] {
+					add(field, "unknown warm prompt %q", arg)
+				}
+			case kind == "prompt":
+				if strings.TrimSpace(arg) == "" {
+					add(field, "prompt must not be empty")
+				}
+			default:
+				add(field, "unknown action %q (expected clipboard, follow_up, quick_ask, template:<name>, warm:<name> or prompt:<text>)", action)
+			}
+		}
+	}
+
+	if d := cfg.Digest; d != nil {
+		if d.Time != "" {
+			if _, err := time.Parse("15:04", d.Time); err != nil {
+				add("digest.time", "invalid time %q (use 24-hour HH:MM, e.g. \"07:30\")", d.Time)
+			}
+		}
+		for _, m := range templateVariablePattern.FindAllStringSubmatch(d.Prompt, -1) {
+			if m[1] != "date" && m[1] != "username" {
+				add("digest.prompt", "unsupported variable {{%s}} (expected date or username)", m[1])
+			}
+		}
+		for i, target := range d.Deliver {
+			switch target {
+			case digestNotification, digestDashboard, digestFileTarget:
+			default:
+				add(fmt.Sprintf("digest.deliver[%d]", i), "invalid target %q (expected notification, dashboard or file)", target)
+			}
+		}
+		if d.Format != "" && d.Format != "markdown" && d.Format != "html" {
+			add("digest.format", "invalid format %q (expected markdown or html)", d.Format)
+		}
+	}
+
+	if f := cfg.Footer; f != nil {
+		for i, pattern := range f.Suppress {
+			if _, err := regexp.Compile(pattern); err != nil {
+				add(fmt.Sprintf("footer.suppress[%d]", i), "invalid regex: %v", err)
+			}
+		}
+		for i, target := range f.Targets {
+			if target != responseTargetAPI && target != responseTargetClipboard {
+				add(fmt.Sprintf("footer.targets[%d]", i), "invalid target %q (expected api or clipboard)", target)
+			}
+		}
+	}
+
+	if f := cfg.OutputFilter; f != nil {
+		if f.Action != "" && f.Action != "mask" && f.Action != "block" {
+			add("output_filter.action", "invalid action %q (expected mask or block)", f.Action)
+		}
+		for i, pattern := range f.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				add(fmt.Sprintf("output_filter.patterns[%d]", i), "invalid regex: %v", err)
+			}
+		}
+	}
+
+	return problems
+}
+
+// effectiveSettings describes the values in use, marking those that fell back to defaults
+func (cfg *AppConfig) effectiveSettings() []string {
+	setting := func(name, value, fallback string) string {
+		if value == "" {
+			return fmt.Sprintf("%s: %s (default)", name, fallback)
+		}
+		return fmt.Sprintf("%s: %s", name, value)
+	}
+
+	action := ""
+	if cfg.OutputFilter != nil {
+		action = cfg.OutputFilter.Action
+		if action == "" {
+			action = "mask (default)"
+		}
+	}
+
+	hotkey := ""
+	if spec, err := parseHotkey(cfg.Hotkey); err == nil {
+		hotkey = spec.Name
+	}
+	quickAsk := ""
+	if spec, err := parseHotkey(cfg.QuickAskHotkey); err == nil {
+		quickAsk = spec.Name
+	}
+	followUp := ""
+	if spec, err := parseHotkey(cfg.FollowUpHotkey); err == nil {
+		followUp = spec.Name
+	}
+
+	maxAttempts := ""
+	if cfg.Retry.MaxAttempts > 0 {
+		maxAttempts = strconv.Itoa(cfg.Retry.MaxAttempts)
+	}
+
+	chunkBytes := ""
+	if cfg.Index.ChunkBytes > 0 {
+		chunkBytes = strconv.Itoa(cfg.Index.ChunkBytes)
+	}
+
+	maxChars := ""
+	if cfg.ToolOutput.MaxChars > 0 {
+		maxChars = strconv.Itoa(cfg.ToolOutput.MaxChars)
+	}
+
+	privateFetch := "blocked"
+	if cfg.URLFetch.AllowPrivate {
+		privateFetch = "allowed"
+	}
+
+	lines := []string{
+		setting("timeout", cfg.Timeout, defaultTimeout.String()),
+		setting("clipboard_timeout", cfg.ClipboardTimeout, clipboardTimeout.String()),
+		fmt.Sprintf("api_conversations: %s", cfg.apiConversationMode()),
+		fmt.Sprintf("clipboard_session: %s, ends after %v idle", onOff(cfg.ClipboardSession.Enabled), durationOrDefault(cfg.ClipboardSession.Idle, clipboardSessionIdle)),
+		setting("launcher.timeout", cfg.Launcher.Timeout, launcherTimeout.String()),
+		setting("retry.max_attempts", maxAttempts, strconv.Itoa(defaultMaxAttempts)),
+		setting("hotkey", hotkey, defaultHotkey),
+		setting("quick_ask_hotkey", quickAsk, defaultQuickAskHotkey),
+		setting("follow_up_hotkey", followUp, defaultFollowUpHotkey),
+		fmt.Sprintf("mcp_servers: %d configured", len(cfg.MCPServers)),
+		fmt.Sprintf("warm_prompts: %d configured", len(cfg.WarmPrompts)),
+		setting("tool_output.max_chars", maxChars, "unlimited"),
+		fmt.Sprintf("access_log: %s, %s", onOff(cfg.AccessLog.Enabled), cfg.AccessLog.path()),
+		fmt.Sprintf("url_fetch: private addresses %s, %d allowed host(s), up to %d MiB in %v", privateFetch, len(cfg.URLFetch.AllowedHosts), positiveOrDefault(cfg.URLFetch.MaxSizeMB, defaultFetchMaxMB), durationOrDefault(cfg.URLFetch.Timeout, defaultFetchTimeout)),
+		fmt.Sprintf("tool_execution: %s, %d in parallel, %d round(s)", onOff(cfg.ToolExecution.Enabled), positiveOrDefault(cfg.ToolExecution.MaxParallel, defaultToolParallel), positiveOrDefault(cfg.ToolExecution.MaxRounds, defaultToolRounds)),
+		fmt.Sprintf("token_budget: %s", budgetSummary(cfg.TokenBudget)),
+		setting("insertion.stop_key", cfg.Insertion.StopKey, defaultStopKey),
+		fmt.Sprintf("insertion.clipboard: %s", cfg.Insertion.clipboardSummary()),
+		fmt.Sprintf("priority: %s", prioritySummary(cfg.Priority)),
+		fmt.Sprintf("hedge: %s, after %v without a response", onOff(cfg.Hedge.Enabled), durationOrDefault(cfg.Hedge.Delay, defaultHedgeDelay)),
+		fmt.Sprintf("language: detection %s, answer in detected language %s", onOff(!cfg.Language.Disabled), onOff(!cfg.Language.Disabled && !cfg.Language.KeepAnswer)),
+		fmt.Sprintf("privacy: %s at startup", onOff(cfg.Privacy.Enabled)),
+		fmt.Sprintf("input_simulation: %s", onOff(!cfg.NoInputSimulation && inputSimulationBuilt)),
+		fmt.Sprintf("features: %s", cfg.featuresSummary()),
+		fmt.Sprintf("dedup: %s", onOff(!cfg.Dedup.Disabled)),
+		fmt.Sprintf("stream: relayed from Khoj as it arrives %s, status updates as %s, journal %s", onOff(!cfg.Stream.Buffered), cfg.streamStatus(), onOff(cfg.Stream.Journal)),
+		fmt.Sprintf("logprobs: synthesized %s", onOff(!cfg.Logprobs.Disabled)),
+		fmt.Sprintf("embeddings: %s", cfg.embeddingsBackend()),
+		fmt.Sprintf("moderation: %s", cfg.moderationSummary()),
+		fmt.Sprintf("template_packs: %d trusted key(s)", len(cfg.TemplatePacks.TrustedKeys)),
+		fmt.Sprintf("scratchpad: %s", cfg.scratchpadSummary()),
+		setting("index.chunk_bytes", chunkBytes, strconv.Itoa(defaultIndexChunkBytes)),
+		fmt.Sprintf("annotate: %s", onOff(cfg.Annotate)),
+		setting("fallback_agent", cfg.FallbackAgent, "none"),
+		fmt.Sprintf("agent_presets: %d configured", len(cfg.AgentPresets)),
+		fmt.Sprintf("app_prompts: %d configured", len(cfg.AppPrompts)),
+		setting("theme.mode", cfg.Theme.Mode, defaultThemeMode),
+		setting("theme.accent", cfg.Theme.Accent, defaultAccent),
+		fmt.Sprintf("tray_preview: %s, %d characters", onOff(!cfg.TrayPreview.Disabled), cfg.trayPreviewChars()),
+		fmt.Sprintf("tray_status: %s", onOff(!cfg.TrayStatus.Disabled)),
+	}
+	if ss := cfg.StateSync; ss != nil {
+		store := ss.Folder
+		if store == "" {
+			store = ss.URL
+		}
+		lines = append(lines, fmt.Sprintf("state_sync: %s, checked every %v", store, durationOrDefault(ss.Interval, defaultStateSyncInterval)))
+	} else {
+		lines = append(lines, "state_sync: disabled (default)")
+	}
+	if team := cfg.Team; team != nil {
+		lines = append(lines, fmt.Sprintf("team: %s, fetched every %v", team.URL, durationOrDefault(team.Refresh, defaultTeamRefresh)))
+	} else {
+		lines = append(lines, "team: disabled (default)")
+	}
+	if lm := cfg.LocalModel; lm != nil {
+		lines = append(lines, fmt.Sprintf("local_model: %s at %s, timeout %v, answers in privacy mode: %s", lm.model(), lm.URL, durationOrDefault(lm.Timeout, defaultLocalModelTimeout), onOff(lm.Privacy)))
+	} else {
+		lines = append(lines, "local_model: disabled (default)")
+	}
+	if l := cfg.Leader; l != nil {
+		key := "the clipboard AI hotkey"
+		if spec, err := parseHotkey(l.Key); err == nil {
+			key = spec.Name
+		}
+		lines = append(lines, fmt.Sprintf("leader: %s, %d action(s), waits %v for the second key", key, len(l.Actions), durationOrDefault(l.Timeout, defaultLeaderTimeout)))
+	} else {
+		lines = append(lines, "leader: disabled (default)")
+	}
+	if len(cfg.Workspace.Roots) > 0 {
+		lines = append(lines, "workspace.roots: "+strings.Join(cfg.Workspace.Roots, ", "))
+	} else {
+		lines = append(lines, "workspace.roots: none, reviewed edits are not written (default)")
+	}
+	if action != "" {
+		lines = append(lines, "output_filter.action: "+action)
+	} else {
+		lines = append(lines, "output_filter: disabled (default)")
+	}
+	if d := cfg.Digest; d != nil {
+		at := d.Time
+		if at == "" {
+			at = defaultDigestTime + " (default)"
+		}
+		lines = append(lines, fmt.Sprintf("digest: daily at %s, delivered to %s", at, strings.Join(d.targets(), ", ")))
+	} else {
+		lines = append(lines, "digest: disabled (default)")
+	}
+	if f := cfg.Footer; f != nil {
+		targets := "api, clipboard"
+		if len(f.Targets) > 0 {
+			targets = strings.Join(f.Targets, ", ")
+		}
+		lines = append(lines, fmt.Sprintf("footer: text=%v sources=%v suppress=%d targets=%s", f.Text != "", f.Sources, len(f.Suppress), targets))
+	} else {
+		lines = append(lines, "footer: disabled (default)")
+	}
+	return lines
+}
+
+// trayPreviewChars is the number of answer characters shown in the tray tooltip
+func (cfg *AppConfig) trayPreviewChars() int {
+	if cfg.TrayPreview.Chars > 0 {
+		return cfg.TrayPreview.Chars
+	}
+	return defaultTrayPreviewChars
+}
+
+// onOff renders a boolean setting for config validate
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// budgetSummary describes the token budget settings for config validate
+func budgetSummary(cfg TokenBudgetConfig) string {
+	if cfg.Default == 0 && len(cfg.PerAgent) == 0 {
+		return "unlimited (default)"
+	}
+	strategy := "truncate"
+	if cfg.SummaryAgent != "" {
+		strategy = "summarize with " + cfg.SummaryAgent
+	}
+	return fmt.Sprintf("default %d tokens, %d agent override(s), %s", cfg.Default, len(cfg.PerAgent), strategy)
+}
+
+// durationOrDefault parses a validated duration setting
+func durationOrDefault(value string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// positiveOrDefault returns a validated count setting, or fallback when it is unset
+func positiveOrDefault(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// configWalker streams config tokens against AppConfig's shape, recording unknown keys and type mismatches
+type configWalker struct {
+	data    []byte
+	dec     *json.Decoder
+	diags   []configDiagnostic
+	offsets map[string]int64 // Field path -> offset of its value
+}
+
+func (w *configWalker) report(offset int64, field, format string, args ...interface{}) {
+	line, col := offsetPosition(w.data, offset)
+	w.diags = append(w.diags, configDiagnostic{Line: line, Column: col, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// walk consumes one JSON value; t is nil for values that are skipped. A non-nil error means the JSON is malformed.
+func (w *configWalker) walk(t reflect.Type, path string) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	offset := w.dec.InputOffset()
+	w.offsets[path] = offset
+	tok, err := w.dec.Token()
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			offset = syntaxErr.Offset
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			offset = int64(len(w.data))
+			err = fmt.Errorf("unexpected end of file")
+		}
+		w.report(offset, path, "syntax error: %v", err)
+		return err
+	}
+
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '[' {
+			if t != nil && t.Kind() != reflect.Slice {
+				w.report(offset, path, "expected %s, got array", configTypeName(t))
+				t = nil
+			}
+			for i := 0; w.dec.More(); i++ {
+				var elem reflect.Type
+				if t != nil {
+					elem = t.Elem()
+				}
+				if err := w.walk(elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err := w.dec.Token()
+			return err
+		}
+
+		var fields map[string]reflect.Type
+		switch {
+		case t == nil:
+		case t.Kind() == reflect.Struct:
+			fields = configFields(t)
+		case t.Kind() == reflect.Map:
+		default:
+			w.report(offset, path, "expected %s, got object", configTypeName(t))
+			t = nil
+		}
+		for w.dec.More() {
+			keyOffset := w.dec.InputOffset()
+			keyTok, err := w.dec.Token()
+			if err != nil {
+				return w.walkErr(err)
+			}
+			key, _ := keyTok.(string)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+
+			var child reflect.Type
+			switch {
+			case fields != nil:
+				ft, ok := fields[key]
+				if !ok {
+					w.report(keyOffset, keyPath, "unknown key%s", suggestConfigKey(key, fields))
+				}
+				child = ft
+			case t != nil:
+				child = t.Elem()
+			}
+			if err := w.walk(child, keyPath); err != nil {
+				return err
+			}
+		}
+		_, err := w.dec.Token()
+		return err
+
+	case string:
+		if t != nil && t.Kind() != reflect.String && t.Kind() != reflect.Interface {
+			w.report(offset, path, "expected %s, got string %q", configTypeName(t), v)
+		}
+	case json.Number:
+		switch {
+		case t == nil || t.Kind() == reflect.Interface:
+		case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+			if _, err := v.Int64(); err != nil {
+				w.report(offset, path, "expected integer, got %s", v)
+			}
+		case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		default:
+			w.report(offset, path, "expected %s, got number %s", configTypeName(t), v)
+		}
+	case bool:
+		if t != nil && t.Kind() != reflect.Bool && t.Kind() != reflect.Interface {
+			w.report(offset, path, "expected %s, got boolean", configTypeName(t))
+		}
+	}
+	return nil
+}
+
+func (w *configWalker) walkErr(err error) error {
+	offset := w.dec.InputOffset()
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		offset = syntaxErr.Offset
+	}
+	w.report(offset, "", "syntax error: %v", err)
+	return err
+}
+
+// configFields maps a struct's JSON keys to field types
+func configFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for name, i := range configFieldIndexes(t) {
+		fields[name] = t.Field(i).Type
+	}
+	return fields
+}
+
+// configFieldIndexes maps a struct's JSON keys to field indexes
+func configFieldIndexes(t reflect.Type) map[string]int {
+	indexes := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		indexes[name] = i
+	}
+	return indexes
+}
+
+func configTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// suggestConfigKey returns a "did you mean" hint for keys within two edits of a known one
+func suggestConfigKey(key string, fields map[string]reflect.Type) string {
+	best, bestDist := "", 3
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// offsetPosition converts a byte offset to a 1-based line and column, skipping separators before the token
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+		offset++
+	}
+	line, col := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// parseHotkey parses combinations such as "Ctrl+Q", "Ctrl+Shift+K" or "Alt+F9"
+func parseHotkey(s string) (hotkeySpec, error) {
+	spec, err := parseKeyCombo(s)
+	if err != nil {
+		return hotkeySpec{}, err
+	}
+	if len(spec.Keys) < 2 {
+		return hotkeySpec{}, fmt.Errorf("invalid hotkey %q: needs at least one modifier, e.g. Ctrl+%s", s, strings.TrimSpace(s))
+	}
+	return spec, nil
+}
+
+// parseKeyCombo parses a single key or modifier combination such as "Esc" or "Ctrl+Q"
+func parseKeyCombo(s string) (hotkeySpec, error) {
+	modifiers := map[string]uint16{"ctrl": VK_CONTROL, "control": VK_CONTROL, "shift": 0x10, "alt": 0x12, "win": 0x5B}
+	named := map[string]uint16{"space": 0x20, "enter": 0x0D, "tab": 0x09, "esc": 0x1B, "escape": 0x1B, "insert": 0x2D, "home": 0x24, "end": 0x23, "pageup": 0x21, "pagedown": 0x22, "pause": 0x13}
+	display := map[string]string{"ctrl": "Ctrl", "control": "Ctrl", "escape": "Esc", "pageup": "PageUp", "pagedown": "PageDown"}
+
+	parts := strings.Split(s, "+")
+	var spec hotkeySpec
+	var labels []string
+	for i, part := range parts {
+		name := strings.ToLower(strings.TrimSpace(part))
+		last := i == len(parts)-1
+		label := display[name]
+		if label == "" && name != "" {
+			label = strings.ToUpper(name[:1]) + name[1:]
+		}
+		labels = append(labels, label)
+		if vk, ok := modifiers[name]; ok && !last {
+			spec.Keys = append(spec.Keys, vk)
+			continue
+		}
+		if !last {
+			return hotkeySpec{}, fmt.Errorf("invalid hotkey %q: %q is not a modifier (Ctrl, Shift, Alt, Win)", s, part)
+		}
+
+		switch {
+		case len(name) == 1 && name[0] >= 'a' && name[0] <= 'z':
+			spec.Keys = append(spec.Keys, uint16(name[0]-'a'+'A'))
+		case len(name) == 1 && name[0] >= '0' && name[0] <= '9':
+			spec.Keys = append(spec.Keys, uint16(name[0]))
+		case len(name) >= 2 && name[0] == 'f':
+			n, err := strconv.Atoi(name[1:])
+			if err != nil || n < 1 || n > 24 {
+				return hotkeySpec{}, fmt.Errorf("invalid hotkey %q: unknown key %q", s, part)
+			}
+			spec.Keys = append(spec.Keys, uint16(0x70+n-1))
+		case named[name] != 0:
+			spec.Keys = append(spec.Keys, named[name])
+		default:
+			return hotkeySpec{}, fmt.Errorf("invalid hotkey %q: unknown key %q (use A-Z, 0-9, F1-F24, Space, Enter, Tab, Esc, Insert, Home, End, PageUp, PageDown, Pause)", s, part)
+		}
+	}
+	spec.Name = strings.Join(labels, "+")
+	return spec, nil
+}
+
+// runConfigCommand implements `khoj-wrapper config validate`, returning the process exit code
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: khoj-wrapper config validate")
+		return 2
+	}
+
+	cfg, applied, found, diags, err := checkConfigFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	if !found {
+		fmt.Printf("ℹ️ %s not found; all defaults apply\n", configFile)
+	}
+
+	if len(diags) > 0 {
+		for _, d := range diags {
+			fmt.Fprintf(os.Stderr, "❌ %s\n", d)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(diags))
+		return 1
+	}
+
+	fmt.Printf("✅ %s is valid\n", configFile)
+	if applied > 0 {
+		fmt.Printf("  %s: %d variable(s) loaded\n", envFile, applied)
+	}
+	for _, line := range cfg.effectiveSettings() {
+		fmt.Printf("  %s\n", line)
+	}
+	return 0
+}
+
+// checkConfigFiles loads .env and checks config.json and KHOJ_TIMEOUT, returning every problem found. A missing
+// config.json is not a problem; found reports whether it exists.
+func checkConfigFiles() (cfg *AppConfig, applied int, found bool, diags []configDiagnostic, err error) {
+	applied, diags, err = loadEnvFile(envFile)
+	if err != nil {
+		return nil, 0, false, nil, err
+	}
+	cfg = &AppConfig{}
+	data, err := os.ReadFile(configFile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, 0, false, nil, fmt.Errorf("failed to read %s: %w", configFile, err)
+	default:
+		found = true
+		var configDiags []configDiagnostic
+		cfg, configDiags = checkConfig(data)
+		diags = append(diags, configDiags...)
+	}
+
+	if timeoutStr := os.Getenv("KHOJ_TIMEOUT"); timeoutStr != "" {
+		if _, err := time.ParseDuration(timeoutStr); err != nil {
+			diags = append(diags, configDiagnostic{Field: "KHOJ_TIMEOUT (environment)", Message: fmt.Sprintf("invalid duration %q", timeoutStr)})
+		}
+	}
+	return cfg, applied, found, diags, nil
+}
+
+// doctorCheck is one line of the `khoj-wrapper doctor` report
+type doctorCheck struct {
+	Name    string
+	Status  string // doctorPass, doctorWarn or doctorFail
+	Detail  string
+	Details []string // Extra lines, such as each config problem
+}
+
+const (
+	doctorPass = "✅"
+	doctorWarn = "⚠️"
+	doctorFail = "❌"
+)
+
+// runDoctor implements `khoj-wrapper doctor`: it checks config, the Khoj connection and API key, the agent, file
+// permissions and the port, prints a report and returns 1 when any check fails. Warnings don't fail.
+func runDoctor(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: khoj-wrapper doctor")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Khoj wrapper %s doctor\n", version)
+	failed := 0
+	for _, check := range doctorChecks(ctx) {
+		fmt.Printf("%s %s: %s\n", check.Status, check.Name, check.Detail)
+		for _, line := range check.Details {
+			fmt.Printf("    %s\n", line)
+		}
+		if check.Status == doctorFail {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d problem(s) found\n", failed)
+		return 1
+	}
+	fmt.Println("No problems found")
+	return 0
+}
+
+// doctorChecks runs every doctor check in report order. Checks that depend on an earlier one, like the API key
+// on the connection, are skipped when it failed.
+func doctorChecks(ctx context.Context) []doctorCheck {
+	var checks []doctorCheck
+
+	cfg, applied, found, diags, err := checkConfigFiles()
+	config := doctorCheck{Name: "Config", Status: doctorPass, Detail: configFile + " is valid"}
+	switch {
+	case err != nil:
+		config.Status, config.Detail = doctorFail, err.Error()
+		cfg = &AppConfig{}
+	case len(diags) > 0:
+		config.Status, config.Detail = doctorFail, fmt.Sprintf("%d problem(s) in %s or %s", len(diags), configFile, envFile)
+		for _, d := range diags {
+			config.Details = append(config.Details, d.String())
+		}
+		if cfg == nil {
+			cfg = &AppConfig{}
+		}
+	case !found:
+		config.Detail = configFile + " not found, all defaults apply"
+	}
+	if applied > 0 {
+		config.Details = append(config.Details, fmt.Sprintf("%s: %d variable(s) loaded", envFile, applied))
+	}
+	checks = append(checks, config)
+
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+	apiKey := os.Getenv("KHOJ_API_KEY")
+
+	connection := doctorCheck{Name: "Connection", Status: doctorPass, Detail: "Khoj answers at " + apiBase}
+	checkCtx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+	err = validateKhojConnection(checkCtx, apiBase, apiKey)
+	cancel()
+	unauthorized := errors.Is(err, errKhojUnauthorized)
+	if err != nil && !unauthorized {
+		hint := classifyKhojError(err).Hint
+		connection.Status, connection.Detail = doctorFail, fmt.Sprintf("%s: %s", apiBase, hint)
+		if hint != err.Error() {
+			connection.Details = []string{err.Error()}
+		}
+	}
+	checks = append(checks, connection)
+
+	auth := doctorCheck{Name: "API key", Status: doctorPass, Detail: "accepted by Khoj"}
+	switch {
+	case apiKey == "":
+		auth.Status, auth.Detail = doctorFail, "KHOJ_API_KEY is not set, add it to "+envFile+" or the environment"
+	case unauthorized:
+		auth.Status, auth.Detail = doctorFail, classifyKhojError(errKhojUnauthorized).Hint
+	case connection.Status == doctorFail:
+		auth.Status, auth.Detail = doctorWarn, "not checked, Khoj is unreachable"
+	}
+	checks = append(checks, auth)
+
+	checks = append(checks, doctorAgentCheck(ctx, cfg, apiBase, apiKey, auth.Status == doctorPass))
+	if cfg.LocalModel != nil {
+		checks = append(checks, doctorLocalModelCheck(ctx, cfg.LocalModel))
+	}
+	checks = append(checks, doctorFilesCheck())
+	checks = append(checks, doctorPortCheck(ctx))
+	return checks
+}
+
+// doctorAgentCheck looks for the saved agent in the agents Khoj lists. Khoj doesn't list private agents shared by
+// slug, so a missing agent is only a warning.
+func doctorAgentCheck(ctx context.Context, cfg *AppConfig, apiBase, apiKey string, reachable bool) doctorCheck {
+	check := doctorCheck{Name: "Agent", Status: doctorPass}
+
+	state, err := loadConversationState()
+	if err != nil {
+		check.Status, check.Detail = doctorFail, err.Error()
+		return check
+	}
+	agent := state.AgentSlug
+	if agent == "" {
+		agent = defaultAgentSlug
+	}
+	check.Detail = agent + " is listed by Khoj"
+	if !reachable {
+		check.Status, check.Detail = doctorWarn, agent+" not checked, the API key check didn't pass"
+		return check
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+	defer cancel()
+	agents, err := fetchKhojAgents(checkCtx, http.DefaultClient, apiBase, apiKey)
+	if err != nil {
+		check.Status, check.Detail = doctorWarn, fmt.Sprintf("%s not checked, Khoj didn't list its agents: %v", agent, err)
+		return check
+	}
+	listed := map[string]bool{}
+	for _, a := range agents {
+		listed[a.Slug] = true
+	}
+	if !listed[agent] {
+		check.Status, check.Detail = doctorWarn, agent+" is not listed by Khoj; fine for a private agent, otherwise pick another with Edit Agent Slug"
+	}
+	if cfg.FallbackAgent != "" && !listed[cfg.FallbackAgent] {
+		check.Status = doctorWarn
+		check.Details = []string{"fallback agent " + cfg.FallbackAgent + " is not listed by Khoj"}
+	}
+	return check
+}
+
+// doctorFilesCheck makes sure the working directory and the wrapper's state files can be written, and that .env,
+// which holds the API key, isn't readable by other users
+func doctorFilesCheck() doctorCheck {
+	dir, _ := os.Getwd()
+	check := doctorCheck{Name: "Files", Status: doctorPass, Detail: dir + " is writable"}
+
+	probe, err := os.CreateTemp(".", ".khoj-doctor-*")
+	if err != nil {
+		check.Status, check.Detail = doctorFail, fmt.Sprintf("%s is not writable: %v", dir, err)
+		return check
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	for _, name := range []string{conversationStateFile, configFile, envFile, sharedLinksFile, clientMappingsFile, digestFile, uploadedFilesFile, apiFilesFile, streamJournalFile, interruptedFile, windowPlacementsFile} {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			check.Status = doctorFail
+			check.Details = append(check.Details, fmt.Sprintf("%s is not writable: %v", name, err))
+			continue
+		}
+		f.Close()
+	}
+	if check.Status == doctorFail {
+		check.Detail = "some files can't be saved"
+	}
+
+	if info, err := os.Stat(envFile); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		if check.Status == doctorPass {
+			check.Status = doctorWarn
+		}
+		check.Details = append(check.Details, fmt.Sprintf("%s is readable by other users (%v), run chmod 600 %s", envFile, info.Mode().Perm(), envFile))
+	}
+	return check
+}
+
+// doctorLocalModelCheck asks the local model's server for its models. It only stands in for Khoj, so a server that
+// isn't running is a warning.
+func doctorLocalModelCheck(ctx context.Context, lm *LocalModelConfig) doctorCheck {
+	check := doctorCheck{Name: "Local model", Status: doctorPass, Detail: lm.model() + " answers at " + lm.URL}
+
+	checkCtx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(checkCtx, "GET", strings.TrimRight(lm.URL, "/")+"/models", nil)
+	if err != nil {
+		check.Status, check.Detail = doctorFail, fmt.Sprintf("invalid URL %s: %v", lm.URL, err)
+		return check
+	}
+	if lm.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+lm.APIKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		check.Status, check.Detail = doctorWarn, fmt.Sprintf("%s can't be reached, so Khoj has no stand-in: %v", lm.URL, err)
+		return check
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		check.Status, check.Detail = doctorWarn, fmt.Sprintf("%s/models answered with status %d", strings.TrimRight(lm.URL, "/"), resp.StatusCode)
+	}
+	return check
+}
+
+// doctorPortCheck makes sure the HTTP port is free, or taken by a wrapper that is already running
+func doctorPortCheck(ctx context.Context) doctorCheck {
+	port := serverPort()
+	check := doctorCheck{Name: "Port", Status: doctorPass, Detail: port + " is free"}
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err == nil {
+		listener.Close()
+		return check
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(checkCtx, "GET", "http://127.0.0.1:"+port+"/health", nil)
+	if resp, herr := http.DefaultClient.Do(req); herr == nil {
+		var health map[string]string
+		json.NewDecoder(resp.Body).Decode(&health)
+		resp.Body.Close()
+		if health["status"] == "healthy" {
+			check.Detail = port + " is in use by a running wrapper"
+			return check
+		}
+	}
+	check.Status = doctorFail
+	check.Detail = fmt.Sprintf("%s is in use by another program, set PORT to a free one: %v", port, err)
+	return check
+}
+
+// compileOutputFilter builds the output filter from config, loading wordlist files
+func compileOutputFilter(cfg *OutputFilterConfig) (*outputFilter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	filter := &outputFilter{mask: cfg.Mask}
+	switch cfg.Action {
+	case "", "mask":
+	case "block":
+		filter.block = true
+	default:
+		return nil, fmt.Errorf("invalid output_filter action %q (expected mask or block)", cfg.Action)
+	}
+
+	patterns, err := compileWordFilters("output_filter", cfg.Words, cfg.Wordlists, cfg.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	filter.patterns = patterns
+	return filter, nil
+}
+
+// compileWordFilters turns whole words, wordlist files and regular expressions into filters; field names the
+// setting in errors
+func compileWordFilters(field string, words, wordlists, patterns []string) ([]*textFilter, error) {
+	var compiled []*textFilter
+	words = append([]string(nil), words...)
+	for _, path := range wordlists {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read wordlist: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				words = append(words, line)
+			}
+		}
+	}
+	if len(words) > 0 {
+		filter := &textFilter{words: true}
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = regexp.QuoteMeta(word)
+			filter.alts = append(filter.alts, regexp.MustCompile(`(?i)\A(?:`+quoted[i]+`)`))
+		}
+		filter.re = regexp.MustCompile(`(?i)(?:` + strings.Join(quoted, "|") + `)`)
+		compiled = append(compiled, filter)
+	}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", field, pattern, err)
+		}
+		compiled = append(compiled, &textFilter{re: re})
+	}
+	return compiled, nil
+}
+
+// textFilter is a compiled filter: a regular expression, or a list of whole words. RE2's \b only knows ASCII
+// letters, so word matches are checked against their neighbors instead: a word that starts or ends with a letter,
+// digit or underscore must not touch another one on that side. Words like "über" and "c++" match as written.
+type textFilter struct {
+	re    *regexp.Regexp
+	words bool
+	alts  []*regexp.Regexp // Each word on its own, anchored, to retry every word where re found one
+}
+
+// find returns the byte ranges of the filter's matches in text
+func (f *textFilter) find(text string) [][]int {
+	if !f.words {
+		return f.re.FindAllStringIndex(text, -1)
+	}
+	var found [][]int
+	for pos := 0; pos < len(text); {
+		loc := f.re.FindStringIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		start := pos + loc[0]
+		if end := f.wordAt(text, start); end > start {
+			found = append(found, []int{start, end})
+			pos = end
+			continue
+		}
+		// A rejected match may hide one that starts inside it
+		_, size := utf8.DecodeRuneInString(text[start:])
+		pos = start + max(size, 1)
+	}
+	return found
+}
+
+// wordAt returns the end of the longest word that starts at text[start:] and stands on its own, or -1. Each word is
+// tried, since the one re picked may be cut off mid-word where a longer or shorter one is not.
+func (f *textFilter) wordAt(text string, start int) int {
+	best := -1
+	for _, alt := range f.alts {
+		if loc := alt.FindStringIndex(text[start:]); loc != nil && loc[1] > 0 && start+loc[1] > best && wordBounded(text, start, start+loc[1]) {
+			best = start + loc[1]
+		}
+	}
+	return best
+}
+
+// wordBounded reports whether text[start:end] stands on its own: each edge that is a word rune faces a non-word rune
+func wordBounded(text string, start, end int) bool {
+	first, _ := utf8.DecodeRuneInString(text[start:end])
+	last, _ := utf8.DecodeLastRuneInString(text[start:end])
+	if isWordRune(first) && start > 0 {
+		if before, _ := utf8.DecodeLastRuneInString(text[:start]); isWordRune(before) {
+			return false
+		}
+	}
+	if isWordRune(last) && end < len(text) {
+		if after, _ := utf8.DecodeRuneInString(text[end:]); isWordRune(after) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordRune reports whether r is part of a word: a letter, digit, combining mark or underscore in any script
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// MatchString reports whether the filter matches anywhere in text
+func (f *textFilter) MatchString(text string) bool {
+	if !f.words {
+		return f.re.MatchString(text)
+	}
+	return len(f.find(text)) > 0
+}
+
+// ReplaceAllStringFunc replaces each match with what repl returns for it
+func (f *textFilter) ReplaceAllStringFunc(text string, repl func(string) string) string {
+	if !f.words {
+		return f.re.ReplaceAllStringFunc(text, repl)
+	}
+	var out strings.Builder
+	last := 0
+	for _, loc := range f.find(text) {
+		out.WriteString(text[last:loc[0]])
+		out.WriteString(repl(text[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// compileModerationFilters builds the filters of each moderation category from config, loading wordlist files
+func compileModerationFilters(cfg ModerationConfig) (map[string][]*textFilter, error) {
+	filters := make(map[string][]*textFilter, len(cfg.Categories))
+	for category, f := range cfg.Categories {
+		if !slices.Contains(moderationCategories, category) {
+			return nil, fmt.Errorf("unknown moderation category %q", category)
+		}
+		patterns, err := compileWordFilters("moderation."+category, f.Words, f.Wordlists, f.Patterns)
+		if err != nil {
+			return nil, err
+		}
+		filters[category] = patterns
+	}
+	return filters, nil
+}
+
+// compileFooter builds footer handling from config
+func compileFooter(cfg *FooterConfig) (*responseFooter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	footer := &responseFooter{text: cfg.Text, sources: cfg.Sources, targets: map[string]bool{}}
+	for _, pattern := range cfg.Suppress {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid footer suppress pattern %q: %w", pattern, err)
+		}
+		footer.suppress = append(footer.suppress, re)
+	}
+
+	targets := cfg.Targets
+	if len(targets) == 0 {
+		targets = []string{responseTargetAPI, responseTargetClipboard}
+	}
+	for _, target := range targets {
+		if target != responseTargetAPI && target != responseTargetClipboard {
+			return nil, fmt.Errorf("invalid footer target %q (expected api or clipboard)", target)
+		}
+		footer.targets[target] = true
+	}
+
+	return footer, nil
+}
+
+// Apply strips suppressed footers from a response and appends the configured ones for the given target
+func (f *responseFooter) Apply(resp *KhojResponse, target string) string {
+	text := resp.Response
+	if f == nil || !f.targets[target] {
+		return text
+	}
+
+	for _, re := range f.suppress {
+		text = re.ReplaceAllString(text, "")
+	}
+	text = strings.TrimRight(text, " \t\r\n")
+
+	if f.sources {
+		if sources := khojSources(resp); len(sources) > 0 {
+			text += "\n\nSources:\n- " + strings.Join(sources, "\n- ")
+		}
+	}
+	if f.text != "" {
+		footer := strings.NewReplacer("{agent}", currentAgentSlug, "{conversation}", resp.ConversationID).Replace(f.text)
+		text += "\n\n" + footer
+	}
+	return text
+}
+
+// khojSources lists the documents and web pages Khoj used for an answer, without duplicates
+func khojSources(resp *KhojResponse) []string {
+	var sources []string
+	seen := map[string]bool{}
+	add := func(source string) {
+		if source != "" && !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+
+	for _, ref := range resp.Context {
+		if file, ok := ref["file"].(string); ok {
+			add(file)
+		} else if uri, ok := ref["uri"].(string); ok {
+			add(uri)
+		}
+	}
+
+	// Online context is keyed by search query; sort for a stable order
+	queries := make([]string, 0, len(resp.OnlineContext))
+	for query := range resp.OnlineContext {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+	for _, query := range queries {
+		results, _ := resp.OnlineContext[query].(map[string]interface{})
+		organic, _ := results["organic"].([]interface{})
+		for _, item := range organic {
+			if page, ok := item.(map[string]interface{}); ok {
+				link, _ := page["link"].(string)
+				add(link)
+			}
+		}
+	}
+	return sources
+}
+
+// postProcessResponse is the response middleware: code extraction or footer handling, then the output filter over the result
+func postProcessResponse(resp *KhojResponse, target, outputMode string) (content string, matches int, blocked bool) {
+	return activeOutputFilter.Apply(responseContent(resp, target, outputMode))
+}
+
+// responseContent reduces a response to its output mode, adding footers to prose; the output filter is not applied
+func responseContent(resp *KhojResponse, target, outputMode string) string {
+	if outputMode == outputModeJSON {
+		return jsonModeContent(resp.Response)
+	}
+	if outputMode == outputModeCode || outputMode == outputModeFirstCode {
+		// Code is pasted as-is, so footers are left off
+		return codeOnlyResponse(resp.Response, outputMode == outputModeFirstCode)
+	}
+	return activeFooter.Apply(resp, target)
+}
+
+// cappedBuffer collects command output up to max bytes and fails writes beyond it, or with truncate keeps the
+// first max bytes and drops the rest
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	truncate bool
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		b.overflow = true
+		if b.truncate {
+			b.buf.Write(p[:b.max-b.buf.Len()])
+			return len(p), nil
+		}
+		return 0, fmt.Errorf("output exceeds %d bytes", b.max)
+	}
+	return b.buf.Write(p)
+}
+
+// applyPostProcess runs the post-process command if there is one; with on_error "keep" a failure returns the response unchanged
+func applyPostProcess(ctx context.Context, cfg *PostProcessConfig, response string) (string, error) {
+	if cfg == nil {
+		return response, nil
+	}
+	processed, err := runPostProcess(ctx, cfg, response)
+	if err != nil && cfg.OnError == postProcessKeep {
+		log.Printf("⚠️ %v; keeping the unprocessed response", err)
+		return response, nil
+	}
+	return processed, err
+}
+
+// runPostProcess pipes a response through a template's post-process command and returns its stdout
+func runPostProcess(ctx context.Context, cfg *PostProcessConfig, response string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, durationOrDefault(cfg.Timeout, defaultPostProcessTimeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cfg.Command, cfg.Args...)
+	cmd.WaitDelay = time.Second // Don't wait on grandchildren still holding the pipes
+	hideChildWindow(cmd)
+
+	cmd.Dir = cfg.Dir
+	if cmd.Dir == "" {
+		dir, err := os.MkdirTemp("", "khoj-post-process-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create post-process directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		cmd.Dir = dir
+	}
+
+	if cfg.InheritEnv {
+		cmd.Env = os.Environ()
+	} else {
+		cmd.Env = []string{}
+		for _, entry := range os.Environ() {
+			name, _, _ := strings.Cut(entry, "=")
+			for _, allowed := range postProcessEnvAllowlist {
+				if strings.EqualFold(name, allowed) {
+					cmd.Env = append(cmd.Env, entry)
+					break
+				}
+			}
+		}
+	}
+	for key, value := range cfg.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	maxOutput := cfg.MaxOutput
+	if maxOutput == 0 {
+		maxOutput = defaultPostProcessOutput
+	}
+	stdout := &cappedBuffer{max: maxOutput}
+	stderr := &cappedBuffer{max: 4096, truncate: true} // Only kept for error messages, so a chatty command still succeeds
+	cmd.Stdin = strings.NewReader(response)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("post-process command %s timed out after %v", cfg.Command, time.Since(start).Round(time.Millisecond))
+	}
+	if stdout.overflow {
+		return "", fmt.Errorf("post-process command %s wrote more than %d bytes", cfg.Command, maxOutput)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return "", fmt.Errorf("post-process command %s failed: %w: %s", cfg.Command, err, msg)
+		}
+		return "", fmt.Errorf("post-process command %s failed: %w", cfg.Command, err)
+	}
+	log.Printf("🔧 Post-processed response with %s in %v (%d -> %d bytes)", cfg.Command, time.Since(start).Round(time.Millisecond), len(response), stdout.buf.Len())
+	return strings.TrimRight(stdout.buf.String(), "\r\n"), nil
+}
+
+// withVerbosity prefixes a prompt with the instruction of a verbosity preset, if any
+func withVerbosity(verbosity, prompt string) string {
+	preset, ok := verbosityPresets[verbosity]
+	if !ok {
+		return prompt
+	}
+	return preset.Instruction + "\n\n" + prompt
+}
+
+// Citation styles for pasted answers
+const (
+	citationsFootnotes = "footnotes" // Markdown footnotes: text[^1], with [^1]: source at the end
+	citationsInline    = "inline"    // Bracketed numbers: text [1], with a numbered source list at the end
+	citationsNone      = "none"      // Links reduced to their text and no sources, for targets that show markup as-is
+)
+
+var (
+	// markdownLinkPattern matches [text](url) links and ![alt](url) images
+	markdownLinkPattern = regexp.MustCompile(`(!?)\[([^\]\n]+)\]\((https?://[^)\s]+)\)`)
+
+	// footnotePattern matches Markdown footnote definitions and references the agent wrote itself
+	footnotePattern = regexp.MustCompile(`(?m)^\[\^[^\]\s]+\]:.*\n?|\[\^[^\]\s]+\]`)
+)
+
+// validCitationStyle reports whether style is a known citation style; empty keeps the answer as written
+func validCitationStyle(style string) bool {
+	switch style {
+	case "", citationsFootnotes, citationsInline, citationsNone:
+		return true
+	}
+	return false
+}
+
+// withCitations rewrites the links in an answer, and the references Khoj returned with it, in a citation style.
+// Links are numbered in order, followed by the other sources Khoj cited. The returned response has no references
+// left, so a footer with sources doesn't list them a second time.
+func withCitations(resp *KhojResponse, style string) *KhojResponse {
+	if style == "" {
+		return resp
+	}
+
+	var sources []string
+	numbers := map[string]int{}
+	cite := func(source string) int {
+		if numbers[source] == 0 {
+			sources = append(sources, source)
+			numbers[source] = len(sources)
+		}
+		return numbers[source]
+	}
+
+	text := markdownLinkPattern.ReplaceAllStringFunc(resp.Response, func(link string) string {
+		m := markdownLinkPattern.FindStringSubmatch(link)
+		switch {
+		case m[1] == "!":
+			return link // Images aren't citations
+		case style == citationsNone:
+			return m[2]
+		case style == citationsFootnotes:
+			return fmt.Sprintf("%s[^%d]", m[2], cite(m[3]))
+		default:
+			return fmt.Sprintf("%s [%d]", m[2], cite(m[3]))
+		}
+	})
+
+	if style == citationsNone {
+		text = footnotePattern.ReplaceAllString(text, "")
+	} else {
+		for _, source := range khojSources(resp) {
+			cite(source)
+		}
+	}
+	text = strings.TrimRight(text, " \t\r\n")
+
+	if len(sources) > 0 {
+		text += "\n"
+		for i, source := range sources {
+			if style == citationsFootnotes {
+				text += fmt.Sprintf("\n[^%d]: %s", i+1, source)
+			} else {
+				text += fmt.Sprintf("\n[%d] %s", i+1, source)
+			}
+		}
+	}
+
+	cited := *resp
+	cited.Response = text
+	cited.Context, cited.OnlineContext = nil, nil
+	return &cited
+}
+
+// limitResponseLength truncates a prose answer to maxChars at a sentence boundary; code and JSON are never cut
+func limitResponseLength(resp *KhojResponse, outputMode string, maxChars int) *KhojResponse {
+	if maxChars <= 0 || (outputMode != "" && outputMode != outputModeFull) {
+		return resp
+	}
+	truncated := truncateAtSentence(resp.Response, maxChars)
+	if truncated == resp.Response {
+		return resp
+	}
+	log.Printf("✂️ Response truncated from %d to %d characters", utf8.RuneCountInString(resp.Response), utf8.RuneCountInString(truncated))
+	limited := *resp
+	limited.Response = truncated
+	return &limited
+}
+
+// truncateAtSentence cuts text to at most maxChars characters, ending at the last full sentence when one
+// ends past a third of the limit, and otherwise at the last word followed by an ellipsis
+func truncateAtSentence(text string, maxChars int) string {
+	text = strings.TrimSpace(text)
+	runes := []rune(text)
+	if maxChars <= 0 || len(runes) <= maxChars {
+		return text
+	}
+
+	cut := runes[:maxChars]
+	for i := len(cut) - 1; i >= maxChars/3; i-- {
+		switch cut[i] {
+		case '.', '!', '?', '。', '！', '？':
+			// A sentence ends at punctuation followed by whitespace; CJK full stops need no space
+			if cut[i] < 0x3000 && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+				continue
+			}
+			return strings.TrimSpace(string(cut[:i+1]))
+		case '\n':
+			if i > 0 && cut[i-1] == '\n' {
+				return strings.TrimSpace(string(cut[:i]))
+			}
+		}
+	}
+
+	if i := strings.LastIndexFunc(string(cut), unicode.IsSpace); i > 0 {
+		return strings.TrimSpace(string(cut)[:i]) + "…"
+	}
+	return string(cut[:maxChars-1]) + "…"
+}
+
+// validOutputMode reports whether mode is empty or a known output mode
+func validOutputMode(mode string) bool {
+	switch mode {
+	case "", outputModeFull, outputModeCode, outputModeFirstCode:
+		return true
+	}
+	return false
+}
+
+// codeOnlyResponse reduces a response to its code blocks, or the trimmed text when there are none
+func codeOnlyResponse(text string, firstOnly bool) string {
+	blocks := extractCodeBlocks(text)
+	if len(blocks) == 0 {
+		log.Printf("No code blocks found in response, returning it unchanged")
+		return strings.TrimSpace(text)
+	}
+	if firstOnly {
+		return blocks[0]
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// Apply masks matches in text; blocked is true when matches were found and the action is block
+func (f *outputFilter) Apply(text string) (filtered string, matches int, blocked bool) {
+	if f == nil {
+		return text, 0, false
+	}
+
+	filtered = text
+	for _, re := range f.patterns {
+		filtered = re.ReplaceAllStringFunc(filtered, func(match string) string {
+			matches++
+			if f.mask != "" {
+				return f.mask
+			}
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		})
+	}
+
+	if matches > 0 && f.block {
+		return text, matches, true
+	}
+	return filtered, matches, false
+}
+
+// readSecret reads a secret from the Windows Credential Manager, falling back to the environment elsewhere
+func readSecret(name string) (string, error) {
+	if runtime.GOOS != "windows" {
+		value := os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("secret %s not found in environment", name)
+		}
+		return value, nil
+	}
+
+	target, err := utf16PtrFromString(secretTargetPrefix + name)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret name: %w", err)
+	}
+
+	var cred *winCredential
+	r1, _, callErr := procCredReadW.Call(uintptr(unsafe.Pointer(target)), 1, 0, uintptr(unsafe.Pointer(&cred))) // CRED_TYPE_GENERIC
+	if r1 == 0 {
+		return "", fmt.Errorf("secret %s not found in credential manager: %v", name, callErr)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	if cred.CredentialBlobSize == 0 {
+		return "", nil
+	}
+	return string(unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)), nil
+}
+
+// writeSecret stores or replaces a secret in the Windows Credential Manager
+func writeSecret(name, value string) error {
+	if runtime.GOOS != "windows" {
+		return fmt.Errorf("secret store only available on Windows")
+	}
+
+	target, err := utf16PtrFromString(secretTargetPrefix + name)
+	if err != nil {
+		return fmt.Errorf("invalid secret name: %w", err)
+	}
+
+	blob := []byte(value)
+	cred := winCredential{
+		Type:               1, // CRED_TYPE_GENERIC
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            2, // CRED_PERSIST_LOCAL_MACHINE
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+
+	r1, _, callErr := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if r1 == 0 {
+		return fmt.Errorf("failed to write secret %s: %v", name, callErr)
+	}
+	return nil
+}
+
+// createNewConversation creates a new conversation session via Khoj API
+func createNewConversation(apiBase, apiKey string) (string, error) {
+	agentSlug := currentAgentSlug
+	if agentSlug == "" {
+		agentSlug = defaultAgentSlug
+	}
+	convID, err := createConversationWithAgent(apiBase, apiKey, agentSlug)
+	if err != nil && startAgentFallback(apiBase, apiKey, "", agentSlug, err) {
+		return adoptAgentFallback(), nil
+	}
+	return convID, err
+}
+
+// createConversationWithAgent creates a new conversation session bound to a specific agent
+func createConversationWithAgent(apiBase, apiKey, agentSlug string) (string, error) {
+	sessionReq := SessionRequest{
+		AgentSlug: agentSlug,
+	}
+
+	jsonData, err := json.Marshal(sessionReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", apiBase+"/api/chat/sessions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create session request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "KhojProvider/1.0")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("session creation failed: %w", &khojStatusError{Status: resp.StatusCode, Body: string(body)})
+	}
+
+	var sessionResp SessionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sessionResp); err != nil {
+		return "", fmt.Errorf("failed to decode session response: %w", err)
+	}
+
+	return sessionResp.ConversationID, nil
+}
+
+// initializeConversationID sets up the conversation ID based on command-line flags and saved state
+func initializeConversationID() error {
+	// Parse command-line flags
+	flag.Parse()
+
+	// Check for conversation ID override from command line
+	if *flagConversationID != "" {
+		conversationID = *flagConversationID
+		log.Printf("Using conversation ID from command line: %s", conversationID)
+		return nil
+	}
+
+	// Check for new conversation flag
+	newConversation = *flagNewConversation
+	if newConversation {
+		log.Printf("Will create new conversation when server starts")
+		return nil
+	}
+
+	// Load conversation state from file
+	state, err := loadConversationState()
+	if err != nil {
+		return fmt.Errorf("failed to load conversation state: %w", err)
+	}
+
+	if state.LastConversationID == "" {
+		log.Printf("No saved conversation found, will create new conversation when server starts")
+		newConversation = true
+		// Set default agent slug if not set
+		if currentAgentSlug == "" {
+			currentAgentSlug = defaultAgentSlug
+		}
+		return nil
+	}
+
+	conversationID = state.LastConversationID
+	if state.AgentSlug != "" {
+		currentAgentSlug = state.AgentSlug
+	} else {
+		currentAgentSlug = defaultAgentSlug
+	}
+	log.Printf("Using saved conversation ID: %s (created: %s)", conversationID, state.CreatedAt.Format(time.RFC3339))
+	log.Printf("Using agent slug: %s", currentAgentSlug)
+	return nil
+}
+
+// loadConversationInstructions restores saved custom instructions from the state file
+func loadConversationInstructions() error {
+	state, err := loadConversationState()
+	if err != nil {
+		return fmt.Errorf("failed to load conversation state: %w", err)
+	}
+
+	instructionsMu.Lock()
+	defer instructionsMu.Unlock()
+	for id, text := range state.Instructions {
+		conversationInstructions[id] = text
+	}
+	return nil
+}
+
+// getConversationInstructions returns the custom instructions attached to a conversation
+func getConversationInstructions(convID string) string {
+	instructionsMu.Lock()
+	defer instructionsMu.Unlock()
+	return conversationInstructions[convID]
+}
+
+// setConversationInstructions attaches (or with empty text, removes) custom instructions and saves state
+func setConversationInstructions(convID, text string) error {
+	if convID == "" {
+		return fmt.Errorf("no active conversation")
+	}
+
+	text = strings.TrimSpace(text)
+	instructionsMu.Lock()
+	if text == "" {
+		delete(conversationInstructions, convID)
+	} else {
+		conversationInstructions[convID] = text
+	}
+	instructionsMu.Unlock()
+
+	state, err := loadConversationState()
+	if err != nil {
+		return fmt.Errorf("failed to load conversation state: %w", err)
+	}
+	if err := saveConversationState(state); err != nil {
+		return err
+	}
+
+	log.Printf("✅ Custom instructions updated for conversation %s (%d characters)", convID, len(text))
+	bus.Publish(topicConversation, "instructions_changed", currentConversationEvent())
+	return nil
+}
+
+// withConversationInstructions prepends a conversation's custom instructions to a prompt
+func withConversationInstructions(convID, prompt string) string {
+	instructions := getConversationInstructions(convID)
+	if instructions == "" {
+		return prompt
+	}
+	return fmt.Sprintf("system: [Custom instructions for this conversation]\n%s\n\n%s", instructions, prompt)
+}
+
+// promptCommands holds the slash commands found at the start of a prompt
+type promptCommands struct {
+	NewConversation bool
+	SetAgent        bool
+	Agent           string
+	NoStream        bool
+	Research        bool
+	CodeOnly        bool
+	Verbosity       string // A verbosityPresets name
+}
+
+// Any reports whether at least one command was given
+func (c promptCommands) Any() bool {
+	return c.NewConversation || c.SetAgent || c.NoStream || c.Research || c.CodeOnly || c.Verbosity != ""
+}
+
+// Summary describes the commands in a short human-readable sentence
+func (c promptCommands) Summary() string {
+	var parts []string
+	if c.SetAgent {
+		parts = append(parts, fmt.Sprintf("agent set to %s", currentAgentSlug))
+	}
+	if c.NewConversation {
+		parts = append(parts, fmt.Sprintf("new conversation %s", getConversationDisplayID()))
+	}
+	if c.NoStream {
+		parts = append(parts, "streaming off")
+	}
+	if c.Research {
+		parts = append(parts, "research mode")
+	}
+	if c.CodeOnly {
+		parts = append(parts, "code blocks only")
+	}
+	if c.Verbosity != "" {
+		parts = append(parts, c.Verbosity+" answer")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseSlashCommands strips leading slash commands from a prompt; unknown commands end the scan and stay in the prompt
+func parseSlashCommands(prompt string) (promptCommands, string) {
+	var cmds promptCommands
+	rest := strings.TrimLeft(prompt, " \t\r\n")
+	for strings.HasPrefix(rest, "/") {
+		word, tail := rest, ""
+		if i := strings.IndexAny(rest, " \t\r\n"); i >= 0 {
+			word, tail = rest[:i], rest[i:]
+		}
+
+		switch strings.ToLower(word) {
+		case "/new":
+			cmds.NewConversation = true
+		case "/nostream":
+			cmds.NoStream = true
+		case "/research":
+			cmds.Research = true
+		case "/code":
+			cmds.CodeOnly = true
+		case "/one-liner", "/short", "/detailed":
+			cmds.Verbosity = strings.ToLower(word[1:])
+		case "/agent":
+			// The slug is the next word on the same line; "/agent" alone resets to the default agent
+			cmds.SetAgent = true
+			line := tail
+			if i := strings.IndexAny(tail, "\r\n"); i >= 0 {
+				line = tail[:i]
+			}
+			if fields := strings.Fields(line); len(fields) > 0 {
+				cmds.Agent = fields[0]
+				tail = tail[strings.Index(tail, fields[0])+len(fields[0]):]
+			}
+		default:
+			return cmds, rest
+		}
+		rest = strings.TrimLeft(tail, " \t\r\n")
+	}
+	return cmds, rest
+}
+
+// runSlashCommands performs the local side effects of parsed commands
+func runSlashCommands(cmds promptCommands) error {
+	// Switch agents first so a new conversation in the same prompt is bound to it
+	if cmds.SetAgent {
+		if err := updateAgentSlug(cmds.Agent); err != nil {
+			return fmt.Errorf("failed to switch agent: %w", err)
+		}
+	}
+	if cmds.NewConversation {
+		if err := createNewConversationFromMenu(); err != nil {
+			return err
+		}
+	}
+	if cmds.Any() {
+		log.Printf("⚡ Slash commands applied: %s", cmds.Summary())
+	}
+	return nil
+}
+
+// withResearchMode asks Khoj to answer a query in research mode
+func withResearchMode(research bool, query string) string {
+	if !research {
+		return query
+	}
+	return khojResearchCommand + " " + query
+}
+
+// applySlashCommands runs the slash commands in the last user message and strips them from it
+func (req *ChatCompletionRequest) applySlashCommands() (promptCommands, error) {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role != "user" {
+			continue
+		}
+		cmds, rest := parseSlashCommands(req.Messages[i].Content)
+		if !cmds.Any() {
+			return cmds, nil
+		}
+		req.Messages[i].Content = rest
+		if cmds.NoStream {
+			req.Stream = false
+		}
+		req.Research = req.Research || cmds.Research
+		if cmds.CodeOnly {
+			req.Output = outputModeCode
+		}
+		if cmds.Verbosity != "" {
+			req.Verbosity = cmds.Verbosity
+		}
+		return cmds, runSlashCommands(cmds)
+	}
+	return promptCommands{}, nil
+}
+
+// commandOnlyResponse acknowledges a message that contained nothing but slash commands
+func commandOnlyResponse(req *ChatCompletionRequest, cmds promptCommands) *ChatCompletionResponse {
+	return &ChatCompletionResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []Choice{
+			{
+				Index: 0,
+				Message: Message{
+					Role:    "assistant",
+					Content: fmt.Sprintf("✅ Done: %s.", cmds.Summary()),
+				},
+				FinishReason: "stop",
+			},
+		},
+	}
+}
+
+// jsonMode reports whether the client asked for a JSON response
+func (req *ChatCompletionRequest) jsonMode() bool {
+	return req.ResponseFormat != nil && (req.ResponseFormat.Type == "json_object" || req.ResponseFormat.Type == "json_schema")
+}
+
+// responseFormatError checks response_format: text, json_object, or json_schema with a schema
+func (req *ChatCompletionRequest) responseFormatError() error {
+	if req.ResponseFormat == nil {
+		return nil
+	}
+	switch req.ResponseFormat.Type {
+	case "text", "json_object":
+		return nil
+	case "json_schema":
+		if req.ResponseFormat.JSONSchema == nil || req.ResponseFormat.JSONSchema.Schema == nil {
+			return fmt.Errorf("response_format json_schema needs json_schema.schema")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid response_format type %q (expected text, json_object or json_schema)", req.ResponseFormat.Type)
+}
+
+// jsonInstruction asks the agent for a JSON object, matching the request's schema when it has one
+func (req *ChatCompletionRequest) jsonInstruction() string {
+	instruction := "system: Respond with a single valid JSON object only, without prose or code fences.\n"
+	if format := req.ResponseFormat.JSONSchema; format != nil && format.Schema != nil {
+		schema, _ := json.Marshal(format.Schema)
+		instruction += fmt.Sprintf("system: The object must match this JSON schema: %s\n", schema)
+		if format.Description != "" {
+			instruction += "system: What the object describes: " + format.Description + "\n"
+		}
+	}
+	return instruction
+}
+
+// lastUserMessageEmpty reports whether the newest user message has no text, images or audio left
+func (req *ChatCompletionRequest) lastUserMessageEmpty() bool {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			return strings.TrimSpace(req.Messages[i].Content) == "" && len(req.Messages[i].Images) == 0 && len(req.Messages[i].Audio) == 0
+		}
+	}
+	return true
+}
+
+// lastUserMessage returns the newest user message, or "" when there is none
+func (req *ChatCompletionRequest) lastUserMessage() string {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			return req.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// createNewConversationFromMenu creates a new conversation and updates the menu
+func createNewConversationFromMenu() error {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	apiKey := os.Getenv("KHOJ_API_KEY")
+	if apiKey == "" {
+		return fmt.Errorf("KHOJ_API_KEY not set")
+	}
+
+	newConvID, err := createNewConversation(apiBase, apiKey)
+	if err != nil {
+		return fmt.Errorf("failed to create new conversation: %w", err)
+	}
+
+	conversationID = newConvID
+
+	// Save the new conversation state
+	state := &ConversationState{
+		LastConversationID: conversationID,
+		AgentSlug:          currentAgentSlug,
+		CreatedAt:          time.Now(),
+	}
+	if err := saveConversationState(state); err != nil {
+		log.Printf("Warning: Failed to save conversation state: %v", err)
+	}
+
+	log.Printf("✅ New conversation created from menu: %s", conversationID)
+	bus.Publish(topicConversation, "created", currentConversationEvent())
+	return nil
+}
+
+// getConversationDisplayID returns the last 4 characters of the conversation ID for display
+func getConversationDisplayID() string {
+	if conversationID == "" {
+		return "None"
+	}
+	if len(conversationID) <= 4 {
+		return conversationID
+	}
+	return "..." + conversationID[len(conversationID)-4:]
+}
+
+// updateConversationID updates the current conversation ID and saves state
+func updateConversationID(newID string) error {
+	if newID == "" {
+		return fmt.Errorf("conversation ID cannot be empty")
+	}
+
+	conversationID = newID
+
+	// Save the updated conversation state
+	state := &ConversationState{
+		LastConversationID: conversationID,
+		AgentSlug:          currentAgentSlug,
+		CreatedAt:          time.Now(),
+	}
+	if err := saveConversationState(state); err != nil {
+		return fmt.Errorf("failed to save conversation state: %w", err)
+	}
+
+	log.Printf("✅ Conversation ID updated: %s", conversationID)
+	bus.Publish(topicConversation, "changed", currentConversationEvent())
+	return nil
+}
+
+// updateAgentSlug updates the current agent slug and saves state
+func updateAgentSlug(newSlug string) error {
+	if newSlug == "" {
+		newSlug = defaultAgentSlug
+	}
+	newSlug = teamAgent(newSlug)
+
+	currentAgentSlug = newSlug
+	clearAgentFallbacks()
+
+	// Save the updated conversation state
+	state := &ConversationState{
+		LastConversationID: conversationID,
+		AgentSlug:          currentAgentSlug,
+		CreatedAt:          time.Now(),
+	}
+	if err := saveConversationState(state); err != nil {
+		return fmt.Errorf("failed to save conversation state: %w", err)
+	}
+
+	log.Printf("✅ Agent slug updated: %s", currentAgentSlug)
+	bus.Publish(topicConversation, "agent_changed", currentConversationEvent())
+	return nil
+}
+
+// agentFallback is the conversation that continues one whose agent failed, answered by the fallback agent
+type agentFallback struct {
+	ConversationID string
+	FailedAgent    string
+	Cause          string
+	noted          bool // The failure was added to the fallback conversation's history
+}
+
+var (
+	agentFallbacks   = make(map[string]*agentFallback) // Original conversation ID -> fallback; "" while creating a conversation failed
+	agentFallbacksMu sync.Mutex
+)
+
+// agentFailed reports whether Khoj rejected a request because of its agent. A deleted agent or one the user
+// may not use answers 403 or 404; other client errors count when they name the agent.
+func agentFailed(err error) bool {
+	var statusErr *khojStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.Status {
+	case http.StatusForbidden, http.StatusNotFound:
+		return true
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return strings.Contains(strings.ToLower(statusErr.Body), "agent")
+	}
+	return false
+}
+
+// startAgentFallback continues convID with the fallback agent after agent failed with cause, and tells the user.
+// It reports false when cause is not an agent failure, no other fallback agent is set or the fallback fails too.
+func startAgentFallback(apiBase, apiKey, convID, agent string, cause error) bool {
+	fallback := appConfig().FallbackAgent
+	if fallback == "" || fallback == agent || !agentFailed(cause) {
+		return false
+	}
+
+	fallbackID, err := createConversationWithAgent(apiBase, apiKey, fallback)
+	if err != nil {
+		log.Printf("❌ Agent %s failed and fallback agent %s failed too: %v", agent, fallback, err)
+		return false
+	}
+
+	reason := truncateText(strings.TrimSpace(cause.Error()), 200)
+	agentFallbacksMu.Lock()
+	agentFallbacks[convID] = &agentFallback{ConversationID: fallbackID, FailedAgent: agent, Cause: reason}
+	agentFallbacksMu.Unlock()
+
+	log.Printf("🔀 Agent %s failed (%s); continuing with fallback agent %s in conversation %s", agent, reason, fallback, fallbackID)
+	showNotification("Khoj AI - Fallback Agent", fmt.Sprintf("Agent %s failed: %s\nUsing %s until you change the agent.", agent, reason, fallback))
+	bus.Publish(topicConversation, "fallback", ConversationEvent{ConversationID: fallbackID, AgentSlug: fallback, FallbackFrom: agent})
+	return true
+}
+
+// routeConversation returns the Khoj conversation and agent for a request to convID, following a fallback.
+// The first request routed to a fallback also gets a note for its history explaining the switch.
+func routeConversation(convID string) (string, string, string) {
+	agentFallbacksMu.Lock()
+	defer agentFallbacksMu.Unlock()
+	fb, ok := agentFallbacks[convID]
+	if !ok {
+		return convID, currentAgentSlug, ""
+	}
+	note := ""
+	if !fb.noted {
+		fb.noted = true
+		note = fmt.Sprintf("system: Agent %s failed (%s), so fallback agent %s answers in this conversation.", fb.FailedAgent, fb.Cause, appConfig().FallbackAgent)
+	}
+	return fb.ConversationID, appConfig().FallbackAgent, note
+}
+
+// withFallbackNote puts a fallback note on its own line before the query, after a leading slash command such as /research
+func withFallbackNote(note, query string) string {
+	if note == "" {
+		return query
+	}
+	if strings.HasPrefix(query, "/") {
+		if command, rest, ok := strings.Cut(query, " "); ok {
+			return command + " " + note + "\n" + rest
+		}
+	}
+	return note + "\n" + query
+}
+
+// adoptAgentFallback returns the fallback conversation started when creating a conversation failed, and routes
+// requests to it straight to the fallback agent
+func adoptAgentFallback() string {
+	agentFallbacksMu.Lock()
+	defer agentFallbacksMu.Unlock()
+	fb := agentFallbacks[""]
+	delete(agentFallbacks, "")
+	agentFallbacks[fb.ConversationID] = fb
+	return fb.ConversationID
+}
+
+// clearAgentFallbacks sends requests to the chosen agent again
+func clearAgentFallbacks() {
+	agentFallbacksMu.Lock()
+	defer agentFallbacksMu.Unlock()
+	agentFallbacks = make(map[string]*agentFallback)
+}
+
+// conversationRepairedKey marks a request retried after its conversation was repaired, so it is retried only once
+type conversationRepairedKey struct{}
+
+var (
+	repairedConversations   = make(map[string]string) // Saved conversation Khoj lost -> the one replacing it
+	repairedConversationsMu sync.Mutex
+)
+
+// repairConversation replaces the saved conversation after Khoj rejected convID with cause, as it does once the
+// conversation was deleted on Khoj or belongs to another account. It starts a conversation with the current agent,
+// moves the custom instructions over, saves the new ID and tells the user, then returns the context and
+// conversation to retry the request with. Requests failing on the same conversation meanwhile share the
+// repair. It returns "" when convID isn't the saved conversation, cause isn't a 403 or 404, Khoj still has the
+// conversation (so the agent failed), the request was retried already or no new conversation can be created.
+func repairConversation(ctx context.Context, apiBase, apiKey, convID string, cause error) (context.Context, string) {
+	var statusErr *khojStatusError
+	if !errors.As(cause, &statusErr) || (statusErr.Status != http.StatusForbidden && statusErr.Status != http.StatusNotFound) {
+		return ctx, ""
+	}
+	if ctx.Err() != nil || ctx.Value(conversationRepairedKey{}) != nil || convID == "" {
+		return ctx, ""
+	}
+	retryCtx := context.WithValue(ctx, conversationRepairedKey{}, true)
+
+	repairedConversationsMu.Lock()
+	defer repairedConversationsMu.Unlock()
+	if newID, ok := repairedConversations[convID]; ok {
+		return retryCtx, newID
+	}
+	if convID != conversationID || !conversationMissing(ctx, apiBase, apiKey, convID) {
+		return ctx, ""
+	}
+
+	newID, err := createNewConversation(apiBase, apiKey)
+	if err != nil {
+		log.Printf("❌ Khoj lost conversation %s and a new one can't be created: %v", convID, err)
+		return ctx, ""
+	}
+	repairedConversations[convID] = newID
+
+	instructionsMu.Lock()
+	if text, ok := conversationInstructions[convID]; ok {
+		conversationInstructions[newID] = text
+		delete(conversationInstructions, convID)
+	}
+	instructionsMu.Unlock()
+	sentAttachments.Forget(convID)
+
+	conversationID = newID
+	state := &ConversationState{
+		LastConversationID: conversationID,
+		AgentSlug:          currentAgentSlug,
+		CreatedAt:          time.Now(),
+	}
+	if err := saveConversationState(state); err != nil {
+		log.Printf("Warning: Failed to save conversation state: %v", err)
+	}
+
+	agent := currentAgentSlug
+	if agent == "" {
+		agent = defaultAgentSlug
+	}
+	log.Printf("🩹 Khoj rejected conversation %s with %d and no longer has it; continuing in new conversation %s with agent %s", convID, statusErr.Status, newID, agent)
+	showNotification("Khoj AI - Conversation Repaired", fmt.Sprintf("Khoj no longer has the saved conversation (%d).\nStarted a new one with agent %s. Earlier Khoj history isn't carried over.", statusErr.Status, agent))
+	event := currentConversationEvent()
+	event.RepairedFrom = convID
+	bus.Publish(topicConversation, "repaired", event)
+	return retryCtx, newID
+}
+
+// conversationMissing reports whether Khoj answers 403 or 404 for convID's history, telling a lost conversation
+// apart from a failed agent
+func conversationMissing(ctx context.Context, apiBase, apiKey, convID string) bool {
+	endpoint := fmt.Sprintf("%s/api/chat/history?conversation_id=%s", apiBase, url.QueryEscape(convID))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("⚠️ Failed to check conversation %s: %v", convID, err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound
+}
+
+// openBrowser opens a URL in the default browser across different platforms
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", url)
+	case "darwin": // macOS
+		cmd = exec.Command("open", url)
+	case "linux":
+		cmd = exec.Command("xdg-open", url)
+	default:
+		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+
+	return cmd.Run()
+}
+
+// showInputDialog creates a temporary web server to show an input dialog
+func showInputDialog(title, prompt, defaultValue string) (string, error) {
+	// Find an available port
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return "", fmt.Errorf("failed to find available port: %w", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	// Channel to receive the result
+	resultCh := make(chan string, 1)
+	errorCh := make(chan error, 1)
+
+	// Create HTTP server
+	mux := http.NewServeMux()
+
+	// Serve the input form
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		html := fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<head>
+    <title>%s</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 50px; background: #f5f5f5; }
+        .container { background: white; padding: 30px; border-radius: 8px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); max-width: 500px; margin: 0 auto; }
+        h2 { color: #333; margin-bottom: 20px; }
+        input[type="text"] { width: 100%%; padding: 10px; border: 1px solid #ddd; border-radius: 4px; font-size: 16px; margin: 10px 0; }
+        button { background: #007cba; color: white; padding: 12px 24px; border: none; border-radius: 4px; cursor: pointer; font-size: 16px; margin-right: 10px; }
+        button:hover { background: #005a87; }
+        .cancel { background: #666; }
+        .cancel:hover { background: #444; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h2>%s</h2>
+        <form method="POST" action="/submit">
+            <p>%s</p>
+            <input type="text" name="value" value="%s" required autofocus>
+            <br><br>
+            <button type="submit">OK</button>
+            <button type="button" class="cancel" onclick="window.close()">Cancel</button>
+        </form>
+    </div>
+    <script>
+        // Auto-select the input text
+        document.querySelector('input[name="value"]').select();
+        // Handle form submission
+        document.querySelector('form').onsubmit = function(e) {
+            e.preventDefault();
+            fetch('/submit', {
+                method: 'POST',
+                body: new FormData(this)
+            }).then(() => {
+                window.close();
+            });
+        };
+    </script>
+</body>
+</html>`, title, title, prompt, defaultValue)
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(html))
+	})
+
+	// Handle form submission
+	mux.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			value := r.FormValue("value")
+			resultCh <- value
+			w.Write([]byte("OK - You can close this window"))
+		}
+	})
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: mux,
+	}
+
+	// Start server in background
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			errorCh <- err
+		}
+	}()
+
+	// Open browser
+	url := fmt.Sprintf("http://localhost:%d", port)
+	go func() {
+		time.Sleep(100 * time.Millisecond) // Give server time to start
+		if err := openBrowser(url); err != nil {
+			log.Printf("Failed to open browser: %v", err)
+		}
+	}()
+
+	// Wait for result or timeout
+	select {
+	case result := <-resultCh:
+		server.Close()
+		return result, nil
+	case err := <-errorCh:
+		server.Close()
+		return "", err
+	case <-time.After(5 * time.Minute): // 5 minute timeout
+		server.Close()
+		return "", fmt.Errorf("input dialog timed out")
+	}
+}
+
+// editConversationIDDialog shows a dialog to edit the conversation ID
+func editConversationIDDialog() error {
+	currentID := conversationID
+	if currentID == "" {
+		currentID = "No conversation ID set"
+	}
+
+	newID, err := showInputDialog(
+		"Edit Conversation ID",
+		"Enter the new conversation ID:",
+		currentID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to show input dialog: %w", err)
+	}
+
+	if newID == "" || newID == currentID {
+		return nil // User cancelled or no change
+	}
+
+	return updateConversationID(newID)
+}
+
+// editAgentSlugDialog shows a dialog to edit the agent slug
+func editAgentSlugDialog() error {
+	currentSlug := currentAgentSlug
+	if currentSlug == "" {
+		currentSlug = defaultAgentSlug
+	}
+
+	newSlug, err := showInputDialog(
+		"Edit Agent Slug",
+		"Enter the new agent slug (e.g., sonnet-short-025716, gpt-4o-mini):",
+		currentSlug,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to show input dialog: %w", err)
+	}
+
+	if newSlug == "" || newSlug == currentSlug {
+		return nil // User cancelled or no change
+	}
+
+	return updateAgentSlug(newSlug)
+}
+
+// editAPIKeyDialog asks for a new Khoj API key, checks it and saves it to .env for the next start
+func editAPIKeyDialog() error {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	key, err := showInputDialog(
+		"Khoj API Key",
+		fmt.Sprintf("Enter your Khoj API key (from %s/settings):", apiBase),
+		"",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to show input dialog: %w", err)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil // User cancelled
+	}
+
+	ctx, cancel := context.WithTimeout(workers.Context(), connectionCheckTimeout)
+	defer cancel()
+	if err := validateKhojConnection(ctx, apiBase, key); errors.Is(err, errKhojUnauthorized) {
+		return fmt.Errorf("Khoj rejected the new API key too - it was not saved")
+	}
+
+	if err := setEnvFileValue(envFile, "KHOJ_API_KEY", key); err != nil {
+		return err
+	}
+	os.Setenv("KHOJ_API_KEY", key)
+	if globalServer != nil && globalServer.provider != nil {
+		globalServer.provider.APIKey = key
+	}
+	log.Printf("🔑 API key updated and saved to %s", envFile)
+	showNotification("Khoj AI", "API key saved")
+	checkKhojConnection(workers.Context(), "API key changed", "")
+	return nil
+}
+
+// setEnvFileValue sets name in a .env file, replacing its line or appending one, and creates the file if needed
+func setEnvFileValue(path, name, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if strings.ContainsAny(value, " \t#\"'\\\n") {
+		value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(value) + `"`
+	}
+	entry := name + "=" + value
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	}
+	replaced := false
+	for i, line := range lines {
+		key, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+		if ok && strings.TrimSpace(key) == name {
+			lines[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		lines = append(lines, entry)
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// setMCPSecretDialog shows dialogs to store a secret and restarts MCP servers using it
+func setMCPSecretDialog() error {
+	name, err := showInputDialog(
+		"Set MCP Secret",
+		"Enter the secret name (e.g., GITHUB_TOKEN):",
+		"",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to show input dialog: %w", err)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil // User cancelled
+	}
+
+	value, err := showInputDialog(
+		"Set MCP Secret",
+		fmt.Sprintf("Enter the new value for %s:", name),
+		"",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to show input dialog: %w", err)
+	}
+	if value == "" {
+		return nil // User cancelled
+	}
+
+	if err := writeSecret(name, value); err != nil {
+		return err
+	}
+	log.Printf("✅ MCP secret updated: %s", name)
+
+	if globalServer != nil && globalServer.provider != nil {
+		globalServer.provider.MCPManager.RestartServersUsingSecret(name)
+	}
+	return nil
+}
+
+// win32API is the slice of user32/kernel32 used by the clipboard AI flow, swappable for a fake in tests
+type win32API interface {
+	Supported() bool
+	ReadClipboard() (string, error)
+	WriteClipboard(text string) error
+	WriteClipboardHTML(text, html string) error
+	ClipboardSequence() uint32
+	IsKeyDown(vk uint16) bool
+	SendInput(input INPUT) bool
+	ForegroundWindow() uintptr
+	SendChar(hwnd uintptr, ch rune)
+	DesktopWindow() uintptr
+	MessageBox(owner uintptr, title, text string, flags uintptr) int
+	WindowClass(hwnd uintptr) string
+	WindowProcess(hwnd uintptr) string
+	WindowTitle(hwnd uintptr) string
+}
+
+// realWin32 calls straight into the Windows DLLs
+type realWin32 struct{}
+
+// inputSimulationDisabled is set once at startup by --no-input-simulation, no_input_simulation or a noinput build,
+// and stays set when the config is reloaded
+var inputSimulationDisabled bool
+
+// errInputSimulationDisabled is returned by clipboard writes while input simulation is disabled
+var errInputSimulationDisabled = errors.New("input simulation is disabled")
+
+// noInputWin32 wraps a win32API so nothing can type, send keys, poll the keyboard or write the clipboard
+type noInputWin32 struct {
+	win32API
+}
+
+func (noInputWin32) WriteClipboard(string) error             { return errInputSimulationDisabled }
+func (noInputWin32) WriteClipboardHTML(string, string) error { return errInputSimulationDisabled }
+func (noInputWin32) IsKeyDown(uint16) bool                   { return false }
+func (noInputWin32) SendInput(INPUT) bool                    { return false }
+func (noInputWin32) SendChar(uintptr, rune)                  {}
+
+// disableInputSimulation installs noInputWin32 when input simulation is turned off, returning why it is off
+func disableInputSimulation(cfg *AppConfig) string {
+	reason := ""
+	switch {
+	case !inputSimulationBuilt:
+		reason = "noinput build"
+	case *flagNoInputSimulation:
+		reason = "--no-input-simulation"
+	case cfg.NoInputSimulation:
+		reason = "no_input_simulation"
+	default:
+		return ""
+	}
+	inputSimulationDisabled = true
+	win32 = noInputWin32{win32}
+	return reason
+}
+
+// win32 is the Win32 implementation used by the clipboard, keyboard and dialog code
+var win32 win32API = realWin32{}
+
+func (realWin32) Supported() bool {
+	return runtime.GOOS == "windows"
+}
+
+func (realWin32) ReadClipboard() (string, error) {
+	r1, _, err := procOpenClipboard.Call(0)
+	if r1 == 0 {
+		return "", fmt.Errorf("failed to open clipboard: %v", err)
+	}
+	defer procCloseClipboard.Call()
+
+	h, _, err := procGetClipboardData.Call(CF_UNICODETEXT)
+	if h == 0 {
+		return "", fmt.Errorf("failed to get clipboard data: %v", err)
+	}
+
+	l, _, err := procGlobalLock.Call(h)
+	if l == 0 {
+		return "", fmt.Errorf("failed to lock global memory: %v", err)
+	}
+	defer procGlobalUnlock.Call(h)
+
+	text := safeUTF16ToString(l, 1<<20)
+	return text, nil
+}
+
+func (realWin32) WriteClipboard(text string) error {
+	return writeClipboard(text, "")
+}
+
+func (realWin32) WriteClipboardHTML(text, html string) error {
+	return writeClipboard(text, html)
+}
+
+// writeClipboard replaces the clipboard with text, adding html in the HTML Format when it is set
+func writeClipboard(text, html string) error {
+	// Open clipboard
+	r1, _, err := procOpenClipboard.Call(0)
+	if r1 == 0 {
+		return fmt.Errorf("failed to open clipboard: %v", err)
+	}
+	defer procCloseClipboard.Call()
+
+	// Clear clipboard
+	user32.NewProc("EmptyClipboard").Call()
+
+	// Convert text to UTF16, 2 bytes per character
+	utf16Text := safeStringToUTF16(text)
+	data := make([]byte, len(utf16Text)*2)
+	for i, char := range utf16Text {
+		data[2*i], data[2*i+1] = byte(char), byte(char>>8)
+	}
+	if err := setClipboardBytes(CF_UNICODETEXT, data); err != nil {
+		return err
+	}
+	if html == "" {
+		return nil
+	}
+
+	name, err := safeUTF16PtrFromString("HTML Format")
+	if err != nil {
+		return err
+	}
+	format, _, _ := user32.NewProc("RegisterClipboardFormatW").Call(name)
+	if format == 0 {
+		return fmt.Errorf("failed to register the HTML clipboard format")
+	}
+	return setClipboardBytes(format, append([]byte(clipboardHTML(html)), 0))
+}
+
+// setClipboardBytes copies data to global memory and hands it to the open clipboard as format
+func setClipboardBytes(format uintptr, data []byte) error {
+	globalAlloc := kernel32.NewProc("GlobalAlloc")
+	globalLock := kernel32.NewProc("GlobalLock")
+	globalUnlock := kernel32.NewProc("GlobalUnlock")
+
+	hMem, _, _ := globalAlloc.Call(0x2000, uintptr(len(data))) // GMEM_MOVEABLE
+	if hMem == 0 {
+		return fmt.Errorf("failed to allocate global memory")
+	}
+
+	pMem, _, _ := globalLock.Call(hMem)
+	if pMem == 0 {
+		return fmt.Errorf("failed to lock global memory")
+	}
+	for i, b := range data {
+		*(*byte)(unsafe.Pointer(pMem + uintptr(i))) = b
+	}
+	globalUnlock.Call(hMem)
+
+	r2, _, _ := user32.NewProc("SetClipboardData").Call(format, hMem)
+	if r2 == 0 {
+		return fmt.Errorf("failed to set clipboard data")
+	}
+	return nil
+}
+
+// clipboardHTML wraps an HTML fragment in the CF_HTML header, whose offsets count UTF-8 bytes from the start
+func clipboardHTML(fragment string) string {
+	const header = "Version:0.9\r\nStartHTML:%010d\r\nEndHTML:%010d\r\nStartFragment:%010d\r\nEndFragment:%010d\r\n"
+	const prefix = "<html><head><meta charset=\"utf-8\"></head><body>\r\n<!--StartFragment-->"
+	const suffix = "<!--EndFragment-->\r\n</body></html>"
+	startHTML := len(fmt.Sprintf(header, 0, 0, 0, 0))
+	startFragment := startHTML + len(prefix)
+	endFragment := startFragment + len(fragment)
+	return fmt.Sprintf(header, startHTML, endFragment+len(suffix), startFragment, endFragment) + prefix + fragment + suffix
+}
+
+func (realWin32) ClipboardSequence() uint32 {
+	seq, _, _ := procClipboardSeq.Call()
+	return uint32(seq)
+}
+
+func (realWin32) IsKeyDown(vk uint16) bool {
+	state, _, _ := user32.NewProc("GetAsyncKeyState").Call(uintptr(vk))
+	return state&0x8000 != 0
+}
+
+func (realWin32) SendInput(input INPUT) bool {
+	ret, _, _ := procSendInput.Call(1, uintptr(unsafe.Pointer(&input)), unsafe.Sizeof(input))
+	return ret != 0
+}
+
+func (realWin32) ForegroundWindow() uintptr {
+	hwnd, _, _ := user32.NewProc("GetForegroundWindow").Call()
+	return hwnd
+}
+
+func (realWin32) SendChar(hwnd uintptr, ch rune) {
+	const WM_CHAR = 0x0102
+	user32.NewProc("SendMessageW").Call(hwnd, WM_CHAR, uintptr(ch), 0)
+}
+
+func (realWin32) DesktopWindow() uintptr {
+	hwnd, _, _ := user32.NewProc("GetDesktopWindow").Call()
+	return hwnd
+}
+
+func (realWin32) MessageBox(owner uintptr, title, text string, flags uintptr) int {
+	titlePtr, _ := safeUTF16PtrFromString(title)
+	textPtr, _ := safeUTF16PtrFromString(text)
+	ret, _, _ := procMessageBox.Call(owner, textPtr, titlePtr, flags)
+	return int(ret)
+}
+
+func (realWin32) WindowClass(hwnd uintptr) string {
+	buf := make([]uint16, 256)
+	n, _, _ := user32.NewProc("GetClassNameW").Call(hwnd, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return utf16ToString(buf[:n])
+}
+
+func (realWin32) WindowTitle(hwnd uintptr) string {
+	buf := make([]uint16, 512)
+	n, _, _ := user32.NewProc("GetWindowTextW").Call(hwnd, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return utf16ToString(buf[:n])
+}
+
+// WindowProcess returns the lowercase executable name of the process owning hwnd, e.g. "msedge.exe"
+func (realWin32) WindowProcess(hwnd uintptr) string {
+	var pid uint32
+	user32.NewProc("GetWindowThreadProcessId").Call(hwnd, uintptr(unsafe.Pointer(&pid)))
+	if pid == 0 {
+		return ""
+	}
+
+	// PROCESS_QUERY_LIMITED_INFORMATION works for elevated processes too
+	h, _, _ := kernel32.NewProc("OpenProcess").Call(0x1000, 0, uintptr(pid))
+	if h == 0 {
+		return ""
+	}
+	defer kernel32.NewProc("CloseHandle").Call(h)
+
+	buf := make([]uint16, 1024)
+	size := uint32(len(buf))
+	ok, _, _ := kernel32.NewProc("QueryFullProcessImageNameW").Call(h, 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if ok == 0 {
+		return ""
+	}
+	name := utf16ToString(buf[:size])
+	if i := strings.LastIndexAny(name, `\/`); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(name)
+}
+
+// Windows-specific clipboard and keyboard functions
+func getClipboardText() (string, error) {
+	if !win32.Supported() {
+		return "", fmt.Errorf("clipboard functionality only available on Windows")
+	}
+	return win32.ReadClipboard()
+}
+
+// pasteTarget is the kind of window text is inserted into, which decides formatting and insertion method
+type pasteTarget struct {
+	Kind     string // One of the targetKind constants
+	Class    string
+	Process  string
+	RichText bool // Markdown is pasted as HTML, with plain text alongside
+}
+
+// Rich text modes of a template
+const (
+	richTextAuto = "auto" // HTML for apps that keep pasted formatting, plain text elsewhere
+	richTextOff  = "off"  // Always plain text
+)
+
+// richTextProcesses and richTextWindowClasses identify apps that keep the formatting of HTML pasted into them
+var (
+	richTextProcesses     = []string{"winword.exe", "outlook.exe", "olk.exe", "onenote.exe", "powerpnt.exe"}
+	richTextWindowClasses = []string{"OpusApp", "rctrl_renwnd32"}
+)
+
+// Paste target kinds
+const (
+	targetTerminal = "terminal" // Plain text, pasted with Shift+Insert and never typed, so newlines can't run commands
+	targetForm     = "form"     // Browser text fields: markdown stripped, pasted or typed with SendInput
+	targetEditor   = "editor"   // Editors and rich text: markdown kept, full fallback cascade
+	targetUnknown  = "unknown"  // Anything else: full fallback cascade
+)
+
+// browserProcesses own windows whose text fields get markdown-stripped text
+var browserProcesses = []string{"msedge.exe", "chrome.exe", "firefox.exe", "brave.exe", "opera.exe", "vivaldi.exe", "arc.exe"}
+
+// editorWindowClasses and editorProcesses identify editors and rich text controls
+var (
+	editorWindowClasses = []string{"Notepad", "Edit", "RichEdit20W", "RICHEDIT50W", "OpusApp", "rctrl_renwnd32", "Scintilla", "SunAwtFrame"}
+	editorProcesses     = []string{"code.exe", "notepad.exe", "notepad++.exe", "sublime_text.exe", "winword.exe", "outlook.exe", "obsidian.exe", "devenv.exe"}
+)
+
+// detectPasteTarget classifies the foreground window; insertion.targets overrides by process or class name
+func detectPasteTarget() pasteTarget {
+	hwnd := win32.ForegroundWindow()
+	target := pasteTarget{Class: win32.WindowClass(hwnd), Process: win32.WindowProcess(hwnd)}
+	target.Kind = classifyPasteTarget(target.Class, target.Process)
+	return target
+}
+
+// supportsRichText reports whether the target keeps the formatting of pasted HTML. Only editors and unknown windows
+// qualify, since terminals and browser text fields get markdown-stripped text.
+func (t pasteTarget) supportsRichText() bool {
+	if t.Kind != targetEditor && t.Kind != targetUnknown {
+		return false
+	}
+	for _, list := range [][]string{richTextProcesses, richTextWindowClasses, appConfig().Insertion.RichTextApps} {
+		for _, name := range list {
+			if strings.EqualFold(name, t.Process) || strings.EqualFold(name, t.Class) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classifyPasteTarget maps a window class and process name to a target kind
+func classifyPasteTarget(class, process string) string {
+	for name, kind := range appConfig().Insertion.Targets {
+		if strings.EqualFold(name, process) || strings.EqualFold(name, class) {
+			return kind
+		}
+	}
+
+	contains := func(list []string, name string) bool {
+		for _, item := range list {
+			if name != "" && strings.EqualFold(item, name) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case isTerminalWindow(class):
+		return targetTerminal
+	case contains(editorProcesses, process) || contains(editorWindowClasses, class):
+		// Checked before browsers: Electron editors such as VS Code share Chrome's window class
+		return targetEditor
+	case contains(browserProcesses, process) || class == "MozillaWindowClass":
+		return targetForm
+	}
+	return targetUnknown
+}
+
+var (
+	markdownFence    = regexp.MustCompile("(?m)^[ \\t]*```[^\\n]*\\n?")
+	markdownHeading  = regexp.MustCompile(`(?m)^#{1,6}\s+`)
+	markdownQuote    = regexp.MustCompile(`(?m)^>\s?`)
+	markdownRule     = regexp.MustCompile(`(?m)^[ \t]*(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})\n`)
+	markdownBullet   = regexp.MustCompile(`(?m)^(\s*)[*+]\s+`)
+	markdownImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+	markdownEmphasis = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)|\*(\S(?:[^*]*?\S)?)\*`)
+	markdownCode     = regexp.MustCompile("`([^`\\n]+)`")
+)
+
+// stripMarkdown turns a markdown answer into plain text, keeping code, link targets and list structure
+func stripMarkdown(text string) string {
+	text = markdownFence.ReplaceAllString(text, "")
+	text = markdownHeading.ReplaceAllString(text, "")
+	text = markdownQuote.ReplaceAllString(text, "")
+	text = markdownRule.ReplaceAllString(text, "")
+	text = markdownBullet.ReplaceAllString(text, "${1}- ")
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1 ($2)")
+	text = markdownEmphasis.ReplaceAllString(text, "$2$4")
+	text = markdownCode.ReplaceAllString(text, "$1")
+	return text
+}
+
+// Format prepares text for the target: plain text for terminals and forms, unchanged otherwise
+func (t pasteTarget) Format(text string) string {
+	switch t.Kind {
+	case targetTerminal:
+		// A trailing newline would run the last command as soon as it is pasted
+		return strings.TrimRight(stripMarkdown(text), "\r\n")
+	case targetForm:
+		return stripMarkdown(text)
+	}
+	return text
+}
+
+// Send inserts already formatted text using the methods that are safe for the target
+func (t pasteTarget) Send(text string) error {
+	if t.RichText && stripMarkdown(text) != text {
+		if err := pasteRichWithCtrlV(text); err == nil {
+			return nil
+		}
+		log.Printf("🔄 Falling back to plain text...")
+	}
+	switch t.Kind {
+	case targetTerminal:
+		// Typing would press Enter at every newline, so a failed paste is an error rather than a fallback
+		if err := setClipboardForPaste(text, ""); err != nil {
+			return fmt.Errorf("failed to set clipboard for terminal paste: %w", err)
+		}
+		if err := simulateShiftInsert(); err != nil {
+			return fmt.Errorf("terminal paste failed, the answer is on the clipboard: %w", err)
+		}
+		log.Printf("✅ Pasted into terminal with Shift+Insert")
+		return nil
+
+	case targetForm:
+		// Browsers ignore WM_CHAR, so skip straight to SendInput typing if pasting fails
+		if err := pasteWithCtrlV(text); err == nil {
+			return nil
+		}
+		log.Printf("🔄 Falling back to character-by-character typing...")
+		return sendTextCharByChar(text)
+	}
+	return sendTextCascade(text)
+}
+
+// sendText inserts text at the cursor, formatted and sent according to the focused window. With richText, markdown is
+// pasted as HTML into apps that support it.
+func sendText(text string, richText bool) error {
+	if !win32.Supported() {
+		return fmt.Errorf("text sending only available on Windows")
+	}
+	target := detectPasteTarget()
+	target.RichText = richText && target.supportsRichText()
+	log.Printf("🎯 Paste target: %s (%s, %s)", target.Kind, target.Process, target.Class)
+	return target.Send(target.Format(text))
+}
+
+// pasteRichWithCtrlV puts a markdown answer on the clipboard as HTML, with the stripped text alongside for apps
+// that only read plain text, and presses Ctrl+V
+func pasteRichWithCtrlV(markdown string) error {
+	log.Printf("🔄 Trying rich text clipboard + Ctrl+V method...")
+	if err := setClipboardForPaste(stripMarkdown(markdown), renderMarkdownHTML(markdown)); err != nil {
+		log.Printf("⚠️ Failed to set rich text clipboard: %v", err)
+		return err
+	}
+	if err := simulateCtrlV(); err != nil {
+		log.Printf("⚠️ Failed to simulate Ctrl+V: %v", err)
+		return err
+	}
+	log.Printf("✅ Rich text clipboard + Ctrl+V method succeeded")
+	return nil
+}
+
+// pasteWithCtrlV puts text on the clipboard and presses Ctrl+V
+func pasteWithCtrlV(text string) error {
+	log.Printf("🔄 Trying clipboard + Ctrl+V method...")
+	if err := setClipboardForPaste(text, ""); err != nil {
+		log.Printf("⚠️ Failed to set clipboard: %v", err)
+		return err
+	}
+
+	if err := simulateCtrlV(); err != nil {
+		log.Printf("⚠️ Failed to simulate Ctrl+V: %v", err)
+		return err
+	}
+	log.Printf("✅ Clipboard + Ctrl+V method succeeded")
+	return nil
+}
+
+// sendTextCascade tries pasting, window messages and typing in turn, for windows of unknown kind
+func sendTextCascade(text string) error {
+	log.Printf("📝 Sending %d characters to cursor position...", len(text))
+
+	// Method 1: Try clipboard + Ctrl+V approach
+	if err := pasteWithCtrlV(text); err == nil {
+		return nil
+	}
+
+	// Method 2: Try direct window message approach
+	log.Printf("🔄 Trying direct window message method...")
+	if err := sendTextViaWindowMessage(text); err != nil {
+		log.Printf("⚠️ Window message method failed: %v", err)
+	} else {
+		log.Printf("✅ Window message method succeeded")
+		return nil
+	}
+
+	// Method 3: Fallback to character-by-character typing
+	log.Printf("🔄 Falling back to character-by-character typing...")
+	return sendTextCharByChar(text)
+}
+
+// errInsertionStopped reports that the user pressed the stop key between chunks
+var errInsertionStopped = fmt.Errorf("insertion stopped by user")
+
+// terminalWindowClasses are the window classes of common Windows terminals
+var terminalWindowClasses = []string{
+	"ConsoleWindowClass",            // conhost: cmd.exe, PowerShell
+	"CASCADIA_HOSTING_WINDOW_CLASS", // Windows Terminal
+	"mintty",                        // Git Bash, Cygwin
+	"PuTTY",
+	"VirtualConsoleClass", // ConEmu, Cmder
+	"Alacritty",
+	"org.wezfurlong.wezterm",
+}
+
+// dangerousCommand is a built-in rule for the terminal safety check
+type dangerousCommand struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+var dangerousCommands = []dangerousCommand{
+	{"recursive delete (rm -r)", regexp.MustCompile(`\brm\s+(-\S+\s+)*-[a-zA-Z]*[rR]`)},
+	{"recursive delete (Remove-Item -Recurse)", regexp.MustCompile(`(?i)\b(Remove-Item|ri|rm|del)\b[^\n|;]*\s-Recurse\b`)},
+	{"recursive delete (del /s, rd /s)", regexp.MustCompile(`(?i)\b(del|erase|rd|rmdir)\b[^\n|&]*\s/s\b`)},
+	{"disk format", regexp.MustCompile(`(?i)\b(format(\.com)?\s+[a-z]:|Format-Volume\b|Clear-Disk\b|mkfs(\.\w+)?\b|diskpart\b)`)},
+	{"raw disk write (dd)", regexp.MustCompile(`\bdd\b[^\n]*\bof=/dev/`)},
+	{"registry delete", regexp.MustCompile(`(?i)\breg(\.exe)?\s+delete\b|\bRemove-Item(Property)?\b[^\n]*\b(HK(LM|CU|CR|U|CC)|Registry)::?`)},
+	{"shadow copy or backup deletion", regexp.MustCompile(`(?i)\bvssadmin\b[^\n]*\bdelete\b|\bwbadmin\b[^\n]*\bdelete\b`)},
+	{"shutdown or reboot", regexp.MustCompile(`(?i)\b(shutdown(\.exe)?\s+[/-]|Stop-Computer\b|Restart-Computer\b|reboot\b)`)},
+	{"discarding git work", regexp.MustCompile(`\bgit\s+(reset\s+--hard|clean\s+-\S*f|push\s+(\S+\s+)*(--force|-f)\b)`)},
+	{"fork bomb", regexp.MustCompile(`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`)},
+}
+
+// isTerminalWindow reports whether a window class belongs to a known or configured terminal
+func isTerminalWindow(class string) bool {
+	if class == "" {
+		return false
+	}
+	for _, known := range append(terminalWindowClasses, appConfig().TerminalSafety.WindowClasses...) {
+		if strings.EqualFold(class, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// findDangerousCommands lists the safety rules a text triggers
+func findDangerousCommands(text string) []string {
+	var hits []string
+	for _, rule := range dangerousCommands {
+		if rule.Pattern.MatchString(text) {
+			hits = append(hits, rule.Name)
+		}
+	}
+	for _, pattern := range appConfig().TerminalSafety.Patterns {
+		re, err := regexp.Compile(pattern) // Validated when the config was loaded
+		if err == nil && re.MatchString(text) {
+			hits = append(hits, "custom pattern "+pattern)
+		}
+	}
+	return hits
+}
+
+// confirmTerminalInsertion asks before typing destructive commands into a terminal; false means do not insert
+func confirmTerminalInsertion(text string) bool {
+	if appConfig().TerminalSafety.Disabled {
+		return true
+	}
+
+	hwnd := win32.ForegroundWindow()
+	class := win32.WindowClass(hwnd)
+	if !isTerminalWindow(class) {
+		return true
+	}
+
+	hits := findDangerousCommands(text)
+	if len(hits) == 0 {
+		return true
+	}
+
+	log.Printf("⚠️ Response for terminal %s contains: %s", class, strings.Join(hits, ", "))
+	bus.Publish(topicClipboard, "confirm", ClipboardEvent{Matches: len(hits)})
+
+	preview := text
+	if len(preview) > 400 {
+		preview = truncateText(preview, 400) + "..."
+	}
+	message := fmt.Sprintf("The response is about to be typed into a terminal and contains potentially destructive commands:\n\n- %s\n\n%s\n\nInsert it anyway?", strings.Join(hits, "\n- "), preview)
+
+	// MB_YESNO = 4, MB_ICONWARNING = 0x30, MB_DEFBUTTON2 = 0x100, MB_TOPMOST = 0x40000; IDYES = 6
+	return win32.MessageBox(hwnd, "Khoj AI - Confirm Command", message, 0x4|0x30|0x100|0x40000) == 6
+}
+
+// insertResponse types text at the cursor, splitting long responses into paragraph chunks with a pause
+// after each one during which the stop key aborts. It returns the number of bytes inserted.
+func insertResponse(ctx context.Context, text string, richText bool) (int, error) {
+	cfg := appConfig().Insertion
+	chunkChars := cfg.ChunkChars
+	if chunkChars == 0 {
+		chunkChars = defaultInsertChunk
+	}
+	if chunkChars < 0 || len(text) <= chunkChars {
+		return len(text), sendText(text, richText)
+	}
+
+	// Classify and format once so markdown spanning chunk boundaries is stripped consistently
+	target := detectPasteTarget()
+	target.RichText = richText && target.supportsRichText()
+	log.Printf("🎯 Paste target: %s (%s, %s)", target.Kind, target.Process, target.Class)
+	text = target.Format(text)
+	if target.Kind == targetTerminal {
+		// Each chunk ends in a newline, which the shell would run as a command, so terminals get one paste
+		return len(text), target.Send(text)
+	}
+
+	pause := durationOrDefault(cfg.Pause, defaultInsertPause)
+	stopKey, _ := parseKeyCombo(defaultStopKey)
+	if cfg.StopKey != "" {
+		stopKey, _ = parseKeyCombo(cfg.StopKey) // Validated when the config was loaded
+	}
+
+	chunks := paragraphChunks(text, chunkChars)
+	log.Printf("⌨️ Inserting %d characters in %d chunks (press %s to stop)", len(text), len(chunks), stopKey.Name)
+	showNotification("Khoj AI", fmt.Sprintf("Inserting %d parts - press %s between parts to stop", len(chunks), stopKey.Name))
+
+	inserted := 0
+	for i, chunk := range chunks {
+		if err := target.Send(chunk); err != nil {
+			return inserted, fmt.Errorf("failed to insert part %d of %d: %w", i+1, len(chunks), err)
+		}
+		inserted += len(chunk)
+		if i == len(chunks)-1 {
+			break
+		}
+		if waitForStopKey(ctx, stopKey, pause) {
+			return inserted, errInsertionStopped
+		}
+	}
+	return inserted, nil
+}
+
+// waitForStopKey polls for the stop key for up to d, reporting whether it was pressed or ctx ended
+func waitForStopKey(ctx context.Context, stopKey hotkeySpec, d time.Duration) bool {
+	ticker := time.NewTicker(25 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(d)
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-deadline:
+			return false
+		case <-ticker.C:
+			if comboPressed(win32, stopKey.Keys...) {
+				return true
+			}
+		}
+	}
+}
+
+// paragraphChunks groups paragraphs into chunks of about maxChars, splitting oversized paragraphs on lines
+func paragraphChunks(text string, maxChars int) []string {
+	paragraphs := strings.SplitAfter(text, "\n\n")
+	var chunks []string
+	var current strings.Builder
+	for _, paragraph := range paragraphs {
+		if current.Len() > 0 && current.Len()+len(paragraph) > maxChars {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		if len(paragraph) > maxChars {
+			chunks = append(chunks, splitIntoChunks(paragraph, maxChars)...)
+			continue
+		}
+		current.WriteString(paragraph)
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+func setClipboardText(text string) error {
+	return win32.WriteClipboard(text)
+}
+
+// clipboardSummary describes the clipboard check done before paste keystrokes
+func (c InsertionConfig) clipboardSummary() string {
+	if c.ClipboardRetries < 0 {
+		return "not verified"
+	}
+	return fmt.Sprintf("verified, %d retries, %v to settle", positiveOrDefault(c.ClipboardRetries, defaultClipboardRetries), durationOrDefault(c.ClipboardSettle, defaultClipboardSettle))
+}
+
+// setClipboardForPaste writes text, and html when set, to the clipboard ahead of a paste keystroke and waits until
+// the write has settled, retrying the write if it does not, so the paste never picks up what the clipboard held before
+func setClipboardForPaste(text, html string) error {
+	write := func() error {
+		if html != "" {
+			return win32.WriteClipboardHTML(text, html)
+		}
+		return setClipboardText(text)
+	}
+
+	cfg := appConfig().Insertion
+	if cfg.ClipboardRetries < 0 {
+		if err := write(); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+
+	retries := positiveOrDefault(cfg.ClipboardRetries, defaultClipboardRetries)
+	settle := durationOrDefault(cfg.ClipboardSettle, defaultClipboardSettle)
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("🔄 Clipboard not settled (%v), retrying write %d/%d", lastErr, attempt, retries)
+		}
+		before := win32.ClipboardSequence()
+		if err := write(); err != nil {
+			if errors.Is(err, errInputSimulationDisabled) {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		if lastErr = waitClipboardSettled(text, before, settle); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("clipboard did not settle after %d writes: %w", retries+1, lastErr)
+}
+
+// waitClipboardSettled polls until the clipboard sequence number has moved past before and the clipboard reads
+// back as text. A zero sequence number means the window station does not report one, so only the text is compared.
+func waitClipboardSettled(text string, before uint32, settle time.Duration) error {
+	deadline := time.Now().Add(settle)
+	for {
+		seq := win32.ClipboardSequence()
+		current, err := win32.ReadClipboard()
+		changed := seq != before || seq == 0
+		if changed && err == nil && current == text {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			switch {
+			case !changed:
+				return fmt.Errorf("clipboard sequence number did not change within %v", settle)
+			case err != nil:
+				return fmt.Errorf("failed to read back clipboard: %w", err)
+			default:
+				return fmt.Errorf("clipboard holds different text after %v", settle)
+			}
+		}
+		time.Sleep(clipboardPollInterval)
+	}
+}
+
+func simulateCtrlV() error {
+	log.Printf("🔄 Simulating Ctrl+V keypress...")
+
+	// Simulate Ctrl+V keypress with proper key sequence
+
+	// Key down: Ctrl
+	ctrlDown := INPUT{
+		Type: INPUT_KEYBOARD,
+		Ki: KEYBDINPUT{
+			WVk:     VK_CONTROL,
+			DwFlags: 0, // Key down
+		},
+	}
+
+	// Key down: V
+	vDown := INPUT{
+		Type: INPUT_KEYBOARD,
+		Ki: KEYBDINPUT{
+			WVk:     0x56, // V key
+			DwFlags: 0,    // Key down
+		},
+	}
+
+	// Key up: V
+	vUp := INPUT{
+		Type: INPUT_KEYBOARD,
+		Ki: KEYBDINPUT{
+			WVk:     0x56, // V key
+			DwFlags: KEYEVENTF_KEYUP,
+		},
+	}
+
+	// Key up: Ctrl
+	ctrlUp := INPUT{
+		Type: INPUT_KEYBOARD,
+		Ki: KEYBDINPUT{
+			WVk:     VK_CONTROL,
+			DwFlags: KEYEVENTF_KEYUP,
+		},
+	}
+
+	// Send Ctrl down
+	ret1 := win32.SendInput(ctrlDown)
+	log.Printf("🔄 Ctrl down result: %t", ret1)
+
+	// Small delay
+	time.Sleep(50 * time.Millisecond)
+
+	// Send V down
+	ret2 := win32.SendInput(vDown)
+	log.Printf("🔄 V down result: %t", ret2)
+
+	// Small delay
+	time.Sleep(50 * time.Millisecond)
+
+	// Send V up
+	ret3 := win32.SendInput(vUp)
+	log.Printf("🔄 V up result: %t", ret3)
+
+	// Small delay
+	time.Sleep(50 * time.Millisecond)
+
+	// Send Ctrl up
+	ret4 := win32.SendInput(ctrlUp)
+	log.Printf("🔄 Ctrl up result: %t", ret4)
+
+	if !ret1 || !ret2 || !ret3 || !ret4 {
+		return fmt.Errorf("SendInput failed - results: %t,%t,%t,%t", ret1, ret2, ret3, ret4)
+	}
+
+	log.Printf("✅ Ctrl+V simulation completed successfully")
+	return nil
+}
+
+// simulateShiftInsert presses Shift+Insert, the paste shortcut shared by conhost, Windows Terminal, mintty and PuTTY
+func simulateShiftInsert() error {
+	// Insert is an extended key; without the flag it arrives as numpad 0
+	keys := []INPUT{
+		{Type: INPUT_KEYBOARD, Ki: KEYBDINPUT{WVk: VK_SHIFT}},
+		{Type: INPUT_KEYBOARD, Ki: KEYBDINPUT{WVk: VK_INSERT, DwFlags: KEYEVENTF_EXTENDEDKEY}},
+		{Type: INPUT_KEYBOARD, Ki: KEYBDINPUT{WVk: VK_INSERT, DwFlags: KEYEVENTF_EXTENDEDKEY | KEYEVENTF_KEYUP}},
+		{Type: INPUT_KEYBOARD, Ki: KEYBDINPUT{WVk: VK_SHIFT, DwFlags: KEYEVENTF_KEYUP}},
+	}
+	for _, key := range keys {
+		if !win32.SendInput(key) {
+			return fmt.Errorf("SendInput failed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+func sendTextViaWindowMessage(text string) error {
+	log.Printf("🔄 Sending text via window messages...")
+
+	// Get the foreground window (where the cursor is)
+	hwnd := win32.ForegroundWindow()
+	if hwnd == 0 {
+		return fmt.Errorf("no foreground window found")
+	}
+
+	log.Printf("🔄 Found foreground window: %v", hwnd)
+
+	// Send each character as WM_CHAR message
+	runes := []rune(text)
+	for i, char := range runes {
+		if i%100 == 0 {
+			log.Printf("🔄 Sending char %d/%d via message", i, len(runes))
+		}
+
+		win32.SendChar(hwnd, char)
+		// Suppress individual character failure messages for cleaner output
+
+		// Small delay
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	log.Printf("✅ Window message method completed")
+	return nil
+}
+
+func sendTextCharByChar(text string) error {
+	log.Printf("🔄 Sending text character by character (%d chars)...", len(text))
+
+	// Convert to runes for proper Unicode handling
+	runes := []rune(text)
+
+	for i, char := range runes {
+		if i%100 == 0 {
+			log.Printf("🔄 Progress: %d/%d characters", i, len(runes))
+		}
+
+		// Use Unicode input for better character support
+		input := INPUT{
+			Type: INPUT_KEYBOARD,
+			Ki: KEYBDINPUT{
+				WVk:         0, // Use 0 for Unicode input
+				WScan:       uint16(char),
+				DwFlags:     4, // KEYEVENTF_UNICODE
+				Time:        0,
+				DwExtraInfo: 0,
+			},
+		}
+
+		// Send the character
+		win32.SendInput(input)
+		// Suppress individual character failure messages for cleaner output
+
+		// Small delay between characters (adjust if too slow)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	log.Printf("✅ Character-by-character sending completed")
+	return nil
+}
+
+// bringToForeground aggressively brings windows to foreground
+func bringToForeground() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	// Get Windows API functions
+	getCurrentThreadId := kernel32.NewProc("GetCurrentThreadId")
+	getForegroundWindow := user32.NewProc("GetForegroundWindow")
+	getWindowThreadProcessId := user32.NewProc("GetWindowThreadProcessId")
+	attachThreadInput := user32.NewProc("AttachThreadInput")
+	allowSetForegroundWindow := user32.NewProc("AllowSetForegroundWindow")
+
+	// Get current thread ID
+	currentThreadId, _, _ := getCurrentThreadId.Call()
+
+	// Get foreground window and its thread
+	foregroundWindow, _, _ := getForegroundWindow.Call()
+	if foregroundWindow != 0 {
+		foregroundThreadId, _, _ := getWindowThreadProcessId.Call(foregroundWindow, 0)
+
+		if foregroundThreadId != currentThreadId {
+			// Attach to foreground thread to bypass focus stealing prevention
+			attachThreadInput.Call(currentThreadId, foregroundThreadId, 1)
+
+			// Allow our process to set foreground window
+			allowSetForegroundWindow.Call(uintptr(0xFFFFFFFF)) // ASFW_ANY
+
+			// Small delay
+			time.Sleep(10 * time.Millisecond)
+
+			// Detach from foreground thread
+			attachThreadInput.Call(currentThreadId, foregroundThreadId, 0)
+		}
+	}
+
+	// Also allow our process specifically
+	allowSetForegroundWindow.Call(uintptr(0xFFFFFFFF))
+
+	log.Printf("🔄 Aggressively prepared foreground permissions")
+}
+
+// forceWindowToForeground uses multiple techniques to force window to front
+func forceWindowToForeground() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	// Find our MessageBox window and force it to foreground
+	findWindow := user32.NewProc("FindWindowW")
+	setForegroundWindow := user32.NewProc("SetForegroundWindow")
+	showWindow := user32.NewProc("ShowWindow")
+	bringWindowToTop := user32.NewProc("BringWindowToTop")
+	setWindowPos := user32.NewProc("SetWindowPos")
+
+	// Try to find MessageBox window (class name "#32770")
+	className, _ := safeUTF16PtrFromString("#32770")
+	hwnd, _, _ := findWindow.Call(className, 0)
+
+	if hwnd != 0 {
+		// MessageBox opens on the primary monitor; move it to where the user is working
+		centerOnCursorMonitor(hwnd)
+
+		// Multiple attempts to bring window to front
+		showWindow.Call(hwnd, 9) // SW_RESTORE
+		showWindow.Call(hwnd, 5) // SW_SHOW
+		bringWindowToTop.Call(hwnd)
+		setForegroundWindow.Call(hwnd)
+
+		// Set window as topmost temporarily
+		setWindowPos.Call(hwnd, uintptr(0xFFFFFFFF), 0, 0, 0, 0, 0x0001|0x0002|0x0040) // HWND_TOPMOST, SWP_NOMOVE|SWP_NOSIZE|SWP_SHOWWINDOW
+
+		log.Printf("🔄 Forced MessageBox window to foreground")
+	}
+}
+
+// showModernInputDialog shows a simple but reliable input dialog; pickerText is appended to the custom prompt
+func showModernInputDialog(title, prompt, defaultValue, pickerText string) (string, bool) {
+	if !win32.Supported() {
+		return defaultValue, false
+	}
+
+	log.Printf("🔔 Showing input dialog for user prompt")
+
+	// Force current process to foreground
+	bringToForeground()
+
+	// First, show a choice dialog
+	choiceText := fmt.Sprintf("%s\n\nDefault: \"%s\"\n\nYES = Use default prompt\nNO = Enter custom prompt\nCANCEL = Abort", prompt, defaultValue)
+
+	// Start a goroutine to force the dialog to foreground after a short delay
+	go func() {
+		time.Sleep(100 * time.Millisecond) // Wait for dialog to appear
+		forceWindowToForeground()
+	}()
+
+	// MB_YESNOCANCEL = 3, MB_ICONQUESTION = 32, MB_TOPMOST = 0x40000, MB_SETFOREGROUND = 0x10000, MB_SYSTEMMODAL = 0x1000
+	ret := win32.MessageBox(win32.DesktopWindow(), title, choiceText, 3|32|0x40000|0x10000|0x1000)
+
+	switch ret {
+	case 6: // YES - use default
+		log.Printf("✅ User chose default prompt: %s", defaultValue)
+		return defaultValue, false
+	case 7: // NO - get custom input
+		log.Printf("🔄 User wants to enter custom prompt")
+		return showSimpleTextInput(title, "Enter your custom prompt:"+pickerText, defaultValue)
+	default: // CANCEL or close
+		log.Printf("ℹ️ User cancelled the dialog")
+		return "", true
+	}
+}
+
+// showSimpleTextInput shows a working text input dialog
+func showSimpleTextInput(title, prompt, defaultValue string) (string, bool) {
+	if runtime.GOOS != "windows" {
+		return defaultValue, false
+	}
+
+	// Force to foreground before showing input dialog
+	bringToForeground()
+
+	// VBScript string literals can't span lines or contain bare quotes
+	vbsEscape := func(text string) string {
+		text = strings.ReplaceAll(text, `"`, `""`)
+		return strings.ReplaceAll(text, "\n", `" & vbCrLf & "`)
+	}
+
+	// Create a VBScript that forces the dialog to foreground
+	script := fmt.Sprintf(`
+Set objShell = CreateObject("WScript.Shell")
+
+' Bring the script window to foreground first
+objShell.AppActivate "Windows Script Host"
+
+' Show InputBox and force it to foreground
+strInput = InputBox("%s", "%s", "%s")
+
+' Force the dialog to stay on top
+objShell.AppActivate "%s"
+
+If strInput <> "" Then
+    Set objFSO = CreateObject("Scripting.FileSystemObject")
+    Set objFile = objFSO.CreateTextFile("temp_input_result.txt", True)
+    objFile.WriteLine "OK:" & strInput
+    objFile.Close
+Else
+    Set objFSO = CreateObject("Scripting.FileSystemObject")
+    Set objFile = objFSO.CreateTextFile("temp_input_result.txt", True)
+    objFile.WriteLine "CANCEL:"
+    objFile.Close
+End If
+`, vbsEscape(prompt), vbsEscape(title), vbsEscape(defaultValue), vbsEscape(title))
+
+	// Write VBScript to file
+	scriptFile := "temp_input_dialog.vbs"
+	err := os.WriteFile(scriptFile, []byte(script), 0644)
+	if err != nil {
+		log.Printf("⚠️ Failed to write VBScript: %v", err)
+		return defaultValue, false
+	}
+
+	// InputBox opens on the primary monitor; move it to where the user is working once it shows
+	go func() {
+		if hwnd := waitForWindow("#32770", title); hwnd != 0 {
+			centerOnCursorMonitor(hwnd)
+		}
+	}()
+
+	// Execute VBScript with wscript (shows GUI)
+	cmd := exec.Command("wscript", scriptFile)
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("⚠️ Failed to run VBScript: %v", err)
+		os.Remove(scriptFile)
+		return defaultValue, false
+	}
+
+	// Read result from file
+	resultFile := "temp_input_result.txt"
+	output, err := os.ReadFile(resultFile)
+	if err != nil {
+		log.Printf("⚠️ Failed to read input result: %v", err)
+		os.Remove(scriptFile)
+		return defaultValue, false
+	}
+
+	// Clean up
+	os.Remove(scriptFile)
+	os.Remove(resultFile)
+
+	// Parse result
+	result := strings.TrimSpace(string(output))
+	if strings.HasPrefix(result, "OK:") {
+		userInput := strings.TrimPrefix(result, "OK:")
+		logContent("✅ User entered custom prompt: %s", userInput)
+		return userInput, false
+	} else {
+		log.Printf("ℹ️ User cancelled custom input")
+		return "", true
+	}
+}
+
+// showNotification logs a notification and, unless the notifications feature is off, publishes it for the
+// notification subscriber to display
+func showNotification(title, message string) {
+	// Log the notification (works in both console and windowsgui mode); messages can quote answers
+	if privacyMode.Load() {
+		log.Printf("📢 %s", title)
+	} else {
+		log.Printf("📢 %s: %s", title, message)
+	}
+	if appConfig().featureEnabled(featureNotifications) {
+		bus.Publish(topicNotification, "requested", NotificationEvent{Title: title, Message: message})
+	}
+}
+
+// displayNotification shows a notification as a tooltip and Windows toast
+func displayNotification(title, message string) {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	// Update systray tooltip with notification
+	notificationText := fmt.Sprintf("🔔 %s: %s", title, message)
+	systray.SetTooltip(notificationText)
+
+	// Show Windows notification - different approach for windowsgui vs console mode
+	workers.Go("notification", func(ctx context.Context) error {
+		logContent("🔔 Attempting to show notification: %s - %s", title, message)
+
+		// Try toast library first (works in console mode)
+		if showToastNotification(title, message) {
+			log.Printf("✅ Toast notification shown successfully")
+		} else {
+			log.Printf("⚠️ Toast notification failed, trying PowerShell method...")
+			// Fallback to PowerShell method for windowsgui mode
+			showPowerShellNotification(title, message)
+		}
+
+		// Keep the tooltip notification visible for 5 seconds
+		select {
+		case <-time.After(5 * time.Second):
+			systray.SetTooltip(trayIdleTooltip())
+		case <-ctx.Done():
+		}
+		return nil
+	})
+}
+
+// showToastNotification tries to show notification using PowerShell (cross-platform compatible)
+func showToastNotification(title, message string) bool {
+	if runtime.GOOS != "windows" {
+		return false
+	}
+
+	// Use PowerShell with Windows.UI.Notifications for proper toast
+	script := fmt.Sprintf(`
+		try {
+			[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+			[Windows.UI.Notifications.ToastNotification, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+			[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+
+			$APP_ID = 'Microsoft.Windows.Computer'
+			$template = @"
+<toast>
+    <visual>
+        <binding template="ToastGeneric">
+            <text>%s</text>
+            <text>%s</text>
+        </binding>
+    </visual>
+    <audio src="ms-winsoundevent:Notification.Default" />
+</toast>
+"@
+
+			$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
+			$xml.LoadXml($template)
+			$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
+			[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($APP_ID).Show($toast)
+			exit 0
+		} catch {
+			exit 1
+		}
+	`, title, message)
+
+	// Execute PowerShell script silently
+	cmd := exec.Command("powershell", "-WindowStyle", "Hidden", "-ExecutionPolicy", "Bypass", "-Command", script)
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("⚠️ PowerShell toast notification failed: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// showPowerShellNotification shows notification using PowerShell (works in windowsgui mode)
+func showPowerShellNotification(title, message string) {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	// Use PowerShell with Windows.UI.Notifications for proper toast in windowsgui mode
+	script := fmt.Sprintf(`
+		[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+		[Windows.UI.Notifications.ToastNotification, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+		[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+
+		$APP_ID = 'Microsoft.Windows.Computer'
+		$template = @"
+<toast>
+    <visual>
+        <binding template="ToastGeneric">
+            <text>%s</text>
+            <text>%s</text>
+        </binding>
+    </visual>
+    <audio src="ms-winsoundevent:Notification.Default" />
+</toast>
+"@
+
+		$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
+		$xml.LoadXml($template)
+		$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
+		[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($APP_ID).Show($toast)
+	`, title, message)
+
+	// Execute PowerShell script
+	workers.Go("powershell-notification", func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, "powershell", "-WindowStyle", "Hidden", "-ExecutionPolicy", "Bypass", "-Command", script)
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("⚠️ PowerShell notification failed: %v", err)
+			// Final fallback to simple message box
+			showFallbackNotification(title, message)
+		} else {
+			log.Printf("✅ PowerShell notification sent successfully")
+		}
+		return nil
+	})
+}
+
+// showFallbackNotification shows a simple fallback notification
+func showFallbackNotification(title, message string) {
+	if !win32.Supported() {
+		return
+	}
+
+	// Simple MessageBox as absolute fallback
+	workers.Go("fallback-notification", func(ctx context.Context) error {
+		// MB_OK = 0, MB_ICONINFORMATION = 64, MB_TOPMOST = 0x40000
+		win32.MessageBox(0, title, message, 0|64|0x40000)
+		return nil
+	})
+}
+
+// checkNotificationSettings checks Windows notification settings
+func checkNotificationSettings() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	log.Printf("🔍 Checking Windows notification settings...")
+
+	// Check if notifications are enabled globally
+	// This is a simplified check - in reality, there are many registry keys to check
+	log.Printf("ℹ️ Common reasons toast notifications might not appear:")
+	log.Printf("   1. Focus Assist is enabled (Priority only or Alarms only)")
+	log.Printf("   2. Notifications are disabled in Windows Settings")
+	log.Printf("   3. App notifications are disabled for this application")
+	log.Printf("   4. Do Not Disturb mode is enabled")
+	log.Printf("   5. Presentation mode is active")
+	log.Printf("   6. Windows notification service is not running")
+
+	log.Printf("💡 To check: Windows Settings > System > Notifications & actions")
+	log.Printf("💡 To check Focus Assist: Windows key + U, then F")
+}
+
+// ClipboardTemplate is a named prompt offered in the clipboard AI picker
+type ClipboardTemplate struct {
+	Name      string
+	Prompt    string
+	Output    string   // Output mode applied to the response
+	Verbosity string   // Verbosity preset name
+	MaxChars  int      // Response length limit; 0 uses the preset's
+	Languages []string // Detected languages this template is the default for
+	Rewrite   bool     // The response replaces the clipboard text, so it is reviewed as a diff first
+	Citations string   // Citation style for pasting
+	RichText  string   // Rich text mode for pasting
+
+	PostProcess *PostProcessConfig // Command the response is piped through before insertion
+
+	// Set for templates provided by MCP servers; rendered via prompts/get
+	MCPServer string
+	MCPPrompt *MCPPrompt
+}
+
+const (
+	defaultClipboardPrompt = "Explain this in two sentences"
+	commandClipboardPrompt = "Write the shell command for this. Reply with the command in a single code block"
+	grammarClipboardPrompt = "Fix the grammar and spelling of this text. Keep its wording, tone and formatting otherwise. Reply with only the corrected text"
+	rewriteClipboardPrompt = "Rewrite this text to be clearer and more concise, keeping its meaning and language. Reply with only the rewritten text"
+)
+
+// clipboardTemplates lists the built-in templates, then configured ones, the team's, installed packs and prompts
+// from MCP servers
+func clipboardTemplates() []ClipboardTemplate {
+	templates := builtinClipboardTemplates()
+	for _, t := range appConfig().Templates {
+		templates = append(templates, ClipboardTemplate{Name: t.Name, Prompt: t.Prompt, Output: t.Output, Verbosity: t.Verbosity, MaxChars: t.MaxChars, Languages: t.Languages, Rewrite: t.Rewrite, Citations: t.Citations, RichText: t.RichText, PostProcess: t.PostProcess})
+	}
+	if team := currentTeam(); team != nil {
+		for _, t := range team.Templates {
+			templates = append(templates, ClipboardTemplate{Name: "team/" + t.Name, Prompt: t.Prompt, Output: t.Output, Verbosity: t.Verbosity, MaxChars: t.MaxChars, Languages: t.Languages, Rewrite: t.Rewrite, Citations: t.Citations, RichText: t.RichText})
+		}
+	}
+	for _, pack := range installedPacks() {
+		for _, t := range pack.Templates {
+			templates = append(templates, ClipboardTemplate{Name: pack.Name + "/" + t.Name, Prompt: t.Prompt, Output: t.Output, Verbosity: t.Verbosity, MaxChars: t.MaxChars, Languages: t.Languages, Rewrite: t.Rewrite, Citations: t.Citations, RichText: t.RichText})
+		}
+	}
+
+	if globalServer == nil || globalServer.provider == nil {
+		return templates
+	}
+
+	prompts := globalServer.provider.MCPManager.Prompts()
+	servers := make([]string, 0, len(prompts))
+	for server := range prompts {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	for _, server := range servers {
+		for i := range prompts[server] {
+			p := prompts[server][i]
+			templates = append(templates, ClipboardTemplate{
+				Name:      server + "/" + p.Name,
+				Prompt:    p.Description,
+				MCPServer: server,
+				MCPPrompt: &p,
+			})
+		}
+	}
+	return templates
+}
+
+// builtinClipboardTemplates returns the templates that are always offered, ahead of configured ones
+func builtinClipboardTemplates() []ClipboardTemplate {
+	return []ClipboardTemplate{
+		{Name: "explain", Prompt: defaultClipboardPrompt},
+		{Name: "command", Prompt: commandClipboardPrompt, Output: outputModeFirstCode},
+		{Name: "grammar", Prompt: grammarClipboardPrompt, Rewrite: true},
+		{Name: "rewrite", Prompt: rewriteClipboardPrompt, Rewrite: true},
+	}
+}
+
+// templatePickerText renders the numbered template list shown in the custom prompt dialog
+func templatePickerText(templates []ClipboardTemplate) string {
+	if len(templates) <= 1 {
+		return ""
+	}
+	var text strings.Builder
+	text.WriteString("\n\nOr enter a template number:")
+	for i, t := range templates {
+		text.WriteString(fmt.Sprintf("\n%d. %s", i+1, t.Name))
+		if t.Verbosity != "" {
+			text.WriteString(" (" + t.Verbosity + ")")
+		}
+		if t.Rewrite {
+			text.WriteString(" (review diff)")
+		}
+	}
+	text.WriteString("\n\nStart with /one-liner, /short or /detailed to set the answer length")
+	return text.String()
+}
+
+// clipboardVerbosity returns the verbosity preset and length limit for a dialog input; slash commands override the template
+func clipboardVerbosity(userPrompt string, templates []ClipboardTemplate, cmds promptCommands) (string, int) {
+	if cmds.Verbosity != "" {
+		return cmds.Verbosity, verbosityPresets[cmds.Verbosity].MaxChars
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		t := templates[n-1]
+		if t.MaxChars > 0 {
+			return t.Verbosity, t.MaxChars
+		}
+		return t.Verbosity, verbosityPresets[t.Verbosity].MaxChars
+	}
+	return "", 0
+}
+
+// clipboardOutputMode returns the output mode of the template picked in the dialog, if any
+func clipboardOutputMode(userPrompt string, templates []ClipboardTemplate) string {
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		return templates[n-1].Output
+	}
+	return ""
+}
+
+// clipboardCitations returns the citation style of the template picked in the dialog, if any
+func clipboardCitations(userPrompt string, templates []ClipboardTemplate) string {
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		return templates[n-1].Citations
+	}
+	return ""
+}
+
+// clipboardRichText returns the rich text mode of the template picked in the dialog, if any
+func clipboardRichText(userPrompt string, templates []ClipboardTemplate) string {
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		return templates[n-1].RichText
+	}
+	return ""
+}
+
+// templateVariablePattern matches {{name}} placeholders in template prompts
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_]+)\s*\}\}`)
+
+// templateVariableNames lists the variables template prompts may reference
+var templateVariableNames = []string{"date", "app_name", "window_title", "username", "selection_language"}
+
+// appDisplayNames maps common executables to the names people use for them in prompts
+var appDisplayNames = map[string]string{
+	"outlook.exe":         "Outlook",
+	"olk.exe":             "Outlook",
+	"winword.exe":         "Word",
+	"excel.exe":           "Excel",
+	"powerpnt.exe":        "PowerPoint",
+	"onenote.exe":         "OneNote",
+	"ms-teams.exe":        "Microsoft Teams",
+	"teams.exe":           "Microsoft Teams",
+	"slack.exe":           "Slack",
+	"discord.exe":         "Discord",
+	"whatsapp.exe":        "WhatsApp",
+	"telegram.exe":        "Telegram",
+	"thunderbird.exe":     "Thunderbird",
+	"msedge.exe":          "Microsoft Edge",
+	"chrome.exe":          "Google Chrome",
+	"firefox.exe":         "Firefox",
+	"code.exe":            "Visual Studio Code",
+	"notepad.exe":         "Notepad",
+	"obsidian.exe":        "Obsidian",
+	"notion.exe":          "Notion",
+	"windowsterminal.exe": "Windows Terminal",
+}
+
+// knownTemplateVariable reports whether name is a supported template variable
+func knownTemplateVariable(name string) bool {
+	for _, known := range templateVariableNames {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// templateVariables resolves the template variables for the window the hotkey was pressed in
+func templateVariables(hwnd uintptr, language languageGuess) map[string]string {
+	vars := map[string]string{
+		"date":               time.Now().Format("Monday, 2 January 2006"),
+		"username":           os.Getenv("USERNAME"),
+		"app_name":           "",
+		"window_title":       "",
+		"selection_language": language.Name,
+	}
+	if vars["username"] == "" {
+		vars["username"] = os.Getenv("USER")
+	}
+	if hwnd != 0 {
+		exe := win32.WindowProcess(hwnd)
+		vars["app_name"] = appDisplayNames[exe]
+		if vars["app_name"] == "" {
+			vars["app_name"] = strings.TrimSuffix(exe, ".exe")
+		}
+		vars["window_title"] = strings.TrimSpace(win32.WindowTitle(hwnd))
+	}
+	for name, value := range vars {
+		if value == "" {
+			vars[name] = "unknown"
+		}
+	}
+	return vars
+}
+
+// expandTemplateVariables replaces {{name}} placeholders in a template prompt; unknown names are left as typed
+func expandTemplateVariables(prompt string, vars map[string]string) string {
+	return templateVariablePattern.ReplaceAllStringFunc(prompt, func(placeholder string) string {
+		if value, ok := vars[templateVariablePattern.FindStringSubmatch(placeholder)[1]]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// appPromptFor returns the first app_prompts entry matching a window, or nil
+func appPromptFor(hwnd uintptr) *AppPromptConfig {
+	class, process := win32.WindowClass(hwnd), win32.WindowProcess(hwnd)
+	kind := classifyPasteTarget(class, process)
+	for i, ap := range appConfig().AppPrompts {
+		if ap.Target == kind {
+			return &appConfig().AppPrompts[i]
+		}
+		for _, name := range ap.Apps {
+			if strings.EqualFold(name, process) || strings.EqualFold(name, class) {
+				return &appConfig().AppPrompts[i]
+			}
+		}
+	}
+	return nil
+}
+
+// withAppPrompt surrounds a clipboard AI prompt with the prefix and suffix configured for the window it was made in
+func withAppPrompt(hwnd uintptr, vars map[string]string, prompt string) string {
+	ap := appPromptFor(hwnd)
+	if ap == nil {
+		return prompt
+	}
+	log.Printf("🪟 Adding the app prompt for %s", vars["app_name"])
+	if ap.Prefix != "" {
+		prompt = expandTemplateVariables(ap.Prefix, vars) + "\n\n" + prompt
+	}
+	if ap.Suffix != "" {
+		prompt += "\n\n" + expandTemplateVariables(ap.Suffix, vars)
+	}
+	return prompt
+}
+
+// clipboardPostProcess returns the post-process command of the template picked in the dialog, if any
+func clipboardPostProcess(userPrompt string, templates []ClipboardTemplate) *PostProcessConfig {
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		return templates[n-1].PostProcess
+	}
+	return nil
+}
+
+// clipboardRewrite reports whether the template picked in the dialog replaces the clipboard text
+func clipboardRewrite(userPrompt string, templates []ClipboardTemplate) bool {
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		return templates[n-1].Rewrite
+	}
+	return false
+}
+
+// buildClipboardPrompt turns the user's dialog input into the final prompt, resolving template numbers
+func buildClipboardPrompt(ctx context.Context, userPrompt, clipboardText string, templates []ClipboardTemplate, vars map[string]string) (string, error) {
+	if n, err := strconv.Atoi(strings.TrimSpace(userPrompt)); err == nil && n >= 1 && n <= len(templates) {
+		t := templates[n-1]
+		if t.MCPPrompt == nil {
+			return fmt.Sprintf("%s:\n\n%s", expandTemplateVariables(t.Prompt, vars), clipboardText), nil
+		}
+
+		// Pass the clipboard text as the first required argument, if any
+		args := map[string]string{}
+		passedContent := false
+		for _, arg := range t.MCPPrompt.Arguments {
+			if arg.Required && !passedContent {
+				args[arg.Name] = clipboardText
+				passedContent = true
+			}
+		}
+
+		rendered, err := globalServer.provider.MCPManager.GetPrompt(ctx, t.MCPServer, t.MCPPrompt.Name, args)
+		if err != nil {
+			return "", fmt.Errorf("failed to render template %s: %w", t.Name, err)
+		}
+		if passedContent {
+			return rendered, nil
+		}
+		return fmt.Sprintf("%s\n\nContent:\n%s", rendered, clipboardText), nil
+	}
+
+	if userPrompt != "" && userPrompt != defaultClipboardPrompt {
+		return fmt.Sprintf("%s\n\nContent:\n%s", userPrompt, clipboardText), nil
+	}
+	return fmt.Sprintf("%s:\n\n%s", defaultClipboardPrompt, clipboardText), nil
+}
+
+// languageGuess is the detected language of a text; Code is empty when it could not be determined
+type languageGuess struct {
+	Code       string
+	Name       string
+	Confidence float64
+}
+
+// languageNames maps the ISO 639-1 codes detectLanguage can return to display names
+var languageNames = map[string]string{
+	"en": "English", "de": "German", "fr": "French", "es": "Spanish", "it": "Italian", "pt": "Portuguese", "nl": "Dutch",
+	"ru": "Russian", "uk": "Ukrainian", "el": "Greek", "ar": "Arabic", "he": "Hebrew", "hi": "Hindi", "th": "Thai",
+	"zh": "Chinese", "ja": "Japanese", "ko": "Korean",
+}
+
+// languageStopwords are frequent short words that tell Latin-script languages apart
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "of", "to", "in", "that", "it", "for", "with", "you", "this", "are", "was", "not"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "zu", "den", "mit", "sich", "auf", "für", "ein", "eine"},
+	"fr": {"le", "la", "les", "et", "est", "des", "une", "pour", "que", "pas", "dans", "sur", "vous", "je", "du"},
+	"es": {"el", "la", "los", "las", "y", "es", "que", "para", "una", "por", "con", "del", "no", "se", "lo"},
+	"it": {"il", "di", "che", "è", "e", "per", "una", "non", "sono", "della", "con", "gli", "mi", "questo", "lo"},
+	"pt": {"o", "os", "de", "que", "não", "uma", "para", "com", "em", "do", "da", "é", "se", "você", "um"},
+	"nl": {"de", "het", "een", "en", "van", "is", "niet", "dat", "ik", "te", "voor", "met", "op", "zijn", "je"},
+}
+
+// detectLanguage guesses the language of text from its script, then from stopwords for Latin-script text
+func detectLanguage(text string) languageGuess {
+	if len(text) > 4000 {
+		text = text[:4000] // Plenty for a guess; avoids scanning huge clipboards
+	}
+
+	// Count letters per script; kana decides Japanese even when mixed with kanji
+	scripts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			scripts["ja"] += 2
+		case unicode.Is(unicode.Han, r):
+			scripts["zh"]++
+		case unicode.Is(unicode.Hangul, r):
+			scripts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			if strings.ContainsRune("їієґЇІЄҐ", r) {
+				scripts["uk"] += 20 // Letters only Ukrainian uses among Cyrillic languages
+			}
+			scripts["ru"]++
+		case unicode.Is(unicode.Greek, r):
+			scripts["el"]++
+		case unicode.Is(unicode.Arabic, r):
+			scripts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			scripts["he"]++
+		case unicode.Is(unicode.Devanagari, r):
+			scripts["hi"]++
+		case unicode.Is(unicode.Thai, r):
+			scripts["th"]++
+		case unicode.Is(unicode.Latin, r):
+			scripts["latin"]++
+		}
+	}
+	if letters < 12 {
+		return languageGuess{}
+	}
+
+	best, bestCount := "", 0
+	for code, count := range scripts {
+		if count > bestCount || (count == bestCount && code < best) {
+			best, bestCount = code, count
+		}
+	}
+	if best == "ja" && scripts["ja"] < letters/10 {
+		best, bestCount = "zh", scripts["zh"] // A few stray kana don't make Chinese text Japanese
+	}
+	if best == "uk" || (best == "ru" && scripts["uk"] > 0) {
+		return languageGuess{Code: "uk", Name: languageNames["uk"], Confidence: 0.9}
+	}
+	if best != "latin" {
+		if best == "" {
+			return languageGuess{}
+		}
+		confidence := float64(bestCount) / float64(letters)
+		if confidence > 1 {
+			confidence = 1 // Kana count double
+		}
+		return languageGuess{Code: best, Name: languageNames[best], Confidence: confidence}
+	}
+
+	// Latin script: score each language by the share of words that are its stopwords
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) })
+	if len(words) < 4 {
+		return languageGuess{}
+	}
+	scores := map[string]int{}
+	total := 0
+	for _, word := range words {
+		for code, stopwords := range languageStopwords {
+			for _, stopword := range stopwords {
+				if word == stopword {
+					scores[code]++
+					total++
+					break
+				}
+			}
+		}
+	}
+	best, bestCount = "", 0
+	for code, count := range scores {
+		if count > bestCount || (count == bestCount && code < best) {
+			best, bestCount = code, count
+		}
+	}
+	if bestCount < 2 {
+		return languageGuess{} // Code, identifiers or lists rather than prose
+	}
+	return languageGuess{Code: best, Name: languageNames[best], Confidence: float64(bestCount) / float64(total)}
+}
+
+// languageTemplate returns the 1-based number of the first template for a language, or 0
+func languageTemplate(templates []ClipboardTemplate, code string) int {
+	for i, t := range templates {
+		for _, language := range t.Languages {
+			if strings.EqualFold(language, code) {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// withAnswerLanguage asks for an answer in the content's language unless it is English, Khoj's default
+func withAnswerLanguage(language languageGuess, prompt string) string {
+	if language.Code == "" || language.Code == "en" {
+		return prompt
+	}
+	return fmt.Sprintf("%s\n\nUnless asked otherwise, answer in %s, the language of the content.", prompt, language.Name)
+}
+
+// processClipboardWithAI processes clipboard content with AI and inserts response at cursor;
+// a non-empty preset is used as the dialog input, so the dialog is skipped
+func processClipboardWithAI(preset string) {
+	if !win32.Supported() {
+		log.Printf("Clipboard AI feature only available on Windows")
+		return
+	}
+
+	if clipboardActive {
+		log.Printf("Clipboard AI already processing, ignoring request")
+		showNotification("Khoj AI", "Already processing a request...")
+		return
+	}
+
+	clipboardActive = true
+	defer func() {
+		clipboardActive = false
+		log.Printf("🔄 Clipboard AI processing completed")
+	}()
+
+	log.Printf("🚀 Starting clipboard AI processing...")
+	targetWindow := win32.ForegroundWindow()
+
+	// Get clipboard content
+	clipboardText, err := getClipboardText()
+	if err != nil {
+		log.Printf("❌ Failed to get clipboard text: %v", err)
+		showNotification("Khoj AI Error", fmt.Sprintf("Failed to read clipboard: %v", err))
+		return
+	}
+
+	if strings.TrimSpace(clipboardText) == "" {
+		log.Printf("⚠️ Clipboard is empty")
+		showNotification("Khoj AI", "Clipboard is empty - copy some text first")
+		return
+	}
+
+	log.Printf("📋 Clipboard content: %d characters", len(clipboardText))
+
+	// Detect the content's language; a template for that language becomes the dialog's default
+	templates := clipboardTemplates()
+	dialogPrompt, defaultPrompt := "Add instructions or context for the AI:", defaultClipboardPrompt
+	var language languageGuess
+	if !appConfig().Language.Disabled {
+		language = detectLanguage(clipboardText)
+	}
+	if language.Code != "" {
+		log.Printf("🌐 Detected clipboard language: %s (%.0f%%)", language.Name, language.Confidence*100)
+		dialogPrompt = fmt.Sprintf("Detected language: %s (%.0f%%)\n\n%s", language.Name, language.Confidence*100, dialogPrompt)
+		if n := languageTemplate(templates, language.Code); n > 0 {
+			defaultPrompt = strconv.Itoa(n)
+			dialogPrompt += fmt.Sprintf("\n\nDefault for %s: template %d (%s)", language.Name, n, templates[n-1].Name)
+		}
+	}
+
+	// Resolve template variables now, while the dialog hasn't taken focus
+	vars := templateVariables(targetWindow, language)
+
+	// Show dialog to get user prompt
+	userPrompt := preset
+	if userPrompt == "" {
+		var cancelled bool
+		userPrompt, cancelled = showModernInputDialog("Khoj AI - Add Context", dialogPrompt, defaultPrompt, templatePickerText(templates))
+		if cancelled {
+			log.Printf("ℹ️ User cancelled the prompt dialog")
+			return
+		}
+	}
+
+	// Slash commands typed into the dialog run locally and never reach Khoj
+	cmds, userPrompt := parseSlashCommands(userPrompt)
+	if err := runSlashCommands(cmds); err != nil {
+		log.Printf("❌ Slash command failed: %v", err)
+		showNotification("Khoj AI Error", err.Error())
+		return
+	}
+	if cmds.NewConversation {
+		clipboardSession.End("/new")
+	}
+
+	outputMode := clipboardOutputMode(userPrompt, templates)
+	if cmds.CodeOnly {
+		outputMode = outputModeCode
+	}
+	verbosity, maxChars := clipboardVerbosity(userPrompt, templates, cmds)
+
+	// Show single notification after user confirms
+	showNotification("Khoj AI", "Processing clipboard content...")
+	bus.Publish(topicClipboard, "processing", ClipboardEvent{Chars: len(clipboardText), Language: language.Code})
+
+	// Create context with timeout - don't defer cancel here since we need it in the goroutine
+	timeout := durationOrDefault(appConfig().ClipboardTimeout, clipboardTimeout)
+	ctx, cancel := context.WithTimeout(workers.Context(), timeout)
+
+	// Prepare the final prompt with user input
+	finalPrompt, err := buildClipboardPrompt(ctx, userPrompt, clipboardText, templates, vars)
+	if err != nil {
+		cancel()
+		log.Printf("❌ Failed to build prompt: %v", err)
+		showNotification("Khoj AI Error", err.Error())
+		return
+	}
+	if !appConfig().Language.KeepAnswer {
+		finalPrompt = withAnswerLanguage(language, finalPrompt)
+	}
+	finalPrompt = withAppPrompt(targetWindow, vars, finalPrompt)
+
+	sendClipboardRequest(ctx, cancel, timeout, clipboardRequest{
+		Prompt:     withVerbosity(verbosity, finalPrompt),
+		Commands:   cmds,
+		OutputMode: outputMode,
+		MaxChars:   maxChars,
+		Exchange:   clipboardExchange{Content: clipboardText, Request: userPrompt, Origin: windowScratchpadOrigin(scratchpadClipboard, targetWindow), Citations: clipboardCitations(userPrompt, templates), RichText: clipboardRichText(userPrompt, templates)},
+		Review:     clipboardRewrite(userPrompt, templates),
+		Language:   language,
+		Window:     targetWindow,
+
+		PostProcess: clipboardPostProcess(userPrompt, templates),
+	})
+}
+
+// sendClipboardRequest sends a clipboard AI prompt and inserts the answer at the cursor, remembering the exchange for follow-ups
+func sendClipboardRequest(ctx context.Context, cancel context.CancelFunc, timeout time.Duration, req clipboardRequest) {
+	// Get API configuration
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	apiKey := os.Getenv("KHOJ_API_KEY")
+	if apiKey == "" {
+		cancel()
+		log.Printf("❌ KHOJ_API_KEY not set")
+		reportKhojError("Request failed", errAPIKeyNotSet)
+		return
+	}
+
+	// A clipboard session keeps the request out of the main conversation
+	convID := conversationID
+	if sessionID, err := clipboardSession.Conversation(apiBase, apiKey); err != nil {
+		log.Printf("⚠️ %v, using the main conversation", err)
+	} else if sessionID != "" {
+		convID = sessionID
+	}
+
+	log.Printf("🔧 Using API base: %s", apiBase)
+	log.Printf("🔧 Using conversation ID: %s", convID)
+
+	// Process with AI using existing conversation context
+	log.Printf("🤖 Sending request to Khoj AI...")
+
+	progress := startProgress("Clipboard AI")
+	workers.Go("clipboard-ai", func(workerCtx context.Context) error {
+		defer cancel()    // Cancel context when goroutine completes
+		var outcome error // Why the answer did not land, for the tray preview
+		defer func() { progress.Done(outcome) }()
+
+		// Use the existing Khoj chat API with conversation context; custom instructions are the main conversation's
+		message := withResearchMode(req.Commands.Research, withConversationInstructions(conversationID, req.Prompt))
+		khojResp, err := sendToKhojChat(apiBase, apiKey, convID, message, ctx)
+		clipboardSession.Touch(convID)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				log.Printf("ℹ️ AI request cancelled during shutdown")
+			} else if ctx.Err() == context.DeadlineExceeded {
+				log.Printf("⏰ AI request timed out after %v", timeout)
+				// Only show notification for timeout errors
+				showNotification("Khoj AI Timeout", fmt.Sprintf("Timed out after %d seconds", int(timeout.Seconds())))
+			} else if khojUnreachable(err) && offerOfflineQueue(err, convID, message, req) {
+				outcome = fmt.Errorf("queued until Khoj is reachable")
+				return nil
+			} else {
+				log.Printf("❌ AI request failed: %v", err)
+				// Only show notification for critical errors
+				reportKhojError("Request failed", err)
+			}
+			outcome = err
+			bus.Publish(topicClipboard, "failed", ClipboardEvent{Error: err.Error()})
+			return nil
+		}
+
+		log.Printf("✅ Received AI response (%d characters)", len(khojResp.Response))
+
+		// Apply the length limit and footers, and screen the response before it lands in another application
+		khojResp = withCitations(limitResponseLength(khojResp, req.OutputMode, req.MaxChars), req.Exchange.Citations)
+		content, err := applyPostProcess(workerCtx, req.PostProcess, responseContent(khojResp, responseTargetClipboard, req.OutputMode))
+		if err != nil {
+			log.Printf("❌ %v", err)
+			showNotification("Khoj AI Error", fmt.Sprintf("Response not inserted: %v", err))
+			outcome = err
+			bus.Publish(topicClipboard, "failed", ClipboardEvent{Error: err.Error()})
+			return nil
+		}
+		aiResponse, matches, blocked := activeOutputFilter.Apply(content)
+		if blocked {
+			log.Printf("🚫 Output filter blocked insertion (%d matches)", matches)
+			showNotification("Khoj AI Blocked", fmt.Sprintf("Response not inserted: %d filtered term(s) found", matches))
+			outcome = fmt.Errorf("blocked by the output filter")
+			bus.Publish(topicClipboard, "blocked", ClipboardEvent{Matches: matches})
+			return nil
+		}
+		progress.Update(aiResponse)
+		if matches > 0 {
+			log.Printf("Output filter masked %d matches", matches)
+		}
+
+		req.Exchange.Response = aiResponse
+		rememberClipboardExchange(req.Exchange)
+		addToAIClipboard(req.Exchange.Request, aiResponse, false)
+		appendScratchpad(req.Exchange.Origin, req.Exchange.Request, aiResponse)
+
+		// Rewrites replace the copied text, so the user reviews the changes first
+		if req.Review {
+			accepted, err := reviewRewrite(workerCtx, req.Exchange.Content, aiResponse, req.Language)
+			if err != nil {
+				log.Printf("❌ Diff preview failed: %v", err)
+				showNotification("Khoj AI Error", fmt.Sprintf("Diff preview failed: %v", err))
+				outcome = err
+				bus.Publish(topicClipboard, "failed", ClipboardEvent{Error: err.Error()})
+				return nil
+			}
+			if !accepted {
+				log.Printf("🛑 Rewrite declined in diff preview")
+				showNotification("Khoj AI", "Rewrite not inserted")
+				outcome = fmt.Errorf("rewrite not inserted")
+				bus.Publish(topicClipboard, "declined", ClipboardEvent{Chars: len(aiResponse)})
+				return nil
+			}
+			focusWindow(req.Window)
+		}
+
+		if !confirmTerminalInsertion(aiResponse) {
+			log.Printf("🛑 Insertion into terminal declined by user")
+			showNotification("Khoj AI", "Command not inserted")
+			outcome = fmt.Errorf("command not inserted")
+			bus.Publish(topicClipboard, "declined", ClipboardEvent{Chars: len(aiResponse)})
+			return nil
+		}
+
+		// Send the AI response to the current cursor position
+		log.Printf("⌨️ Inserting response at cursor...")
+		var inserted int
+		richText := req.Exchange.RichText != richTextOff
+		if req.Commands.NoStream {
+			// /nostream inserts the whole answer at once instead of paragraph by paragraph
+			inserted, err = len(aiResponse), sendText(aiResponse, richText)
+		} else {
+			inserted, err = insertResponse(workerCtx, aiResponse, richText)
+		}
+		if err == errInsertionStopped {
+			log.Printf("⏹️ Insertion stopped by user after %d characters", inserted)
+			showNotification("Khoj AI", fmt.Sprintf("Insertion stopped: %d of %d characters inserted", inserted, len(aiResponse)))
+			outcome = err
+			bus.Publish(topicClipboard, "stopped", ClipboardEvent{Chars: inserted})
+		} else if err != nil {
+			log.Printf("❌ Failed to send text: %v", err)
+			// Only show notification for insertion errors
+			showNotification("Khoj AI Error", fmt.Sprintf("Failed to insert: %v", err))
+			outcome = err
+			bus.Publish(topicClipboard, "failed", ClipboardEvent{Error: err.Error()})
+		} else {
+			log.Printf("✅ Successfully inserted AI response")
+			bus.Publish(topicClipboard, "inserted", ClipboardEvent{Chars: len(aiResponse), Matches: matches})
+			// No success notification - user can see the text was inserted
+		}
+		return nil
+	})
+}
+
+// rememberClipboardExchange keeps an answered exchange for the follow-up hotkey; follow-ups keep the original content
+func rememberClipboardExchange(exchange clipboardExchange) {
+	lastExchangeMu.Lock()
+	defer lastExchangeMu.Unlock()
+	if exchange.Content == "" {
+		exchange.Content = lastExchange.Content
+	}
+	lastExchange = exchange
+}
+
+// Offline queue and AI clipboard limits
+const (
+	aiClipboardSize         = 20 // Answers kept in the AI clipboard ring
+	maxQueuedClipboard      = 20
+	offlineRetryInterval    = 30 * time.Second
+	offlineMaxRetryInterval = 5 * time.Minute
+)
+
+// khojStatusError is a non-200 reply from Khoj's chat API
+type khojStatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *khojStatusError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.Status, e.Body)
+}
+
+// khojUnreachable reports whether a chat request failed because Khoj could not be reached rather than because it
+// rejected the request; callers check their own context first, since cancellations also surface as *url.Error
+func khojUnreachable(err error) bool {
+	var statusErr *khojStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.Status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// Khoj failure classes, each with its own troubleshooting hint and fix
+const (
+	failureUnauthorized = "unauthorized" // The API key is missing, mistyped or revoked
+	failureQuota        = "quota"        // 402 or 429: the plan's usage limit is reached
+	failureAgent        = "agent"        // The agent was deleted or the user may not use it
+	failureUnreachable  = "unreachable"  // No route to Khoj, or a gateway error
+	failureTLS          = "tls"          // The certificate is not trusted, often a proxy inspecting HTTPS
+	failureOther        = "other"
+)
+
+// errAPIKeyNotSet is reported when a request needs Khoj but KHOJ_API_KEY is empty
+var errAPIKeyNotSet = errors.New("KHOJ_API_KEY not set")
+
+// khojFailure is a failed Khoj request mapped to a troubleshooting hint and the fix to offer
+type khojFailure struct {
+	Class string
+	Hint  string // What went wrong and what to try
+	Fix   string // The question offering the fix; empty when there is none
+}
+
+// fixOfferCooldown keeps repeated failures of one class from stacking fix dialogs
+const fixOfferCooldown = time.Minute
+
+var (
+	fixOffered   = make(map[string]time.Time) // Failure class -> when its fix was last offered
+	fixOfferedMu sync.Mutex
+)
+
+// classifyKhojError maps a failed Khoj request to its failure class. Khoj answers 403 both for a rejected key
+// and for an agent the user may not use, so a 403 only counts as an agent failure when the body names the agent.
+func classifyKhojError(err error) khojFailure {
+	keyFix := "Enter a new API key now?"
+	if errors.Is(err, errAPIKeyNotSet) {
+		return khojFailure{Class: failureUnauthorized, Hint: "No Khoj API key is set.", Fix: "Enter your API key now?"}
+	}
+	if errors.Is(err, errKhojUnauthorized) {
+		return khojFailure{Class: failureUnauthorized, Hint: "Khoj rejected the API key. It may be mistyped, expired or revoked.", Fix: keyFix}
+	}
+
+	var statusErr *khojStatusError
+	if errors.As(err, &statusErr) {
+		agentHint := fmt.Sprintf("Khoj can't find agent %s, or you aren't allowed to use it.", currentAgentSlug)
+		switch statusErr.Status {
+		case http.StatusUnauthorized:
+			return khojFailure{Class: failureUnauthorized, Hint: "Khoj rejected the API key. It may be mistyped, expired or revoked.", Fix: keyFix}
+		case http.StatusForbidden:
+			if strings.Contains(strings.ToLower(statusErr.Body), "agent") {
+				return khojFailure{Class: failureAgent, Hint: agentHint, Fix: "Pick another agent now?"}
+			}
+			return khojFailure{Class: failureUnauthorized, Hint: "Khoj rejected the API key. It may be mistyped, expired or revoked.", Fix: keyFix}
+		case http.StatusPaymentRequired, http.StatusTooManyRequests:
+			return khojFailure{Class: failureQuota, Hint: "Your Khoj usage limit is reached. Wait for it to reset or upgrade your plan.", Fix: "Open your Khoj settings?"}
+		}
+		if agentFailed(err) {
+			return khojFailure{Class: failureAgent, Hint: agentHint, Fix: "Pick another agent now?"}
+		}
+	}
+
+	// Certificate errors also surface as *url.Error, so they are checked before reachability
+	if tlsFailed(err) {
+		return khojFailure{Class: failureTLS, Hint: "Khoj's HTTPS certificate isn't trusted. A proxy or security tool may be inspecting the connection, or KHOJ_API_BASE points to a server without HTTPS.", Fix: "Run a connection test?"}
+	}
+	if khojUnreachable(err) {
+		return khojFailure{Class: failureUnreachable, Hint: "Khoj can't be reached. Check your network, VPN or proxy, and KHOJ_API_BASE.", Fix: "Run a connection test?"}
+	}
+	return khojFailure{Class: failureOther, Hint: err.Error()}
+}
+
+// tlsFailed reports whether a request failed on an untrusted or invalid certificate, or a server not speaking TLS
+func tlsFailed(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var verification *tls.CertificateVerificationError
+	var header tls.RecordHeaderError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) ||
+		errors.As(err, &verification) || errors.As(err, &header)
+}
+
+// reportKhojError notifies about a failed request with the hint for its failure class and, on Windows, offers
+// the fix in a dialog. action names what failed, e.g. "Request failed".
+func reportKhojError(action string, err error) {
+	failure := classifyKhojError(err)
+	showNotification("Khoj AI Error", fmt.Sprintf("%s: %s", action, failure.Hint))
+	if failure.Fix == "" || !win32.Supported() {
+		return
+	}
+
+	fixOfferedMu.Lock()
+	due := time.Since(fixOffered[failure.Class]) >= fixOfferCooldown
+	if due {
+		fixOffered[failure.Class] = time.Now()
+	}
+	fixOfferedMu.Unlock()
+	if !due {
+		return
+	}
+
+	workers.Go("troubleshoot", func(ctx context.Context) error {
+		message := fmt.Sprintf("%s: %s\n\n%s", action, failure.Hint, failure.Fix)
+		// MB_YESNO = 4, MB_ICONWARNING = 0x30, MB_TOPMOST = 0x40000; IDYES = 6
+		if win32.MessageBox(win32.ForegroundWindow(), "Khoj AI - Troubleshooting", message, 0x4|0x30|0x40000) != 6 {
+			return nil
+		}
+		log.Printf("🩺 Running the %s fix", failure.Class)
+		if err := runKhojFix(ctx, failure.Class); err != nil {
+			log.Printf("❌ %s fix failed: %v", failure.Class, err)
+			showNotification("Khoj AI Error", err.Error())
+		}
+		return nil
+	})
+}
+
+// runKhojFix runs the remediation for a failure class
+func runKhojFix(ctx context.Context, class string) error {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	switch class {
+	case failureUnauthorized:
+		return editAPIKeyDialog()
+	case failureAgent:
+		return editAgentSlugDialog()
+	case failureQuota:
+		return openBrowser(apiBase + "/settings")
+	case failureUnreachable, failureTLS:
+		runConnectionTest(ctx)
+	}
+	return nil
+}
+
+// aiClipboardEntry is an answer kept in the AI clipboard ring
+type aiClipboardEntry struct {
+	ID        int       `json:"id"`
+	Request   string    `json:"request"`
+	Answer    string    `json:"answer"`
+	Queued    bool      `json:"queued"` // Answered from the offline queue instead of being inserted at the cursor
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// queuedClipboardRequest is a clipboard AI request waiting for Khoj to become reachable
+type queuedClipboardRequest struct {
+	ID        int       `json:"id"`
+	Request   string    `json:"request"`
+	QueuedAt  time.Time `json:"queued_at"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+
+	conversationID string
+	message        string // Exactly what was sent the first time, instructions included
+	clipboard      clipboardRequest
+}
+
+var (
+	// aiClipboard holds recent clipboard AI answers, newest first; offlineQueue holds requests waiting for Khoj, oldest first.
+	// Both are kept in memory only, since they contain clipboard text.
+	aiClipboard    []aiClipboardEntry
+	offlineQueue   []queuedClipboardRequest
+	aiClipboardSeq int
+	aiClipboardMu  sync.Mutex
+
+	offlineQueueWake = make(chan struct{}, 1)
+	offlineQueueOnce sync.Once
+)
+
+// addToAIClipboard keeps an answer in the AI clipboard ring, dropping the oldest beyond aiClipboardSize
+func addToAIClipboard(request, answer string, queued bool) {
+	if request == "" {
+		request = defaultClipboardPrompt
+	}
+
+	aiClipboardMu.Lock()
+	defer aiClipboardMu.Unlock()
+	aiClipboardSeq++
+	entry := aiClipboardEntry{ID: aiClipboardSeq, Request: request, Answer: answer, Queued: queued, CreatedAt: time.Now()}
+	aiClipboard = append([]aiClipboardEntry{entry}, aiClipboard...)
+	if len(aiClipboard) > aiClipboardSize {
+		aiClipboard = aiClipboard[:aiClipboardSize]
+	}
+}
+
+// Scratchpad sources and file choices
+const (
+	scratchpadClipboard   = "clipboard"
+	scratchpadQuickAsk    = "quick_ask"
+	scratchpadAPI         = "api"
+	scratchpadByApp       = "app"
+	scratchpadByWorkspace = "workspace"
+
+	defaultScratchpadDir = "scratchpads"
+)
+
+// scratchpadOrigin says where a request was made, which picks the scratchpad its answer goes to
+type scratchpadOrigin struct {
+	Source    string // clipboard, quick_ask or api
+	App       string // Foreground application, or the API client
+	Title     string // Window title, searched for workspace folder names
+	Workspace string // Folder or name from X-Khoj-Workspace
+}
+
+var (
+	scratchpadMu sync.Mutex
+
+	// quickAskOrigin is the window that was in front when quick ask last opened
+	quickAskOrigin atomic.Pointer[scratchpadOrigin]
+)
+
+// windowScratchpadOrigin names the application and title of a window
+func windowScratchpadOrigin(source string, hwnd uintptr) scratchpadOrigin {
+	vars := templateVariables(hwnd, languageGuess{})
+	return scratchpadOrigin{Source: source, App: vars["app_name"], Title: vars["window_title"]}
+}
+
+// apiScratchpadOrigin names the client of a chat completion and the workspace it sent
+func apiScratchpadOrigin(r *http.Request, req *ChatCompletionRequest) scratchpadOrigin {
+	origin := scratchpadOrigin{Source: scratchpadAPI, App: clientIdentity(r, req), Workspace: strings.TrimSpace(r.Header.Get("X-Khoj-Workspace"))}
+	if origin.App == "" {
+		origin.App = "api"
+	}
+	return origin
+}
+
+type scratchpadOriginKey struct{}
+
+// withScratchpadOrigin tags a context with where its request came from
+func withScratchpadOrigin(ctx context.Context, origin scratchpadOrigin) context.Context {
+	return context.WithValue(ctx, scratchpadOriginKey{}, origin)
+}
+
+// scratchpadOriginFrom returns the origin a context was tagged with, defaulting to an unnamed API client
+func scratchpadOriginFrom(ctx context.Context) scratchpadOrigin {
+	if origin, ok := ctx.Value(scratchpadOriginKey{}).(scratchpadOrigin); ok {
+		return origin
+	}
+	return scratchpadOrigin{Source: scratchpadAPI, App: "api"}
+}
+
+// scratchpadSummary describes the scratchpad settings for `config validate`
+func (cfg *AppConfig) scratchpadSummary() string {
+	sp := cfg.Scratchpad
+	if sp == nil {
+		return "off (default)"
+	}
+	dir, by, sources := sp.Dir, sp.By, sp.Sources
+	if dir == "" {
+		dir = defaultScratchpadDir
+	}
+	if by == "" {
+		by = scratchpadByApp
+	}
+	if len(sources) == 0 {
+		sources = []string{scratchpadClipboard, scratchpadQuickAsk, scratchpadAPI}
+	}
+	return fmt.Sprintf("per %s in %s, from %s", by, dir, strings.Join(sources, ", "))
+}
+
+// scratchpadFile picks the file an answer from origin is appended to, or returns "" when its source isn't recorded.
+// By workspace, the workspace named by X-Khoj-Workspace or found in the window title is used; answers from
+// anywhere else go to their application's file.
+func scratchpadFile(cfg *ScratchpadConfig, workspaceRoots []string, origin scratchpadOrigin) string {
+	if len(cfg.Sources) > 0 {
+		recorded := false
+		for _, source := range cfg.Sources {
+			recorded = recorded || source == origin.Source
+		}
+		if !recorded {
+			return ""
+		}
+	}
+
+	name := origin.App
+	if cfg.By == scratchpadByWorkspace {
+		folders := cfg.Workspaces
+		if len(folders) == 0 {
+			folders = workspaceRoots
+		}
+		if workspace := scratchpadWorkspace(folders, origin); workspace != "" {
+			name = workspace
+		}
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = defaultScratchpadDir
+	}
+	return filepath.Join(dir, scratchpadFileName(name)+".md")
+}
+
+// scratchpadWorkspace finds the workspace of an origin. A workspace sent by the client is used even when it isn't
+// configured, named after its last path element. Window titles match the longest configured folder name they
+// contain, since editors show the open folder in the title.
+func scratchpadWorkspace(folders []string, origin scratchpadOrigin) string {
+	if origin.Workspace != "" {
+		sent := filepath.Clean(origin.Workspace)
+		for _, folder := range folders {
+			if rel, err := filepath.Rel(folder, sent); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return filepath.Base(folder)
+			}
+		}
+		return filepath.Base(sent)
+	}
+
+	best := ""
+	title := strings.ToLower(origin.Title)
+	for _, folder := range folders {
+		name := filepath.Base(folder)
+		if len(name) > len(best) && strings.Contains(title, strings.ToLower(name)) {
+			best = name
+		}
+	}
+	return best
+}
+
+// scratchpadFileName keeps letters, digits, dots, dashes and spaces so any name makes a valid file name
+func scratchpadFileName(name string) string {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' || r == ' ' {
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(name))
+	clean = strings.Trim(clean, ". ")
+	if len([]rune(clean)) > 80 {
+		clean = string([]rune(clean)[:80])
+	}
+	if clean == "" {
+		return "unknown"
+	}
+	return clean
+}
+
+// appendScratchpad adds an answer and the request it answered to the origin's scratchpad file. Nothing is
+// written in privacy mode.
+func appendScratchpad(origin scratchpadOrigin, request, answer string) {
+	cfg := appConfig().Scratchpad
+	if cfg == nil || privacyMode.Load() || strings.TrimSpace(answer) == "" {
+		return
+	}
+	path := scratchpadFile(cfg, appConfig().Workspace.Roots, origin)
+	if path == "" {
+		return
+	}
+
+	var entry strings.Builder
+	fmt.Fprintf(&entry, "## %s · %s · %s\n\n", time.Now().Format("2006-01-02 15:04:05"), origin.Source, origin.App)
+	if request = strings.TrimSpace(request); request != "" {
+		for _, line := range strings.Split(truncateText(request, 500), "\n") {
+			entry.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+		}
+		entry.WriteString("\n")
+	}
+	entry.WriteString(strings.TrimSpace(answer) + "\n\n")
+
+	scratchpadMu.Lock()
+	defer scratchpadMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("⚠️ Scratchpad not written: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("⚠️ Scratchpad not written: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(entry.String()); err != nil {
+		log.Printf("⚠️ Scratchpad not written: %v", err)
+		return
+	}
+	log.Printf("📝 Appended %d characters to %s", len(answer), path)
+}
+
+// offerOfflineQueue asks whether a request that could not reach Khoj should wait for it, and queues it if the user agrees
+func offerOfflineQueue(err error, conversationID, message string, req clipboardRequest) bool {
+	aiClipboardMu.Lock()
+	full := len(offlineQueue) >= maxQueuedClipboard
+	aiClipboardMu.Unlock()
+	if full {
+		log.Printf("⚠️ Offline queue full (%d requests), not offering to queue", maxQueuedClipboard)
+		return false
+	}
+
+	log.Printf("📡 Khoj unreachable: %v", err)
+	prompt := "Khoj can't be reached right now.\n\nQueue this request and deliver the answer to the AI Clipboard once Khoj is back?"
+	// MB_YESNO = 4, MB_ICONQUESTION = 0x20, MB_TOPMOST = 0x40000; IDYES = 6
+	if win32.MessageBox(win32.ForegroundWindow(), "Khoj AI - Offline", prompt, 0x4|0x20|0x40000) != 6 {
+		log.Printf("ℹ️ User declined to queue the request")
+		return false
+	}
+
+	request := req.Exchange.Request
+	if request == "" {
+		request = defaultClipboardPrompt
+	}
+
+	aiClipboardMu.Lock()
+	aiClipboardSeq++
+	queued := queuedClipboardRequest{
+		ID:        aiClipboardSeq,
+		Request:   request,
+		QueuedAt:  time.Now(),
+		Attempts:  1,
+		LastError: err.Error(),
+
+		conversationID: conversationID,
+		message:        message,
+		clipboard:      req,
+	}
+	offlineQueue = append(offlineQueue, queued)
+	waiting := len(offlineQueue)
+	aiClipboardMu.Unlock()
+
+	log.Printf("📥 Queued clipboard request %d (%d waiting)", queued.ID, waiting)
+	showNotification("Khoj AI", fmt.Sprintf("Request queued (%d waiting) - you'll be notified when Khoj is back", waiting))
+	bus.Publish(topicClipboard, "queued", ClipboardEvent{Chars: len(req.Exchange.Content)})
+	offlineQueueOnce.Do(startOfflineQueue)
+	return true
+}
+
+// wakeOfflineQueue makes the queue worker retry now instead of waiting for its next attempt
+func wakeOfflineQueue() {
+	aiClipboardMu.Lock()
+	waiting := len(offlineQueue)
+	aiClipboardMu.Unlock()
+	if waiting == 0 {
+		return
+	}
+	select {
+	case offlineQueueWake <- struct{}{}:
+	default:
+	}
+}
+
+// startOfflineQueue retries queued clipboard requests, backing off while Khoj stays unreachable
+func startOfflineQueue() {
+	workers.Go("offline-queue", func(ctx context.Context) error {
+		interval := offlineRetryInterval
+		for {
+			select {
+			case <-ctx.Done():
+				aiClipboardMu.Lock()
+				waiting := len(offlineQueue)
+				aiClipboardMu.Unlock()
+				if waiting > 0 {
+					log.Printf("⚠️ Discarding %d queued clipboard request(s) on shutdown", waiting)
+				}
+				return nil
+			case <-time.After(interval):
+			case <-offlineQueueWake:
+			}
+
+			if drainOfflineQueue(ctx) {
+				interval = offlineRetryInterval
+				continue
+			}
+			interval *= 2
+			if interval > offlineMaxRetryInterval {
+				interval = offlineMaxRetryInterval
+			}
+		}
+	})
+}
+
+// drainOfflineQueue sends queued requests oldest first and delivers the answers to the AI clipboard.
+// It returns false when Khoj is still unreachable, leaving the rest of the queue for the next attempt.
+func drainOfflineQueue(ctx context.Context) bool {
+	delivered, announced := 0, false
+	defer func() {
+		if delivered > 0 {
+			showNotification("Khoj AI", fmt.Sprintf("%d queued answer(s) ready in the AI Clipboard", delivered))
+		}
+	}()
+
+	for {
+		aiClipboardMu.Lock()
+		if len(offlineQueue) == 0 {
+			aiClipboardMu.Unlock()
+			return true
+		}
+		next := offlineQueue[0]
+		waiting := len(offlineQueue)
+		aiClipboardMu.Unlock()
+
+		answer, err := replayClipboardRequest(ctx, next)
+		if ctx.Err() != nil {
+			return true
+		}
+		if err != nil && khojUnreachable(err) {
+			log.Printf("📡 Khoj still unreachable, %d request(s) queued: %v", waiting, err)
+			aiClipboardMu.Lock()
+			if len(offlineQueue) > 0 && offlineQueue[0].ID == next.ID {
+				offlineQueue[0].Attempts++
+				offlineQueue[0].LastError = err.Error()
+			}
+			aiClipboardMu.Unlock()
+			return false
+		}
+
+		if !announced {
+			announced = true
+			log.Printf("📡 Khoj reachable again, processing %d queued request(s)", waiting)
+			showNotification("Khoj AI", fmt.Sprintf("Khoj is back - processing %d queued request(s)", waiting))
+		}
+		if !removeQueuedClipboard(next.ID) {
+			log.Printf("ℹ️ Queued request %d was cancelled while it was being sent", next.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("❌ Queued request %d failed: %v", next.ID, err)
+			reportKhojError("Queued request failed", err)
+			bus.Publish(topicClipboard, "failed", ClipboardEvent{Error: err.Error()})
+			continue
+		}
+
+		log.Printf("✅ Queued request %d answered (%d characters)", next.ID, len(answer))
+		addToAIClipboard(next.Request, answer, true)
+		appendScratchpad(next.clipboard.Exchange.Origin, next.Request, answer)
+		bus.Publish(topicClipboard, "delivered", ClipboardEvent{Chars: len(answer)})
+		delivered++
+	}
+}
+
+// replayClipboardRequest sends a queued request at background priority and screens the answer as the hotkey would
+func replayClipboardRequest(ctx context.Context, queued queuedClipboardRequest) (string, error) {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	ctx, cancel := context.WithTimeout(withRequestClass(ctx, classBackground), durationOrDefault(appConfig().Timeout, defaultTimeout))
+	defer cancel()
+
+	req := queued.clipboard
+	khojResp, err := sendToKhojChat(apiBase, os.Getenv("KHOJ_API_KEY"), queued.conversationID, queued.message, ctx)
+	if err != nil {
+		return "", err
+	}
+	khojResp = withCitations(limitResponseLength(khojResp, req.OutputMode, req.MaxChars), req.Exchange.Citations)
+	content, err := applyPostProcess(ctx, req.PostProcess, responseContent(khojResp, responseTargetClipboard, req.OutputMode))
+	if err != nil {
+		return "", err
+	}
+	answer, matches, blocked := activeOutputFilter.Apply(content)
+	if blocked {
+		return "", fmt.Errorf("answer blocked by the output filter (%d filtered term(s) found)", matches)
+	}
+	return answer, nil
+}
+
+// removeQueuedClipboard drops a request from the offline queue, reporting whether it was still queued
+func removeQueuedClipboard(id int) bool {
+	aiClipboardMu.Lock()
+	defer aiClipboardMu.Unlock()
+	for i, queued := range offlineQueue {
+		if queued.ID == id {
+			offlineQueue = append(offlineQueue[:i], offlineQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// handleAIClipboard lists the AI clipboard and offline queue; POST retries the queue now and DELETE ?id= cancels a queued request
+func handleAIClipboard(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		wakeOfflineQueue()
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || !removeQueuedClipboard(id) {
+			http.Error(w, "Queued request not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("🗑️ Queued request %d cancelled", id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	aiClipboardMu.Lock()
+	listing := struct {
+		Queued  []queuedClipboardRequest `json:"queued"`
+		Entries []aiClipboardEntry       `json:"entries"`
+	}{
+		Queued:  append([]queuedClipboardRequest{}, offlineQueue...),
+		Entries: append([]aiClipboardEntry{}, aiClipboard...),
+	}
+	aiClipboardMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// showAIClipboard opens the AI clipboard window
+func showAIClipboard() {
+	if err := openAppWindow("http://localhost:"+serverPort()+"/clipboard", aiClipboardTitle, 640, 560); err != nil {
+		log.Printf("Failed to open AI clipboard: %v", err)
+	}
+}
+
+// Network change detection
+const (
+	networkPollInterval    = 5 * time.Second // Interface polling where address change notifications are unavailable
+	networkSettleDelay     = 3 * time.Second // Changes arrive in bursts while an interface or VPN comes up
+	connectionCheckTimeout = 10 * time.Second
+)
+
+// Khoj connection states reported in ConnectionEvent
+const (
+	connectionConnected    = "connected"
+	connectionUnreachable  = "unreachable"
+	connectionUnauthorized = "unauthorized"
+)
+
+// errKhojUnauthorized is returned by validateKhojConnection when Khoj answers but rejects the API key
+var errKhojUnauthorized = errors.New("Khoj rejected the API key")
+
+var networkWatchOnce sync.Once
+
+// startNetworkWatch checks the Khoj connection now and again whenever the machine's network addresses change,
+// so the tray shows a lost connection before the next request fails
+func startNetworkWatch() {
+	networkWatchOnce.Do(func() {
+		changes := make(chan struct{}, 1)
+		if runtime.GOOS == "windows" {
+			go notifyAddrChanges(changes)
+		} else {
+			workers.Go("network-poll", func(ctx context.Context) error {
+				return pollNetworkInterfaces(ctx, changes)
+			})
+		}
+
+		workers.Go("network-watch", func(ctx context.Context) error {
+			state := checkKhojConnection(ctx, "startup", "")
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-changes:
+				}
+				if !waitNetworkSettled(ctx, changes) {
+					return nil
+				}
+				log.Printf("🌐 Network changed, re-validating the Khoj connection")
+				state = checkKhojConnection(ctx, "network_change", state)
+			}
+		})
+	})
+}
+
+// signalNetworkChange records a change without blocking; one pending signal is enough
+func signalNetworkChange(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// waitNetworkSettled waits until no change has arrived for networkSettleDelay; it returns false on shutdown
+func waitNetworkSettled(ctx context.Context, changes <-chan struct{}) bool {
+	settle := time.NewTimer(networkSettleDelay)
+	defer settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changes:
+			settle.Reset(networkSettleDelay)
+		case <-settle.C:
+			return true
+		}
+	}
+}
+
+// notifyAddrChanges signals each change Windows reports to the IP address table, which covers interfaces going up
+// or down and VPNs connecting. NotifyAddrChange blocks without a handle and cannot be cancelled, so this runs in a
+// plain goroutine that ends with the process rather than as a worker.
+func notifyAddrChanges(changes chan<- struct{}) {
+	for {
+		if r1, _, err := procNotifyAddrChange.Call(0, 0); r1 != 0 {
+			log.Printf("⚠️ NotifyAddrChange failed, network changes will not be detected: %v", err)
+			return
+		}
+		signalNetworkChange(changes)
+	}
+}
+
+// pollNetworkInterfaces signals a change whenever the interfaces that are up, or their addresses, differ from the last poll
+func pollNetworkInterfaces(ctx context.Context, changes chan<- struct{}) error {
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+
+	last := networkFingerprint()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if current := networkFingerprint(); current != last {
+			last = current
+			signalNetworkChange(changes)
+		}
+	}
+}
+
+// networkFingerprint lists the interfaces that are up with their addresses
+func networkFingerprint() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		fmt.Fprintf(&b, "%s %v\n", iface.Name, addrs)
+	}
+	return b.String()
+}
+
+// checkKhojConnection validates the Khoj connection and publishes the result, notifying when it differs from the
+// previous state. It returns the new state.
+func checkKhojConnection(ctx context.Context, reason, previous string) string {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, connectionCheckTimeout)
+	defer cancel()
+	ev := ConnectionEvent{State: connectionConnected, Reason: reason}
+	if err := validateKhojConnection(checkCtx, apiBase, os.Getenv("KHOJ_API_KEY")); err != nil {
+		if ctx.Err() != nil {
+			return previous
+		}
+		ev.State = connectionUnreachable
+		if errors.Is(err, errKhojUnauthorized) {
+			ev.State = connectionUnauthorized
+		}
+		ev.Error = err.Error()
+		log.Printf("🌐 Khoj connection check (%s): %s: %v", reason, ev.State, err)
+	} else {
+		log.Printf("🌐 Khoj connection check (%s): connected", reason)
+	}
+	bus.Publish(topicConnection, "checked", ev)
+
+	if ev.State == connectionConnected {
+		wakeOfflineQueue()
+	}
+	if previous == "" || ev.State == previous {
+		return ev.State
+	}
+	switch ev.State {
+	case connectionConnected:
+		showNotification("Khoj AI", "Connection to Khoj restored")
+	case connectionUnauthorized:
+		reportKhojError("Connection check", errKhojUnauthorized)
+	default:
+		showNotification("Khoj AI", "Khoj is unreachable after a network change")
+	}
+	return ev.State
+}
+
+// runConnectionTest checks the Khoj connection on request and notifies the result either way
+func runConnectionTest(ctx context.Context) {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	switch checkKhojConnection(ctx, "connection test", "") {
+	case connectionConnected:
+		showNotification("Khoj AI", "Khoj is reachable - try your request again")
+	case connectionUnauthorized:
+		reportKhojError("Connection test", errKhojUnauthorized)
+	case connectionUnreachable:
+		showNotification("Khoj AI Error", "Khoj is still unreachable at "+apiBase)
+	}
+}
+
+// validateKhojConnection makes a cheap authenticated request to Khoj. Anything but an auth or gateway error counts
+// as connected, so servers without the user endpoint still pass.
+func validateKhojConnection(ctx context.Context, apiBase, apiKey string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+"/api/v1/user", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create connection check: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach Khoj: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w (status %d)", errKhojUnauthorized, resp.StatusCode)
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("Khoj answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// privacyMode keeps prompts and responses off the disk and out of the logs while set
+var privacyMode atomic.Bool
+
+// privacyIconData is the tray icon with a badge, shown while privacy mode is on
+var privacyIconData = badgeIcon(iconData)
+
+// logContent logs a line quoting prompts or responses, which privacy mode leaves out
+func logContent(format string, args ...interface{}) {
+	if !privacyMode.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// logRequest logs like log.Printf, prefixed with the ID of the request ctx serves, if any
+func logRequest(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFrom(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// logRequestContent is logContent for a line that belongs to a request, prefixed like logRequest
+func logRequestContent(ctx context.Context, format string, args ...interface{}) {
+	if !privacyMode.Load() {
+		logRequest(ctx, format, args...)
+	}
+}
+
+// setPrivacyMode switches privacy mode and tells the tray and dashboard
+func setPrivacyMode(enabled bool) {
+	if privacyMode.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		log.Printf("🕶️ Privacy mode on: prompts and responses are no longer logged or saved")
+	} else {
+		log.Printf("🕶️ Privacy mode off")
+	}
+	bus.Publish(topicPrivacy, "changed", PrivacyEvent{Enabled: enabled})
+}
+
+// badgeIcon returns a copy of a 32x32, 32-bit ICO with a filled circle painted over its bottom-right corner
+func badgeIcon(ico []byte) []byte {
+	const pixels = 6 + 16 + 40 // ICONDIR, one ICONDIRENTRY and the BITMAPINFOHEADER
+	const mask = pixels + 32*32*4
+	icon := append([]byte(nil), ico...)
+	if len(icon) < mask+32*4 {
+		return icon
+	}
+	for y := 0; y < 12; y++ { // Rows are stored bottom-up
+		for x := 20; x < 32; x++ {
+			dx, dy := float64(x)-25.5, float64(y)-5.5
+			if dx*dx+dy*dy > 36 {
+				continue
+			}
+			i := pixels + (y*32+x)*4
+			copy(icon[i:i+4], []byte{0xb0, 0x27, 0x9c, 0xff}) // Purple, stored as BGRA
+			icon[mask+y*4+x/8] &^= 0x80 >> (x % 8)
+		}
+	}
+	return icon
+}
+
+// localDataFiles lists the existing files that hold local history and state, including written digests.
+// config.json and .env are settings and are not included.
+func localDataFiles() []string {
+	candidates := []string{conversationStateFile, clientMappingsFile, legacyClientMappingsFile, sharedLinksFile, digestFile, uploadedFilesFile, apiFilesFile, streamJournalFile, interruptedFile, windowPlacementsFile, "temp_input_dialog.vbs", "temp_input_result.txt"}
+	stored, _ := filepath.Glob(filepath.Join(apiFilesDir, "file-*"))
+	candidates = append(candidates, stored...)
+	logPath := appConfig().AccessLog.path()
+	candidates = append(candidates, logPath)
+	for i := 1; i <= appConfig().AccessLog.maxFiles(); i++ {
+		candidates = append(candidates, fmt.Sprintf("%s.%d", logPath, i))
+	}
+	dir := "digests"
+	if d := appConfig().Digest; d != nil && d.Dir != "" {
+		dir = d.Dir
+	}
+	for _, pattern := range []string{"digest-*.md", "digest-*.html"} {
+		written, _ := filepath.Glob(filepath.Join(dir, pattern))
+		candidates = append(candidates, written...)
+	}
+
+	files := []string{}
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// shredFile overwrites a file with zeros and syncs it before removing it. SSDs and copy-on-write file systems
+// may still keep older copies, so this is best effort.
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to overwrite %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// wipeLocalData shreds the local data files and clears the in-memory history, answers and custom instructions.
+// It returns the number of files deleted; the current conversation stays active.
+func wipeLocalData() (int, error) {
+	accessLog.Close() // Windows can't delete the log while it is open
+	streamJournal.Close()
+	instructionsMu.Lock()
+	conversationInstructions = make(map[string]string)
+	instructionsMu.Unlock()
+
+	lastExchangeMu.Lock()
+	lastExchange = clipboardExchange{}
+	lastExchangeMu.Unlock()
+
+	aiClipboardMu.Lock()
+	aiClipboard, offlineQueue = nil, nil
+	aiClipboardMu.Unlock()
+
+	warmAnswersMu.Lock()
+	for _, answer := range warmAnswers {
+		answer.Answer, answer.Error, answer.UpdatedAt = "", "", time.Time{}
+	}
+	warmAnswersMu.Unlock()
+	privateDigest.Store(nil)
+	sentAttachments.Forget("")
+	transcripts.Forget("")
+	windowPlacements.Forget()
+	editReviewsMu.Lock()
+	editReviews = nil
+	editReviewsMu.Unlock()
+
+	indexUploadsMu.Lock()
+	for i := len(indexUploads) - 1; i >= 0; i-- {
+		if !indexUploads[i].Running {
+			indexUploads = append(indexUploads[:i], indexUploads[i+1:]...)
+		}
+	}
+	indexUploadsMu.Unlock()
+
+	// Hold the stores' locks so none writes its file back while it is being shredded
+	sharedLinksMu.Lock()
+	uploadedFilesMu.Lock()
+	clientMappings.mu.Lock()
+	clientMappings.closeLocked()
+	var errs []error
+	wiped := 0
+	for _, path := range localDataFiles() {
+		if err := shredFile(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		wiped++
+	}
+	clientMappings.mu.Unlock()
+	uploadedFilesMu.Unlock()
+	sharedLinksMu.Unlock()
+
+	log.Printf("🧹 Wiped local data: %d file(s) deleted", wiped)
+	bus.Publish(topicPrivacy, "wiped", PrivacyEvent{Enabled: privacyMode.Load(), Wiped: wiped})
+	return wiped, errors.Join(errs...)
+}
+
+// handleDashboardPrivacy reports privacy mode and the local data files (GET), switches the mode (PUT {"enabled": bool})
+// or wipes local data (DELETE)
+func handleDashboardPrivacy(w http.ResponseWriter, r *http.Request) {
+	wiped := 0
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		setPrivacyMode(body.Enabled)
+	case http.MethodDelete:
+		var err error
+		if wiped, err = wipeLocalData(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": privacyMode.Load(),
+		"files":   localDataFiles(),
+		"wiped":   wiped,
+	})
+}
+
+// followUpPrompt asks a follow-up question with the previous exchange restated, so it works even after switching conversations
+func followUpPrompt(previous clipboardExchange, question string) string {
+	request := previous.Request
+	if request == "" {
+		request = defaultClipboardPrompt
+	}
+	return fmt.Sprintf("Earlier I asked: %s\n\nContent:\n%s\n\nYou answered:\n%s\n\nFollow-up: %s", request, previous.Content, previous.Response, question)
+}
+
+// processFollowUp asks a follow-up about the last clipboard AI exchange without reading the clipboard again
+func processFollowUp() {
+	if !win32.Supported() {
+		log.Printf("Clipboard AI feature only available on Windows")
+		return
+	}
+
+	if clipboardActive {
+		log.Printf("Clipboard AI already processing, ignoring follow-up")
+		showNotification("Khoj AI", "Already processing a request...")
+		return
+	}
+
+	lastExchangeMu.Lock()
+	previous := lastExchange
+	lastExchangeMu.Unlock()
+	if previous.Response == "" {
+		log.Printf("⚠️ No previous clipboard AI exchange to follow up on")
+		clipboardKey, _, _ := currentHotkeys()
+		showNotification("Khoj AI", fmt.Sprintf("Nothing to follow up on - press %s first", clipboardKey.Name))
+		return
+	}
+
+	clipboardActive = true
+	defer func() {
+		clipboardActive = false
+	}()
+
+	// The answer goes to the window in front now, which picks the app prompt
+	targetWindow := win32.ForegroundWindow()
+	vars := templateVariables(targetWindow, languageGuess{})
+
+	question, cancelled := showSimpleTextInput("Khoj AI - Follow Up", "Follow-up question about the last answer:", "")
+	if cancelled || strings.TrimSpace(question) == "" {
+		log.Printf("ℹ️ User cancelled the follow-up dialog")
+		return
+	}
+
+	cmds, question := parseSlashCommands(question)
+	if err := runSlashCommands(cmds); err != nil {
+		log.Printf("❌ Slash command failed: %v", err)
+		showNotification("Khoj AI Error", err.Error())
+		return
+	}
+	outputMode := ""
+	if cmds.CodeOnly {
+		outputMode = outputModeCode
+	}
+
+	log.Printf("🔁 Following up on the last exchange (%d characters of context)", len(previous.Content)+len(previous.Response))
+	showNotification("Khoj AI", "Processing follow-up...")
+	bus.Publish(topicClipboard, "processing", ClipboardEvent{Source: "follow_up", Chars: len(previous.Content)})
+
+	timeout := durationOrDefault(appConfig().ClipboardTimeout, clipboardTimeout)
+	ctx, cancel := context.WithTimeout(workers.Context(), timeout)
+	prompt := withVerbosity(cmds.Verbosity, withAppPrompt(targetWindow, vars, followUpPrompt(previous, question)))
+	sendClipboardRequest(ctx, cancel, timeout, clipboardRequest{
+		Prompt:     prompt,
+		Commands:   cmds,
+		OutputMode: outputMode,
+		MaxChars:   verbosityPresets[cmds.Verbosity].MaxChars,
+		Exchange:   clipboardExchange{Request: question, Origin: previous.Origin, Citations: previous.Citations, RichText: previous.RichText},
+	})
+}
+
+// clipboardSessionStore is the temporary conversation that consecutive clipboard AI requests share. It ends once
+// no request was made for clipboard_session.idle, so the next request starts a fresh one.
+type clipboardSessionStore struct {
+	mu       sync.Mutex
+	convID   string
+	apiBase  string
+	apiKey   string
+	requests int
+	timer    *time.Timer
+}
+
+var clipboardSession = &clipboardSessionStore{}
+
+// Conversation returns the open session's conversation, starting a session when none is open. It returns ""
+// when clipboard sessions are off.
+func (s *clipboardSessionStore) Conversation(apiBase, apiKey string) (string, error) {
+	if !appConfig().ClipboardSession.Enabled {
+		return "", nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.convID == "" {
+		convID, err := createNewConversation(apiBase, apiKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to start clipboard session: %w", err)
+		}
+		s.convID, s.apiBase, s.apiKey, s.requests = convID, apiBase, apiKey, 0
+		log.Printf("🧵 Clipboard session started in conversation %s", convID)
+	}
+	s.requests++
+	s.restartTimerLocked()
+	return s.convID, nil
+}
+
+// Touch restarts the idle timer when convID is still the session's, so slow answers don't end it early
+func (s *clipboardSessionStore) Touch(convID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.convID != "" && s.convID == convID {
+		s.restartTimerLocked()
+	}
+}
+
+func (s *clipboardSessionStore) restartTimerLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	convID := s.convID
+	idle := durationOrDefault(appConfig().ClipboardSession.Idle, clipboardSessionIdle)
+	s.timer = time.AfterFunc(idle, func() {
+		s.end(convID, fmt.Sprintf("%v idle", idle))
+	})
+}
+
+// End closes the open session, if any
+func (s *clipboardSessionStore) End(reason string) {
+	s.mu.Lock()
+	convID := s.convID
+	s.mu.Unlock()
+	if convID != "" {
+		s.end(convID, reason)
+	}
+}
+
+// end closes the session if convID is still its conversation, deleting it on Khoj with delete_remote
+func (s *clipboardSessionStore) end(convID, reason string) {
+	s.mu.Lock()
+	if s.convID != convID {
+		s.mu.Unlock()
+		return
+	}
+	apiBase, apiKey, requests := s.apiBase, s.apiKey, s.requests
+	s.convID = ""
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+
+	log.Printf("🧵 Clipboard session %s ended after %d request(s) (%s)", convID, requests, reason)
+	if appConfig().ClipboardSession.DeleteRemote {
+		if err := deleteKhojConversation(apiBase, apiKey, convID); err != nil {
+			log.Printf("⚠️ Failed to delete clipboard session conversation %s: %v", convID, err)
+		}
+	}
+}
+
+// sendToKhojChat sends a message to Khoj using the existing conversation context, starting a new conversation if Khoj
+// lost the saved one and switching to the fallback agent if the agent fails
+func sendToKhojChat(apiBase, apiKey, conversationID, message string, ctx context.Context) (*KhojResponse, error) {
+	if err := checkTeamDeny(ctx, message); err != nil {
+		return nil, err
+	}
+	if localModelFirst() {
+		return askLocalModel(ctx, &KhojRequest{Q: message, ConversationID: conversationID}, localReasonPrivacy, nil)
+	}
+	convID, agent, note := routeConversation(conversationID)
+	resp, err := postKhojChatMessage(ctx, apiBase, apiKey, convID, agent, withFallbackNote(note, message))
+	if err != nil {
+		if retryCtx, newID := repairConversation(ctx, apiBase, apiKey, convID, err); newID != "" {
+			return sendToKhojChat(apiBase, apiKey, newID, message, retryCtx)
+		}
+	}
+	if err != nil && ctx.Err() == nil && startAgentFallback(apiBase, apiKey, conversationID, agent, err) {
+		return sendToKhojChat(apiBase, apiKey, conversationID, message, ctx)
+	}
+	return orLocalModel(ctx, &KhojRequest{Q: message, ConversationID: conversationID}, resp, err, nil)
+}
+
+// postKhojChatMessage sends one message to a conversation, answered by agent
+func postKhojChatMessage(ctx context.Context, apiBase, apiKey, conversationID, agent, message string) (*KhojResponse, error) {
+	// Prepare the request body
+	requestBody := map[string]interface{}{
+		"q":               message,
+		"conversation_id": conversationID,
+		"stream":          false,
+		"train":           false,
+		"agent":           agent,
+	}
+
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Create the request
+	url := fmt.Sprintf("%s/api/chat", apiBase)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	setRequestIDHeader(req)
+
+	// Send the request; hotkey requests are interactive, replays of queued requests are background
+	client := &http.Client{}
+	var body []byte
+	start := time.Now()
+	err = khojScheduler.Run(ctx, requestClassFrom(ctx), func(ctx context.Context) error {
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errBody, _ := io.ReadAll(resp.Body)
+			return &khojStatusError{Status: resp.StatusCode, Body: string(errBody)}
+		}
+
+		// Read the response
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		mirrorExchange(ctx, conversationID, "clipboard", message, nil, start, nil, err)
+		return nil, err
+	}
+
+	// Parse the response
+	var khojResp KhojResponse
+	if err := json.Unmarshal(body, &khojResp); err != nil {
+		err = fmt.Errorf("failed to parse response: %w", err)
+		mirrorExchange(ctx, conversationID, "clipboard", message, nil, start, nil, err)
+		return nil, err
+	}
+	mirrorExchange(ctx, conversationID, "clipboard", message, nil, start, &khojResp, nil)
+
+	// Clipboard turns push earlier chat attachments back in the conversation history too
+	sentAttachments.Record(conversationID, nil)
+	return &khojResp, nil
+}
+
+// setupKeyboardMonitoring sets up polling-based hotkey detection (Ctrl+Q unless configured)
+func setupKeyboardMonitoring() error {
+	if !win32.Supported() {
+		return fmt.Errorf("keyboard monitoring only available on Windows")
+	}
+
+	log.Printf("� Setting up keyboard monitoring for %s...", activeHotkey.Name)
+
+	// Start polling for the hotkey combination
+	workers.Go("hotkey-poller", func(ctx context.Context) error {
+		var hotkey, quickAsk, followUp, leaderKey hotkeyEdgeDetector
+		warmKeys := configuredWarmHotkeys(appConfig())
+		leader := configuredLeader(appConfig())
+		warm := make([]hotkeyEdgeDetector, len(warmKeys))
+		ticker := time.NewTicker(50 * time.Millisecond) // Check every 50ms
+		defer ticker.Stop()
+
+		log.Printf("✅ Keyboard monitoring started! Press %s to use Clipboard AI", activeHotkey.Name)
+		showNotification("Khoj AI Ready", fmt.Sprintf("Press %s to process clipboard", activeHotkey.Name))
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				// Re-read every tick so bindings changed through the hotkey API apply immediately
+				clipboardKey, quickAskKey, followUpKey := currentHotkeys()
+
+				// Ctrl+Shift+Q also holds Ctrl+Q, so the follow-up combination wins when both match
+				followUpPressed := comboPressed(win32, followUpKey.Keys...)
+
+				// Trigger only on the rising edge (when the hotkey becomes pressed)
+				clipboardFired := hotkey.Update(comboPressed(win32, clipboardKey.Keys...) && !followUpPressed)
+
+				// A leader on the clipboard AI hotkey replaces it; pressed alone it still opens the dialog after the timeout
+				var leaderFired bool
+				leaderName, fallback := "", ""
+				if leader != nil {
+					if leader.key.Name == "" || leader.key.Name == clipboardKey.Name {
+						leaderFired, clipboardFired = clipboardFired, false
+						leaderName, fallback = clipboardKey.Name, "clipboard"
+					} else {
+						leaderFired = leaderKey.Update(comboPressed(win32, leader.key.Keys...))
+						leaderName = leader.key.Name
+					}
+				}
+
+				// While a sequence is pending its second key belongs to the leader, not to other hotkeys
+				pending := leader != nil && leader.Pending()
+				if pending {
+					if action, done := leader.Poll(win32, time.Now()); done {
+						runLeaderAction(action)
+					}
+				} else if leaderFired {
+					log.Printf("🎯 %s detected! Waiting for the second key...", leaderName)
+					showNotification("Khoj AI", leaderName+" then "+leader.hint)
+					leader.Start(win32, time.Now(), fallback)
+					pending = true
+				}
+
+				clipboardAI := appConfig().featureEnabled(featureClipboardAI)
+				if clipboardFired && !pending && clipboardAI {
+					log.Printf("🎯 %s detected! Processing clipboard with AI...", clipboardKey.Name)
+
+					// Show immediate notification and hand off to the clipboard subscriber
+					showNotification("Khoj AI", "Processing clipboard...")
+					bus.Publish(topicClipboard, "requested", ClipboardEvent{Source: "hotkey"})
+				}
+				if followUp.Update(followUpPressed) && !pending && clipboardAI {
+					log.Printf("🎯 %s detected! Asking a follow-up...", followUpKey.Name)
+					bus.Publish(topicClipboard, "follow_up", ClipboardEvent{Source: "hotkey"})
+				}
+				if quickAsk.Update(comboPressed(win32, quickAskKey.Keys...)) && !pending {
+					log.Printf("🎯 %s detected! Opening quick ask...", quickAskKey.Name)
+					go openQuickAsk()
+				}
+				for i, key := range warmKeys {
+					if warm[i].Update(comboPressed(win32, key.Spec.Keys...)) && !pending {
+						log.Printf("🎯 %s detected! Showing warm answer %s...", key.Spec.Name, key.Prompt)
+						go showWarmAnswer(key.Prompt)
+					}
+				}
+			}
+		}
+	})
+
+	return nil
+}
+
+// testKeyboardState manually checks if the hotkey is currently pressed (for debugging)
+func testKeyboardState() {
+	if !win32.Supported() {
+		return
+	}
+
+	log.Printf("🔍 Manual key state check:")
+	activeHotkey, _, _ := currentHotkeys()
+	names := strings.Split(activeHotkey.Name, "+")
+	states := make([]string, len(activeHotkey.Keys))
+	for i, vk := range activeHotkey.Keys {
+		name := fmt.Sprintf("0x%02X", vk)
+		if i < len(names) {
+			name = strings.TrimSpace(names[i])
+		}
+		pressed := win32.IsKeyDown(vk)
+		log.Printf("  %s key: %t", name, pressed)
+		states[i] = fmt.Sprintf("%s:%t", name, pressed)
+	}
+
+	if comboPressed(win32, activeHotkey.Keys...) {
+		log.Printf("🎯 Manual detection: %s is currently pressed!", activeHotkey.Name)
+		showNotification("Debug", activeHotkey.Name+" detected manually!")
+	} else {
+		log.Printf("ℹ️ %s not currently pressed", activeHotkey.Name)
+		showNotification("Debug", strings.Join(states, " "))
+	}
+}
+
+// hotkeyEdgeDetector reports the rising edge of a polled key combination
+type hotkeyEdgeDetector struct {
+	last bool
+}
+
+// Update records the current state and returns true only when the combination has just become pressed
+func (d *hotkeyEdgeDetector) Update(pressed bool) bool {
+	fired := pressed && !d.last
+	d.last = pressed
+	return fired
+}
+
+// leaderAction binds the key pressed after the leader to an action
+type leaderAction struct {
+	Spec   hotkeySpec
+	Action string
+}
+
+// leaderSequence waits for the second key of a leader sequence such as Ctrl+Q then S
+type leaderSequence struct {
+	key     hotkeySpec // Empty when the clipboard AI hotkey is the leader
+	timeout time.Duration
+	actions []leaderAction
+	hint    string // Shown when the leader is pressed, e.g. "S: summarize, T: translate"
+
+	edges    []hotkeyEdgeDetector
+	cancel   hotkeyEdgeDetector
+	fallback string    // Runs when no second key arrives in time; empty runs nothing
+	deadline time.Time // Zero while no sequence is pending
+}
+
+// configuredLeader builds the leader sequence from cfg, or returns nil when no leader is configured
+func configuredLeader(cfg *AppConfig) *leaderSequence {
+	l := cfg.Leader
+	if l == nil || len(l.Actions) == 0 {
+		return nil
+	}
+
+	seq := &leaderSequence{timeout: durationOrDefault(l.Timeout, defaultLeaderTimeout)}
+	if l.Key != "" {
+		if spec, err := parseHotkey(l.Key); err == nil {
+			seq.key = spec
+		}
+	}
+
+	keys := make([]string, 0, len(l.Actions))
+	for key := range l.Actions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var hints []string
+	for _, key := range keys {
+		spec, err := parseKeyCombo(key)
+		if err != nil {
+			continue
+		}
+		action := l.Actions[key]
+		seq.actions = append(seq.actions, leaderAction{Spec: spec, Action: action})
+
+		label := action
+		if kind, arg, ok := strings.Cut(action, ":"); ok {
+			label = arg
+			if kind == "prompt" && len(arg) > 30 {
+				label = truncateText(arg, 30) + "…"
+			}
+		}
+		hints = append(hints, spec.Name+": "+label)
+	}
+	seq.edges = make([]hotkeyEdgeDetector, len(seq.actions))
+	seq.hint = strings.Join(hints, ", ")
+	return seq
+}
+
+// Pending reports whether the leader was pressed and the second key is still awaited
+func (s *leaderSequence) Pending() bool {
+	return !s.deadline.IsZero()
+}
+
+// Start begins waiting for the second key; keys already held, like the leader's own, count only once released and pressed again
+func (s *leaderSequence) Start(api win32API, now time.Time, fallback string) {
+	for i, a := range s.actions {
+		s.edges[i].Update(comboPressed(api, a.Spec.Keys...))
+	}
+	s.cancel.Update(api.IsKeyDown(0x1B))
+	s.fallback = fallback
+	s.deadline = now.Add(s.timeout)
+}
+
+// Poll returns the chosen action once the sequence ends by a bound key, Esc or the timeout;
+// when several bindings fire together, such as S and Ctrl+S, the one with more keys wins
+func (s *leaderSequence) Poll(api win32API, now time.Time) (action string, done bool) {
+	best := -1
+	for i, a := range s.actions {
+		if s.edges[i].Update(comboPressed(api, a.Spec.Keys...)) && (best < 0 || len(a.Spec.Keys) > len(s.actions[best].Spec.Keys)) {
+			best = i
+		}
+	}
+	cancelled := s.cancel.Update(api.IsKeyDown(0x1B))
+
+	switch {
+	case best >= 0:
+		action = s.actions[best].Action
+	case cancelled:
+		// Esc ends the sequence without running anything, unless it is bound itself
+	case now.Before(s.deadline):
+		return "", false
+	default:
+		action = s.fallback
+	}
+	s.deadline = time.Time{}
+	return action, true
+}
+
+// runLeaderAction runs an action chosen with a leader sequence
+func runLeaderAction(action string) {
+	if action == "" {
+		log.Printf("ℹ️ Leader sequence ended without an action")
+		return
+	}
+	log.Printf("🎯 Leader action %s", action)
+
+	kind, arg, _ := strings.Cut(action, ":")
+	switch kind {
+	case "clipboard":
+		showNotification("Khoj AI", "Processing clipboard...")
+		bus.Publish(topicClipboard, "requested", ClipboardEvent{Source: "leader"})
+	case "follow_up":
+		bus.Publish(topicClipboard, "follow_up", ClipboardEvent{Source: "leader"})
+	case "quick_ask":
+		go openQuickAsk()
+	case "warm":
+		go showWarmAnswer(arg)
+	case "prompt":
+		bus.Publish(topicClipboard, "requested", ClipboardEvent{Source: "leader", Prompt: arg})
+	case "template":
+		// Templates are picked by number, the same way the dialog does it
+		for i, t := range clipboardTemplates() {
+			if t.Name == arg {
+				bus.Publish(topicClipboard, "requested", ClipboardEvent{Source: "leader", Prompt: strconv.Itoa(i + 1)})
+				return
+			}
+		}
+		log.Printf("❌ Leader action template %q not found", arg)
+		showNotification("Khoj AI Error", fmt.Sprintf("Template %q not found", arg))
+	}
+}
+
+// comboPressed reports whether every key in vks is currently held
+func comboPressed(api win32API, vks ...uint16) bool {
+	for _, vk := range vks {
+		if !api.IsKeyDown(vk) {
+			return false
+		}
+	}
+	return len(vks) > 0
+}
+
+// stopKeyboardMonitoring stops the keyboard monitoring (placeholder for cleanup)
+func stopKeyboardMonitoring() {
+	// The polling worker exits when the run group is stopped
+	log.Printf("Keyboard monitoring stopped")
+}
+
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat is the schema a json_schema answer must match
+type JSONSchemaFormat struct {
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+type ChatCompletionRequest struct {
+	Model       string          `json:"model"`
+	Messages    []Message       `json:"messages"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	Tools       []Tool          `json:"tools,omitempty"`
+	ToolChoice  json.RawMessage `json:"tool_choice,omitempty"` // "none", "auto", "required" or {"type": "function", ...}
+	Stop        json.RawMessage `json:"stop,omitempty"`        // A string or an array of up to maxStopSequences strings
+	N           int             `json:"n,omitempty"`           // Choices to return, up to maxChoices
+	Purpose     string          `json:"purpose,omitempty"`
+
+	// Forwarded to Khoj for chat models that support seeded sampling; see systemFingerprint
+	Seed *int64 `json:"seed,omitempty"`
+
+	// With include_usage, a stream ends with a chunk carrying the usage and no choices
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	// Token logprobs, synthesized since Khoj doesn't report them; top_logprobs may be up to maxTopLogprobs
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
+	// Extension: MCP resources attached as context files
+	MCPResources []MCPResourceRef `json:"mcp_resources,omitempty"`
+
+	// OpenAI JSON mode: {"type": "json_object"} or {"type": "json_schema", ...}
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	// Extension: "code" or "first_code" returns only the code blocks of the answer
+	Output string `json:"khoj_output,omitempty"`
+
+	// Extension: "content" streams Khoj's research steps and thoughts as reasoning_content deltas, "off" drops them
+	Reasoning string `json:"khoj_reasoning,omitempty"`
+
+	// OpenAI end-user identifier; selects the client's own conversation in per_client mode
+	User string `json:"user,omitempty"`
+
+	// MCP tools the wrapper runs itself, offered alongside Tools when tool_execution is enabled
+	ServerTools []Tool `json:"-"`
+
+	// Set by the /research slash command
+	Research bool `json:"-"`
+
+	// Set by the /one-liner, /short and /detailed slash commands
+	Verbosity string `json:"-"`
+}
+
+var iconData = []byte{0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x20, 0x20, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0xa8, 0x10, 0x00, 0x00, 0x16, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0x01, 0x00, 0x00, 0x62, 0x01, 0x00, 0x00, 0x94, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x94, 0x01, 0x00, 0x00, 0x66, 0x01, 0x00, 0x00, 0x0d, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x65, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xfb, 0x01, 0x00, 0x00, 0x6c, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x98, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x5a, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5a, 0x01, 0x00, 0x00, 0x90, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x9f, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x59, 0x01, 0x00, 0x00, 0x92, 0x01, 0x00, 0x00, 0x16, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x98, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x2f, 0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x60, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x0b, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x59, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x8a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xda, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0xd9, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x92, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0xef, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xef, 0x01, 0x00, 0x00, 0xca, 0x01, 0x00, 0x00, 0x36, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x15, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x16, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x23, 0x01, 0x00, 0x00, 0x23, 0x01, 0x00, 0x00, 0x12, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xa3, 0x01, 0x00, 0x00, 0x23, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x2c, 0x01, 0x00, 0x00, 0x8a, 0x01, 0x00, 0x00, 0xcc, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0xe7, 0x01, 0x00, 0x00, 0xcf, 0x01, 0x00, 0x00, 0x90, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0xe4, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0x61, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x5b, 0x01, 0x00, 0x00, 0xdf, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf5, 0x01, 0x00, 0x00, 0xdc, 0x01, 0x00, 0x00, 0xdb, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xe4, 0x01, 0x00, 0x00, 0x64, 0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0xe4, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0x83, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x51, 0x01, 0x00, 0x00, 0xed, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0x9d, 0x01, 0x00, 0x00, 0x3b, 0x01, 0x00, 0x00, 0x17, 0x01, 0x00, 0x00, 0x18, 0x01, 0x00, 0x00, 0x3a, 0x01, 0x00, 0x00, 0x98, 0x01, 0x00, 0x00, 0xf5, 0x01, 0x00, 0x00, 0xf2, 0x01, 0x00, 0x00, 0x5c, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0xe3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xb5, 0x01, 0x00, 0x00, 0x3d, 0x01, 0x00, 0x00, 0x34, 0x01, 0x00, 0x00, 0x34, 0x01, 0x00, 0x00, 0x42, 0x01, 0x00, 0x00, 0xcf, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xab, 0x01, 0x00, 0x00, 0x3b, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x07, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x72, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0xd7, 0x01, 0x00, 0x00, 0x22, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x3a, 0x01, 0x00, 0x00, 0xe3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf5, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xfe, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0xd9, 0x01, 0x00, 0x00, 0x20, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0xab, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x6e, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x2a, 0x01, 0x00, 0x00, 0xb7, 0x01, 0x00, 0x00, 0x69, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x20, 0x01, 0x00, 0x00, 0xbb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xd9, 0x01, 0x00, 0x00, 0xbe, 0x01, 0x00, 0x00, 0xc0, 0x01, 0x00, 0x00, 0xc1, 0x01, 0x00, 0x00, 0xeb, 0x01, 0x00, 0x00, 0xfe, 0x01, 0x00, 0x00, 0xd0, 0x01, 0x00, 0x00, 0xbf, 0x01, 0x00, 0x00, 0xc0, 0x01, 0x00, 0x00, 0xc1, 0x01, 0x00, 0x00, 0xaa, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa8, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x53, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0xba, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0x2c, 0x01, 0x00, 0x00, 0x06, 0x01, 0x00, 0x00, 0x0f, 0x01, 0x00, 0x00, 0xb9, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0x44, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x37, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0xbe, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0xba, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xbe, 0x01, 0x00, 0x00, 0x25, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0xb0, 0x01, 0x00, 0x00, 0xfc, 0x01, 0x00, 0x00, 0x47, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x42, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0x4c, 0x01, 0x00, 0x00, 0x4a, 0x01, 0x00, 0x00, 0x75, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0xd0, 0x01, 0x00, 0x00, 0x51, 0x01, 0x00, 0x00, 0x4b, 0x01, 0x00, 0x00, 0x4e, 0x01, 0x00, 0x00, 0xb1, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0xba, 0x01, 0x00, 0x00, 0xf8, 0x01, 0x00, 0x00, 0x5f, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x89, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x80, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x1d, 0x01, 0x00, 0x00, 0xde, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xfd, 0x01, 0x00, 0x00, 0xfb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xfe, 0x01, 0x00, 0x00, 0xfc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xee, 0x01, 0x00, 0x00, 0x46, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x24, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x0a, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x42, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xdc, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x13, 0x01, 0x00, 0x00, 0x92, 0x01, 0x00, 0x00, 0xa9, 0x01, 0x00, 0x00, 0xa4, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xb3, 0x01, 0x00, 0x00, 0xa7, 0x01, 0x00, 0x00, 0xa8, 0x01, 0x00, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xcc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xae, 0x01, 0x00, 0x00, 0x1a, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x9f, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xc2, 0x01, 0x00, 0x00, 0x36, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x37, 0x01, 0x00, 0x00, 0xc3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa1, 0x01, 0x00, 0x00, 0x0a, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x2f, 0x01, 0x00, 0x00, 0xcc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xad, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x20, 0x01, 0x00, 0x00, 0xbc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0x9e, 0x01, 0x00, 0x00, 0x6e, 0x01, 0x00, 0x00, 0x6e, 0x01, 0x00, 0x00, 0x9e, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xbd, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0xcb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xad, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x1d, 0x01, 0x00, 0x00, 0x93, 0x01, 0x00, 0x00, 0xeb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xeb, 0x01, 0x00, 0x00, 0x94, 0x01, 0x00, 0x00, 0x1d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xef, 0x01, 0x00, 0x00, 0xae, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x30, 0x01, 0x00, 0x00, 0x6c, 0x01, 0x00, 0x00, 0x8e, 0x01, 0x00, 0x00, 0x8e, 0x01, 0x00, 0x00, 0x6c, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x45, 0x01, 0x00, 0x00, 0x1b, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf0, 0x00, 0x00, 0x0f, 0xf0, 0x00, 0x00, 0x0f, 0xf0, 0x00, 0x00, 0x0f, 0xf1, 0xff, 0xff, 0x87, 0xf1, 0x1f, 0xff, 0x87, 0xf1, 0x1f, 0xff, 0x87, 0xf1, 0x1f, 0xff, 0x87, 0xf0, 0x00, 0x00, 0x07, 0xf0, 0x00, 0x00, 0x0f, 0xf0, 0x00, 0x00, 0x0f, 0xf8, 0x00, 0x00, 0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf9, 0xf8, 0x1f, 0xff, 0xf8, 0xe0, 0x07, 0xff, 0xf0, 0xc0, 0x03, 0xff, 0xe0, 0xc0, 0x03, 0xff, 0xc0, 0x00, 0x41, 0x9f, 0x80, 0x00, 0x61, 0x0f, 0x80, 0x00, 0x71, 0x07, 0xc0, 0x00, 0x70, 0x03, 0xe0, 0x0e, 0x00, 0x01, 0xf0, 0x8e, 0x00, 0x01, 0xf8, 0x86, 0x00, 0x01, 0xff, 0x81, 0x80, 0x83, 0xff, 0xc0, 0x03, 0x07, 0xff, 0xe0, 0x07, 0x0f, 0xff, 0xf0, 0x0f, 0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// runGroup owns the app's background workers so Quit can cancel them and wait for them to finish
+type runGroup struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// workers is the run group for tray handlers, the hotkey poller, notifications and clipboard requests
+var workers = newRunGroup(context.Background())
+
+func newRunGroup(parent context.Context) *runGroup {
+	ctx, cancel := context.WithCancel(parent)
+	return &runGroup{ctx: ctx, cancel: cancel, running: make(map[string]int)}
+}
+
+// Context returns the group's context, cancelled when the group stops
+func (g *runGroup) Context() context.Context {
+	return g.ctx
+}
+
+// Go runs fn as a named worker; errors and panics are logged rather than tearing down the app.
+// Workers started after Stop are dropped.
+func (g *runGroup) Go(name string, fn func(ctx context.Context) error) {
+	g.mu.Lock()
+	if g.ctx.Err() != nil {
+		g.mu.Unlock()
+		log.Printf("ℹ️ Not starting worker %s: shutting down", name)
+		return
+	}
+	g.running[name]++
+	g.wg.Add(1)
+	g.mu.Unlock()
+
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("💥 Worker %s panicked: %v", name, r)
+			}
+			g.mu.Lock()
+			if g.running[name]--; g.running[name] == 0 {
+				delete(g.running, name)
+			}
+			g.mu.Unlock()
+		}()
+
+		if err := fn(g.ctx); err != nil && g.ctx.Err() == nil {
+			log.Printf("⚠️ Worker %s exited: %v", name, err)
+		}
+	}()
+}
+
+// Running lists the workers that have not returned yet, with counts for repeated names
+func (g *runGroup) Running() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	names := make([]string, 0, len(g.running))
+	for name, count := range g.running {
+		if count > 1 {
+			name = fmt.Sprintf("%s×%d", name, count)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stop cancels every worker and waits up to timeout, returning the ones that leaked
+func (g *runGroup) Stop(timeout time.Duration) []string {
+	g.mu.Lock()
+	g.cancel()
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		leaked := g.Running()
+		log.Printf("⚠️ %d worker(s) still running after %v: %s", len(leaked), timeout, strings.Join(leaked, ", "))
+		return leaked
+	}
+}
+
+// Event is a message published on the internal bus between subsystems
+type Event struct {
+	Topic   string      `json:"topic"`
+	Kind    string      `json:"kind"`
+	Time    time.Time   `json:"time"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// Event topics; kinds are listed alongside each
+const (
+	topicServer       = "server"       // started, stopped, error
+	topicConversation = "conversation" // created, changed, agent_changed, instructions_changed, fallback, repaired, synced
+	topicClipboard    = "clipboard"    // requested, follow_up, processing, inserted, stopped, blocked, declined, failed, queued, delivered
+	topicNotification = "notification" // requested
+	topicMCP          = "mcp"          // status (payload MCPServerStatus)
+	topicConfig       = "config"       // changed (templates or hotkeys updated through the API)
+	topicConnection   = "connection"   // checked (payload ConnectionEvent)
+	topicPrivacy      = "privacy"      // changed, wiped (payload PrivacyEvent)
+	topicUpload       = "upload"       // progress, failed, done (payload UploadEvent)
+	topicProgress     = "progress"     // started, preview, done (payload ProgressEvent)
+	topicActivity     = "activity"     // started, finished (payload ActivityEvent)
+	topicLocalModel   = "local_model"  // answering, stopped (payload LocalModelEvent)
+)
+
+// ServerEvent is the payload for server events
+type ServerEvent struct {
+	Port  string `json:"port,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ConversationEvent is the payload for conversation events
+type ConversationEvent struct {
+	ConversationID string `json:"conversation_id"`
+	AgentSlug      string `json:"agent_slug"`
+	FallbackFrom   string `json:"fallback_from,omitempty"` // The agent that failed, for fallback events
+	RepairedFrom   string `json:"repaired_from,omitempty"` // The conversation Khoj lost, for repaired events
+}
+
+// ClipboardEvent is the payload for clipboard events
+type ClipboardEvent struct {
+	Source   string `json:"source,omitempty"` // hotkey, leader, menu or follow_up
+	Prompt   string `json:"prompt,omitempty"` // Dialog input chosen up front, such as a template number; skips the dialog
+	Chars    int    `json:"chars,omitempty"`
+	Matches  int    `json:"matches,omitempty"`
+	Language string `json:"language,omitempty"` // Detected language code of the clipboard text
+	Error    string `json:"error,omitempty"`
+}
+
+// ConfigEvent is the payload for config events, with the hotkeys now in effect
+type ConfigEvent struct {
+	Hotkey         string `json:"hotkey"`
+	QuickAskHotkey string `json:"quick_ask_hotkey"`
+	FollowUpHotkey string `json:"follow_up_hotkey"`
+	Templates      int    `json:"templates"`
+}
+
+// ConnectionEvent is the payload for connection events, the result of re-validating the Khoj connection
+type ConnectionEvent struct {
+	State  string `json:"state"`  // connected, unreachable or unauthorized
+	Reason string `json:"reason"` // startup or network_change
+	Error  string `json:"error,omitempty"`
+}
+
+// LocalModelEvent is the payload for local model events, sent when the local model starts or stops answering
+type LocalModelEvent struct {
+	Model  string `json:"model"`
+	Reason string `json:"reason,omitempty"` // unreachable or privacy, for answering events
+}
+
+// PrivacyEvent is the payload for privacy events
+type PrivacyEvent struct {
+	Enabled bool `json:"enabled"`
+	Wiped   int  `json:"wiped,omitempty"` // Files deleted by a wipe
+}
+
+// UploadEvent is the payload for upload events, the state of a file indexed in parts
+type UploadEvent struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Bytes   int    `json:"bytes"`
+	Parts   int    `json:"parts"`
+	Done    int    `json:"done"` // Parts indexed so far
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"` // Why the upload is paused
+}
+
+// ProgressEvent is the payload for progress events, one response being generated and delivered
+type ProgressEvent struct {
+	ID      int64  `json:"id"`
+	Source  string `json:"source"`            // Clipboard AI, Quick Ask or Chat
+	Chars   int    `json:"chars"`             // Answer delivered so far
+	Preview string `json:"preview,omitempty"` // The end of the answer so far; empty in privacy mode
+	Error   string `json:"error,omitempty"`   // Why the response failed, on done
+}
+
+// ActivityEvent is the payload for activity events, published as each Khoj request starts and finishes
+type ActivityEvent struct {
+	Active int `json:"active"` // Requests running or queued
+	Today  int `json:"today"`  // Requests started since midnight, or since the app started
+}
+
+// NotificationEvent is the payload for notification events
+type NotificationEvent struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// eventSubscriber receives events for a set of topics (all topics when empty)
+type eventSubscriber struct {
+	topics map[string]bool
+	ch     chan Event
+}
+
+// eventBus fans published events out to subscribers without blocking publishers
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   map[int]*eventSubscriber
+	nextID int
+}
+
+// bus carries server, conversation, clipboard, notification and MCP events
+var bus = newEventBus()
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]*eventSubscriber)}
+}
+
+// Subscribe returns a channel of events for the given topics and a function that unsubscribes
+func (b *eventBus) Subscribe(topics ...string) (<-chan Event, func()) {
+	sub := &eventSubscriber{topics: make(map[string]bool), ch: make(chan Event, eventBufferSize)}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+	}
+
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = sub
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// Publish delivers an event to every matching subscriber; a subscriber with a full buffer misses it
+func (b *eventBus) Publish(topic, kind string, payload interface{}) {
+	ev := Event{Topic: topic, Kind: kind, Time: time.Now(), Payload: payload}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs {
+		if len(sub.topics) > 0 && !sub.topics[topic] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Printf("⚠️ Event bus: dropped %s/%s for a slow subscriber", topic, kind)
+		}
+	}
+}
+
+// currentConversationEvent snapshots the conversation state for an event payload
+func currentConversationEvent() ConversationEvent {
+	return ConversationEvent{ConversationID: conversationID, AgentSlug: currentAgentSlug}
+}
+
+type serverControl struct {
+	srv      *http.Server
+	provider *KhojProvider
+	stopCh   chan struct{}
+	running  bool
+}
+
+var globalServer *serverControl
+
+func getAPIKeyStatus() string {
+	apiKey := os.Getenv("KHOJ_API_KEY")
+	if apiKey == "" || apiKey == "dummy" {
+		return "🔑 API Key: Not Set"
+	}
+	return "🔑 API Key: ✅ Set"
+}
+
+// showPrivacyBadge shows privacy mode on the tray: the badged icon, a title where the platform shows one, and the menu check
+func showPrivacyBadge(item *systray.MenuItem, enabled bool) {
+	if enabled {
+		systray.SetIcon(privacyIconData)
+		systray.SetTitle(trayIdleTitle())
+		item.Check()
+		return
+	}
+	systray.SetIcon(iconData)
+	systray.SetTitle(trayIdleTitle())
+	item.Uncheck()
+}
+
+// trayStatusLine is the live status shown in the tray between responses, e.g. "Khoj • 2 active • 145 today • conv a1b2"
+func trayStatusLine(activity ActivityEvent, convID string) string {
+	parts := []string{"Khoj", fmt.Sprintf("%d active", activity.Active), fmt.Sprintf("%d today", activity.Today)}
+	if len(convID) > 4 {
+		convID = convID[len(convID)-4:]
+	}
+	if convID != "" {
+		parts = append(parts, "conv "+convID)
+	}
+	return strings.Join(parts, " • ")
+}
+
+// trayIdleTitle is the tray title between responses, badged in privacy mode
+func trayIdleTitle() string {
+	title := "Khoj Provider"
+	if !appConfig().TrayStatus.Disabled {
+		title = trayStatusLine(khojActivity.Snapshot(), conversationID)
+	}
+	if privacyMode.Load() {
+		title += " 🕶️"
+	}
+	if reason, _ := localModelAnswering(); reason != "" {
+		title += " 🏠"
+	}
+	return title
+}
+
+// trayIdleTooltip is the tray tooltip between responses and notifications
+func trayIdleTooltip() string {
+	if appConfig().TrayStatus.Disabled {
+		return "Khoj OpenAI Wrapper Server"
+	}
+	return truncateText(trayStatusLine(khojActivity.Snapshot(), conversationID), maxTrayTooltipBytes)
+}
+
+// getConnectionStatusTitle formats the last Khoj connection check for the tray menu
+func getConnectionStatusTitle(ev ConnectionEvent) string {
+	switch ev.State {
+	case connectionConnected:
+		return "🟢 Khoj: Connected"
+	case connectionUnauthorized:
+		return "🟡 Khoj: API key rejected"
+	default:
+		return "🔴 Khoj: Unreachable"
+	}
+}
+
+// getLocalModelTitle formats the local model standing in for Khoj for the tray menu
+func getLocalModelTitle(ev LocalModelEvent) string {
+	if ev.Reason == localReasonPrivacy {
+		return "🏠 Local Model: " + ev.Model + " (privacy mode)"
+	}
+	return "🏠 Local Model: " + ev.Model + " (Khoj unreachable)"
+}
+
+// getUploadStatusTitle formats the progress of a file indexed in parts for the tray menu
+func getUploadStatusTitle(ev UploadEvent) string {
+	if ev.Error != "" {
+		return fmt.Sprintf("⚠️ Paused: %s (%d/%d parts)", ev.Name, ev.Done, ev.Parts)
+	}
+	return fmt.Sprintf("📦 Indexing %s (%d/%d parts)", ev.Name, ev.Done, ev.Parts)
+}
+
+// progressSeq numbers the responses reported to the tray
+var progressSeq atomic.Int64
+
+// progressReporter publishes the progress of one response for the tray preview; a nil reporter does nothing
+type progressReporter struct {
+	ev   ProgressEvent
+	text string // The end of the answer so far, enough for the longest preview
+	last time.Time
+}
+
+// startProgress announces a response that is waiting for Khoj, unless the tray preview is disabled
+func startProgress(source string) *progressReporter {
+	if appConfig().TrayPreview.Disabled {
+		return nil
+	}
+	p := &progressReporter{ev: ProgressEvent{ID: progressSeq.Add(1), Source: source}}
+	bus.Publish(topicProgress, "started", p.ev)
+	return p
+}
+
+// startRequestProgress starts the tray preview for an API request; background requests are not shown
+func startRequestProgress(ctx context.Context, source string) *progressReporter {
+	if requestClassFrom(ctx) == classBackground {
+		return nil
+	}
+	return startProgress(source)
+}
+
+// Update reports the answer delivered so far, at most every trayPreviewInterval
+func (p *progressReporter) Update(answer string) {
+	if p == nil {
+		return
+	}
+	p.ev.Chars = len(answer)
+	p.text = answer
+	if cut := len(answer) - 4*maxTrayPreviewChars; cut > 0 {
+		for cut < len(answer) && !utf8.RuneStart(answer[cut]) {
+			cut++
+		}
+		p.text = answer[cut:]
+	}
+	if time.Since(p.last) >= trayPreviewInterval {
+		p.publish("preview")
+	}
+}
+
+// Done ends the response with the final preview, or the error that stopped it
+func (p *progressReporter) Done(err error) {
+	if p == nil {
+		return
+	}
+	if err != nil {
+		p.ev.Error = err.Error()
+	}
+	p.publish("done")
+}
+
+func (p *progressReporter) publish(kind string) {
+	p.last = time.Now()
+	p.ev.Preview = ""
+	if !privacyMode.Load() {
+		p.ev.Preview = p.text
+	}
+	bus.Publish(topicProgress, kind, p.ev)
+}
+
+// trayProgress tracks the responses in flight for the tray tooltip and title
+type trayProgress struct {
+	active     map[int64]*trayProgressEntry
+	finished   *trayProgressEntry // The last response that ended, shown for trayPreviewLinger
+	finishedAt time.Time
+}
+
+type trayProgressEntry struct {
+	ev      ProgressEvent
+	started time.Time
+}
+
+func newTrayProgress() *trayProgress {
+	return &trayProgress{active: make(map[int64]*trayProgressEntry)}
+}
+
+// Update applies a progress event received at the given time
+func (t *trayProgress) Update(kind string, ev ProgressEvent, at time.Time) {
+	switch kind {
+	case "started":
+		t.active[ev.ID] = &trayProgressEntry{ev: ev, started: at}
+	case "preview":
+		if entry, ok := t.active[ev.ID]; ok {
+			entry.ev = ev
+		}
+	case "done":
+		if entry, ok := t.active[ev.ID]; ok {
+			delete(t.active, ev.ID)
+			entry.ev = ev
+			t.finished, t.finishedAt = entry, at
+		}
+	}
+}
+
+// Render formats the newest response for the tooltip and title; ok is false once nothing is left to show
+func (t *trayProgress) Render(now time.Time, chars int) (tooltip, title string, ok bool) {
+	var newest *trayProgressEntry
+	for _, entry := range t.active {
+		if newest == nil || entry.ev.ID > newest.ev.ID {
+			newest = entry
+		}
+	}
+
+	switch {
+	case newest != nil:
+		source := newest.ev.Source
+		if len(t.active) > 1 {
+			source += fmt.Sprintf(" (+%d more)", len(t.active)-1)
+		}
+		elapsed := int(now.Sub(newest.started).Seconds())
+		if newest.ev.Chars == 0 {
+			tooltip = fmt.Sprintf("⏳ %s: waiting for Khoj… %ds", source, elapsed)
+			title = fmt.Sprintf("Khoj ⏳ %ds", elapsed)
+		} else {
+			tooltip = fitPreview("✍️ "+source+": ", newest.ev, chars)
+			title = "Khoj ✍️ " + progressPreview(newest.ev, 20)
+		}
+	case t.finished != nil && now.Sub(t.finishedAt) < trayPreviewLinger:
+		if ev := t.finished.ev; ev.Error != "" {
+			tooltip = fmt.Sprintf("⚠️ %s: %s", ev.Source, ev.Error)
+			title = "Khoj ⚠️"
+		} else {
+			tooltip = fitPreview("✅ "+ev.Source+": ", ev, chars)
+			title = "Khoj ✅"
+		}
+	default:
+		return "", "", false
+	}
+	return truncateText(tooltip, maxTrayTooltipBytes), title, true
+}
+
+// fitPreview appends the answer preview to label, shortening it until the tooltip fits
+func fitPreview(label string, ev ProgressEvent, chars int) string {
+	tooltip := label + progressPreview(ev, chars)
+	for n := chars - 10; n > 0 && len(tooltip) > maxTrayTooltipBytes; n -= 10 {
+		tooltip = label + progressPreview(ev, n)
+	}
+	return tooltip
+}
+
+// progressPreview shows the last n characters of the answer on one line, or its size when the text is withheld
+func progressPreview(ev ProgressEvent, n int) string {
+	if ev.Preview == "" {
+		return fmt.Sprintf("%d characters", ev.Chars)
+	}
+	runes := []rune(strings.Join(strings.Fields(ev.Preview), " "))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return "…" + string(runes[len(runes)-n:])
+}
+
+// getMCPStatusTitle formats an MCP server's health for the tray menu
+func getMCPStatusTitle(status MCPServerStatus) string {
+	switch status.State {
+	case "running":
+		return fmt.Sprintf("🟢 %s (%d tools)", status.Name, status.Tools)
+	case "starting":
+		return fmt.Sprintf("🟡 %s: starting", status.Name)
+	case "restarting":
+		return fmt.Sprintf("🟡 %s: restarting (crash %d)", status.Name, status.Crashes)
+	case "failed":
+		return fmt.Sprintf("🔴 %s: failed", status.Name)
+	default:
+		return fmt.Sprintf("⚪ %s: stopped", status.Name)
+	}
+}
+
+// startTrayProgress shows responses being generated in the tray tooltip and title, and the live status in between
+func startTrayProgress() {
+	events, unsubscribe := bus.Subscribe(topicProgress, topicActivity, topicConversation)
+	workers.Go("tray-progress", func(ctx context.Context) error {
+		defer unsubscribe()
+		progress := newTrayProgress()
+		ticker := time.NewTicker(time.Second) // Counts up the elapsed time while waiting for Khoj
+		defer ticker.Stop()
+		showing := false
+		var idleTitle, idleTooltip string // Last live status set, so notifications are only replaced when it changes
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ev := <-events:
+				if payload, ok := ev.Payload.(ProgressEvent); ok {
+					progress.Update(ev.Kind, payload, ev.Time)
+				}
+			case <-ticker.C:
+			}
+
+			tooltip, title, ok := progress.Render(time.Now(), appConfig().trayPreviewChars())
+			// Set on every tick so notifications restoring the tooltip do not hide the preview
+			switch {
+			case ok:
+				systray.SetTooltip(tooltip)
+				systray.SetTitle(title)
+				showing = true
+			default:
+				title, tooltip := trayIdleTitle(), trayIdleTooltip()
+				if showing || title != idleTitle || tooltip != idleTooltip {
+					systray.SetTooltip(tooltip)
+					systray.SetTitle(title)
+					idleTitle, idleTooltip = title, tooltip
+				}
+				showing = false
+			}
+		}
+	})
+}
+
+func onReady() {
+	systray.SetIcon(iconData)
+	systray.SetTitle(trayIdleTitle())
+	systray.SetTooltip(trayIdleTooltip())
+
+	// Display notifications and run clipboard requests published by other subsystems
+	startNotificationSubscriber()
+	startClipboardSubscriber()
+
+	// Set up keyboard monitoring for Ctrl+Q (Windows only)
+	if runtime.GOOS == "windows" {
+		if inputSimulationDisabled {
+			log.Printf("⌨️ Keyboard monitoring off: input simulation is disabled")
+		} else if err := setupKeyboardMonitoring(); err != nil {
+			log.Printf("Failed to setup keyboard monitoring: %v", err)
+		}
+
+		// Check notification settings on startup
+		checkNotificationSettings()
+	}
+
+	// Menu items
+	mStart := systray.AddMenuItem("Start Server", "Start the server")
+	mStop := systray.AddMenuItem("Stop Server", "Stop the server")
+	mStatus := systray.AddMenuItem("Status: Stopped", "Server status")
+	systray.AddSeparator()
+
+	// Conversation management
+	mConvID := systray.AddMenuItem("Conv: "+getConversationDisplayID(), "Current conversation ID")
+	mConvID.Disable() // Read-only status
+	mNewConv := systray.AddMenuItem("🆕 New Conversation", "Create a new conversation")
+	mEditConv := systray.AddMenuItem("✏️ Edit Conversation ID", "Change conversation ID")
+	mAgentSlug := systray.AddMenuItem("🤖 Agent: "+currentAgentSlug, "Current agent slug")
+	mAgentSlug.Disable() // Read-only status
+	mEditAgent := systray.AddMenuItem("⚙️ Edit Agent Slug", "Change agent slug")
+	mShareConv := systray.AddMenuItem("🔗 Share Conversation", "Create a share link and copy it to the clipboard")
+	systray.AddSeparator()
+
+	// MCP server health and secret rotation (only when MCP servers are configured)
+	var mMCPSecret *systray.MenuItem
+	serverItems := make(map[string]*systray.MenuItem)
+	if len(appConfig().MCPServers) > 0 && appConfig().featureEnabled(featureMCP) {
+		mMCPServers := systray.AddMenuItem("🔌 MCP Servers", "MCP server health")
+		for _, cfg := range appConfig().MCPServers {
+			item := mMCPServers.AddSubMenuItem(getMCPStatusTitle(MCPServerStatus{Name: cfg.Name, State: "stopped"}), "MCP server status")
+			item.Disable() // Read-only status
+			serverItems[cfg.Name] = item
+		}
+		mMCPSecret = systray.AddMenuItem("🔑 Set MCP Secret", "Store a secret injected into MCP servers")
+		systray.AddSeparator()
+	}
+
+	mAPIKey := systray.AddMenuItem(getAPIKeyStatus(), "API Key status")
+	mAPIKey.Disable() // Read-only status
+	mConnection := systray.AddMenuItem("⚪ Khoj: Checking...", "Result of the last Khoj connection check")
+	mConnection.Disable() // Read-only status, refreshed when the network changes
+	systray.AddSeparator()
+
+	// Clipboard AI feature (Windows only)
+	var mClipboardAI *systray.MenuItem
+	var mFollowUp *systray.MenuItem
+	var mAIClipboard *systray.MenuItem
+	var mTestKeys *systray.MenuItem
+	var mTestNotification *systray.MenuItem
+	if runtime.GOOS == "windows" {
+		mClipboardAI = systray.AddMenuItem("📋 Clipboard AI ("+activeHotkey.Name+")", "Process clipboard with AI and insert at cursor")
+		mFollowUp = systray.AddMenuItem("🔁 Follow Up ("+activeFollowUpHotkey.Name+")", "Ask a follow-up about the last clipboard AI answer")
+		mAIClipboard = systray.AddMenuItem("🗂️ AI Clipboard", "Recent clipboard AI answers and requests queued while Khoj is offline")
+		mTestKeys = systray.AddMenuItem("🔍 Test Keyboard State", "Debug keyboard hook detection")
+		mTestNotification = systray.AddMenuItem("🔔 Test Notification", "Test Windows toast notification")
+		systray.AddSeparator()
+
+		if !appConfig().featureEnabled(featureClipboardAI) {
+			mClipboardAI.Hide()
+			mFollowUp.Hide()
+			mAIClipboard.Hide()
+			mTestKeys.Hide()
+		}
+		if !appConfig().featureEnabled(featureNotifications) {
+			mTestNotification.Hide()
+		}
+
+		// The items stay visible so it's clear the features exist but were turned off
+		if inputSimulationDisabled {
+			mClipboardAI.SetTitle("📋 Clipboard AI (input simulation disabled)")
+			mFollowUp.SetTitle("🔁 Follow Up (input simulation disabled)")
+			mTestKeys.SetTitle("🔍 Test Keyboard State (input simulation disabled)")
+			mClipboardAI.Disable()
+			mFollowUp.Disable()
+			mTestKeys.Disable()
+		}
+	}
+
+	mQuickAsk := systray.AddMenuItem(quickAskMenuTitle(activeQuickAskHotkey.Name), "Ask the current agent a question in a small popup")
+
+	// Warm prompts open their cached answers (only when warm prompts are configured)
+	warmItems := make(map[string]*systray.MenuItem)
+	if len(appConfig().WarmPrompts) > 0 {
+		mWarm := systray.AddMenuItem("⚡ Warm Prompts", "Answers prepared at startup")
+		for _, p := range appConfig().WarmPrompts {
+			title := p.Name
+			if spec, err := parseHotkey(p.Hotkey); p.Hotkey != "" && err == nil {
+				title += " (" + spec.Name + ")"
+			}
+			warmItems[p.Name] = mWarm.AddSubMenuItem(title, "Show the cached answer")
+		}
+	}
+	mDrop := systray.AddMenuItem("📥 Drop Files", "Drag files onto a window to summarize or index them")
+	mUpload := systray.AddMenuItem("📦 Indexing...", "Progress of a large file indexed in parts")
+	mUpload.Hide() // Shown while a large file is being indexed or is paused after a failure
+	mLocalModel := systray.AddMenuItem("🏠 Local Model", "Answers come from the local model instead of Khoj")
+	mLocalModel.Disable()
+	mLocalModel.Hide() // Shown while the local model answers in Khoj's place
+	mDashboard := systray.AddMenuItem("📊 Open Dashboard", "Edit custom instructions in the browser")
+	if !appConfig().featureEnabled(featureFileTools) {
+		mDrop.Hide()
+	}
+	if !appConfig().featureEnabled(featureDashboard) {
+		mDashboard.Hide()
+	}
+	mPrivacy := systray.AddMenuItemCheckbox("🕶️ Privacy Mode", "Keep prompts and responses off the disk and out of the logs", privacyMode.Load())
+	mWipe := systray.AddMenuItem("🧹 Wipe Local Data...", "Securely delete local history, state and caches")
+	mQuit := systray.AddMenuItem("Quit", "Quit the application")
+
+	mStop.Disable()
+	showPrivacyBadge(mPrivacy, privacyMode.Load())
+
+	// Initialize server control
+	globalServer = &serverControl{
+		stopCh:  make(chan struct{}),
+		running: false,
+	}
+
+	// Keep the menu in sync with server, conversation, MCP, config, connection, privacy, upload and local model events
+	trayEvents, unsubscribe := bus.Subscribe(topicServer, topicConversation, topicMCP, topicConfig, topicConnection, topicPrivacy, topicUpload, topicLocalModel)
+	workers.Go("tray-events", func(ctx context.Context) error {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ev := <-trayEvents:
+				switch payload := ev.Payload.(type) {
+				case ServerEvent:
+					if ev.Kind == "started" {
+						mStart.Disable()
+						mStop.Enable()
+						mStatus.SetTitle("Status: Running")
+						systray.SetTooltip("Khoj Server: Running on port " + payload.Port)
+					} else {
+						mStart.Enable()
+						mStop.Disable()
+						mStatus.SetTitle("Status: Stopped")
+						systray.SetTooltip("Khoj Server: Stopped")
+					}
+				case ConversationEvent:
+					mConvID.SetTitle("Conv: " + getConversationDisplayID())
+					if payload.FallbackFrom != "" {
+						mAgentSlug.SetTitle("🔀 Agent: " + payload.AgentSlug + " (fallback for " + payload.FallbackFrom + ")")
+					} else {
+						mAgentSlug.SetTitle("🤖 Agent: " + payload.AgentSlug)
+					}
+				case MCPServerStatus:
+					if item, ok := serverItems[payload.Name]; ok {
+						item.SetTitle(getMCPStatusTitle(payload))
+						item.SetTooltip(payload.LastErr)
+					}
+				case ConfigEvent:
+					if mClipboardAI != nil && !inputSimulationDisabled {
+						mClipboardAI.SetTitle("📋 Clipboard AI (" + payload.Hotkey + ")")
+						mFollowUp.SetTitle("🔁 Follow Up (" + payload.FollowUpHotkey + ")")
+					}
+					mQuickAsk.SetTitle(quickAskMenuTitle(payload.QuickAskHotkey))
+				case ConnectionEvent:
+					mConnection.SetTitle(getConnectionStatusTitle(payload))
+					mConnection.SetTooltip(payload.Error)
+				case PrivacyEvent:
+					showPrivacyBadge(mPrivacy, payload.Enabled)
+				case UploadEvent:
+					if ev.Kind == "done" {
+						mUpload.Hide()
+					} else {
+						mUpload.SetTitle(getUploadStatusTitle(payload))
+						mUpload.SetTooltip(payload.Error)
+						mUpload.Show()
+					}
+				case LocalModelEvent:
+					if ev.Kind == "answering" {
+						mLocalModel.SetTitle(getLocalModelTitle(payload))
+						mLocalModel.Show()
+					} else {
+						mLocalModel.Hide()
+					}
+					systray.SetTitle(trayIdleTitle())
+				}
+			}
+		}
+	})
+	startTrayProgress()
+	startNetworkWatch()
+
+	// Handle menu clicks
+	workers.Go("tray-menu", func(ctx context.Context) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+
+			case <-mStart.ClickedCh:
+				if !globalServer.running {
+					mStart.Disable() // Re-enabled by the server event if startup fails
+					workers.Go("server", runServer)
+				}
+
+			case <-mStop.ClickedCh:
+				if globalServer.running {
+					stopServer()
+				}
+
+			case <-mNewConv.ClickedCh:
+				if err := createNewConversationFromMenu(); err != nil {
+					log.Printf("Failed to create new conversation: %v", err)
+				}
+
+			case <-mEditConv.ClickedCh:
+				if err := editConversationIDDialog(); err != nil {
+					log.Printf("Failed to edit conversation ID: %v", err)
+				}
+
+			case <-mEditAgent.ClickedCh:
+				if err := editAgentSlugDialog(); err != nil {
+					log.Printf("Failed to edit agent slug: %v", err)
+				}
+
+			case <-mShareConv.ClickedCh:
+				if err := shareConversationFromMenu(); err != nil {
+					log.Printf("Failed to share conversation: %v", err)
+				}
+
+			case <-mQuickAsk.ClickedCh:
+				go openQuickAsk()
+
+			case <-mDrop.ClickedCh:
+				if err := openBrowser("http://localhost:" + serverPort() + "/drop"); err != nil {
+					log.Printf("Failed to open drop window: %v", err)
+				}
+
+			case <-mUpload.ClickedCh:
+				if err := openBrowser("http://localhost:" + serverPort() + "/dashboard#uploads"); err != nil {
+					log.Printf("Failed to open dashboard: %v", err)
+				}
+
+			case <-mDashboard.ClickedCh:
+				if err := openBrowser("http://localhost:" + serverPort() + "/dashboard"); err != nil {
+					log.Printf("Failed to open dashboard: %v", err)
+				}
+
+			case <-mPrivacy.ClickedCh:
+				setPrivacyMode(!mPrivacy.Checked())
+
+			case <-mWipe.ClickedCh:
+				// The dashboard lists the files and asks for confirmation before wiping
+				if err := openBrowser("http://localhost:" + serverPort() + "/dashboard#privacy"); err != nil {
+					log.Printf("Failed to open dashboard: %v", err)
+				}
+
+			case <-mQuit.ClickedCh:
+				if globalServer.running {
+					stopServer()
+				}
+				systray.Quit()
+				return nil
+			}
+		}
+	})
+
+	// Handle clipboard AI menu clicks in a separate worker (Windows only)
+	if mClipboardAI != nil {
+		workers.Go("tray-clipboard-ai", func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-mClipboardAI.ClickedCh:
+					log.Printf("📋 Clipboard AI menu clicked")
+					bus.Publish(topicClipboard, "requested", ClipboardEvent{Source: "menu"})
+				case <-mFollowUp.ClickedCh:
+					log.Printf("🔁 Follow-up menu clicked")
+					bus.Publish(topicClipboard, "follow_up", ClipboardEvent{Source: "menu"})
+				case <-mAIClipboard.ClickedCh:
+					showAIClipboard()
+				}
+			}
+		})
+	}
+
+	// Handle warm prompt menu clicks, one worker per prompt
+	for name, item := range warmItems {
+		workers.Go("tray-warm-"+name, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-item.ClickedCh:
+					go showWarmAnswer(name)
+				}
+			}
+		})
+	}
+
+	// Handle MCP secret menu clicks
+	if mMCPSecret != nil {
+		workers.Go("tray-mcp-secret", func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-mMCPSecret.ClickedCh:
+					if err := setMCPSecretDialog(); err != nil {
+						log.Printf("Failed to set MCP secret: %v", err)
+					}
+				}
+			}
+		})
+	}
+
+	// Handle test keyboard state menu clicks (Windows only)
+	if mTestKeys != nil {
+		workers.Go("tray-test-keys", func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-mTestKeys.ClickedCh:
+					log.Printf("🔍 Test keyboard state menu clicked")
+					testKeyboardState()
+				}
+			}
+		})
+	}
+
+	// Handle test notification menu clicks (Windows only)
+	if mTestNotification != nil {
+		workers.Go("tray-test-notification", func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-mTestNotification.ClickedCh:
+					log.Printf("🔔 Test notification menu clicked")
+					checkNotificationSettings()
+					showNotification("Test Notification", "This is a test notification to verify Windows toast notifications are working.")
+				}
+			}
+		})
+	}
+
+	// Auto-start server
+	mStart.Disable()
+	workers.Go("server", runServer)
+}
+
+// startNotificationSubscriber displays notifications published on the bus
+func startNotificationSubscriber() {
+	events, unsubscribe := bus.Subscribe(topicNotification)
+	workers.Go("notifications", func(ctx context.Context) error {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ev := <-events:
+				if n, ok := ev.Payload.(NotificationEvent); ok {
+					displayNotification(n.Title, n.Message)
+				}
+			}
+		}
+	})
+}
+
+// startClipboardSubscriber runs the clipboard AI flow for each clipboard request on the bus
+// quickAskMenuTitle names the quick ask menu item with its hotkey, which doesn't work while input simulation is disabled
+func quickAskMenuTitle(hotkey string) string {
+	if inputSimulationDisabled {
+		return "💬 Quick Ask"
+	}
+	return "💬 Quick Ask (" + hotkey + ")"
+}
+
+func startClipboardSubscriber() {
+	events, unsubscribe := bus.Subscribe(topicClipboard)
+	workers.Go("clipboard-requests", func(ctx context.Context) error {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ev := <-events:
+				if (ev.Kind == "requested" || ev.Kind == "follow_up") && !appConfig().featureEnabled(featureClipboardAI) {
+					log.Printf("📋 Ignoring clipboard request: the clipboard_ai feature is off")
+					continue
+				}
+				switch ev.Kind {
+				case "requested":
+					payload, _ := ev.Payload.(ClipboardEvent)
+					workers.Go("clipboard-ai-prompt", func(context.Context) error {
+						processClipboardWithAI(payload.Prompt)
+						return nil
+					})
+				case "follow_up":
+					workers.Go("clipboard-ai-follow-up", func(context.Context) error {
+						processFollowUp()
+						return nil
+					})
+				}
+			}
+		}
+	})
+}
+
+// loadProviderSettings reads the Khoj API settings from environment variables
+func loadProviderSettings() (apiBase, apiKey string, timeout time.Duration) {
+	apiBase = os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	apiKey = os.Getenv("KHOJ_API_KEY")
+	if apiKey == "" {
+		log.Printf("KHOJ_API_KEY not set, using default")
+		apiKey = "dummy"
+	}
+
+	timeout = durationOrDefault(appConfig().Timeout, defaultTimeout)
+
+	timeoutStr := os.Getenv("KHOJ_TIMEOUT")
+	if timeoutStr != "" {
+		if parsedTimeout, err := time.ParseDuration(timeoutStr); err == nil {
+			timeout = parsedTimeout
+		} else {
+			log.Printf("⚠️ Invalid KHOJ_TIMEOUT %q (%v), using %v", timeoutStr, err, timeout)
+		}
+	}
+
+	return apiBase, apiKey, timeout
+}
+
+// ensureConversation creates and saves a new conversation if one is requested or missing
+func ensureConversation(apiBase, apiKey string) error {
+	if !newConversation && conversationID != "" {
+		return nil
+	}
+
+	log.Printf("Creating new conversation...")
+	newConvID, err := createNewConversation(apiBase, apiKey)
+	if err != nil {
+		return fmt.Errorf("failed to create new conversation: %w", err)
+	}
+
+	conversationID = newConvID
+	newConversation = false
+
+	// Save the new conversation ID to file
+	state := &ConversationState{
+		LastConversationID: conversationID,
+		AgentSlug:          currentAgentSlug,
+		CreatedAt:          time.Now(),
+	}
+	if err := saveConversationState(state); err != nil {
+		log.Printf("Warning: Failed to save conversation state: %v", err)
+	}
+
+	log.Printf("✅ New conversation created: %s", conversationID)
+	bus.Publish(topicConversation, "created", currentConversationEvent())
+	return nil
+}
+
+// runServer adapts startServer to a run-group worker; stopServer ends it by shutting down the listener
+func runServer(ctx context.Context) error {
+	startServer()
+	return nil
+}
+
+// serverPort returns the HTTP port from PORT, defaulting to 3002
+func serverPort() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return port
+	}
+	return "3002"
+}
+
+func startServer() {
+	apiBase, apiKey, timeout := loadProviderSettings()
+
+	port := serverPort()
+
+	// log.Printf("Starting Khoj provider with API Base: %s", apiBase)
+	// log.Printf("API Key: %s...", apiKey[:min(len(apiKey), 8)])
+
+	log.Printf("Using timeout: %v", timeout)
+	provider := NewKhojProviderWithTimeout(apiBase, apiKey, timeout)
+	globalServer.provider = provider
+	if appConfig().featureEnabled(featureMCP) {
+		provider.MCPManager.StartAll(appConfig().MCPServers)
+	} else if len(appConfig().MCPServers) > 0 {
+		log.Printf("🔌 Not starting %d MCP server(s): the mcp feature is off", len(appConfig().MCPServers))
+	}
+
+	// Handle conversation creation if needed
+	if err := ensureConversation(apiBase, apiKey); err != nil {
+		log.Printf("Failed to create new conversation: %v", err)
+		globalServer.running = false
+		bus.Publish(topicServer, "error", ServerEvent{Port: port, Error: err.Error()})
+		return
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(serverStatus())
+	})
+
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r.Context(), "Starting request - User-Agent: %s", r.Header.Get("User-Agent"))
+		logRequest(r.Context(), "Request headers: %+v", r.Header)
+
+		enableCORS(w)
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logRequest(r.Context(), "Error reading request body: %v", err)
+			http.Error(w, "Error reading request", http.StatusBadRequest)
+			return
+		}
+
+		// Check if this is an applyToFile request FIRST
+		var rawRequest map[string]interface{}
+		if err := json.Unmarshal(body, &rawRequest); err != nil {
+			logRequest(r.Context(), "Error parsing JSON: %v", err)
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		// If not applyToFile, parse as normal ChatCompletionRequest
+		var req ChatCompletionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			logRequest(r.Context(), "Error decoding ChatCompletionRequest: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if !validOutputMode(req.Output) {
+			http.Error(w, fmt.Sprintf("Invalid khoj_output %q (expected full, code or first_code)", req.Output), http.StatusBadRequest)
+			return
+		}
+		if req.Reasoning != "" && req.Reasoning != reasoningContent && req.Reasoning != reasoningOff {
+			http.Error(w, fmt.Sprintf("Invalid khoj_reasoning %q (expected content or off)", req.Reasoning), http.StatusBadRequest)
+			return
+		}
+		if err := req.responseFormatError(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.imageError(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.fileError(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := stopSequences(req.Stop); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.choicesError(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.logprobsError(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.samplingError(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.ServerTools = provider.serverTools()
+		if _, _, err := req.toolChoice(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Run slash commands in the newest user message before anything is sent to Khoj
+		cmds, err := req.applySlashCommands()
+		if err != nil {
+			logRequest(r.Context(), "Error running slash commands: %v", err)
+			http.Error(w, fmt.Sprintf("Slash command failed: %v", err), http.StatusBadGateway)
+			return
+		}
+		if cmds.Any() && req.lastUserMessageEmpty() {
+			// Nothing left to ask - acknowledge the commands without a Khoj round trip
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(commandOnlyResponse(&req, cmds))
+			return
+		}
+
+		r, err = provider.routeChatRequest(r, &req, cmds.NewConversation)
+		if err != nil {
+			http.Error(w, "Failed to create conversation", http.StatusBadGateway)
+			return
+		}
+
+		// Handle streaming vs non-streaming for normal requests
+		if req.Stream {
+			provider.handleStreamingRequest(w, r, &req)
+			return
+		}
+
+		// Non-streaming response
+		progress := startRequestProgress(r.Context(), "Chat")
+		var resp *ChatCompletionResponse
+		if req.N > 1 {
+			resp, err = provider.completeChoices(r.Context(), &req)
+		} else {
+			resp, err = provider.HandleChatCompletion(r.Context(), &req)
+		}
+		if err != nil {
+			logRequest(r.Context(), "Error handling chat completion: %v", err)
+			progress.Done(err)
+			var jsonErr *jsonAnswerError
+			var denied *teamDeniedError
+			switch {
+			case errors.As(err, &jsonErr):
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(openAIError(err))
+				return
+			case errors.As(err, &denied):
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(openAIError(err))
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		progress.Update(resp.Choices[0].Message.Content)
+		progress.Done(nil)
+		appendScratchpad(scratchpadOriginFrom(r.Context()), req.lastUserMessage(), resp.Choices[0].Message.Content)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	mux.HandleFunc("/v1/completions", provider.handleCompletions)
+	mux.HandleFunc("/v1/models", provider.handleModels)
+	mux.HandleFunc("/v1/embeddings", provider.handleEmbeddings)
+	mux.HandleFunc("/v1/moderations", provider.handleModerations)
+	mux.HandleFunc("/v1/audio/speech", provider.handleSpeech)
+	mux.HandleFunc("/v1/images/generations", provider.handleImageGenerations)
+	mux.HandleFunc("/v1/models/", provider.handleModels)
+	if appConfig().featureEnabled(featureFileTools) {
+		// Uploads go into the Khoj knowledge base, as the drop window's do
+		mux.HandleFunc("/v1/files", provider.handleFiles)
+		mux.HandleFunc("/v1/files/", provider.handleFiles)
+		mux.HandleFunc("/v1/edits/stream", provider.handleEditStream)
+		mux.HandleFunc("/v1/edits/lines", provider.handleEditLines)
+	}
+	mux.HandleFunc("/launcher/ask", loopbackOnly(provider.handleLauncherAsk))
+	mux.HandleFunc("/warm/api/answer", loopbackOnly(provider.handleWarmAnswer))
+	if appConfig().featureEnabled(featureDashboard) {
+		mux.HandleFunc("/dashboard/api/digest", loopbackOnly(provider.handleDashboardDigest))
+		mux.HandleFunc("/dashboard/api/replay", loopbackOnly(provider.handleDashboardReplay))
+	}
+	registerDashboard(mux)
+	startClientMappingGC(apiBase, apiKey)
+	startWarmPrompts(provider)
+	startDigest(provider)
+
+	globalServer.srv = &http.Server{
+		Addr:    ":" + port,
+		Handler: traceRequests(logAccess(trackUpstream(mux))),
+	}
+
+	globalServer.running = true
+	// log.Printf("Khoj provider server starting on :%s", port)
+	bus.Publish(topicServer, "started", ServerEvent{Port: port})
+
+	if err := globalServer.srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("Server error: %v", err)
+		globalServer.running = false
+		bus.Publish(topicServer, "error", ServerEvent{Port: port, Error: err.Error()})
+	}
+}
+
+func stopServer() {
+	if globalServer.srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		globalServer.srv.Shutdown(ctx)
+		globalServer.running = false
+		if globalServer.provider != nil {
+			globalServer.provider.MCPManager.StopAll()
+		}
+		bus.Publish(topicServer, "stopped", ServerEvent{})
+		// log.Printf("Server stopped")
+	}
+}
+
+// runHeadlessServer serves the HTTP API without the system tray until interrupted
+func runHeadlessServer() {
+	globalServer = &serverControl{stopCh: make(chan struct{})}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	workers.Go("server", runServer)
+
+	<-interrupt
+	log.Printf("Interrupted, shutting down")
+	if globalServer.running {
+		stopServer()
+	}
+	workers.Stop(workerShutdownTimeout)
+}
+
+func onExit() {
+	// Clean up keyboard monitoring
+	if runtime.GOOS == "windows" {
+		stopKeyboardMonitoring()
+	}
+
+	if globalServer.running {
+		stopServer()
+	}
+	clipboardSession.End("quit")
+
+	if leaked := workers.Stop(workerShutdownTimeout); len(leaked) == 0 {
+		log.Printf("✅ All background workers stopped")
+	}
+}
+
+// Generate contextual diff showing only changed sections with context
+func generateContextualDiff(originalLines, modifiedLines []string, filename string) string {
+	var diff strings.Builder
+	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
+	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+
+	// Find changed sections
+	changes := findChangedSections(originalLines, modifiedLines)
+
+	if len(changes) == 0 {
+		// No changes found
+		diff.WriteString("@@ -0,0 +0,0 @@\n")
+		return diff.String()
+	}
+
+	// Generate hunks for each changed section
+	for _, change := range changes {
+		contextLines := 3 // Show 3 lines of context before/after changes
+
+		startOrig := max(0, change.OrigStart-contextLines)
+		endOrig := min(len(originalLines), change.OrigEnd+contextLines)
+		startMod := max(0, change.ModStart-contextLines)
+		endMod := min(len(modifiedLines), change.ModEnd+contextLines)
+
+		diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
+			startOrig+1, endOrig-startOrig,
+			startMod+1, endMod-startMod))
+
+		// Show context before changes
+		for i := startOrig; i < change.OrigStart && i < len(originalLines); i++ {
+			diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
+		}
+
+		// Show removed lines
+		for i := change.OrigStart; i < change.OrigEnd && i < len(originalLines); i++ {
+			diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+		}
+
+		// Show added lines
+		for i := change.ModStart; i < change.ModEnd && i < len(modifiedLines); i++ {
+			diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+		}
+
+		// Show context after changes
+		for i := change.OrigEnd; i < endOrig && i < len(originalLines); i++ {
+			diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
+		}
+	}
+
+	return diff.String()
+}
+
+// diffOp is a single line in an edit script: ' ' unchanged, '-' removed, '+' added
+type diffOp struct {
+	Kind byte
+	Text string
+}
+
+// DiffHunk is a unified diff hunk; line numbers are 1-based like the @@ header
+type DiffHunk struct {
+	OldStart int      `json:"old_start"`
+	OldLines int      `json:"old_lines"`
+	NewStart int      `json:"new_start"`
+	NewLines int      `json:"new_lines"`
+	Lines    []string `json:"lines"`
+}
+
+// Header returns the @@ line for the hunk
+func (h DiffHunk) Header() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.OldStart, h.OldLines, h.NewStart, h.NewLines)
+}
+
+// Patch renders the hunk in unified diff format
+func (h DiffHunk) Patch() string {
+	var patch strings.Builder
+	patch.WriteString(h.Header() + "\n")
+	for _, line := range h.Lines {
+		patch.WriteString(line + "\n")
+	}
+	return patch.String()
+}
+
+// maxDiffEdits bounds the Myers search; beyond it the middle is treated as a full replacement
+const maxDiffEdits = 4000
+
+// diffLines computes a minimal line edit script using Myers' algorithm
+func diffLines(a, b []string) []diffOp {
+	// Trim common prefix and suffix to keep the search small
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	replaceAll := func() []diffOp {
+		ops := make([]diffOp, 0, n+m)
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+	if n == 0 || m == 0 {
+		return replaceAll()
+	}
+
+	maxD := n + m
+	if maxD > maxDiffEdits {
+		maxD = maxDiffEdits
+	}
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Insertion
+			} else {
+				x = v[offset+k-1] + 1 // Deletion
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return replaceAll()
+	}
+
+	// Walk the trace backwards to recover the edit script
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		vd := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && vd[offset+k-1] < vd[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := vd[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+				y--
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+				x--
+			}
+		}
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// groupHunks groups an edit script into hunks with the given number of context lines.
+// oldBase and newBase offset the 0-based line positions of the script.
+func groupHunks(ops []diffOp, contextLines, oldBase, newBase int) []DiffHunk {
+	var hunks []DiffHunk
+	oldPos, newPos := oldBase, newBase
+
+	i := 0
+	for i < len(ops) {
+		if ops[i].Kind == ' ' {
+			oldPos++
+			newPos++
+			i++
+			continue
+		}
+
+		// Start a hunk with leading context
+		lead := 0
+		for lead < contextLines && i-lead-1 >= 0 && ops[i-lead-1].Kind == ' ' {
+			lead++
+		}
+		hunk := DiffHunk{OldStart: oldPos - lead + 1, NewStart: newPos - lead + 1}
+		for _, op := range ops[i-lead : i] {
+			hunk.Lines = append(hunk.Lines, " "+op.Text)
+		}
+		hunk.OldLines, hunk.NewLines = lead, lead
+
+		// Extend until a run of unchanged lines longer than twice the context
+		for i < len(ops) {
+			if ops[i].Kind == ' ' {
+				run := 0
+				for i+run < len(ops) && ops[i+run].Kind == ' ' {
+					run++
+				}
+				if i+run >= len(ops) || run > 2*contextLines {
+					tail := min(run, contextLines)
+					for _, op := range ops[i : i+tail] {
+						hunk.Lines = append(hunk.Lines, " "+op.Text)
+					}
+					hunk.OldLines += tail
+					hunk.NewLines += tail
+					oldPos += tail
+					newPos += tail
+					i += tail
+					break
+				}
+				for _, op := range ops[i : i+run] {
+					hunk.Lines = append(hunk.Lines, " "+op.Text)
+				}
+				hunk.OldLines += run
+				hunk.NewLines += run
+				oldPos += run
+				newPos += run
+				i += run
+				continue
+			}
+
+			hunk.Lines = append(hunk.Lines, string(ops[i].Kind)+ops[i].Text)
+			if ops[i].Kind == '-' {
+				hunk.OldLines++
+				oldPos++
+			} else {
+				hunk.NewLines++
+				newPos++
+			}
+			i++
+		}
+
+		// Empty ranges start at the preceding line, matching diff -u
+		if hunk.OldLines == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStart--
+		}
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
+
+// hunkStreamSlack is how far past the received text the original is searched for partial feeds
+const hunkStreamSlack = 200
+
+// hunkStreamer emits diff hunks as soon as a partial modified file makes them final.
+// Emitted hunks anchor later diffs so earlier output never changes.
+type hunkStreamer struct {
+	original  []string
+	origStart int // Lines before these anchors are already emitted
+	modStart  int
+	emit      func(DiffHunk) error
+	contextN  int
+	count     int
+}
+
+func newHunkStreamer(original string, emit func(DiffHunk) error) *hunkStreamer {
+	return &hunkStreamer{original: strings.Split(original, "\n"), emit: emit, contextN: 3}
+}
+
+// Feed diffs the modified lines received so far; when final is false only hunks followed
+// by enough confirmed unchanged lines are emitted
+func (hs *hunkStreamer) Feed(modified []string, final bool) error {
+	if hs.modStart > len(modified) {
+		return nil
+	}
+	// Partial input only needs the nearby original lines; deletions beyond the window stay pending
+	original := hs.original[hs.origStart:]
+	if !final {
+		window := len(modified) - hs.modStart + hunkStreamSlack
+		if window < len(original) {
+			original = original[:window]
+		}
+	}
+	ops := diffLines(original, modified[hs.modStart:])
+	hunks := groupHunks(ops, hs.contextN, hs.origStart, hs.modStart)
+
+	for _, hunk := range hunks {
+		newEnd := hunk.NewStart - 1 + hunk.NewLines
+		if hunk.NewLines == 0 {
+			newEnd = hunk.NewStart
+		}
+		if !final && newEnd+hs.contextN >= len(modified) {
+			break // The rest of the stream may still change this hunk
+		}
+		if err := hs.emit(hunk); err != nil {
+			return err
+		}
+		hs.count++
+
+		hs.origStart = hunk.OldStart - 1 + hunk.OldLines
+		if hunk.OldLines == 0 {
+			hs.origStart = hunk.OldStart
+		}
+		hs.modStart = newEnd
+	}
+	return nil
+}
+
+// Structure to represent a changed section
+type ChangeSection struct {
+	OrigStart, OrigEnd int
+	ModStart, ModEnd   int
+}
+
+// Find sections that have changed between original and modified - HANDLES MID-FILE CHANGES
+func findChangedSections(originalLines, modifiedLines []string) []ChangeSection {
+	var changes []ChangeSection
+
+	// Find the first line that differs
+	i := 0
+	minLen := min(len(originalLines), len(modifiedLines))
+
+	// Scan through both files to find first difference
+	for i < minLen {
+		if originalLines[i] != modifiedLines[i] {
+			// Found start of change at line i
+			changeStart := i
+
+			// Now find the end of this change block
+			origEnd := i
+			modEnd := i
+
+			// Simple approach: assume a small block of changes (max 10 lines)
+			maxChangeLines := 10
+			linesProcessed := 0
+
+			// Advance through the changed section
+			for linesProcessed < maxChangeLines {
+				// Check if we've reached end of either file
+				if origEnd >= len(originalLines) || modEnd >= len(modifiedLines) {
+					break
+				}
+
+				// If lines match again, we might be at the end of the change
+				if origEnd < len(originalLines) && modEnd < len(modifiedLines) &&
+					originalLines[origEnd] == modifiedLines[modEnd] {
+					// Check if next few lines also match (stable end)
+					matchCount := 0
+					for k := 0; k < 3 && origEnd+k < len(originalLines) && modEnd+k < len(modifiedLines); k++ {
+						if originalLines[origEnd+k] == modifiedLines[modEnd+k] {
+							matchCount++
+						} else {
+							break
+						}
+					}
+					if matchCount >= 2 {
+						// Found stable end of change
+						break
+					}
+				}
+
+				origEnd++
+				modEnd++
+				linesProcessed++
+			}
+
+			changes = append(changes, ChangeSection{
+				OrigStart: changeStart,
+				OrigEnd:   min(changeStart+3, origEnd),
+				ModStart:  changeStart,
+				ModEnd:    min(changeStart+3, modEnd),
+			})
+
+			// Return only first change to keep it minimal
+			return changes
+		}
+		i++
+	}
+
+	// Handle length differences (additions/deletions at end)
+	if len(originalLines) != len(modifiedLines) {
+		if len(originalLines) < len(modifiedLines) {
+			// Lines added at end
+			changes = append(changes, ChangeSection{
+				OrigStart: len(originalLines),
+				OrigEnd:   len(originalLines),
+				ModStart:  len(originalLines),
+				ModEnd:    min(len(originalLines)+3, len(modifiedLines)),
+			})
+		} else {
+			// Lines removed from end
+			changes = append(changes, ChangeSection{
+				OrigStart: len(modifiedLines),
+				OrigEnd:   min(len(modifiedLines)+3, len(originalLines)),
+				ModStart:  len(modifiedLines),
+				ModEnd:    len(modifiedLines),
+			})
+		}
+	}
+
+	return changes
+}
+
+// Helper functions
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Calculate similarity between two sets of lines
+func calculateSimilarity(original, modified []string) float64 {
+	if len(original) == 0 && len(modified) == 0 {
+		return 1.0
+	}
+	if len(original) == 0 || len(modified) == 0 {
+		return 0.0
+	}
+
+	// Simple similarity calculation based on common lines
+	commonLines := 0
+	originalSet := make(map[string]bool)
+	for _, line := range original {
+		originalSet[line] = true
+	}
+
+	for _, line := range modified {
+		if originalSet[line] {
+			commonLines++
+		}
+	}
+
+	maxLines := len(original)
+	if len(modified) > maxLines {
+		maxLines = len(modified)
+	}
+
+	return float64(commonLines) / float64(maxLines)
+}
+
+// Generate unified diff between original and modified content
+func generateUnifiedDiff(original, modified, filename string) string {
+	originalLines := strings.Split(original, "\n")
+	modifiedLines := strings.Split(modified, "\n")
+
+	log.Printf("File diff generation: original_lines=%d, modified_lines=%d", len(originalLines), len(modifiedLines))
+
+	// For large files with small changes, use optimized diff
+	if len(originalLines) > 1000 || len(modifiedLines) > 1000 {
+		log.Printf("Using optimized diff for large file")
+		return generateOptimizedDiff(originalLines, modifiedLines, filename)
+	}
+
+	// For smaller files, use simple line-by-line diff
+	return generateSimpleDiff(originalLines, modifiedLines, filename)
+}
+
+// Generate optimized diff that only shows actual changes - TRULY MINIMAL VERSION
+func generateOptimizedDiff(originalLines, modifiedLines []string, filename string) string {
+	var diff strings.Builder
+	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
+	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+
+	// Find actual changed sections (not individual lines)
+	changes := findChangedSections(originalLines, modifiedLines)
+
+	if len(changes) == 0 {
+		diff.WriteString("@@ -0,0 +0,0 @@\n")
+		return diff.String()
+	}
+
+	// Process only the first change section and limit its size
+	change := changes[0]
+
+	// Limit the change to maximum 10 lines total
+	maxLinesPerSection := 5
+
+	origStart := change.OrigStart
+	origEnd := min(change.OrigEnd, origStart+maxLinesPerSection)
+	modStart := change.ModStart
+	modEnd := min(change.ModEnd, modStart+maxLinesPerSection)
+
+	removedCount := origEnd - origStart
+	addedCount := modEnd - modStart
+
+	diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
+		origStart+1, removedCount,
+		modStart+1, addedCount))
+
+	// Show removed lines (limited)
+	for i := origStart; i < origEnd && i < len(originalLines); i++ {
+		diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+	}
+
+	// Show added lines (limited)
+	for i := modStart; i < modEnd && i < len(modifiedLines); i++ {
+		diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+	}
+
+	return diff.String()
+}
+
+// Find limited changes - only return first few actual differences
+func findLimitedChanges(originalLines, modifiedLines []string, maxChanges int) []ChangeSection {
+	var changes []ChangeSection
+
+	minLen := min(len(originalLines), len(modifiedLines))
+
+	// Find first few different lines
+	for i := 0; i < minLen && len(changes) < maxChanges; i++ {
+		if originalLines[i] != modifiedLines[i] {
+			// Found a difference - create a minimal change section
+			changes = append(changes, ChangeSection{
+				OrigStart: i,
+				OrigEnd:   i + 1, // Just one line
+				ModStart:  i,
+				ModEnd:    i + 1, // Just one line
+			})
+		}
+	}
+
+	// Handle case where one file is longer
+	if len(originalLines) != len(modifiedLines) && len(changes) < maxChanges {
+		if len(originalLines) > len(modifiedLines) {
+			// Original has more lines
+			changes = append(changes, ChangeSection{
+				OrigStart: len(modifiedLines),
+				OrigEnd:   min(len(modifiedLines)+3, len(originalLines)), // Show max 3 extra lines
+				ModStart:  len(modifiedLines),
+				ModEnd:    len(modifiedLines),
+			})
+		} else {
+			// Modified has more lines
+			changes = append(changes, ChangeSection{
+				OrigStart: len(originalLines),
+				OrigEnd:   len(originalLines),
+				ModStart:  len(originalLines),
+				ModEnd:    min(len(originalLines)+3, len(modifiedLines)), // Show max 3 extra lines
+			})
+		}
+	}
+
+	return changes
+}
+
+// Find the first line that differs between two slices
+func findFirstDifference(original, modified []string) int {
+	minLen := min(len(original), len(modified))
+	for i := 0; i < minLen; i++ {
+		if original[i] != modified[i] {
+			return i
+		}
+	}
+
+	// If one file is longer than the other, the first difference is at the end of the shorter one
+	if len(original) != len(modified) {
+		return minLen
+	}
+
+	return -1 // Files are identical
+}
+
+// Find the last line that differs between two slices
+func findLastDifference(original, modified []string) int {
+	origLen := len(original)
+	modLen := len(modified)
+
+	// Start from the end and work backwards
+	i, j := origLen-1, modLen-1
+
+	for i >= 0 && j >= 0 && original[i] == modified[j] {
+		i--
+		j--
+	}
+
+	// Return the last different line in the original file
+	if i >= 0 {
+		return i
+	}
+
+	// If we've exhausted the original but not the modified,
+	// the last difference is at the end of the original
+	return origLen - 1
+}
+
+// Simple diff for smaller files - NO CONTEXT LINES
+func generateSimpleDiff(originalLines, modifiedLines []string, filename string) string {
+	var diff strings.Builder
+	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
+	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+
+	// Count only changed lines
+	changedOrigLines := 0
+	changedModLines := 0
+
+	maxLines := max(len(originalLines), len(modifiedLines))
+	for i := 0; i < maxLines; i++ {
+		origLineExists := i < len(originalLines)
+		modLineExists := i < len(modifiedLines)
+
+		if origLineExists && modLineExists {
+			if originalLines[i] != modifiedLines[i] {
+				changedOrigLines++
+				changedModLines++
+			}
+		} else if origLineExists {
+			changedOrigLines++
+		} else if modLineExists {
+			changedModLines++
+		}
+	}
+
+	diff.WriteString(fmt.Sprintf("@@ -1,%d +1,%d @@\n", changedOrigLines, changedModLines))
+
+	// Show only changed lines, no context
+	for i := 0; i < maxLines; i++ {
+		origLineExists := i < len(originalLines)
+		modLineExists := i < len(modifiedLines)
+
+		if origLineExists && modLineExists {
+			if originalLines[i] != modifiedLines[i] {
+				diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+				diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+			}
+			// Skip identical lines (no context)
+		} else if origLineExists {
+			diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+		} else if modLineExists {
+			diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+		}
+	}
+
+	return diff.String()
+}
+
+// Generate a simple replacement diff (more efficient for large changes)
+func generateSimpleReplacement(original, modified, filename string) string {
+	var diff strings.Builder
+	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
+	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+
+	originalLines := strings.Split(original, "\n")
+	modifiedLines := strings.Split(modified, "\n")
+
+	diff.WriteString(fmt.Sprintf("@@ -1,%d +1,%d @@\n", len(originalLines), len(modifiedLines)))
+
+	// Show only first few lines of removal and addition to keep diff manageable
+	maxShowLines := 10
+
+	// Show some removed lines
+	for i := 0; i < min(len(originalLines), maxShowLines); i++ {
+		diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+	}
+	if len(originalLines) > maxShowLines {
+		diff.WriteString(fmt.Sprintf("-... (%d more lines removed)\n", len(originalLines)-maxShowLines))
+	}
+
+	// Show some added lines
+	for i := 0; i < min(len(modifiedLines), maxShowLines); i++ {
+		diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+	}
+	if len(modifiedLines) > maxShowLines {
+		diff.WriteString(fmt.Sprintf("+... (%d more lines added)\n", len(modifiedLines)-maxShowLines))
+	}
+
+	return diff.String()
+}
+
+// Generate proper unified diff for similar files
+func generateProperUnifiedDiff(originalLines, modifiedLines []string, filename string) string {
+	var diff strings.Builder
+	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
+	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+
+	maxLines := len(originalLines)
+	if len(modifiedLines) > maxLines {
+		maxLines = len(modifiedLines)
+	}
+
+	diff.WriteString(fmt.Sprintf("@@ -1,%d +1,%d @@\n", len(originalLines), len(modifiedLines)))
+
+	for i := 0; i < maxLines; i++ {
+		if i < len(originalLines) && i < len(modifiedLines) {
+			if originalLines[i] != modifiedLines[i] {
+				diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+				diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+			} else {
+				diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
+			}
+		} else if i < len(originalLines) {
+			diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+		} else if i < len(modifiedLines) {
+			diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+		}
+	}
+
+	return diff.String()
+}
+
+// buildMCPEnv builds the session-scoped environment for an MCP server process.
+// Secrets are resolved at launch and only ever live in the child's environment.
+func buildMCPEnv(cfg MCPServerConfig) ([]string, error) {
+	env := os.Environ()
+	for key, value := range cfg.Env {
+		env = append(env, key+"="+value)
+	}
+
+	for _, name := range cfg.SecretEnv {
+		value, err := readSecret(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve secret %s for MCP server %s: %w", name, cfg.Name, err)
+		}
+		env = append(env, name+"="+value)
+	}
+
+	return env, nil
+}
+
+// StartServer launches an MCP server process with its injected environment
+func (m *MCPToolManager) StartServer(cfg MCPServerConfig) error {
+	env, err := buildMCPEnv(cfg)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = env
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe for MCP server %s: %w", cfg.Name, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe for MCP server %s: %w", cfg.Name, err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start MCP server %s: %w", cfg.Name, err)
+	}
+
+	session := &MCPSession{
+		Name:    cfg.Name,
+		Command: cfg.Command,
+		Process: cmd,
+		Config:  cfg,
+		stdin:   stdin,
+		stdout:  stdout,
+		pending: make(map[int64]chan mcpRPCMessage),
+		done:    make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.Sessions[cfg.Name] = session
+	m.setStatusLocked(cfg.Name, "starting", 0, "")
+	m.mu.Unlock()
+
+	startedAt := time.Now()
+	go session.readLoop()
+	go func() {
+		<-session.done // Reads must finish before Wait closes the pipe
+		err := cmd.Wait()
+		m.handleExit(session, startedAt, err)
+	}()
+
+	log.Printf("🔌 MCP server started: %s (pid %d)", cfg.Name, cmd.Process.Pid)
+
+	// Handshake and catalog discovery happen in the background so slow servers don't delay startup
+	go func() {
+		if err := m.initializeSession(session); err != nil {
+			log.Printf("Failed to initialize MCP server %s: %v", cfg.Name, err)
+		}
+	}()
+	return nil
+}
+
+// readLoop dispatches JSON-RPC responses from the server to waiting callers
+func (s *MCPSession) readLoop() {
+	defer close(s.done)
+
+	reader := bufio.NewReader(s.stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg mcpRPCMessage
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				log.Printf("MCP server %s sent invalid JSON: %v", s.Name, jsonErr)
+			} else if msg.Method != "" && msg.ID != nil {
+				s.replyToServerRequest(msg)
+			} else if msg.ID != nil {
+				s.rpcMu.Lock()
+				ch, ok := s.pending[*msg.ID]
+				s.rpcMu.Unlock()
+				if ok {
+					ch <- msg
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// replyToServerRequest answers requests initiated by the server (only ping is supported)
+func (s *MCPSession) replyToServerRequest(msg mcpRPCMessage) {
+	reply := mcpRPCMessage{JSONRPC: "2.0", ID: msg.ID}
+	if msg.Method == "ping" {
+		reply.Result = json.RawMessage("{}")
+	} else {
+		reply.Error = &mcpRPCError{Code: -32601, Message: "method not found"}
+	}
+	if err := s.send(reply); err != nil {
+		log.Printf("Failed to reply to MCP server %s: %v", s.Name, err)
+	}
+}
+
+func (s *MCPSession) send(msg mcpRPCMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal MCP message: %w", err)
+	}
+	data = append(data, '\n')
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.stdin.Write(data); err != nil {
+		return fmt.Errorf("failed to write to MCP server %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// call sends a JSON-RPC request and waits for the matching response
+func (s *MCPSession) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	id := atomic.AddInt64(&s.nextID, 1)
+	ch := make(chan mcpRPCMessage, 1)
+
+	s.rpcMu.Lock()
+	s.pending[id] = ch
+	s.rpcMu.Unlock()
+	defer func() {
+		s.rpcMu.Lock()
+		delete(s.pending, id)
+		s.rpcMu.Unlock()
+	}()
+
+	if err := s.send(mcpRPCMessage{JSONRPC: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return nil, fmt.Errorf("MCP %s failed: %s (code %d)", method, resp.Error.Message, resp.Error.Code)
+		}
+		return resp.Result, nil
+	case <-s.done:
+		return nil, fmt.Errorf("MCP server %s exited", s.Name)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// initializeSession performs the MCP handshake and lists tools, resources, and prompts
+func (m *MCPToolManager) initializeSession(s *MCPSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	initResult, err := s.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": "2024-11-05",
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "khoj-wrapper", "version": version},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.send(mcpRPCMessage{JSONRPC: "2.0", Method: "notifications/initialized"}); err != nil {
+		return err
+	}
+
+	var capabilities struct {
+		Capabilities map[string]json.RawMessage `json:"capabilities"`
+	}
+	json.Unmarshal(initResult, &capabilities)
+
+	var tools []MCPTool
+	if _, ok := capabilities.Capabilities["tools"]; ok {
+		if err := s.listAll(ctx, "tools/list", "tools", func(raw json.RawMessage) error {
+			var page []struct {
+				Name        string                 `json:"name"`
+				Description string                 `json:"description"`
+				InputSchema map[string]interface{} `json:"inputSchema"`
+			}
+			if err := json.Unmarshal(raw, &page); err != nil {
+				return err
+			}
+			for _, t := range page {
+				tools = append(tools, MCPTool{Name: t.Name, Description: t.Description, InputSchema: t.InputSchema})
+			}
+			return nil
+		}); err != nil {
+			log.Printf("Failed to list tools from MCP server %s: %v", s.Name, err)
+		}
+	}
+
+	var resources []MCPResource
+	if _, ok := capabilities.Capabilities["resources"]; ok {
+		if err := s.listAll(ctx, "resources/list", "resources", func(raw json.RawMessage) error {
+			var page []MCPResource
+			if err := json.Unmarshal(raw, &page); err != nil {
+				return err
+			}
+			resources = append(resources, page...)
+			return nil
+		}); err != nil {
+			log.Printf("Failed to list resources from MCP server %s: %v", s.Name, err)
+		}
+	}
+
+	var prompts []MCPPrompt
+	if _, ok := capabilities.Capabilities["prompts"]; ok {
+		if err := s.listAll(ctx, "prompts/list", "prompts", func(raw json.RawMessage) error {
+			var page []MCPPrompt
+			if err := json.Unmarshal(raw, &page); err != nil {
+				return err
+			}
+			prompts = append(prompts, page...)
+			return nil
+		}); err != nil {
+			log.Printf("Failed to list prompts from MCP server %s: %v", s.Name, err)
+		}
+	}
+
+	m.mu.Lock()
+	s.Tools = tools
+	s.Resources = resources
+	s.Prompts = prompts
+	if m.Sessions[s.Name] == s {
+		m.setStatusLocked(s.Name, "running", len(tools), "")
+	}
+	m.mu.Unlock()
+
+	log.Printf("✅ MCP server %s ready: %d tools, %d resources, %d prompts", s.Name, len(tools), len(resources), len(prompts))
+	return nil
+}
+
+// listAll follows nextCursor pagination for an MCP list method
+func (s *MCPSession) listAll(ctx context.Context, method, field string, handle func(json.RawMessage) error) error {
+	cursor := ""
+	for {
+		params := map[string]interface{}{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+
+		result, err := s.call(ctx, method, params)
+		if err != nil {
+			return err
+		}
+
+		var page map[string]json.RawMessage
+		if err := json.Unmarshal(result, &page); err != nil {
+			return fmt.Errorf("failed to parse %s result: %w", method, err)
+		}
+		if items, ok := page[field]; ok {
+			if err := handle(items); err != nil {
+				return fmt.Errorf("failed to parse %s result: %w", method, err)
+			}
+		}
+
+		cursor = ""
+		if next, ok := page["nextCursor"]; ok {
+			json.Unmarshal(next, &cursor)
+		}
+		if cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (m *MCPToolManager) session(name string) (*MCPSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.Sessions[name]
+	if !ok {
+		return nil, fmt.Errorf("MCP server %s is not running", name)
+	}
+	return session, nil
+}
+
+// ReadResource reads the text contents of an MCP resource
+func (m *MCPToolManager) ReadResource(ctx context.Context, server, uri string) (string, string, error) {
+	session, err := m.session(server)
+	if err != nil {
+		return "", "", err
+	}
+
+	result, err := session.call(ctx, "resources/read", map[string]string{"uri": uri})
+	if err != nil {
+		return "", "", err
+	}
+
+	var read struct {
+		Contents []struct {
+			URI      string `json:"uri"`
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+		} `json:"contents"`
+	}
+	if err := json.Unmarshal(result, &read); err != nil {
+		return "", "", fmt.Errorf("failed to parse resource contents: %w", err)
+	}
+
+	var text strings.Builder
+	mimeType := ""
+	for _, content := range read.Contents {
+		if content.Text == "" {
+			continue // Binary blobs are not forwarded to Khoj
+		}
+		if mimeType == "" {
+			mimeType = content.MimeType
+		}
+		text.WriteString(content.Text)
+	}
+	return text.String(), mimeType, nil
+}
+
+// GetPrompt renders an MCP prompt into plain text
+func (m *MCPToolManager) GetPrompt(ctx context.Context, server, name string, args map[string]string) (string, error) {
+	session, err := m.session(server)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := session.call(ctx, "prompts/get", map[string]interface{}{"name": name, "arguments": args})
+	if err != nil {
+		return "", err
+	}
+
+	var prompt struct {
+		Messages []struct {
+			Role    string `json:"role"`
+			Content struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(result, &prompt); err != nil {
+		return "", fmt.Errorf("failed to parse prompt: %w", err)
+	}
+
+	var text strings.Builder
+	for _, msg := range prompt.Messages {
+		if msg.Content.Type != "text" {
+			continue
+		}
+		if text.Len() > 0 {
+			text.WriteString("\n\n")
+		}
+		text.WriteString(msg.Content.Text)
+	}
+	return text.String(), nil
+}
+
+// Tools returns all tools offered by running MCP servers, keyed by server name
+func (m *MCPToolManager) Tools() map[string][]MCPTool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tools := make(map[string][]MCPTool)
+	for name, session := range m.Sessions {
+		if len(session.Tools) > 0 {
+			tools[name] = append([]MCPTool(nil), session.Tools...)
+		}
+	}
+	return tools
+}
+
+// CallTool runs an MCP tool with arguments given as a JSON object and returns its text content. Results the
+// server marks as errors are returned as errors.
+func (m *MCPToolManager) CallTool(ctx context.Context, server, name, arguments string) (string, error) {
+	session, err := m.session(server)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := session.call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": json.RawMessage(arguments)})
+	if err != nil {
+		return "", err
+	}
+
+	var call struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	if err := json.Unmarshal(result, &call); err != nil {
+		return "", fmt.Errorf("failed to parse tool result: %w", err)
+	}
+
+	var text strings.Builder
+	for _, content := range call.Content {
+		if text.Len() > 0 {
+			text.WriteString("\n")
+		}
+		if content.Type == "text" {
+			text.WriteString(content.Text)
+		} else {
+			text.WriteString("[" + content.Type + " content not shown]") // Images and other blobs are not forwarded to Khoj
+		}
+	}
+	if call.IsError {
+		return "", fmt.Errorf("%s", text.String())
+	}
+	return text.String(), nil
+}
+
+// Prompts returns all prompts offered by running MCP servers, keyed by server name
+func (m *MCPToolManager) Prompts() map[string][]MCPPrompt {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prompts := make(map[string][]MCPPrompt)
+	for name, session := range m.Sessions {
+		if len(session.Prompts) > 0 {
+			prompts[name] = append([]MCPPrompt(nil), session.Prompts...)
+		}
+	}
+	return prompts
+}
+
+// newMCPToolManager creates an empty MCP tool manager
+func newMCPToolManager() *MCPToolManager {
+	return &MCPToolManager{
+		Sessions: make(map[string]*MCPSession),
+		Status:   make(map[string]*MCPServerStatus),
+	}
+}
+
+// setStatusLocked records a server's health and publishes it on the bus; m.mu must be held
+func (m *MCPToolManager) setStatusLocked(name, state string, tools int, lastErr string) {
+	status, ok := m.Status[name]
+	if !ok {
+		status = &MCPServerStatus{Name: name}
+		m.Status[name] = status
+	}
+	status.State = state
+	status.Tools = tools
+	if lastErr != "" {
+		status.LastErr = lastErr
+	}
+
+	bus.Publish(topicMCP, "status", *status)
+}
+
+// handleExit invalidates a session's tools when its process exits and schedules a restart if it crashed
+func (m *MCPToolManager) handleExit(s *MCPSession, startedAt time.Time, exitErr error) {
+	m.mu.Lock()
+	if current, ok := m.Sessions[s.Name]; ok && current != s {
+		// A restart already replaced this process; the newer session owns the server's tools and status
+		m.mu.Unlock()
+		return
+	}
+	delete(m.Sessions, s.Name) // Drops its tools, resources, and prompts from the registry
+	intentional := s.stopped || m.closed
+	if intentional {
+		m.setStatusLocked(s.Name, "stopped", 0, "")
+	}
+	m.mu.Unlock()
+
+	if intentional {
+		return
+	}
+
+	reason := "exited"
+	if exitErr != nil {
+		reason = exitErr.Error()
+	}
+	log.Printf("⚠️ MCP server %s crashed: %s", s.Name, reason)
+	m.recordCrash(s.Config, time.Since(startedAt) >= mcpStableRunTime, reason)
+}
+
+// recordCrash counts a crash and restarts the server with exponential backoff
+func (m *MCPToolManager) recordCrash(cfg MCPServerConfig, wasStable bool, reason string) {
+	m.mu.Lock()
+	status, ok := m.Status[cfg.Name]
+	if !ok {
+		status = &MCPServerStatus{Name: cfg.Name}
+		m.Status[cfg.Name] = status
+	}
+	if wasStable {
+		status.Crashes = 0
+	}
+	status.Crashes++
+	crashes := status.Crashes
+
+	if crashes > mcpMaxRestarts {
+		m.setStatusLocked(cfg.Name, "failed", 0, reason)
+		m.mu.Unlock()
+		log.Printf("❌ MCP server %s failed %d times in a row, giving up", cfg.Name, crashes-1)
+		showNotification("Khoj MCP Error", fmt.Sprintf("%s keeps crashing and was disabled: %s", cfg.Name, reason))
+		return
+	}
+	m.setStatusLocked(cfg.Name, "restarting", 0, reason)
+	m.mu.Unlock()
+
+	if crashes == mcpCrashNotifyAfter {
+		showNotification("Khoj MCP", fmt.Sprintf("%s crashed %d times, still restarting", cfg.Name, crashes))
+	}
+
+	backoff := time.Duration(1<<uint(crashes-1)) * time.Second
+	if backoff > mcpMaxRestartBackoff {
+		backoff = mcpMaxRestartBackoff
+	}
+	log.Printf("🔄 Restarting MCP server %s in %v (crash %d)", cfg.Name, backoff, crashes)
+
+	time.AfterFunc(backoff, func() {
+		m.mu.Lock()
+		closed := m.closed
+		_, running := m.Sessions[cfg.Name]
+		m.mu.Unlock()
+		if closed || running {
+			return
+		}
+
+		if err := m.StartServer(cfg); err != nil {
+			log.Printf("Failed to restart MCP server %s: %v", cfg.Name, err)
+			m.recordCrash(cfg, false, err.Error())
+		}
+	})
+}
+
+// StartAll launches every configured MCP server, logging failures
+func (m *MCPToolManager) StartAll(configs []MCPServerConfig) {
+	m.mu.Lock()
+	m.closed = false
+	m.mu.Unlock()
+
+	for _, cfg := range configs {
+		if err := m.StartServer(cfg); err != nil {
+			log.Printf("Failed to start MCP server: %v", err)
+			m.mu.Lock()
+			m.setStatusLocked(cfg.Name, "failed", 0, err.Error())
+			m.mu.Unlock()
+		}
+	}
+}
+
+// StopServer terminates a running MCP server process
+func (m *MCPToolManager) StopServer(name string) {
+	m.mu.Lock()
+	session, ok := m.Sessions[name]
+	delete(m.Sessions, name)
+	if ok {
+		session.stopped = true
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	session.stdin.Close()
+	if session.Process.Process != nil {
+		session.Process.Process.Kill()
+	}
+	log.Printf("MCP server stopped: %s", name)
+}
+
+// StopAll terminates all running MCP server processes
+func (m *MCPToolManager) StopAll() {
+	m.mu.Lock()
+	m.closed = true
+	names := make([]string, 0, len(m.Sessions))
+	for name := range m.Sessions {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+
+	for _, name := range names {
+		m.StopServer(name)
+	}
+}
+
+// RestartServersUsingSecret relaunches MCP servers that reference a rotated secret
+func (m *MCPToolManager) RestartServersUsingSecret(secretName string) {
+	m.mu.Lock()
+	var affected []MCPServerConfig
+	for _, session := range m.Sessions {
+		for _, name := range session.Config.SecretEnv {
+			if name == secretName {
+				affected = append(affected, session.Config)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, cfg := range affected {
+		m.StopServer(cfg.Name)
+		if err := m.StartServer(cfg); err != nil {
+			log.Printf("Failed to restart MCP server %s: %v", cfg.Name, err)
+		}
+	}
+}
+
+func NewKhojProvider(apiBase, apiKey string) *KhojProvider {
+	return &KhojProvider{
+		APIBase: apiBase,
+		APIKey:  apiKey,
+		HTTPClient: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+		MCPManager: newMCPToolManager(),
+		toolSlots:  make(chan struct{}, positiveOrDefault(appConfig().ToolExecution.MaxParallel, defaultToolParallel)),
+	}
+}
+
+// HandleChatCompletion processes ONLY regular chat completion requests
+func (kp *KhojProvider) HandleChatCompletion(ctx context.Context, req *ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	turn, err := kp.prepareChatTurn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return kp.completeChatTurn(ctx, turn)
+}
+
+// maxChoices is the most choices a chat completion may ask for with n
+const maxChoices = 8
+
+// choicesError checks n: streamed answers have one choice, and each extra choice is another Khoj request
+func (req *ChatCompletionRequest) choicesError() error {
+	switch {
+	case req.N < 0:
+		return fmt.Errorf("n must not be negative")
+	case req.N > maxChoices:
+		return fmt.Errorf("n may be at most %d, got %d", maxChoices, req.N)
+	case req.N > 1 && req.Stream:
+		return fmt.Errorf("n greater than 1 is not supported with stream")
+	}
+	return nil
+}
+
+// maxTopLogprobs is the most alternatives per token top_logprobs may ask for, as in OpenAI's API
+const maxTopLogprobs = 20
+
+// logprobsError checks logprobs and top_logprobs
+func (req *ChatCompletionRequest) logprobsError() error {
+	switch {
+	case req.TopLogprobs < 0 || req.TopLogprobs > maxTopLogprobs:
+		return fmt.Errorf("top_logprobs must be between 0 and %d, got %d", maxTopLogprobs, req.TopLogprobs)
+	case req.TopLogprobs > 0 && !req.Logprobs:
+		return fmt.Errorf("top_logprobs requires logprobs to be true")
+	}
+	return nil
+}
+
+// wantsLogprobs reports whether the answer should carry logprobs
+func (req *ChatCompletionRequest) wantsLogprobs() bool {
+	return req.Logprobs && !appConfig().Logprobs.Disabled
+}
+
+// completeChoices answers a chat completion with n > 1 choices. The first is answered in the request's conversation
+// and the others at the same time, each in a conversation of its own with the same agent and instructions. That way
+// no answer sees another and the conversation keeps a single exchange. The extra conversations are deleted afterwards.
+func (kp *KhojProvider) completeChoices(ctx context.Context, req *ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	turn, err := kp.prepareChatTurn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	logRequest(ctx, "🎲 Answering %d choices at once", req.N)
+
+	responses := make([]*ChatCompletionResponse, req.N)
+	errs := make([]error, req.N)
+	var wg sync.WaitGroup
+	for i := range req.N {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == 0 {
+				responses[i], errs[i] = kp.completeChatTurn(ctx, turn)
+			} else {
+				responses[i], errs[i] = kp.completeInOwnConversation(ctx, req, turn.agent)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("choice %d failed: %w", i, err)
+		}
+	}
+
+	resp := responses[0]
+	for i, extra := range responses[1:] {
+		choice := extra.Choices[0]
+		choice.Index = i + 1
+		resp.Choices = append(resp.Choices, choice)
+		resp.Usage.CompletionTokens += extra.Usage.CompletionTokens
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	return resp, nil
+}
+
+// completeInOwnConversation answers req in a new conversation with agent, deleted once the answer is in
+func (kp *KhojProvider) completeInOwnConversation(ctx context.Context, req *ChatCompletionRequest, agent string) (*ChatCompletionResponse, error) {
+	convID, err := createConversationWithAgent(kp.APIBase, kp.APIKey, agent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	defer func() {
+		if err := deleteKhojConversation(kp.APIBase, kp.APIKey, convID); err != nil {
+			logRequest(ctx, "Failed to delete choice conversation %s: %v", convID, err)
+		}
+	}()
+	ctx = withInstructionsFrom(withConversationID(ctx, convID), instructionsConversation(ctx))
+	return kp.HandleChatCompletion(ctx, req)
+}
+
+// chatTurn is a chat completion request turned into a Khoj request, ready to send
+type chatTurn struct {
+	original   *ChatCompletionRequest // As the client sent it, for retrying with the fallback agent
+	req        *ChatCompletionRequest // With the agent's preset applied
+	convID     string
+	khojConvID string // The conversation the request goes to, which may be the agent's fallback
+	agent      string
+	prompt     string
+	khojReq    *KhojRequest
+	sentFiles  []KhojFile // Recorded as sent once Khoj answers
+	budget     *BudgetReport
+}
+
+// prepareChatTurn builds the Khoj request for a chat completion: the prompt from the messages, attached files
+// and MCP resources, routed to the client's conversation or the agent's fallback
+func (kp *KhojProvider) prepareChatTurn(ctx context.Context, req *ChatCompletionRequest) (*chatTurn, error) {
+	logRequest(ctx, "Processing regular chat completion for model: %s", req.Model)
+
+	// Route to the agent's fallback conversation if it failed, and fill in the agent's default parameters
+	convID := conversationFromContext(ctx)
+	khojConvID, agent, fallbackNote := routeConversation(convID)
+	original := req
+	req = withAgentPreset(req, agent)
+
+	// Build prompt from messages (WITHOUT file contents)
+	var prompt strings.Builder
+	var files []KhojFile
+	var images []KhojFile // Deduplicated like files, then sent as Khoj images
+
+	for _, msg := range req.Messages {
+		// Keep oversized tool results within the prompt budget
+		if msg.Role == "tool" {
+			msg.Content = kp.limitToolOutput(ctx, toolNameForCall(req.Messages, msg.ToolCallId), msg.Content)
+		}
+
+		messageContent := msg.Content
+
+		// Files uploaded to /v1/files are attached when they are text, and otherwise found through Khoj's search
+		for _, id := range msg.Files {
+			file, data, err := openAPIFile(id)
+			if err != nil {
+				return nil, err
+			}
+			if !utf8.Valid(data) {
+				messageContent = strings.TrimSpace(fmt.Sprintf("%s [file: %s, indexed in the knowledge base]", messageContent, file.Filename))
+				continue
+			}
+			files = append(files, KhojFile{
+				Name:     file.Filename,
+				Content:  string(data),
+				FileType: fileTypeFromMime(mime.TypeByExtension(filepath.Ext(file.Filename))),
+				Size:     len(data),
+			})
+			logRequest(ctx, "Attached uploaded file %s as %s (%d bytes)", id, file.Filename, len(data))
+			messageContent = strings.TrimSpace(fmt.Sprintf("%s [file: %s]", messageContent, file.Filename))
+		}
+
+		// Images are sent alongside the prompt and labelled where they appeared
+		for _, imageURL := range msg.Images {
+			dataURL, err := fetchImage(ctx, imageURL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read image %d: %w", len(images)+1, err)
+			}
+			name := fmt.Sprintf("image %d", len(images)+1)
+			images = append(images, KhojFile{Name: name, Content: dataURL, FileType: "image", Size: len(dataURL)})
+			messageContent = strings.TrimSpace(messageContent + " [" + name + "]")
+		}
+
+		// Khoj chat takes no audio, so clips are transcribed into the prompt
+		for n, audio := range msg.Audio {
+			transcript, err := kp.transcribeAudio(ctx, audio)
+			if err != nil {
+				return nil, fmt.Errorf("failed to transcribe audio: %w", err)
+			}
+			messageContent = strings.TrimSpace(fmt.Sprintf("%s [audio %d, transcribed: %s]", messageContent, n+1, transcript))
+		}
+
+		switch {
+		case msg.Role == "tool":
+			prompt.WriteString(fmt.Sprintf("tool result for %s (%s): %s\n", toolNameForCall(req.Messages, msg.ToolCallId), msg.ToolCallId, messageContent))
+		case len(msg.ToolCalls) > 0:
+			if messageContent != "" {
+				prompt.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, messageContent))
+			}
+			for _, call := range msg.ToolCalls {
+				prompt.WriteString(fmt.Sprintf("%s: called %s with %s (%s)\n", msg.Role, call.Function.Name, callArguments(call.Function.Arguments), call.ID))
+			}
+		default:
+			prompt.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, messageContent))
+		}
+	}
+
+	// Results of wrapper tool calls made alongside the client's, whose results the client has just sent
+	for _, result := range pendingToolResults.Take(req.Messages) {
+		prompt.WriteString(result.promptLine())
+	}
+
+	// Describe the tools so the agent can ask for them to be called
+	if instructions := req.toolInstructions(); instructions != "" {
+		prompt.WriteString(instructions)
+	}
+
+	// Attach requested MCP resources as context files
+	for _, ref := range req.MCPResources {
+		content, mimeType, err := kp.MCPManager.ReadResource(ctx, ref.Server, ref.URI)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MCP resource %s from %s: %w", ref.URI, ref.Server, err)
+		}
+		files = append(files, KhojFile{
+			Name:     ref.URI,
+			Content:  content,
+			FileType: fileTypeFromMime(mimeType),
+			Size:     len(content),
+		})
+		logRequest(ctx, "Attached MCP resource %s from %s (%d bytes)", ref.URI, ref.Server, len(content))
+	}
+
+	// Leave out attachments the conversation received unchanged in a recent request
+	files, unchanged := sentAttachments.Filter(khojConvID, files)
+	images, unchangedImages := sentAttachments.Filter(khojConvID, images)
+	unchanged = append(unchanged, unchangedImages...)
+	if len(unchanged) > 0 {
+		logRequest(ctx, "♻️ Not re-sending unchanged attachment(s): %s", strings.Join(unchanged, ", "))
+		prompt.WriteString("system: Unchanged since attached earlier in this conversation, so not attached again: " + strings.Join(unchanged, ", ") + "\n")
+	}
+
+	if req.jsonMode() {
+		prompt.WriteString(req.jsonInstruction())
+	} else if preset, ok := verbosityPresets[req.Verbosity]; ok {
+		prompt.WriteString("system: " + preset.Instruction + "\n")
+	}
+	if instruction := temperatureInstruction(req.Temperature); instruction != "" && !agentSamples(agent, samplingTemperature) {
+		prompt.WriteString("system: " + instruction + "\n")
+	}
+
+	finalPrompt := withConversationInstructions(instructionsConversation(ctx), prompt.String())
+
+	// Shrink attached files that would push the request over the agent's token budget
+	files, budgetReport := kp.fitFilesToBudget(ctx, currentAgentSlug, finalPrompt, files)
+	// Recorded with the content that goes out, so a summarized or truncated file is sent in full next time
+	sentFiles := append(append([]KhojFile(nil), files...), images...)
+
+	// Call Khoj API with files separate from prompt
+	khojReq := &KhojRequest{
+		Q:              withResearchMode(req.Research, withFallbackNote(fallbackNote, finalPrompt)),
+		Stream:         false,
+		ConversationID: khojConvID, // The client's own conversation, the global one, or its fallback
+		ClientID:       "khoj-provider-continue",
+		Files:          files, // Send files here, not in prompt
+		Seed:           req.Seed,
+		Temperature:    req.Temperature,
+		TopP:           req.TopP,
+	}
+	for _, image := range images {
+		khojReq.Images = append(khojReq.Images, image.Content)
+	}
+
+	// DEBUG: Log what you send to Khoj
+	logRequest(ctx, "=== DEBUG: Khoj API Request ===")
+	logRequestContent(ctx, "Query (prompt): %s", finalPrompt)
+	logRequest(ctx, "Files count: %d", len(khojReq.Files))
+
+	if len(khojReq.Files) > 0 {
+		for i, file := range khojReq.Files {
+			logRequest(ctx, "File %d: Name=%s, Size=%d bytes, Type=%s", i+1, file.Name, file.Size, file.FileType)
+			if len(file.Content) > 200 {
+				logRequestContent(ctx, "File %d content preview: %s...", i+1, file.Content[:200])
+			}
+		}
+	} else {
+		logRequest(ctx, "No files being sent to Khoj")
+	}
+	if len(khojReq.Images) > 0 {
+		logRequest(ctx, "Images count: %d", len(khojReq.Images))
+	}
+	if req.Seed != nil {
+		logRequest(ctx, "🎲 Seed: %d", *req.Seed)
+	}
+	if req.Temperature != nil {
+		logRequest(ctx, "🌡️ Temperature: %g", *req.Temperature)
+	}
+	if req.TopP != nil {
+		logRequest(ctx, "🌡️ top_p: %g", *req.TopP)
+	}
+
+	return &chatTurn{
+		original:   original,
+		req:        req,
+		convID:     convID,
+		khojConvID: khojConvID,
+		agent:      agent,
+		prompt:     finalPrompt,
+		khojReq:    khojReq,
+		sentFiles:  sentFiles,
+		budget:     budgetReport,
+	}, nil
+}
+
+// completeChatTurn sends a prepared turn to Khoj and post-processes the whole answer
+func (kp *KhojProvider) completeChatTurn(ctx context.Context, turn *chatTurn) (*ChatCompletionResponse, error) {
+	req := turn.req
+	khojResp, err := kp.callKhojAPI(ctx, turn.khojReq)
+	if err != nil {
+		if retryCtx, newID := repairConversation(ctx, kp.APIBase, kp.APIKey, turn.khojConvID, err); newID != "" {
+			return kp.HandleChatCompletion(retryCtx, turn.original)
+		}
+		if ctx.Err() == nil && startAgentFallback(kp.APIBase, kp.APIKey, turn.convID, turn.agent, err) {
+			return kp.HandleChatCompletion(ctx, turn.original)
+		}
+		return nil, fmt.Errorf("khoj API call failed: %w", err)
+	}
+	sentAttachments.Record(turn.khojConvID, turn.sentFiles)
+
+	// DEBUG: Log what you get back from Khoj
+	logRequest(ctx, "=== DEBUG: Khoj API Response ===")
+	logRequest(ctx, "Response length: %d characters", len(khojResp.Response))
+	logRequestContent(ctx, "Response preview: %s", khojResp.Response[:min(300, len(khojResp.Response))])
+	logRequest(ctx, "Using conversation ID: %s", turn.khojConvID)
+
+	// The wrapper's own tools run here; calls to the client's tools go back to it, masked by the output filter
+	khojResp, calls, err := kp.runServerTools(ctx, turn, khojResp)
+	if err != nil {
+		return nil, err
+	}
+	if len(calls) > 0 {
+		if calls, blocked := filterToolCalls(calls); !blocked {
+			logRequest(ctx, "🔧 Agent called %d tool(s): %s", len(calls), toolCallNames(calls))
+			return &ChatCompletionResponse{
+				ID:         fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+				Object:     "chat.completion",
+				Created:    time.Now().Unix(),
+				Model:      req.Model,
+				Choices:    []Choice{{Message: Message{Role: "assistant", ToolCalls: calls}, FinishReason: "tool_calls"}},
+				Usage:      turn.usage(khojResp.Response),
+				KhojBudget: turn.budget,
+				XKhoj:      upstreamStatsFrom(ctx).annotation(turn.agent, turn.khojConvID),
+
+				SystemFingerprint: turn.fingerprint(),
+			}, nil
+		}
+	}
+
+	outputMode := req.Output
+	if req.jsonMode() {
+		outputMode = outputModeJSON
+	}
+	khojResp = limitResponseLength(khojResp, outputMode, maxAnswerChars(req.Verbosity))
+	if req.jsonMode() {
+		if khojResp, err = kp.coerceJSONAnswer(ctx, turn, khojResp); err != nil {
+			return nil, err
+		}
+	}
+	content, matches, blocked := postProcessResponse(khojResp, responseTargetAPI, outputMode)
+	finishReason := "stop"
+	if blocked {
+		logRequest(ctx, "🚫 Output filter blocked response (%d matches)", matches)
+		content = ""
+		finishReason = "content_filter"
+	} else if matches > 0 {
+		logRequest(ctx, "Output filter masked %d matches", matches)
+	}
+	if i := stopIndex(content, req.stopSequences()); i >= 0 && !blocked {
+		content, finishReason = content[:i], "stop"
+	}
+	if cut, over := truncateToTokens(turn.encoding(), content, req.MaxTokens); over && !req.jsonMode() && !blocked {
+		logRequest(ctx, "✂️ Answer cut at max_tokens (%d)", req.MaxTokens)
+		content, finishReason = cut, "length"
+	}
+	var logprobs *ChoiceLogprobs
+	if req.wantsLogprobs() && !req.Stream { // Streams send logprobs with each delta
+		logprobs = synthesizedLogprobs(turn.encoding(), content, req.TopLogprobs)
+	}
+
+	response := &ChatCompletionResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []Choice{
+			{
+				Index: 0,
+				Message: Message{
+					Role:    "assistant",
+					Content: content,
+				},
+				Logprobs:     logprobs,
+				FinishReason: finishReason,
+			},
+		},
+		Usage:      turn.usage(content), // Only what the client receives counts
+		KhojBudget: turn.budget,
+		XKhoj:      upstreamStatsFrom(ctx).annotation(turn.agent, turn.khojConvID),
+
+		SystemFingerprint: turn.fingerprint(),
+	}
+
+	return response, nil
+}
+
+// encoding names the tokenizer for the turn's model
+func (t *chatTurn) encoding() string {
+	return tokenEncodingFor(t.req.Model, t.agent)
+}
+
+// fingerprint is the system_fingerprint of the turn's responses
+func (t *chatTurn) fingerprint() string {
+	return systemFingerprint(t.agent)
+}
+
+// usage counts the prompt sent to Khoj and the answer returned to the client with the tokenizer for the turn's model
+func (t *chatTurn) usage(answer string) Usage {
+	encoding := t.encoding()
+	prompt, completion := countTokens(encoding, t.prompt), countTokens(encoding, answer)
+	return Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+}
+
+// toolChoice reads tool_choice: "none", "auto" (the default), "required", or an object naming the function to call
+func (req *ChatCompletionRequest) toolChoice() (mode, name string, err error) {
+	if len(req.ToolChoice) == 0 || string(req.ToolChoice) == "null" {
+		return "auto", "", nil
+	}
+	if err := json.Unmarshal(req.ToolChoice, &mode); err == nil {
+		switch mode {
+		case "none", "auto", "required":
+			return mode, "", nil
+		}
+		return "", "", fmt.Errorf("invalid tool_choice %q (expected none, auto, required or a function)", mode)
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(req.ToolChoice, &named); err != nil || named.Type != "function" || named.Function.Name == "" {
+		return "", "", fmt.Errorf("invalid tool_choice (expected none, auto, required or {\"type\": \"function\", \"function\": {\"name\": ...}})")
+	}
+	for _, tool := range req.offeredTools() {
+		if tool.Function.Name == named.Function.Name {
+			return "function", named.Function.Name, nil
+		}
+	}
+	return "", "", fmt.Errorf("tool_choice names %q, which is not in tools", named.Function.Name)
+}
+
+// offeredTools lists the client's tools, then the wrapper's
+func (req *ChatCompletionRequest) offeredTools() []Tool {
+	return append(append([]Tool(nil), req.Tools...), req.ServerTools...)
+}
+
+// toolsEnabled reports whether the agent may call the request's tools
+func (req *ChatCompletionRequest) toolsEnabled() bool {
+	mode, _, _ := req.toolChoice()
+	return len(req.offeredTools()) > 0 && mode != "none" && mode != ""
+}
+
+// toolInstructions describes the request's tools to the agent and how to call them, or returns "" without tools.
+// Khoj has no tool calling of its own, so the agent is asked to reply with a tool_calls JSON value instead.
+func (req *ChatCompletionRequest) toolInstructions() string {
+	if !req.toolsEnabled() {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("system: You can call the tools below. Their results are sent back to you as tool results.\n")
+	for _, tool := range req.offeredTools() {
+		b.WriteString("- " + tool.Function.Name)
+		if tool.Function.Description != "" {
+			b.WriteString(": " + tool.Function.Description)
+		}
+		if len(tool.Function.Parameters) > 0 {
+			schema, _ := json.Marshal(tool.Function.Parameters)
+			b.WriteString(" (parameters as JSON schema: " + string(schema) + ")")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("To call tools, reply with only this JSON and nothing else, with one entry per call:\n")
+	b.WriteString(`{"tool_calls": [{"name": "<tool>", "arguments": {<arguments>}}]}` + "\n")
+
+	switch mode, name, _ := req.toolChoice(); mode {
+	case "required":
+		b.WriteString("You must call at least one tool now.\n")
+	case "function":
+		b.WriteString("You must call the " + name + " tool now.\n")
+	default:
+		b.WriteString("If no tool is needed, answer normally.\n")
+	}
+	return b.String()
+}
+
+// toolCallIntent is one call in the agent's tool_calls reply
+type toolCallIntent struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// parseToolCalls finds the first tool_calls JSON value in an answer and turns its calls to offered tools into OpenAI
+// tool calls. Calls to tools the request didn't offer, or with arguments that aren't an object, are dropped.
+func (req *ChatCompletionRequest) parseToolCalls(answer string) []ToolCall {
+	if !req.toolsEnabled() {
+		return nil
+	}
+	offered := make(map[string]bool, len(req.Tools)+len(req.ServerTools))
+	for _, tool := range req.offeredTools() {
+		offered[tool.Function.Name] = true
+	}
+
+	var a jsonAssembler
+	for _, value := range a.Write(answer) {
+		var reply struct {
+			ToolCalls []toolCallIntent `json:"tool_calls"`
+		}
+		if json.Unmarshal([]byte(value), &reply) != nil || len(reply.ToolCalls) == 0 {
+			continue
+		}
+
+		var calls []ToolCall
+		for _, intent := range reply.ToolCalls {
+			if !offered[intent.Name] {
+				log.Printf("⚠️ Agent called unknown tool %q, ignoring it", intent.Name)
+				continue
+			}
+			args := callArguments(intent.Arguments)
+			if args == "" {
+				args = "{}"
+			}
+			var object map[string]interface{}
+			if json.Unmarshal([]byte(args), &object) != nil {
+				log.Printf("⚠️ Agent called %s with arguments that aren't a JSON object, ignoring it", intent.Name)
+				continue
+			}
+			encoded, _ := json.Marshal(args)
+			calls = append(calls, ToolCall{
+				ID:       "call_" + randomHex(12),
+				Type:     "function",
+				Function: Function{Name: intent.Name, Arguments: encoded},
+			})
+		}
+		return calls
+	}
+	return nil
+}
+
+// Tool execution defaults
+const (
+	defaultToolParallel = 4
+	defaultToolRounds   = 5
+	defaultToolTimeout  = 30 * time.Second
+)
+
+// serverTools lists the tools of running MCP servers as OpenAI tools named server.tool, when tool_execution is
+// enabled. The dot keeps them apart from client tools, whose names can't contain one.
+func (kp *KhojProvider) serverTools() []Tool {
+	if !appConfig().ToolExecution.Enabled {
+		return nil
+	}
+	var tools []Tool
+	for server, serverTools := range kp.MCPManager.Tools() {
+		for _, tool := range serverTools {
+			tools = append(tools, Tool{Type: "function", Function: Function{Name: server + "." + tool.Name, Description: tool.Description, Parameters: tool.InputSchema}})
+		}
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Function.Name < tools[j].Function.Name })
+	return tools
+}
+
+// splitToolCalls separates calls to the wrapper's tools from calls to the client's
+func (req *ChatCompletionRequest) splitToolCalls(calls []ToolCall) (server, client []ToolCall) {
+	own := make(map[string]bool, len(req.ServerTools))
+	for _, tool := range req.ServerTools {
+		own[tool.Function.Name] = true
+	}
+	for _, call := range calls {
+		if own[call.Function.Name] {
+			server = append(server, call)
+		} else {
+			client = append(client, call)
+		}
+	}
+	return server, client
+}
+
+// toolResult is the output of a tool call the wrapper ran
+type toolResult struct {
+	Call   ToolCall
+	Output string
+}
+
+// promptLine renders a result the way tool messages are written into the prompt
+func (r toolResult) promptLine() string {
+	return fmt.Sprintf("tool result for %s (%s): %s\n", r.Call.Function.Name, r.Call.ID, r.Output)
+}
+
+// pendingToolResultStore keeps the results of wrapper tool calls that came with calls to client tools, until the
+// client sends its own results. They are keyed by the client's call IDs rather than the conversation, which may be
+// a different one for the next request in stateless mode.
+type pendingToolResultStore struct {
+	mu     sync.Mutex
+	groups map[string]*pendingToolGroup // Keyed by client tool call ID
+}
+
+// pendingToolGroup holds the wrapper's results for one answer, and the client calls they came with
+type pendingToolGroup struct {
+	callIDs []string
+	results []toolResult
+	added   time.Time
+}
+
+// pendingToolResultTTL drops results whose client never sent its own
+const pendingToolResultTTL = time.Hour
+
+var pendingToolResults = &pendingToolResultStore{groups: make(map[string]*pendingToolGroup)}
+
+// Add keeps results until a request carries the result of one of clientCalls
+func (p *pendingToolResultStore) Add(clientCalls []ToolCall, results []toolResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, group := range p.groups {
+		if time.Since(group.added) > pendingToolResultTTL {
+			delete(p.groups, id)
+		}
+	}
+	group := &pendingToolGroup{results: results, added: time.Now()}
+	for _, call := range clientCalls {
+		group.callIDs = append(group.callIDs, call.ID)
+		p.groups[call.ID] = group
+	}
+}
+
+// Take returns and forgets the results kept for the client calls answered by tool messages
+func (p *pendingToolResultStore) Take(messages []Message) []toolResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var results []toolResult
+	for _, msg := range messages {
+		group, ok := p.groups[msg.ToolCallId]
+		if msg.Role != "tool" || !ok {
+			continue
+		}
+		for _, id := range group.callIDs {
+			delete(p.groups, id)
+		}
+		results = append(results, group.results...)
+	}
+	return results
+}
+
+// runServerTools runs the calls in an answer that go to the wrapper's tools and sends their results back to Khoj in
+// the same conversation, until the agent answers, calls a client tool or tool_execution.max_rounds is reached. It
+// returns the last answer and the calls left for the client to run.
+func (kp *KhojProvider) runServerTools(ctx context.Context, turn *chatTurn, resp *KhojResponse) (*KhojResponse, []ToolCall, error) {
+	maxRounds := positiveOrDefault(appConfig().ToolExecution.MaxRounds, defaultToolRounds)
+	for round := 1; ; round++ {
+		serverCalls, clientCalls := turn.req.splitToolCalls(turn.req.parseToolCalls(resp.Response))
+		if len(serverCalls) == 0 {
+			return resp, clientCalls, nil
+		}
+
+		results := kp.runToolCalls(ctx, serverCalls)
+		if len(clientCalls) > 0 {
+			// The agent continues once the client has run its tools, so these results wait for that request
+			pendingToolResults.Add(clientCalls, results)
+			return resp, clientCalls, nil
+		}
+
+		var query strings.Builder
+		for _, result := range results {
+			query.WriteString(result.promptLine())
+		}
+		if round >= maxRounds {
+			query.WriteString("system: No more tools can be called. Answer the request with the results you have.\n")
+		} else {
+			query.WriteString("system: Call more tools in the same JSON format if you need them, otherwise answer the request.\n")
+		}
+
+		next := *turn.khojReq
+		next.Q, next.Files = query.String(), nil
+		var err error
+		if resp, err = kp.callKhojAPI(ctx, &next); err != nil {
+			return nil, nil, fmt.Errorf("khoj API call with tool results failed: %w", err)
+		}
+		if round >= maxRounds {
+			_, clientCalls := turn.req.splitToolCalls(turn.req.parseToolCalls(resp.Response))
+			return resp, clientCalls, nil
+		}
+	}
+}
+
+// runToolCalls runs tool calls on their MCP servers concurrently and returns the results in call order. The
+// provider's tool slots bound how many run at once across all requests. Failures become results, so the agent
+// can react to them.
+func (kp *KhojProvider) runToolCalls(ctx context.Context, calls []ToolCall) []toolResult {
+	logRequest(ctx, "🔧 Running %d tool call(s): %s", len(calls), toolCallNames(calls))
+	timeout := durationOrDefault(appConfig().ToolExecution.Timeout, defaultToolTimeout)
+	results := make([]toolResult, len(calls))
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = toolResult{Call: call}
+			select {
+			case kp.toolSlots <- struct{}{}:
+				defer func() { <-kp.toolSlots }()
+			case <-ctx.Done():
+				results[i].Output = "error: " + ctx.Err().Error()
+				return
+			}
+
+			start := time.Now()
+			callCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			server, tool, _ := strings.Cut(call.Function.Name, ".")
+			output, err := kp.MCPManager.CallTool(callCtx, server, tool, callArguments(call.Function.Arguments))
+			if err != nil {
+				logRequest(ctx, "⚠️ Tool %s failed after %v: %v", call.Function.Name, time.Since(start).Round(time.Millisecond), err)
+				results[i].Output = "error: " + err.Error()
+				return
+			}
+			logRequest(ctx, "🔧 Tool %s returned %d characters in %v", call.Function.Name, len(output), time.Since(start).Round(time.Millisecond))
+			results[i].Output = kp.limitToolOutput(ctx, call.Function.Name, output)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// callArguments returns tool call arguments as JSON text; OpenAI sends them as a JSON string, agents often as an object
+func callArguments(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	return string(raw)
+}
+
+// filterToolCalls runs the output filter over tool call arguments; blocked is true when any call was blocked
+func filterToolCalls(calls []ToolCall) ([]ToolCall, bool) {
+	for i, call := range calls {
+		args, matches, blocked := activeOutputFilter.Apply(callArguments(call.Function.Arguments))
+		if blocked {
+			log.Printf("🚫 Output filter blocked tool call %s (%d matches)", call.Function.Name, matches)
+			return nil, true
+		}
+		if matches > 0 {
+			log.Printf("Output filter masked %d matches in tool call %s", matches, call.Function.Name)
+			calls[i].Function.Arguments, _ = json.Marshal(args)
+		}
+	}
+	return calls, false
+}
+
+// toolCallNames lists the functions of tool calls for logging
+func toolCallNames(calls []ToolCall) string {
+	names := make([]string, len(calls))
+	for i, call := range calls {
+		names[i] = call.Function.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// toolNameForCall finds the function name of the assistant tool call a tool message answers
+func toolNameForCall(messages []Message, toolCallID string) string {
+	for _, msg := range messages {
+		for _, call := range msg.ToolCalls {
+			if call.ID == toolCallID {
+				return call.Function.Name
+			}
+		}
+	}
+	return ""
+}
+
+// truncateText cuts text to at most maxBytes without splitting a UTF-8 sequence
+func truncateText(text string, maxBytes int) string {
+	if len(text) <= maxBytes {
+		return text
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut]
+}
+
+// limitToolOutput enforces the configured output limit for a tool, summarizing when an agent is configured
+func (kp *KhojProvider) limitToolOutput(ctx context.Context, toolName, output string) string {
+	cfg := appConfig().ToolOutput
+	limit := cfg.MaxChars
+	if perTool, ok := cfg.PerTool[toolName]; ok {
+		limit = perTool
+	}
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+
+	if cfg.SummaryAgent != "" {
+		instruction := fmt.Sprintf("Summarize the following output of the %q tool in at most %d characters. Keep identifiers, numbers, paths, and error messages verbatim.", toolName, limit)
+		summary, err := kp.runScratchPrompt(ctx, cfg.SummaryAgent, instruction+"\n\n"+output)
+		if err == nil && len(summary) <= limit {
+			logRequest(ctx, "Summarized %s output: %d -> %d characters", toolName, len(output), len(summary))
+			return fmt.Sprintf("[Summarized from %d characters]\n%s", len(output), summary)
+		}
+		if err != nil {
+			logRequest(ctx, "Failed to summarize %s output, truncating instead: %v", toolName, err)
+		}
+	}
+
+	logRequest(ctx, "Truncated %s output: %d -> %d characters", toolName, len(output), limit)
+	return fmt.Sprintf("%s\n[... truncated %d characters]", truncateText(output, limit), len(output)-limit)
+}
+
+// fetchImage turns an image_url into the base64 data URL Khoj expects. Data URLs are passed through; http and
+// https URLs are downloaded under the url_fetch guards.
+func fetchImage(ctx context.Context, imageURL string) (string, error) {
+	if err := checkImageURL(imageURL); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(imageURL, "data:") {
+		return imageURL, nil
+	}
+
+	data, mimeType, err := fetchURL(ctx, imageURL, appConfig().URLFetch.imageTypes())
+	if err != nil {
+		return "", fmt.Errorf("failed to download image: %w", err)
+	}
+	logRequest(ctx, "🖼️ Downloaded image (%d bytes, %s)", len(data), mimeType)
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// checkImageURL accepts base64 image data URLs and http or https URLs
+func checkImageURL(imageURL string) error {
+	if strings.HasPrefix(imageURL, "data:") {
+		header, _, ok := strings.Cut(imageURL, ",")
+		if !ok || !strings.HasPrefix(header, "data:image/") || !strings.HasSuffix(header, ";base64") {
+			return fmt.Errorf("data URL is not a base64 image")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		return fmt.Errorf("unsupported image URL scheme (expected data, http or https)")
+	}
+	return appConfig().URLFetch.checkURL(imageURL)
+}
+
+const (
+	defaultFetchMaxMB   = 20
+	defaultFetchTimeout = 30 * time.Second
+	maxFetchRedirects   = 5
+)
+
+// defaultImageTypes are the image formats vision models accept
+var defaultImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// errPrivateAddress marks a download refused because it would reach a private address
+var errPrivateAddress = errors.New("private address")
+
+// cgnatRange is the carrier-grade NAT range, which net.IP.IsPrivate doesn't cover
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// fetchURL downloads a client-supplied http(s) URL under the url_fetch guards, returning the body and its detected
+// content type, which must match one of allowedTypes. Addresses are checked when each connection is made, so
+// redirects and DNS answers can't reach a private address either.
+func fetchURL(ctx context.Context, rawURL string, allowedTypes []string) ([]byte, string, error) {
+	cfg := appConfig().URLFetch
+	if err := cfg.checkURL(rawURL); err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, durationOrDefault(cfg.Timeout, defaultFetchTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := cfg.client().Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			log.Printf("🛡️ Refused to fetch %s: %v", truncateText(rawURL, 100), err)
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("server answered %d", resp.StatusCode)
+	}
+
+	maxBytes := positiveOrDefault(cfg.MaxSizeMB, defaultFetchMaxMB) << 20
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if len(data) > maxBytes {
+		return nil, "", fmt.Errorf("download is larger than %d MiB", maxBytes>>20)
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	if !contentTypeAllowed(mimeType, allowedTypes) {
+		return nil, "", fmt.Errorf("downloaded file is %s, which is not allowed (expected %s)", mimeType, strings.Join(allowedTypes, ", "))
+	}
+	return data, mimeType, nil
+}
+
+// checkURL refuses URLs that name a private address outright, before any connection is made
+func (cfg URLFetchConfig) checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid URL %q", truncateText(rawURL, 100))
+	}
+	host := strings.ToLower(u.Hostname())
+	if cfg.AllowPrivate || cfg.hostAllowed(host) {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%s is a %w; add it to url_fetch.allowed_hosts to fetch from it", host, errPrivateAddress)
+	}
+	if ip := net.ParseIP(host); ip != nil && privateIP(ip) {
+		return fmt.Errorf("%s is a %w; add it to url_fetch.allowed_hosts to fetch from it", host, errPrivateAddress)
+	}
+	return nil
+}
+
+// client returns an HTTP client whose connections to private addresses fail unless url_fetch allows them
+func (cfg URLFetchConfig) client() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	guarded := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// Runs with the resolved address, so a public name pointing at a private address is caught too
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip != nil && privateIP(ip) && !cfg.hostAllowed(host) {
+				return fmt.Errorf("%s is a %w; add it to url_fetch.allowed_hosts to fetch from it", host, errPrivateAddress)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			// No proxy: it would connect on the wrapper's behalf, past the address check
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				host, _, _ := net.SplitHostPort(address)
+				if cfg.AllowPrivate || cfg.hostAllowed(strings.ToLower(host)) {
+					return dialer.DialContext(ctx, network, address)
+				}
+				return guarded.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// hostAllowed reports whether url_fetch.allowed_hosts names host, or an IP range holding it
+func (cfg URLFetchConfig) hostAllowed(host string) bool {
+	ip := net.ParseIP(host)
+	for _, allowed := range cfg.AllowedHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == host {
+			return true
+		}
+		if _, ipNet, err := net.ParseCIDR(allowed); err == nil && ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && ip != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageTypes returns the content types accepted for downloaded images
+func (cfg URLFetchConfig) imageTypes() []string {
+	if len(cfg.ImageTypes) > 0 {
+		return cfg.ImageTypes
+	}
+	return defaultImageTypes
+}
+
+// privateIP reports whether ip is loopback, private, link-local (which holds cloud metadata services), carrier-grade
+// NAT, multicast or unspecified
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatRange.Contains(ip) ||
+		(ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// contentTypeAllowed matches a media type against entries such as "image/png" or "image/*"
+func contentTypeAllowed(mimeType string, allowed []string) bool {
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == mimeType || (strings.HasSuffix(entry, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(entry, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageError checks the image URLs of every message before anything is downloaded
+func (req *ChatCompletionRequest) imageError() error {
+	n := 0
+	for _, msg := range req.Messages {
+		for _, imageURL := range msg.Images {
+			n++
+			if err := checkImageURL(imageURL); err != nil {
+				return fmt.Errorf("invalid image %d: %w", n, err)
+			}
+		}
+	}
+	return nil
+}
+
+// fileError checks that file content parts name files uploaded to /v1/files
+func (req *ChatCompletionRequest) fileError() error {
+	for _, msg := range req.Messages {
+		for _, id := range msg.Files {
+			if _, err := lookupAPIFile(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maxAudioTranscripts bounds the transcript cache, which keeps clips resent with the history from being transcribed again
+const maxAudioTranscripts = 100
+
+var (
+	audioTranscriptsMu sync.Mutex
+	audioTranscripts   = make(map[string]string) // Content hash -> transcript
+)
+
+// transcribeAudio turns an input_audio clip into text with Khoj's speech-to-text model
+func (kp *KhojProvider) transcribeAudio(ctx context.Context, audio MessageAudio) (string, error) {
+	key := contentHash([]byte(audio.Data))
+	audioTranscriptsMu.Lock()
+	transcript, ok := audioTranscripts[key]
+	audioTranscriptsMu.Unlock()
+	if ok {
+		return transcript, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(audio.Data)
+	if err != nil {
+		return "", fmt.Errorf("input_audio data is not base64: %w", err)
+	}
+	format := audio.Format
+	if format == "" {
+		format = "wav"
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "audio."+format)
+	if err != nil {
+		return "", fmt.Errorf("failed to build transcription request: %w", err)
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return "", fmt.Errorf("failed to build transcription request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", kp.APIBase+"/api/transcribe", &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create transcription request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	setRequestIDHeader(req)
+
+	start := time.Now()
+	resp, err := kp.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send transcription request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("transcription failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode transcription: %w", err)
+	}
+	logRequest(ctx, "🎙️ Transcribed %d bytes of %s audio in %v", len(data), format, time.Since(start).Round(time.Millisecond))
+
+	audioTranscriptsMu.Lock()
+	if len(audioTranscripts) >= maxAudioTranscripts {
+		audioTranscripts = make(map[string]string)
+	}
+	audioTranscripts[key] = result.Text
+	audioTranscriptsMu.Unlock()
+	return result.Text, nil
+}
+
+// runScratchPrompt sends a one-off prompt to an agent in a scratch conversation separate from the user's
+func (kp *KhojProvider) runScratchPrompt(ctx context.Context, agentSlug, prompt string) (string, error) {
+	kp.scratchMu.Lock()
+	convID, ok := kp.scratchConversations[agentSlug]
+	if !ok {
+		var err error
+		convID, err = createConversationWithAgent(kp.APIBase, kp.APIKey, agentSlug)
+		if err != nil {
+			kp.scratchMu.Unlock()
+			return "", fmt.Errorf("failed to create scratch conversation for %s: %w", agentSlug, err)
+		}
+		if kp.scratchConversations == nil {
+			kp.scratchConversations = make(map[string]string)
+		}
+		kp.scratchConversations[agentSlug] = convID
+	}
+	kp.scratchMu.Unlock()
+
+	resp, err := kp.callKhojAPI(ctx, &KhojRequest{
+		Q:              prompt,
+		ConversationID: convID,
+		ClientID:       "khoj-provider-scratch",
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Response), nil
+}
+
+// estimateTokens approximates a token count at 4 bytes per token. Budgets use it since files can be megabytes, and
+// countTokens falls back to it when a tokenizer can't be loaded.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// fallbackEncoding counts tokens for models whose family is unknown; it is close for most current chat models
+const fallbackEncoding = tiktoken.MODEL_CL100K_BASE
+
+// o200kPrefixes are OpenAI model families on o200k_base that tiktoken-go doesn't map yet
+var o200kPrefixes = []string{"o1", "o3", "o4", "gpt-5", "gpt-oss", "chatgpt-4o"}
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = map[string]*tiktoken.Tiktoken{} // Encoding name -> tokenizer, nil when it failed to load
+)
+
+// modelEncoding names the tiktoken encoding of a model such as gpt-4o or openai/gpt-4.1-mini, or returns "" when
+// the model's family is unknown
+func modelEncoding(model string) string {
+	model = strings.ToLower(model)
+	model = model[strings.LastIndex(model, "/")+1:]
+	if encoding, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return encoding
+	}
+	for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return encoding
+		}
+	}
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	return ""
+}
+
+// tokenEncodingFor picks the encoding for a request: the requested model's when its family is known, else that of
+// the agent's chat model from the last agent list, else fallbackEncoding
+func tokenEncodingFor(model, agent string) string {
+	if encoding := modelEncoding(model); encoding != "" {
+		return encoding
+	}
+	if encoding := modelEncoding(agentChatModel(agent)); encoding != "" {
+		return encoding
+	}
+	return fallbackEncoding
+}
+
+// agentChatModel is the chat model Khoj reported for an agent when the agents were last listed, or ""
+func agentChatModel(slug string) string {
+	agentListMu.Lock()
+	defer agentListMu.Unlock()
+	for _, a := range agentList {
+		if a.Slug == slug {
+			return a.ChatModel
+		}
+	}
+	return ""
+}
+
+// systemFingerprint identifies the setup that answered a request, as OpenAI's system_fingerprint does: a seeded
+// request can only be expected to repeat its answer while the fingerprint stays the same. It covers the wrapper
+// version, the agent and the agent's chat model.
+func systemFingerprint(agent string) string {
+	sum := sha256.Sum256([]byte(version + "\x00" + agent + "\x00" + agentChatModel(agent)))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
+
+// countTokens counts the tokens of text in an encoding. The encodings are built into the binary, so counting never
+// downloads anything.
+func countTokens(encoding, text string) int {
+	if text == "" {
+		return 0
+	}
+	tk := tokenizer(encoding)
+	if tk == nil {
+		return estimateTokens(text)
+	}
+	return len(tk.EncodeOrdinary(text))
+}
+
+// tokenizer loads an encoding once, returning nil when it can't be loaded
+func tokenizer(encoding string) *tiktoken.Tiktoken {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	if tk, ok := tokenizers[encoding]; ok {
+		return tk
+	}
+
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	tk, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		log.Printf("⚠️ Estimating tokens at 4 bytes each: failed to load the %s tokenizer: %v", encoding, err)
+	}
+	tokenizers[encoding] = tk
+	return tk
+}
+
+// splitTokens splits text into its tokens in an encoding, or into pieces of about 4 bytes when the tokenizer can't
+// be loaded. Tokens may end inside a UTF-8 sequence; joined, they are text again.
+func splitTokens(encoding, text string) []string {
+	var tokens []string
+	tk := tokenizer(encoding)
+	if tk == nil {
+		for text != "" {
+			n := min(4, len(text))
+			for n < len(text) && !utf8.RuneStart(text[n]) {
+				n++
+			}
+			tokens = append(tokens, text[:n])
+			text = text[n:]
+		}
+		return tokens
+	}
+	for _, id := range tk.EncodeOrdinary(text) {
+		tokens = append(tokens, tk.Decode([]int{id}))
+	}
+	return tokens
+}
+
+// truncateToTokens cuts text to its first maxTokens tokens, reporting whether anything was cut. A maxTokens of 0 or
+// less means no limit.
+func truncateToTokens(encoding, text string, maxTokens int) (string, bool) {
+	if maxTokens <= 0 {
+		return text, false
+	}
+	tokens := splitTokens(encoding, text)
+	if len(tokens) <= maxTokens {
+		return text, false
+	}
+	cut := strings.Join(tokens[:maxTokens], "")
+	for !utf8.ValidString(cut) {
+		cut = cut[:len(cut)-1] // A token ending inside a character
+	}
+	return cut, true
+}
+
+// tokenBytes returns a token's bytes, which the token string can't show when it ends inside a UTF-8 sequence
+func tokenBytes(token string) []int {
+	b := make([]int, len(token))
+	for i := 0; i < len(token); i++ {
+		b[i] = int(token[i])
+	}
+	return b
+}
+
+// synthesizedLogprobs builds chat logprobs for an answer. Khoj doesn't report token probabilities, so each token of
+// the answer gets logprob 0, as if it were certain, and top_logprobs lists only the token itself.
+func synthesizedLogprobs(encoding, text string, top int) *ChoiceLogprobs {
+	logprobs := &ChoiceLogprobs{Content: []TokenLogprob{}}
+	for _, token := range splitTokens(encoding, text) {
+		entry := TokenLogprob{Token: token, Bytes: tokenBytes(token), TopLogprobs: []TopLogprob{}}
+		if top > 0 {
+			entry.TopLogprobs = append(entry.TopLogprobs, TopLogprob{Token: token, Bytes: entry.Bytes})
+		}
+		logprobs.Content = append(logprobs.Content, entry)
+	}
+	return logprobs
+}
+
+// synthesizedCompletionLogprobs builds legacy text completion logprobs like synthesizedLogprobs, for text that
+// starts offset bytes into the choice's text
+func synthesizedCompletionLogprobs(encoding, text string, offset, top int) *CompletionLogprobs {
+	logprobs := &CompletionLogprobs{Tokens: []string{}, TokenLogprobs: []float64{}, TopLogprobs: []map[string]float64{}, TextOffset: []int{}}
+	for _, token := range splitTokens(encoding, text) {
+		logprobs.Tokens = append(logprobs.Tokens, token)
+		logprobs.TokenLogprobs = append(logprobs.TokenLogprobs, 0)
+		alternatives := map[string]float64{}
+		if top > 0 {
+			alternatives[token] = 0
+		}
+		logprobs.TopLogprobs = append(logprobs.TopLogprobs, alternatives)
+		logprobs.TextOffset = append(logprobs.TextOffset, offset)
+		offset += len(token)
+	}
+	return logprobs
+}
+
+// fitFilesToBudget shrinks attached files so the prompt plus files stay within the agent's token budget.
+// Files are given equal shares of the remaining budget and files smaller than their share donate the rest.
+// Oversized files are summarized (map-reduce over chunks when larger than one chunk) or truncated if no summary agent is set.
+func (kp *KhojProvider) fitFilesToBudget(ctx context.Context, agent, prompt string, files []KhojFile) ([]KhojFile, *BudgetReport) {
+	cfg := appConfig().TokenBudget
+	budget := cfg.Default
+	if perAgent, ok := cfg.PerAgent[agent]; ok {
+		budget = perAgent
+	}
+	if budget <= 0 || len(files) == 0 {
+		return files, nil
+	}
+
+	promptTokens := estimateTokens(prompt)
+	total := promptTokens
+	for _, f := range files {
+		total += estimateTokens(f.Content)
+	}
+	if total <= budget {
+		return files, nil
+	}
+
+	report := &BudgetReport{Agent: agent, Budget: budget, EstimatedTokens: total}
+	available := budget - promptTokens
+	if available <= 0 {
+		logRequest(ctx, "⚠️ Prompt alone (%d tokens) exceeds the %d token budget for %s; sending files unchanged", promptTokens, budget, agent)
+		report.Strategy = "over_budget"
+		report.FinalTokens = total
+		for _, f := range files {
+			tokens := estimateTokens(f.Content)
+			report.Files = append(report.Files, BudgetFileReport{Name: f.Name, OriginalTokens: tokens, FinalTokens: tokens, Strategy: "kept"})
+		}
+		return files, report
+	}
+
+	shares := budgetShares(files, available)
+	fitted := make([]KhojFile, len(files))
+	report.FinalTokens = promptTokens
+	for i, f := range files {
+		original := estimateTokens(f.Content)
+		fileReport := BudgetFileReport{Name: f.Name, OriginalTokens: original, Strategy: "kept"}
+		if original > shares[i] {
+			f.Content, fileReport.Strategy, fileReport.Chunks = kp.shrinkFile(ctx, cfg, f, shares[i])
+			f.Size = len(f.Content)
+			report.Strategy = mergeBudgetStrategy(report.Strategy, fileReport.Strategy)
+			logRequest(ctx, "Fitted %s to budget via %s: %d -> %d tokens", f.Name, fileReport.Strategy, original, estimateTokens(f.Content))
+		}
+		fileReport.FinalTokens = estimateTokens(f.Content)
+		report.FinalTokens += fileReport.FinalTokens
+		report.Files = append(report.Files, fileReport)
+		fitted[i] = f
+	}
+	return fitted, report
+}
+
+// budgetShares splits available tokens across files, letting small files keep all of theirs
+func budgetShares(files []KhojFile, available int) []int {
+	shares := make([]int, len(files))
+	remaining := make(map[int]bool, len(files))
+	for i := range files {
+		remaining[i] = true
+	}
+
+	for len(remaining) > 0 {
+		share := available / len(remaining)
+		settled := false
+		for i := range remaining {
+			if tokens := estimateTokens(files[i].Content); tokens <= share {
+				shares[i] = tokens
+				available -= tokens
+				delete(remaining, i)
+				settled = true
+			}
+		}
+		if !settled {
+			for i := range remaining {
+				shares[i] = share
+			}
+			break
+		}
+	}
+	return shares
+}
+
+// mergeBudgetStrategy reports the most involved strategy used across files
+func mergeBudgetStrategy(current, next string) string {
+	rank := map[string]int{"": 0, "truncate": 1, "summarize": 2, "map_reduce": 3}
+	if rank[next] > rank[current] {
+		return next
+	}
+	return current
+}
+
+// shrinkFile reduces a file to roughly targetTokens, returning the new content, strategy used and chunk count
+func (kp *KhojProvider) shrinkFile(ctx context.Context, cfg TokenBudgetConfig, file KhojFile, targetTokens int) (string, string, int) {
+	targetChars := targetTokens * 4
+	truncate := func() (string, string, int) {
+		marker := fmt.Sprintf("\n[... truncated to fit token budget, %d of %d characters kept]", targetChars, len(file.Content))
+		return truncateText(file.Content, max(targetChars-len(marker), 0)) + marker, "truncate", 0
+	}
+	if cfg.SummaryAgent == "" {
+		return truncate()
+	}
+
+	chunkTokens := cfg.ChunkTokens
+	if chunkTokens <= 0 {
+		chunkTokens = defaultChunkTokens
+	}
+	chunks := splitIntoChunks(file.Content, chunkTokens*4)
+
+	summarize := func(text string, chars int, part string) (string, error) {
+		instruction := fmt.Sprintf("Summarize %s of the file %q in at most %d characters. Keep identifiers, numbers, paths, headings, and error messages verbatim.", part, file.Name, chars)
+		return kp.runScratchPrompt(ctx, cfg.SummaryAgent, instruction+"\n\n"+text)
+	}
+
+	if len(chunks) == 1 {
+		summary, err := summarize(file.Content, targetChars, "the whole")
+		if err != nil {
+			logRequest(ctx, "Failed to summarize %s, truncating instead: %v", file.Name, err)
+			return truncate()
+		}
+		return fmt.Sprintf("[Summarized from %d characters]\n%s", len(file.Content), summary), "summarize", 1
+	}
+
+	// Map: summarize each chunk within its slice of the target
+	perChunk := max(targetChars/len(chunks), 200)
+	summaries := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		summary, err := summarize(chunk, perChunk, fmt.Sprintf("part %d of %d", i+1, len(chunks)))
+		if err != nil {
+			logRequest(ctx, "Failed to summarize chunk %d of %s, truncating instead: %v", i+1, file.Name, err)
+			return truncate()
+		}
+		summaries[i] = fmt.Sprintf("[Part %d/%d]\n%s", i+1, len(chunks), summary)
+	}
+
+	// Reduce: merge the partial summaries if they still exceed the target
+	combined := strings.Join(summaries, "\n\n")
+	if len(combined) > targetChars {
+		reduced, err := summarize(combined, targetChars, "these partial summaries")
+		if err != nil {
+			logRequest(ctx, "Failed to merge summaries of %s, truncating them instead: %v", file.Name, err)
+			combined = truncateText(combined, targetChars)
+		} else {
+			combined = reduced
+		}
+	}
+	return fmt.Sprintf("[Summarized from %d characters in %d parts]\n%s", len(file.Content), len(chunks), combined), "map_reduce", len(chunks)
+}
+
+// splitIntoChunks splits text into pieces of at most maxChars, preferring line boundaries
+func splitIntoChunks(text string, maxChars int) []string {
+	var chunks []string
+	for len(text) > maxChars {
+		cut := strings.LastIndexByte(text[:maxChars], '\n') + 1
+		if cut <= maxChars/2 {
+			cut = len(truncateText(text, maxChars))
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+	if text != "" || len(chunks) == 0 {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// runeChunks cuts text into pieces of about size bytes, never inside a UTF-8 sequence
+func runeChunks(text string, size int) []string {
+	var chunks []string
+	for text != "" {
+		n := min(size, len(text))
+		for n < len(text) && !utf8.RuneStart(text[n]) {
+			n++
+		}
+		chunks = append(chunks, text[:n])
+		text = text[n:]
+	}
+	return chunks
+}
+
+// fileTypeFromMime maps a MIME type onto the file_type values Khoj understands
+func fileTypeFromMime(mimeType string) string {
+	switch {
+	case strings.Contains(mimeType, "html"):
+		return "html"
+	case strings.Contains(mimeType, "markdown"):
+		return "markdown"
+	case strings.Contains(mimeType, "json"):
+		return "json"
+	default:
+		return "text"
+	}
+}
+
+func (kp *KhojProvider) callKhojAPI(ctx context.Context, req *KhojRequest) (*KhojResponse, error) {
+	if err := checkTeamDenyRequest(ctx, req); err != nil {
+		return nil, err
+	}
+	var resp *KhojResponse
+	start := time.Now()
+	if localModelFirst() {
+		resp, err := askLocalModel(ctx, req, localReasonPrivacy, nil)
+		mirrorExchange(ctx, req.ConversationID, req.ClientID, req.Q, req.Files, start, resp, err)
+		return resp, err
+	}
+	err := khojScheduler.Run(ctx, requestClassFrom(ctx), func(ctx context.Context) error {
+		var err error
+		resp, err = kp.sendKhojRequest(ctx, req)
+		return err
+	})
+	resp, err = orLocalModel(ctx, req, resp, err, nil)
+	mirrorExchange(ctx, req.ConversationID, req.ClientID, req.Q, req.Files, start, resp, err)
+	return resp, err
+}
+
+// sendKhojRequest posts a chat request to Khoj, retrying transport and server errors within the attempt budget
+func (kp *KhojProvider) sendKhojRequest(ctx context.Context, req *KhojRequest) (*KhojResponse, error) {
+	stats := upstreamStatsFrom(ctx)
+	maxAttempts := stats.budget()
+	var lastErr error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt > 0 {
+			logRequest(ctx, "Retrying Khoj API call (attempt %d/%d)", attempt+1, maxAttempts)
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+
+		jsonData, err := json.Marshal(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+
+		logRequest(ctx, "Making Khoj API call to: %s", kp.APIBase+"/api/chat")
+
+		start := time.Now()
+		status, body, err := kp.postKhojChat(ctx, jsonData)
+		stats.record(time.Since(start))
+		if err != nil {
+			lastErr = err
+			logRequest(ctx, "Khoj API call failed (attempt %d): %v", attempt+1, lastErr)
+			continue
+		}
+
+		logRequest(ctx, "Khoj API response status: %d, body length: %d", status, len(body))
+
+		if status != http.StatusOK {
+			lastErr = &khojStatusError{Status: status, Body: string(body)}
+			if status >= 500 {
+				continue
+			}
+			return nil, lastErr
+		}
+
+		var khojResp KhojResponse
+		if err := json.Unmarshal(body, &khojResp); err != nil {
+			lastErr = fmt.Errorf("failed to decode response: %w", err)
+			logRequestContent(ctx, "Response body: %s", string(body))
+			continue
+		}
+
+		logRequest(ctx, "Successfully parsed Khoj response")
+		return &khojResp, nil
+	}
+
+	if maxAttempts == 1 {
+		return nil, fmt.Errorf("khoj API call failed (retries disabled): %w", lastErr)
+	}
+	return nil, fmt.Errorf("khoj API call failed after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// khojChatResult is the outcome of one POST to /api/chat
+type khojChatResult struct {
+	status int
+	body   []byte
+	err    error
+	hedge  bool
+}
+
+// postKhojChat makes one POST to /api/chat, hedging interactive requests when hedging is enabled
+func (kp *KhojProvider) postKhojChat(ctx context.Context, jsonData []byte) (int, []byte, error) {
+	if !appConfig().Hedge.Enabled || requestClassFrom(ctx) != classInteractive {
+		r := kp.postKhojChatOnce(ctx, jsonData, nil)
+		return r.status, r.body, r.err
+	}
+	r := kp.hedgedPostKhojChat(ctx, jsonData, durationOrDefault(appConfig().Hedge.Delay, defaultHedgeDelay))
+	if r.hedge && r.err == nil {
+		upstreamStatsFrom(ctx).markHedged()
+	}
+	return r.status, r.body, r.err
+}
+
+// hedgedPostKhojChat sends a second copy of the request if the first has not started responding after delay.
+// The first successful answer wins and the other request is cancelled. Both copies ask Khoj to stream: without
+// stream, Khoj only responds once the whole answer is written, so every slow answer would be sent twice.
+func (kp *KhojProvider) hedgedPostKhojChat(ctx context.Context, jsonData []byte, delay time.Duration) khojChatResult {
+	var streamReq KhojRequest
+	if err := json.Unmarshal(jsonData, &streamReq); err != nil {
+		return khojChatResult{err: fmt.Errorf("failed to parse request: %w", err)}
+	}
+	streamReq.Stream = true
+	jsonData, err := json.Marshal(&streamReq)
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("failed to marshal request: %w", err)}
+	}
+
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	defer cancelPrimary()
+	hedgeCtx, cancelHedge := context.WithCancel(ctx)
+	defer cancelHedge()
+
+	results := make(chan khojChatResult, 2)
+	responding := make(chan struct{})
+	go func() {
+		results <- kp.postKhojChatStreamed(primaryCtx, jsonData, func() { close(responding) })
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-responding:
+		return <-results
+	case r := <-results:
+		return r
+	case <-ctx.Done():
+		return khojChatResult{err: ctx.Err()}
+	case <-timer.C:
+	}
+
+	logRequest(ctx, "🪁 No response from Khoj after %v, sending a hedged request", delay)
+	go func() {
+		r := kp.postKhojChatStreamed(hedgeCtx, jsonData, nil)
+		r.hedge = true
+		results <- r
+	}()
+
+	var r khojChatResult
+	for i := 0; i < 2; i++ {
+		r = <-results
+		if r.err == nil && r.status < 500 {
+			break
+		}
+	}
+	if r.hedge {
+		logRequest(ctx, "🪁 Hedged request answered first")
+	}
+	return r
+}
+
+// postKhojChatOnce makes one POST to /api/chat and reads the whole response; onResponse runs when the headers arrive
+func (kp *KhojProvider) postKhojChatOnce(ctx context.Context, jsonData []byte, onResponse func()) khojChatResult {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", kp.APIBase+"/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("failed to create request: %w", err)}
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "KhojProvider/1.0")
+	if kp.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	}
+	setRequestIDHeader(httpReq)
+
+	defer trackKhojCall(ctx)()
+	resp, err := kp.HTTPClient.Do(httpReq)
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("HTTP request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+	if onResponse != nil {
+		onResponse()
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("failed to read response body: %w", err)}
+	}
+	return khojChatResult{status: resp.StatusCode, body: body}
+}
+
+// postKhojChatStreamed makes one streaming POST to /api/chat and answers with the assembled response as the JSON
+// body a non-streamed request gets; onResponse runs when the headers arrive, which Khoj sends as it starts answering
+func (kp *KhojProvider) postKhojChatStreamed(ctx context.Context, jsonData []byte, onResponse func()) khojChatResult {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", kp.APIBase+"/api/chat", bytes.NewReader(jsonData))
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("failed to create request: %w", err)}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "KhojProvider/1.0")
+	if kp.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	}
+	setRequestIDHeader(httpReq)
+
+	defer trackKhojCall(ctx)()
+	httpResp, err := kp.HTTPClient.Do(httpReq)
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("HTTP request failed: %w", err)}
+	}
+	defer httpResp.Body.Close()
+	if onResponse != nil {
+		onResponse()
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			return khojChatResult{err: fmt.Errorf("failed to read response body: %w", err)}
+		}
+		return khojChatResult{status: httpResp.StatusCode, body: body}
+	}
+
+	none := func(string) error { return nil }
+	resp, _, err := decodeKhojStream(httpResp, none, func(khojProgress) error { return nil })
+	if err != nil {
+		return khojChatResult{err: err}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return khojChatResult{err: fmt.Errorf("failed to marshal response: %w", err)}
+	}
+	return khojChatResult{status: httpResp.StatusCode, body: body}
+}
+
+// khojEventDelimiter ends each event in Khoj's chat stream
+const khojEventDelimiter = "␃🔚␗"
+
+// streamKhojAPI sends a chat request with stream=true, calling onDelta with each piece of the answer as Khoj
+// writes it and onProgress with each status update and piece of reasoning, and returns the whole response once the
+// stream ends
+func (kp *KhojProvider) streamKhojAPI(ctx context.Context, req *KhojRequest, onDelta func(string) error, onProgress func(khojProgress) error) (*KhojResponse, error) {
+	if err := checkTeamDenyRequest(ctx, req); err != nil {
+		return nil, err
+	}
+	if entry := streamJournal.Start(ctx, req); entry != nil {
+		defer entry.Finish()
+		deliver := onDelta
+		onDelta = func(text string) error {
+			entry.Append(text)
+			return deliver(text)
+		}
+	}
+	var resp *KhojResponse
+	start := time.Now()
+	if localModelFirst() {
+		resp, err := askLocalModel(ctx, req, localReasonPrivacy, onDelta)
+		mirrorExchange(ctx, req.ConversationID, req.ClientID, req.Q, req.Files, start, resp, err)
+		return resp, err
+	}
+	delivered := false
+	err := khojScheduler.Run(ctx, requestClassFrom(ctx), func(ctx context.Context) error {
+		var err error
+		resp, err = kp.sendKhojStream(ctx, req, func(text string) error {
+			delivered = true
+			return onDelta(text)
+		}, onProgress)
+		return err
+	})
+	if !delivered { // The local model would repeat what Khoj already sent
+		resp, err = orLocalModel(ctx, req, resp, err, onDelta)
+	}
+	mirrorExchange(ctx, req.ConversationID, req.ClientID, req.Q, req.Files, start, resp, err)
+	return resp, err
+}
+
+// sendKhojStream posts a streaming chat request, retrying like sendKhojRequest until part of the answer was passed on
+func (kp *KhojProvider) sendKhojStream(ctx context.Context, req *KhojRequest, onDelta func(string) error, onProgress func(khojProgress) error) (*KhojResponse, error) {
+	stats := upstreamStatsFrom(ctx)
+	maxAttempts := stats.budget()
+
+	streamReq := *req
+	streamReq.Stream = true
+	jsonData, err := json.Marshal(&streamReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt > 0 {
+			logRequest(ctx, "Retrying Khoj API call (attempt %d/%d)", attempt+1, maxAttempts)
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+
+		logRequest(ctx, "Making streaming Khoj API call to: %s", kp.APIBase+"/api/chat")
+		resp, delivered, err := kp.readKhojStream(ctx, jsonData, stats, onDelta, onProgress)
+		if err == nil {
+			if resp.ConversationID == "" {
+				resp.ConversationID = req.ConversationID
+			}
+			return resp, nil
+		}
+		if errors.Is(err, errMaxTokensReached) {
+			return nil, err // The answer was cut on purpose
+		}
+		lastErr = err
+		logRequest(ctx, "Khoj API call failed (attempt %d): %v", attempt+1, err)
+
+		// Once the client has part of the answer a retry would repeat it
+		var statusErr *khojStatusError
+		if delivered || ctx.Err() != nil || (errors.As(err, &statusErr) && statusErr.Status < 500) {
+			return nil, err
+		}
+	}
+
+	if maxAttempts == 1 {
+		return nil, fmt.Errorf("khoj API call failed (retries disabled): %w", lastErr)
+	}
+	return nil, fmt.Errorf("khoj API call failed after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// readKhojStream makes one streaming POST to /api/chat; delivered reports whether onDelta was called, after
+// which the request must not be retried. Progress updates don't count, since repeating them on a retry is harmless.
+func (kp *KhojProvider) readKhojStream(ctx context.Context, jsonData []byte, stats *upstreamStats, onDelta func(string) error, onProgress func(khojProgress) error) (resp *KhojResponse, delivered bool, err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", kp.APIBase+"/api/chat", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "KhojProvider/1.0")
+	if kp.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	}
+	setRequestIDHeader(httpReq)
+
+	defer trackKhojCall(ctx)()
+	start := time.Now()
+	httpResp, err := kp.HTTPClient.Do(httpReq)
+	stats.record(time.Since(start)) // Latency to the first byte, before the client's headers are written
+	if err != nil {
+		return nil, false, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(httpResp.Body)
+		return nil, false, &khojStatusError{Status: httpResp.StatusCode, Body: string(body)}
+	}
+	return decodeKhojStream(httpResp, onDelta, onProgress)
+}
+
+// decodeKhojStream reads the body of a streamed chat response, calling onDelta and onProgress as for readKhojStream
+func decodeKhojStream(httpResp *http.Response, onDelta func(string) error, onProgress func(khojProgress) error) (resp *KhojResponse, delivered bool, err error) {
+	// Servers that ignore stream=true send the usual JSON body
+	if strings.HasPrefix(httpResp.Header.Get("Content-Type"), "application/json") {
+		var khojResp KhojResponse
+		if err := json.NewDecoder(httpResp.Body).Decode(&khojResp); err != nil {
+			return nil, false, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if khojResp.Response != "" {
+			if err := onDelta(khojResp.Response); err != nil {
+				return nil, true, err
+			}
+		}
+		return &khojResp, khojResp.Response != "", nil
+	}
+
+	khojResp := &KhojResponse{}
+	var answer strings.Builder
+	handle := func(event string) error {
+		text, progress := khojStreamEvent(khojResp, event)
+		if progress.Text != "" {
+			return onProgress(progress)
+		}
+		if text == "" {
+			return nil
+		}
+		delivered = true
+		answer.WriteString(text)
+		return onDelta(text)
+	}
+
+	var pending []byte
+	buf := make([]byte, 4096)
+	for {
+		n, readErr := httpResp.Body.Read(buf)
+		pending = append(pending, buf[:n]...)
+		for {
+			i := bytes.Index(pending, []byte(khojEventDelimiter))
+			if i < 0 {
+				break
+			}
+			event := string(pending[:i])
+			pending = pending[i+len(khojEventDelimiter):]
+			if err := handle(event); err != nil {
+				return nil, delivered, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, delivered, fmt.Errorf("failed to read response stream: %w", readErr)
+		}
+	}
+	// Older servers end the stream without a final delimiter
+	if err := handle(string(pending)); err != nil {
+		return nil, delivered, err
+	}
+
+	khojResp.Response = answer.String()
+	return khojResp, delivered, nil
+}
+
+// Why the local model answers in Khoj's place
+const (
+	localReasonUnreachable = "unreachable" // Khoj can't be reached
+	localReasonPrivacy     = "privacy"     // Privacy mode is on and local_model.privacy is set
+)
+
+// localModelState tracks whether the local model is answering in Khoj's place, for the tray and /status
+var localModelState struct {
+	sync.Mutex
+	reason string // localReasonUnreachable or localReasonPrivacy while the local model answers
+	since  time.Time
+}
+
+// localModelClient talks to the local model; requests are bounded by local_model.timeout instead
+var localModelClient = &http.Client{}
+
+// model is the name sent to the local server and shown when it answers
+func (c *LocalModelConfig) model() string {
+	if c.Model != "" {
+		return c.Model
+	}
+	return "local"
+}
+
+// localModelFirst reports whether requests skip Khoj and go straight to the local model
+func localModelFirst() bool {
+	lm := appConfig().LocalModel
+	return lm != nil && lm.Privacy && privacyMode.Load()
+}
+
+// localModelAnswering returns why and since when the local model is answering, or "" while Khoj is
+func localModelAnswering() (string, time.Time) {
+	localModelState.Lock()
+	defer localModelState.Unlock()
+	return localModelState.reason, localModelState.since
+}
+
+// orLocalModel passes on Khoj's result, asking the local model instead when Khoj couldn't be reached
+func orLocalModel(ctx context.Context, req *KhojRequest, resp *KhojResponse, err error, onDelta func(string) error) (*KhojResponse, error) {
+	if appConfig().LocalModel == nil {
+		return resp, err
+	}
+	if err == nil {
+		noteKhojAnswering()
+		return resp, nil
+	}
+	if ctx.Err() != nil || !khojUnreachable(err) {
+		return resp, err
+	}
+	logRequest(ctx, "🏠 Khoj can't be reached, asking the local model instead: %v", err)
+	localResp, localErr := askLocalModel(ctx, req, localReasonUnreachable, onDelta)
+	if localErr != nil && !errors.Is(localErr, errMaxTokensReached) {
+		// Keep Khoj's error first, so callers still see that Khoj is unreachable, e.g. to offer the offline queue
+		return nil, fmt.Errorf("%w (local model failed too: %v)", err, localErr)
+	}
+	return localResp, localErr
+}
+
+// askLocalModel answers req with the local model, streaming the answer through onDelta when it is set. The local
+// server only sees this request; earlier turns of the conversation are kept by Khoj.
+func askLocalModel(ctx context.Context, req *KhojRequest, reason string, onDelta func(string) error) (*KhojResponse, error) {
+	lm := appConfig().LocalModel
+	model := lm.model()
+
+	prompt := req.Q
+	for _, f := range req.Files {
+		prompt += fmt.Sprintf("\n\n--- %s ---\n%s", f.Name, f.Content)
+	}
+	body := map[string]interface{}{
+		"model":    model,
+		"messages": []map[string]string{{"role": "user", "content": prompt}},
+		"stream":   onDelta != nil,
+	}
+	if req.Temperature != nil {
+		body["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		body["top_p"] = *req.TopP
+	}
+	if req.Seed != nil {
+		body["seed"] = *req.Seed
+	}
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, durationOrDefault(lm.Timeout, defaultLocalModelTimeout))
+	defer cancel()
+	endpoint := strings.TrimRight(lm.URL, "/") + "/chat/completions"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if lm.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+lm.APIKey)
+	}
+	if len(req.Images) > 0 {
+		logRequest(ctx, "🏠 %d image(s) not sent to the local model", len(req.Images))
+	}
+
+	logRequest(ctx, "🏠 Asking local model %s at %s", model, endpoint)
+	upstreamStatsFrom(ctx).markLocal(model)
+	httpResp, err := localModelClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("local model request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return nil, fmt.Errorf("local model answered with status %d: %s", httpResp.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+
+	var answer string
+	if onDelta != nil && strings.HasPrefix(httpResp.Header.Get("Content-Type"), "text/event-stream") {
+		if answer, err = readLocalModelStream(httpResp.Body, onDelta); err != nil {
+			return nil, err
+		}
+	} else {
+		var completion struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.NewDecoder(httpResp.Body).Decode(&completion); err != nil {
+			return nil, fmt.Errorf("failed to decode local model response: %w", err)
+		}
+		if len(completion.Choices) == 0 {
+			return nil, fmt.Errorf("local model sent no answer")
+		}
+		answer = completion.Choices[0].Message.Content
+		if onDelta != nil && answer != "" {
+			if err := onDelta(answer); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	logRequest(ctx, "🏠 Local model %s answered with %d characters", model, len(answer))
+	noteLocalModelAnswering(reason)
+	return &KhojResponse{Response: answer, ConversationID: req.ConversationID, CreatedBy: model}, nil
+}
+
+// readLocalModelStream passes on the content deltas of an OpenAI event stream and returns the whole answer
+func readLocalModelStream(body io.Reader, onDelta func(string) error) (string, error) {
+	var answer strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		text := chunk.Choices[0].Delta.Content
+		answer.WriteString(text)
+		if err := onDelta(text); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read local model stream: %w", err)
+	}
+	return answer.String(), nil
+}
+
+// noteLocalModelAnswering records that the local model answered, telling the tray and, when Khoj just became
+// unreachable, the user
+func noteLocalModelAnswering(reason string) {
+	localModelState.Lock()
+	changed := localModelState.reason != reason
+	if changed {
+		localModelState.reason, localModelState.since = reason, time.Now()
+	}
+	localModelState.Unlock()
+	if !changed {
+		return
+	}
+
+	model := appConfig().LocalModel.model()
+	if reason == localReasonPrivacy {
+		log.Printf("🏠 Local model %s is answering while privacy mode is on", model)
+	} else {
+		log.Printf("🏠 Local model %s is answering while Khoj can't be reached", model)
+		showNotification("Khoj AI - Local Model", fmt.Sprintf("Khoj can't be reached, so %s answers until it's back.", model))
+	}
+	bus.Publish(topicLocalModel, "answering", LocalModelEvent{Model: model, Reason: reason})
+}
+
+// noteKhojAnswering records that Khoj answered again after the local model stood in for it
+func noteKhojAnswering() {
+	localModelState.Lock()
+	was := localModelState.reason
+	localModelState.reason = ""
+	localModelState.Unlock()
+	if was == "" {
+		return
+	}
+	log.Printf("🏠 Khoj is answering again instead of the local model")
+	bus.Publish(topicLocalModel, "stopped", LocalModelEvent{Model: appConfig().LocalModel.model()})
+}
+
+// khojProgress is an update Khoj streams before and while it writes the answer
+type khojProgress struct {
+	Kind string // progressStatus or progressThought
+	Text string
+}
+
+// Kinds of khojProgress
+const (
+	progressStatus  = "status"  // A research step, such as "Searching notes for: ..."
+	progressThought = "thought" // A piece of the agent's reasoning, streamed in chunks like the answer
+)
+
+// khojStreamEvent applies one event of Khoj's chat stream to resp and returns the answer text or the progress update
+// it carries. Answer chunks are sent as plain text; status, thoughts, references and metadata are JSON objects with
+// a type and data. Generated images are kept in resp.Images; other event types, such as usage, are skipped.
+func khojStreamEvent(resp *KhojResponse, event string) (text string, progress khojProgress) {
+	trimmed := strings.TrimSpace(event)
+	if !strings.HasPrefix(trimmed, "{") || !strings.HasSuffix(trimmed, "}") {
+		return event, progress
+	}
+	var ev struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(trimmed), &ev); err != nil || ev.Type == "" {
+		return event, progress // An answer chunk that happens to look like JSON
+	}
+
+	switch ev.Type {
+	case "message":
+		json.Unmarshal(ev.Data, &text)
+		return text, progress
+	case progressStatus, progressThought:
+		progress.Kind = ev.Type
+		json.Unmarshal(ev.Data, &progress.Text)
+		return "", progress
+	case "references":
+		var refs struct {
+			Context       []map[string]interface{} `json:"context"`
+			OnlineContext map[string]interface{}   `json:"onlineContext"`
+		}
+		if json.Unmarshal(ev.Data, &refs) == nil {
+			resp.Context = append(resp.Context, refs.Context...)
+			if len(refs.OnlineContext) > 0 {
+				resp.OnlineContext = refs.OnlineContext
+			}
+		}
+	case "metadata":
+		var meta struct {
+			ConversationID string `json:"conversationId"`
+		}
+		if json.Unmarshal(ev.Data, &meta) == nil && meta.ConversationID != "" {
+			resp.ConversationID = meta.ConversationID
+		}
+	case "generated_assets":
+		var assets struct {
+			Images []string `json:"images"`
+		}
+		if json.Unmarshal(ev.Data, &assets) == nil {
+			resp.Images = append(resp.Images, assets.Images...)
+		}
+	}
+	return "", progress
+}
+
+func NewKhojProviderWithTimeout(apiBase, apiKey string, timeout time.Duration) *KhojProvider {
+	return &KhojProvider{
+		APIBase: apiBase,
+		APIKey:  apiKey,
+		HTTPClient: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+				DisableKeepAlives:   false,
+			},
+		},
+		MCPManager: newMCPToolManager(),
+		toolSlots:  make(chan struct{}, positiveOrDefault(appConfig().ToolExecution.MaxParallel, defaultToolParallel)),
+	}
+}
+
+// routeChatRequest tags a request's context with its scratchpad origin, its client's conversation and its priority.
+// newConversation starts a fresh conversation for an identified client.
+func (kp *KhojProvider) routeChatRequest(r *http.Request, req *ChatCompletionRequest, newConversation bool) (*http.Request, error) {
+	// The client and X-Khoj-Workspace pick the scratchpad the answer is recorded in
+	r = r.WithContext(withScratchpadOrigin(r.Context(), apiScratchpadOrigin(r, req)))
+
+	// Stateless requests get a conversation of their own, deleted once the request ends
+	if appConfig().apiConversationMode() == apiConversationsStateless {
+		convID, err := createNewConversation(kp.APIBase, kp.APIKey)
+		if err != nil {
+			logRequest(r.Context(), "Error creating stateless conversation: %v", err)
+			return r, fmt.Errorf("failed to create stateless conversation: %w", err)
+		}
+		r = r.WithContext(withStatelessConversation(withConversationID(r.Context(), convID)))
+		if !appConfig().APIConversations.KeepStateless {
+			context.AfterFunc(r.Context(), func() {
+				if err := deleteKhojConversation(kp.APIBase, kp.APIKey, convID); err != nil {
+					logRequest(r.Context(), "Failed to delete stateless conversation %s: %v", convID, err)
+				}
+			})
+		}
+	}
+
+	// Route identified clients to their own conversation
+	if client := clientIdentity(r, req); client != "" && appConfig().apiConversationMode() == apiConversationsPerClient {
+		if newConversation {
+			clientMappings.Forget(client)
+		}
+		convID, err := clientMappings.ConversationFor(kp.APIBase, kp.APIKey, client)
+		if err != nil {
+			logRequest(r.Context(), "Error resolving conversation for client %s: %v", client, err)
+			return r, fmt.Errorf("failed to create conversation for client %s: %w", client, err)
+		}
+		r = r.WithContext(withConversationID(r.Context(), convID))
+	}
+
+	// Background requests yield Khoj capacity to interactive ones
+	class := classifyRequest(r, req)
+	r = r.WithContext(withRequestClass(r.Context(), class))
+	if class == classBackground {
+		logRequest(r.Context(), "Request classified as background")
+	}
+	return r, nil
+}
+
+func (kp *KhojProvider) handleStreamingRequest(w http.ResponseWriter, r *http.Request, req *ChatCompletionRequest) {
+	stream := &completionStream{w: w, id: fmt.Sprintf("chatcmpl-%d", time.Now().Unix()), created: time.Now().Unix(), model: req.Model, stop: req.stopSequences(), includeUsage: req.includeUsage()}
+	stream.logprobs, stream.topLogprobs, stream.encoding = req.wantsLogprobs(), req.TopLogprobs, tokenEncodingFor(req.Model, "")
+	stream.reasoning = req.Reasoning
+	kp.serveStream(w, r, req, stream)
+}
+
+// serveStream sends the event stream headers and streams the answer to req through stream
+func (kp *KhojProvider) serveStream(w http.ResponseWriter, r *http.Request, req *ChatCompletionRequest, stream *completionStream) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	ctx := r.Context()
+	progress := startRequestProgress(ctx, "Chat")
+	// The echoed prompt is not searched for stop sequences
+	if stream.echo != "" && stream.send(map[string]interface{}{"content": stream.echo}, nil, nil) != nil {
+		progress.Done(fmt.Errorf("client disconnected"))
+		return
+	}
+	kp.streamChatCompletion(ctx, stream, req, progress)
+}
+
+// streamChatCompletion answers a streaming chat completion. Answers that post-processing leaves unchanged are
+// relayed from Khoj's stream as they arrive; the rest are completed first and then sent in small deltas.
+func (kp *KhojProvider) streamChatCompletion(ctx context.Context, stream *completionStream, req *ChatCompletionRequest, progress *progressReporter) {
+	turn, err := kp.prepareChatTurn(ctx, req)
+	if err != nil {
+		logRequest(ctx, "Error in HandleChatCompletion: %v", err)
+		progress.Done(err)
+		stream.Fail(err)
+		return
+	}
+	stream.encoding, stream.fingerprint = turn.encoding(), turn.fingerprint()
+	if reason := turn.bufferReason(ctx); reason != "" {
+		logRequest(ctx, "Streaming the answer after Khoj finishes: %s", reason)
+		kp.streamCompletedTurn(ctx, stream, turn, progress)
+		return
+	}
+
+	stream.maxTokens = req.MaxTokens
+	var streamed strings.Builder
+	khojResp, err := kp.streamKhojAPI(ctx, turn.khojReq, func(delta string) error {
+		if err := stream.Delta(delta); err != nil {
+			return fmt.Errorf("client disconnected: %w", err)
+		}
+		streamed.WriteString(delta)
+		progress.Update(streamed.String())
+		if stream.limited {
+			return errMaxTokensReached
+		}
+		return nil
+	}, func(update khojProgress) error {
+		if err := stream.Progress(update); err != nil {
+			return fmt.Errorf("client disconnected: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, errMaxTokensReached) {
+		// Khoj's stream is closed early, so the rest of the answer is never generated
+		logRequest(ctx, "✂️ Stopped streaming at max_tokens (%d)", req.MaxTokens)
+		sentAttachments.Record(turn.khojConvID, turn.sentFiles)
+		progress.Done(nil)
+		answer := stream.answer.String()
+		appendScratchpad(scratchpadOriginFrom(ctx), turn.original.lastUserMessage(), answer)
+		stream.usage = turn.usage(answer)
+		stream.Finish("length", turn.budget, upstreamStatsFrom(ctx).annotation(turn.agent, turn.khojConvID))
+		return
+	}
+	if err != nil {
+		if streamed.Len() == 0 {
+			if retryCtx, newID := repairConversation(ctx, kp.APIBase, kp.APIKey, turn.khojConvID, err); newID != "" {
+				kp.streamChatCompletion(retryCtx, stream, turn.original, progress)
+				return
+			}
+		}
+		if streamed.Len() == 0 && ctx.Err() == nil && startAgentFallback(kp.APIBase, kp.APIKey, turn.convID, turn.agent, err) {
+			kp.streamChatCompletion(ctx, stream, turn.original, progress)
+			return
+		}
+		logRequest(ctx, "Error streaming chat completion: %v", err)
+		progress.Done(err)
+		stream.Fail(fmt.Errorf("khoj API call failed: %w", err))
+		return
+	}
+	sentAttachments.Record(turn.khojConvID, turn.sentFiles)
+	logRequest(ctx, "Streamed %d characters from Khoj", len(khojResp.Response))
+
+	// The answer went out as Khoj wrote it, so configured footers follow as one more delta
+	answer := strings.TrimRight(khojResp.Response, " \t\r\n")
+	if full := activeFooter.Apply(khojResp, responseTargetAPI); len(full) > len(answer) && strings.HasPrefix(full, answer) {
+		if err := stream.Delta(full[len(answer):]); err != nil {
+			progress.Done(fmt.Errorf("client disconnected"))
+			return
+		}
+		streamed.WriteString(full[len(answer):])
+		progress.Update(streamed.String())
+	}
+
+	progress.Done(nil)
+	answer = streamed.String()
+	if i := stopIndex(answer, stream.stop); i >= 0 {
+		answer = answer[:i]
+	}
+	appendScratchpad(scratchpadOriginFrom(ctx), turn.original.lastUserMessage(), answer)
+	stream.usage = turn.usage(answer)
+	stream.Finish("stop", turn.budget, upstreamStatsFrom(ctx).annotation(turn.agent, turn.khojConvID))
+}
+
+// errMaxTokensReached ends Khoj's stream once a streamed answer reaches max_tokens
+var errMaxTokensReached = errors.New("max_tokens reached")
+
+// bufferReason says why a turn's answer can't be relayed while Khoj streams it, or returns "" when it can.
+// Background requests are buffered because preempting them restarts the request.
+func (t *chatTurn) bufferReason(ctx context.Context) string {
+	switch {
+	case appConfig().Stream.Buffered:
+		return "stream.buffered is set"
+	case requestClassFrom(ctx) == classBackground:
+		return "background request"
+	case t.req.jsonMode():
+		return "JSON mode"
+	case t.req.toolsEnabled():
+		return "tool calling"
+	case t.req.Output != "" && t.req.Output != outputModeFull:
+		return "khoj_output " + t.req.Output
+	case maxAnswerChars(t.req.Verbosity) > 0:
+		return "answer length limit"
+	case activeOutputFilter != nil:
+		return "output filter"
+	case activeFooter != nil && activeFooter.targets[responseTargetAPI] && len(activeFooter.suppress) > 0:
+		return "footer suppress patterns"
+	}
+	return ""
+}
+
+// khoj_reasoning values; without one, progress updates are sent as stream.status says
+const (
+	reasoningContent = "content"
+	reasoningOff     = "off"
+)
+
+// How Khoj's status updates are sent to streaming clients
+const (
+	streamStatusComment = "comment"
+	streamStatusDelta   = "delta"
+	streamStatusOff     = "off"
+)
+
+// streamStatus returns the configured stream.status, defaulting to comments
+func (cfg *AppConfig) streamStatus() string {
+	if cfg.Stream.Status == "" {
+		return streamStatusComment
+	}
+	return cfg.Stream.Status
+}
+
+// streamCompletedTurn waits for the whole post-processed answer and sends it in small deltas
+func (kp *KhojProvider) streamCompletedTurn(ctx context.Context, stream *completionStream, turn *chatTurn, progress *progressReporter) {
+	resp, err := kp.completeChatTurn(ctx, turn)
+	if err != nil {
+		logRequest(ctx, "Error in HandleChatCompletion: %v", err)
+		progress.Done(err)
+		stream.Fail(err)
+		return
+	}
+
+	stream.usage = resp.Usage
+	if calls := resp.Choices[0].Message.ToolCalls; len(calls) > 0 {
+		progress.Done(nil)
+		if stream.ToolCalls(calls) == nil {
+			stream.Finish(resp.Choices[0].FinishReason, resp.KhojBudget, resp.XKhoj)
+		}
+		return
+	}
+
+	content := resp.Choices[0].Message.Content
+	chunkSize := 50
+
+	// JSON mode deltas carry whole values so clients never see a token split inside a string
+	var deltas []string
+	if turn.req.jsonMode() {
+		var assembler jsonAssembler
+		for i := 0; i < len(content); i += chunkSize {
+			deltas = append(deltas, assembler.Write(content[i:min(i+chunkSize, len(content))])...)
+		}
+		if rest, ok := assembler.Flush(); ok {
+			deltas = append(deltas, rest)
+		}
+	} else {
+		for i := 0; i < len(content); i += chunkSize {
+			deltas = append(deltas, content[i:min(i+chunkSize, len(content))])
+		}
+	}
+
+	var streamed strings.Builder
+	for _, delta := range deltas {
+		select {
+		case <-ctx.Done():
+			logRequest(ctx, "Client disconnected during streaming")
+			progress.Done(fmt.Errorf("client disconnected"))
+			return
+		default:
+		}
+
+		if err := stream.Delta(delta); err != nil {
+			logRequest(ctx, "Error writing chunk: %v", err)
+			progress.Done(fmt.Errorf("client disconnected"))
+			return
+		}
+		streamed.WriteString(delta)
+		progress.Update(streamed.String())
+
+		time.Sleep(5 * time.Millisecond)
+	}
+	progress.Done(nil)
+	appendScratchpad(scratchpadOriginFrom(ctx), turn.original.lastUserMessage(), content)
+	stream.Finish(resp.Choices[0].FinishReason, resp.KhojBudget, resp.XKhoj)
+}
+
+// completionStream writes OpenAI chat.completion.chunk events to a streaming client, or text_completion events for
+// /v1/completions
+type completionStream struct {
+	w       http.ResponseWriter
+	id      string
+	created int64
+	model   string
+
+	stop []string // The answer ends before the first of these
+
+	// With max_tokens, the answer ends once this many tokens were sent
+	maxTokens int
+	limited   bool
+	answer    strings.Builder // Answer text sent so far
+
+	// With stream_options.include_usage, Finish sends usage in a last chunk before [DONE]
+	includeUsage bool
+	usage        Usage
+
+	fingerprint string // system_fingerprint, known once the turn is prepared
+
+	reasoning     string // khoj_reasoning: how status updates and thoughts are sent
+	reasoningOpen bool   // The last reasoning_content delta didn't end its line
+
+	// With logprobs, each delta carries synthesized logprobs for its text
+	logprobs    bool
+	topLogprobs int
+	encoding    string
+	sent        int // Bytes of text sent, for text_offset
+
+	// Text completions only
+	text    bool
+	echo    string // The prompt, sent before the answer
+	held    string // Answer text that may be the start of a stop sequence
+	stopped bool
+}
+
+// Delta sends one piece of the answer. With stop sequences, text that could begin one is held back, and everything
+// after one is dropped.
+func (s *completionStream) Delta(content string) error {
+	if s.stopped {
+		return nil
+	}
+	if len(s.stop) == 0 {
+		return s.emit(content)
+	}
+
+	s.held += content
+	if i := stopIndex(s.held, s.stop); i >= 0 {
+		s.stopped = true
+		text := s.held[:i]
+		s.held = ""
+		return s.emit(text)
+	}
+
+	longest := 0
+	for _, stop := range s.stop {
+		longest = max(longest, len(stop))
+	}
+	cut := len(s.held) - (longest - 1)
+	for cut > 0 && !utf8.RuneStart(s.held[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		return nil
+	}
+	text := s.held[:cut]
+	s.held = s.held[cut:]
+	return s.emit(text)
+}
+
+// emit sends answer text, cutting it where the answer reaches max_tokens. The whole answer is counted each time,
+// since a word split between deltas is often a single token.
+func (s *completionStream) emit(text string) error {
+	if s.maxTokens > 0 && text != "" {
+		sent := s.answer.Len()
+		if cut, over := truncateToTokens(s.encoding, s.answer.String()+text, s.maxTokens); over {
+			text = ""
+			if len(cut) > sent {
+				text = cut[sent:]
+			}
+			s.stopped, s.limited, s.held = true, true, ""
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	s.answer.WriteString(text)
+	return s.send(map[string]interface{}{"content": text}, nil, nil)
+}
+
+// ToolCalls sends the agent's tool calls as one delta
+func (s *completionStream) ToolCalls(calls []ToolCall) error {
+	deltas := make([]map[string]interface{}, len(calls))
+	for i, call := range calls {
+		deltas[i] = map[string]interface{}{"index": i, "id": call.ID, "type": call.Type, "function": call.Function}
+	}
+	return s.send(map[string]interface{}{"role": "assistant", "tool_calls": deltas}, nil, nil)
+}
+
+// Progress passes one of Khoj's progress updates on. With khoj_reasoning content, status updates and thoughts go
+// out as reasoning_content deltas, and with khoj_reasoning off they are dropped. Otherwise each is sent as
+// stream.status says: as an SSE comment, which clients ignore unless they look for it, as an x_khoj_status field in
+// an otherwise empty delta, or not at all.
+func (s *completionStream) Progress(update khojProgress) error {
+	if s.stopped {
+		return nil
+	}
+	switch s.reasoning {
+	case reasoningOff:
+		return nil
+	case reasoningContent:
+		text := update.Text
+		if update.Kind == progressStatus {
+			// Steps stay on lines of their own between the thoughts
+			text = strings.TrimSpace(text) + "\n"
+			if s.reasoningOpen {
+				text = "\n" + text
+			}
+		}
+		s.reasoningOpen = !strings.HasSuffix(text, "\n")
+		return s.send(map[string]interface{}{"reasoning_content": text}, nil, nil)
+	}
+
+	status := strings.Join(strings.Fields(update.Text), " ")
+	if status == "" {
+		return nil
+	}
+	switch appConfig().streamStatus() {
+	case streamStatusOff:
+		return nil
+	case streamStatusDelta:
+		return s.send(map[string]interface{}{"x_khoj_status": status}, nil, nil)
+	}
+	if _, err := fmt.Fprintf(s.w, ": status %s\n\n", status); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Finish sends the last chunk with the finish reason and the budget and annotation extensions, then [DONE]
+func (s *completionStream) Finish(finishReason string, budget *BudgetReport, annotation *KhojAnnotation) {
+	if s.held != "" {
+		if s.emit(s.held) != nil {
+			return
+		}
+		s.held = ""
+	}
+	switch {
+	case s.limited:
+		finishReason = "length"
+	case s.stopped:
+		finishReason = "stop"
+	}
+
+	extra := map[string]interface{}{}
+	if budget != nil {
+		extra["khoj_budget"] = budget
+	}
+	if annotation != nil {
+		extra["x_khoj"] = annotation
+	}
+	if s.send(map[string]interface{}{}, finishReason, extra) != nil {
+		return
+	}
+	if s.includeUsage && s.write(s.chunk([]map[string]interface{}{}, map[string]interface{}{"usage": s.usage})) != nil {
+		return
+	}
+	fmt.Fprintf(s.w, "data: [DONE]\n\n")
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Fail sends an error event in place of the rest of the answer
+func (s *completionStream) Fail(err error) {
+	errorData, _ := json.Marshal(openAIError(err))
+	fmt.Fprintf(s.w, "data: %s\n\n", errorData)
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *completionStream) send(delta map[string]interface{}, finishReason interface{}, extra map[string]interface{}) error {
+	text, _ := delta["content"].(string)
+	choice := map[string]interface{}{
+		"index":         0,
+		"delta":         delta,
+		"finish_reason": finishReason,
+	}
+	if s.logprobs && text != "" {
+		choice["logprobs"] = synthesizedLogprobs(s.encoding, text, s.topLogprobs)
+	}
+	if s.text {
+		choice = map[string]interface{}{
+			"index":         0,
+			"text":          text,
+			"logprobs":      nil,
+			"finish_reason": finishReason,
+		}
+		if status, ok := delta["x_khoj_status"]; ok {
+			choice["x_khoj_status"] = status
+		}
+		if s.logprobs && text != "" {
+			choice["logprobs"] = synthesizedCompletionLogprobs(s.encoding, text, s.sent, s.topLogprobs)
+		}
+		s.sent += len(text)
+	}
+	return s.write(s.chunk([]map[string]interface{}{choice}, extra))
+}
+
+// chunk builds an event holding choices and the fields in extra. As in OpenAI's API, streams that end with usage
+// have a null usage in every other chunk.
+func (s *completionStream) chunk(choices []map[string]interface{}, extra map[string]interface{}) map[string]interface{} {
+	object := "chat.completion.chunk"
+	if s.text {
+		object = "text_completion"
+	}
+	chunk := map[string]interface{}{
+		"id":      s.id,
+		"object":  object,
+		"created": s.created,
+		"model":   s.model,
+		"choices": choices,
+	}
+	if s.fingerprint != "" {
+		chunk["system_fingerprint"] = s.fingerprint
+	}
+	if s.includeUsage {
+		chunk["usage"] = nil
+	}
+	for key, value := range extra {
+		chunk[key] = value
+	}
+	return chunk
+}
+
+// write sends one event and flushes it to the client
+func (s *completionStream) write(chunk map[string]interface{}) error {
+	chunkData, _ := json.Marshal(chunk)
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", chunkData); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// maxStopSequences is the most stop sequences a completion request may have, as in OpenAI's API
+const maxStopSequences = 4
+
+// maxCompletionLogprobs is the most alternatives per token a text completion may ask for, as in OpenAI's API
+const maxCompletionLogprobs = 5
+
+// handleCompletions serves the legacy /v1/completions API for tools that can't send chat messages. The prompt, and
+// the suffix for fill-in-the-middle requests, become one chat message asking for only the missing text.
+func (kp *KhojProvider) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creq CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&creq); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	prompt, err := completionPrompt(creq.Prompt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stop, err := stopSequences(creq.Stop)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if creq.N > 1 || creq.BestOf > 1 {
+		http.Error(w, "n and best_of greater than 1 are not supported", http.StatusBadRequest)
+		return
+	}
+	if creq.Logprobs != nil && (*creq.Logprobs < 0 || *creq.Logprobs > maxCompletionLogprobs) {
+		http.Error(w, fmt.Sprintf("logprobs must be between 0 and %d, got %d", maxCompletionLogprobs, *creq.Logprobs), http.StatusBadRequest)
+		return
+	}
+	logprobs := creq.Logprobs != nil && !appConfig().Logprobs.Disabled
+	req := chatRequestForCompletion(&creq, prompt)
+	if err := req.samplingError(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validOutputMode(req.Output) {
+		http.Error(w, fmt.Sprintf("Invalid khoj_output %q (expected full, code or first_code)", req.Output), http.StatusBadRequest)
+		return
+	}
+
+	r, err = kp.routeChatRequest(r, req, false)
+	if err != nil {
+		http.Error(w, "Failed to create conversation", http.StatusBadGateway)
+		return
+	}
+
+	id := fmt.Sprintf("cmpl-%d", time.Now().Unix())
+	if req.Stream {
+		stream := &completionStream{w: w, id: id, created: time.Now().Unix(), model: req.Model, text: true, stop: stop, includeUsage: req.includeUsage()}
+		if creq.Echo {
+			stream.echo = prompt
+		}
+		if logprobs {
+			stream.logprobs, stream.topLogprobs, stream.encoding = true, *creq.Logprobs, tokenEncodingFor(req.Model, "")
+		}
+		kp.serveStream(w, r, req, stream)
+		return
+	}
+
+	progress := startRequestProgress(r.Context(), "Completion")
+	resp, err := kp.HandleChatCompletion(r.Context(), req)
+	if err != nil {
+		logRequest(r.Context(), "Error handling completion: %v", err)
+		progress.Done(err)
+		var denied *teamDeniedError
+		if errors.As(err, &denied) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(openAIError(err))
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	text := resp.Choices[0].Message.Content
+	progress.Update(text)
+	progress.Done(nil)
+	appendScratchpad(scratchpadOriginFrom(r.Context()), req.lastUserMessage(), text)
+
+	finishReason := resp.Choices[0].FinishReason
+	if i := stopIndex(text, stop); i >= 0 {
+		text, finishReason = text[:i], "stop"
+	}
+	if creq.Echo {
+		text = prompt + text
+	}
+	choice := CompletionChoice{Text: text, FinishReason: finishReason}
+	if logprobs {
+		choice.Logprobs = synthesizedCompletionLogprobs(tokenEncodingFor(req.Model, ""), text, 0, *creq.Logprobs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CompletionResponse{
+		ID:         id,
+		Object:     "text_completion",
+		Created:    resp.Created,
+		Model:      resp.Model,
+		Choices:    []CompletionChoice{choice},
+		Usage:      resp.Usage,
+		KhojBudget: resp.KhojBudget,
+		XKhoj:      resp.XKhoj,
+
+		SystemFingerprint: resp.SystemFingerprint,
+	})
+}
+
+// chatRequestForCompletion turns a text completion into a chat completion asking the agent to continue the prompt,
+// or to fill in the gap between the prompt and the suffix
+func chatRequestForCompletion(creq *CompletionRequest, prompt string) *ChatCompletionRequest {
+	var content string
+	if creq.Suffix != "" {
+		content = "Fill in the text that belongs between the prefix and the suffix below. Reply with only the missing text, " +
+			"without repeating the prefix or the suffix and without any explanation.\n\n" +
+			"Prefix:\n" + prompt + "\n\nSuffix:\n" + creq.Suffix
+	} else {
+		content = "Continue the text below from exactly where it stops. Reply with only the continuation, " +
+			"without repeating the text and without any explanation.\n\n" + prompt
+	}
+
+	output := creq.Output
+	if output == "" && creq.Suffix != "" {
+		// Inserted code is often fenced, which would break the file it goes into
+		output = outputModeFirstCode
+	}
+	return &ChatCompletionRequest{
+		Model:       creq.Model,
+		Messages:    []Message{{Role: "user", Content: content}},
+		Temperature: creq.Temperature,
+		TopP:        creq.TopP,
+		MaxTokens:   creq.MaxTokens,
+		Stream:      creq.Stream,
+		Purpose:     creq.Purpose,
+		Output:      output,
+		User:        creq.User,
+		Seed:        creq.Seed,
+
+		StreamOptions: creq.StreamOptions,
+	}
+}
+
+// completionPrompt reads a completion prompt: a string, or an array holding one string. Token arrays are rejected
+// since Khoj takes text.
+func completionPrompt(raw json.RawMessage) (string, error) {
+	var prompt string
+	if err := json.Unmarshal(raw, &prompt); err == nil {
+		return prompt, nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(raw, &prompts); err != nil {
+		return "", fmt.Errorf("prompt must be a string or an array of strings")
+	}
+	if len(prompts) != 1 {
+		return "", fmt.Errorf("prompt must hold exactly one string, got %d", len(prompts))
+	}
+	return prompts[0], nil
+}
+
+// stopSequences reads the stop field: missing, a string or an array of up to maxStopSequences strings
+func stopSequences(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var stop string
+	if err := json.Unmarshal(raw, &stop); err == nil {
+		if stop == "" {
+			return nil, nil
+		}
+		return []string{stop}, nil
+	}
+	var stops []string
+	if err := json.Unmarshal(raw, &stops); err != nil {
+		return nil, fmt.Errorf("stop must be a string or an array of strings")
+	}
+	if len(stops) > maxStopSequences {
+		return nil, fmt.Errorf("stop may hold at most %d sequences, got %d", maxStopSequences, len(stops))
+	}
+	var nonEmpty []string
+	for _, stop := range stops {
+		if stop != "" {
+			nonEmpty = append(nonEmpty, stop)
+		}
+	}
+	return nonEmpty, nil
+}
+
+// stopSequences returns the request's stop sequences; the chat handler has already rejected malformed ones
+func (req *ChatCompletionRequest) stopSequences() []string {
+	stops, _ := stopSequences(req.Stop)
+	return stops
+}
+
+// includeUsage reports whether a streamed answer should end with a usage chunk
+func (req *ChatCompletionRequest) includeUsage() bool {
+	return req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+}
+
+// stopIndex returns where the first stop sequence in text begins, or -1 when there is none
+func stopIndex(text string, stops []string) int {
+	first := -1
+	for _, stop := range stops {
+		if i := strings.Index(text, stop); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// agentListTTL is how long the agents list from Khoj is reused for /v1/models
+const agentListTTL = 5 * time.Minute
+
+var (
+	agentList   []KhojAgent
+	agentListAt time.Time
+	agentListMu sync.Mutex
+)
+
+// handleModels lists the Khoj agents as OpenAI models for client model pickers: GET /v1/models for all of them,
+// GET /v1/models/{slug} for one
+func (kp *KhojProvider) handleModels(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agents, err := kp.khojAgents(r.Context())
+	if err != nil {
+		logRequest(r.Context(), "Error listing Khoj agents: %v", err)
+		http.Error(w, "Failed to list Khoj agents", http.StatusBadGateway)
+		return
+	}
+	models := agentModels(agents, currentAgentSlug)
+
+	w.Header().Set("Content-Type", "application/json")
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/models"), "/"); id != "" {
+		for _, model := range models {
+			if model.ID == id {
+				json.NewEncoder(w).Encode(model)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("Model %q not found", id), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(ModelList{Object: "list", Data: models})
+}
+
+// khojAgents returns the agents Khoj lists for the API key, reusing the last list for agentListTTL. When Khoj
+// can't be reached, the last list is used as long as there is one.
+func (kp *KhojProvider) khojAgents(ctx context.Context) ([]KhojAgent, error) {
+	agentListMu.Lock()
+	defer agentListMu.Unlock()
+	if agentList != nil && time.Since(agentListAt) < agentListTTL {
+		return agentList, nil
+	}
+
+	agents, err := fetchKhojAgents(ctx, kp.HTTPClient, kp.APIBase, kp.APIKey)
+	if err != nil {
+		if agentList != nil {
+			log.Printf("⚠️ Using the agents listed %v ago: %v", time.Since(agentListAt).Round(time.Second), err)
+			return agentList, nil
+		}
+		return nil, err
+	}
+	log.Printf("🤖 Khoj lists %d agents", len(agents))
+	agentList, agentListAt = agents, time.Now()
+	return agents, nil
+}
+
+// fetchKhojAgents gets the agents from Khoj's /api/agents
+func fetchKhojAgents(ctx context.Context, client *http.Client, apiBase, apiKey string) ([]KhojAgent, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+"/api/agents", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	setRequestIDHeader(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agents: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agents: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &khojStatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+
+	var agents []KhojAgent
+	if err := json.Unmarshal(body, &agents); err != nil {
+		return nil, fmt.Errorf("failed to decode agents: %w", err)
+	}
+	return agents, nil
+}
+
+// agentModels turns agents into model objects sorted by slug, with the current agent first. The current agent is
+// added when Khoj doesn't list it, e.g. a private agent shared by its slug.
+func agentModels(agents []KhojAgent, current string) []ModelObject {
+	models := make([]ModelObject, 0, len(agents)+1)
+	seen := map[string]bool{}
+	for _, agent := range agents {
+		if agent.Slug == "" || seen[agent.Slug] {
+			continue
+		}
+		seen[agent.Slug] = true
+		owner := agent.Creator
+		if owner == "" {
+			owner = "khoj"
+		}
+		name := agent.Name
+		if name == "" {
+			name = agent.Slug
+		}
+		models = append(models, ModelObject{
+			ID:      agent.Slug,
+			Object:  "model",
+			OwnedBy: owner,
+			XKhoj:   &ModelAnnotation{Name: name, ChatModel: agent.ChatModel, Current: agent.Slug == current},
+		})
+	}
+	if current != "" && !seen[current] {
+		models = append(models, ModelObject{ID: current, Object: "model", OwnedBy: "khoj", XKhoj: &ModelAnnotation{Name: current, Current: true}})
+	}
+
+	sort.SliceStable(models, func(i, j int) bool {
+		if models[i].XKhoj.Current != models[j].XKhoj.Current {
+			return models[i].XKhoj.Current
+		}
+		return models[i].ID < models[j].ID
+	})
+	return models
+}
+
+// Embedding backends
+const (
+	embeddingsLocal       = "local"
+	embeddingsHuggingFace = "huggingface"
+	embeddingsOpenAI      = "openai"
+)
+
+const (
+	defaultLocalEmbeddingDims = 384
+	maxLocalEmbeddingDims     = 4096
+	localEmbeddingModel       = "khoj-wrapper-local"
+	maxEmbeddingInputs        = 2048 // Same as OpenAI
+)
+
+// embeddingsBackend returns the configured backend with its default applied, followed by the URL it uses
+func (cfg *AppConfig) embeddingsBackend() string {
+	backend := cfg.Embeddings.Backend
+	switch {
+	case backend == "" && cfg.Embeddings.URL != "":
+		backend = embeddingsHuggingFace
+	case backend == "":
+		return embeddingsLocal + " (default)"
+	}
+	if backend == embeddingsLocal {
+		return backend
+	}
+	return backend + " at " + cfg.Embeddings.URL
+}
+
+// handleEmbeddings answers OpenAI embedding requests with the configured backend, so RAG tools need no second
+// provider. Khoj has no embeddings API, so remote backends call the inference endpoint of Khoj's search model
+// directly.
+func (kp *KhojProvider) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	inputs, err := embeddingInputs(req.Input)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		http.Error(w, fmt.Sprintf("invalid encoding_format %q (expected float or base64)", req.EncodingFormat), http.StatusBadRequest)
+		return
+	}
+
+	cfg := appConfig().Embeddings
+	backend := cfg.Backend
+	if backend == "" && cfg.URL != "" {
+		backend = embeddingsHuggingFace
+	}
+
+	start := time.Now()
+	var vectors [][]float64
+	model := cfg.Model
+	switch backend {
+	case embeddingsHuggingFace, embeddingsOpenAI:
+		if backend == embeddingsHuggingFace && req.Dimensions > 0 {
+			http.Error(w, "dimensions is not supported by the huggingface embeddings backend", http.StatusBadRequest)
+			return
+		}
+		if model == "" {
+			model = req.Model
+		}
+		vectors, err = fetchEmbeddings(r.Context(), kp.HTTPClient, backend, cfg, model, req.Dimensions, inputs)
+		if err != nil {
+			logRequest(r.Context(), "❌ Embeddings from %s failed: %v", cfg.URL, err)
+			http.Error(w, fmt.Sprintf("Embedding backend failed: %v", err), http.StatusBadGateway)
+			return
+		}
+		if model == "" {
+			model = backend
+		}
+	default:
+		dims := cfg.Dimensions
+		if req.Dimensions > 0 {
+			dims = req.Dimensions
+		}
+		if dims == 0 {
+			dims = defaultLocalEmbeddingDims
+		}
+		if dims > maxLocalEmbeddingDims {
+			http.Error(w, fmt.Sprintf("dimensions must be at most %d", maxLocalEmbeddingDims), http.StatusBadRequest)
+			return
+		}
+		if model == "" {
+			model = localEmbeddingModel
+		}
+		for _, input := range inputs {
+			vectors = append(vectors, localEmbedding(input, dims))
+		}
+	}
+	if len(vectors) != len(inputs) {
+		http.Error(w, fmt.Sprintf("Embedding backend returned %d vectors for %d inputs", len(vectors), len(inputs)), http.StatusBadGateway)
+		return
+	}
+
+	resp := EmbeddingResponse{Object: "list", Model: model, Data: make([]EmbeddingObject, len(vectors))}
+	for i, vector := range vectors {
+		resp.Data[i] = EmbeddingObject{Object: "embedding", Index: i, Embedding: vector}
+		if req.EncodingFormat == "base64" {
+			resp.Data[i].Embedding = encodeEmbedding(vector)
+		}
+		resp.Usage.PromptTokens += estimateTokens(inputs[i])
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	logRequest(r.Context(), "🧮 Embedded %d input(s) with %s in %v", len(inputs), model, time.Since(start).Round(time.Millisecond))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// moderationCategories are OpenAI's moderation categories, in the order its API lists them
+var moderationCategories = []string{
+	"harassment", "harassment/threatening", "hate", "hate/threatening", "illicit", "illicit/violent",
+	"self-harm", "self-harm/instructions", "self-harm/intent", "sexual", "sexual/minors", "violence", "violence/graphic",
+}
+
+const (
+	moderationModel            = "khoj-wrapper-moderation"
+	maxModerationInputs        = 32 // The agent check makes one Khoj call per input
+	defaultModerationThreshold = 0.5
+)
+
+// moderationSummary describes the moderation filters and agent in use
+func (cfg *AppConfig) moderationSummary() string {
+	m := cfg.Moderation
+	if len(m.Categories) == 0 && m.Agent == "" {
+		return "no filters, every input passes (default)"
+	}
+	summary := fmt.Sprintf("filters for %d categories", len(m.Categories))
+	if m.Agent != "" {
+		threshold := m.Threshold
+		if threshold == 0 {
+			threshold = defaultModerationThreshold
+		}
+		summary += fmt.Sprintf(", agent %s flags scores from %g", m.Agent, threshold)
+	}
+	return summary
+}
+
+// handleModerations answers OpenAI moderation requests with the configured filters and agent, so clients that check
+// content before sending it keep working. Without either, every input passes.
+func (kp *KhojProvider) handleModerations(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	inputs, err := moderationInputs(req.Input)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := ModerationResponse{ID: "modr-" + randomHex(12), Model: moderationModel, Results: make([]ModerationResult, len(inputs))}
+	flagged := 0
+	for i, input := range inputs {
+		resp.Results[i] = kp.moderate(r.Context(), input)
+		if resp.Results[i].Flagged {
+			flagged++
+		}
+	}
+	logRequest(r.Context(), "🛡️ Moderated %d input(s), %d flagged", len(inputs), flagged)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// moderationInputs reads input: a string, an array of strings checked one by one, or an array of text and image_url
+// parts checked together as one input. Images are not checked, so image parts are skipped.
+func moderationInputs(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if single == "" {
+			return nil, fmt.Errorf("input is required")
+		}
+		return []string{single}, nil
+	}
+
+	var inputs []string
+	if err := json.Unmarshal(raw, &inputs); err != nil {
+		var parts []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(raw, &parts); err != nil {
+			return nil, fmt.Errorf("input must be a string, an array of strings or an array of text and image_url parts")
+		}
+		var texts []string
+		for i, part := range parts {
+			switch part.Type {
+			case "text":
+				texts = append(texts, part.Text)
+			case "image_url":
+			default:
+				return nil, fmt.Errorf("input[%d] has unknown type %q (expected text or image_url)", i, part.Type)
+			}
+		}
+		if len(parts) == 0 {
+			return nil, fmt.Errorf("input is required")
+		}
+		return []string{strings.Join(texts, "\n")}, nil
+	}
+
+	switch {
+	case len(inputs) == 0:
+		return nil, fmt.Errorf("input is required")
+	case len(inputs) > maxModerationInputs:
+		return nil, fmt.Errorf("input has %d items, at most %d are allowed", len(inputs), maxModerationInputs)
+	}
+	return inputs, nil
+}
+
+// moderate checks one input against the filters and, when none matched, asks the moderation agent to score it.
+// A failing agent is logged and leaves the verdict to the filters.
+func (kp *KhojProvider) moderate(ctx context.Context, text string) ModerationResult {
+	result := ModerationResult{
+		Categories:                make(map[string]bool, len(moderationCategories)),
+		CategoryScores:            make(map[string]float64, len(moderationCategories)),
+		CategoryAppliedInputTypes: make(map[string][]string, len(moderationCategories)),
+	}
+	applied := []string{}
+	if text != "" {
+		applied = []string{"text"}
+	}
+	for _, category := range moderationCategories {
+		result.Categories[category] = false
+		result.CategoryScores[category] = 0
+		result.CategoryAppliedInputTypes[category] = applied
+	}
+	if text == "" {
+		return result
+	}
+
+	for category, patterns := range activeModerationFilters {
+		for _, re := range patterns {
+			if re.MatchString(text) {
+				result.Flagged, result.Categories[category], result.CategoryScores[category] = true, true, 1
+				break
+			}
+		}
+	}
+	agent := appConfig().Moderation.Agent
+	if result.Flagged || agent == "" {
+		return result
+	}
+
+	scores, err := kp.moderationScores(ctx, agent, text)
+	if err != nil {
+		logRequest(ctx, "⚠️ Moderation agent %s failed, using the filters only: %v", agent, err)
+		return result
+	}
+	threshold := appConfig().Moderation.Threshold
+	if threshold == 0 {
+		threshold = defaultModerationThreshold
+	}
+	for category, score := range scores {
+		result.CategoryScores[category] = score
+		if score >= threshold {
+			result.Flagged, result.Categories[category] = true, true
+		}
+	}
+	return result
+}
+
+// moderationScores asks agent to score text in each moderation category, returning the known categories it scored
+func (kp *KhojProvider) moderationScores(ctx context.Context, agent, text string) (map[string]float64, error) {
+	prompt := fmt.Sprintf("Score the text below for content moderation. Answer with only a JSON object that gives each of these categories a score from 0 to 1, where 1 means the text clearly belongs to it: %s.\n\nText:\n<<<\n%s\n>>>",
+		strings.Join(moderationCategories, ", "), text)
+	answer, err := kp.runScratchPrompt(ctx, agent, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonModeContent(answer)), &raw); err != nil {
+		return nil, fmt.Errorf("answer is not a JSON object: %w", err)
+	}
+	scores := make(map[string]float64)
+	for category, value := range raw {
+		score, ok := value.(float64)
+		if !ok || !slices.Contains(moderationCategories, category) {
+			continue
+		}
+		scores[category] = math.Min(math.Max(score, 0), 1)
+	}
+	if len(scores) == 0 {
+		return nil, fmt.Errorf("answer scored no known category")
+	}
+	return scores, nil
+}
+
+// maxSpeechInput is the longest text /v1/audio/speech reads out, in characters; the same as OpenAI
+const maxSpeechInput = 4096
+
+// handleSpeech answers OpenAI text-to-speech requests with Khoj's speech API, passing the audio on as Khoj streams it
+func (kp *KhojProvider) handleSpeech(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SpeechRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case strings.TrimSpace(req.Input) == "":
+		http.Error(w, "input is required", http.StatusBadRequest)
+		return
+	case utf8.RuneCountInString(req.Input) > maxSpeechInput:
+		http.Error(w, fmt.Sprintf("input must be at most %d characters", maxSpeechInput), http.StatusBadRequest)
+		return
+	case req.ResponseFormat != "" && req.ResponseFormat != "mp3":
+		http.Error(w, fmt.Sprintf("Unsupported response_format %q (Khoj only produces mp3)", req.ResponseFormat), http.StatusBadRequest)
+		return
+	case req.Speed != 0 && (req.Speed < 0.25 || req.Speed > 4):
+		http.Error(w, "speed must be between 0.25 and 4", http.StatusBadRequest)
+		return
+	}
+
+	httpReq, err := http.NewRequestWithContext(r.Context(), "POST", kp.APIBase+"/api/chat/speech?text="+url.QueryEscape(req.Input), nil)
+	if err != nil {
+		http.Error(w, "Failed to create speech request", http.StatusInternalServerError)
+		return
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	setRequestIDHeader(httpReq)
+
+	start := time.Now()
+	resp, err := kp.HTTPClient.Do(httpReq)
+	if err != nil {
+		logRequest(r.Context(), "❌ Speech request to Khoj failed: %v", err)
+		http.Error(w, "Failed to reach Khoj", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		logRequest(r.Context(), "❌ Khoj text to speech failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		// Client errors such as rate limits are passed on; anything else, including a missing voice model, is a 502
+		status := http.StatusBadGateway
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			status = resp.StatusCode
+		}
+		http.Error(w, fmt.Sprintf("Khoj text to speech failed with status %d", resp.StatusCode), status)
+		return
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				logRequest(r.Context(), "⚠️ Speech client went away after %d bytes: %v", written, err)
+				return
+			}
+			written += int64(n)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logRequest(r.Context(), "⚠️ Speech stream from Khoj ended after %d bytes: %v", written, err)
+			return
+		}
+	}
+	logRequest(r.Context(), "🔊 Spoke %d characters as %d bytes of audio in %v", utf8.RuneCountInString(req.Input), written, time.Since(start).Round(time.Millisecond))
+}
+
+// maxImageDownload bounds a generated image downloaded for a b64_json response
+const maxImageDownload = 32 << 20
+
+// markdownImagePattern matches a markdown image, which some Khoj servers put in the answer instead of an event
+var markdownImagePattern = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)\)`)
+
+// handleImageGenerations draws an image with Khoj's /image command in the client's conversation and returns it
+// as an OpenAI images response
+func (kp *KhojProvider) handleImageGenerations(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ImageGenerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	prompt := strings.TrimSpace(req.Prompt)
+	switch {
+	case prompt == "":
+		http.Error(w, "prompt is required", http.StatusBadRequest)
+		return
+	case req.N > 1:
+		http.Error(w, "n must be 1 (Khoj draws one image per request)", http.StatusBadRequest)
+		return
+	case req.ResponseFormat != "" && req.ResponseFormat != "url" && req.ResponseFormat != "b64_json":
+		http.Error(w, fmt.Sprintf("Unsupported response_format %q (use url or b64_json)", req.ResponseFormat), http.StatusBadRequest)
+		return
+	}
+
+	r, err := kp.routeChatRequest(r, &ChatCompletionRequest{Model: req.Model, User: req.User}, false)
+	if err != nil {
+		http.Error(w, "Failed to create conversation", http.StatusBadGateway)
+		return
+	}
+	ctx := r.Context()
+
+	start := time.Now()
+	logRequest(ctx, "🎨 Generating image: %s", truncateText(prompt, 80))
+	khojResp, err := kp.streamKhojAPI(ctx, &KhojRequest{
+		Q:              "/image " + prompt,
+		ConversationID: conversationFromContext(ctx),
+		ClientID:       "khoj-provider-images",
+	}, func(string) error { return nil }, func(p khojProgress) error {
+		if p.Kind == progressStatus {
+			logRequest(ctx, "🎨 %s", p.Text)
+		}
+		return nil
+	})
+	var denied *teamDeniedError
+	if errors.As(err, &denied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logRequest(ctx, "❌ Image generation failed: %v", err)
+		http.Error(w, "Khoj image generation failed", http.StatusBadGateway)
+		return
+	}
+	images := khojImages(khojResp)
+	if len(images) == 0 {
+		// Khoj answers in text when it has no text-to-image model or refuses the prompt
+		answer := truncateText(strings.TrimSpace(khojResp.Response), 300)
+		logRequest(ctx, "❌ Khoj did not generate an image: %s", answer)
+		http.Error(w, "Khoj did not generate an image: "+answer, http.StatusBadGateway)
+		return
+	}
+
+	revised := ""
+	if len(khojResp.InferredQueries) > 0 {
+		revised = khojResp.InferredQueries[0]
+	}
+	resp := ImageGenerationResponse{Created: time.Now().Unix()}
+	for _, image := range images[:1] {
+		if strings.HasPrefix(image, "/") {
+			image = strings.TrimSuffix(kp.APIBase, "/") + image
+		}
+		data := ImageData{RevisedPrompt: revised}
+		switch {
+		case req.ResponseFormat != "b64_json":
+			data.URL = image
+		case strings.HasPrefix(image, "data:"):
+			_, encoded, ok := strings.Cut(image, ";base64,")
+			if !ok {
+				logRequest(ctx, "❌ Khoj returned an image data URL that isn't base64")
+				http.Error(w, "Khoj returned an unreadable image", http.StatusBadGateway)
+				return
+			}
+			data.B64JSON = encoded
+		default:
+			raw, err := kp.downloadImage(ctx, image)
+			if err != nil {
+				logRequest(ctx, "❌ %v", err)
+				http.Error(w, "Failed to download the generated image", http.StatusBadGateway)
+				return
+			}
+			data.B64JSON = base64.StdEncoding.EncodeToString(raw)
+		}
+		resp.Data = append(resp.Data, data)
+	}
+
+	logRequest(ctx, "🎨 Generated image in %v", time.Since(start).Round(time.Millisecond))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// khojImages returns the images Khoj generated as URLs or data URLs: from the generated assets event, older
+// servers' image field, or else markdown images in the answer
+func khojImages(resp *KhojResponse) []string {
+	images := append([]string(nil), resp.Images...)
+	if image := resp.Image; image != "" {
+		// Only text-to-image2 sends a URL; the others are base64, PNG or, for text-to-image-v3, WebP
+		if !strings.HasPrefix(image, "http") && !strings.HasPrefix(image, "/") && !strings.HasPrefix(image, "data:") {
+			mime := "image/png"
+			if strings.HasSuffix(resp.IntentType, "-v3") {
+				mime = "image/webp"
+			}
+			image = "data:" + mime + ";base64," + image
+		}
+		images = append(images, image)
+	}
+	if len(images) == 0 {
+		for _, m := range markdownImagePattern.FindAllStringSubmatch(resp.Response, -1) {
+			images = append(images, m[1])
+		}
+	}
+	return images
+}
+
+// downloadImage fetches a generated image. Only the Khoj server itself is fetched directly, with the API key; any
+// other URL may come from the answer text, so it goes through the url_fetch guards like client-supplied URLs.
+func (kp *KhojProvider) downloadImage(ctx context.Context, imageURL string) ([]byte, error) {
+	if !strings.HasPrefix(imageURL, strings.TrimSuffix(kp.APIBase, "/")+"/") {
+		raw, _, err := fetchURL(ctx, imageURL, appConfig().URLFetch.imageTypes())
+		if err != nil {
+			return nil, fmt.Errorf("failed to download image: %w", err)
+		}
+		return raw, nil
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image request: %w", err)
+	}
+	if kp.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	}
+	resp, err := kp.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image download failed with status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxImageDownload+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(raw) > maxImageDownload {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxImageDownload)
+	}
+	return raw, nil
+}
+
+// embeddingInputs decodes input as a string or an array of strings. Token arrays are rejected since the wrapper
+// can't know the backend's tokenizer.
+func embeddingInputs(raw json.RawMessage) ([]string, error) {
+	var inputs []string
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		inputs = []string{single}
+	} else if err := json.Unmarshal(raw, &inputs); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of strings; token arrays are not supported")
+	}
+
+	switch {
+	case len(inputs) == 0:
+		return nil, fmt.Errorf("input is required")
+	case len(inputs) > maxEmbeddingInputs:
+		return nil, fmt.Errorf("input has %d items, at most %d are allowed", len(inputs), maxEmbeddingInputs)
+	}
+	for i, input := range inputs {
+		if input == "" {
+			return nil, fmt.Errorf("input[%d] is empty", i)
+		}
+	}
+	return inputs, nil
+}
+
+// fetchEmbeddings embeds inputs with a Hugging Face feature-extraction endpoint, which takes {"inputs": [...]}, or
+// an OpenAI-compatible one, whose URL may be the base or the full /embeddings path
+func fetchEmbeddings(ctx context.Context, client *http.Client, backend string, cfg EmbeddingsConfig, model string, dims int, inputs []string) ([][]float64, error) {
+	endpoint := cfg.URL
+	var payload interface{} = map[string]interface{}{"inputs": inputs}
+	if backend == embeddingsOpenAI {
+		if !strings.HasSuffix(strings.TrimRight(endpoint, "/"), "/embeddings") {
+			endpoint = strings.TrimRight(endpoint, "/") + "/embeddings"
+		}
+		body := map[string]interface{}{"input": inputs, "model": model}
+		if dims > 0 {
+			body["dimensions"] = dims
+		}
+		payload = body
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the embedding endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embeddings: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embedding endpoint answered %d: %s", resp.StatusCode, truncateText(strings.TrimSpace(string(body)), 200))
+	}
+
+	if backend == embeddingsHuggingFace {
+		var vectors [][]float64
+		if err := json.Unmarshal(body, &vectors); err != nil {
+			return nil, fmt.Errorf("failed to decode embeddings, expected one pooled vector per input: %w", err)
+		}
+		return vectors, nil
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings: %w", err)
+	}
+	vectors := make([][]float64, len(result.Data))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding endpoint returned index %d for %d inputs", item.Index, len(inputs))
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	return vectors, nil
+}
+
+// localEmbedding hashes the words and character trigrams of text into a unit vector. It needs no model: texts
+// that share words and spellings end up close, which suits keyword-like retrieval but doesn't capture meaning.
+func localEmbedding(text string, dims int) []float64 {
+	vector := make([]float64, dims)
+	add := func(feature string, weight float64) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		vector[sum%uint64(dims)] += weight
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		add("w:"+word, 1)
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			add("t:"+string(runes[i:i+3]), 0.5)
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
+
+// encodeEmbedding packs a vector as base64 of little-endian float32s, the OpenAI "base64" encoding_format
+func encodeEmbedding(vector []float64) string {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// EditStreamRequest asks for an instruction to be applied to a file with hunks streamed back
+type EditStreamRequest struct {
+	Model       string `json:"model"`
+	Filename    string `json:"filename"`
+	Path        string `json:"path,omitempty"` // File the reviewed result is written to; defaults to filename
+	Original    string `json:"original"`
+	Instruction string `json:"instruction"`
+}
+
+// handleEditStream applies an edit instruction and emits the resulting diff hunks as SSE events
+func (kp *KhojProvider) handleEditStream(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EditStreamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Instruction == "" {
+		http.Error(w, "instruction is required", http.StatusBadRequest)
+		return
+	}
+	if req.Filename == "" {
+		req.Filename = "file"
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	sendEvent := func(event string, payload interface{}) error {
+		data, _ := json.Marshal(payload)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	prompt := fmt.Sprintf("Apply the following instruction to %s. Reply with the complete modified file in a single code block and nothing else.\n\nInstruction: %s\n\n```\n%s\n```",
+		req.Filename, req.Instruction, req.Original)
+
+	streamer := newHunkStreamer(req.Original, func(h DiffHunk) error {
+		return sendEvent("hunk", map[string]interface{}{
+			"filename":  req.Filename,
+			"old_start": h.OldStart,
+			"old_lines": h.OldLines,
+			"new_start": h.NewStart,
+			"new_lines": h.NewLines,
+			"lines":     h.Lines,
+			"patch":     h.Patch(),
+		})
+	})
+
+	// Each edit gets a conversation of its own, so the file never shows up in the user's chat
+	convID, err := createConversationWithAgent(kp.APIBase, kp.APIKey, currentAgentSlug)
+	if err != nil {
+		logRequest(r.Context(), "Edit stream failed: %v", err)
+		sendEvent("error", map[string]string{"message": fmt.Sprintf("failed to create conversation: %v", err)})
+		return
+	}
+	defer func() {
+		if err := deleteKhojConversation(kp.APIBase, kp.APIKey, convID); err != nil {
+			logRequest(r.Context(), "Failed to delete edit conversation %s: %v", convID, err)
+		}
+	}()
+
+	// Complete lines of the code block are diffed as they arrive; hunks the rest of the file can't change go out
+	var answer strings.Builder
+	fed, emitErr := 0, error(nil)
+	khojResp, err := kp.streamKhojAPI(r.Context(), &KhojRequest{
+		Q:              prompt,
+		ConversationID: convID,
+		ClientID:       "khoj-provider-edits",
+	}, func(delta string) error {
+		answer.WriteString(delta)
+		lines := codeBlockLines(answer.String())
+		if len(lines) <= fed {
+			return nil
+		}
+		fed = len(lines)
+		if emitErr = streamer.Feed(lines, false); emitErr != nil {
+			return fmt.Errorf("client disconnected: %w", emitErr)
+		}
+		return nil
+	}, func(khojProgress) error { return nil })
+	if emitErr != nil {
+		logRequest(r.Context(), "Error writing hunk: %v", emitErr)
+		return
+	}
+	if err != nil {
+		logRequest(r.Context(), "Edit stream failed: %v", err)
+		sendEvent("error", map[string]string{"message": err.Error()})
+		return
+	}
+
+	modified := khojResp.Response
+	if blocks := extractCodeBlocks(modified); len(blocks) > 0 {
+		modified = blocks[0]
+	}
+	if err := streamer.Feed(strings.Split(modified, "\n"), true); err != nil {
+		logRequest(r.Context(), "Error writing hunk: %v", err)
+		return
+	}
+
+	path := req.Path
+	if path == "" {
+		path = req.Filename
+	}
+	review := addEditReview(req.Filename, path, req.Original, modified)
+	sendEvent("done", map[string]interface{}{
+		"filename":   req.Filename,
+		"hunks":      streamer.count,
+		"modified":   modified,
+		"review_url": "http://localhost:" + serverPort() + "/dashboard/diff?id=" + review.ID,
+	})
+}
+
+// maxEditReviews bounds the finished edits kept for review on the dashboard
+const maxEditReviews = 20
+
+// editReview is a finished edit kept for review: the original, the modified file and the hunks between them
+type editReview struct {
+	ID       string     `json:"id"`
+	Filename string     `json:"filename"`
+	Path     string     `json:"path"` // Relative paths resolve against the first workspace root
+	Original string     `json:"original"`
+	Modified string     `json:"modified"`
+	Hunks    []DiffHunk `json:"hunks"`
+	Created  time.Time  `json:"created"`
+	Written  string     `json:"written,omitempty"` // Resolved path of the last write
+}
+
+var (
+	editReviews   []*editReview // Oldest first; kept in memory only
+	editReviewSeq atomic.Int64
+	editReviewsMu sync.Mutex
+)
+
+// splitEditLines splits text into lines without their endings, reporting the line ending used and whether the text
+// ends with one
+func splitEditLines(text string) ([]string, string, bool) {
+	newline := "\n"
+	if strings.Contains(text, "\r\n") {
+		newline = "\r\n"
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	final := strings.HasSuffix(text, "\n")
+	if text = strings.TrimSuffix(text, "\n"); text == "" {
+		return nil, newline, final
+	}
+	return strings.Split(text, "\n"), newline, final
+}
+
+// addEditReview keeps a finished edit for review, dropping the oldest beyond maxEditReviews
+func addEditReview(filename, path, original, modified string) *editReview {
+	oldLines, _, _ := splitEditLines(original)
+	newLines, _, _ := splitEditLines(modified)
+	review := &editReview{
+		ID:       strconv.FormatInt(editReviewSeq.Add(1), 10),
+		Filename: filename,
+		Path:     path,
+		Original: original,
+		Modified: modified,
+		Hunks:    groupHunks(diffLines(oldLines, newLines), 3, 0, 0),
+		Created:  time.Now(),
+	}
+
+	editReviewsMu.Lock()
+	editReviews = append(editReviews, review)
+	if len(editReviews) > maxEditReviews {
+		editReviews = append([]*editReview(nil), editReviews[len(editReviews)-maxEditReviews:]...)
+	}
+	editReviewsMu.Unlock()
+	return review
+}
+
+// findEditReviewLocked returns the review with id and its index, or nil; editReviewsMu must be held
+func findEditReviewLocked(id string) (*editReview, int) {
+	for i, review := range editReviews {
+		if review.ID == id {
+			return review, i
+		}
+	}
+	return nil, -1
+}
+
+// applyHunks returns original with only the accepted hunks applied; the hunks must come from diffing original
+func applyHunks(original []string, hunks []DiffHunk, accepted map[int]bool) []string {
+	var result []string
+	pos := 0
+	for i, h := range hunks {
+		start := h.OldStart - 1
+		if h.OldLines == 0 {
+			start = h.OldStart // Empty ranges start at the preceding line
+		}
+		result = append(result, original[pos:start]...)
+		pos = start + h.OldLines
+		if !accepted[i] {
+			result = append(result, original[start:pos]...)
+			continue
+		}
+		for _, line := range h.Lines {
+			if line[0] != '-' {
+				result = append(result, line[1:])
+			}
+		}
+	}
+	return append(result, original[pos:]...)
+}
+
+// workspacePath resolves path inside one of the workspace roots, following symlinks so none can lead outside them
+func workspacePath(path string) (string, error) {
+	roots := appConfig().Workspace.Roots
+	if len(roots) == 0 {
+		return "", fmt.Errorf("no workspace configured; set workspace.roots in %s", configFile)
+	}
+	if strings.TrimSpace(path) == "" {
+		return "", fmt.Errorf("no path to write to")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(roots[0], path)
+	}
+	path = filepath.Clean(path)
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// A new file: its directory must exist and resolve inside the workspace
+		var dir string
+		if dir, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			resolved = filepath.Join(dir, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+
+	for _, root := range roots {
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(resolvedRoot, resolved)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the workspace", path)
+}
+
+// writeEditReview writes the original with the accepted hunks applied to path inside the workspace. Unless force is
+// set it refuses with errEditConflict when the file no longer matches the edit's original.
+func writeEditReview(review *editReview, path string, accepted map[int]bool, force bool) (string, error) {
+	target, err := workspacePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	mode := os.FileMode(0644)
+	current, err := os.ReadFile(target)
+	switch {
+	case err == nil:
+		if info, err := os.Stat(target); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if !force && strings.ReplaceAll(string(current), "\r\n", "\n") != strings.ReplaceAll(review.Original, "\r\n", "\n") {
+			return "", errEditConflict
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if !force && review.Original != "" {
+			return "", errEditConflict
+		}
+	default:
+		return "", fmt.Errorf("failed to read %s: %w", target, err)
+	}
+
+	original, newline, final := splitEditLines(review.Original)
+	if review.Original == "" {
+		_, newline, final = splitEditLines(review.Modified)
+	}
+	lines := applyHunks(original, review.Hunks, accepted)
+	text := strings.Join(lines, newline)
+	if final && len(lines) > 0 {
+		text += newline
+	}
+
+	// Write a sibling file and rename it over the target so a crash never leaves it half written
+	tmp := target + ".khoj-tmp"
+	if err := os.WriteFile(tmp, []byte(text), mode); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to replace %s: %w", target, err)
+	}
+	return target, nil
+}
+
+// errEditConflict reports that the file on disk changed since the edit was made
+var errEditConflict = errors.New("the file on disk no longer matches the edit's original")
+
+// handleDashboardEdits lists edits kept for review (GET), returns one (GET ?id=), writes it with the accepted hunks
+// (POST ?id= {"accepted": [0, 2], "path": "...", "force": false}) or discards it (DELETE ?id=)
+func handleDashboardEdits(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	editReviewsMu.Lock()
+	defer editReviewsMu.Unlock()
+
+	review, index := findEditReviewLocked(id)
+	if id != "" && review == nil {
+		http.Error(w, "Edit not found; only the last 20 edits are kept", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if review == nil {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Accepted []int  `json:"accepted"`
+			Path     string `json:"path"`
+			Force    bool   `json:"force"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		accepted := make(map[int]bool)
+		for _, i := range req.Accepted {
+			if i < 0 || i >= len(review.Hunks) {
+				http.Error(w, fmt.Sprintf("hunk %d does not exist", i), http.StatusBadRequest)
+				return
+			}
+			accepted[i] = true
+		}
+		if req.Path == "" {
+			req.Path = review.Path
+		}
+		target, err := writeEditReview(review, req.Path, accepted, req.Force)
+		switch {
+		case errors.Is(err, errEditConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		review.Path, review.Written = req.Path, target
+		log.Printf("💾 Wrote edit %s to %s with %d of %d hunks", review.ID, target, len(accepted), len(review.Hunks))
+	case http.MethodDelete:
+		if review == nil {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		editReviews = append(editReviews[:index], editReviews[index+1:]...)
+		review = nil
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if review != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"workspace": appConfig().Workspace.Roots, "edit": review})
+		return
+	}
+
+	// Summaries only, newest first; the full texts come with ?id=
+	type summary struct {
+		ID       string    `json:"id"`
+		Filename string    `json:"filename"`
+		Path     string    `json:"path"`
+		Hunks    int       `json:"hunks"`
+		Created  time.Time `json:"created"`
+		Written  string    `json:"written,omitempty"`
+	}
+	summaries := []summary{}
+	for i := len(editReviews) - 1; i >= 0; i-- {
+		e := editReviews[i]
+		summaries = append(summaries, summary{e.ID, e.Filename, e.Path, len(e.Hunks), e.Created, e.Written})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"workspace": appConfig().Workspace.Roots, "edits": summaries})
+}
+
+// EditLinesRequest asks for a line range of a buffer to be rewritten; lines are 1-based and end is inclusive
+type EditLinesRequest struct {
+	Filename    string `json:"filename"`
+	Text        string `json:"text"`
+	Start       int    `json:"start"`
+	End         int    `json:"end"` // start-1 inserts before start without replacing anything
+	Instruction string `json:"instruction"`
+}
+
+// EditLinesResponse holds only the lines that replace start..end
+type EditLinesResponse struct {
+	Start int      `json:"start"`
+	End   int      `json:"end"`
+	Lines []string `json:"lines"`
+	Text  string   `json:"text"` // Lines joined with the buffer's line ending, with a final newline
+}
+
+// editContextLines is how many lines around the range are sent as context
+const editContextLines = 100
+
+// Markers delimiting the range inside the buffer excerpt sent to Khoj
+const (
+	editStartMarker = "<<<KHOJ EDIT START>>>"
+	editEndMarker   = "<<<KHOJ EDIT END>>>"
+)
+
+// handleEditLines rewrites a line range of a buffer and returns just the replacement lines, so editor
+// plugins can swap a range without parsing diffs. Send Accept: text/plain to get the bare replacement text.
+func (kp *KhojProvider) handleEditLines(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EditLinesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Instruction == "" {
+		http.Error(w, "instruction is required", http.StatusBadRequest)
+		return
+	}
+	if req.Filename == "" {
+		req.Filename = "file"
+	}
+
+	newline := "\n"
+	if strings.Contains(req.Text, "\r\n") {
+		newline = "\r\n"
+	}
+	lines := strings.Split(strings.TrimSuffix(strings.ReplaceAll(req.Text, "\r\n", "\n"), "\n"), "\n")
+	if req.Text == "" {
+		lines = nil
+	}
+	if req.Start < 1 || req.Start > len(lines)+1 || req.End < req.Start-1 || req.End > len(lines) {
+		http.Error(w, fmt.Sprintf("invalid range %d-%d for a buffer of %d lines", req.Start, req.End, len(lines)), http.StatusBadRequest)
+		return
+	}
+
+	excerpt := make([]string, 0, req.End-req.Start+3+2*editContextLines)
+	excerpt = append(excerpt, lines[max(0, req.Start-1-editContextLines):req.Start-1]...)
+	excerpt = append(excerpt, editStartMarker)
+	excerpt = append(excerpt, lines[req.Start-1:req.End]...)
+	excerpt = append(excerpt, editEndMarker)
+	excerpt = append(excerpt, lines[req.End:min(len(lines), req.End+editContextLines)]...)
+
+	prompt := fmt.Sprintf("Here is part of %s. The lines to change are between %s and %s.\n\n```\n%s\n```\n\nInstruction: %s\n\n"+
+		"Reply with only the new lines that replace the marked ones, in a single code block. Do not repeat the markers or any unmarked lines. Keep the indentation.",
+		req.Filename, editStartMarker, editEndMarker, strings.Join(excerpt, "\n"), req.Instruction)
+
+	// As with edit streams, the excerpt goes to a conversation of its own that is deleted afterwards
+	convID, err := createConversationWithAgent(kp.APIBase, kp.APIKey, currentAgentSlug)
+	if err != nil {
+		logRequest(r.Context(), "Line edit failed: %v", err)
+		http.Error(w, fmt.Sprintf("failed to create conversation: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		if err := deleteKhojConversation(kp.APIBase, kp.APIKey, convID); err != nil {
+			logRequest(r.Context(), "Failed to delete edit conversation %s: %v", convID, err)
+		}
+	}()
+
+	khojResp, err := kp.callKhojAPI(r.Context(), &KhojRequest{
+		Q:              prompt,
+		ConversationID: convID,
+		ClientID:       "khoj-provider-edits",
+	})
+	if err != nil {
+		logRequest(r.Context(), "Line edit failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	content, matches, blocked := postProcessResponse(khojResp, responseTargetAPI, outputModeFirstCode)
+	if blocked {
+		logRequest(r.Context(), "🚫 Output filter blocked line edit (%d matches)", matches)
+		http.Error(w, "Response blocked by the output filter", http.StatusBadGateway)
+		return
+	}
+
+	// Drop markers the model echoed despite the instruction
+	replacement := []string{}
+	for _, line := range strings.Split(strings.TrimRight(strings.ReplaceAll(content, "\r\n", "\n"), "\n"), "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != editStartMarker && trimmed != editEndMarker {
+			replacement = append(replacement, line)
+		}
+	}
+	if len(replacement) == 1 && replacement[0] == "" {
+		replacement = []string{} // An empty answer deletes the range
+	}
+	logRequest(r.Context(), "✏️ Line edit of %s:%d-%d returned %d line(s)", req.Filename, req.Start, req.End, len(replacement))
+
+	text := strings.Join(replacement, newline)
+	if len(replacement) > 0 {
+		text += newline
+	}
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, text)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EditLinesResponse{Start: req.Start, End: req.End, Lines: replacement, Text: text})
+}
+
+// launcherNamePattern limits launcher names, which become client mapping keys
+var launcherNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// handleLauncherAsk answers GET /launcher/ask?q=... in plain text for launcher extensions. Each launcher gets its
+// own scratch conversation, so quick queries never land in the main one; new=1 starts that conversation over.
+func (kp *KhojProvider) handleLauncherAsk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	question := strings.TrimSpace(query.Get("q"))
+	if question == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	launcher := query.Get("launcher")
+	if launcher == "" {
+		launcher = "launcher"
+	}
+	if !launcherNamePattern.MatchString(launcher) {
+		http.Error(w, "launcher must be 1-32 letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	output := query.Get("output")
+	if !validOutputMode(output) {
+		http.Error(w, fmt.Sprintf("Invalid output %q (expected full, code or first_code)", output), http.StatusBadRequest)
+		return
+	}
+
+	client := "launcher:" + launcher
+	if query.Get("new") == "1" {
+		clientMappings.Forget(client)
+	}
+	convID, err := clientMappings.ConversationFor(kp.APIBase, kp.APIKey, client)
+	if err != nil {
+		logRequest(r.Context(), "Error resolving conversation for %s: %v", client, err)
+		http.Error(w, "Failed to create conversation for launcher", http.StatusBadGateway)
+		return
+	}
+
+	timeout := durationOrDefault(appConfig().Launcher.Timeout, launcherTimeout)
+	ctx, cancel := context.WithTimeout(withRequestClass(r.Context(), classInteractive), timeout)
+	defer cancel()
+
+	start := time.Now()
+	khojResp, err := kp.callKhojAPI(ctx, &KhojRequest{
+		Q:              question,
+		ConversationID: convID,
+		ClientID:       "khoj-provider-" + launcher,
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, fmt.Sprintf("Timed out after %v", timeout), http.StatusGatewayTimeout)
+			return
+		}
+		logRequest(r.Context(), "Launcher query from %s failed: %v", launcher, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	answer, matches, blocked := postProcessResponse(khojResp, responseTargetAPI, output)
+	if blocked {
+		logRequest(r.Context(), "🚫 Output filter blocked launcher answer (%d matches)", matches)
+		http.Error(w, "Answer blocked by the output filter", http.StatusBadGateway)
+		return
+	}
+	logRequest(r.Context(), "🚀 Answered %s query in %v", launcher, time.Since(start).Round(time.Millisecond))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, answer)
+}
+
+// warmAnswer is the cached result of a warm prompt
+type warmAnswer struct {
+	Name      string    `json:"name"`
+	Answer    string    `json:"answer"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"` // Zero until the first run succeeds
+	Running   bool      `json:"running"`
+}
+
+var (
+	warmAnswers     = make(map[string]*warmAnswer)
+	warmAnswersMu   sync.Mutex
+	warmPromptsOnce sync.Once
+)
+
+// warmPrompt looks up a configured warm prompt by name
+func warmPrompt(name string) (WarmPromptConfig, bool) {
+	for _, p := range appConfig().WarmPrompts {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return WarmPromptConfig{}, false
+}
+
+// startWarmPrompts runs every warm prompt once, then again on its refresh interval
+func startWarmPrompts(kp *KhojProvider) {
+	warmPromptsOnce.Do(func() {
+		for _, p := range appConfig().WarmPrompts {
+			workers.Go("warm-"+p.Name, func(ctx context.Context) error {
+				refreshWarmPrompt(ctx, kp, p)
+				if p.Refresh == "" {
+					return nil
+				}
+				ticker := time.NewTicker(durationOrDefault(p.Refresh, time.Hour))
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-ticker.C:
+						refreshWarmPrompt(ctx, kp, p)
+					}
+				}
+			})
+		}
+	})
+}
+
+// refreshWarmPrompt asks Khoj a warm prompt in its own scratch conversation and caches the answer
+func refreshWarmPrompt(ctx context.Context, kp *KhojProvider, p WarmPromptConfig) {
+	if entry := claimWarmPrompt(p.Name); entry != nil {
+		runWarmPrompt(ctx, kp, p, entry)
+	}
+}
+
+// claimWarmPrompt marks a warm prompt as running, returning nil if a run is already in progress
+func claimWarmPrompt(name string) *warmAnswer {
+	warmAnswersMu.Lock()
+	defer warmAnswersMu.Unlock()
+	entry := warmAnswers[name]
+	if entry == nil {
+		entry = &warmAnswer{Name: name}
+		warmAnswers[name] = entry
+	}
+	if entry.Running {
+		return nil
+	}
+	entry.Running = true
+	return entry
+}
+
+// runWarmPrompt runs a claimed warm prompt; a failed run keeps the previous answer
+func runWarmPrompt(ctx context.Context, kp *KhojProvider, p WarmPromptConfig, entry *warmAnswer) {
+	start := time.Now()
+	answer, err := askWarmPrompt(ctx, kp, p)
+
+	warmAnswersMu.Lock()
+	defer warmAnswersMu.Unlock()
+	entry.Running = false
+	if err != nil {
+		log.Printf("❌ Warm prompt %s failed: %v", p.Name, err)
+		entry.Error = err.Error()
+		return
+	}
+	log.Printf("🔥 Warmed %s in %v", p.Name, time.Since(start).Round(time.Millisecond))
+	entry.Answer, entry.Error, entry.UpdatedAt = answer, "", time.Now()
+}
+
+// askWarmPrompt sends one warm prompt at background priority so it never delays interactive requests
+func askWarmPrompt(ctx context.Context, kp *KhojProvider, p WarmPromptConfig) (string, error) {
+	client := "warm:" + p.Name
+	convID, err := clientMappings.ConversationFor(kp.APIBase, kp.APIKey, client)
+	if err != nil {
+		return "", fmt.Errorf("failed to create conversation: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(withRequestClass(ctx, classBackground), durationOrDefault(appConfig().Timeout, defaultTimeout))
+	defer cancel()
+
+	khojResp, err := kp.callKhojAPI(ctx, &KhojRequest{
+		Q:              expandTemplateVariables(p.Prompt, templateVariables(0, languageGuess{})),
+		ConversationID: convID,
+		ClientID:       "khoj-provider-warm",
+	})
+	if err != nil {
+		return "", err
+	}
+	answer, matches, blocked := postProcessResponse(khojResp, responseTargetAPI, p.Output)
+	if blocked {
+		return "", fmt.Errorf("answer blocked by the output filter (%d matches)", matches)
+	}
+	return answer, nil
+}
+
+// handleWarmAnswer returns the cached answer of ?name= on GET; POST re-runs the prompt in the background
+func (kp *KhojProvider) handleWarmAnswer(w http.ResponseWriter, r *http.Request) {
+	p, ok := warmPrompt(r.URL.Query().Get("name"))
+	if !ok {
+		http.Error(w, "Unknown warm prompt", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		warmAnswersMu.Lock()
+		answer := warmAnswer{Name: p.Name, Running: true} // Not started yet counts as warming up
+		if entry := warmAnswers[p.Name]; entry != nil {
+			answer = *entry
+		}
+		warmAnswersMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer)
+
+	case http.MethodPost:
+		// Claim before replying so the page's next poll already sees the run
+		if entry := claimWarmPrompt(p.Name); entry != nil {
+			workers.Go("warm-refresh-"+p.Name, func(ctx context.Context) error {
+				runWarmPrompt(ctx, kp, p, entry)
+				return nil
+			})
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// showWarmAnswer opens the cached answer of a warm prompt in a small always-on-top window
+func showWarmAnswer(name string) {
+	if err := openAppWindow("http://localhost:"+serverPort()+"/warm?name="+url.QueryEscape(name), warmAnswerTitle, 640, 480); err != nil {
+		log.Printf("Failed to open warm answer: %v", err)
+		return
+	}
+	pinWindowOnTop(warmAnswerTitle)
+}
+
+// Daily digest delivery targets and schedule defaults
+const (
+	digestNotification  = "notification"
+	digestDashboard     = "dashboard"
+	digestFileTarget    = "file"
+	defaultDigestTime   = "08:00"
+	digestRetryDelay    = 15 * time.Minute
+	digestCheckInterval = 10 * time.Minute // Timers stall while the machine sleeps, so the schedule is re-checked this often
+)
+
+// defaultDigestPrompt asks for a digest when digest.prompt is not set
+const defaultDigestPrompt = "Today is {{date}}. Write my daily digest from my notes and automations: what changed since yesterday, " +
+	"open tasks and deadlines, and anything I should follow up on. Use short Markdown sections with bullet lists."
+
+// targets returns where digests are delivered, applying the default
+func (d *DigestConfig) targets() []string {
+	if len(d.Deliver) == 0 {
+		return []string{digestNotification, digestDashboard}
+	}
+	return d.Deliver
+}
+
+// delivers reports whether digests go to target
+func (d *DigestConfig) delivers(target string) bool {
+	for _, t := range d.targets() {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Digest is one generated daily digest
+type Digest struct {
+	Date      string    `json:"date"` // Local day it was generated for, e.g. 2026-10-14
+	Markdown  string    `json:"markdown"`
+	HTML      string    `json:"html"`
+	CreatedAt time.Time `json:"created_at"`
+	File      string    `json:"file,omitempty"` // Copy written by file delivery
+}
+
+var (
+	digestMu      sync.Mutex
+	digestRunning bool
+	digestLastErr string
+	digestOnce    sync.Once
+)
+
+// privateDigest is the latest digest generated in privacy mode, which is never written to digestFile
+var privateDigest atomic.Pointer[Digest]
+
+// loadDigest reads the latest digest, returning nil if none has been generated yet
+func loadDigest() (*Digest, error) {
+	if digest := privateDigest.Load(); digest != nil {
+		return digest, nil
+	}
+	data, err := os.ReadFile(digestFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read digest file: %w", err)
+	}
+
+	var digest Digest
+	if err := json.Unmarshal(data, &digest); err != nil {
+		return nil, fmt.Errorf("failed to parse digest file: %w", err)
+	}
+	return &digest, nil
+}
+
+// saveDigest records the latest digest, in memory only while privacy mode is on
+func saveDigest(digest *Digest) error {
+	if privacyMode.Load() {
+		privateDigest.Store(digest)
+		return nil
+	}
+	privateDigest.Store(nil)
+	data, err := json.MarshalIndent(digest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal digest: %w", err)
+	}
+	if err := os.WriteFile(digestFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write digest file: %w", err)
+	}
+	return nil
+}
+
+// nextDigestRun returns when the digest should run next: now if today's is due but missing, otherwise the next scheduled time
+func nextDigestRun(now time.Time, at string, last *Digest) time.Time {
+	clock, err := time.Parse("15:04", at)
+	if err != nil {
+		clock, _ = time.Parse("15:04", defaultDigestTime)
+	}
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if now.Before(scheduled) {
+		return scheduled
+	}
+	if last == nil || last.Date != now.Format("2006-01-02") {
+		return now
+	}
+	return scheduled.AddDate(0, 0, 1)
+}
+
+// startDigest schedules the daily digest when it is configured. A digest missed while the wrapper was not
+// running is generated as soon as it starts, and a failed one is retried later the same day.
+func startDigest(kp *KhojProvider) {
+	cfg := appConfig().Digest
+	if cfg == nil {
+		return
+	}
+	digestOnce.Do(func() {
+		workers.Go("digest", func(ctx context.Context) error {
+			for {
+				last, err := loadDigest()
+				if err != nil {
+					log.Printf("⚠️ %v", err)
+				}
+				if wait := time.Until(nextDigestRun(time.Now(), cfg.Time, last)); wait > 0 {
+					if wait > digestCheckInterval {
+						wait = digestCheckInterval
+					}
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(wait):
+					}
+					continue
+				}
+				if _, err := runDigest(ctx, kp, cfg); err != nil {
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-time.After(digestRetryDelay):
+					}
+				}
+			}
+		})
+	})
+}
+
+// claimDigestRun marks a digest as being generated, returning false if one already is
+func claimDigestRun() bool {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	if digestRunning {
+		return false
+	}
+	digestRunning = true
+	return true
+}
+
+// runDigest generates and delivers a digest; only one runs at a time
+func runDigest(ctx context.Context, kp *KhojProvider, cfg *DigestConfig) (*Digest, error) {
+	if !claimDigestRun() {
+		return nil, fmt.Errorf("a digest is already being generated")
+	}
+	return runClaimedDigest(ctx, kp, cfg)
+}
+
+// runClaimedDigest generates and delivers a digest after claimDigestRun succeeded
+func runClaimedDigest(ctx context.Context, kp *KhojProvider, cfg *DigestConfig) (*Digest, error) {
+	digest, err := generateDigest(ctx, kp, cfg)
+	if err == nil {
+		err = deliverDigest(digest, cfg)
+	}
+
+	digestMu.Lock()
+	digestRunning, digestLastErr = false, ""
+	if err != nil {
+		digestLastErr = err.Error()
+	}
+	digestMu.Unlock()
+
+	if err != nil {
+		log.Printf("❌ Daily digest failed: %v", err)
+		if cfg.delivers(digestNotification) {
+			showNotification("Khoj Daily Digest", "Failed: "+err.Error())
+		}
+		return nil, err
+	}
+	log.Printf("📰 Daily digest for %s delivered to %s", digest.Date, strings.Join(cfg.targets(), ", "))
+	return digest, nil
+}
+
+// generateDigest asks Khoj for a digest in its own scratch conversation, at background priority
+func generateDigest(ctx context.Context, kp *KhojProvider, cfg *DigestConfig) (*Digest, error) {
+	convID, err := clientMappings.ConversationFor(kp.APIBase, kp.APIKey, "digest")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(withRequestClass(ctx, classBackground), durationOrDefault(appConfig().Timeout, defaultTimeout))
+	defer cancel()
+
+	prompt := cfg.Prompt
+	if prompt == "" {
+		prompt = defaultDigestPrompt
+	}
+	khojResp, err := kp.callKhojAPI(ctx, &KhojRequest{
+		Q:              expandTemplateVariables(prompt, templateVariables(0, languageGuess{})),
+		ConversationID: convID,
+		ClientID:       "khoj-provider-digest",
+	})
+	if err != nil {
+		return nil, err
+	}
+	markdown, matches, blocked := postProcessResponse(khojResp, responseTargetAPI, "")
+	if blocked {
+		return nil, fmt.Errorf("digest blocked by the output filter (%d matches)", matches)
+	}
+
+	now := time.Now()
+	return &Digest{Date: now.Format("2006-01-02"), Markdown: markdown, HTML: renderMarkdownHTML(markdown), CreatedAt: now}, nil
+}
+
+// deliverDigest writes the digest file, records the digest for the dashboard and shows the notification.
+// The digest is recorded even if the file cannot be written, so it is not generated again.
+func deliverDigest(digest *Digest, cfg *DigestConfig) error {
+	var fileErr error
+	if cfg.delivers(digestFileTarget) && privacyMode.Load() {
+		log.Printf("🕶️ Privacy mode: digest file not written")
+	} else if cfg.delivers(digestFileTarget) {
+		digest.File, fileErr = writeDigestFile(digest, cfg)
+	}
+	if err := saveDigest(digest); err != nil {
+		return err
+	}
+	if cfg.delivers(digestNotification) {
+		showNotification("Khoj Daily Digest", digestSummary(digest.Markdown, 180))
+	}
+	return fileErr
+}
+
+// writeDigestFile saves the digest as digest-<date>.md or .html in the configured folder
+func writeDigestFile(digest *Digest, cfg *DigestConfig) (string, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "digests"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create digest folder: %w", err)
+	}
+
+	name, content := "digest-"+digest.Date+".md", digest.Markdown
+	if cfg.Format == "html" {
+		name, content = "digest-"+digest.Date+".html", fmt.Sprintf(digestDocumentHTML, digest.Date, digest.Date, digest.HTML)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("failed to write digest: %w", err)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path, nil
+}
+
+// digestSummary returns the start of the digest as plain text, for the notification
+func digestSummary(markdown string, maxRunes int) string {
+	text := strings.Join(strings.Fields(stripMarkdown(markdown)), " ")
+	if runes := []rune(text); len(runes) > maxRunes {
+		return strings.TrimSpace(string(runes[:maxRunes])) + "…"
+	}
+	return text
+}
+
+// handleDashboardDigest returns the digest schedule and latest digest; POST generates a digest now
+func (kp *KhojProvider) handleDashboardDigest(w http.ResponseWriter, r *http.Request) {
+	cfg := appConfig().Digest
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if cfg == nil {
+			http.Error(w, "The daily digest is not configured", http.StatusNotFound)
+			return
+		}
+		if !claimDigestRun() {
+			http.Error(w, "A digest is already being generated", http.StatusConflict)
+			return
+		}
+		workers.Go("digest-now", func(ctx context.Context) error {
+			runClaimedDigest(ctx, kp, cfg)
+			return nil
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := map[string]interface{}{"enabled": cfg != nil}
+	if cfg != nil {
+		at := cfg.Time
+		if at == "" {
+			at = defaultDigestTime
+		}
+		digestMu.Lock()
+		status["running"], status["error"] = digestRunning, digestLastErr
+		digestMu.Unlock()
+		status["time"], status["deliver"] = at, cfg.targets()
+		if cfg.delivers(digestDashboard) {
+			digest, err := loadDigest()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			status["digest"] = digest
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Block-level Markdown the digest renderer recognizes, beyond the patterns shared with stripMarkdown
+var (
+	markdownHeadingLine = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	markdownListItem    = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+(.*)$`)
+)
+
+// renderMarkdownHTML converts Markdown to HTML: headings, paragraphs, lists, quotes, rules, code blocks, inline
+// code, emphasis and http(s) or mailto links. Everything else is escaped, so the result is safe to put in a page.
+func renderMarkdownHTML(text string) string {
+	var out strings.Builder
+	var paragraph []string
+	list := "" // "ul" or "ol" while inside a list
+	inCode := false
+
+	flush := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + renderInlineMarkdown(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if inCode {
+			if strings.HasPrefix(trimmed, "```") {
+				out.WriteString("</code></pre>\n")
+				inCode = false
+			} else {
+				out.WriteString(html.EscapeString(line) + "\n")
+			}
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			out.WriteString("<pre><code>")
+			inCode = true
+		case trimmed == "":
+			flush()
+		case markdownHeadingLine.MatchString(trimmed):
+			flush()
+			m := markdownHeadingLine.FindStringSubmatch(trimmed)
+			fmt.Fprintf(&out, "<h%d>%s</h%d>\n", len(m[1]), renderInlineMarkdown(m[2]), len(m[1]))
+		case markdownRule.MatchString(trimmed + "\n"):
+			flush()
+			out.WriteString("<hr>\n")
+		case markdownListItem.MatchString(line):
+			m := markdownListItem.FindStringSubmatch(line)
+			kind := "ul"
+			if m[1][0] >= '0' && m[1][0] <= '9' {
+				kind = "ol"
+			}
+			if len(paragraph) > 0 || list != kind {
+				flush()
+				out.WriteString("<" + kind + ">\n")
+				list = kind
+			}
+			out.WriteString("<li>" + renderInlineMarkdown(m[2]) + "</li>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			out.WriteString("<blockquote>" + renderInlineMarkdown(strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))) + "</blockquote>\n")
+		default:
+			if list != "" {
+				flush()
+			}
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	if inCode {
+		out.WriteString("</code></pre>\n")
+	}
+	flush()
+	return out.String()
+}
+
+// renderInlineMarkdown converts inline code, links and emphasis in one block of text to escaped HTML
+func renderInlineMarkdown(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range markdownCode.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(renderMarkdownSpans(text[last:loc[0]]))
+		out.WriteString("<code>" + html.EscapeString(text[loc[2]:loc[3]]) + "</code>")
+		last = loc[1]
+	}
+	out.WriteString(renderMarkdownSpans(text[last:]))
+	return out.String()
+}
+
+// renderMarkdownSpans escapes text outside code spans, then converts its links and emphasis
+func renderMarkdownSpans(text string) string {
+	text = html.EscapeString(text)
+	text = markdownLink.ReplaceAllStringFunc(text, func(link string) string {
+		m := markdownLink.FindStringSubmatch(link)
+		target, err := url.Parse(html.UnescapeString(m[2]))
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https" && target.Scheme != "mailto") {
+			return link
+		}
+		return `<a href="` + m[2] + `">` + m[1] + `</a>`
+	})
+	return markdownEmphasis.ReplaceAllStringFunc(text, func(span string) string {
+		m := markdownEmphasis.FindStringSubmatch(span)
+		if m[2] != "" {
+			return "<strong>" + m[2] + "</strong>"
+		}
+		return "<em>" + m[4] + "</em>"
+	})
+}
+
+// registerDashboard mounts the local dashboard page and its JSON API, and the popup windows the tray opens.
+// Pages of features switched off in the features section are left out.
+func registerDashboard(mux *http.ServeMux) {
+	if appConfig().featureEnabled(featureDashboard) {
+		mux.HandleFunc("/dashboard", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(dashboardHTML))
+		}))
+		mux.HandleFunc("/dashboard/api/instructions", loopbackOnly(handleDashboardInstructions))
+		mux.HandleFunc("/dashboard/api/shares", loopbackOnly(handleDashboardShares))
+		mux.HandleFunc("/dashboard/api/clients", loopbackOnly(handleDashboardClients))
+		mux.HandleFunc("/dashboard/api/templates", loopbackOnly(handleDashboardTemplates))
+		mux.HandleFunc("/dashboard/api/packs", loopbackOnly(handleDashboardPacks))
+		mux.HandleFunc("/dashboard/api/hotkeys", loopbackOnly(handleDashboardHotkeys))
+		mux.HandleFunc("/dashboard/api/theme", loopbackOnly(handleDashboardTheme))
+		mux.HandleFunc("/dashboard/api/privacy", loopbackOnly(handleDashboardPrivacy))
+		mux.HandleFunc("/dashboard/api/uploads", loopbackOnly(handleDashboardUploads))
+		mux.HandleFunc("/dashboard/api/transcript", loopbackOnly(handleDashboardTranscript))
+		if appConfig().featureEnabled(featureFileTools) {
+			mux.HandleFunc("/dashboard/diff", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte(diffReviewHTML))
+			}))
+			mux.HandleFunc("/dashboard/api/edits", loopbackOnly(handleDashboardEdits))
+		}
+	}
+	mux.HandleFunc("/theme.css", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache") // Reopened popups pick up a changed theme
+		w.Write([]byte(themeCSS(appConfig().Theme)))
+	}))
+	if appConfig().featureEnabled(featureFileTools) {
+		mux.HandleFunc("/drop", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(dropHTML))
+		}))
+		mux.HandleFunc("/drop/api/files", loopbackOnly(handleDropFile))
+		mux.HandleFunc("/drop/api/uploads", loopbackOnly(handleIndexUploads))
+	}
+	mux.HandleFunc("/ask", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(quickAskHTML))
+	}))
+	mux.HandleFunc("/ask/api/question", loopbackOnly(handleQuickAsk))
+	mux.HandleFunc("/warm", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(warmAnswerHTML))
+	}))
+	if appConfig().featureEnabled(featureClipboardAI) {
+		mux.HandleFunc("/preview", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(diffPreviewHTML))
+		}))
+		mux.HandleFunc("/preview/api/diff", loopbackOnly(handleDiffPreview))
+		mux.HandleFunc("/preview/api/decision", loopbackOnly(handleDiffDecision))
+		mux.HandleFunc("/clipboard", loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(aiClipboardHTML))
+		}))
+		mux.HandleFunc("/clipboard/api/entries", loopbackOnly(handleAIClipboard))
+	}
+}
+
+// SharedLink is a share link created for a conversation, kept so it can be listed and revoked later
+type SharedLink struct {
+	ConversationID string     `json:"conversation_id"`
+	URL            string     `json:"url"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+var sharedLinksMu sync.Mutex
+
+// loadSharedLinks reads previously created share links; a missing file means none
+func loadSharedLinks() ([]SharedLink, error) {
+	data, err := os.ReadFile(sharedLinksFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read shared links file: %w", err)
+	}
+
+	var links []SharedLink
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, fmt.Errorf("failed to parse shared links file: %w", err)
+	}
+	return links, nil
+}
+
+// saveSharedLinks writes the share link history
+func saveSharedLinks(links []SharedLink) error {
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal shared links: %w", err)
+	}
+	if err := os.WriteFile(sharedLinksFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write shared links file: %w", err)
+	}
+	return nil
+}
+
+// shareConversation asks Khoj to publish a conversation and records the returned link
+func shareConversation(apiBase, apiKey, convID string) (*SharedLink, error) {
+	if convID == "" {
+		return nil, fmt.Errorf("no active conversation")
+	}
+
+	endpoint := fmt.Sprintf("%s/api/chat/share?conversation_id=%s", apiBase, url.QueryEscape(convID))
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create share request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	var result struct {
+		Status string `json:"status"`
+		URL    string `json:"url"`
+	}
+	if err := doShareRequest(req, &result); err != nil {
+		return nil, err
+	}
+	if result.URL == "" {
+		return nil, fmt.Errorf("khoj did not return a share link")
+	}
+
+	link := SharedLink{ConversationID: convID, URL: result.URL, CreatedAt: time.Now()}
+	sharedLinksMu.Lock()
+	defer sharedLinksMu.Unlock()
+	links, err := loadSharedLinks()
+	if err != nil {
+		return nil, err
+	}
+	if err := saveSharedLinks(append(links, link)); err != nil {
+		return nil, err
+	}
+
+	log.Printf("🔗 Shared conversation %s: %s", convID, link.URL)
+	bus.Publish(topicConversation, "shared", currentConversationEvent())
+	return &link, nil
+}
+
+// revokeSharedLink deletes the public copy behind a share link and marks it revoked
+func revokeSharedLink(apiBase, apiKey, shareURL string) error {
+	sharedLinksMu.Lock()
+	defer sharedLinksMu.Unlock()
+
+	links, err := loadSharedLinks()
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, link := range links {
+		if link.URL == shareURL && link.RevokedAt == nil {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("no active share link %s", shareURL)
+	}
+
+	// Khoj identifies the public copy by the last path segment of its URL
+	slug := path.Base(strings.TrimSuffix(shareURL, "/"))
+	endpoint := fmt.Sprintf("%s/api/chat/share?public_conversation_slug=%s", apiBase, url.QueryEscape(slug))
+	req, err := http.NewRequest("DELETE", endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create revoke request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if err := doShareRequest(req, nil); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	links[index].RevokedAt = &now
+	if err := saveSharedLinks(links); err != nil {
+		return err
+	}
+
+	log.Printf("🔗 Revoked share link %s", shareURL)
+	bus.Publish(topicConversation, "share_revoked", currentConversationEvent())
+	return nil
+}
+
+// doShareRequest sends a share API request and decodes the JSON reply into result when non-nil
+func doShareRequest(req *http.Request, result interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send share request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read share response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("share request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	if result != nil {
+		if err := json.Unmarshal(body, result); err != nil {
+			return fmt.Errorf("failed to parse share response: %w", err)
+		}
+	}
+	return nil
+}
+
+// shareConversationFromMenu shares the active conversation and copies the link to the clipboard
+func shareConversationFromMenu() error {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	apiKey := os.Getenv("KHOJ_API_KEY")
+	if apiKey == "" {
+		reportKhojError("Sharing failed", errAPIKeyNotSet)
+		return errAPIKeyNotSet
+	}
+
+	link, err := shareConversation(apiBase, apiKey, conversationID)
+	if err != nil {
+		reportKhojError("Sharing failed", err)
+		return err
+	}
+
+	if err := win32.WriteClipboard(link.URL); err != nil {
+		log.Printf("Failed to copy share link to clipboard: %v", err)
+		showNotification("Khoj AI", "Share link created: "+link.URL)
+		return nil
+	}
+	showNotification("Khoj AI", "Share link copied to clipboard")
+	return nil
+}
+
+// handleDashboardShares lists (GET), creates (POST) or revokes (DELETE ?url=) conversation share links
+func handleDashboardShares(w http.ResponseWriter, r *http.Request) {
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+	apiKey := os.Getenv("KHOJ_API_KEY")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := shareConversation(apiBase, apiKey, conversationID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	case http.MethodDelete:
+		if err := revokeSharedLink(apiBase, apiKey, r.URL.Query().Get("url")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sharedLinksMu.Lock()
+	links, err := loadSharedLinks()
+	sharedLinksMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if links == nil {
+		links = []SharedLink{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+// maxDropFileSize caps files accepted by the drop window
+const maxDropFileSize = 20 << 20
+
+// dropResult is the drop window's reply for one file
+type dropResult struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	Bytes   int    `json:"bytes"`
+	Summary string `json:"summary,omitempty"`
+
+	// AlreadyIndexed is the name Khoj holds the same content under when the upload was skipped
+	AlreadyIndexed string `json:"already_indexed,omitempty"`
+	Parts          int    `json:"parts,omitempty"` // Documents a large text file was indexed as
+}
+
+// handleDropFile summarizes or indexes one file uploaded from the drop window (multipart fields file and action)
+func handleDropFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxDropFileSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxDropFileSize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxDropFileSize {
+		http.Error(w, fmt.Sprintf("File is larger than %d MB", maxDropFileSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := dropResult{Name: header.Filename, Action: r.FormValue("action"), Bytes: len(data)}
+	log.Printf("📥 Dropped %s (%d bytes), action %s", result.Name, result.Bytes, result.Action)
+
+	switch result.Action {
+	case "summarize":
+		result.Summary, err = summarizeDroppedFile(r.Context(), result.Name, data)
+	case "index":
+		apiBase := os.Getenv("KHOJ_API_BASE")
+		if apiBase == "" {
+			apiBase = "https://app.khoj.dev"
+		}
+		result.AlreadyIndexed, result.Parts, err = indexFileOnce(r.Context(), apiBase, os.Getenv("KHOJ_API_KEY"), result.Name, data)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown action %q (expected summarize or index)", result.Action), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Drop %s failed for %s: %v", result.Action, result.Name, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// summarizeDroppedFile asks the current agent for a summary of a text file, within its token budget
+func summarizeDroppedFile(ctx context.Context, name string, data []byte) (string, error) {
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("%s is not a text file; use Index to add documents such as PDFs", name)
+	}
+	if globalServer == nil || globalServer.provider == nil {
+		return "", fmt.Errorf("server is not running")
+	}
+	kp := globalServer.provider
+
+	prompt := withConversationInstructions(conversationID, fmt.Sprintf("Summarize the attached file %s. Start with one sentence on what it is, then list the key points.", name))
+	files := []KhojFile{{
+		Name:     name,
+		Content:  string(data),
+		FileType: fileTypeFromMime(mime.TypeByExtension(filepath.Ext(name))),
+		Size:     len(data),
+	}}
+	files, _ = kp.fitFilesToBudget(ctx, currentAgentSlug, prompt, files)
+
+	resp, err := kp.callKhojAPI(ctx, &KhojRequest{
+		Q:              prompt,
+		ConversationID: conversationID,
+		ClientID:       "khoj-provider-drop",
+		Files:          files,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize %s: %w", name, err)
+	}
+
+	summary, _, blocked := postProcessResponse(resp, responseTargetAPI, "")
+	if blocked {
+		return "", fmt.Errorf("summary blocked by the output filter")
+	}
+	return summary, nil
+}
+
+// indexFileToKhoj uploads a file to the user's Khoj knowledge base
+func indexFileToKhoj(ctx context.Context, apiBase, apiKey, name string, data []byte) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", name)
+	if err != nil {
+		return fmt.Errorf("failed to build upload: %w", err)
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return fmt.Errorf("failed to build upload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PATCH", apiBase+"/api/content?client=khoj-wrapper", &body)
+	if err != nil {
+		return fmt.Errorf("failed to create index request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("indexing failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	log.Printf("✅ Indexed %s to Khoj", name)
+	return nil
+}
+
+// UploadedFile is a file this client indexed to Khoj, keyed by content hash in uploadedFilesFile
+type UploadedFile struct {
+	Name       string    `json:"name"`
+	Size       int       `json:"size"`
+	Parts      int       `json:"parts,omitempty"` // Indexed as this many documents named by partName
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// documents lists the names Khoj holds the file under: its own, or those of its parts
+func (f UploadedFile) documents() []string {
+	if f.Parts == 0 {
+		return []string{f.Name}
+	}
+	names := make([]string, f.Parts)
+	for i := range names {
+		names[i] = partName(f.Name, i+1)
+	}
+	return names
+}
+
+// indexedIn reports whether Khoj lists the file, or every one of its parts
+func (f UploadedFile) indexedIn(indexed map[string]bool) bool {
+	for _, name := range f.documents() {
+		if !indexed[name] {
+			return false
+		}
+	}
+	return true
+}
+
+var uploadedFilesMu sync.Mutex
+
+// loadUploadedFiles reads the content hash -> file map; a missing file means nothing was indexed yet
+func loadUploadedFiles() (map[string]UploadedFile, error) {
+	files := make(map[string]UploadedFile)
+	data, err := os.ReadFile(uploadedFilesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, fmt.Errorf("failed to read uploaded files: %w", err)
+	}
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse uploaded files: %w", err)
+	}
+	return files, nil
+}
+
+// saveUploadedFiles writes the content hash -> file map
+func saveUploadedFiles(files map[string]UploadedFile) error {
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal uploaded files: %w", err)
+	}
+	if err := os.WriteFile(uploadedFilesFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write uploaded files: %w", err)
+	}
+	return nil
+}
+
+// contentHash is the hex SHA-256 of a file's content
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// khojIndexedFiles lists the names of the uploaded files Khoj currently holds
+func khojIndexedFiles(ctx context.Context, apiBase, apiKey string) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+"/api/content/computer", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file list request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Khoj files: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("file list failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var names []string
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, fmt.Errorf("failed to parse Khoj file list: %w", err)
+	}
+	indexed := make(map[string]bool, len(names))
+	for _, name := range names {
+		indexed[name] = true
+	}
+	return indexed, nil
+}
+
+// indexFileOnce indexes a file unless Khoj already holds the same content from this client, in which case it
+// returns the name Khoj has it under. Text files larger than index.chunk_bytes are indexed in parts, whose count
+// is returned.
+func indexFileOnce(ctx context.Context, apiBase, apiKey, name string, data []byte) (string, int, error) {
+	hash := contentHash(data)
+	if !appConfig().Dedup.Disabled {
+		if existing := alreadyIndexed(ctx, apiBase, apiKey, name, hash); existing != "" {
+			return existing, 0, nil
+		}
+	}
+
+	if size := indexChunkBytes(); len(data) > size && utf8.Valid(data) {
+		upload := indexUploadFor(name, hash, data, size)
+		return "", upload.Parts, upload.run(ctx, apiBase, apiKey)
+	}
+	if err := indexFileToKhoj(ctx, apiBase, apiKey, name, data); err != nil {
+		return "", 0, err
+	}
+	replaceUploadedFile(ctx, apiBase, apiKey, hash, UploadedFile{Name: name, Size: len(data), UploadedAt: time.Now()})
+	return "", 0, nil
+}
+
+// alreadyIndexed returns the name Khoj holds the content under, or "" when it has to be uploaded.
+// Recorded files that Khoj no longer lists were deleted there and are forgotten.
+func alreadyIndexed(ctx context.Context, apiBase, apiKey, name, hash string) string {
+	uploadedFilesMu.Lock()
+	files, err := loadUploadedFiles()
+	uploadedFilesMu.Unlock()
+	if err != nil {
+		log.Printf("⚠️ %v; uploading %s without dedup", err, name)
+		return ""
+	}
+
+	previous, ok := files[hash]
+	if !ok {
+		return ""
+	}
+	indexed, err := khojIndexedFiles(ctx, apiBase, apiKey)
+	switch {
+	case err != nil:
+		log.Printf("⚠️ Could not check whether Khoj still has %s, uploading again: %v", previous.Name, err)
+	case previous.indexedIn(indexed):
+		log.Printf("♻️ %s is already indexed in Khoj as %s; skipping upload", name, previous.Name)
+		return previous.Name
+	default:
+		log.Printf("🗑️ %s was deleted from Khoj; uploading again", previous.Name)
+		if err := forgetUploadedFiles(indexed); err != nil {
+			log.Printf("Failed to update uploaded files: %v", err)
+		}
+	}
+	return ""
+}
+
+// replaceUploadedFile records a newly indexed file and deletes the documents of older content under the same name
+// that it did not replace, such as the extra parts of a file that shrank
+func replaceUploadedFile(ctx context.Context, apiBase, apiKey, hash string, file UploadedFile) {
+	stale, err := recordUploadedFile(hash, file)
+	if err != nil {
+		log.Printf("Failed to record uploaded file: %v", err)
+	}
+	for _, name := range stale {
+		if err := deleteKhojContentFile(ctx, apiBase, apiKey, name); err != nil {
+			log.Printf("⚠️ Failed to delete %s, left over from an earlier upload of %s: %v", name, file.Name, err)
+		}
+	}
+}
+
+// recordUploadedFile stores a newly indexed file. Khoj replaces content by file name, so older content
+// uploaded under the same name is dropped; its documents that file doesn't overwrite are returned.
+func recordUploadedFile(hash string, file UploadedFile) ([]string, error) {
+	uploadedFilesMu.Lock()
+	defer uploadedFilesMu.Unlock()
+
+	files, err := loadUploadedFiles()
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]bool)
+	for _, name := range file.documents() {
+		kept[name] = true
+	}
+	var stale []string
+	for h, f := range files {
+		if f.Name != file.Name {
+			continue
+		}
+		for _, name := range f.documents() {
+			if !kept[name] && h != hash {
+				stale = append(stale, name)
+			}
+		}
+		delete(files, h)
+	}
+	files[hash] = file
+	return stale, saveUploadedFiles(files)
+}
+
+// forgetUploadedFiles drops recorded files missing from Khoj's list; a nil list forgets everything
+func forgetUploadedFiles(indexed map[string]bool) error {
+	uploadedFilesMu.Lock()
+	defer uploadedFilesMu.Unlock()
+
+	files, err := loadUploadedFiles()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for h, f := range files {
+		if !f.indexedIn(indexed) {
+			delete(files, h)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	log.Printf("🧹 Forgot %d uploaded file(s)", removed)
+	return saveUploadedFiles(files)
+}
+
+// maxAPIFileSize caps files uploaded through /v1/files
+const maxAPIFileSize = 50 << 20
+
+// APIFile is a file uploaded through /v1/files, in the shape of an OpenAI file object
+type APIFile struct {
+	ID        string      `json:"id"`
+	Object    string      `json:"object"`
+	Bytes     int         `json:"bytes"`
+	CreatedAt int64       `json:"created_at"`
+	Filename  string      `json:"filename"`
+	Purpose   string      `json:"purpose"`
+	Status    string      `json:"status"`
+	XKhoj     APIFileKhoj `json:"x_khoj"`
+}
+
+// APIFileKhoj is where Khoj holds an uploaded file's content
+type APIFileKhoj struct {
+	IndexedAs string `json:"indexed_as"`      // Another upload's name when Khoj already had the same content
+	Parts     int    `json:"parts,omitempty"` // Documents a large text file was indexed as
+	Hash      string `json:"hash"`
+}
+
+// apiFileIDPattern matches the IDs handed out by uploadAPIFile, which also name the stored copies
+var apiFileIDPattern = regexp.MustCompile(`^file-[0-9a-f]{24}$`)
+
+var apiFilesMu sync.Mutex
+
+// loadAPIFiles reads the ID -> file map; a missing file means nothing was uploaded yet
+func loadAPIFiles() (map[string]APIFile, error) {
+	files := make(map[string]APIFile)
+	data, err := os.ReadFile(apiFilesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, fmt.Errorf("failed to read uploaded API files: %w", err)
+	}
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse uploaded API files: %w", err)
+	}
+	return files, nil
+}
+
+// saveAPIFiles writes the ID -> file map
+func saveAPIFiles(files map[string]APIFile) error {
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal uploaded API files: %w", err)
+	}
+	if err := os.WriteFile(apiFilesFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write uploaded API files: %w", err)
+	}
+	return nil
+}
+
+// lookupAPIFile returns an uploaded file by ID
+func lookupAPIFile(id string) (APIFile, error) {
+	apiFilesMu.Lock()
+	files, err := loadAPIFiles()
+	apiFilesMu.Unlock()
+	if err != nil {
+		return APIFile{}, err
+	}
+	file, ok := files[id]
+	if !ok {
+		return APIFile{}, fmt.Errorf("no such file: %s", id)
+	}
+	return file, nil
+}
+
+// openAPIFile returns an uploaded file and its content
+func openAPIFile(id string) (APIFile, []byte, error) {
+	file, err := lookupAPIFile(id)
+	if err != nil {
+		return file, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(apiFilesDir, id))
+	if err != nil {
+		return file, nil, fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	return file, data, nil
+}
+
+// uploadAPIFile indexes a file into Khoj's content API and keeps a copy for attaching it to chat requests.
+// It is indexed as files/<id>/<filename>, since Khoj replaces content by name.
+func (kp *KhojProvider) uploadAPIFile(ctx context.Context, filename, purpose string, data []byte) (APIFile, error) {
+	file := APIFile{
+		ID:        "file-" + randomHex(12),
+		Object:    "file",
+		Bytes:     len(data),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}
+	file.XKhoj.IndexedAs = path.Join("files", file.ID, filename)
+	file.XKhoj.Hash = contentHash(data)
+
+	if err := os.MkdirAll(apiFilesDir, 0755); err != nil {
+		return file, fmt.Errorf("failed to create %s: %w", apiFilesDir, err)
+	}
+	stored := filepath.Join(apiFilesDir, file.ID)
+	if err := os.WriteFile(stored, data, 0644); err != nil {
+		return file, fmt.Errorf("failed to store %s: %w", filename, err)
+	}
+
+	existing, parts, err := indexFileOnce(ctx, kp.APIBase, kp.APIKey, file.XKhoj.IndexedAs, data)
+	if err != nil {
+		os.Remove(stored)
+		return file, err
+	}
+	if existing != "" {
+		file.XKhoj.IndexedAs = existing
+	}
+	file.XKhoj.Parts = parts
+
+	apiFilesMu.Lock()
+	defer apiFilesMu.Unlock()
+	files, err := loadAPIFiles()
+	if err == nil {
+		files[file.ID] = file
+		err = saveAPIFiles(files)
+	}
+	if err != nil {
+		os.Remove(stored)
+		return file, err
+	}
+	logRequest(ctx, "📎 Uploaded %s as %s (%d bytes), indexed as %s", filename, file.ID, file.Bytes, file.XKhoj.IndexedAs)
+	return file, nil
+}
+
+// apiUploadedName reports whether a Khoj document name is one uploadAPIFile chose, files/<id>/<filename>. Documents
+// deduplicated against the CLI indexer, the drop window or the workspace indexer belong to them and are never deleted.
+func apiUploadedName(name string) bool {
+	dir, _, ok := strings.Cut(strings.TrimPrefix(name, "files/"), "/")
+	return ok && strings.HasPrefix(name, "files/") && apiFileIDPattern.MatchString(dir)
+}
+
+// deleteAPIFile forgets an uploaded file and deletes it on Khoj, unless another upload shares its document or it
+// was indexed by another part of the wrapper
+func (kp *KhojProvider) deleteAPIFile(ctx context.Context, id string) error {
+	apiFilesMu.Lock()
+	defer apiFilesMu.Unlock()
+	files, err := loadAPIFiles()
+	if err != nil {
+		return err
+	}
+	file, ok := files[id]
+	if !ok {
+		return fmt.Errorf("no such file: %s", id)
+	}
+
+	shared := !apiUploadedName(file.XKhoj.IndexedAs)
+	for otherID, other := range files {
+		shared = shared || (otherID != id && other.XKhoj.IndexedAs == file.XKhoj.IndexedAs)
+	}
+	if !shared {
+		names := []string{file.XKhoj.IndexedAs}
+		if file.XKhoj.Parts > 0 {
+			names = names[:0]
+			for i := 1; i <= file.XKhoj.Parts; i++ {
+				names = append(names, partName(file.XKhoj.IndexedAs, i))
+			}
+		}
+		for _, name := range names {
+			if err := deleteKhojContentFile(ctx, kp.APIBase, kp.APIKey, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	delete(files, id)
+	if err := saveAPIFiles(files); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(apiFilesDir, id)); err != nil && !os.IsNotExist(err) {
+		logRequest(ctx, "⚠️ Failed to remove the stored copy of %s: %v", id, err)
+	}
+	logRequest(ctx, "🗑️ Deleted uploaded file %s (%s)", id, file.Filename)
+	return nil
+}
+
+// deleteKhojContentFile removes one indexed document from the user's Khoj knowledge base; one that is already
+// gone counts as deleted
+func deleteKhojContentFile(ctx context.Context, apiBase, apiKey, name string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", apiBase+"/api/content/file?filename="+url.QueryEscape(name), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	setRequestIDHeader(req)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from Khoj: %w", name, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("deleting %s failed with status %d: %s", name, resp.StatusCode, string(body))
+}
+
+// handleFiles serves the OpenAI files API: upload (POST /v1/files), list (GET /v1/files), retrieve
+// (GET /v1/files/<id>), download (GET /v1/files/<id>/content) and delete (DELETE /v1/files/<id>)
+func (kp *KhojProvider) handleFiles(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/files"), "/")
+	id, sub, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		kp.handleFileUpload(w, r)
+		return
+	case id == "" && r.Method == http.MethodGet:
+		apiFilesMu.Lock()
+		files, err := loadAPIFiles()
+		apiFilesMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := []APIFile{}
+		for _, f := range files {
+			if purpose := r.URL.Query().Get("purpose"); purpose == "" || f.Purpose == purpose {
+				list = append(list, f)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].CreatedAt != list[j].CreatedAt {
+				return list[i].CreatedAt > list[j].CreatedAt
+			}
+			return list[i].ID < list[j].ID
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": list})
+		return
+	case id == "" || (sub != "" && sub != "content"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !apiFileIDPattern.MatchString(id) {
+		http.Error(w, fmt.Sprintf("No such file: %s", id), http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && sub == "content":
+		file, data, err := openAPIFile(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(file.Filename))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+	case r.Method == http.MethodGet:
+		file, err := lookupAPIFile(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(file)
+	case r.Method == http.MethodDelete && sub == "":
+		if _, err := lookupAPIFile(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := kp.deleteAPIFile(r.Context(), id); err != nil {
+			logRequest(r.Context(), "❌ Failed to delete %s: %v", id, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "object": "file", "deleted": true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFileUpload indexes a multipart upload (fields file and purpose) and answers with its file object
+func (kp *KhojProvider) handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIFileSize+1<<20)
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+	data, err := io.ReadAll(io.LimitReader(upload, maxAPIFileSize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAPIFileSize {
+		http.Error(w, fmt.Sprintf("File is larger than %d MB", maxAPIFileSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := checkTeamDeny(r.Context(), string(data)); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(openAIError(err))
+		return
+	}
+
+	// Only the base name is kept, so an upload can't name a path outside files/<id>
+	filename := filepath.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+	if filename == "" || filename == "." || filename == "/" {
+		http.Error(w, "file has no name", http.StatusBadRequest)
+		return
+	}
+	purpose := r.FormValue("purpose")
+	if purpose == "" {
+		purpose = "assistants"
+	}
+
+	file, err := kp.uploadAPIFile(r.Context(), filename, purpose, data)
+	if err != nil {
+		logRequest(r.Context(), "❌ Failed to upload %s: %v", filename, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// indexPart is one document of a file indexed in parts
+type indexPart struct {
+	Name string
+	Data []byte
+}
+
+// partName names part i after the file, e.g. notes.part-2.md, so Khoj keeps the extension's file type. The name
+// leaves out the part count, so the parts of a file uploaded again replace those of the earlier upload.
+func partName(name string, i int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.part-%d%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// splitIndexParts cuts text into parts of about size bytes, at line breaks where possible.
+// Each part starts with a line giving its position, so search results can be put back in order.
+func splitIndexParts(name string, data []byte, size int) []indexPart {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := min(size, len(data))
+		if n < len(data) {
+			if cut := bytes.LastIndexByte(data[:n], '\n'); cut > 0 {
+				n = cut + 1
+			} else {
+				for n > 1 && !utf8.RuneStart(data[n]) {
+					n--
+				}
+			}
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+
+	parts := make([]indexPart, len(chunks))
+	for i, chunk := range chunks {
+		header := fmt.Sprintf("Part %d of %d of %s\n\n", i+1, len(chunks), name)
+		parts[i] = indexPart{Name: partName(name, i+1), Data: append([]byte(header), chunk...)}
+	}
+	return parts
+}
+
+// indexChunkBytes is the size above which text files are indexed in parts
+func indexChunkBytes() int {
+	if appConfig().Index.ChunkBytes > 0 {
+		return appConfig().Index.ChunkBytes
+	}
+	return defaultIndexChunkBytes
+}
+
+// indexUpload is a file being indexed in parts. A failed upload is kept in memory and resumes at the failed part.
+type indexUpload struct {
+	UploadEvent
+	hash  string
+	parts []indexPart
+}
+
+// maxPausedUploads caps the failed uploads kept for resuming; the oldest are dropped first
+const maxPausedUploads = 10
+
+var (
+	indexUploads   []*indexUpload
+	indexUploadSeq int
+	indexUploadsMu sync.Mutex
+)
+
+// indexUploadFor returns the paused upload of the same content to resume, or starts a new one
+func indexUploadFor(name, hash string, data []byte, size int) *indexUpload {
+	indexUploadsMu.Lock()
+	defer indexUploadsMu.Unlock()
+
+	for _, u := range indexUploads {
+		if u.hash == hash && u.Name == name {
+			return u
+		}
+	}
+
+	parts := splitIndexParts(name, data, size)
+	indexUploadSeq++
+	u := &indexUpload{
+		UploadEvent: UploadEvent{ID: indexUploadSeq, Name: name, Bytes: len(data), Parts: len(parts)},
+		hash:        hash,
+		parts:       parts,
+	}
+	var paused []*indexUpload
+	for _, old := range indexUploads {
+		if !old.Running {
+			paused = append(paused, old)
+		}
+	}
+	for _, old := range paused[:max(len(paused)-maxPausedUploads+1, 0)] {
+		removeIndexUploadLocked(old)
+	}
+	indexUploads = append(indexUploads, u)
+	log.Printf("📦 Indexing %s (%d bytes) in %d parts", name, len(data), len(parts))
+	return u
+}
+
+// removeIndexUploadLocked drops an upload from indexUploads; the caller holds indexUploadsMu
+func removeIndexUploadLocked(u *indexUpload) {
+	for i, other := range indexUploads {
+		if other == u {
+			indexUploads = append(indexUploads[:i], indexUploads[i+1:]...)
+			return
+		}
+	}
+}
+
+// findIndexUpload returns an upload by ID, or nil
+func findIndexUpload(id int) *indexUpload {
+	indexUploadsMu.Lock()
+	defer indexUploadsMu.Unlock()
+	for _, u := range indexUploads {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// run uploads the remaining parts in order. It stops at the first failure, so the next run resumes at that part.
+func (u *indexUpload) run(ctx context.Context, apiBase, apiKey string) error {
+	indexUploadsMu.Lock()
+	if u.Running {
+		indexUploadsMu.Unlock()
+		return fmt.Errorf("%s is already being indexed", u.Name)
+	}
+	u.Running, u.Error = true, ""
+	if u.Done > 0 {
+		log.Printf("▶️ Resuming %s at part %d of %d", u.Name, u.Done+1, u.Parts)
+	}
+	indexUploadsMu.Unlock()
+
+	for {
+		indexUploadsMu.Lock()
+		next, ev := u.Done, u.UploadEvent
+		indexUploadsMu.Unlock()
+		if next == u.Parts {
+			break
+		}
+		bus.Publish(topicUpload, "progress", ev)
+
+		part := u.parts[next]
+		if err := indexFileToKhoj(ctx, apiBase, apiKey, part.Name, part.Data); err != nil {
+			indexUploadsMu.Lock()
+			u.Running, u.Error = false, err.Error()
+			ev := u.UploadEvent
+			indexUploadsMu.Unlock()
+			bus.Publish(topicUpload, "failed", ev)
+			return fmt.Errorf("indexed %d of %d parts of %s, drop it again or resume from the dashboard: %w", next, u.Parts, u.Name, err)
+		}
+
+		indexUploadsMu.Lock()
+		u.Done++
+		indexUploadsMu.Unlock()
+	}
+
+	indexUploadsMu.Lock()
+	u.Running = false
+	removeIndexUploadLocked(u)
+	ev := u.UploadEvent
+	indexUploadsMu.Unlock()
+	bus.Publish(topicUpload, "done", ev)
+
+	replaceUploadedFile(ctx, apiBase, apiKey, u.hash, UploadedFile{Name: u.Name, Size: u.Bytes, Parts: u.Parts, UploadedAt: time.Now()})
+	return nil
+}
+
+// handleIndexUploads lists uploads in progress or paused (GET), resumes one (POST ?id=) or discards a paused one (DELETE ?id=)
+func handleIndexUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		u := findIndexUpload(id)
+		if u == nil {
+			http.Error(w, "Unknown upload", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			apiBase := os.Getenv("KHOJ_API_BASE")
+			if apiBase == "" {
+				apiBase = "https://app.khoj.dev"
+			}
+			if err := u.run(r.Context(), apiBase, os.Getenv("KHOJ_API_KEY")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		case http.MethodDelete:
+			indexUploadsMu.Lock()
+			running := u.Running
+			if !running {
+				removeIndexUploadLocked(u)
+			}
+			indexUploadsMu.Unlock()
+			if running {
+				http.Error(w, "Upload is in progress", http.StatusConflict)
+				return
+			}
+			log.Printf("🗑️ Discarded paused upload of %s at part %d of %d", u.Name, u.Done, u.Parts)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	indexUploadsMu.Lock()
+	uploads := make([]UploadEvent, len(indexUploads))
+	for i, u := range indexUploads {
+		uploads[i] = u.UploadEvent
+	}
+	indexUploadsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploads)
+}
+
+// handleDashboardUploads lists the files indexed from this client (GET), drops those deleted on Khoj (POST)
+// or forgets them all so they are uploaded again (DELETE)
+func handleDashboardUploads(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		apiBase := os.Getenv("KHOJ_API_BASE")
+		if apiBase == "" {
+			apiBase = "https://app.khoj.dev"
+		}
+		var indexed map[string]bool
+		if indexed, err = khojIndexedFiles(r.Context(), apiBase, os.Getenv("KHOJ_API_KEY")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		err = forgetUploadedFiles(indexed)
+	case http.MethodDelete:
+		err = forgetUploadedFiles(nil)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uploadedFilesMu.Lock()
+	files, err := loadUploadedFiles()
+	uploadedFilesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type entry struct {
+		Hash string `json:"hash"`
+		UploadedFile
+	}
+	entries := []entry{}
+	for hash, f := range files {
+		entries = append(entries, entry{Hash: hash, UploadedFile: f})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UploadedAt.After(entries[j].UploadedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// attachmentResendTurns is how many requests an unchanged chat attachment is left out for before it is sent again,
+// so it never falls out of the conversation history Khoj passes to the model
+const attachmentResendTurns = 4
+
+// attachmentLedger remembers which attachment contents each Khoj conversation has received and at which request
+type attachmentLedger struct {
+	mu    sync.Mutex
+	turns map[string]int            // Conversation ID -> requests recorded
+	sent  map[string]map[string]int // Conversation ID -> content hash -> request it was last sent with
+}
+
+// sentAttachments tracks chat completion attachments per conversation; it is not persisted
+var sentAttachments = &attachmentLedger{turns: make(map[string]int), sent: make(map[string]map[string]int)}
+
+// Filter leaves out files the conversation received unchanged within the last attachmentResendTurns requests,
+// returning the files to send and the names of those left out
+func (l *attachmentLedger) Filter(convID string, files []KhojFile) ([]KhojFile, []string) {
+	if appConfig().Dedup.Disabled || convID == "" || len(files) == 0 {
+		return files, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var kept []KhojFile
+	var skipped []string
+	for _, f := range files {
+		if turn, ok := l.sent[convID][contentHash([]byte(f.Content))]; ok && l.turns[convID]-turn < attachmentResendTurns {
+			skipped = append(skipped, f.Name)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept, skipped
+}
+
+// Record counts a successful request to the conversation and notes the files it carried
+func (l *attachmentLedger) Record(convID string, files []KhojFile) {
+	if convID == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.turns[convID]++
+	if len(files) == 0 {
+		return
+	}
+	if l.sent[convID] == nil {
+		l.sent[convID] = make(map[string]int)
+	}
+	for _, f := range files {
+		l.sent[convID][contentHash([]byte(f.Content))] = l.turns[convID]
+	}
+}
+
+// Forget drops a conversation deleted on Khoj; an empty ID forgets every conversation
+func (l *attachmentLedger) Forget(convID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if convID == "" {
+		l.turns, l.sent = make(map[string]int), make(map[string]map[string]int)
+		return
+	}
+	delete(l.turns, convID)
+	delete(l.sent, convID)
+}
+
+// Limits for the transcript mirror, which lives in memory only
+const (
+	maxTranscriptExchanges     = 100      // Per conversation, oldest dropped first
+	maxTranscriptConversations = 20       // Least recently active dropped first
+	maxTranscriptTextBytes     = 64 << 10 // Per prompt or answer
+)
+
+// TranscriptExchange is one prompt the wrapper sent to Khoj and the answer it got back, as they went over the wire
+type TranscriptExchange struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"`          // Client ID sent to Khoj, or "clipboard" for the Clipboard AI, quick ask and templates
+	Sent      string    `json:"sent"`            // The flattened prompt, with its system lines and slash commands
+	Files     []string  `json:"files,omitempty"` // Names of the files attached to the request
+	Received  string    `json:"received,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	RequestID string    `json:"request_id,omitempty"` // The inbound request that caused it, as in X-Request-Id
+
+	// Recovered from the stream journal: Received is the part of the answer streamed before the wrapper stopped
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// transcriptMirror keeps the recent exchanges of each Khoj conversation the wrapper talked to
+type transcriptMirror struct {
+	mu        sync.Mutex
+	exchanges map[string][]TranscriptExchange // Khoj conversation ID -> exchanges, oldest first
+	updated   map[string]time.Time
+}
+
+// transcripts mirrors every chat request the wrapper sends; it is not persisted, apart from the answers
+// streamJournal.Recover saves to interruptedFile
+var transcripts = &transcriptMirror{exchanges: make(map[string][]TranscriptExchange), updated: make(map[string]time.Time)}
+
+// mirrorExchange records a finished request to convID, taking the conversation Khoj answered in when convID is empty
+func mirrorExchange(ctx context.Context, convID, source, sent string, files []KhojFile, start time.Time, resp *KhojResponse, err error) {
+	exchange := TranscriptExchange{
+		Time:      start,
+		Source:    source,
+		Sent:      truncateText(sent, maxTranscriptTextBytes),
+		LatencyMs: time.Since(start).Milliseconds(),
+		RequestID: requestIDFrom(ctx),
+	}
+	for _, f := range files {
+		exchange.Files = append(exchange.Files, f.Name)
+	}
+	if err != nil {
+		exchange.Error = strings.TrimSpace(err.Error())
+	} else if resp != nil {
+		exchange.Received = truncateText(resp.Response, maxTranscriptTextBytes)
+		if convID == "" {
+			convID = resp.ConversationID
+		}
+	}
+	transcripts.Record(convID, exchange)
+}
+
+// Record appends an exchange to a conversation, dropping the oldest exchanges and conversations over the limits
+func (m *transcriptMirror) Record(convID string, exchange TranscriptExchange) {
+	if convID == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exchanges := append(m.exchanges[convID], exchange)
+	if len(exchanges) > maxTranscriptExchanges {
+		exchanges = append([]TranscriptExchange(nil), exchanges[len(exchanges)-maxTranscriptExchanges:]...)
+	}
+	m.exchanges[convID] = exchanges
+	m.updated[convID] = time.Now()
+
+	for len(m.exchanges) > maxTranscriptConversations {
+		oldest := convID
+		for id, at := range m.updated {
+			if at.Before(m.updated[oldest]) {
+				oldest = id
+			}
+		}
+		delete(m.exchanges, oldest)
+		delete(m.updated, oldest)
+	}
+}
+
+// Exchanges returns a copy of a conversation's exchanges, oldest first
+func (m *transcriptMirror) Exchanges(convID string) []TranscriptExchange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]TranscriptExchange{}, m.exchanges[convID]...)
+}
+
+// Exchange returns one exchange of a conversation by its position, oldest first
+func (m *transcriptMirror) Exchange(convID string, index int) (TranscriptExchange, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exchanges := m.exchanges[convID]
+	if index < 0 || index >= len(exchanges) {
+		return TranscriptExchange{}, false
+	}
+	return exchanges[index], true
+}
+
+// Conversations lists the mirrored conversation IDs, most recently active first
+func (m *transcriptMirror) Conversations() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.updated))
+	for id := range m.updated {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return m.updated[ids[i]].After(m.updated[ids[j]]) })
+	return ids
+}
+
+// Forget drops a conversation's exchanges, or every conversation's for an empty ID
+func (m *transcriptMirror) Forget(convID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if convID == "" {
+		m.exchanges, m.updated = make(map[string][]TranscriptExchange), make(map[string]time.Time)
+		return
+	}
+	delete(m.exchanges, convID)
+	delete(m.updated, convID)
+}
+
+// streamJournalWriter appends streamed answers to the stream journal as they arrive. Each line is written as soon as
+// Khoj sends it, so the operating system has it even when the wrapper crashes. Once no stream is in flight, the
+// finished ones are in the transcript and the journal is emptied.
+type streamJournalWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	active int
+	gen    int  // Bumped when the file is closed, so entries started before a wipe stop writing
+	owned  bool // Set once recovered; only the tray app and serve journal, never a filter or companion process
+}
+
+// streamJournalRecord is one line of the journal: a stream's start, a piece of its answer, or its end
+type streamJournalRecord struct {
+	ID             string     `json:"id"`
+	Time           *time.Time `json:"time,omitempty"` // Start records only
+	ConversationID string     `json:"conversation_id,omitempty"`
+	Source         string     `json:"source,omitempty"`
+	Sent           string     `json:"sent,omitempty"`
+	Files          []string   `json:"files,omitempty"`
+	RequestID      string     `json:"request_id,omitempty"`
+	Delta          string     `json:"delta,omitempty"`
+	Done           bool       `json:"done,omitempty"`
+}
+
+// streamJournalEntry is one stream being journaled
+type streamJournalEntry struct {
+	journal *streamJournalWriter
+	id      string
+	gen     int
+}
+
+var streamJournal = &streamJournalWriter{}
+
+// Start journals a stream about to be sent to Khoj, or returns nil when the journal is off or privacy mode is on
+func (j *streamJournalWriter) Start(ctx context.Context, req *KhojRequest) *streamJournalEntry {
+	if !appConfig().Stream.Journal || privacyMode.Load() {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.owned {
+		return nil
+	}
+	if j.file == nil {
+		f, err := os.OpenFile(streamJournalFile, os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekEnd)
+		}
+		if err != nil {
+			logRequest(ctx, "⚠️ Failed to open the stream journal, streaming without it: %v", err)
+			return nil
+		}
+		j.file = f
+	}
+	j.active++
+	entry := &streamJournalEntry{journal: j, id: randomHex(8), gen: j.gen}
+	now := time.Now()
+	record := streamJournalRecord{
+		ID:             entry.id,
+		Time:           &now,
+		ConversationID: req.ConversationID,
+		Source:         req.ClientID,
+		Sent:           truncateText(req.Q, maxTranscriptTextBytes),
+		RequestID:      requestIDFrom(ctx),
+	}
+	for _, f := range req.Files {
+		record.Files = append(record.Files, f.Name)
+	}
+	j.writeLocked(record)
+	return entry
+}
+
+// Append journals a piece of the answer; nothing is written once privacy mode was turned on
+func (e *streamJournalEntry) Append(text string) {
+	if privacyMode.Load() {
+		return
+	}
+	e.journal.mu.Lock()
+	defer e.journal.mu.Unlock()
+	if e.gen == e.journal.gen {
+		e.journal.writeLocked(streamJournalRecord{ID: e.id, Delta: text})
+	}
+}
+
+// Finish marks the stream as ended, emptying the journal when it was the last one in flight
+func (e *streamJournalEntry) Finish() {
+	j := e.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if e.gen != j.gen {
+		return
+	}
+	j.active--
+	if j.active > 0 {
+		j.writeLocked(streamJournalRecord{ID: e.id, Done: true})
+		return
+	}
+	if err := j.file.Truncate(0); err != nil {
+		log.Printf("⚠️ Failed to empty the stream journal: %v", err)
+		j.writeLocked(streamJournalRecord{ID: e.id, Done: true})
+		return
+	}
+	j.file.Seek(0, io.SeekStart)
+}
+
+// Close closes the journal file; streams in flight stop writing to it
+func (j *streamJournalWriter) Close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	j.active = 0
+	j.gen++
+}
+
+func (j *streamJournalWriter) writeLocked(record streamJournalRecord) {
+	line, _ := json.Marshal(record)
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		log.Printf("⚠️ Failed to write the stream journal: %v", err)
+	}
+}
+
+// maxInterruptedAnswers caps interruptedFile; the oldest recovered answers are dropped first
+const maxInterruptedAnswers = 50
+
+// interruptedAnswer is an answer recovered from the stream journal, as saved in interruptedFile
+type interruptedAnswer struct {
+	ConversationID string `json:"conversation_id"`
+	TranscriptExchange
+}
+
+// loadInterruptedAnswers reads the recovered answers; a missing file means none
+func loadInterruptedAnswers() ([]interruptedAnswer, error) {
+	data, err := os.ReadFile(interruptedFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recovered answers: %w", err)
+	}
+	var answers []interruptedAnswer
+	if err := json.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("failed to parse recovered answers: %w", err)
+	}
+	return answers, nil
+}
+
+// saveInterruptedAnswers writes a sibling file and renames it over interruptedFile, so a crash never leaves it half
+// written
+func saveInterruptedAnswers(answers []interruptedAnswer) error {
+	data, err := json.MarshalIndent(answers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal recovered answers: %w", err)
+	}
+	tmp := interruptedFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write recovered answers: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, interruptedFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write recovered answers: %w", err)
+	}
+	return nil
+}
+
+// Recover saves the answers a crash cut off to interruptedFile, marked as interrupted, empties the journal and
+// starts journaling. Every answer in interruptedFile is put in the transcript, so they survive later restarts too.
+// The journal is only emptied once its answers are saved. It runs at startup, before any stream is sent.
+func (j *streamJournalWriter) Recover() {
+	j.mu.Lock()
+	j.owned = true
+	j.mu.Unlock()
+
+	saved, err := loadInterruptedAnswers()
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	defer func() {
+		for _, answer := range saved {
+			transcripts.Record(answer.ConversationID, answer.TranscriptExchange)
+		}
+	}()
+
+	data, err := os.ReadFile(streamJournalFile)
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	var order []string
+	started := make(map[string]*streamJournalRecord)
+	answers := make(map[string]*strings.Builder)
+	for _, line := range strings.Split(string(data), "\n") {
+		var record streamJournalRecord
+		if json.Unmarshal([]byte(line), &record) != nil || record.ID == "" {
+			continue // A line cut off by the crash
+		}
+		switch {
+		case record.Done:
+			delete(started, record.ID)
+		case record.Delta != "":
+			if answer := answers[record.ID]; answer != nil && started[record.ID] != nil {
+				answer.WriteString(record.Delta)
+			}
+		case record.Time != nil:
+			r := record
+			started[record.ID] = &r
+			answers[record.ID] = &strings.Builder{}
+			order = append(order, record.ID)
+		}
+	}
+
+	recovered := 0
+	for _, id := range order {
+		start := started[id]
+		if start == nil {
+			continue
+		}
+		saved = append(saved, interruptedAnswer{ConversationID: start.ConversationID, TranscriptExchange: TranscriptExchange{
+			Time:        *start.Time,
+			Source:      start.Source,
+			Sent:        start.Sent,
+			Files:       start.Files,
+			Received:    truncateText(answers[id].String(), maxTranscriptTextBytes),
+			RequestID:   start.RequestID,
+			Interrupted: true,
+		}})
+		recovered++
+	}
+	if recovered > 0 {
+		saved = saved[max(len(saved)-maxInterruptedAnswers, 0):]
+		if err := saveInterruptedAnswers(saved); err != nil {
+			log.Printf("⚠️ %v; keeping the stream journal to recover from at the next start", err)
+			return
+		}
+		log.Printf("♻️ Recovered %d answer(s) cut off when the wrapper stopped; they are in the dashboard transcript and %s", recovered, interruptedFile)
+	}
+	if err := os.Truncate(streamJournalFile, 0); err != nil {
+		log.Printf("⚠️ Failed to empty the stream journal: %v", err)
+	}
+}
+
+// activeKhojConversation is the Khoj conversation requests to the current conversation go to, following a fallback
+func activeKhojConversation() string {
+	agentFallbacksMu.Lock()
+	defer agentFallbacksMu.Unlock()
+	if fb, ok := agentFallbacks[conversationID]; ok {
+		return fb.ConversationID
+	}
+	return conversationID
+}
+
+// handleDashboardTranscript returns the mirrored exchanges of ?conversation_id=, the active conversation by default
+// (GET), or clears them (DELETE; every conversation's without an ID)
+func handleDashboardTranscript(w http.ResponseWriter, r *http.Request) {
+	convID := r.URL.Query().Get("conversation_id")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		transcripts.Forget(convID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	active := activeKhojConversation()
+	if convID == "" {
+		convID = active
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_id": convID,
+		"active":          active,
+		"conversations":   transcripts.Conversations(),
+		"exchanges":       transcripts.Exchanges(convID),
+	})
+}
+
+// ReplayRequest sends a transcript exchange's prompt to Khoj again, optionally to another agent or edited
+type ReplayRequest struct {
+	ConversationID string    `json:"conversation_id"`
+	Index          int       `json:"index"`
+	Time           time.Time `json:"time"`             // The exchange's time, so a transcript that moved on is not misread
+	Agent          string    `json:"agent,omitempty"`  // Defaults to the current agent
+	Prompt         string    `json:"prompt,omitempty"` // Defaults to the prompt sent originally
+}
+
+// ReplayResult is a replayed answer with its word diff against the original answer
+type ReplayResult struct {
+	Agent     string     `json:"agent"`
+	Original  string     `json:"original"`
+	Received  string     `json:"received"`
+	LatencyMs int64      `json:"latency_ms"`
+	Spans     []diffSpan `json:"spans"`
+}
+
+// handleDashboardReplay lists the agents a replay can use (GET) or replays an exchange (POST). Replays go to a
+// fresh conversation that is deleted afterwards, so they see only the prompt and leave no trace in the transcript.
+func (kp *KhojProvider) handleDashboardReplay(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var slugs []string
+		if agents, err := kp.khojAgents(r.Context()); err == nil {
+			for _, agent := range agents {
+				slugs = append(slugs, agent.Slug)
+			}
+		} else {
+			logRequest(r.Context(), "Error listing Khoj agents for replay: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"agents": slugs, "current": currentAgentSlug})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	exchange, ok := transcripts.Exchange(req.ConversationID, req.Index)
+	if !ok || !exchange.Time.Equal(req.Time) {
+		http.Error(w, "Exchange is no longer in the transcript; refresh and try again", http.StatusConflict)
+		return
+	}
+	agent := strings.TrimSpace(req.Agent)
+	if agent == "" {
+		agent = currentAgentSlug
+	}
+	if agent == "" {
+		agent = defaultAgentSlug
+	}
+	prompt := req.Prompt
+	if strings.TrimSpace(prompt) == "" {
+		prompt = exchange.Sent
+	}
+
+	convID, err := createConversationWithAgent(kp.APIBase, kp.APIKey, agent)
+	if err != nil {
+		logRequest(r.Context(), "Error creating replay conversation: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to create conversation for %s: %v", agent, err), http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		if err := deleteKhojConversation(kp.APIBase, kp.APIKey, convID); err != nil {
+			logRequest(r.Context(), "Failed to delete replay conversation %s: %v", convID, err)
+		}
+		transcripts.Forget(convID)
+	}()
+
+	start := time.Now()
+	resp, err := kp.callKhojAPI(r.Context(), &KhojRequest{Q: prompt, ConversationID: convID, ClientID: "khoj-provider-replay"})
+	if err != nil {
+		logRequest(r.Context(), "Error replaying exchange: %v", err)
+		http.Error(w, fmt.Sprintf("Replay failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	result := ReplayResult{
+		Agent:     agent,
+		Original:  exchange.Received,
+		Received:  resp.Response,
+		LatencyMs: time.Since(start).Milliseconds(),
+		Spans:     wordDiff(exchange.Received, resp.Response),
+	}
+	logRequest(r.Context(), "🔁 Replayed exchange %d of %s with %s in %d ms", req.Index, req.ConversationID, agent, result.LatencyMs)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// QuickAskRequest is a question typed into the quick-ask popup
+type QuickAskRequest struct {
+	Question string `json:"question"`
+}
+
+// handleQuickAsk sends a popup question to the current agent and streams the answer back as SSE events
+func handleQuickAsk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req QuickAskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Slash commands work here as in the clipboard prompt, e.g. "/agent coder how do I ..."
+	cmds, question := parseSlashCommands(req.Question)
+	if err := runSlashCommands(cmds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	sendEvent := func(event string, payload interface{}) error {
+		data, _ := json.Marshal(payload)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	if strings.TrimSpace(question) == "" {
+		message := "Nothing to ask"
+		if cmds.Any() {
+			message = "Applied " + cmds.Summary()
+		}
+		sendEvent("done", map[string]string{"agent": currentAgentSlug, "message": message})
+		return
+	}
+
+	apiBase := os.Getenv("KHOJ_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://app.khoj.dev"
+	}
+
+	logRequest(r.Context(), "💬 Quick ask: %d characters for agent %s", len(question), currentAgentSlug)
+	progress := startProgress("Quick Ask")
+	prompt := withResearchMode(cmds.Research, withConversationInstructions(conversationID, withVerbosity(cmds.Verbosity, question)))
+	khojResp, err := sendToKhojChat(apiBase, os.Getenv("KHOJ_API_KEY"), conversationID, prompt, r.Context())
+	if err != nil {
+		logRequest(r.Context(), "❌ Quick ask failed: %v", err)
+		progress.Done(err)
+		sendEvent("error", map[string]string{"message": classifyKhojError(err).Hint})
+		return
+	}
+
+	khojResp = limitResponseLength(khojResp, "", verbosityPresets[cmds.Verbosity].MaxChars)
+	answer, _, blocked := postProcessResponse(khojResp, responseTargetAPI, "")
+	if blocked {
+		progress.Done(fmt.Errorf("blocked by the output filter"))
+		sendEvent("error", map[string]string{"message": "Answer blocked by the output filter"})
+		return
+	}
+
+	// Pace the answer out in small deltas like the chat completions stream, cut between characters so each delta
+	// is valid UTF-8 on its own
+	sent := 0
+	for _, chunk := range runeChunks(answer, 50) {
+		if r.Context().Err() != nil {
+			progress.Done(fmt.Errorf("popup closed"))
+			return
+		}
+		if err := sendEvent("delta", map[string]string{"content": chunk}); err != nil {
+			progress.Done(fmt.Errorf("popup closed"))
+			return
+		}
+		sent += len(chunk)
+		progress.Update(answer[:sent])
+		time.Sleep(5 * time.Millisecond)
+	}
+	progress.Done(nil)
+	if origin := quickAskOrigin.Load(); origin != nil {
+		appendScratchpad(*origin, question, answer)
+	} else {
+		appendScratchpad(scratchpadOrigin{Source: scratchpadQuickAsk}, question, answer)
+	}
+	sendEvent("done", map[string]string{"agent": currentAgentSlug})
+}
+
+// openQuickAsk opens the quick-ask popup as a chromeless, always-on-top window
+func openQuickAsk() {
+	origin := windowScratchpadOrigin(scratchpadQuickAsk, win32.ForegroundWindow())
+	quickAskOrigin.Store(&origin)
+
+	url := "http://localhost:" + serverPort() + "/ask"
+	if err := openAppWindow(url, quickAskTitle, 640, 420); err != nil {
+		log.Printf("Failed to open quick ask: %v", err)
+		return
+	}
+	pinWindowOnTop(quickAskTitle)
+}
+
+// openAppWindow opens url in a minimal Edge or Chrome app window on the monitor under the cursor, falling back
+// to the default browser; width and height are in 96-DPI units, and title finds the window to place it
+func openAppWindow(url, title string, width, height int) error {
+	if runtime.GOOS == "windows" {
+		candidates := []string{
+			filepath.Join(os.Getenv("ProgramFiles(x86)"), `Microsoft\Edge\Application\msedge.exe`),
+			filepath.Join(os.Getenv("ProgramFiles"), `Microsoft\Edge\Application\msedge.exe`),
+			filepath.Join(os.Getenv("ProgramFiles"), `Google\Chrome\Application\chrome.exe`),
+			filepath.Join(os.Getenv("LOCALAPPDATA"), `Google\Chrome\Application\chrome.exe`),
+		}
+		for _, browser := range candidates {
+			if _, err := os.Stat(browser); err != nil {
+				continue
+			}
+			args := []string{"--app=" + url, fmt.Sprintf("--window-size=%d,%d", width, height)}
+			mon, placeable := cursorMonitor()
+			if placeable {
+				// The browser reads the position in 96-DPI units; placeAppWindow corrects it once the window exists
+				r := placementRect(mon, windowPlacements.Get(title, mon.Name), width, height)
+				args = append(args, fmt.Sprintf("--window-position=%d,%d", r.X*96/mon.DPI, r.Y*96/mon.DPI))
+			}
+			cmd := exec.Command(browser, args...)
+			if err := cmd.Start(); err == nil {
+				go cmd.Wait()
+				if placeable {
+					go placeAppWindow(title, mon, width, height)
+				}
+				return nil
+			}
+		}
+	}
+	return openBrowser(url)
+}
+
+// pinWindowOnTop waits for a top-level window with the given title and makes it topmost
+func pinWindowOnTop(title string) {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	hwnd := waitForWindow("", title)
+	if hwnd == 0 {
+		log.Printf("⚠️ %s window not found; it will not stay on top", title)
+		return
+	}
+	user32.NewProc("SetWindowPos").Call(hwnd, ^uintptr(0), 0, 0, 0, 0, 0x0001|0x0002|0x0040) // HWND_TOPMOST, SWP_NOMOVE|SWP_NOSIZE|SWP_SHOWWINDOW
+	user32.NewProc("SetForegroundWindow").Call(hwnd)
+}
+
+// windowRect is a window's bounds in physical pixels
+type windowRect struct {
+	X, Y, Width, Height int
+}
+
+// monitorInfo describes one display: its device name, work area and effective DPI
+type monitorInfo struct {
+	Name string // Device name such as \\.\DISPLAY2, stable while the monitor stays connected to the same port
+	Work windowRect
+	DPI  int
+}
+
+// windowPlacement is a popup's remembered bounds on one monitor, in 96-DPI units relative to its work area
+type windowPlacement struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// winRect mirrors the Win32 RECT struct
+type winRect struct {
+	Left, Top, Right, Bottom int32
+}
+
+// monitorInfoEx mirrors the Win32 MONITORINFOEXW struct
+type monitorInfoEx struct {
+	Size    uint32
+	Monitor winRect
+	Work    winRect
+	Flags   uint32
+	Device  [32]uint16
+}
+
+// enableDPIAwareness makes window coordinates physical pixels on every monitor, so popups can be placed and sized exactly
+func enableDPIAwareness() {
+	if runtime.GOOS != "windows" {
+		return
+	}
+
+	// Per-monitor v2 needs Windows 10 1703, per-monitor Windows 8.1; older systems only know system-wide awareness
+	if proc := user32.NewProc("SetProcessDpiAwarenessContext"); proc.Find() == nil {
+		if ok, _, _ := proc.Call(^uintptr(3)); ok != 0 { // DPI_AWARENESS_CONTEXT_PER_MONITOR_AWARE_V2 (-4)
+			return
+		}
+	}
+	if proc := shcore.NewProc("SetProcessDpiAwareness"); proc.Find() == nil {
+		if hr, _, _ := proc.Call(2); hr == 0 { // PROCESS_PER_MONITOR_DPI_AWARE
+			return
+		}
+	}
+	user32.NewProc("SetProcessDPIAware").Call()
+}
+
+// cursorMonitor returns the monitor under the mouse cursor
+func cursorMonitor() (monitorInfo, bool) {
+	if runtime.GOOS != "windows" {
+		return monitorInfo{}, false
+	}
+	var pt struct{ X, Y int32 }
+	if ok, _, _ := user32.NewProc("GetCursorPos").Call(uintptr(unsafe.Pointer(&pt))); ok == 0 {
+		return monitorInfo{}, false
+	}
+	// MonitorFromRect takes a pointer, unlike MonitorFromPoint whose by-value POINT differs between 32 and 64 bit
+	r := winRect{Left: pt.X, Top: pt.Y, Right: pt.X + 1, Bottom: pt.Y + 1}
+	hmon, _, _ := user32.NewProc("MonitorFromRect").Call(uintptr(unsafe.Pointer(&r)), 2) // MONITOR_DEFAULTTONEAREST
+	return monitorFromHandle(hmon)
+}
+
+// windowMonitor returns the monitor holding most of a window
+func windowMonitor(hwnd uintptr) (monitorInfo, bool) {
+	hmon, _, _ := user32.NewProc("MonitorFromWindow").Call(hwnd, 2) // MONITOR_DEFAULTTONEAREST
+	return monitorFromHandle(hmon)
+}
+
+// monitorFromHandle reads the name, work area and DPI of a monitor handle
+func monitorFromHandle(hmon uintptr) (monitorInfo, bool) {
+	if hmon == 0 {
+		return monitorInfo{}, false
+	}
+	info := monitorInfoEx{}
+	info.Size = uint32(unsafe.Sizeof(info))
+	if ok, _, _ := user32.NewProc("GetMonitorInfoW").Call(hmon, uintptr(unsafe.Pointer(&info))); ok == 0 {
+		return monitorInfo{}, false
+	}
+	w := info.Work
+	mon := monitorInfo{
+		Name: utf16ToString(info.Device[:]),
+		Work: windowRect{X: int(w.Left), Y: int(w.Top), Width: int(w.Right - w.Left), Height: int(w.Bottom - w.Top)},
+		DPI:  96,
+	}
+
+	// Without GetDpiForMonitor (Windows 8.1) every monitor uses the same scale
+	if proc := shcore.NewProc("GetDpiForMonitor"); proc.Find() == nil {
+		var dpiX, dpiY uint32
+		if hr, _, _ := proc.Call(hmon, 0, uintptr(unsafe.Pointer(&dpiX)), uintptr(unsafe.Pointer(&dpiY))); hr == 0 && dpiX > 0 { // MDT_EFFECTIVE_DPI
+			mon.DPI = int(dpiX)
+		}
+	}
+	return mon, true
+}
+
+// placementRect returns a popup's physical bounds on mon: its remembered placement, or its default size
+// centered, scaled to the monitor's DPI and kept inside the work area
+func placementRect(mon monitorInfo, saved *windowPlacement, width, height int) windowRect {
+	scale := func(v int) int { return v * mon.DPI / 96 }
+
+	var r windowRect
+	if saved != nil {
+		r = windowRect{X: mon.Work.X + scale(saved.X), Y: mon.Work.Y + scale(saved.Y), Width: scale(saved.Width), Height: scale(saved.Height)}
+	} else {
+		r = windowRect{Width: scale(width), Height: scale(height)}
+		r.X = mon.Work.X + (mon.Work.Width-r.Width)/2
+		r.Y = mon.Work.Y + (mon.Work.Height-r.Height)/2
+	}
+
+	r.Width, r.Height = min(r.Width, mon.Work.Width), min(r.Height, mon.Work.Height)
+	r.X = max(mon.Work.X, min(r.X, mon.Work.X+mon.Work.Width-r.Width))
+	r.Y = max(mon.Work.Y, min(r.Y, mon.Work.Y+mon.Work.Height-r.Height))
+	return r
+}
+
+// placementFromRect converts physical bounds on mon into a placement that survives DPI changes
+func placementFromRect(mon monitorInfo, r windowRect) windowPlacement {
+	unscale := func(v int) int { return v * 96 / mon.DPI }
+	return windowPlacement{X: unscale(r.X - mon.Work.X), Y: unscale(r.Y - mon.Work.Y), Width: unscale(r.Width), Height: unscale(r.Height)}
+}
+
+// windowPlacementStore remembers popup bounds per window title and monitor in windowPlacementsFile
+type windowPlacementStore struct {
+	mu         sync.Mutex
+	loaded     bool
+	placements map[string]map[string]windowPlacement // Window title -> monitor name -> placement
+}
+
+var windowPlacements = &windowPlacementStore{}
+
+// loadLocked reads the placement file once; a missing or unreadable file means nothing is remembered
+func (s *windowPlacementStore) loadLocked() {
+	if s.loaded {
+		return
+	}
+	s.loaded = true
+	s.placements = make(map[string]map[string]windowPlacement)
+	data, err := os.ReadFile(windowPlacementsFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &s.placements); err != nil {
+		log.Printf("⚠️ Ignoring %s: %v", windowPlacementsFile, err)
+		s.placements = make(map[string]map[string]windowPlacement)
+	}
+}
+
+// Get returns the remembered placement of a window on a monitor, or nil
+func (s *windowPlacementStore) Get(title, monitor string) *windowPlacement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadLocked()
+	if p, ok := s.placements[title][monitor]; ok {
+		return &p
+	}
+	return nil
+}
+
+// Set remembers where a window was left on a monitor and saves the file
+func (s *windowPlacementStore) Set(title, monitor string, p windowPlacement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadLocked()
+	if s.placements[title] == nil {
+		s.placements[title] = make(map[string]windowPlacement)
+	}
+	s.placements[title][monitor] = p
+
+	data, err := json.MarshalIndent(s.placements, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal window placements: %w", err)
+	}
+	if err := os.WriteFile(windowPlacementsFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write window placements file: %w", err)
+	}
+	return nil
+}
+
+// Forget drops every remembered placement; the file itself is removed by the caller
+func (s *windowPlacementStore) Forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = true
+	s.placements = make(map[string]map[string]windowPlacement)
+}
+
+// waitForWindow polls for up to five seconds for a top-level window; an empty class matches any
+func waitForWindow(class, title string) uintptr {
+	findWindow := user32.NewProc("FindWindowW")
+	titlePtr, err := safeUTF16PtrFromString(title)
+	if err != nil {
+		return 0
+	}
+	var classPtr uintptr
+	if class != "" {
+		if classPtr, err = safeUTF16PtrFromString(class); err != nil {
+			return 0
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if hwnd, _, _ := findWindow.Call(classPtr, titlePtr); hwnd != 0 {
+			return hwnd
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0
+}
+
+// windowBounds returns a window's current bounds, or false while it is minimized, maximized or gone
+func windowBounds(hwnd uintptr) (windowRect, bool) {
+	if iconic, _, _ := user32.NewProc("IsIconic").Call(hwnd); iconic != 0 {
+		return windowRect{}, false
+	}
+	if zoomed, _, _ := user32.NewProc("IsZoomed").Call(hwnd); zoomed != 0 {
+		return windowRect{}, false
+	}
+	var r winRect
+	if ok, _, _ := user32.NewProc("GetWindowRect").Call(hwnd, uintptr(unsafe.Pointer(&r))); ok == 0 {
+		return windowRect{}, false
+	}
+	return windowRect{X: int(r.Left), Y: int(r.Top), Width: int(r.Right - r.Left), Height: int(r.Bottom - r.Top)}, true
+}
+
+// setWindowBounds moves and resizes a window without activating it or changing its z-order
+func setWindowBounds(hwnd uintptr, r windowRect) {
+	setWindowPos := user32.NewProc("SetWindowPos")
+	const flags = 0x0004 | 0x0010 // SWP_NOZORDER|SWP_NOACTIVATE
+
+	// Move first, then size: arriving on a monitor with another DPI makes the window rescale itself once
+	setWindowPos.Call(hwnd, 0, uintptr(r.X), uintptr(r.Y), 0, 0, flags|0x0001) // SWP_NOSIZE
+	time.Sleep(150 * time.Millisecond)
+	setWindowPos.Call(hwnd, 0, uintptr(r.X), uintptr(r.Y), uintptr(r.Width), uintptr(r.Height), flags)
+}
+
+// placeAppWindow moves a new popup window to its place on mon, then follows it until it closes
+// and remembers where it was left, per monitor
+func placeAppWindow(title string, mon monitorInfo, width, height int) {
+	hwnd := waitForWindow("", title)
+	if hwnd == 0 {
+		return
+	}
+	placed := placementRect(mon, windowPlacements.Get(title, mon.Name), width, height)
+	setWindowBounds(hwnd, placed)
+
+	isWindow := user32.NewProc("IsWindow")
+	last, lastMon := placed, mon
+	for {
+		if alive, _, _ := isWindow.Call(hwnd); alive == 0 {
+			break
+		}
+		if r, ok := windowBounds(hwnd); ok {
+			if m, ok := windowMonitor(hwnd); ok {
+				last, lastMon = r, m
+			}
+		}
+		time.Sleep(time.Second)
+	}
+
+	if last == placed && lastMon.Name == mon.Name {
+		return
+	}
+	if err := windowPlacements.Set(title, lastMon.Name, placementFromRect(lastMon, last)); err != nil {
+		log.Printf("⚠️ Failed to remember the %s window position: %v", title, err)
+	}
+}
+
+// centerOnCursorMonitor moves a dialog to the middle of the monitor under the cursor, keeping its size
+func centerOnCursorMonitor(hwnd uintptr) {
+	mon, ok := cursorMonitor()
+	if !ok {
+		return
+	}
+	r, ok := windowBounds(hwnd)
+	if !ok {
+		return
+	}
+	x := mon.Work.X + max(0, (mon.Work.Width-r.Width)/2)
+	y := mon.Work.Y + max(0, (mon.Work.Height-r.Height)/2)
+	user32.NewProc("SetWindowPos").Call(hwnd, 0, uintptr(x), uintptr(y), 0, 0, 0x0001|0x0004|0x0010) // SWP_NOSIZE|SWP_NOZORDER|SWP_NOACTIVATE
+}
+
+// diffSpan is a run of words the rewrite kept, inserted or deleted
+type diffSpan struct {
+	Op   string `json:"op"` // "equal", "insert" or "delete"
+	Text string `json:"text"`
+}
+
+// diffTokenPattern splits text into words, whitespace runs and single punctuation marks
+var diffTokenPattern = regexp.MustCompile(`(?s)\s+|[\p{L}\p{N}_]+|.`)
+
+// maxDiffCells bounds the LCS table; longer texts are shown as one deletion and one insertion
+const maxDiffCells = 4_000_000
+
+// wordDiff computes a word-level diff turning original into revised
+func wordDiff(original, revised string) []diffSpan {
+	a := diffTokenPattern.FindAllString(original, -1)
+	b := diffTokenPattern.FindAllString(revised, -1)
+
+	var spans []diffSpan
+	add := func(op, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Op == op {
+			spans[n-1].Text += text
+			return
+		}
+		spans = append(spans, diffSpan{Op: op, Text: text})
+	}
+
+	// Common prefix and suffix need no table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	add("equal", strings.Join(a[:prefix], ""))
+	tail := strings.Join(a[len(a)-suffix:], "")
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	n, m := len(a), len(b)
+	if (n+1)*(m+1) > maxDiffCells {
+		add("delete", strings.Join(a, ""))
+		add("insert", strings.Join(b, ""))
+		add("equal", tail)
+		return spans
+	}
+
+	// lcs[i*(m+1)+j] is the LCS length of a[i:] and b[j:]
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			} else if down, right := lcs[(i+1)*(m+1)+j], lcs[i*(m+1)+j+1]; down >= right {
+				lcs[i*(m+1)+j] = down
+			} else {
+				lcs[i*(m+1)+j] = right
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			add("equal", a[i])
+			i++
+			j++
+		case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+			add("delete", a[i])
+			i++
+		default:
+			add("insert", b[j])
+			j++
+		}
+	}
+	add("delete", strings.Join(a[i:], ""))
+	add("insert", strings.Join(b[j:], ""))
+	add("equal", tail)
+	return spans
+}
+
+// diffPreview is a rewrite waiting for the user to accept or decline it in the preview window
+type diffPreview struct {
+	Original string     `json:"original"`
+	Revised  string     `json:"revised"`
+	Spans    []diffSpan `json:"spans"`
+	Language string     `json:"language,omitempty"`
+
+	decision chan bool
+}
+
+var (
+	diffPreviews   = make(map[string]*diffPreview)
+	diffPreviewsMu sync.Mutex
+	diffPreviewSeq atomic.Int64
+)
+
+// reviewRewrite shows the word diff between original and revised and waits for the user's decision
+func reviewRewrite(ctx context.Context, original, revised string, language languageGuess) (bool, error) {
+	id := strconv.FormatInt(diffPreviewSeq.Add(1), 10)
+	preview := &diffPreview{
+		Original: original,
+		Revised:  revised,
+		Spans:    wordDiff(original, revised),
+		Language: language.Name,
+		decision: make(chan bool, 1),
+	}
+
+	diffPreviewsMu.Lock()
+	diffPreviews[id] = preview
+	diffPreviewsMu.Unlock()
+	defer func() {
+		diffPreviewsMu.Lock()
+		delete(diffPreviews, id)
+		diffPreviewsMu.Unlock()
+	}()
+
+	log.Printf("🔍 Showing diff preview %s (%d spans)", id, len(preview.Spans))
+	if err := openAppWindow("http://localhost:"+serverPort()+"/preview?id="+id, diffPreviewTitle, 820, 560); err != nil {
+		return false, fmt.Errorf("failed to open diff preview: %w", err)
+	}
+	pinWindowOnTop(diffPreviewTitle)
+
+	select {
+	case accepted := <-preview.decision:
+		return accepted, nil
+	case <-time.After(diffPreviewTimeout):
+		log.Printf("⏰ Diff preview %s expired without a decision", id)
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// handleDiffPreview returns a pending preview's diff to the preview window
+func handleDiffPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	diffPreviewsMu.Lock()
+	preview := diffPreviews[r.URL.Query().Get("id")]
+	diffPreviewsMu.Unlock()
+	if preview == nil {
+		http.Error(w, "Preview not found or already decided", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+// handleDiffDecision records whether the user accepted the rewrite shown in a preview
+func handleDiffDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID     string `json:"id"`
+		Accept bool   `json:"accept"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	diffPreviewsMu.Lock()
+	preview := diffPreviews[req.ID]
+	delete(diffPreviews, req.ID)
+	diffPreviewsMu.Unlock()
+	if preview == nil {
+		http.Error(w, "Preview not found or already decided", http.StatusNotFound)
+		return
+	}
+	preview.decision <- req.Accept
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// focusWindow returns keyboard focus to hwnd, attaching to the foreground thread to get past focus stealing prevention
+func focusWindow(hwnd uintptr) {
+	if runtime.GOOS != "windows" || hwnd == 0 {
+		return
+	}
+
+	getCurrentThreadId := kernel32.NewProc("GetCurrentThreadId")
+	getWindowThreadProcessId := user32.NewProc("GetWindowThreadProcessId")
+	attachThreadInput := user32.NewProc("AttachThreadInput")
+	setForegroundWindow := user32.NewProc("SetForegroundWindow")
+
+	currentThreadId, _, _ := getCurrentThreadId.Call()
+	if foreground := win32.ForegroundWindow(); foreground != 0 && foreground != hwnd {
+		foregroundThreadId, _, _ := getWindowThreadProcessId.Call(foreground, 0)
+		if foregroundThreadId != currentThreadId {
+			attachThreadInput.Call(currentThreadId, foregroundThreadId, 1)
+			defer attachThreadInput.Call(currentThreadId, foregroundThreadId, 0)
+		}
+	}
+	setForegroundWindow.Call(hwnd)
+
+	// Give the window time to take focus before keystrokes arrive
+	time.Sleep(150 * time.Millisecond)
+}
+
+// loopbackOnly rejects requests from other machines, requests naming another host (a DNS rebinding page reaches
+// the loopback address under its own name), and writes without the X-Khoj-Dashboard header (cross-origin pages
+// cannot send it without a CORS preflight, which these routes never approve)
+func loopbackOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Dashboard is only available from this machine", http.StatusForbidden)
+			return
+		}
+		if !loopbackHost(r.Host) {
+			http.Error(w, "Dashboard is only available at localhost:"+serverPort(), http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Header.Get("X-Khoj-Dashboard") != "1" {
+			http.Error(w, "Missing X-Khoj-Dashboard header", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// loopbackHost reports whether a Host header names this machine's loopback address on the server port
+func loopbackHost(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || port != serverPort() {
+		return false
+	}
+	return strings.EqualFold(host, "localhost") || host == "127.0.0.1" || host == "::1"
+}
+
+// dashboardInstructions is the JSON shape of the dashboard's custom instructions API
+type dashboardInstructions struct {
+	ConversationID string `json:"conversation_id"`
+	AgentSlug      string `json:"agent_slug,omitempty"`
+	Instructions   string `json:"instructions"`
+}
+
+// handleDashboardInstructions reads (GET) or replaces (PUT) a conversation's custom instructions, the active
+// conversation's unless ?conversation_id= or the body names another, and answers with that conversation's
+func handleDashboardInstructions(w http.ResponseWriter, r *http.Request) {
+	convID := r.URL.Query().Get("conversation_id")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body dashboardInstructions
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if body.ConversationID != "" {
+			convID = body.ConversationID
+		}
+		if convID == "" {
+			convID = conversationID
+		}
+		if err := setConversationInstructions(convID, body.Instructions); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if convID == "" {
+		convID = conversationID
+	}
+	result := dashboardInstructions{ConversationID: convID, Instructions: getConversationInstructions(convID)}
+	if convID == conversationID {
+		result.AgentSlug = currentAgentSlug
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+var (
+	errTemplateNotFound = errors.New("template not found")
+	errTemplateExists   = errors.New("a template with that name already exists")
+)
+
+// dashboardHotkeys is the hotkey API's view of the three hotkeys; empty values restore the defaults
+type dashboardHotkeys struct {
+	Hotkey         string `json:"hotkey"`
+	QuickAskHotkey string `json:"quick_ask_hotkey"`
+	FollowUpHotkey string `json:"follow_up_hotkey"`
+}
+
+// handleDashboardTemplates lists, creates, replaces and deletes the templates in config.json.
+// PUT and DELETE address a template with ?name=; every change is validated before it is saved.
+func handleDashboardTemplates(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		var body TemplateConfig
+		if r.Method != http.MethodDelete {
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Method != http.MethodPost && name == "" {
+			http.Error(w, "Missing ?name=", http.StatusBadRequest)
+			return
+		}
+
+		diags, err := updateConfigFile(func(doc *configDocument) error {
+			var templates []TemplateConfig
+			if err := doc.Get("templates", &templates); err != nil {
+				return err
+			}
+			index := func(name string) int {
+				for i, t := range templates {
+					if t.Name == name {
+						return i
+					}
+				}
+				return -1
+			}
+
+			switch r.Method {
+			case http.MethodPost:
+				if index(body.Name) >= 0 {
+					return errTemplateExists
+				}
+				templates = append(templates, body)
+			case http.MethodPut:
+				i := index(name)
+				if i < 0 {
+					return errTemplateNotFound
+				}
+				if j := index(body.Name); j >= 0 && j != i {
+					return errTemplateExists
+				}
+				templates[i] = body
+			case http.MethodDelete:
+				i := index(name)
+				if i < 0 {
+					return errTemplateNotFound
+				}
+				templates = append(templates[:i], templates[i+1:]...)
+			}
+
+			if len(templates) == 0 {
+				doc.Delete("templates")
+				return nil
+			}
+			return doc.Set("templates", templates)
+		})
+		if !writeConfigUpdateError(w, diags, err) {
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Reply with the templates as written, so ${VAR} references survive an edit round trip
+	configFileMu.Lock()
+	doc, err := readConfigDocument()
+	configFileMu.Unlock()
+	templates := []TemplateConfig{}
+	if err == nil {
+		err = doc.Get("templates", &templates)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// templatePacksDir holds installed template packs, one signed pack file each
+const templatePacksDir = "template_packs"
+
+// maxPackBytes bounds a pack file fetched from a URL or read from disk
+const maxPackBytes = 1 << 20
+
+var packNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// TemplatePack is a shareable set of clipboard templates; its templates are offered as name/template
+type TemplatePack struct {
+	Name        string           `json:"name"` // Lowercase letters, digits and dashes
+	Title       string           `json:"title,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Author      string           `json:"author,omitempty"`
+	Version     string           `json:"version,omitempty"`
+	Templates   []TemplateConfig `json:"templates"`
+}
+
+// signedTemplatePack is a pack file: the pack, its publisher's key and an Ed25519 signature over the pack with
+// insignificant whitespace removed
+type signedTemplatePack struct {
+	Pack      json.RawMessage `json:"pack"`
+	PublicKey string          `json:"public_key"` // Base64
+	Signature string          `json:"signature"`  // Base64
+
+	// Recorded on install, outside the signature
+	Source      string     `json:"source,omitempty"`
+	InstalledAt *time.Time `json:"installed_at,omitempty"`
+}
+
+// templatePackInfo is a verified pack as shown in the dashboard gallery
+type templatePackInfo struct {
+	TemplatePack
+	Fingerprint string     `json:"fingerprint"` // Short form of the publisher's key
+	PublicKey   string     `json:"public_key"`
+	Trusted     bool       `json:"trusted"`
+	Source      string     `json:"source,omitempty"`
+	InstalledAt *time.Time `json:"installed_at,omitempty"`
+	Installed   string     `json:"installed_version,omitempty"` // Previews only: the version this one would replace, or "installed" without a version
+}
+
+var (
+	templatePacks   []templatePackInfo
+	templatePacksMu sync.Mutex
+
+	errPackUntrusted = errors.New("the pack's publisher is not trusted")
+)
+
+// installedPacks returns the packs loaded from templatePacksDir, sorted by name
+func installedPacks() []templatePackInfo {
+	templatePacksMu.Lock()
+	defer templatePacksMu.Unlock()
+	return append([]templatePackInfo(nil), templatePacks...)
+}
+
+// loadTemplatePacks reads every installed pack, skipping ones whose signature doesn't verify or whose publisher is
+// no longer trusted
+func loadTemplatePacks() {
+	files, _ := filepath.Glob(filepath.Join(templatePacksDir, "*.json"))
+	var packs []templatePackInfo
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("⚠️ Skipping template pack %s: %v", file, err)
+			continue
+		}
+		info, err := verifyTemplatePack(data)
+		if err != nil {
+			log.Printf("⚠️ Skipping template pack %s: %v", file, err)
+			continue
+		}
+		if !info.Trusted {
+			log.Printf("⚠️ Skipping template pack %s: signed by %s, which is not in template_packs.trusted_keys", info.Name, info.Fingerprint)
+			continue
+		}
+		packs = append(packs, info)
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].Name < packs[j].Name })
+
+	templatePacksMu.Lock()
+	templatePacks = packs
+	templatePacksMu.Unlock()
+	if len(packs) > 0 {
+		log.Printf("📦 Loaded %d template pack(s)", len(packs))
+	}
+}
+
+// verifyTemplatePack checks a pack file's signature and templates. Trust is reported, not required.
+func verifyTemplatePack(data []byte) (templatePackInfo, error) {
+	var file signedTemplatePack
+	if err := json.Unmarshal(data, &file); err != nil {
+		return templatePackInfo{}, fmt.Errorf("failed to parse pack file: %w", err)
+	}
+	if len(file.Pack) == 0 || file.Signature == "" || file.PublicKey == "" {
+		return templatePackInfo{}, fmt.Errorf("not a signed template pack: pack, public_key and signature are required")
+	}
+	key, err := parsePackKey(file.PublicKey)
+	if err != nil {
+		return templatePackInfo{}, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(file.Signature)
+	if err != nil {
+		return templatePackInfo{}, fmt.Errorf("invalid signature: %w", err)
+	}
+	var signed bytes.Buffer
+	if err := json.Compact(&signed, file.Pack); err != nil {
+		return templatePackInfo{}, fmt.Errorf("failed to parse pack: %w", err)
+	}
+	if !ed25519.Verify(key, signed.Bytes(), signature) {
+		return templatePackInfo{}, fmt.Errorf("the signature doesn't match the pack; it was changed after signing or signed with another key")
+	}
+
+	var pack TemplatePack
+	if err := json.Unmarshal(file.Pack, &pack); err != nil {
+		return templatePackInfo{}, fmt.Errorf("failed to parse pack: %w", err)
+	}
+	if err := validateTemplatePack(pack); err != nil {
+		return templatePackInfo{}, err
+	}
+
+	info := templatePackInfo{
+		TemplatePack: pack,
+		Fingerprint:  packKeyFingerprint(key),
+		PublicKey:    file.PublicKey,
+		Source:       file.Source,
+		InstalledAt:  file.InstalledAt,
+	}
+	for _, trusted := range appConfig().TemplatePacks.TrustedKeys {
+		if k, err := parsePackKey(trusted); err == nil && k.Equal(key) {
+			info.Trusted = true
+		}
+	}
+	return info, nil
+}
+
+// validateTemplatePack checks a pack's name and templates
+func validateTemplatePack(pack TemplatePack) error {
+	if !packNamePattern.MatchString(pack.Name) {
+		return fmt.Errorf("invalid pack name %q (use up to 40 lowercase letters, digits and dashes)", pack.Name)
+	}
+	if len(pack.Templates) == 0 {
+		return fmt.Errorf("pack %s has no templates", pack.Name)
+	}
+	return validateSharedTemplates("templates", pack.Templates)
+}
+
+// validateSharedTemplates runs templates from a pack or the team overlay through the config rules. They can't set
+// post_process, since that would run a command from someone else's file.
+func validateSharedTemplates(field string, templates []TemplateConfig) error {
+	seen := map[string]bool{}
+	for i, t := range templates {
+		switch {
+		case t.PostProcess != nil:
+			return fmt.Errorf("%s[%d].post_process: not allowed in shared templates", field, i)
+		case strings.Contains(t.Name, "/"):
+			return fmt.Errorf("%s[%d].name: must not contain /", field, i)
+		case seen[t.Name]:
+			return fmt.Errorf("%s[%d].name: %q is used twice", field, i, t.Name)
+		}
+		seen[t.Name] = true
+	}
+	if problems := (&AppConfig{Templates: templates}).validate(); len(problems) > 0 {
+		return fmt.Errorf("%s: %s", problems[0][0], problems[0][1])
+	}
+	return nil
+}
+
+// parsePackKey decodes a base64 Ed25519 public key
+func parsePackKey(key string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q (expected a base64 Ed25519 key)", truncateText(key, 60))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// packKeyFingerprint shortens a publisher key for display
+func packKeyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "ed25519:" + hex.EncodeToString(sum[:8])
+}
+
+// readPackSource reads a pack file from an http(s) URL or a local path
+func readPackSource(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pack: %w", err)
+		}
+		defer f.Close()
+		return readLimited(f, source)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download pack: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download pack: %s answered %d", source, resp.StatusCode)
+	}
+	return readLimited(resp.Body, source)
+}
+
+// readLimited reads at most maxPackBytes, failing instead of truncating
+func readLimited(r io.Reader, source string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxPackBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack: %w", err)
+	}
+	if len(data) > maxPackBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", source, maxPackBytes)
+	}
+	return data, nil
+}
+
+// installTemplatePack verifies a pack and saves it to templatePacksDir, replacing an installed pack of the same
+// name. With trust, an untrusted publisher's key is added to template_packs.trusted_keys first.
+func installTemplatePack(data []byte, source string, trust bool) (templatePackInfo, error) {
+	info, err := verifyTemplatePack(data)
+	if err != nil {
+		return info, err
+	}
+	if !info.Trusted {
+		if !trust {
+			return info, fmt.Errorf("%w: %s signed %s", errPackUntrusted, info.Fingerprint, info.Name)
+		}
+		diags, err := updateConfigFile(func(doc *configDocument) error {
+			var packs TemplatePacksConfig
+			if err := doc.Get("template_packs", &packs); err != nil {
+				return err
+			}
+			packs.TrustedKeys = append(packs.TrustedKeys, info.PublicKey)
+			return doc.Set("template_packs", packs)
+		})
+		if err != nil {
+			return info, err
+		}
+		if len(diags) > 0 {
+			return info, fmt.Errorf("failed to trust %s: %s", info.Fingerprint, diags[0])
+		}
+		log.Printf("🔑 Trusting template packs signed by %s", info.Fingerprint)
+		info.Trusted = true
+	}
+
+	var file signedTemplatePack
+	json.Unmarshal(data, &file)
+	now := time.Now()
+	file.Source, file.InstalledAt = source, &now
+
+	// The encoder must not escape <, > and &: the signature covers the pack's bytes
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(file); err != nil {
+		return info, fmt.Errorf("failed to marshal pack: %w", err)
+	}
+	if err := os.MkdirAll(templatePacksDir, 0755); err != nil {
+		return info, fmt.Errorf("failed to create %s: %w", templatePacksDir, err)
+	}
+	path := filepath.Join(templatePacksDir, info.Name+".json")
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		return info, fmt.Errorf("failed to write pack: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return info, fmt.Errorf("failed to replace pack: %w", err)
+	}
+
+	log.Printf("📦 Installed template pack %s %s with %d template(s) from %s", info.Name, info.Version, len(info.Templates), source)
+	loadTemplatePacks()
+	info.Source, info.InstalledAt = source, &now
+	return info, nil
+}
+
+// dashboardPackRequest installs or previews the pack at source
+type dashboardPackRequest struct {
+	Source string `json:"source"`
+	Trust  bool   `json:"trust,omitempty"` // Trust the publisher's key if it isn't yet
+}
+
+// handleDashboardPacks lists installed template packs (GET), previews (POST ?preview=1) or installs (POST) a pack
+// from a URL or local file, and removes one (DELETE ?name=)
+func handleDashboardPacks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body dashboardPackRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		body.Source = strings.TrimSpace(body.Source)
+		if body.Source == "" {
+			http.Error(w, "source is required", http.StatusBadRequest)
+			return
+		}
+		data, err := readPackSource(r.Context(), body.Source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		if r.URL.Query().Get("preview") != "" {
+			info, err := verifyTemplatePack(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			info.Source = body.Source
+			for _, installed := range installedPacks() {
+				if installed.Name == info.Name {
+					info.Installed = installed.Version
+					if info.Installed == "" {
+						info.Installed = "installed"
+					}
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(info)
+			return
+		}
+
+		if _, err := installTemplatePack(data, body.Source, body.Trust); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errPackUntrusted) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !packNamePattern.MatchString(name) {
+			http.Error(w, "Missing or invalid ?name=", http.StatusBadRequest)
+			return
+		}
+		if err := os.Remove(filepath.Join(templatePacksDir, name+".json")); err != nil {
+			status := http.StatusInternalServerError
+			if os.IsNotExist(err) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, fmt.Sprintf("failed to remove pack %s: %v", name, err), status)
+			return
+		}
+		log.Printf("📦 Removed template pack %s", name)
+		loadTemplatePacks()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	packs := installedPacks()
+	if packs == nil {
+		packs = []templatePackInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(packs)
+}
+
+// runPackCommand implements `khoj-wrapper pack keygen <key-file>` and `khoj-wrapper pack sign -key <key-file>
+// <pack.json>`, which writes the signed pack file to stdout
+func runPackCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: khoj-wrapper pack keygen <key-file>\n       khoj-wrapper pack sign -key <key-file> <pack.json> > signed.json")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			return usage()
+		}
+		if _, err := os.Stat(args[1]); err == nil {
+			fmt.Fprintf(os.Stderr, "❌ %s already exists\n", args[1])
+			return 1
+		}
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to generate key: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(args[1], []byte(base64.StdEncoding.EncodeToString(private)+"\n"), 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to write key: %v\n", err)
+			return 1
+		}
+		fmt.Printf("✅ Private key written to %s; keep it secret\n", args[1])
+		fmt.Printf("  public key: %s\n", base64.StdEncoding.EncodeToString(public))
+		fmt.Printf("  fingerprint: %s\n", packKeyFingerprint(public))
+		return 0
+
+	case "sign":
+		fs := flag.NewFlagSet("pack sign", flag.ContinueOnError)
+		keyFile := fs.String("key", "", "Private key file from `khoj-wrapper pack keygen`")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *keyFile == "" || fs.NArg() != 1 {
+			return usage()
+		}
+
+		private, err := readSigningKey(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+
+		data, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to read pack: %v\n", err)
+			return 1
+		}
+		var pack TemplatePack
+		if err := json.Unmarshal(data, &pack); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to parse %s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+		if err := validateTemplatePack(pack); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+
+		var compact bytes.Buffer
+		json.Compact(&compact, data)
+		file := signedTemplatePack{
+			Pack:      compact.Bytes(),
+			PublicKey: base64.StdEncoding.EncodeToString(private.Public().(ed25519.PublicKey)),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(private, compact.Bytes())),
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to write signed pack: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "✅ Signed %s with %d template(s) as %s\n", pack.Name, len(pack.Templates), packKeyFingerprint(private.Public().(ed25519.PublicKey)))
+		return 0
+	}
+	return usage()
+}
+
+// readSigningKey reads a private key written by `khoj-wrapper pack keygen`
+func readSigningKey(file string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not a key from `khoj-wrapper pack keygen`", file)
+	}
+	return ed25519.PrivateKey(raw), nil
+}
+
+// teamOverlayFile caches the last verified team overlay, so it applies while team.url can't be reached
+const teamOverlayFile = "team_overlay.json"
+
+// TeamOverlay is what a team admin publishes at team.url. It applies on top of config.json and can't be edited locally.
+type TeamOverlay struct {
+	Name      string            `json:"name,omitempty"` // Shown in the log and /status
+	Version   string            `json:"version,omitempty"`
+	Templates []TemplateConfig  `json:"templates,omitempty"` // Offered as team/<name>
+	Agents    map[string]string `json:"agents,omitempty"`    // Alias -> agent slug, for /agent and the agent form
+	Deny      []TeamDenyRule    `json:"deny,omitempty"`
+	Expires   *time.Time        `json:"expires,omitempty"` // Signed with the rest, so an old overlay can't be replayed forever
+}
+
+// TeamDenyRule blocks prompts matching a regular expression before they reach Khoj
+type TeamDenyRule struct {
+	Pattern string `json:"pattern"`
+	Message string `json:"message,omitempty"` // Shown instead of an answer; defaults to naming the pattern
+}
+
+// signedTeamOverlay is the file at team.url: the overlay, its signer's key and an Ed25519 signature over the overlay
+// with insignificant whitespace removed, as for template packs
+type signedTeamOverlay struct {
+	Overlay   json.RawMessage `json:"overlay"`
+	PublicKey string          `json:"public_key,omitempty"` // Base64; only used to name the signer when the signature fails
+	Signature string          `json:"signature"`            // Base64
+}
+
+// teamPolicy is a verified team overlay with its deny rules compiled
+type teamPolicy struct {
+	TeamOverlay
+	FetchedAt time.Time
+	deny      []*regexp.Regexp // Parallel to Deny
+}
+
+var (
+	activeTeam   *teamPolicy
+	activeTeamMu sync.RWMutex
+)
+
+// currentTeam returns the team overlay in effect, or nil without one
+func currentTeam() *teamPolicy {
+	activeTeamMu.RLock()
+	defer activeTeamMu.RUnlock()
+	return activeTeam
+}
+
+// teamDeniedError is returned for a prompt one of the team's deny rules blocks
+type teamDeniedError struct {
+	Message string
+}
+
+func (e *teamDeniedError) Error() string {
+	return "blocked by team policy: " + e.Message
+}
+
+// checkTeamDenyRequest checks a request's prompt and the content of each attached file against the team's deny rules
+func checkTeamDenyRequest(ctx context.Context, req *KhojRequest) error {
+	if err := checkTeamDeny(ctx, req.Q); err != nil {
+		return err
+	}
+	for _, file := range req.Files {
+		if err := checkTeamDeny(ctx, file.Content); err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkTeamDeny returns a *teamDeniedError when prompt matches one of the team's deny rules
+func checkTeamDeny(ctx context.Context, prompt string) error {
+	team := currentTeam()
+	if team == nil {
+		return nil
+	}
+	for i, re := range team.deny {
+		if !re.MatchString(prompt) {
+			continue
+		}
+		message := team.Deny[i].Message
+		if message == "" {
+			message = fmt.Sprintf("the prompt matches %q", team.Deny[i].Pattern)
+		}
+		logRequest(ctx, "⛔ Prompt blocked by team deny rule %d (%s)", i, team.Deny[i].Pattern)
+		return &teamDeniedError{Message: message}
+	}
+	return nil
+}
+
+// teamAgent resolves a team agent alias to its slug, returning other slugs unchanged
+func teamAgent(slug string) string {
+	team := currentTeam()
+	if team == nil {
+		return slug
+	}
+	if mapped, ok := team.Agents[slug]; ok {
+		log.Printf("👥 Team agent %s is %s", slug, mapped)
+		return mapped
+	}
+	return slug
+}
+
+// verifyTeamOverlay checks an overlay file's signature against key and its expiry, then validates the overlay
+func verifyTeamOverlay(data []byte, key ed25519.PublicKey) (*teamPolicy, error) {
+	var file signedTeamOverlay
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse team overlay: %w", err)
+	}
+	if len(file.Overlay) == 0 || file.Signature == "" {
+		return nil, fmt.Errorf("not a signed team overlay: overlay and signature are required")
+	}
+	signature, err := base64.StdEncoding.DecodeString(file.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	var signed bytes.Buffer
+	if err := json.Compact(&signed, file.Overlay); err != nil {
+		return nil, fmt.Errorf("failed to parse overlay: %w", err)
+	}
+	if !ed25519.Verify(key, signed.Bytes(), signature) {
+		if signer, err := parsePackKey(file.PublicKey); err == nil && !signer.Equal(key) {
+			return nil, fmt.Errorf("signed by %s, but team.public_key is %s", packKeyFingerprint(signer), packKeyFingerprint(key))
+		}
+		return nil, fmt.Errorf("the signature doesn't match the overlay; it was changed after signing or signed with another key")
+	}
+
+	var overlay TeamOverlay
+	if err := json.Unmarshal(file.Overlay, &overlay); err != nil {
+		return nil, fmt.Errorf("failed to parse overlay: %w", err)
+	}
+	if overlay.Expires == nil {
+		return nil, fmt.Errorf("the overlay has no expires; sign it again with `khoj-wrapper team sign`")
+	}
+	if time.Now().After(*overlay.Expires) {
+		return nil, fmt.Errorf("the overlay expired at %s", overlay.Expires.Format(time.RFC3339))
+	}
+	return compileTeamOverlay(overlay)
+}
+
+// compileTeamOverlay validates an overlay's templates and agent aliases and compiles its deny rules
+func compileTeamOverlay(overlay TeamOverlay) (*teamPolicy, error) {
+	if err := validateSharedTemplates("templates", overlay.Templates); err != nil {
+		return nil, err
+	}
+	for alias, slug := range overlay.Agents {
+		if len(strings.Fields(alias)) != 1 || len(strings.Fields(slug)) != 1 {
+			return nil, fmt.Errorf("agents.%s: aliases and slugs must be single words, got %q", alias, slug)
+		}
+	}
+	policy := &teamPolicy{TeamOverlay: overlay}
+	for i, rule := range overlay.Deny {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil || rule.Pattern == "" {
+			return nil, fmt.Errorf("deny[%d].pattern: invalid regular expression %q", i, rule.Pattern)
+		}
+		policy.deny = append(policy.deny, re)
+	}
+	return policy, nil
+}
+
+// teamSync keeps the team overlay current with team.url
+type teamSync struct {
+	url      string
+	key      ed25519.PublicKey
+	interval time.Duration
+	client   *http.Client
+	etag     string
+	last     []byte // The file in effect, to log only changes
+	lastErr  string
+}
+
+// startTeamOverlay applies the cached team overlay, then fetches team.url now and every team.refresh
+func startTeamOverlay(cfg *TeamConfig) {
+	if cfg == nil {
+		return
+	}
+	key, err := parsePackKey(cfg.PublicKey)
+	if err != nil {
+		log.Printf("⚠️ Team config disabled: %v", err)
+		return
+	}
+	s := &teamSync{url: cfg.URL, key: key, interval: durationOrDefault(cfg.Refresh, defaultTeamRefresh), client: &http.Client{Timeout: 30 * time.Second}}
+
+	// A cached overlay only counts if it still verifies against the configured key
+	if data, err := os.ReadFile(teamOverlayFile); err == nil {
+		policy, err := verifyTeamOverlay(data, key)
+		if err != nil {
+			log.Printf("⚠️ Ignoring cached team overlay: %v", err)
+		} else {
+			if info, err := os.Stat(teamOverlayFile); err == nil {
+				policy.FetchedAt = info.ModTime()
+			}
+			s.apply(policy, data, "cache")
+		}
+	}
+	workers.Go("team-config", s.run)
+}
+
+// run fetches the overlay at startup and every interval after
+func (s *teamSync) run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		err := s.refresh(ctx)
+		s.dropExpired()
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return nil
+		case err != nil && err.Error() != s.lastErr:
+			kept := "no team overlay"
+			if currentTeam() != nil {
+				kept = "the last team overlay"
+			}
+			log.Printf("⚠️ Team config from %s failed, keeping %s and retrying every %v: %v", s.url, kept, s.interval, err)
+		case err == nil && s.lastErr != "":
+			log.Printf("👥 Team config from %s restored", s.url)
+		}
+		s.lastErr = ""
+		if err != nil {
+			s.lastErr = err.Error()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh fetches team.url once, applying and caching the overlay when it verifies
+func (s *teamSync) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download team overlay: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download team overlay: %s answered %d", s.url, resp.StatusCode)
+	}
+	data, err := readLimited(resp.Body, s.url)
 	if err != nil {
-		log.Printf("⚠️ PowerShell toast notification failed: %v", err)
-		return false
+		return err
 	}
+	policy, err := verifyTeamOverlay(data, s.key)
+	if err != nil {
+		return fmt.Errorf("rejected team overlay: %w", err)
+	}
+	s.etag = resp.Header.Get("ETag")
+	policy.FetchedAt = time.Now()
 
-	return true
+	if err := os.WriteFile(teamOverlayFile+".tmp", data, 0644); err == nil {
+		if err := os.Rename(teamOverlayFile+".tmp", teamOverlayFile); err != nil {
+			os.Remove(teamOverlayFile + ".tmp")
+		}
+	}
+	s.apply(policy, data, s.url)
+	return nil
 }
 
-// showPowerShellNotification shows notification using PowerShell (works in windowsgui mode)
-func showPowerShellNotification(title, message string) {
-	if runtime.GOOS != "windows" {
+// dropExpired stops applying the overlay in effect once it expires, when no newer one could be fetched
+func (s *teamSync) dropExpired() {
+	activeTeamMu.Lock()
+	defer activeTeamMu.Unlock()
+	if activeTeam == nil || activeTeam.Expires == nil || time.Now().Before(*activeTeam.Expires) {
 		return
 	}
+	log.Printf("⚠️ Team overlay %s expired at %s and no longer applies", activeTeam.Version, activeTeam.Expires.Format(time.RFC3339))
+	activeTeam = nil
+	s.last = nil
+}
 
-	// Use PowerShell with Windows.UI.Notifications for proper toast in windowsgui mode
-	script := fmt.Sprintf(`
-		[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
-		[Windows.UI.Notifications.ToastNotification, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
-		[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+// apply puts policy in effect, logging what it brings when the overlay changed
+func (s *teamSync) apply(policy *teamPolicy, data []byte, source string) {
+	activeTeamMu.Lock()
+	activeTeam = policy
+	activeTeamMu.Unlock()
+	if bytes.Equal(data, s.last) {
+		return
+	}
+	s.last = data
+	name := policy.Name
+	if name == "" {
+		name = "team overlay"
+	}
+	log.Printf("👥 Applied %s %s from %s: %d template(s), %d agent alias(es), %d deny rule(s)", name, policy.Version, source, len(policy.Templates), len(policy.Agents), len(policy.Deny))
+}
 
-		$APP_ID = 'Microsoft.Windows.Computer'
-		$template = @"
-<toast>
-    <visual>
-        <binding template="ToastGeneric">
-            <text>%s</text>
-            <text>%s</text>
-        </binding>
-    </visual>
-    <audio src="ms-winsoundevent:Notification.Default" />
-</toast>
-"@
+// runTeamCommand implements `khoj-wrapper team sign -key <key-file> <overlay.json>`, which writes the signed
+// overlay to stdout for publishing at team.url
+func runTeamCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: khoj-wrapper team sign -key <key-file> [-valid 720h] <overlay.json> > team.json")
+		return 2
+	}
+	if len(args) == 0 || args[0] != "sign" {
+		return usage()
+	}
+	fs := flag.NewFlagSet("team sign", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "Private key file from `khoj-wrapper pack keygen`")
+	valid := fs.Duration("valid", defaultTeamValidity, "How long the signed overlay applies, unless it sets expires")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *keyFile == "" || fs.NArg() != 1 {
+		return usage()
+	}
 
-		$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
-		$xml.LoadXml($template)
-		$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
-		[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($APP_ID).Show($toast)
-	`, title, message)
+	private, err := readSigningKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to read overlay: %v\n", err)
+		return 1
+	}
+	var overlay TeamOverlay
+	if err := json.Unmarshal(data, &overlay); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to parse %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	if _, err := compileTeamOverlay(overlay); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	if overlay.Expires == nil {
+		expires := time.Now().Add(*valid).UTC().Truncate(time.Second)
+		overlay.Expires = &expires
+	}
+	data, err = json.Marshal(overlay)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to write signed overlay: %v\n", err)
+		return 1
+	}
 
-	// Execute PowerShell script
-	go func() {
-		cmd := exec.Command("powershell", "-WindowStyle", "Hidden", "-ExecutionPolicy", "Bypass", "-Command", script)
-		err := cmd.Run()
-		if err != nil {
-			log.Printf("⚠️ PowerShell notification failed: %v", err)
-			// Final fallback to simple message box
-			showFallbackNotification(title, message)
-		} else {
-			log.Printf("✅ PowerShell notification sent successfully")
-		}
-	}()
+	var compact bytes.Buffer
+	json.Compact(&compact, data)
+	public := private.Public().(ed25519.PublicKey)
+	file := signedTeamOverlay{
+		Overlay:   compact.Bytes(),
+		PublicKey: base64.StdEncoding.EncodeToString(public),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(private, compact.Bytes())),
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(file); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to write signed overlay: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "✅ Signed %d template(s), %d agent alias(es) and %d deny rule(s) as %s, valid until %s\n", len(overlay.Templates), len(overlay.Agents), len(overlay.Deny), packKeyFingerprint(public), overlay.Expires.Format(time.RFC3339))
+	return 0
 }
 
-// showFallbackNotification shows a simple fallback notification
-func showFallbackNotification(title, message string) {
-	if runtime.GOOS != "windows" {
+// handleDashboardHotkeys reads and replaces the clipboard AI, quick ask and follow-up hotkeys; changes apply without a restart
+func handleDashboardHotkeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body dashboardHotkeys
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		diags, err := updateConfigFile(func(doc *configDocument) error {
+			for key, value := range map[string]string{"hotkey": body.Hotkey, "quick_ask_hotkey": body.QuickAskHotkey, "follow_up_hotkey": body.FollowUpHotkey} {
+				if value = strings.TrimSpace(value); value == "" {
+					doc.Delete(key)
+				} else if err := doc.Set(key, value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !writeConfigUpdateError(w, diags, err) {
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Simple MessageBox as absolute fallback
-	go func() {
-		titlePtr, _ := safeUTF16PtrFromString(title)
-		messagePtr, _ := safeUTF16PtrFromString(message)
+	clipboardKey, quickAskKey, followUpKey := currentHotkeys()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboardHotkeys{
+		Hotkey:         clipboardKey.Name,
+		QuickAskHotkey: quickAskKey.Name,
+		FollowUpHotkey: followUpKey.Name,
+	})
+}
 
-		// MB_OK = 0, MB_ICONINFORMATION = 64, MB_TOPMOST = 0x40000
-		procMessageBox.Call(0, messagePtr, titlePtr, 0|64|0x40000)
-	}()
+// dashboardTheme is the theme API's view of the theme in effect, with defaults filled in
+type dashboardTheme struct {
+	Mode   string `json:"mode"`
+	Accent string `json:"accent"`
 }
 
-// checkNotificationSettings checks Windows notification settings
-func checkNotificationSettings() {
-	if runtime.GOOS != "windows" {
+// handleDashboardTheme reads and sets the theme in config.json; a change applies the next time a page loads
+func handleDashboardTheme(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body dashboardTheme
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		// Defaults are left out so config.json only holds what differs
+		theme := ThemeConfig{Mode: strings.TrimSpace(body.Mode), Accent: strings.ToLower(strings.TrimSpace(body.Accent))}
+		if theme.Mode == defaultThemeMode {
+			theme.Mode = ""
+		}
+		if theme.Accent == defaultAccent {
+			theme.Accent = ""
+		}
+		diags, err := updateConfigFile(func(doc *configDocument) error {
+			if theme == (ThemeConfig{}) {
+				doc.Delete("theme")
+				return nil
+			}
+			return doc.Set("theme", theme)
+		})
+		if !writeConfigUpdateError(w, diags, err) {
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	log.Printf("🔍 Checking Windows notification settings...")
+	theme := appConfig().Theme
+	body := dashboardTheme{Mode: theme.Mode, Accent: expandHexColor(theme.Accent)}
+	if body.Mode == "" {
+		body.Mode = defaultThemeMode
+	}
+	if body.Accent == "" {
+		body.Accent = defaultAccent
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
 
-	// Check if notifications are enabled globally
-	// This is a simplified check - in reality, there are many registry keys to check
-	log.Printf("ℹ️ Common reasons toast notifications might not appear:")
-	log.Printf("   1. Focus Assist is enabled (Priority only or Alarms only)")
-	log.Printf("   2. Notifications are disabled in Windows Settings")
-	log.Printf("   3. App notifications are disabled for this application")
-	log.Printf("   4. Do Not Disturb mode is enabled")
-	log.Printf("   5. Presentation mode is active")
-	log.Printf("   6. Windows notification service is not running")
+// accentPattern matches the #rgb and #rrggbb colors theme.accent accepts
+var accentPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
 
-	log.Printf("💡 To check: Windows Settings > System > Notifications & actions")
-	log.Printf("💡 To check Focus Assist: Windows key + U, then F")
-}
+// Theme colors as CSS custom properties; every page styles itself with these
+const (
+	lightThemeVars = `color-scheme: light; --bg: #fafafa; --surface: #fff; --text: #222; --muted: #666; --border: #ddd; --subtle: #f4f4f4; --error: #c0392b; --ok: #27ae60; --ins-bg: #d4f7dc; --ins-text: #135e26; --del-bg: #fbdada; --del-text: #8a1c1c;`
+	darkThemeVars  = `color-scheme: dark; --bg: #1b1c1f; --surface: #25272b; --text: #e4e4e4; --muted: #9a9ea6; --border: #3d4046; --subtle: #2e3035; --error: #ff7b6e; --ok: #5fd08a; --ins-bg: #1e4a2b; --ins-text: #b5efc5; --del-bg: #562326; --del-text: #ffc7c7;`
+	themeBaseCSS   = `body { accent-color: var(--accent); }
+a { color: var(--accent); }
+:focus-visible { outline: 2px solid var(--accent); outline-offset: 1px; }
+button.primary { background: var(--accent); color: var(--accent-text); border: 1px solid var(--accent); border-radius: 4px; }
+button.primary:hover:not(:disabled) { filter: brightness(1.1); }
+button.primary:disabled { opacity: 0.5; }
+`
+)
 
-// processClipboardWithAI processes clipboard content with AI and inserts response at cursor
-func processClipboardWithAI() {
-	if runtime.GOOS != "windows" {
-		log.Printf("Clipboard AI feature only available on Windows")
-		return
+// themeCSS renders /theme.css; the system mode switches palettes with the OS dark-mode setting through prefers-color-scheme
+func themeCSS(theme ThemeConfig) string {
+	accent := expandHexColor(theme.Accent)
+	if accent == "" {
+		accent = defaultAccent
 	}
-
-	if clipboardActive {
-		log.Printf("Clipboard AI already processing, ignoring request")
-		showNotification("Khoj AI", "Already processing a request...")
-		return
+	vars := lightThemeVars
+	if theme.Mode == "dark" {
+		vars = darkThemeVars
 	}
 
-	clipboardActive = true
-	defer func() {
-		clipboardActive = false
-		log.Printf("🔄 Clipboard AI processing completed")
-	}()
+	var css strings.Builder
+	fmt.Fprintf(&css, ":root { %s --accent: %s; --accent-text: %s; --accent-soft: color-mix(in srgb, var(--accent) 14%%, transparent); }\n", vars, accent, accentTextColor(accent))
+	if theme.Mode == "" || theme.Mode == "system" {
+		fmt.Fprintf(&css, "@media (prefers-color-scheme: dark) { :root { %s } }\n", darkThemeVars)
+	}
+	css.WriteString(themeBaseCSS)
+	return css.String()
+}
 
-	log.Printf("🚀 Starting clipboard AI processing...")
+// expandHexColor turns #rgb into #rrggbb, the only form color inputs accept; other values are returned lowercased
+func expandHexColor(color string) string {
+	color = strings.ToLower(color)
+	if len(color) == 4 && accentPattern.MatchString(color) {
+		return string([]byte{'#', color[1], color[1], color[2], color[2], color[3], color[3]})
+	}
+	return color
+}
 
-	// Get clipboard content
-	clipboardText, err := getClipboardText()
-	if err != nil {
-		log.Printf("❌ Failed to get clipboard text: %v", err)
-		showNotification("Khoj AI Error", fmt.Sprintf("Failed to read clipboard: %v", err))
-		return
+// accentTextColor picks black or white text, whichever reads better on an #rrggbb background
+func accentTextColor(accent string) string {
+	var r, g, b int
+	if _, err := fmt.Sscanf(accent, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return "#fff"
 	}
+	if r*299+g*587+b*114 > 160*1000 {
+		return "#111"
+	}
+	return "#fff"
+}
 
-	if strings.TrimSpace(clipboardText) == "" {
-		log.Printf("⚠️ Clipboard is empty")
-		showNotification("Khoj AI", "Clipboard is empty - copy some text first")
-		return
+// writeConfigUpdateError reports a failed config update and returns false, or returns true when it succeeded
+func writeConfigUpdateError(w http.ResponseWriter, diags []configDiagnostic, err error) bool {
+	switch {
+	case errors.Is(err, errTemplateNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errTemplateExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case len(diags) > 0:
+		lines := make([]string, len(diags))
+		for i, d := range diags {
+			d.Line, d.Column = 0, 0 // Positions would point into the rejected edit, not the file on disk
+			lines[i] = d.String()
+		}
+		http.Error(w, strings.Join(lines, "\n"), http.StatusBadRequest)
+	default:
+		return true
 	}
+	return false
+}
 
-	log.Printf("📋 Clipboard content: %d characters", len(clipboardText))
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj Wrapper Dashboard</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  body { font-family: system-ui, sans-serif; max-width: 760px; margin: 2rem auto; padding: 0 1rem; background: var(--surface); color: var(--text); }
+  h1 { font-size: 1.4rem; }
+  section { border: 1px solid var(--border); border-radius: 8px; padding: 1rem; margin-bottom: 1rem; }
+  h2 { font-size: 1.1rem; margin-top: 0; }
+  textarea { width: 100%; min-height: 10rem; font: inherit; box-sizing: border-box; }
+  .meta { color: var(--muted); font-size: 0.9rem; }
+  .status { margin-left: 0.5rem; color: var(--muted); }
+  table { width: 100%; border-collapse: collapse; font-size: 0.9rem; }
+  td, th { text-align: left; padding: 0.3rem; border-bottom: 1px solid var(--border); word-break: break-all; }
+  .revoked { color: var(--muted); text-decoration: line-through; }
+  #digest-body { line-height: 1.5; }
+  #digest-body pre { background: var(--subtle); padding: 0.6rem; overflow-x: auto; }
+  #transcript-rows pre { background: var(--subtle); padding: 0.6rem; white-space: pre-wrap; word-break: break-word; max-height: 16rem; overflow-y: auto; }
+  #transcript-rows ins { background: var(--ins-bg); color: var(--ins-text); text-decoration: none; }
+  #transcript-rows del { background: var(--del-bg); color: var(--del-text); }
+  .gallery { display: grid; grid-template-columns: repeat(auto-fill, minmax(220px, 1fr)); gap: 0.6rem; margin-top: 0.6rem; }
+  .card { border: 1px solid var(--border); border-radius: 6px; padding: 0.6rem; }
+  .card h3 { font-size: 1rem; margin: 0 0 0.3rem; }
+  .card ul { margin: 0.3rem 0; padding-left: 1.2rem; font-size: 0.9rem; }
+</style>
+</head>
+<body>
+<h1>Khoj Wrapper</h1>
+
+<section id="instructions">
+  <h2>Custom Instructions</h2>
+  <p class="meta">Prepended to every request in conversation <code id="conv">…</code> (agent <code id="agent">…</code>).</p>
+  <textarea id="text" placeholder="e.g. Answer in British English. Prefer short bullet lists."></textarea>
+  <p><button class="primary" id="save">Save</button><span class="status" id="status"></span></p>
+</section>
+
+<section id="shares">
+  <h2>Share Links</h2>
+  <p class="meta">Anyone with a share link can read a snapshot of the conversation. Revoking deletes the snapshot on Khoj.</p>
+  <p><button id="share">Share current conversation</button><span class="status" id="share-status"></span></p>
+  <table><thead><tr><th>Link</th><th>Conversation</th><th>Created</th><th></th></tr></thead><tbody id="links"></tbody></table>
+</section>
+
+<section id="digest">
+  <h2>Daily Digest</h2>
+  <p class="meta" id="digest-meta">Loading…</p>
+  <div id="digest-body"></div>
+  <p><button id="digest-run">Generate now</button><span class="status" id="digest-status"></span></p>
+</section>
+
+<section id="clients">
+  <h2>Client Conversations</h2>
+  <p class="meta" id="clients-meta">Clients identified by <code>X-Khoj-Client</code> or the <code>user</code> field get their own conversation.</p>
+  <p><button id="gc">Clean up now</button><span class="status" id="clients-status"></span></p>
+  <table><thead><tr><th>Client</th><th>Conversation</th><th>Last used</th><th></th></tr></thead><tbody id="client-rows"></tbody></table>
+</section>
+
+<section id="templates">
+  <h2>Clipboard Templates</h2>
+  <p class="meta">Saved to config.json and offered in the Clipboard AI dialog right away, after the built-in templates.</p>
+  <table><thead><tr><th>Name</th><th>Prompt</th><th>Options</th><th></th></tr></thead><tbody id="template-rows"></tbody></table>
+  <p><input id="t-name" placeholder="Name"></p>
+  <textarea id="t-prompt" placeholder="Prompt, e.g. Draft a reply to this for {{app_name}}" style="min-height: 4rem"></textarea>
+  <p>
+    <select id="t-output"><option value="">full answer</option><option value="code">code only</option><option value="first_code">first code block</option></select>
+    <select id="t-verbosity"><option value="">any length</option><option>one-liner</option><option>short</option><option>detailed</option></select>
+    <select id="t-citations"><option value="">links as written</option><option value="footnotes">footnote citations</option><option value="inline">numbered citations</option><option value="none">no citations</option></select>
+    <select id="t-rich-text"><option value="">rich text in Office</option><option value="off">plain text only</option></select>
+    <label><input type="checkbox" id="t-rewrite"> review as diff</label>
+  </p>
+  <p><button class="primary" id="t-save">Add template</button> <button id="t-new">New</button><span class="status" id="templates-status"></span></p>
+</section>
+
+<section id="packs">
+  <h2>Template Packs</h2>
+  <p class="meta">Shared sets of templates, signed by their publisher. Their templates are offered as <code>pack/template</code> after your own. Packs can't run post-processing commands.</p>
+  <p><input id="pk-source" placeholder="https://… or C:\path\to\pack.json" style="width: 60%"> <button id="pk-preview">Preview</button><span class="status" id="packs-status"></span></p>
+  <div id="pk-card"></div>
+  <div class="gallery" id="pk-gallery"></div>
+</section>
+
+<section id="hotkeys">
+  <h2>Hotkeys</h2>
+  <p class="meta">Take effect immediately. Leave a field empty for its default.</p>
+  <p>Clipboard AI <input id="h-clipboard"> Quick ask <input id="h-quick"> Follow-up <input id="h-follow"></p>
+  <p><button class="primary" id="h-save">Save</button><span class="status" id="hotkeys-status"></span></p>
+</section>
+
+<section id="theme">
+  <h2>Theme</h2>
+  <p class="meta">For the dashboard and popups. System follows the Windows dark-mode setting. Open popups change when they are reopened.</p>
+  <p>Mode <select id="th-mode"><option value="system">System</option><option value="light">Light</option><option value="dark">Dark</option></select> Accent <input type="color" id="th-accent"></p>
+  <p><button class="primary" id="th-save">Save</button> <button id="th-reset">Reset</button><span class="status" id="theme-status"></span></p>
+</section>
+
+<section id="uploads">
+  <h2>Indexed Files</h2>
+  <p class="meta">Files indexed from the drop window, by content. Dropping one again is skipped while Khoj still has it. Large text files are indexed in parts; if a part fails, the upload pauses and resumes from that part.</p>
+  <table><thead><tr><th>Indexing in parts</th><th>Progress</th><th></th></tr></thead><tbody id="pending-rows"></tbody></table>
+  <p><button id="u-sync">Check Khoj</button> <button id="u-forget">Forget all</button><span class="status" id="uploads-status"></span></p>
+  <table><thead><tr><th>File</th><th>Size</th><th>Indexed</th></tr></thead><tbody id="upload-rows"></tbody></table>
+</section>
+
+<section id="edits">
+  <h2>Edit Reviews</h2>
+  <p class="meta">Results of <code>/v1/edits/stream</code>, kept in memory for review. Open one to accept or reject each hunk and write the result inside the workspace.</p>
+  <table><thead><tr><th>File</th><th>Hunks</th><th>Created</th><th></th></tr></thead><tbody id="edit-rows"></tbody></table>
+</section>
+
+<section id="transcript">
+  <h2>Transcript</h2>
+  <p class="meta">What the wrapper actually sent to Khoj and got back, including the flattened prompt, system lines and attachment names. Kept in memory for the last 20 conversations. <b>Replay</b> sends a prompt again, optionally edited or to another agent, and shows how the answer changed.</p>
+  <p><select id="tr-conv"></select> <button id="tr-refresh">Refresh</button> <button id="tr-clear">Clear</button><span class="status" id="transcript-status"></span></p>
+  <div id="transcript-rows"></div>
+</section>
+
+<section id="privacy">
+  <h2>Privacy</h2>
+  <p><label><input type="checkbox" id="p-enabled"> Privacy mode</label>: prompts and responses are not logged, and digests stay in memory. Lasts until the app quits.</p>
+  <p class="meta">Wiping overwrites and deletes the files below, and clears custom instructions, the AI Clipboard, queued requests, paused uploads, warm answers, edit reviews, the transcript and the last follow-up. config.json and .env are kept. Conversations stored on Khoj are not affected.</p>
+  <ul id="p-files"></ul>
+  <p><button id="p-wipe">Wipe local data</button><span class="status" id="privacy-status"></span></p>
+</section>
+
+<script>
+const api = (path, options = {}) =>
+  fetch(path, { ...options, headers: { "Content-Type": "application/json", "X-Khoj-Dashboard": "1" } })
+    .then(r => r.ok ? r.json() : r.text().then(t => Promise.reject(new Error(t))));
+
+function show(data) {
+  document.getElementById("conv").textContent = data.conversation_id || "none";
+  document.getElementById("agent").textContent = data.agent_slug || "default";
+  document.getElementById("text").value = data.instructions || "";
+}
 
-	// Show dialog to get user prompt
-	userPrompt, cancelled := showModernInputDialog("Khoj AI - Add Context", "Add instructions or context for the AI:", "Explain this in two sentences")
-	if cancelled {
-		log.Printf("ℹ️ User cancelled the prompt dialog")
-		return
-	}
+api("/dashboard/api/instructions").then(show);
+
+function showLinks(links) {
+  const body = document.getElementById("links");
+  body.innerHTML = "";
+  links.slice().reverse().forEach(link => {
+    const row = body.insertRow();
+    const cell = row.insertCell();
+    const a = document.createElement("a");
+    a.href = a.textContent = link.url;
+    a.target = "_blank";
+    if (link.revoked_at) a.className = "revoked";
+    cell.appendChild(a);
+    row.insertCell().textContent = "…" + link.conversation_id.slice(-4);
+    row.insertCell().textContent = new Date(link.created_at).toLocaleString();
+    const action = row.insertCell();
+    if (link.revoked_at) {
+      action.textContent = "revoked";
+    } else {
+      const copy = document.createElement("button");
+      copy.textContent = "Copy";
+      copy.onclick = () => navigator.clipboard.writeText(link.url);
+      const revoke = document.createElement("button");
+      revoke.textContent = "Revoke";
+      revoke.onclick = () => shareAction("DELETE", "?url=" + encodeURIComponent(link.url), "Revoked");
+      action.append(copy, " ", revoke);
+    }
+  });
+}
 
-	// Show single notification after user confirms
-	showNotification("Khoj AI", "Processing clipboard content...")
+function shareAction(method, query, done) {
+  const status = document.getElementById("share-status");
+  status.textContent = "Working…";
+  api("/dashboard/api/shares" + query, { method })
+    .then(links => { showLinks(links); status.textContent = done; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+}
 
-	// Prepare the final prompt with user input
-	var finalPrompt string
-	if userPrompt != "" && userPrompt != "Explain this in two sentences" {
-		finalPrompt = fmt.Sprintf("%s\n\nContent:\n%s", userPrompt, clipboardText)
-	} else {
-		finalPrompt = fmt.Sprintf("Explain this in two sentences:\n\n%s", clipboardText)
-	}
+api("/dashboard/api/shares").then(showLinks);
+document.getElementById("share").onclick = () => shareAction("POST", "", "Shared");
+
+function showDigest(data) {
+  const meta = document.getElementById("digest-meta");
+  const status = document.getElementById("digest-status");
+  document.getElementById("digest-run").disabled = !data.enabled || data.running;
+  if (!data.enabled) {
+    meta.textContent = "The daily digest is off. Add a digest section to config.json.";
+    return;
+  }
+  meta.textContent = "Generated daily at " + data.time + " and delivered to " + data.deliver.join(", ") + ".";
+  if (data.digest) {
+    meta.textContent += " Latest: " + new Date(data.digest.created_at).toLocaleString() +
+      (data.digest.file ? ", saved to " + data.digest.file : "") + ".";
+    document.getElementById("digest-body").innerHTML = data.digest.html; // Rendered and escaped by the server
+  }
+  status.textContent = data.running ? "Generating…" : data.error ? "Failed: " + data.error : "";
+  if (data.running) setTimeout(() => api("/dashboard/api/digest").then(showDigest), 2000);
+}
 
-	// Create context with timeout - don't defer cancel here since we need it in the goroutine
-	ctx, cancel := context.WithTimeout(context.Background(), clipboardTimeout)
+api("/dashboard/api/digest").then(showDigest);
+document.getElementById("digest-run").onclick = () =>
+  api("/dashboard/api/digest", { method: "POST" }).then(showDigest)
+    .catch(err => { document.getElementById("digest-status").textContent = "Failed: " + err.message; });
+
+function showClients(data) {
+  if (!data.enabled) {
+    document.getElementById("clients-meta").textContent = "Per-client conversations are off. Set api_conversations.mode to per_client in config.json.";
+  }
+  const body = document.getElementById("client-rows");
+  body.innerHTML = "";
+  data.mappings.forEach(m => {
+    const row = body.insertRow();
+    row.insertCell().textContent = m.client;
+    row.insertCell().textContent = "…" + m.conversation_id.slice(-4);
+    row.insertCell().textContent = new Date(m.last_used).toLocaleString();
+    const forget = document.createElement("button");
+    forget.textContent = "Forget";
+    forget.onclick = () => clientAction("DELETE", "?client=" + encodeURIComponent(m.client), "Forgotten");
+    row.insertCell().appendChild(forget);
+  });
+}
 
-	// Get API configuration
-	apiBase := os.Getenv("KHOJ_API_BASE")
-	if apiBase == "" {
-		apiBase = "https://app.khoj.dev"
-	}
+function clientAction(method, query, done) {
+  const status = document.getElementById("clients-status");
+  api("/dashboard/api/clients" + query, { method })
+    .then(data => { showClients(data); status.textContent = done; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+}
 
-	apiKey := os.Getenv("KHOJ_API_KEY")
-	if apiKey == "" {
-		log.Printf("❌ KHOJ_API_KEY not set")
-		showNotification("Khoj AI Error", "API key not configured")
-		return
-	}
+api("/dashboard/api/clients").then(showClients);
+document.getElementById("gc").onclick = () => clientAction("POST", "?gc=1", "Cleaned up");
+
+// editing is the template loaded into the form, whose other fields are kept on save
+let editing = null;
+
+function editTemplate(t) {
+  editing = t;
+  document.getElementById("t-name").value = t ? t.name : "";
+  document.getElementById("t-prompt").value = t ? t.prompt : "";
+  document.getElementById("t-output").value = t && t.output || "";
+  document.getElementById("t-verbosity").value = t && t.verbosity || "";
+  document.getElementById("t-citations").value = t && t.citations || "";
+  document.getElementById("t-rich-text").value = t && t.rich_text || "";
+  document.getElementById("t-rewrite").checked = !!(t && t.rewrite);
+  document.getElementById("t-save").textContent = t ? "Save template" : "Add template";
+}
 
-	log.Printf("🔧 Using API base: %s", apiBase)
-	log.Printf("🔧 Using conversation ID: %s", conversationID)
+function showTemplates(templates) {
+  const body = document.getElementById("template-rows");
+  body.innerHTML = "";
+  templates.forEach(t => {
+    const row = body.insertRow();
+    row.insertCell().textContent = t.name;
+    row.insertCell().textContent = t.prompt.length > 80 ? t.prompt.slice(0, 80) + "…" : t.prompt;
+    row.insertCell().textContent = [t.output, t.verbosity, t.citations && t.citations + " citations", t.rich_text == "off" && "plain text", t.rewrite && "diff", ...(t.languages || [])].filter(Boolean).join(", ");
+    const edit = document.createElement("button");
+    edit.textContent = "Edit";
+    edit.onclick = () => editTemplate(t);
+    const remove = document.createElement("button");
+    remove.textContent = "Delete";
+    remove.onclick = () => templateAction("DELETE", t.name, undefined, "Deleted");
+    row.insertCell().append(edit, " ", remove);
+  });
+}
 
-	// Process with AI using existing conversation context
-	log.Printf("🤖 Sending request to Khoj AI...")
+function templateAction(method, name, template, done) {
+  const status = document.getElementById("templates-status");
+  status.textContent = "Saving…";
+  api("/dashboard/api/templates" + (name ? "?name=" + encodeURIComponent(name) : ""), {
+    method,
+    body: template && JSON.stringify(template),
+  }).then(templates => { showTemplates(templates); editTemplate(null); status.textContent = done; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+}
 
-	go func() {
-		defer cancel() // Cancel context when goroutine completes
+api("/dashboard/api/templates").then(showTemplates);
+document.getElementById("t-new").onclick = () => editTemplate(null);
+document.getElementById("t-save").onclick = () => {
+  const template = {
+    ...(editing || {}),
+    name: document.getElementById("t-name").value.trim(),
+    prompt: document.getElementById("t-prompt").value,
+    output: document.getElementById("t-output").value || undefined,
+    verbosity: document.getElementById("t-verbosity").value || undefined,
+    citations: document.getElementById("t-citations").value || undefined,
+    rich_text: document.getElementById("t-rich-text").value || undefined,
+    rewrite: document.getElementById("t-rewrite").checked || undefined,
+  };
+  if (editing) templateAction("PUT", editing.name, template, "Saved");
+  else templateAction("POST", "", template, "Added");
+};
+
+// packCard renders a pack with textContent only, since packs come from other people
+function packCard(p, buttons) {
+  const card = document.createElement("div");
+  card.className = "card";
+  const title = document.createElement("h3");
+  title.textContent = (p.title || p.name) + (p.version ? " " + p.version : "");
+  const meta = document.createElement("p");
+  meta.className = "meta";
+  meta.textContent = [p.author && "by " + p.author, p.description].filter(Boolean).join(" · ");
+  const list = document.createElement("ul");
+  p.templates.forEach(t => {
+    const item = document.createElement("li");
+    item.textContent = p.name + "/" + t.name;
+    item.title = t.prompt;
+    list.appendChild(item);
+  });
+  const signer = document.createElement("p");
+  signer.className = "meta";
+  signer.textContent = "Signed by " + p.fingerprint + (p.trusted ? " (trusted)" : " (not trusted yet)") +
+    (p.source ? " · from " + p.source : "");
+  card.append(title, meta, list, signer, ...buttons);
+  return card;
+}
 
-		// Use the existing Khoj chat API with conversation context
-		aiResponse, err := sendToKhojChat(apiBase, apiKey, conversationID, finalPrompt, ctx)
-		if err != nil {
-			if ctx.Err() == context.DeadlineExceeded {
-				log.Printf("⏰ AI request timed out after %v", clipboardTimeout)
-				// Only show notification for timeout errors
-				showNotification("Khoj AI Timeout", fmt.Sprintf("Timed out after %d seconds", int(clipboardTimeout.Seconds())))
-			} else {
-				log.Printf("❌ AI request failed: %v", err)
-				// Only show notification for critical errors
-				showNotification("Khoj AI Error", fmt.Sprintf("Request failed: %v", err))
-			}
-			return
-		}
+function showPacks(packs) {
+  const gallery = document.getElementById("pk-gallery");
+  gallery.innerHTML = "";
+  if (!packs.length) gallery.textContent = "No packs installed.";
+  packs.forEach(p => {
+    const buttons = [];
+    if (p.source) {
+      const update = document.createElement("button");
+      update.textContent = "Update";
+      update.onclick = () => previewPack(p.source);
+      buttons.push(update, " ");
+    }
+    const remove = document.createElement("button");
+    remove.textContent = "Remove";
+    remove.onclick = () => packAction("DELETE", "?name=" + encodeURIComponent(p.name), undefined, "Removed " + p.name);
+    buttons.push(remove);
+    gallery.appendChild(packCard(p, buttons));
+  });
+}
 
-		log.Printf("✅ Received AI response (%d characters)", len(aiResponse))
+function packAction(method, query, body, done) {
+  const status = document.getElementById("packs-status");
+  status.textContent = "Working…";
+  return api("/dashboard/api/packs" + query, { method, body: body && JSON.stringify(body) })
+    .then(packs => { showPacks(packs); document.getElementById("pk-card").innerHTML = ""; status.textContent = done; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+}
 
-		// Send the AI response to the current cursor position
-		log.Printf("⌨️ Inserting response at cursor...")
-		err = sendText(aiResponse)
-		if err != nil {
-			log.Printf("❌ Failed to send text: %v", err)
-			// Only show notification for insertion errors
-			showNotification("Khoj AI Error", fmt.Sprintf("Failed to insert: %v", err))
-		} else {
-			log.Printf("✅ Successfully inserted AI response")
-			// No success notification - user can see the text was inserted
-		}
-	}()
+function previewPack(source) {
+  const status = document.getElementById("packs-status");
+  const slot = document.getElementById("pk-card");
+  status.textContent = "Checking…";
+  slot.innerHTML = "";
+  api("/dashboard/api/packs?preview=1", { method: "POST", body: JSON.stringify({ source }) })
+    .then(p => {
+      status.textContent = p.installed_version ? "Replaces the installed " + p.name + " " + p.installed_version : "";
+      const install = document.createElement("button");
+      install.className = "primary";
+      install.textContent = p.trusted ? "Install" : "Trust publisher and install";
+      install.onclick = () => {
+        if (!p.trusted && !confirm("Trust every pack signed by " + p.fingerprint + "? Only do this for publishers you know.")) return;
+        packAction("POST", "", { source, trust: !p.trusted }, "Installed " + p.name);
+      };
+      const cancel = document.createElement("button");
+      cancel.textContent = "Cancel";
+      cancel.onclick = () => { slot.innerHTML = ""; status.textContent = ""; };
+      slot.appendChild(packCard(p, [install, " ", cancel]));
+    })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
 }
 
-// sendToKhojChat sends a message to Khoj using the existing conversation context
-func sendToKhojChat(apiBase, apiKey, conversationID, message string, ctx context.Context) (string, error) {
-	// Prepare the request body
-	requestBody := map[string]interface{}{
-		"q":               message,
-		"conversation_id": conversationID,
-		"stream":          false,
-		"train":           false,
-		"agent":           currentAgentSlug,
-	}
+api("/dashboard/api/packs").then(showPacks);
+document.getElementById("pk-preview").onclick = () => previewPack(document.getElementById("pk-source").value.trim());
 
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
+function showHotkeys(h) {
+  document.getElementById("h-clipboard").value = h.hotkey;
+  document.getElementById("h-quick").value = h.quick_ask_hotkey;
+  document.getElementById("h-follow").value = h.follow_up_hotkey;
+}
 
-	// Create the request
-	url := fmt.Sprintf("%s/api/chat", apiBase)
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
+api("/dashboard/api/hotkeys").then(showHotkeys);
+document.getElementById("h-save").onclick = () => {
+  const status = document.getElementById("hotkeys-status");
+  status.textContent = "Saving…";
+  api("/dashboard/api/hotkeys", {
+    method: "PUT",
+    body: JSON.stringify({
+      hotkey: document.getElementById("h-clipboard").value,
+      quick_ask_hotkey: document.getElementById("h-quick").value,
+      follow_up_hotkey: document.getElementById("h-follow").value,
+    }),
+  }).then(h => { showHotkeys(h); status.textContent = "Saved"; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+};
+
+function showTheme(t) {
+  document.getElementById("th-mode").value = t.mode;
+  document.getElementById("th-accent").value = t.accent;
+}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+function saveTheme(theme) {
+  const status = document.getElementById("theme-status");
+  status.textContent = "Saving…";
+  api("/dashboard/api/theme", { method: "PUT", body: JSON.stringify(theme) })
+    .then(t => {
+      showTheme(t);
+      document.querySelector('link[rel="stylesheet"]').href = "/theme.css?" + Date.now();
+      status.textContent = "Saved";
+    })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+api("/dashboard/api/theme").then(showTheme);
+document.getElementById("th-save").onclick = () => saveTheme({
+  mode: document.getElementById("th-mode").value,
+  accent: document.getElementById("th-accent").value,
+});
+document.getElementById("th-reset").onclick = () => saveTheme({ mode: "", accent: "" });
+
+function showUploads(files) {
+  const body = document.getElementById("upload-rows");
+  body.innerHTML = "";
+  files.forEach(f => {
+    const row = body.insertRow();
+    row.insertCell().textContent = f.name;
+    row.insertCell().textContent = Math.ceil(f.size / 1024) + " KB";
+    row.insertCell().textContent = new Date(f.uploaded_at).toLocaleString();
+  });
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
+function uploadsAction(method, done) {
+  const status = document.getElementById("uploads-status");
+  api("/dashboard/api/uploads", { method })
+    .then(files => { showUploads(files); status.textContent = done; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+}
 
-	// Read the response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
+api("/dashboard/api/uploads").then(showUploads);
+
+// showPending lists large files being indexed in parts, refreshing while one is running
+let pendingTimer;
+function showPending(uploads) {
+  const body = document.getElementById("pending-rows");
+  body.innerHTML = "";
+  uploads.forEach(u => {
+    const row = body.insertRow();
+    row.insertCell().textContent = u.name;
+    row.insertCell().textContent = u.done + " of " + u.parts + " parts" + (u.error ? " - paused: " + u.error : "");
+    const cell = row.insertCell();
+    if (u.running) return;
+    const resume = document.createElement("button");
+    resume.textContent = "Resume";
+    resume.onclick = () => pendingAction("POST", u.id, "Indexed " + u.name);
+    const discard = document.createElement("button");
+    discard.textContent = "Discard";
+    discard.onclick = () => pendingAction("DELETE", u.id, "Discarded");
+    cell.append(resume, " ", discard);
+  });
+  if (uploads.length === 0) body.innerHTML = '<tr><td colspan="3">None</td></tr>';
+  clearTimeout(pendingTimer);
+  if (uploads.some(u => u.running)) pendingTimer = setTimeout(refreshPending, 1000);
+}
 
-	// Parse the response
-	var khojResp KhojResponse
-	if err := json.Unmarshal(body, &khojResp); err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
-	}
+function refreshPending() {
+  api("/drop/api/uploads").then(showPending);
+}
+
+function pendingAction(method, id, done) {
+  const status = document.getElementById("uploads-status");
+  status.textContent = method === "POST" ? "Resuming…" : "";
+  if (method === "POST") setTimeout(refreshPending, 500);
+  api("/drop/api/uploads?id=" + id, { method })
+    .then(uploads => { showPending(uploads); status.textContent = done; api("/dashboard/api/uploads").then(showUploads); })
+    .catch(err => { status.textContent = "Failed: " + err.message; refreshPending(); });
+}
+
+refreshPending();
+document.getElementById("u-sync").onclick = () => uploadsAction("POST", "Up to date with Khoj");
+document.getElementById("u-forget").onclick = () => uploadsAction("DELETE", "Forgotten; files will be uploaded again");
+
+function showEdits(data) {
+  const body = document.getElementById("edit-rows");
+  body.innerHTML = "";
+  data.edits.forEach(e => {
+    const row = body.insertRow();
+    row.insertCell().textContent = e.path + (e.written ? " (written)" : "");
+    row.insertCell().textContent = e.hunks;
+    row.insertCell().textContent = new Date(e.created).toLocaleString();
+    const link = document.createElement("a");
+    link.href = "/dashboard/diff?id=" + e.id;
+    link.textContent = "Review";
+    row.insertCell().appendChild(link);
+  });
+  if (data.edits.length === 0) body.innerHTML = '<tr><td colspan="4">None</td></tr>';
+}
+
+api("/dashboard/api/edits").then(showEdits);
+
+// showTranscript lists the mirrored exchanges of one conversation, newest last
+function showTranscript(data) {
+  const select = document.getElementById("tr-conv");
+  select.innerHTML = "";
+  const ids = data.conversations.includes(data.active) ? data.conversations : [data.active, ...data.conversations];
+  ids.forEach(id => {
+    const option = new Option(id === data.active ? id + " (active)" : id, id);
+    option.selected = id === data.conversation_id;
+    select.add(option);
+  });
+  const rows = document.getElementById("transcript-rows");
+  rows.innerHTML = "";
+  data.exchanges.forEach((e, i) => {
+    const meta = document.createElement("p");
+    meta.className = "meta";
+    meta.textContent = new Date(e.time).toLocaleString() + " · " + e.source + " · " + e.latency_ms + " ms" +
+      (e.files ? " · files: " + e.files.join(", ") : "") + (e.request_id ? " · " + e.request_id : "");
+    const sent = document.createElement("pre");
+    sent.textContent = "→ " + e.sent;
+    const received = document.createElement("pre");
+    received.textContent = e.error ? "✗ " + e.error : "← " + e.received + (e.interrupted ? " [interrupted]" : "");
+    const replay = document.createElement("button");
+    replay.textContent = "Replay";
+    replay.onclick = () => { replay.replaceWith(replayForm(data.conversation_id, i, e)); };
+    rows.append(meta, sent, received, replay);
+  });
+  if (data.exchanges.length === 0) rows.innerHTML = '<p class="meta">Nothing exchanged yet</p>';
+}
+
+let replayAgents;
+
+// replayForm lets one exchange be replayed with an edited prompt or another agent, showing a word diff of the answers
+function replayForm(conversationId, index, exchange) {
+  const form = document.createElement("div");
+  const prompt = document.createElement("textarea");
+  prompt.value = exchange.sent;
+  const agent = document.createElement("select");
+  replayAgents = replayAgents || api("/dashboard/api/replay");
+  replayAgents.then(data => {
+    const agents = data.agents || [];
+    (!data.current || agents.includes(data.current) ? agents : [data.current, ...agents]).forEach(slug => agent.add(new Option(slug === data.current ? slug + " (current)" : slug, slug, false, slug === data.current)));
+  });
+  const run = document.createElement("button");
+  run.textContent = "Run";
+  const status = document.createElement("span");
+  status.className = "status";
+  const diff = document.createElement("pre");
+  diff.hidden = true;
+  run.onclick = () => {
+    status.textContent = "Replaying…";
+    api("/dashboard/api/replay", { method: "POST", body: JSON.stringify({ conversation_id: conversationId, index, time: exchange.time, agent: agent.value, prompt: prompt.value }) })
+      .then(result => {
+        let inserted = 0, deleted = 0;
+        diff.innerHTML = "";
+        result.spans.forEach(span => {
+          const words = span.text.split(/\s+/).filter(Boolean).length;
+          if (span.op === "insert") inserted += words;
+          if (span.op === "delete") deleted += words;
+          const el = document.createElement(span.op === "insert" ? "ins" : span.op === "delete" ? "del" : "span");
+          el.textContent = span.text;
+          diff.appendChild(el);
+        });
+        diff.hidden = false;
+        status.textContent = result.agent + " · " + result.latency_ms + " ms · " + inserted + " word(s) added, " + deleted + " removed";
+      })
+      .catch(err => { status.textContent = "Failed: " + err.message; });
+  };
+  const controls = document.createElement("p");
+  controls.append(agent, " ", run, status);
+  form.append(prompt, controls, diff);
+  return form;
+}
+
+const transcriptPath = () => "/dashboard/api/transcript?conversation_id=" + encodeURIComponent(document.getElementById("tr-conv").value);
+api("/dashboard/api/transcript").then(showTranscript);
+document.getElementById("tr-conv").onchange = () => api(transcriptPath()).then(showTranscript);
+document.getElementById("tr-refresh").onclick = () => api(transcriptPath()).then(showTranscript);
+document.getElementById("tr-clear").onclick = () => {
+  const status = document.getElementById("transcript-status");
+  api(transcriptPath(), { method: "DELETE" })
+    .then(data => { showTranscript(data); status.textContent = "Cleared"; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+};
+
+function showPrivacy(data) {
+  document.getElementById("p-enabled").checked = data.enabled;
+  const list = document.getElementById("p-files");
+  list.innerHTML = "";
+  data.files.forEach(file => {
+    const item = document.createElement("li");
+    item.textContent = file;
+    list.appendChild(item);
+  });
+  if (data.files.length === 0) list.innerHTML = "<li>No local data files</li>";
+}
+
+api("/dashboard/api/privacy").then(showPrivacy);
+document.getElementById("p-enabled").onchange = e =>
+  api("/dashboard/api/privacy", { method: "PUT", body: JSON.stringify({ enabled: e.target.checked }) }).then(showPrivacy);
+document.getElementById("p-wipe").onclick = () => {
+  if (!confirm("Securely delete all local history, state and caches? This cannot be undone.")) return;
+  const status = document.getElementById("privacy-status");
+  status.textContent = "Wiping…";
+  api("/dashboard/api/privacy", { method: "DELETE" })
+    .then(data => { showPrivacy(data); status.textContent = "Wiped " + data.wiped + " file(s)"; api("/dashboard/api/instructions").then(show); api("/dashboard/api/transcript").then(showTranscript); api("/dashboard/api/edits").then(showEdits); })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+};
+
+document.getElementById("save").onclick = () => {
+  const status = document.getElementById("status");
+  status.textContent = "Saving…";
+  api("/dashboard/api/instructions", {
+    method: "PUT",
+    body: JSON.stringify({ instructions: document.getElementById("text").value }),
+  }).then(data => { show(data); status.textContent = "Saved"; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+};
+</script>
+</body>
+</html>
+`
 
-	return khojResp.Response, nil
+// dropHTML is the drag-and-drop window opened from the tray
+const dropHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj - Drop Files</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  body { font-family: system-ui, sans-serif; max-width: 640px; margin: 1.5rem auto; padding: 0 1rem; background: var(--surface); color: var(--text); }
+  #zone { border: 3px dashed var(--border); border-radius: 12px; padding: 3rem 1rem; text-align: center; color: var(--muted); font-size: 1.1rem; }
+  #zone.over { border-color: var(--accent); background: var(--accent-soft); color: var(--accent); }
+  .actions { margin: 1rem 0; }
+  .actions label { margin-right: 1.5rem; }
+  .file { border: 1px solid var(--border); border-radius: 8px; padding: 0.6rem 0.8rem; margin-top: 0.6rem; }
+  .file .name { font-weight: 600; }
+  .file .state { color: var(--muted); font-size: 0.9rem; margin-left: 0.5rem; }
+  .file.failed .state { color: var(--error); }
+  .file.done .state { color: var(--ok); }
+  progress { width: 100%; }
+  pre { white-space: pre-wrap; font: inherit; background: var(--subtle); padding: 0.6rem; border-radius: 6px; }
+</style>
+</head>
+<body>
+<div class="actions">
+  Action for the next drop:
+  <label><input type="radio" name="action" value="summarize" checked> Summarize</label>
+  <label><input type="radio" name="action" value="index"> Index to Khoj</label>
+</div>
+<div id="zone">Drop files here</div>
+<div id="files"></div>
+
+<script>
+const zone = document.getElementById("zone");
+zone.ondragover = e => { e.preventDefault(); zone.classList.add("over"); };
+zone.ondragleave = () => zone.classList.remove("over");
+zone.ondrop = e => {
+  e.preventDefault();
+  zone.classList.remove("over");
+  const action = document.querySelector("input[name=action]:checked").value;
+  [...e.dataTransfer.files].forEach(file => { queue = queue.then(upload(file, action)); });
+};
+
+// Files are processed one at a time so each shows its own progress
+let queue = Promise.resolve();
+
+// upload adds the file's row now and returns the step that sends it
+function upload(file, action) {
+  const row = document.createElement("div");
+  row.className = "file";
+  row.innerHTML = '<span class="name"></span><span class="state">waiting…</span><progress max="100" value="0"></progress>';
+  row.querySelector(".name").textContent = file.name + (action === "index" ? " → index" : " → summary");
+  document.getElementById("files").prepend(row);
+  const state = row.querySelector(".state");
+  const bar = row.querySelector("progress");
+
+  return () => new Promise(resolve => {
+    const form = new FormData();
+    form.append("action", action);
+    form.append("file", file);
+    const xhr = new XMLHttpRequest();
+    xhr.open("POST", "/drop/api/files");
+    xhr.setRequestHeader("X-Khoj-Dashboard", "1");
+    xhr.upload.onprogress = e => {
+      if (e.lengthComputable) bar.value = 100 * e.loaded / e.total;
+      state.textContent = "uploading…";
+    };
+    // Large text files are indexed in parts; show which part is being sent
+    let poll;
+    xhr.upload.onload = () => {
+      bar.removeAttribute("value");
+      state.textContent = action === "index" ? "indexing…" : "summarizing…";
+      if (action === "index") poll = setInterval(() => {
+        fetch("/drop/api/uploads").then(r => r.json()).then(uploads => {
+          const u = uploads.find(u => u.name === file.name && u.running);
+          if (u) { bar.max = u.parts; bar.value = u.done; state.textContent = "indexing part " + (u.done + 1) + " of " + u.parts + "…"; }
+        });
+      }, 1000);
+    };
+    xhr.onloadend = () => clearInterval(poll);
+    xhr.onload = () => {
+      bar.remove();
+      if (xhr.status !== 200) {
+        row.classList.add("failed");
+        state.textContent = "failed: " + xhr.responseText.trim();
+      } else {
+        row.classList.add("done");
+        const result = JSON.parse(xhr.responseText);
+        state.textContent = action !== "index" ? "done"
+          : result.already_indexed ? "already indexed as " + result.already_indexed
+          : result.parts ? "indexed in " + result.parts + " parts" : "indexed";
+        if (result.summary) {
+          const pre = document.createElement("pre");
+          pre.textContent = result.summary;
+          row.appendChild(pre);
+        }
+      }
+      resolve();
+    };
+    xhr.onerror = () => { bar.remove(); row.classList.add("failed"); state.textContent = "failed: connection error"; resolve(); };
+    xhr.send(form);
+  });
 }
+</script>
+</body>
+</html>
+`
 
-// setupKeyboardMonitoring sets up polling-based Ctrl+Q detection
-func setupKeyboardMonitoring() error {
-	if runtime.GOOS != "windows" {
-		return fmt.Errorf("keyboard monitoring only available on Windows")
-	}
-
-	log.Printf("� Setting up keyboard monitoring for Ctrl+Q...")
+// quickAskHTML is the quick-ask popup; its title must match quickAskTitle
+const quickAskHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj Quick Ask</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  html, body { margin: 0; height: 100%; }
+  body { font-family: system-ui, sans-serif; display: flex; flex-direction: column; background: var(--bg); color: var(--text); }
+  #question { font: inherit; font-size: 1.2rem; padding: 0.8rem 1rem; border: none; border-bottom: 1px solid var(--border); outline: none; background: var(--surface); }
+  #answer { flex: 1; overflow-y: auto; padding: 0.8rem 1rem; white-space: pre-wrap; line-height: 1.45; }
+  #status { font-size: 0.8rem; color: var(--muted); padding: 0.3rem 1rem; border-top: 1px solid var(--border); }
+  .error { color: var(--error); }
+</style>
+</head>
+<body>
+<input id="question" placeholder="Ask Khoj… (Enter to send, Esc to close)" autofocus autocomplete="off">
+<div id="answer"></div>
+<div id="status">Slash commands such as /agent, /new and /research work here</div>
+
+<script>
+const question = document.getElementById("question");
+const answer = document.getElementById("answer");
+const status = document.getElementById("status");
+let controller = null;
+
+question.onkeydown = e => {
+  if (e.key === "Escape") { if (controller) controller.abort(); window.close(); }
+  if (e.key === "Enter" && question.value.trim()) { e.preventDefault(); ask(question.value); }
+};
+
+async function ask(text) {
+  if (controller) controller.abort();
+  controller = new AbortController();
+  answer.textContent = "";
+  answer.className = "";
+  status.textContent = "Thinking…";
+  try {
+    const res = await fetch("/ask/api/question", {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "X-Khoj-Dashboard": "1" },
+      body: JSON.stringify({ question: text }),
+      signal: controller.signal,
+    });
+    if (!res.ok) throw new Error((await res.text()).trim());
+
+    // Parse the SSE stream by hand; EventSource cannot POST
+    const reader = res.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = "";
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) break;
+      buffer += decoder.decode(value, { stream: true });
+      let end;
+      while ((end = buffer.indexOf("\n\n")) >= 0) {
+        handle(buffer.slice(0, end));
+        buffer = buffer.slice(end + 2);
+      }
+    }
+  } catch (err) {
+    if (err.name === "AbortError") return;
+    answer.className = "error";
+    answer.textContent = err.message;
+    status.textContent = "Failed";
+  }
+  question.select();
+}
 
-	// Start polling for Ctrl+Q combination
-	go func() {
-		getAsyncKeyState := user32.NewProc("GetAsyncKeyState")
+function handle(block) {
+  let event = "message", data = "";
+  for (const line of block.split("\n")) {
+    if (line.startsWith("event: ")) event = line.slice(7);
+    else if (line.startsWith("data: ")) data += line.slice(6);
+  }
+  const payload = JSON.parse(data || "{}");
+  if (event === "delta") {
+    answer.textContent += payload.content;
+    answer.scrollTop = answer.scrollHeight;
+  } else if (event === "done") {
+    if (payload.message) answer.textContent = payload.message;
+    status.textContent = "Answered by " + (payload.agent || "the default agent");
+  } else if (event === "error") {
+    answer.className = "error";
+    answer.textContent = payload.message;
+    status.textContent = "Failed";
+  }
+}
+</script>
+</body>
+</html>
+`
 
-		var lastCtrlQState bool
-		ticker := time.NewTicker(50 * time.Millisecond) // Check every 50ms
-		defer ticker.Stop()
+// diffPreviewHTML is the rewrite review window; its title must match diffPreviewTitle
+const diffPreviewHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj Diff Preview</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  html, body { margin: 0; height: 100%; }
+  body { font-family: system-ui, sans-serif; display: flex; flex-direction: column; background: var(--bg); color: var(--text); }
+  header { padding: 0.6rem 1rem; border-bottom: 1px solid var(--border); background: var(--surface); font-size: 0.9rem; color: var(--muted); }
+  #diff { flex: 1; overflow-y: auto; padding: 0.8rem 1rem; white-space: pre-wrap; line-height: 1.55; }
+  ins { background: var(--ins-bg); color: var(--ins-text); text-decoration: none; }
+  del { background: var(--del-bg); color: var(--del-text); }
+  footer { display: flex; gap: 0.5rem; justify-content: flex-end; padding: 0.6rem 1rem; border-top: 1px solid var(--border); }
+  button { font: inherit; padding: 0.4rem 1rem; }
+  .error { color: var(--error); }
+</style>
+</head>
+<body>
+<header id="summary">Loading…</header>
+<div id="diff"></div>
+<footer>
+  <button id="decline">Keep original (Esc)</button>
+  <button class="primary" id="accept">Replace (Enter)</button>
+</footer>
+
+<script>
+const id = new URLSearchParams(location.search).get("id");
+const summary = document.getElementById("summary");
+const diff = document.getElementById("diff");
+let decided = false;
+
+async function load() {
+  const res = await fetch("/preview/api/diff?id=" + encodeURIComponent(id));
+  if (!res.ok) {
+    decided = true;
+    summary.className = "error";
+    summary.textContent = (await res.text()).trim();
+    return;
+  }
+  const preview = await res.json();
+  let inserted = 0, deleted = 0;
+  for (const span of preview.spans) {
+    const words = span.text.split(/\s+/).filter(Boolean).length;
+    if (span.op === "insert") inserted += words;
+    if (span.op === "delete") deleted += words;
+    const el = document.createElement(span.op === "insert" ? "ins" : span.op === "delete" ? "del" : "span");
+    el.textContent = span.text;
+    diff.appendChild(el);
+  }
+  summary.textContent = inserted + " word(s) added, " + deleted + " removed" +
+    (preview.language ? " · " + preview.language : "");
+  document.getElementById("accept").focus();
+}
 
-		log.Printf("✅ Keyboard monitoring started! Press Ctrl+Q to use Clipboard AI")
-		showNotification("Khoj AI Ready", "Press Ctrl+Q to process clipboard")
+function decide(accept) {
+  if (decided) { window.close(); return; }
+  decided = true;
+  fetch("/preview/api/decision", {
+    method: "POST",
+    headers: { "Content-Type": "application/json", "X-Khoj-Dashboard": "1" },
+    body: JSON.stringify({ id, accept }),
+    keepalive: true,
+  }).finally(() => window.close());
+}
 
-		for {
-			select {
-			case <-ticker.C:
-				// Check if both Ctrl and Q are pressed
-				ctrlState, _, _ := getAsyncKeyState.Call(VK_CONTROL)
-				qState, _, _ := getAsyncKeyState.Call(VK_Q)
+document.getElementById("accept").onclick = () => decide(true);
+document.getElementById("decline").onclick = () => decide(false);
+document.onkeydown = e => {
+  if (e.key === "Escape") decide(false);
+  if (e.key === "Enter") { e.preventDefault(); decide(true); }
+};
+// Closing the window counts as keeping the original
+window.addEventListener("pagehide", () => { if (!decided) decide(false); });
+load();
+</script>
+</body>
+</html>
+`
 
-				ctrlPressed := (ctrlState & 0x8000) != 0
-				qPressed := (qState & 0x8000) != 0
+// diffReviewHTML shows an edit kept for review side by side, with a checkbox per hunk and a button to write the result
+const diffReviewHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj Edit Review</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  body { font-family: system-ui, sans-serif; margin: 1.5rem auto; padding: 0 1rem; max-width: 1400px; background: var(--surface); color: var(--text); }
+  h1 { font-size: 1.3rem; }
+  .meta { color: var(--muted); font-size: 0.9rem; }
+  .status { margin-left: 0.5rem; color: var(--muted); }
+  .hunk { border: 1px solid var(--border); border-radius: 6px; margin-bottom: 1rem; overflow: hidden; }
+  .hunk header { display: flex; gap: 1rem; align-items: center; padding: 0.4rem 0.6rem; background: var(--subtle); font-size: 0.9rem; }
+  .hunk.rejected table { opacity: 0.45; }
+  table { width: 100%; border-collapse: collapse; table-layout: fixed; font: 0.85rem/1.45 ui-monospace, monospace; }
+  td { padding: 0 0.4rem; white-space: pre-wrap; word-break: break-all; vertical-align: top; }
+  td.num { width: 3.5rem; color: var(--muted); text-align: right; user-select: none; }
+  td.del { background: var(--del-bg); }
+  td.ins { background: var(--ins-bg); }
+  td.empty { background: var(--subtle); }
+  input[type=text] { width: 32rem; max-width: 100%; font: inherit; }
+  .error { color: var(--error); }
+</style>
+</head>
+<body>
+<h1 id="title">Edit Review</h1>
+<p class="meta" id="summary">Loading…</p>
+<p>
+  <button id="all">Accept all</button> <button id="none">Reject all</button>
+  &nbsp; Write to <input type="text" id="path"> <button class="primary" id="write">Write to disk</button> <button id="discard">Discard</button>
+  <span class="status" id="status"></span>
+</p>
+<div id="hunks"></div>
+
+<script>
+const id = new URLSearchParams(location.search).get("id");
+const api = (path, options = {}) =>
+  fetch(path, { ...options, headers: { "Content-Type": "application/json", "X-Khoj-Dashboard": "1" } })
+    .then(r => r.ok ? r.json() : r.text().then(t => Promise.reject(Object.assign(new Error(t.trim()), { status: r.status }))));
+const status = document.getElementById("status");
+let edit;
+
+// sideBySide pairs a hunk's removed and added lines row by row, with unchanged lines on both sides
+function sideBySide(hunk) {
+  const rows = [];
+  let oldNum = hunk.old_lines ? hunk.old_start : hunk.old_start + 1;
+  let newNum = hunk.new_lines ? hunk.new_start : hunk.new_start + 1;
+  for (let i = 0; i < hunk.lines.length;) {
+    if (hunk.lines[i][0] === " ") {
+      rows.push([oldNum++, hunk.lines[i].slice(1), "", newNum++, hunk.lines[i].slice(1), ""]);
+      i++;
+      continue;
+    }
+    const removed = [], added = [];
+    while (i < hunk.lines.length && hunk.lines[i][0] === "-") removed.push(hunk.lines[i++].slice(1));
+    while (i < hunk.lines.length && hunk.lines[i][0] === "+") added.push(hunk.lines[i++].slice(1));
+    for (let j = 0; j < Math.max(removed.length, added.length); j++) {
+      rows.push([
+        j < removed.length ? oldNum++ : "", j < removed.length ? removed[j] : "", j < removed.length ? "del" : "empty",
+        j < added.length ? newNum++ : "", j < added.length ? added[j] : "", j < added.length ? "ins" : "empty",
+      ]);
+    }
+  }
+  const table = document.createElement("table");
+  rows.forEach(([on, ot, oc, nn, nt, nc]) => {
+    const row = table.insertRow();
+    [[on, "num"], [ot, oc], [nn, "num"], [nt, nc]].forEach(([text, cls]) => {
+      const cell = row.insertCell();
+      cell.className = cls;
+      cell.textContent = text;
+    });
+  });
+  return table;
+}
 
-				currentCtrlQState := ctrlPressed && qPressed
+function show(data) {
+  edit = data.edit;
+  const writable = (data.workspace || []).length > 0;
+  document.title = "Review " + edit.filename;
+  document.getElementById("title").textContent = edit.filename;
+  document.getElementById("path").value = edit.path;
+  document.getElementById("summary").textContent = edit.hunks.length + " hunk(s) · " + new Date(edit.created).toLocaleString() +
+    (edit.written ? " · written to " + edit.written : "") +
+    (writable ? " · workspace " + data.workspace.join(", ") : " · set workspace.roots in config.json to write files");
+  document.getElementById("write").disabled = !writable || edit.hunks.length === 0;
+  const hunks = document.getElementById("hunks");
+  hunks.innerHTML = "";
+  edit.hunks.forEach((hunk, i) => {
+    const box = document.createElement("div");
+    box.className = "hunk";
+    const header = document.createElement("header");
+    const label = document.createElement("label");
+    const check = document.createElement("input");
+    check.type = "checkbox";
+    check.checked = true;
+    check.dataset.hunk = i;
+    check.onchange = () => box.classList.toggle("rejected", !check.checked);
+    label.append(check, " Accept");
+    const range = document.createElement("code");
+    range.textContent = "@@ -" + hunk.old_start + "," + hunk.old_lines + " +" + hunk.new_start + "," + hunk.new_lines + " @@";
+    header.append(label, range);
+    box.append(header, sideBySide(hunk));
+    hunks.appendChild(box);
+  });
+  if (edit.hunks.length === 0) hunks.innerHTML = '<p class="meta">No changes</p>';
+}
 
-				// Trigger only on the rising edge (when Ctrl+Q becomes pressed)
-				if currentCtrlQState && !lastCtrlQState {
-					log.Printf("🎯 Ctrl+Q detected! Processing clipboard with AI...")
+function setAll(checked) {
+  document.querySelectorAll("[data-hunk]").forEach(check => { check.checked = checked; check.onchange(); });
+}
 
-					// Show immediate notification and process
-					go func() {
-						showNotification("Khoj AI", "Processing clipboard...")
-						processClipboardWithAI()
-					}()
-				}
+function write(force) {
+  const accepted = [...document.querySelectorAll("[data-hunk]:checked")].map(check => Number(check.dataset.hunk));
+  status.textContent = "Writing…";
+  api("/dashboard/api/edits?id=" + encodeURIComponent(id), {
+    method: "POST",
+    body: JSON.stringify({ accepted, path: document.getElementById("path").value, force }),
+  }).then(data => {
+    show(data);
+    status.textContent = "Wrote " + accepted.length + " of " + data.edit.hunks.length + " hunk(s) to " + data.edit.written;
+  }).catch(err => {
+    if (err.status === 409 && !force && confirm(err.message + ". Write anyway?")) return write(true);
+    status.textContent = "Failed: " + err.message;
+  });
+}
 
-				lastCtrlQState = currentCtrlQState
-			}
-		}
-	}()
+document.getElementById("all").onclick = () => setAll(true);
+document.getElementById("none").onclick = () => setAll(false);
+document.getElementById("write").onclick = () => write(false);
+document.getElementById("discard").onclick = () =>
+  api("/dashboard/api/edits?id=" + encodeURIComponent(id), { method: "DELETE" })
+    .then(() => { location.href = "/dashboard#edits"; })
+    .catch(err => { status.textContent = "Failed: " + err.message; });
+
+api("/dashboard/api/edits?id=" + encodeURIComponent(id)).then(show).catch(err => {
+  document.getElementById("summary").className = "error";
+  document.getElementById("summary").textContent = err.message;
+});
+</script>
+</body>
+</html>
+`
 
-	return nil
+// warmAnswerHTML shows a cached warm prompt answer; its title must match warmAnswerTitle
+const warmAnswerHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj Warm Answer</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  html, body { margin: 0; height: 100%; }
+  body { font-family: system-ui, sans-serif; display: flex; flex-direction: column; background: var(--bg); color: var(--text); }
+  header { display: flex; align-items: center; gap: 0.5rem; padding: 0.6rem 1rem; border-bottom: 1px solid var(--border); background: var(--surface); font-size: 0.9rem; color: var(--muted); }
+  header strong { color: var(--text); }
+  #status { flex: 1; }
+  #answer { flex: 1; overflow-y: auto; padding: 0.8rem 1rem; white-space: pre-wrap; line-height: 1.55; }
+  button { font: inherit; padding: 0.3rem 0.8rem; }
+  .error { color: var(--error); }
+</style>
+</head>
+<body>
+<header>
+  <strong id="name"></strong>
+  <span id="status">Loading…</span>
+  <button class="primary" id="copy">Copy</button>
+  <button id="refresh">Refresh</button>
+</header>
+<div id="answer"></div>
+
+<script>
+const name = new URLSearchParams(location.search).get("name");
+const api = "/warm/api/answer?name=" + encodeURIComponent(name);
+const status = document.getElementById("status");
+const answer = document.getElementById("answer");
+document.getElementById("name").textContent = name;
+let timer = null;
+
+function age(updated) {
+  const minutes = Math.round((Date.now() - new Date(updated)) / 60000);
+  return minutes < 1 ? "just now" : minutes < 60 ? minutes + " min ago" : Math.round(minutes / 60) + " h ago";
 }
 
-// testKeyboardState manually checks if Ctrl+Q is currently pressed (for debugging)
-func testKeyboardState() {
-	if runtime.GOOS != "windows" {
-		return
-	}
-
-	getAsyncKeyState := user32.NewProc("GetAsyncKeyState")
+async function load() {
+  clearTimeout(timer);
+  const res = await fetch(api);
+  if (!res.ok) {
+    status.className = "error";
+    status.textContent = (await res.text()).trim();
+    return;
+  }
+  const warm = await res.json();
+  const ready = !warm.updated_at.startsWith("0001-");
+  if (ready) answer.textContent = warm.answer;
+  status.className = warm.error ? "error" : "";
+  status.textContent = warm.running ? (ready ? "Refreshing…" : "Warming up…")
+    : warm.error ? warm.error + (ready ? " (showing answer from " + age(warm.updated_at) + ")" : "")
+    : "Updated " + age(warm.updated_at);
+  if (warm.running) timer = setTimeout(load, 1000);
+}
 
-	qState, _, _ := getAsyncKeyState.Call(VK_Q)
-	ctrlState, _, _ := getAsyncKeyState.Call(VK_CONTROL)
+document.getElementById("refresh").onclick = async () => {
+  await fetch(api, { method: "POST", headers: { "X-Khoj-Dashboard": "1" } });
+  load();
+};
+document.getElementById("copy").onclick = () => navigator.clipboard.writeText(answer.textContent);
+document.onkeydown = e => { if (e.key === "Escape") window.close(); };
+load();
+</script>
+</body>
+</html>
+`
 
-	qPressed := (qState & 0x8000) != 0
-	ctrlPressed := (ctrlState & 0x8000) != 0
+// aiClipboardHTML lists recent clipboard AI answers and the offline queue
+const aiClipboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj AI Clipboard</title>
+<link rel="stylesheet" href="/theme.css">
+<style>
+  body { font-family: system-ui, sans-serif; margin: 0; background: var(--bg); color: var(--text); }
+  header { display: flex; align-items: center; gap: 0.5rem; padding: 0.6rem 1rem; border-bottom: 1px solid var(--border); background: var(--surface); font-size: 0.9rem; color: var(--muted); }
+  header strong { color: var(--text); flex: 1; }
+  section { padding: 0.4rem 1rem; }
+  h2 { font-size: 0.85rem; text-transform: uppercase; color: var(--muted); margin: 0.8rem 0 0.4rem; }
+  .entry { background: var(--surface); border: 1px solid var(--border); border-radius: 4px; padding: 0.5rem 0.7rem; margin-bottom: 0.5rem; }
+  .meta { display: flex; align-items: center; gap: 0.5rem; font-size: 0.8rem; color: var(--muted); }
+  .meta span { flex: 1; }
+  .request { font-weight: 600; margin: 0.2rem 0; }
+  .answer { white-space: pre-wrap; line-height: 1.5; max-height: 9rem; overflow-y: auto; }
+  .error { color: var(--error); font-size: 0.8rem; }
+  .empty { color: var(--muted); font-size: 0.9rem; }
+  button { font: inherit; padding: 0.2rem 0.7rem; }
+</style>
+</head>
+<body>
+<header>
+  <strong>AI Clipboard</strong>
+  <button id="retry" hidden>Retry now</button>
+</header>
+<section id="queue" hidden>
+  <h2>Waiting for Khoj</h2>
+  <div id="queued"></div>
+</section>
+<section>
+  <h2>Answers</h2>
+  <div id="entries"></div>
+</section>
+
+<script>
+const api = "/clipboard/api/entries";
+const headers = { "X-Khoj-Dashboard": "1" };
+let timer = null;
+
+function time(value) {
+  return new Date(value).toLocaleString();
+}
 
-	log.Printf("🔍 Manual key state check:")
-	log.Printf("  Q key: %t (raw: %d/0x%x)", qPressed, qState, qState)
-	log.Printf("  Ctrl key: %t (raw: %d/0x%x)", ctrlPressed, ctrlState, ctrlState)
+function entry(meta, request, button) {
+  const div = document.createElement("div");
+  div.className = "entry";
+  const line = document.createElement("div");
+  line.className = "meta";
+  const span = document.createElement("span");
+  span.textContent = meta;
+  line.append(span, button);
+  const req = document.createElement("div");
+  req.className = "request";
+  req.textContent = request;
+  div.append(line, req);
+  return div;
+}
 
-	if qPressed && ctrlPressed {
-		log.Printf("🎯 Manual detection: Ctrl+Q is currently pressed!")
-		showNotification("Debug", "Ctrl+Q detected manually!")
-	} else {
-		log.Printf("ℹ️ Ctrl+Q not currently pressed")
-		showNotification("Debug", fmt.Sprintf("Q:%t Ctrl:%t", qPressed, ctrlPressed))
-	}
+function button(label, onclick) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.onclick = onclick;
+  return b;
 }
 
-// stopKeyboardMonitoring stops the keyboard monitoring (placeholder for cleanup)
-func stopKeyboardMonitoring() {
-	// The polling goroutine will stop when the application exits
-	log.Printf("Keyboard monitoring stopped")
+function render(listing) {
+  const queued = document.getElementById("queued");
+  queued.replaceChildren();
+  for (const q of listing.queued) {
+    const div = entry("Queued " + time(q.queued_at) + " · " + q.attempts + " attempt(s)", q.request,
+      button("Cancel", async () => render(await (await fetch(api + "?id=" + q.id, { method: "DELETE", headers })).json())));
+    if (q.last_error) {
+      const err = document.createElement("div");
+      err.className = "error";
+      err.textContent = q.last_error;
+      div.append(err);
+    }
+    queued.append(div);
+  }
+  document.getElementById("queue").hidden = listing.queued.length === 0;
+  document.getElementById("retry").hidden = listing.queued.length === 0;
+
+  const entries = document.getElementById("entries");
+  entries.replaceChildren();
+  for (const e of listing.entries) {
+    const div = entry(time(e.created_at) + (e.queued ? " · from the offline queue" : ""), e.request,
+      button("Copy", () => navigator.clipboard.writeText(e.answer)));
+    const answer = document.createElement("div");
+    answer.className = "answer";
+    answer.textContent = e.answer;
+    div.append(answer);
+    entries.append(div);
+  }
+  if (listing.entries.length === 0) {
+    entries.innerHTML = '<div class="empty">No answers yet.</div>';
+  }
+
+  clearTimeout(timer);
+  if (listing.queued.length > 0) timer = setTimeout(load, 5000);
 }
 
-type ChatCompletionRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Stream      bool      `json:"stream,omitempty"`
-	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  string    `json:"tool_choice,omitempty"`
-	Stop        []string  `json:"stop,omitempty"`
-	Purpose     string    `json:"purpose,omitempty"`
+async function load() {
+  render(await (await fetch(api)).json());
 }
 
-var iconData = []byte{0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x20, 0x20, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0xa8, 0x10, 0x00, 0x00, 0x16, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0x01, 0x00, 0x00, 0x62, 0x01, 0x00, 0x00, 0x94, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x94, 0x01, 0x00, 0x00, 0x66, 0x01, 0x00, 0x00, 0x0d, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x65, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xfb, 0x01, 0x00, 0x00, 0x6c, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x98, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x95, 0x01, 0x00, 0x00, 0x5a, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x5a, 0x01, 0x00, 0x00, 0x90, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x9f, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x59, 0x01, 0x00, 0x00, 0x92, 0x01, 0x00, 0x00, 0x16, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x98, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x2f, 0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x9a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x60, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x0b, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x59, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa2, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x8a, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xda, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0xd9, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x92, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0xef, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xef, 0x01, 0x00, 0x00, 0xca, 0x01, 0x00, 0x00, 0x36, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x15, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x16, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x23, 0x01, 0x00, 0x00, 0x23, 0x01, 0x00, 0x00, 0x12, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xa3, 0x01, 0x00, 0x00, 0x23, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x2c, 0x01, 0x00, 0x00, 0x8a, 0x01, 0x00, 0x00, 0xcc, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0xe7, 0x01, 0x00, 0x00, 0xcf, 0x01, 0x00, 0x00, 0x90, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0xe4, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0x61, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x5b, 0x01, 0x00, 0x00, 0xdf, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf5, 0x01, 0x00, 0x00, 0xdc, 0x01, 0x00, 0x00, 0xdb, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xe4, 0x01, 0x00, 0x00, 0x64, 0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0xe4, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0x83, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x51, 0x01, 0x00, 0x00, 0xed, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0x9d, 0x01, 0x00, 0x00, 0x3b, 0x01, 0x00, 0x00, 0x17, 0x01, 0x00, 0x00, 0x18, 0x01, 0x00, 0x00, 0x3a, 0x01, 0x00, 0x00, 0x98, 0x01, 0x00, 0x00, 0xf5, 0x01, 0x00, 0x00, 0xf2, 0x01, 0x00, 0x00, 0x5c, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0xe3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xb5, 0x01, 0x00, 0x00, 0x3d, 0x01, 0x00, 0x00, 0x34, 0x01, 0x00, 0x00, 0x34, 0x01, 0x00, 0x00, 0x42, 0x01, 0x00, 0x00, 0xcf, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xab, 0x01, 0x00, 0x00, 0x3b, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0x07, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x72, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0xd7, 0x01, 0x00, 0x00, 0x22, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x3a, 0x01, 0x00, 0x00, 0xe3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf5, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xfe, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0xd9, 0x01, 0x00, 0x00, 0x20, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0xab, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x6e, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x2a, 0x01, 0x00, 0x00, 0xb7, 0x01, 0x00, 0x00, 0x69, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x20, 0x01, 0x00, 0x00, 0xbb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xd9, 0x01, 0x00, 0x00, 0xbe, 0x01, 0x00, 0x00, 0xc0, 0x01, 0x00, 0x00, 0xc1, 0x01, 0x00, 0x00, 0xeb, 0x01, 0x00, 0x00, 0xfe, 0x01, 0x00, 0x00, 0xd0, 0x01, 0x00, 0x00, 0xbf, 0x01, 0x00, 0x00, 0xc0, 0x01, 0x00, 0x00, 0xc1, 0x01, 0x00, 0x00, 0xaa, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x58, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa8, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x53, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0xba, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xc6, 0x01, 0x00, 0x00, 0x2c, 0x01, 0x00, 0x00, 0x06, 0x01, 0x00, 0x00, 0x0f, 0x01, 0x00, 0x00, 0xb9, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0x44, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x37, 0x01, 0x00, 0x00, 0xf6, 0x01, 0x00, 0x00, 0xbe, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0xba, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xbe, 0x01, 0x00, 0x00, 0x25, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0xb0, 0x01, 0x00, 0x00, 0xfc, 0x01, 0x00, 0x00, 0x47, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x09, 0x01, 0x00, 0x00, 0x42, 0x01, 0x00, 0x00, 0x4d, 0x01, 0x00, 0x00, 0x4c, 0x01, 0x00, 0x00, 0x4a, 0x01, 0x00, 0x00, 0x75, 0x01, 0x00, 0x00, 0xf9, 0x01, 0x00, 0x00, 0xd0, 0x01, 0x00, 0x00, 0x51, 0x01, 0x00, 0x00, 0x4b, 0x01, 0x00, 0x00, 0x4e, 0x01, 0x00, 0x00, 0xb1, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf0, 0x01, 0x00, 0x00, 0x67, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0xba, 0x01, 0x00, 0x00, 0xf8, 0x01, 0x00, 0x00, 0x5f, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x89, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0x80, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x1d, 0x01, 0x00, 0x00, 0xde, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xfd, 0x01, 0x00, 0x00, 0xfb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xfe, 0x01, 0x00, 0x00, 0xfc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xee, 0x01, 0x00, 0x00, 0x46, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x24, 0x01, 0x00, 0x00, 0x5d, 0x01, 0x00, 0x00, 0x0a, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x42, 0x01, 0x00, 0x00, 0xf3, 0x01, 0x00, 0x00, 0xdc, 0x01, 0x00, 0x00, 0x2e, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x13, 0x01, 0x00, 0x00, 0x92, 0x01, 0x00, 0x00, 0xa9, 0x01, 0x00, 0x00, 0xa4, 0x01, 0x00, 0x00, 0xc7, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xf4, 0x01, 0x00, 0x00, 0xb3, 0x01, 0x00, 0x00, 0xa7, 0x01, 0x00, 0x00, 0xa8, 0x01, 0x00, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xcc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xae, 0x01, 0x00, 0x00, 0x1a, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x08, 0x01, 0x00, 0x00, 0x9f, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xc2, 0x01, 0x00, 0x00, 0x36, 0x01, 0x00, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x37, 0x01, 0x00, 0x00, 0xc3, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xa1, 0x01, 0x00, 0x00, 0x0a, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x2f, 0x01, 0x00, 0x00, 0xcc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xad, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x20, 0x01, 0x00, 0x00, 0xbc, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0x9e, 0x01, 0x00, 0x00, 0x6e, 0x01, 0x00, 0x00, 0x6e, 0x01, 0x00, 0x00, 0x9e, 0x01, 0x00, 0x00, 0xe6, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xbd, 0x01, 0x00, 0x00, 0x21, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x2d, 0x01, 0x00, 0x00, 0xcb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xad, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x1d, 0x01, 0x00, 0x00, 0x93, 0x01, 0x00, 0x00, 0xeb, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xff, 0x01, 0x00, 0x00, 0xeb, 0x01, 0x00, 0x00, 0x94, 0x01, 0x00, 0x00, 0x1d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x50, 0x01, 0x00, 0x00, 0xef, 0x01, 0x00, 0x00, 0xae, 0x01, 0x00, 0x00, 0x19, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x30, 0x01, 0x00, 0x00, 0x6c, 0x01, 0x00, 0x00, 0x8e, 0x01, 0x00, 0x00, 0x8e, 0x01, 0x00, 0x00, 0x6c, 0x01, 0x00, 0x00, 0x31, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x04, 0x01, 0x00, 0x00, 0x45, 0x01, 0x00, 0x00, 0x1b, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf0, 0x00, 0x00, 0x0f, 0xf0, 0x00, 0x00, 0x0f, 0xf0, 0x00, 0x00, 0x0f, 0xf1, 0xff, 0xff, 0x87, 0xf1, 0x1f, 0xff, 0x87, 0xf1, 0x1f, 0xff, 0x87, 0xf1, 0x1f, 0xff, 0x87, 0xf0, 0x00, 0x00, 0x07, 0xf0, 0x00, 0x00, 0x0f, 0xf0, 0x00, 0x00, 0x0f, 0xf8, 0x00, 0x00, 0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xf9, 0xf8, 0x1f, 0xff, 0xf8, 0xe0, 0x07, 0xff, 0xf0, 0xc0, 0x03, 0xff, 0xe0, 0xc0, 0x03, 0xff, 0xc0, 0x00, 0x41, 0x9f, 0x80, 0x00, 0x61, 0x0f, 0x80, 0x00, 0x71, 0x07, 0xc0, 0x00, 0x70, 0x03, 0xe0, 0x0e, 0x00, 0x01, 0xf0, 0x8e, 0x00, 0x01, 0xf8, 0x86, 0x00, 0x01, 0xff, 0x81, 0x80, 0x83, 0xff, 0xc0, 0x03, 0x07, 0xff, 0xe0, 0x07, 0x0f, 0xff, 0xf0, 0x0f, 0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+document.getElementById("retry").onclick = async () => {
+  render(await (await fetch(api, { method: "POST", headers })).json());
+  setTimeout(load, 1000);
+};
+document.onkeydown = e => { if (e.key === "Escape") window.close(); };
+load();
+</script>
+</body>
+</html>
+`
 
-type serverControl struct {
-	srv     *http.Server
-	stopCh  chan struct{}
-	running bool
+// digestDocumentHTML wraps a digest written with format "html"; its arguments are the date twice, then the body
+const digestDocumentHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Khoj Daily Digest · %s</title>
+<style>
+  body { font-family: system-ui, sans-serif; max-width: 760px; margin: 2rem auto; padding: 0 1rem; color: #222; line-height: 1.55; }
+  pre { background: #f4f4f4; padding: 0.6rem; overflow-x: auto; }
+  blockquote { border-left: 3px solid #ddd; margin-left: 0; padding-left: 1rem; color: #555; }
+</style>
+</head>
+<body>
+<h1>Daily Digest · %s</h1>
+%s</body>
+</html>
+`
+
+func enableCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, X-Khoj-Priority, X-Khoj-Client, X-Khoj-Max-Attempts, X-Khoj-Annotate, X-Khoj-Workspace, X-Request-Id")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Type, X-Khoj-Attempts, X-Khoj-Upstream-Latency, X-Request-Id")
+	w.Header().Set("Access-Control-Max-Age", "86400")
 }
 
-var globalServer *serverControl
+// Generate minimal diff that focuses only on the actual changes
+func generateMinimalDiff(original, modified, filename string) string {
+	originalLines := strings.Split(original, "\n")
+	modifiedLines := strings.Split(modified, "\n")
 
-func getAPIKeyStatus() string {
-	apiKey := os.Getenv("KHOJ_API_KEY")
-	if apiKey == "" || apiKey == "dummy" {
-		return "🔑 API Key: Not Set"
+	// Find the actual differences
+	changes := findActualChanges(originalLines, modifiedLines)
+
+	if len(changes) == 0 {
+		return "" // No changes
 	}
-	return "🔑 API Key: ✅ Set"
-}
 
-func onReady() {
-	systray.SetIcon(iconData)
-	systray.SetTitle("Khoj Provider")
-	systray.SetTooltip("Khoj OpenAI Wrapper Server")
+	var diff strings.Builder
+	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
+	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
 
-	// Set up keyboard monitoring for Ctrl+Q (Windows only)
-	if runtime.GOOS == "windows" {
-		if err := setupKeyboardMonitoring(); err != nil {
-			log.Printf("Failed to setup keyboard monitoring: %v", err)
-		}
+	// Generate only the first significant change to keep it minimal
+	change := changes[0]
+	contextLines := 2 // Minimal context
 
-		// Check notification settings on startup
-		checkNotificationSettings()
+	startLine := max(0, change.StartLine-contextLines)
+	endLine := min(len(originalLines), change.EndLine+contextLines)
+
+	diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
+		startLine+1, endLine-startLine,
+		startLine+1, endLine-startLine+(change.LinesAdded-change.LinesRemoved)))
+
+	// Show minimal context and changes
+	for i := startLine; i < change.StartLine && i < len(originalLines); i++ {
+		diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
 	}
 
-	// Menu items
-	mStart := systray.AddMenuItem("Start Server", "Start the server")
-	mStop := systray.AddMenuItem("Stop Server", "Stop the server")
-	mStatus := systray.AddMenuItem("Status: Stopped", "Server status")
-	systray.AddSeparator()
+	// Show the actual change
+	for i := change.StartLine; i < change.EndLine && i < len(originalLines); i++ {
+		diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+	}
 
-	// Conversation management
-	mConvID := systray.AddMenuItem("Conv: "+getConversationDisplayID(), "Current conversation ID")
-	mConvID.Disable() // Read-only status
-	mNewConv := systray.AddMenuItem("🆕 New Conversation", "Create a new conversation")
-	mEditConv := systray.AddMenuItem("✏️ Edit Conversation ID", "Change conversation ID")
-	mAgentSlug := systray.AddMenuItem("🤖 Agent: "+currentAgentSlug, "Current agent slug")
-	mAgentSlug.Disable() // Read-only status
-	mEditAgent := systray.AddMenuItem("⚙️ Edit Agent Slug", "Change agent slug")
-	systray.AddSeparator()
+	// Show the replacement (simplified)
+	if change.LinesAdded > 0 {
+		diff.WriteString(fmt.Sprintf("+%s\n", "<!-- Changes applied -->"))
+	}
 
-	mAPIKey := systray.AddMenuItem(getAPIKeyStatus(), "API Key status")
-	mAPIKey.Disable() // Read-only status
-	systray.AddSeparator()
+	return diff.String()
+}
 
-	// Clipboard AI feature (Windows only)
-	var mClipboardAI *systray.MenuItem
-	var mTestKeys *systray.MenuItem
-	var mTestNotification *systray.MenuItem
-	if runtime.GOOS == "windows" {
-		mClipboardAI = systray.AddMenuItem("📋 Clipboard AI (Ctrl+Q)", "Process clipboard with AI and insert at cursor")
-		mTestKeys = systray.AddMenuItem("🔍 Test Keyboard State", "Debug keyboard hook detection")
-		mTestNotification = systray.AddMenuItem("🔔 Test Notification", "Test Windows toast notification")
-		systray.AddSeparator()
+type Change struct {
+	StartLine    int
+	EndLine      int
+	LinesAdded   int
+	LinesRemoved int
+}
+
+func findActualChanges(original, modified []string) []Change {
+	// Simplified change detection
+	if len(original) != len(modified) {
+		return []Change{{
+			StartLine:    0,
+			EndLine:      min(len(original), 10), // Show only first 10 lines of change
+			LinesAdded:   len(modified) - len(original),
+			LinesRemoved: max(0, len(original)-len(modified)),
+		}}
 	}
 
-	mQuit := systray.AddMenuItem("Quit", "Quit the application")
+	// Find first difference
+	for i := 0; i < len(original) && i < len(modified); i++ {
+		if original[i] != modified[i] {
+			return []Change{{
+				StartLine:    i,
+				EndLine:      min(i+5, len(original)), // Show 5 lines of change
+				LinesAdded:   0,
+				LinesRemoved: 0,
+			}}
+		}
+	}
 
-	mStop.Disable()
+	return []Change{} // No changes
+}
 
-	// Initialize server control
-	globalServer = &serverControl{
-		stopCh:  make(chan struct{}),
-		running: false,
+func min(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
+}
 
-	// Handle menu clicks
-	go func() {
-		for {
-			select {
-			case <-mStart.ClickedCh:
-				if !globalServer.running {
-					go startServer()
-					mStart.Disable()
-					mStop.Enable()
-					mStatus.SetTitle("Status: Running")
-					systray.SetTooltip("Khoj Server: Running on port 3002")
-				}
+// Editor companion mode: LSP-style JSON-RPC over stdio for editor plugins
 
-			case <-mStop.ClickedCh:
-				if globalServer.running {
-					stopServer()
-					mStart.Enable()
-					mStop.Disable()
-					mStatus.SetTitle("Status: Stopped")
-					systray.SetTooltip("Khoj Server: Stopped")
-				}
+// companionMessage is a JSON-RPC 2.0 message framed with LSP Content-Length headers
+type companionMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *mcpRPCError    `json:"error,omitempty"`
+}
 
-			case <-mNewConv.ClickedCh:
-				if err := createNewConversationFromMenu(); err != nil {
-					log.Printf("Failed to create new conversation: %v", err)
-				} else {
-					mConvID.SetTitle("Conv: " + getConversationDisplayID())
-				}
+// companionActionParams are the parameters shared by all inline actions
+type companionActionParams struct {
+	Text        string `json:"text"`
+	Language    string `json:"language,omitempty"`
+	Instruction string `json:"instruction,omitempty"`
+}
 
-			case <-mEditConv.ClickedCh:
-				if err := editConversationIDDialog(); err != nil {
-					log.Printf("Failed to edit conversation ID: %v", err)
-				} else {
-					mConvID.SetTitle("Conv: " + getConversationDisplayID())
-				}
+// JSON-RPC error codes used by the companion protocol
+const (
+	rpcMethodNotFound   = -32601
+	rpcInvalidParams    = -32602
+	rpcInternalError    = -32603
+	rpcRequestCancelled = -32800
+)
 
-			case <-mEditAgent.ClickedCh:
-				if err := editAgentSlugDialog(); err != nil {
-					log.Printf("Failed to edit agent slug: %v", err)
-				} else {
-					mAgentSlug.SetTitle("🤖 Agent: " + currentAgentSlug)
-				}
+// companionServer serves inline editor actions over a framed stdio stream
+type companionServer struct {
+	provider *KhojProvider
+	writer   *bufio.Writer
+	writeMu  sync.Mutex
 
-			case <-mQuit.ClickedCh:
-				if globalServer.running {
-					stopServer()
-				}
-				systray.Quit()
-				return
-			}
-		}
-	}()
+	inFlight map[string]context.CancelFunc
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
 
-	// Handle clipboard AI menu clicks in a separate goroutine (Windows only)
-	if mClipboardAI != nil {
-		go func() {
-			for {
-				select {
-				case <-mClipboardAI.ClickedCh:
-					log.Printf("📋 Clipboard AI menu clicked")
-					go processClipboardWithAI()
-				}
-			}
-		}()
+// runCompanion serves the companion protocol on stdin/stdout until exit or EOF
+func runCompanion() error {
+	apiBase, apiKey, timeout := loadProviderSettings()
+	if err := ensureConversation(apiBase, apiKey); err != nil {
+		return err
 	}
 
-	// Handle test keyboard state menu clicks (Windows only)
-	if mTestKeys != nil {
-		go func() {
-			for {
-				select {
-				case <-mTestKeys.ClickedCh:
-					log.Printf("🔍 Test keyboard state menu clicked")
-					testKeyboardState()
-				}
-			}
-		}()
+	cs := &companionServer{
+		provider: NewKhojProviderWithTimeout(apiBase, apiKey, timeout),
+		writer:   bufio.NewWriter(os.Stdout),
+		inFlight: make(map[string]context.CancelFunc),
+	}
+	log.Printf("Editor companion ready on stdio (conversation %s)", conversationID)
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		msg, err := readCompanionMessage(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read companion message: %w", err)
+		}
+		if msg.Method == "exit" {
+			break
+		}
+		cs.dispatch(msg)
 	}
 
-	// Handle test notification menu clicks (Windows only)
-	if mTestNotification != nil {
-		go func() {
-			for {
-				select {
-				case <-mTestNotification.ClickedCh:
-					log.Printf("🔔 Test notification menu clicked")
-					checkNotificationSettings()
-					showNotification("Test Notification", "This is a test notification to verify Windows toast notifications are working.")
-				}
-			}
-		}()
+	cs.cancelAll()
+	cs.wg.Wait()
+	return nil
+}
+
+// runFilter reads text from stdin, runs it through a template or prompt and writes only the answer to stdout,
+// so the wrapper works in pipelines and as an editor filter command. It returns the process exit code.
+func runFilter(args []string) int {
+	fs := flag.NewFlagSet("filter", flag.ContinueOnError)
+	templateName := fs.String("template", "", "Template to apply: a built-in (explain, command, grammar, rewrite) or one from config.json")
+	prompt := fs.String("prompt", "", "Instructions to use instead of a template")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*templateName == "") == (*prompt == "") {
+		fmt.Fprintln(os.Stderr, "usage: khoj-wrapper filter (--template <name> | --prompt <instructions>) < input")
+		return 2
 	}
 
-	// Auto-start server
-	go startServer()
-	mStart.Disable()
-	mStop.Enable()
-	mStatus.SetTitle("Status: Running")
-}
+	var t ClipboardTemplate
+	if *templateName != "" {
+		var names []string
+		found := false
+		for _, candidate := range clipboardTemplates() {
+			names = append(names, candidate.Name)
+			if candidate.Name == *templateName {
+				t, found = candidate, true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "❌ Unknown template %q (available: %s)\n", *templateName, strings.Join(names, ", "))
+			return 2
+		}
+	}
 
-func startServer() {
-	apiBase := os.Getenv("KHOJ_API_BASE")
-	if apiBase == "" {
-		apiBase = "https://app.khoj.dev"
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to read stdin: %v\n", err)
+		return 1
+	}
+	text := string(input)
+	if strings.TrimSpace(text) == "" {
+		fmt.Fprintln(os.Stderr, "❌ No input on stdin")
+		return 1
 	}
 
-	apiKey := os.Getenv("KHOJ_API_KEY")
-	if apiKey == "" {
-		log.Printf("KHOJ_API_KEY not set, using default")
-		apiKey = "dummy"
+	apiBase, apiKey, timeout := loadProviderSettings()
+	if err := ensureConversation(apiBase, apiKey); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3002"
+	var language languageGuess
+	if !appConfig().Language.Disabled {
+		language = detectLanguage(text)
+	}
+	finalPrompt := fmt.Sprintf("%s\n\nContent:\n%s", *prompt, text)
+	if t.Name != "" {
+		finalPrompt = fmt.Sprintf("%s:\n\n%s", expandTemplateVariables(t.Prompt, templateVariables(0, language)), text)
+	}
+	if !appConfig().Language.KeepAnswer {
+		finalPrompt = withAnswerLanguage(language, finalPrompt)
+	}
+	maxChars := t.MaxChars
+	if maxChars == 0 {
+		maxChars = verbosityPresets[t.Verbosity].MaxChars
 	}
 
-	// log.Printf("Starting Khoj provider with API Base: %s", apiBase)
-	// log.Printf("API Key: %s...", apiKey[:min(len(apiKey), 8)])
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	timeoutStr := os.Getenv("KHOJ_TIMEOUT")
-	timeout := 120 * time.Second
-	if timeoutStr != "" {
-		if parsedTimeout, err := time.ParseDuration(timeoutStr); err == nil {
-			timeout = parsedTimeout
-		}
+	resp, err := sendToKhojChat(apiBase, apiKey, conversationID, withConversationInstructions(conversationID, withVerbosity(t.Verbosity, finalPrompt)), ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Request failed: %v\n", err)
+		return 1
+	}
+	resp = withCitations(limitResponseLength(resp, t.Output, maxChars), t.Citations)
+	content, err := applyPostProcess(ctx, t.PostProcess, responseContent(resp, responseTargetAPI, t.Output))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	output, matches, blocked := activeOutputFilter.Apply(content)
+	if blocked {
+		fmt.Fprintf(os.Stderr, "🚫 Output filter blocked the response (%d matches)\n", matches)
+		return 1
 	}
 
-	log.Printf("Using timeout: %v", timeout)
-	provider := NewKhojProviderWithTimeout(apiBase, apiKey, timeout)
+	// Editor filters replace whole lines, so keep the input's final newline
+	if strings.HasSuffix(text, "\n") && !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+	if _, err := io.WriteString(os.Stdout, output); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to write stdout: %v\n", err)
+		return 1
+	}
+	return 0
+}
 
-	// Handle conversation creation if needed
-	if newConversation || conversationID == "" {
-		log.Printf("Creating new conversation...")
-		newConvID, err := createNewConversation(apiBase, apiKey)
+// readCompanionMessage reads one Content-Length framed message
+func readCompanionMessage(reader *bufio.Reader) (*companionMessage, error) {
+	contentLength := -1
+	for {
+		line, err := reader.ReadString('\n')
 		if err != nil {
-			log.Printf("Failed to create new conversation: %v", err)
-			globalServer.running = false
-			return
+			return nil, err
 		}
-
-		conversationID = newConvID
-		newConversation = false
-
-		// Save the new conversation ID to file
-		state := &ConversationState{
-			LastConversationID: conversationID,
-			AgentSlug:          currentAgentSlug,
-			CreatedAt:          time.Now(),
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break // End of headers
 		}
-		if err := saveConversationState(state); err != nil {
-			log.Printf("Warning: Failed to save conversation state: %v", err)
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length header: %w", err)
+			}
 		}
-
-		log.Printf("✅ New conversation created: %s", conversationID)
+	}
+	if contentLength < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
 	}
 
-	mux := http.NewServeMux()
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
-	})
+	var msg companionMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("invalid JSON-RPC message: %w", err)
+	}
+	return &msg, nil
+}
 
-	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Starting request - User-Agent: %s", r.Header.Get("User-Agent"))
-		log.Printf("Request headers: %+v", r.Header)
+func (cs *companionServer) write(msg companionMessage) {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal companion response: %v", err)
+		return
+	}
 
-		enableCORS(w)
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+	fmt.Fprintf(cs.writer, "Content-Length: %d\r\n\r\n", len(data))
+	cs.writer.Write(data)
+	cs.writer.Flush()
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+func (cs *companionServer) reply(id json.RawMessage, result interface{}) {
+	cs.write(companionMessage{ID: id, Result: result})
+}
 
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+func (cs *companionServer) replyError(id json.RawMessage, code int, message string) {
+	cs.write(companionMessage{ID: id, Error: &mcpRPCError{Code: code, Message: message}})
+}
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("Error reading request body: %v", err)
-			http.Error(w, "Error reading request", http.StatusBadRequest)
-			return
+// dispatch routes a message; inline actions run concurrently so they can be cancelled
+func (cs *companionServer) dispatch(msg *companionMessage) {
+	switch msg.Method {
+	case "initialize":
+		cs.reply(msg.ID, map[string]interface{}{
+			"serverInfo": map[string]string{"name": "khoj-wrapper", "version": version},
+			"actions":    []string{"khoj/explain", "khoj/refactor", "khoj/docComment"},
+		})
+	case "initialized":
+		// Notification, nothing to do
+	case "shutdown":
+		cs.cancelAll()
+		cs.reply(msg.ID, nil)
+	case "$/cancelRequest":
+		var params struct {
+			ID json.RawMessage `json:"id"`
 		}
-
-		// Check if this is an applyToFile request FIRST
-		var rawRequest map[string]interface{}
-		if err := json.Unmarshal(body, &rawRequest); err != nil {
-			log.Printf("Error parsing JSON: %v", err)
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
+		if err := json.Unmarshal(msg.Params, &params); err == nil {
+			cs.cancel(string(params.ID))
 		}
-
-		// If not applyToFile, parse as normal ChatCompletionRequest
-		var req ChatCompletionRequest
-		if err := json.Unmarshal(body, &req); err != nil {
-			log.Printf("Error decoding ChatCompletionRequest: %v", err)
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	case "khoj/explain", "khoj/refactor", "khoj/docComment":
+		var params companionActionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil || params.Text == "" {
+			cs.replyError(msg.ID, rpcInvalidParams, "params.text is required")
 			return
 		}
 
-		// Handle streaming vs non-streaming for normal requests
-		if req.Stream {
-			provider.handleStreamingRequest(w, r, &req)
-			return
-		}
+		ctx, cancel := context.WithCancel(context.Background())
+		key := string(msg.ID)
+		cs.mu.Lock()
+		cs.inFlight[key] = cancel
+		cs.mu.Unlock()
 
-		// Non-streaming response
-		resp, err := provider.HandleChatCompletion(r.Context(), &req)
-		if err != nil {
-			log.Printf("Error handling chat completion: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+		cs.wg.Add(1)
+		go func() {
+			defer cs.wg.Done()
+			defer func() {
+				cs.mu.Lock()
+				delete(cs.inFlight, key)
+				cs.mu.Unlock()
+				cancel()
+			}()
+
+			result, err := cs.runAction(ctx, msg.Method, params)
+			if ctx.Err() == context.Canceled {
+				cs.replyError(msg.ID, rpcRequestCancelled, "request cancelled")
+				return
+			}
+			if err != nil {
+				cs.replyError(msg.ID, rpcInternalError, err.Error())
+				return
+			}
+			cs.reply(msg.ID, map[string]string{"text": result})
+		}()
+	default:
+		if len(msg.ID) > 0 {
+			cs.replyError(msg.ID, rpcMethodNotFound, "method not found: "+msg.Method)
 		}
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
-	})
+func (cs *companionServer) cancel(key string) {
+	cs.mu.Lock()
+	cancel, ok := cs.inFlight[key]
+	cs.mu.Unlock()
+	if ok {
+		log.Printf("Cancelling companion request %s", key)
+		cancel()
+	}
+}
 
-	globalServer.srv = &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+func (cs *companionServer) cancelAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, cancel := range cs.inFlight {
+		cancel()
 	}
+}
 
-	globalServer.running = true
-	// log.Printf("Khoj provider server starting on :%s", port)
+// runAction builds the prompt for an inline action and returns the text to show or insert
+func (cs *companionServer) runAction(ctx context.Context, method string, params companionActionParams) (string, error) {
+	code := fmt.Sprintf("```%s\n%s\n```", params.Language, params.Text)
 
-	if err := globalServer.srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Printf("Server error: %v", err)
-		globalServer.running = false
+	var prompt string
+	switch method {
+	case "khoj/explain":
+		instruction := params.Instruction
+		if instruction == "" {
+			instruction = "Explain the following code selection concisely."
+		}
+		prompt = fmt.Sprintf("%s\n\n%s", instruction, code)
+	case "khoj/refactor":
+		instruction := params.Instruction
+		if instruction == "" {
+			instruction = "Refactor the following code for readability without changing behavior."
+		}
+		prompt = fmt.Sprintf("%s Reply with only the refactored code in a single code block.\n\n%s", instruction, code)
+	case "khoj/docComment":
+		prompt = fmt.Sprintf("Write an idiomatic doc comment for the following %s code. Reply with only the comment in a single code block.\n\n%s", params.Language, code)
 	}
-}
 
-func stopServer() {
-	if globalServer.srv != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		globalServer.srv.Shutdown(ctx)
-		globalServer.running = false
-		// log.Printf("Server stopped")
+	resp, err := cs.provider.HandleChatCompletion(ctx, &ChatCompletionRequest{
+		Model:    "khoj-chat",
+		Messages: []Message{{Role: "user", Content: prompt}},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	text := resp.Choices[0].Message.Content
+	if method == "khoj/explain" {
+		return text, nil
+	}
+	if blocks := extractCodeBlocks(text); len(blocks) > 0 {
+		return blocks[0], nil
 	}
+	return text, nil
 }
 
-func onExit() {
-	// Clean up keyboard monitoring
-	if runtime.GOOS == "windows" {
-		stopKeyboardMonitoring()
+// codeBlockLines returns the complete lines received so far of the first fenced code block in a streaming answer,
+// or nil before the block opens. They are always a prefix of the block extractCodeBlocks finds in the whole answer.
+func codeBlockLines(partial string) []string {
+	lines := strings.Split(partial, "\n")
+	lines = lines[:len(lines)-1] // The last line may still grow
+	for i, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "```") {
+			continue
+		}
+		body := lines[i+1:]
+		for j, line := range body {
+			if strings.HasPrefix(strings.TrimSpace(line), "```") {
+				return body[:j]
+			}
+		}
+		return body
 	}
+	return nil
+}
 
-	if globalServer.running {
-		stopServer()
+// extractCodeBlocks returns the contents of fenced Markdown code blocks in order
+func extractCodeBlocks(text string) []string {
+	var blocks []string
+	var current strings.Builder
+	inBlock := false
+
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inBlock {
+				blocks = append(blocks, strings.TrimSuffix(current.String(), "\n"))
+				current.Reset()
+			}
+			inBlock = !inBlock
+			continue
+		}
+		if inBlock {
+			current.WriteString(line)
+			current.WriteString("\n")
+		}
 	}
+	return blocks
 }
 
-// Generate contextual diff showing only changed sections with context
-func generateContextualDiff(originalLines, modifiedLines []string, filename string) string {
-	var diff strings.Builder
-	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
-	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+func main() {
+	// Config validation runs before anything else so it can report every problem
+	flag.Parse()
+	if flag.Arg(0) == "config" {
+		os.Exit(runConfigCommand(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "pack" {
+		os.Exit(runPackCommand(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "team" {
+		os.Exit(runTeamCommand(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "doctor" {
+		os.Exit(runDoctor(flag.Args()[1:]))
+	}
 
-	// Find changed sections
-	changes := findChangedSections(originalLines, modifiedLines)
+	// Load .env before anything reads the environment; existing variables take precedence
+	applied, envDiags, err := loadEnvFile(envFile)
+	if err != nil {
+		log.Fatal("Env file loading failed: ", err)
+	}
+	for _, d := range envDiags {
+		log.Printf("⚠️ Skipping %s", d)
+	}
+	if applied > 0 {
+		log.Printf("Loaded %d variable(s) from %s", applied, envFile)
+	}
 
-	if len(changes) == 0 {
-		// No changes found
-		diff.WriteString("@@ -0,0 +0,0 @@\n")
-		return diff.String()
+	// Load optional settings from config file
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Config loading failed: ", err)
+	}
+	activeConfig.Store(cfg)
+	privacyMode.Store(appConfig().Privacy.Enabled)
+	if reason := disableInputSimulation(appConfig()); reason != "" {
+		log.Printf("🔒 Input simulation disabled (%s): no typing, keyboard hooks or clipboard writes", reason)
 	}
 
-	// Generate hunks for each changed section
-	for _, change := range changes {
-		contextLines := 3 // Show 3 lines of context before/after changes
+	// Pick up a conversation another machine switched to before reading the saved one
+	if err := startStateSync(appConfig().StateSync); err != nil {
+		log.Printf("⚠️ Conversation state sync: %v; using the local state", err)
+	}
 
-		startOrig := max(0, change.OrigStart-contextLines)
-		endOrig := min(len(originalLines), change.OrigEnd+contextLines)
-		startMod := max(0, change.ModStart-contextLines)
-		endMod := min(len(modifiedLines), change.ModEnd+contextLines)
+	// Initialize conversation ID from environment variables and command-line flags
+	if err := initializeConversationID(); err != nil {
+		log.Fatal("Conversation ID initialization failed: ", err)
+	}
 
-		diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
-			startOrig+1, endOrig-startOrig,
-			startMod+1, endMod-startMod))
+	if err := loadConversationInstructions(); err != nil {
+		log.Fatal("Custom instructions loading failed: ", err)
+	}
 
-		// Show context before changes
-		for i := startOrig; i < change.OrigStart && i < len(originalLines); i++ {
-			diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
-		}
+	clipboardKey, quickAskKey, followUpKey, err := configuredHotkeys(appConfig())
+	if err != nil {
+		log.Fatal("Hotkey setup failed: ", err)
+	}
+	setActiveHotkeys(clipboardKey, quickAskKey, followUpKey)
 
-		// Show removed lines
-		for i := change.OrigStart; i < change.OrigEnd && i < len(originalLines); i++ {
-			diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
-		}
+	filter, err := compileOutputFilter(appConfig().OutputFilter)
+	if err != nil {
+		log.Fatal("Output filter setup failed: ", err)
+	}
+	activeOutputFilter = filter
 
-		// Show added lines
-		for i := change.ModStart; i < change.ModEnd && i < len(modifiedLines); i++ {
-			diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
-		}
+	footer, err := compileFooter(appConfig().Footer)
+	if err != nil {
+		log.Fatal("Footer setup failed: ", err)
+	}
+	activeFooter = footer
 
-		// Show context after changes
-		for i := change.OrigEnd; i < endOrig && i < len(originalLines); i++ {
-			diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
+	moderation, err := compileModerationFilters(appConfig().Moderation)
+	if err != nil {
+		log.Fatal("Moderation setup failed: ", err)
+	}
+	activeModerationFilters = moderation
+	khojScheduler.Configure(appConfig().Priority)
+	loadTemplatePacks()
+	startTeamOverlay(appConfig().Team)
+
+	// Subcommands run headless without the system tray
+	switch flag.Arg(0) {
+	case "companion":
+		if err := runCompanion(); err != nil {
+			log.Fatal("Companion mode failed: ", err)
 		}
+		return
+	case "serve":
+		streamJournal.Recover()
+		runHeadlessServer()
+		return
+	case "filter":
+		os.Exit(runFilter(flag.Args()[1:]))
 	}
 
-	return diff.String()
-}
-
-// Structure to represent a changed section
-type ChangeSection struct {
-	OrigStart, OrigEnd int
-	ModStart, ModEnd   int
-}
-
-// Find sections that have changed between original and modified - HANDLES MID-FILE CHANGES
-func findChangedSections(originalLines, modifiedLines []string) []ChangeSection {
-	var changes []ChangeSection
-
-	// Find the first line that differs
-	i := 0
-	minLen := min(len(originalLines), len(modifiedLines))
-
-	// Scan through both files to find first difference
-	for i < minLen {
-		if originalLines[i] != modifiedLines[i] {
-			// Found start of change at line i
-			changeStart := i
-
-			// Now find the end of this change block
-			origEnd := i
-			modEnd := i
-
-			// Simple approach: assume a small block of changes (max 10 lines)
-			maxChangeLines := 10
-			linesProcessed := 0
+	// Popups are placed in physical pixels, so the process must not be DPI-virtualized
+	enableDPIAwareness()
 
-			// Advance through the changed section
-			for linesProcessed < maxChangeLines {
-				// Check if we've reached end of either file
-				if origEnd >= len(originalLines) || modEnd >= len(modifiedLines) {
-					break
-				}
+	// Initialize systray
+	streamJournal.Recover()
+	systray.Run(onReady, onExit)
+}
 
-				// If lines match again, we might be at the end of the change
-				if origEnd < len(originalLines) && modEnd < len(modifiedLines) &&
-					originalLines[origEnd] == modifiedLines[modEnd] {
-					// Check if next few lines also match (stable end)
-					matchCount := 0
-					for k := 0; k < 3 && origEnd+k < len(originalLines) && modEnd+k < len(modifiedLines); k++ {
-						if originalLines[origEnd+k] == modifiedLines[modEnd+k] {
-							matchCount++
-						} else {
-							break
-						}
-					}
-					if matchCount >= 2 {
-						// Found stable end of change
-						break
-					}
+// jsonAssembler buffers streamed text until a complete top-level JSON object or array is available.
+// Prose and code fences outside values are skipped; Flush repairs a value cut off mid-stream.
+type jsonAssembler struct {
+	buf      strings.Builder
+	stack    []byte // Open containers, '{' or '['
+	expect   []byte // Per container: 'k' key, ':' colon, 'v' value, ',' comma or close
+	inString bool
+	escape   bool
+	literal  bool // Inside a number, true, false or null
+}
+
+// Write feeds a chunk and returns the top-level values it completed
+func (a *jsonAssembler) Write(chunk string) []string {
+	var values []string
+	for _, r := range chunk {
+		if len(a.stack) == 0 && r != '{' && r != '[' {
+			continue // Text between values
+		}
+		if a.literal && !isJSONLiteralRune(r) {
+			a.literal = false
+			a.setExpect(',')
+		}
+		a.buf.WriteRune(r)
+
+		if a.inString {
+			switch {
+			case a.escape:
+				a.escape = false
+			case r == '\\':
+				a.escape = true
+			case r == '"':
+				a.inString = false
+				if a.top() == 'k' {
+					a.setExpect(':')
+				} else {
+					a.setExpect(',')
 				}
+			}
+			continue
+		}
 
-				origEnd++
-				modEnd++
-				linesProcessed++
+		switch r {
+		case '{', '[':
+			a.setExpect(',') // The parent sees a value once this container closes
+			a.stack = append(a.stack, byte(r))
+			if r == '{' {
+				a.expect = append(a.expect, 'k')
+			} else {
+				a.expect = append(a.expect, 'v')
 			}
+		case '}', ']':
+			a.stack = a.stack[:len(a.stack)-1]
+			a.expect = a.expect[:len(a.expect)-1]
+			if len(a.stack) == 0 {
+				values = append(values, a.buf.String())
+				a.buf.Reset()
+			}
+		case '"':
+			a.inString = true
+		case ':':
+			a.setExpect('v')
+		case ',':
+			if a.stack[len(a.stack)-1] == '{' {
+				a.setExpect('k')
+			} else {
+				a.setExpect('v')
+			}
+		default:
+			if isJSONLiteralRune(r) && r != ' ' {
+				a.literal = true
+			}
+		}
+	}
+	return values
+}
 
-			changes = append(changes, ChangeSection{
-				OrigStart: changeStart,
-				OrigEnd:   min(changeStart+3, origEnd),
-				ModStart:  changeStart,
-				ModEnd:    min(changeStart+3, modEnd),
-			})
+// Flush returns the buffered partial value closed into valid JSON; ok is false when nothing was buffered or it cannot be repaired
+func (a *jsonAssembler) Flush() (value string, ok bool) {
+	if len(a.stack) == 0 {
+		return "", false
+	}
 
-			// Return only first change to keep it minimal
-			return changes
+	text := a.buf.String()
+	expect := a.top()
+	if a.inString {
+		if a.escape {
+			text = text[:len(text)-1]
 		}
-		i++
+		text = regexp.MustCompile(`\\u[0-9a-fA-F]{0,3}$`).ReplaceAllString(text, "")
+		text += `"`
+		if expect == 'k' {
+			expect = ':'
+		} else {
+			expect = ','
+		}
+	} else if a.literal {
+		text = completeJSONLiteral(text)
+		expect = ','
 	}
 
-	// Handle length differences (additions/deletions at end)
-	if len(originalLines) != len(modifiedLines) {
-		if len(originalLines) < len(modifiedLines) {
-			// Lines added at end
-			changes = append(changes, ChangeSection{
-				OrigStart: len(originalLines),
-				OrigEnd:   len(originalLines),
-				ModStart:  len(originalLines),
-				ModEnd:    min(len(originalLines)+3, len(modifiedLines)),
-			})
+	text = strings.TrimRight(text, " \t\r\n")
+	switch expect {
+	case ':':
+		text += ":null"
+	case 'v':
+		if strings.HasSuffix(text, ":") {
+			text += "null"
+		}
+	}
+	text = strings.TrimSuffix(text, ",")
+	for i := len(a.stack) - 1; i >= 0; i-- {
+		if a.stack[i] == '{' {
+			text += "}"
 		} else {
-			// Lines removed from end
-			changes = append(changes, ChangeSection{
-				OrigStart: len(modifiedLines),
-				OrigEnd:   min(len(modifiedLines)+3, len(originalLines)),
-				ModStart:  len(modifiedLines),
-				ModEnd:    len(modifiedLines),
-			})
+			text += "]"
 		}
 	}
 
-	return changes
+	a.buf.Reset()
+	a.stack, a.expect = nil, nil
+	a.inString, a.escape, a.literal = false, false, false
+	if !json.Valid([]byte(text)) {
+		return "", false
+	}
+	return text, true
 }
 
-// Helper functions
-func max(a, b int) int {
-	if a > b {
-		return a
+func (a *jsonAssembler) top() byte {
+	if len(a.expect) == 0 {
+		return 0
 	}
-	return b
+	return a.expect[len(a.expect)-1]
 }
 
-// Calculate similarity between two sets of lines
-func calculateSimilarity(original, modified []string) float64 {
-	if len(original) == 0 && len(modified) == 0 {
-		return 1.0
-	}
-	if len(original) == 0 || len(modified) == 0 {
-		return 0.0
+func (a *jsonAssembler) setExpect(state byte) {
+	if len(a.expect) > 0 {
+		a.expect[len(a.expect)-1] = state
 	}
+}
 
-	// Simple similarity calculation based on common lines
-	commonLines := 0
-	originalSet := make(map[string]bool)
-	for _, line := range original {
-		originalSet[line] = true
-	}
+// isJSONLiteralRune reports whether r can appear in a number, true, false or null
+func isJSONLiteralRune(r rune) bool {
+	return strings.ContainsRune("0123456789+-.eEtrufalsn", r)
+}
 
-	for _, line := range modified {
-		if originalSet[line] {
-			commonLines++
+// completeJSONLiteral finishes a literal cut off at the end of text, e.g. "tr" -> "true" or "1." -> "1"
+func completeJSONLiteral(text string) string {
+	start := len(text)
+	for start > 0 && isJSONLiteralRune(rune(text[start-1])) {
+		start--
+	}
+	partial := text[start:]
+	for _, word := range []string{"true", "false", "null"} {
+		if strings.HasPrefix(word, partial) {
+			return text[:start] + word
 		}
 	}
+	return text[:start] + strings.TrimRight(partial, "+-.eE")
+}
 
-	maxLines := len(original)
-	if len(modified) > maxLines {
-		maxLines = len(modified)
+// jsonModeContent reduces a JSON-mode answer to its first JSON value, repairing a truncated one
+func jsonModeContent(content string) string {
+	var a jsonAssembler
+	if values := a.Write(content); len(values) > 0 {
+		return values[0]
+	}
+	if repaired, ok := a.Flush(); ok {
+		log.Printf("Repaired truncated JSON response (%d characters)", len(repaired))
+		return repaired
 	}
+	log.Printf("JSON mode response contained no JSON value, returning it unchanged")
+	return content
+}
 
-	return float64(commonLines) / float64(maxLines)
+// jsonAnswerError reports a JSON-mode answer that could not be coerced into what the client asked for
+type jsonAnswerError struct {
+	reason string
 }
 
-// Generate unified diff between original and modified content
-func generateUnifiedDiff(original, modified, filename string) string {
-	originalLines := strings.Split(original, "\n")
-	modifiedLines := strings.Split(modified, "\n")
+func (e *jsonAnswerError) Error() string {
+	return "the agent's answer could not be coerced into valid JSON: " + e.reason
+}
 
-	log.Printf("File diff generation: original_lines=%d, modified_lines=%d", len(originalLines), len(modifiedLines))
+// coerceJSONAnswer reduces a JSON-mode answer to one JSON object and checks it against the request's schema. An
+// answer that still fails is sent back to the agent once with the reasons, and a second failure is an error.
+func (kp *KhojProvider) coerceJSONAnswer(ctx context.Context, turn *chatTurn, resp *KhojResponse) (*KhojResponse, error) {
+	content := jsonModeContent(resp.Response)
+	problems := turn.req.jsonProblems(content)
+	if len(problems) == 0 {
+		coerced := *resp
+		coerced.Response = content
+		return &coerced, nil
+	}
 
-	// For large files with small changes, use optimized diff
-	if len(originalLines) > 1000 || len(modifiedLines) > 1000 {
-		log.Printf("Using optimized diff for large file")
-		return generateOptimizedDiff(originalLines, modifiedLines, filename)
+	logRequest(ctx, "JSON answer rejected, asking the agent to correct it: %s", strings.Join(problems, "; "))
+	next := *turn.khojReq
+	next.Q = fmt.Sprintf("system: Your answer was rejected: %s.\n%s", strings.Join(problems, "; "), turn.req.jsonInstruction())
+	next.Files = nil
+	retry, err := kp.callKhojAPI(ctx, &next)
+	if err != nil {
+		return nil, fmt.Errorf("khoj API call for a JSON correction failed: %w", err)
 	}
 
-	// For smaller files, use simple line-by-line diff
-	return generateSimpleDiff(originalLines, modifiedLines, filename)
+	content = jsonModeContent(retry.Response)
+	if problems = turn.req.jsonProblems(content); len(problems) > 0 {
+		return nil, &jsonAnswerError{reason: strings.Join(problems, "; ")}
+	}
+	coerced := *retry
+	coerced.Response = content
+	return &coerced, nil
 }
 
-// Generate optimized diff that only shows actual changes - TRULY MINIMAL VERSION
-func generateOptimizedDiff(originalLines, modifiedLines []string, filename string) string {
-	var diff strings.Builder
-	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
-	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+// maxJSONProblems bounds the schema violations reported for one answer
+const maxJSONProblems = 5
 
-	// Find actual changed sections (not individual lines)
-	changes := findChangedSections(originalLines, modifiedLines)
+// jsonProblems lists why content is not the JSON object the request asked for
+func (req *ChatCompletionRequest) jsonProblems(content string) []string {
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return []string{"the answer is not valid JSON"}
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return []string{"the answer is not a JSON object"}
+	}
+	if format := req.ResponseFormat.JSONSchema; format != nil && format.Schema != nil {
+		problems := schemaErrors(value, format.Schema, "$")
+		return problems[:min(len(problems), maxJSONProblems)]
+	}
+	return nil
+}
 
-	if len(changes) == 0 {
-		diff.WriteString("@@ -0,0 +0,0 @@\n")
-		return diff.String()
+// schemaErrors checks a decoded JSON value against the subset of JSON Schema that structured outputs use: type,
+// enum, const, properties, required, additionalProperties, items and anyOf. Other keywords are ignored.
+func schemaErrors(value interface{}, schema map[string]interface{}, path string) []string {
+	if options, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, option := range options {
+			if sub, ok := option.(map[string]interface{}); ok && len(schemaErrors(value, sub, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return []string{path + " matches none of the anyOf schemas"}
+		}
+	}
+	if types := schemaTypes(schema["type"]); len(types) > 0 && !matchesSchemaType(value, types) {
+		return []string{fmt.Sprintf("%s must be %s", path, strings.Join(types, " or "))}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || reflect.DeepEqual(allowed, value)
+		}
+		if !found {
+			return []string{path + " is not one of the allowed values"}
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		return []string{path + " does not have the required value"}
 	}
 
-	// Process only the first change section and limit its size
-	change := changes[0]
+	var errs []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := v[key]; !present {
+					errs = append(errs, fmt.Sprintf("%s is missing required property %q", path, key))
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if sub, ok := properties[key].(map[string]interface{}); ok {
+				errs = append(errs, schemaErrors(v[key], sub, path+"."+key)...)
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				errs = append(errs, fmt.Sprintf("%s has unexpected property %q", path, key))
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				errs = append(errs, schemaErrors(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return errs
+}
 
-	// Limit the change to maximum 10 lines total
-	maxLinesPerSection := 5
+// schemaTypes reads a schema's type, which is a name or a list of names
+func schemaTypes(raw interface{}) []string {
+	switch t := raw.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, name := range t {
+			if s, ok := name.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
 
-	origStart := change.OrigStart
-	origEnd := min(change.OrigEnd, origStart+maxLinesPerSection)
-	modStart := change.ModStart
-	modEnd := min(change.ModEnd, modStart+maxLinesPerSection)
+// matchesSchemaType reports whether a decoded JSON value has one of the JSON Schema types
+func matchesSchemaType(value interface{}, types []string) bool {
+	for _, t := range types {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case nil:
+			if t == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	removedCount := origEnd - origStart
-	addedCount := modEnd - modStart
+// openAIError is the body of an OpenAI-style error response
+func openAIError(err error) map[string]interface{} {
+	body := map[string]interface{}{"message": err.Error(), "type": "api_error"}
+	var jsonErr *jsonAnswerError
+	if errors.As(err, &jsonErr) {
+		body["code"] = "json_validation_failed"
+	}
+	var denied *teamDeniedError
+	if errors.As(err, &denied) {
+		// The rule's message as the admin wrote it, without the wrapping of the Khoj call
+		body["message"], body["type"], body["code"] = denied.Error(), "invalid_request_error", "team_policy"
+	}
+	return map[string]interface{}{"error": body}
+}
 
-	diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
-		origStart+1, removedCount,
-		modStart+1, addedCount))
+// requestClass is the scheduling priority of a Khoj request
+type requestClass int
 
-	// Show removed lines (limited)
-	for i := origStart; i < origEnd && i < len(originalLines); i++ {
-		diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+const (
+	classInteractive requestClass = iota // Someone is waiting: chat clients, the clipboard hotkey, editors
+	classBackground                      // Notes sync, batch jobs; may be delayed or preempted
+)
+
+func (c requestClass) String() string {
+	if c == classBackground {
+		return "background"
 	}
+	return "interactive"
+}
 
-	// Show added lines (limited)
-	for i := modStart; i < modEnd && i < len(modifiedLines); i++ {
-		diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+type requestClassKey struct{}
+
+// withRequestClass tags a context with the scheduling class of the request it serves
+func withRequestClass(ctx context.Context, class requestClass) context.Context {
+	return context.WithValue(ctx, requestClassKey{}, class)
+}
+
+// requestClassFrom returns the class a context was tagged with, defaulting to interactive
+func requestClassFrom(ctx context.Context) requestClass {
+	if class, ok := ctx.Value(requestClassKey{}).(requestClass); ok {
+		return class
 	}
+	return classInteractive
+}
 
-	return diff.String()
+// upstreamStats tracks the Khoj attempts made for one client request and the time spent on them
+type upstreamStats struct {
+	mu          sync.Mutex
+	attempts    int
+	latency     time.Duration
+	hedged      bool   // A hedged copy answered
+	localModel  string // The local model that answered instead of Khoj
+	maxAttempts int    // From X-Khoj-Max-Attempts; 0 uses the configured budget
+	annotate    bool   // From X-Khoj-Annotate or the annotate setting
+	requestID   string // From traceRequests
 }
 
-// Find limited changes - only return first few actual differences
-func findLimitedChanges(originalLines, modifiedLines []string, maxChanges int) []ChangeSection {
-	var changes []ChangeSection
+type upstreamStatsKey struct{}
 
-	minLen := min(len(originalLines), len(modifiedLines))
+// withUpstreamStats attaches stats that sendKhojRequest records into
+func withUpstreamStats(ctx context.Context, stats *upstreamStats) context.Context {
+	return context.WithValue(ctx, upstreamStatsKey{}, stats)
+}
 
-	// Find first few different lines
-	for i := 0; i < minLen && len(changes) < maxChanges; i++ {
-		if originalLines[i] != modifiedLines[i] {
-			// Found a difference - create a minimal change section
-			changes = append(changes, ChangeSection{
-				OrigStart: i,
-				OrigEnd:   i + 1, // Just one line
-				ModStart:  i,
-				ModEnd:    i + 1, // Just one line
-			})
-		}
+// upstreamStatsFrom returns the stats attached to a context, or nil outside a client request
+func upstreamStatsFrom(ctx context.Context) *upstreamStats {
+	stats, _ := ctx.Value(upstreamStatsKey{}).(*upstreamStats)
+	return stats
+}
+
+// record counts one attempt that took d
+func (s *upstreamStats) record(d time.Duration) {
+	if s == nil {
+		return
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	s.latency += d
+}
 
-	// Handle case where one file is longer
-	if len(originalLines) != len(modifiedLines) && len(changes) < maxChanges {
-		if len(originalLines) > len(modifiedLines) {
-			// Original has more lines
-			changes = append(changes, ChangeSection{
-				OrigStart: len(modifiedLines),
-				OrigEnd:   min(len(modifiedLines)+3, len(originalLines)), // Show max 3 extra lines
-				ModStart:  len(modifiedLines),
-				ModEnd:    len(modifiedLines),
-			})
-		} else {
-			// Modified has more lines
-			changes = append(changes, ChangeSection{
-				OrigStart: len(originalLines),
-				OrigEnd:   len(originalLines),
-				ModStart:  len(originalLines),
-				ModEnd:    min(len(originalLines)+3, len(modifiedLines)), // Show max 3 extra lines
-			})
-		}
+// markHedged notes that the answer came from a hedged copy of the request
+func (s *upstreamStats) markHedged() {
+	if s == nil {
+		return
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hedged = true
+}
 
-	return changes
+// markLocal notes that the local model answered instead of Khoj
+func (s *upstreamStats) markLocal(model string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.localModel = model
 }
 
-// Find the first line that differs between two slices
-func findFirstDifference(original, modified []string) int {
-	minLen := min(len(original), len(modified))
-	for i := 0; i < minLen; i++ {
-		if original[i] != modified[i] {
-			return i
-		}
+// annotation returns the x_khoj metadata for a chat completion, or nil when the client did not ask for it
+func (s *upstreamStats) annotation(agent, convID string) *KhojAnnotation {
+	if s == nil || !s.annotate {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &KhojAnnotation{
+		Agent:             agent,
+		ConversationID:    convID,
+		UpstreamLatencyMs: s.latency.Milliseconds(),
+		Attempts:          s.attempts,
+		Retries:           max(s.attempts-1, 0),
+		Hedged:            s.hedged,
+		LocalModel:        s.localModel,
+		RequestID:         s.requestID,
 	}
+}
 
-	// If one file is longer than the other, the first difference is at the end of the shorter one
-	if len(original) != len(modified) {
-		return minLen
+// budget returns the attempts allowed per Khoj call; a client can lower the configured budget but not raise it
+func (s *upstreamStats) budget() int {
+	limit := appConfig().Retry.MaxAttempts
+	if limit <= 0 {
+		limit = defaultMaxAttempts
 	}
+	if s != nil && s.maxAttempts > 0 && s.maxAttempts < limit {
+		return s.maxAttempts
+	}
+	return limit
+}
 
-	return -1 // Files are identical
+type requestIDKey struct{}
+
+// requestIDPattern is what a client's X-Request-Id must look like to be kept; anything else gets a new ID
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// withRequestID tags a context with the ID of the inbound request it serves
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
 }
 
-// Find the last line that differs between two slices
-func findLastDifference(original, modified []string) int {
-	origLen := len(original)
-	modLen := len(modified)
+// requestIDFrom returns the request ID a context was tagged with, or "" outside an inbound request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
 
-	// Start from the end and work backwards
-	i, j := origLen-1, modLen-1
+// traceRequests gives every inbound request an ID, the client's X-Request-Id when it is well formed or a new
+// "req_" one. The ID is returned in X-Request-Id, sent on to Khoj, prefixed to the request's log lines and kept
+// with its transcript exchanges.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDPattern.MatchString(id) {
+			id = "req_" + randomHex(12)
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
 
-	for i >= 0 && j >= 0 && original[i] == modified[j] {
-		i--
-		j--
+// setRequestIDHeader passes the request ID of an outgoing request's context on to Khoj
+func setRequestIDHeader(req *http.Request) {
+	if id := requestIDFrom(req.Context()); id != "" {
+		req.Header.Set("X-Request-Id", id)
 	}
+}
 
-	// Return the last different line in the original file
-	if i >= 0 {
-		return i
+// trackUpstream reads X-Khoj-Max-Attempts and X-Khoj-Annotate, and reports X-Khoj-Attempts and X-Khoj-Upstream-Latency
+// (milliseconds) on responses that called Khoj. The headers cover the calls made before the response started.
+func trackUpstream(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := &upstreamStats{annotate: appConfig().Annotate, requestID: requestIDFrom(r.Context())}
+		if value := r.Header.Get("X-Khoj-Annotate"); value != "" {
+			annotate, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "X-Khoj-Annotate must be true or false", http.StatusBadRequest)
+				return
+			}
+			stats.annotate = annotate
+		}
+		if value := r.Header.Get("X-Khoj-Max-Attempts"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				http.Error(w, "X-Khoj-Max-Attempts must be a positive integer (1 disables retries)", http.StatusBadRequest)
+				return
+			}
+			stats.maxAttempts = n
+		}
+		next.ServeHTTP(&upstreamStatsWriter{ResponseWriter: w, stats: stats}, r.WithContext(withUpstreamStats(r.Context(), stats)))
+	})
+}
+
+// Access log formats
+const (
+	accessLogCombined = "combined"
+	accessLogCommon   = "common"
+)
+
+// path returns the access log file; relative paths are in the working directory
+func (cfg AccessLogConfig) path() string {
+	if cfg.Path != "" {
+		return cfg.Path
 	}
+	return "access.log"
+}
 
-	// If we've exhausted the original but not the modified,
-	// the last difference is at the end of the original
-	return origLen - 1
+// maxFiles returns how many rotated logs are kept
+func (cfg AccessLogConfig) maxFiles() int {
+	return positiveOrDefault(cfg.MaxFiles, 5)
 }
 
-// Simple diff for smaller files - NO CONTEXT LINES
-func generateSimpleDiff(originalLines, modifiedLines []string, filename string) string {
-	var diff strings.Builder
-	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
-	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+// logAccess writes an access log line for each request to the OpenAI-compatible API (/v1/) when access_log is
+// enabled. Nothing is written in privacy mode.
+func logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := appConfig().AccessLog
+		if !cfg.Enabled || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &accessLogRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if !privacyMode.Load() {
+			accessLog.Write(cfg, accessLogLine(cfg.Format, r, recorder.status, recorder.bytes, start))
+		}
+	})
+}
 
-	// Count only changed lines
-	changedOrigLines := 0
-	changedModLines := 0
+// accessLogLine formats a request in Apache's common or combined log format. The user field holds a key ID
+// derived from the bearer token, or the X-Khoj-Client name; combined lines end with the duration in ms.
+func accessLogLine(format string, r *http.Request, status int, bytes int64, start time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s", host, accessLogUser(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, accessLogField(r.URL.RequestURI()), r.Proto, status, size)
+	if format == accessLogCommon {
+		return line + "\n"
+	}
+	return fmt.Sprintf("%s \"%s\" \"%s\" %d\n", line, accessLogField(orDash(r.Referer())), accessLogField(orDash(r.UserAgent())), time.Since(start).Milliseconds())
+}
 
-	maxLines := max(len(originalLines), len(modifiedLines))
-	for i := 0; i < maxLines; i++ {
-		origLineExists := i < len(originalLines)
-		modLineExists := i < len(modifiedLines)
+// accessLogUser names the caller without writing its key: "key-" and a short hash of the bearer token
+func accessLogUser(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && strings.TrimSpace(token) != "" {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		return "key-" + hex.EncodeToString(sum[:4])
+	}
+	if client := strings.TrimSpace(r.Header.Get("X-Khoj-Client")); client != "" {
+		return strings.Join(strings.Fields(accessLogField(client)), "_")
+	}
+	return "-"
+}
 
-		if origLineExists && modLineExists {
-			if originalLines[i] != modifiedLines[i] {
-				changedOrigLines++
-				changedModLines++
-			}
-		} else if origLineExists {
-			changedOrigLines++
-		} else if modLineExists {
-			changedModLines++
+// accessLogField escapes quotes and control characters so a value can't break a log line
+func accessLogField(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r < 0x20 || r == 0x7f {
+			return '_'
 		}
+		return r
+	}, value)
+}
+
+// orDash returns "-" for empty log values
+func orDash(value string) string {
+	if value == "" {
+		return "-"
 	}
+	return value
+}
 
-	diff.WriteString(fmt.Sprintf("@@ -1,%d +1,%d @@\n", changedOrigLines, changedModLines))
+// accessLogRecorder captures the status and body size of a response
+type accessLogRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
 
-	// Show only changed lines, no context
-	for i := 0; i < maxLines; i++ {
-		origLineExists := i < len(originalLines)
-		modLineExists := i < len(modifiedLines)
+func (w *accessLogRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
 
-		if origLineExists && modLineExists {
-			if originalLines[i] != modifiedLines[i] {
-				diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
-				diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
-			}
-			// Skip identical lines (no context)
-		} else if origLineExists {
-			diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
-		} else if modLineExists {
-			diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
-		}
+func (w *accessLogRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
 	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
 
-	return diff.String()
+// Flush keeps streaming handlers working through the recorder
+func (w *accessLogRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
-// Generate a simple replacement diff (more efficient for large changes)
-func generateSimpleReplacement(original, modified, filename string) string {
-	var diff strings.Builder
-	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
-	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *accessLogRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
 
-	originalLines := strings.Split(original, "\n")
-	modifiedLines := strings.Split(modified, "\n")
+// accessLogWriter appends to the access log, rotating it by size
+type accessLogWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	path string
+	size int64
+}
 
-	diff.WriteString(fmt.Sprintf("@@ -1,%d +1,%d @@\n", len(originalLines), len(modifiedLines)))
+var accessLog = &accessLogWriter{}
 
-	// Show only first few lines of removal and addition to keep diff manageable
-	maxShowLines := 10
+// Write appends a line, opening the configured file or rotating it first when needed
+func (l *accessLogWriter) Write(cfg AccessLogConfig, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// Show some removed lines
-	for i := 0; i < min(len(originalLines), maxShowLines); i++ {
-		diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+	if path := cfg.path(); l.file == nil || l.path != path {
+		l.closeLocked()
+		if err := l.openLocked(path); err != nil {
+			log.Printf("⚠️ Access log not written: %v", err)
+			return
+		}
 	}
-	if len(originalLines) > maxShowLines {
-		diff.WriteString(fmt.Sprintf("-... (%d more lines removed)\n", len(originalLines)-maxShowLines))
+	if maxSize := int64(positiveOrDefault(cfg.MaxSizeMB, 10)) << 20; l.size > 0 && l.size+int64(len(line)) > maxSize {
+		if err := l.rotateLocked(cfg.maxFiles()); err != nil {
+			log.Printf("⚠️ Access log not rotated: %v", err)
+			return
+		}
+	}
+	n, err := l.file.WriteString(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("⚠️ Access log not written: %v", err)
 	}
+}
 
-	// Show some added lines
-	for i := 0; i < min(len(modifiedLines), maxShowLines); i++ {
-		diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+// Close closes the log file; the next Write opens it again
+func (l *accessLogWriter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeLocked()
+}
+
+func (l *accessLogWriter) openLocked(path string) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create access log directory: %w", err)
+		}
 	}
-	if len(modifiedLines) > maxShowLines {
-		diff.WriteString(fmt.Sprintf("+... (%d more lines added)\n", len(modifiedLines)-maxShowLines))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
 	}
-
-	return diff.String()
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat access log: %w", err)
+	}
+	l.file, l.path, l.size = f, path, info.Size()
+	return nil
 }
 
-// Generate proper unified diff for similar files
-func generateProperUnifiedDiff(originalLines, modifiedLines []string, filename string) string {
-	var diff strings.Builder
-	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
-	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+func (l *accessLogWriter) closeLocked() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
 
-	maxLines := len(originalLines)
-	if len(modifiedLines) > maxLines {
-		maxLines = len(modifiedLines)
+// rotateLocked shifts access.log.1 to .2 and so on, dropping the oldest, and starts a new log
+func (l *accessLogWriter) rotateLocked(maxFiles int) error {
+	path := l.path
+	l.closeLocked()
+	os.Remove(fmt.Sprintf("%s.%d", path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate access log: %w", err)
 	}
+	return l.openLocked(path)
+}
 
-	diff.WriteString(fmt.Sprintf("@@ -1,%d +1,%d @@\n", len(originalLines), len(modifiedLines)))
+// upstreamStatsWriter adds the upstream stats headers just before the response header is written
+type upstreamStatsWriter struct {
+	http.ResponseWriter
+	stats       *upstreamStats
+	wroteHeader bool
+}
 
-	for i := 0; i < maxLines; i++ {
-		if i < len(originalLines) && i < len(modifiedLines) {
-			if originalLines[i] != modifiedLines[i] {
-				diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
-				diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
-			} else {
-				diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
-			}
-		} else if i < len(originalLines) {
-			diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
-		} else if i < len(modifiedLines) {
-			diff.WriteString(fmt.Sprintf("+%s\n", modifiedLines[i]))
+func (w *upstreamStatsWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.stats.mu.Lock()
+		if w.stats.attempts > 0 {
+			w.Header().Set("X-Khoj-Attempts", strconv.Itoa(w.stats.attempts))
+			w.Header().Set("X-Khoj-Upstream-Latency", strconv.FormatInt(w.stats.latency.Milliseconds(), 10))
+		}
+		if w.stats.localModel != "" {
+			w.Header().Set("X-Khoj-Local-Model", w.stats.localModel)
 		}
+		w.stats.mu.Unlock()
 	}
-
-	return diff.String()
+	w.ResponseWriter.WriteHeader(code)
 }
 
-func NewKhojProvider(apiBase, apiKey string) *KhojProvider {
-	return &KhojProvider{
-		APIBase: apiBase,
-		APIKey:  apiKey,
-		HTTPClient: &http.Client{
-			Timeout: 120 * time.Second,
-		},
-		MCPManager: &MCPToolManager{
-			Sessions: make(map[string]*MCPSession),
-		},
+func (w *upstreamStatsWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
 	}
+	return w.ResponseWriter.Write(p)
 }
 
-// HandleChatCompletion processes ONLY regular chat completion requests
-func (kp *KhojProvider) HandleChatCompletion(ctx context.Context, req *ChatCompletionRequest) (*ChatCompletionResponse, error) {
-	log.Printf("Processing regular chat completion for model: %s", req.Model)
+// Flush keeps streaming handlers working through the wrapper
+func (w *upstreamStatsWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
-	// Build prompt from messages (WITHOUT file contents)
-	var prompt strings.Builder
-	var files []KhojFile
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *upstreamStatsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
 
-	for i, msg := range req.Messages {
-		// Don't include large file contents in the prompt text
-		messageContent := msg.Content
+// classifyRequest reads the X-Khoj-Priority header, falling back to the request's purpose
+func classifyRequest(r *http.Request, req *ChatCompletionRequest) requestClass {
+	value := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Khoj-Priority")))
+	if value == "" {
+		value = strings.ToLower(strings.TrimSpace(req.Purpose))
+	}
+	switch value {
+	case "background", "batch", "sync", "notes", "indexing":
+		return classBackground
+	}
+	return classInteractive
+}
 
-		// Check if this message contains file-like content
-		isLargeContent := len(msg.Content) > 10000
-		containsHTML := strings.Contains(msg.Content, "<!DOCTYPE html>") || strings.Contains(msg.Content, "<html")
+// errPreempted is the cancellation cause of a background request that yielded to an interactive one
+var errPreempted = errors.New("preempted by an interactive request")
+
+// schedTicket is one request waiting for or holding a scheduler slot
+type schedTicket struct {
+	class     requestClass
+	ready     chan struct{}
+	cancel    context.CancelCauseFunc
+	granted   bool
+	preempted bool
+	sched     *requestScheduler
+	inFlight  int // Calls Khoj has received and not answered yet; these are never preempted
+}
 
-		log.Printf("=== DEBUG: Message %d Analysis ===", i+1)
-		log.Printf("Content length: %d, isLargeContent: %v, containsHTML: %v", len(msg.Content), isLargeContent, containsHTML)
+// schedTicketKey finds the scheduler ticket a Khoj call runs under in its context
+type schedTicketKey struct{}
 
-		if isLargeContent && containsHTML {
-			// This is file content - add to files array, not prompt
-			filename := "main.html"
-			if strings.Contains(msg.Content, "index.html") {
-				filename = "index.html"
-			}
+// trackKhojCall marks the ticket ctx runs under as waiting on Khoj until the returned func is called, so preemption
+// leaves it alone: cancelling would waste what Khoj already did, and the requeued request would reach it twice
+func trackKhojCall(ctx context.Context) func() {
+	t, _ := ctx.Value(schedTicketKey{}).(*schedTicket)
+	if t == nil {
+		return func() {}
+	}
+	t.sched.mu.Lock()
+	t.inFlight++
+	t.sched.mu.Unlock()
+	return func() {
+		t.sched.mu.Lock()
+		defer t.sched.mu.Unlock()
+		t.inFlight--
+		t.sched.dispatchLocked()
+	}
+}
 
-			file := KhojFile{
-				Name:     filename,
-				Content:  msg.Content,
-				FileType: "html",
-				Size:     len(msg.Content),
-			}
-			files = append(files, file)
+// requestScheduler limits concurrent Khoj requests, serving interactive requests first
+type requestScheduler struct {
+	mu      sync.Mutex
+	limit   int
+	bgLimit int
+	preempt bool
+	running []*schedTicket
+	waiting [2][]*schedTicket // Indexed by requestClass, FIFO
+}
 
-			log.Printf("=== DEBUG: Adding file to Khoj request ===")
-			log.Printf("File name: %s", file.Name)
-			log.Printf("File size: %d bytes", file.Size)
-			log.Printf("File type: %s", file.FileType)
+// khojScheduler gates every request sent to Khoj; configured from config.json at startup
+var khojScheduler = newRequestScheduler(PriorityConfig{})
 
-			// Replace the large content with a reference in the prompt
-			messageContent = fmt.Sprintf("[File: %s (%d bytes) - sent in files array]", filename, len(msg.Content))
-		}
+func newRequestScheduler(cfg PriorityConfig) *requestScheduler {
+	s := &requestScheduler{}
+	s.Configure(cfg)
+	return s
+}
 
-		prompt.WriteString(fmt.Sprintf("%s: %s\n", msg.Role, messageContent))
+// Configure applies limits; requests already running are not affected
+func (s *requestScheduler) Configure(cfg PriorityConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = cfg.MaxConcurrent
+	if s.limit <= 0 {
+		s.limit = defaultMaxConcurrent
 	}
-
-	finalPrompt := prompt.String()
-
-	// Call Khoj API with files separate from prompt
-	khojReq := &KhojRequest{
-		Q:              finalPrompt,
-		Stream:         false,
-		ConversationID: conversationID, // Use global conversation ID (empty for new conversations)
-		ClientID:       "khoj-provider-continue",
-		Files:          files, // Send files here, not in prompt
+	s.bgLimit = cfg.MaxBackground
+	if s.bgLimit <= 0 || s.bgLimit >= s.limit {
+		s.bgLimit = max(1, s.limit-1) // The last slot stays free for interactive requests
 	}
+	s.preempt = !cfg.DisablePreemption
+	s.dispatchLocked()
+}
 
-	// DEBUG: Log what you send to Khoj
-	log.Printf("=== DEBUG: Khoj API Request ===")
-	log.Printf("Query (prompt): %s", finalPrompt)
-	log.Printf("Files count: %d", len(khojReq.Files))
-
-	if len(khojReq.Files) > 0 {
-		for i, file := range khojReq.Files {
-			log.Printf("File %d: Name=%s, Size=%d bytes, Type=%s", i+1, file.Name, file.Size, file.FileType)
-			if len(file.Content) > 200 {
-				log.Printf("File %d content preview: %s...", i+1, file.Content[:200])
-			}
+// Run calls fn once a slot is free; preempted background calls are requeued and run again
+func (s *requestScheduler) Run(ctx context.Context, class requestClass, fn func(ctx context.Context) error) error {
+	khojActivity.begin()
+	defer khojActivity.end()
+	for attempt := 1; ; attempt++ {
+		t, runCtx, err := s.acquire(ctx, class)
+		if err != nil {
+			return err
 		}
-	} else {
-		log.Printf("No files being sent to Khoj")
+		err = fn(runCtx)
+		// A call that finished before it noticed the preemption keeps its answer
+		preempted := err != nil && context.Cause(runCtx) == errPreempted && ctx.Err() == nil
+		s.release(t)
+		if !preempted {
+			return err
+		}
+		if attempt >= maxPreemptions {
+			return fmt.Errorf("background request gave up after %d preemptions: %w", attempt, errPreempted)
+		}
+		log.Printf("⏸️ Background Khoj request preempted, requeueing (attempt %d)", attempt+1)
 	}
+}
 
-	khojResp, err := kp.callKhojAPI(ctx, khojReq)
-	if err != nil {
-		return nil, fmt.Errorf("khoj API call failed: %w", err)
+// Stats returns the number of running and waiting requests per class
+func (s *requestScheduler) Stats() (running, waiting [2]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.running {
+		running[t.class]++
 	}
+	waiting[classInteractive] = len(s.waiting[classInteractive])
+	waiting[classBackground] = len(s.waiting[classBackground])
+	return running, waiting
+}
 
-	// DEBUG: Log what you get back from Khoj
-	log.Printf("=== DEBUG: Khoj API Response ===")
-	log.Printf("Response length: %d characters", len(khojResp.Response))
-	log.Printf("Response preview: %s", khojResp.Response[:min(300, len(khojResp.Response))])
-	log.Printf("Using conversation ID: %s", conversationID)
-
-	response := &ChatCompletionResponse{
-		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   req.Model,
-		Choices: []Choice{
-			{
-				Index: 0,
-				Message: Message{
-					Role:    "assistant",
-					Content: khojResp.Response,
-				},
-				FinishReason: "stop",
-			},
-		},
-		Usage: Usage{
-			PromptTokens:     len(finalPrompt) / 4,
-			CompletionTokens: len(khojResp.Response) / 4,
-			TotalTokens:      (len(finalPrompt) + len(khojResp.Response)) / 4,
-		},
+func (s *requestScheduler) acquire(ctx context.Context, class requestClass) (*schedTicket, context.Context, error) {
+	runCtx, cancel := context.WithCancelCause(ctx)
+	t := &schedTicket{class: class, ready: make(chan struct{}), cancel: cancel, sched: s}
+	runCtx = context.WithValue(runCtx, schedTicketKey{}, t)
+
+	s.mu.Lock()
+	s.waiting[class] = append(s.waiting[class], t)
+	s.dispatchLocked()
+	queued := !t.granted
+	s.mu.Unlock()
+	if queued {
+		log.Printf("⏳ %s Khoj request queued", class)
 	}
 
-	return response, nil
+	select {
+	case <-t.ready:
+		return t, runCtx, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		granted := t.granted
+		if !granted {
+			s.removeWaitingLocked(t)
+		}
+		s.mu.Unlock()
+		if granted {
+			s.release(t)
+		}
+		cancel(nil)
+		return nil, nil, ctx.Err()
+	}
 }
 
-func (kp *KhojProvider) callKhojAPI(ctx context.Context, req *KhojRequest) (*KhojResponse, error) {
-	maxRetries := 3
-	var lastErr error
-
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			log.Printf("Retrying Khoj API call (attempt %d/%d)", attempt+1, maxRetries)
-			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+func (s *requestScheduler) release(t *schedTicket) {
+	t.cancel(nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.running {
+		if r == t {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
 		}
+	}
+	s.dispatchLocked()
+}
 
-		jsonData, err := json.Marshal(req)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal request: %w", err)
+// dispatchLocked grants free slots, interactive first, and preempts background work an interactive request is waiting on
+func (s *requestScheduler) dispatchLocked() {
+	for len(s.running) < s.limit {
+		class := classInteractive
+		if len(s.waiting[classInteractive]) == 0 {
+			if len(s.waiting[classBackground]) == 0 || s.countRunningLocked(classBackground) >= s.bgLimit {
+				break
+			}
+			class = classBackground
 		}
+		t := s.waiting[class][0]
+		s.waiting[class] = s.waiting[class][1:]
+		t.granted = true
+		s.running = append(s.running, t)
+		close(t.ready)
+	}
 
-		log.Printf("Making Khoj API call to: %s", kp.APIBase+"/api/chat")
+	if !s.preempt || len(s.waiting[classInteractive]) == 0 {
+		return
+	}
 
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", kp.APIBase+"/api/chat", bytes.NewBuffer(jsonData))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create request: %w", err)
+	// Free one slot per waiting interactive request, newest background request first. Requests Khoj is answering
+	// are left to finish; a background request is preempted between its Khoj calls, such as while waiting to retry.
+	needed := len(s.waiting[classInteractive])
+	for _, t := range s.running {
+		if t.preempted {
+			needed--
 		}
-
-		httpReq.Header.Set("Content-Type", "application/json")
-		httpReq.Header.Set("User-Agent", "KhojProvider/1.0")
-		if kp.APIKey != "" {
-			httpReq.Header.Set("Authorization", "Bearer "+kp.APIKey)
+	}
+	for i := len(s.running) - 1; i >= 0 && needed > 0; i-- {
+		if t := s.running[i]; t.class == classBackground && !t.preempted && t.inFlight == 0 {
+			t.preempted = true
+			t.cancel(errPreempted)
+			needed--
 		}
+	}
+}
 
-		resp, err := kp.HTTPClient.Do(httpReq)
-		if err != nil {
-			lastErr = fmt.Errorf("HTTP request failed: %w", err)
-			log.Printf("Khoj API call failed (attempt %d): %v", attempt+1, lastErr)
-			continue
+func (s *requestScheduler) countRunningLocked(class requestClass) int {
+	n := 0
+	for _, t := range s.running {
+		if t.class == class {
+			n++
 		}
+	}
+	return n
+}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			lastErr = fmt.Errorf("failed to read response body: %w", err)
-			continue
+func (s *requestScheduler) removeWaitingLocked(t *schedTicket) {
+	queue := s.waiting[t.class]
+	for i, w := range queue {
+		if w == t {
+			s.waiting[t.class] = append(queue[:i], queue[i+1:]...)
+			return
 		}
+	}
+}
 
-		log.Printf("Khoj API response status: %d, body length: %d", resp.StatusCode, len(body))
+// requestActivity counts Khoj requests for the tray status
+type requestActivity struct {
+	mu     sync.Mutex
+	active int
+	today  int
+	day    string // Local date the today count belongs to
+}
 
-		if resp.StatusCode != http.StatusOK {
-			lastErr = fmt.Errorf("khoj API error %d: %s", resp.StatusCode, string(body))
-			if resp.StatusCode >= 500 {
-				continue
-			}
-			return nil, lastErr
-		}
+// khojActivity counts the requests run by khojScheduler
+var khojActivity = &requestActivity{}
+
+// begin counts a request that was just made and publishes the new counts
+func (a *requestActivity) begin() {
+	a.mu.Lock()
+	a.rollDayLocked()
+	a.active++
+	a.today++
+	ev := ActivityEvent{Active: a.active, Today: a.today}
+	a.mu.Unlock()
+	bus.Publish(topicActivity, "started", ev)
+}
 
-		var khojResp KhojResponse
-		if err := json.Unmarshal(body, &khojResp); err != nil {
-			lastErr = fmt.Errorf("failed to decode response: %w", err)
-			log.Printf("Response body: %s", string(body))
-			continue
-		}
+// end counts a request that finished, however it ended, and publishes the new counts
+func (a *requestActivity) end() {
+	a.mu.Lock()
+	a.rollDayLocked()
+	a.active--
+	ev := ActivityEvent{Active: a.active, Today: a.today}
+	a.mu.Unlock()
+	bus.Publish(topicActivity, "finished", ev)
+}
 
-		log.Printf("Successfully parsed Khoj response")
-		return &khojResp, nil
-	}
+// Snapshot returns the current counts
+func (a *requestActivity) Snapshot() ActivityEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rollDayLocked()
+	return ActivityEvent{Active: a.active, Today: a.today}
+}
 
-	return nil, fmt.Errorf("khoj API call failed after %d attempts: %w", maxRetries, lastErr)
+// rollDayLocked starts a new today count after midnight
+func (a *requestActivity) rollDayLocked() {
+	if day := time.Now().Format("2006-01-02"); day != a.day {
+		a.day, a.today = day, 0
+	}
 }
 
-func NewKhojProviderWithTimeout(apiBase, apiKey string, timeout time.Duration) *KhojProvider {
-	return &KhojProvider{
-		APIBase: apiBase,
-		APIKey:  apiKey,
-		HTTPClient: &http.Client{
-			Timeout: timeout,
-			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 100,
-				IdleConnTimeout:     90 * time.Second,
-				DisableKeepAlives:   false,
-			},
-		},
-		MCPManager: &MCPToolManager{
-			Sessions: make(map[string]*MCPSession),
-		},
+// prioritySummary describes the effective scheduler limits for config validate
+func prioritySummary(cfg PriorityConfig) string {
+	s := newRequestScheduler(cfg)
+	preempt := "preempts background"
+	if !s.preempt {
+		preempt = "no preemption"
 	}
+	return fmt.Sprintf("%d concurrent, %d background, %s", s.limit, s.bgLimit, preempt)
 }
 
-func (kp *KhojProvider) handleStreamingRequest(w http.ResponseWriter, r *http.Request, req *ChatCompletionRequest) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+type conversationIDKey struct{}
 
-	ctx := r.Context()
+// withConversationID tags a context with the conversation a request belongs to
+func withConversationID(ctx context.Context, convID string) context.Context {
+	return context.WithValue(ctx, conversationIDKey{}, convID)
+}
 
-	resp, err := kp.HandleChatCompletion(ctx, req)
-	if err != nil {
-		log.Printf("Error in HandleChatCompletion: %v", err)
-		errorChunk := map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": err.Error(),
-				"type":    "api_error",
-			},
-		}
-		errorData, _ := json.Marshal(errorChunk)
-		fmt.Fprintf(w, "data: %s\n\n", errorData)
-		return
+// conversationFromContext returns the request's conversation, defaulting to the global one
+func conversationFromContext(ctx context.Context) string {
+	if convID, ok := ctx.Value(conversationIDKey{}).(string); ok && convID != "" {
+		return convID
 	}
+	return conversationID
+}
 
-	content := resp.Choices[0].Message.Content
-	chunkSize := 50
+// API conversation modes
+const (
+	apiConversationsShared    = "shared"
+	apiConversationsStateless = "stateless"
+	apiConversationsPerClient = "per_client"
+)
 
-	for i := 0; i < len(content); i += chunkSize {
-		select {
-		case <-ctx.Done():
-			log.Printf("Client disconnected during streaming")
-			return
-		default:
-		}
+// apiConversationMode returns the configured mode; client_conversations.enabled alone selects per_client
+func (cfg *AppConfig) apiConversationMode() string {
+	switch {
+	case cfg.APIConversations.Mode != "":
+		return cfg.APIConversations.Mode
+	case cfg.ClientConversations.Enabled:
+		return apiConversationsPerClient
+	}
+	return apiConversationsShared
+}
 
-		end := i + chunkSize
-		if end > len(content) {
-			end = len(content)
-		}
+// Subsystems the features section can switch off
+const (
+	featureClipboardAI   = "clipboard_ai"
+	featureDashboard     = "dashboard"
+	featureMCP           = "mcp"
+	featureNotifications = "notifications"
+	featureFileTools     = "file_tools"
+	featureWebhooks      = "webhooks" // The wrapper sends no webhooks yet; accepted so configs can opt out ahead of them
+)
 
-		chunk := map[string]interface{}{
-			"id":      resp.ID,
-			"object":  "chat.completion.chunk",
-			"created": resp.Created,
-			"model":   resp.Model,
-			"choices": []map[string]interface{}{
-				{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"content": content[i:end],
-					},
-					"finish_reason": nil,
-				},
-			},
-		}
+var knownFeatures = []string{featureClipboardAI, featureDashboard, featureMCP, featureNotifications, featureFileTools, featureWebhooks}
 
-		chunkData, _ := json.Marshal(chunk)
+// featureEnabled reports whether a subsystem is on; every feature is on unless features sets it to false
+func (cfg *AppConfig) featureEnabled(name string) bool {
+	enabled, ok := cfg.Features[name]
+	return !ok || enabled
+}
 
-		if _, err := fmt.Fprintf(w, "data: %s\n\n", chunkData); err != nil {
-			log.Printf("Error writing chunk: %v", err)
-			return
+// featuresSummary lists the switched off features for config validate
+func (cfg *AppConfig) featuresSummary() string {
+	var off []string
+	for _, name := range knownFeatures {
+		if !cfg.featureEnabled(name) {
+			off = append(off, name)
 		}
+	}
+	if len(off) == 0 {
+		return "all on"
+	}
+	return "off: " + strings.Join(off, ", ")
+}
 
-		if flusher, ok := w.(http.Flusher); ok {
-			flusher.Flush()
-		}
+type statelessConversationKey struct{}
 
-		time.Sleep(5 * time.Millisecond)
-	}
+// withStatelessConversation marks a request whose conversation lasts only for that request
+func withStatelessConversation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statelessConversationKey{}, true)
+}
 
-	finalChunk := map[string]interface{}{
-		"id":      resp.ID,
-		"object":  "chat.completion.chunk",
-		"created": resp.Created,
-		"model":   resp.Model,
-		"choices": []map[string]interface{}{
-			{
-				"index":         0,
-				"delta":         map[string]interface{}{},
-				"finish_reason": "stop",
-			},
-		},
-	}
+type instructionsConversationKey struct{}
 
-	finalData, _ := json.Marshal(finalChunk)
-	fmt.Fprintf(w, "data: %s\n\n", finalData)
-	fmt.Fprintf(w, "data: [DONE]\n\n")
+// withInstructionsFrom makes a request use another conversation's custom instructions
+func withInstructionsFrom(ctx context.Context, convID string) context.Context {
+	return context.WithValue(ctx, instructionsConversationKey{}, convID)
+}
 
-	if flusher, ok := w.(http.Flusher); ok {
-		flusher.Flush()
+// instructionsConversation returns the conversation whose custom instructions apply to a request. Stateless
+// conversations can't be given any, so they use the global conversation's.
+func instructionsConversation(ctx context.Context) string {
+	if convID, ok := ctx.Value(instructionsConversationKey{}).(string); ok {
+		return convID
 	}
+	if stateless, _ := ctx.Value(statelessConversationKey{}).(bool); stateless {
+		return conversationID
+	}
+	return conversationFromContext(ctx)
 }
 
-func enableCORS(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Type")
-	w.Header().Set("Access-Control-Max-Age", "86400")
+// clientIdentity names the calling client from X-Khoj-Client or the request's user field
+func clientIdentity(r *http.Request, req *ChatCompletionRequest) string {
+	if client := strings.TrimSpace(r.Header.Get("X-Khoj-Client")); client != "" {
+		return client
+	}
+	return strings.TrimSpace(req.User)
 }
 
-// Generate minimal diff that focuses only on the actual changes
-func generateMinimalDiff(original, modified, filename string) string {
-	originalLines := strings.Split(original, "\n")
-	modifiedLines := strings.Split(modified, "\n")
+// ClientMapping is the conversation assigned to one client
+type ClientMapping struct {
+	Client         string    `json:"client"`
+	ConversationID string    `json:"conversation_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsed       time.Time `json:"last_used"`
+}
 
-	// Find the actual differences
-	changes := findActualChanges(originalLines, modifiedLines)
+// clientMappingStore persists client-to-conversation mappings in the SQLite database clientMappingsFile
+type clientMappingStore struct {
+	mu sync.Mutex
+	db *sql.DB
+}
 
-	if len(changes) == 0 {
-		return "" // No changes
+var clientMappings = &clientMappingStore{}
+
+// openLocked opens the database once, creating the table and importing legacyClientMappingsFile
+func (s *clientMappingStore) openLocked() error {
+	if s.db != nil {
+		return nil
+	}
+	db, err := sql.Open("sqlite", clientMappingsFile)
+	if err != nil {
+		return fmt.Errorf("failed to open client mappings database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS client_conversations (
+		client          TEXT PRIMARY KEY,
+		conversation_id TEXT NOT NULL,
+		created_at      INTEGER NOT NULL,
+		last_used       INTEGER NOT NULL
+	)`); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to create client mappings table: %w", err)
 	}
+	s.db = db
+	if err := s.importLegacyLocked(); err != nil {
+		log.Printf("Warning: Failed to import %s: %v", legacyClientMappingsFile, err)
+	}
+	return nil
+}
 
-	var diff strings.Builder
-	diff.WriteString(fmt.Sprintf("--- a/%s\n", filename))
-	diff.WriteString(fmt.Sprintf("+++ b/%s\n", filename))
+// importLegacyLocked moves mappings saved by older versions into the database and removes the JSON file
+func (s *clientMappingStore) importLegacyLocked() error {
+	data, err := os.ReadFile(legacyClientMappingsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []ClientMapping
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse client mappings file: %w", err)
+	}
 
-	// Generate only the first significant change to keep it minimal
-	change := changes[0]
-	contextLines := 2 // Minimal context
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range list {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO client_conversations (client, conversation_id, created_at, last_used) VALUES (?, ?, ?, ?)`,
+			m.Client, m.ConversationID, m.CreatedAt.UnixNano(), m.LastUsed.UnixNano()); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Imported %d client mappings from %s", len(list), legacyClientMappingsFile)
+	return os.Remove(legacyClientMappingsFile)
+}
 
-	startLine := max(0, change.StartLine-contextLines)
-	endLine := min(len(originalLines), change.EndLine+contextLines)
+// closeLocked closes the database so its file can be deleted; the next use reopens it
+func (s *clientMappingStore) closeLocked() {
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+}
 
-	diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
-		startLine+1, endLine-startLine,
-		startLine+1, endLine-startLine+(change.LinesAdded-change.LinesRemoved)))
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
 
-	// Show minimal context and changes
-	for i := startLine; i < change.StartLine && i < len(originalLines); i++ {
-		diff.WriteString(fmt.Sprintf(" %s\n", originalLines[i]))
+// queryLocked returns the mappings selected by a query over client, conversation_id, created_at and last_used
+func (s *clientMappingStore) queryLocked(q sqlQuerier, query string, args ...interface{}) ([]ClientMapping, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client mappings: %w", err)
+	}
+	defer rows.Close()
+
+	list := []ClientMapping{}
+	for rows.Next() {
+		var m ClientMapping
+		var createdAt, lastUsed int64
+		if err := rows.Scan(&m.Client, &m.ConversationID, &createdAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to read client mappings: %w", err)
+		}
+		m.CreatedAt, m.LastUsed = time.Unix(0, createdAt), time.Unix(0, lastUsed)
+		list = append(list, m)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read client mappings: %w", err)
+	}
+	return list, nil
+}
 
-	// Show the actual change
-	for i := change.StartLine; i < change.EndLine && i < len(originalLines); i++ {
-		diff.WriteString(fmt.Sprintf("-%s\n", originalLines[i]))
+// ConversationFor returns the client's conversation, creating one on first use, and records the use
+func (s *clientMappingStore) ConversationFor(apiBase, apiKey, client string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.openLocked(); err != nil {
+		return "", err
 	}
 
-	// Show the replacement (simplified)
-	if change.LinesAdded > 0 {
-		diff.WriteString(fmt.Sprintf("+%s\n", "<!-- Changes applied -->"))
+	now := time.Now().UnixNano()
+	var convID string
+	err := s.db.QueryRow(`SELECT conversation_id FROM client_conversations WHERE client = ?`, client).Scan(&convID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		convID, err = createNewConversation(apiBase, apiKey)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("✅ New conversation %s for client %s", convID, client)
+		if _, err := s.db.Exec(`INSERT INTO client_conversations (client, conversation_id, created_at, last_used) VALUES (?, ?, ?, ?)`, client, convID, now, now); err != nil {
+			log.Printf("Warning: Failed to save client mapping: %v", err)
+		}
+	case err != nil:
+		return "", fmt.Errorf("failed to read client mapping: %w", err)
+	default:
+		if _, err := s.db.Exec(`UPDATE client_conversations SET last_used = ? WHERE client = ?`, now, client); err != nil {
+			log.Printf("Warning: Failed to save client mapping: %v", err)
+		}
 	}
+	return convID, nil
+}
 
-	return diff.String()
+// Forget removes a client's mapping so its next request starts a new conversation
+func (s *clientMappingStore) Forget(client string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.openLocked(); err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`DELETE FROM client_conversations WHERE client = ?`, client)
+	if err != nil {
+		return fmt.Errorf("failed to delete client mapping: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Forgot conversation mapping for client %s", client)
+	}
+	return nil
 }
 
-type Change struct {
-	StartLine    int
-	EndLine      int
-	LinesAdded   int
-	LinesRemoved int
+// List returns the current mappings, most recently used first
+func (s *clientMappingStore) List() ([]ClientMapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.openLocked(); err != nil {
+		return nil, err
+	}
+	return s.queryLocked(s.db, `SELECT client, conversation_id, created_at, last_used FROM client_conversations ORDER BY last_used DESC`)
 }
 
-func findActualChanges(original, modified []string) []Change {
-	// Simplified change detection
-	if len(original) != len(modified) {
-		return []Change{{
-			StartLine:    0,
-			EndLine:      min(len(original), 10), // Show only first 10 lines of change
-			LinesAdded:   len(modified) - len(original),
-			LinesRemoved: max(0, len(original)-len(modified)),
-		}}
+// Collect removes mappings unused for maxAge and returns them
+func (s *clientMappingStore) Collect(maxAge time.Duration) ([]ClientMapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.openLocked(); err != nil {
+		return nil, err
 	}
 
-	// Find first difference
-	for i := 0; i < len(original) && i < len(modified); i++ {
-		if original[i] != modified[i] {
-			return []Change{{
-				StartLine:    i,
-				EndLine:      min(i+5, len(original)), // Show 5 lines of change
-				LinesAdded:   0,
-				LinesRemoved: 0,
-			}}
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect client mappings: %w", err)
+	}
+	defer tx.Rollback()
+	removed, err := s.queryLocked(tx, `SELECT client, conversation_id, created_at, last_used FROM client_conversations WHERE last_used < ?`, cutoff)
+	if err != nil || len(removed) == 0 {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM client_conversations WHERE last_used < ?`, cutoff); err != nil {
+		return nil, fmt.Errorf("failed to collect client mappings: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to collect client mappings: %w", err)
+	}
+	return removed, nil
+}
+
+// collectClientMappings runs one garbage collection pass, deleting the remote conversations when configured
+func collectClientMappings(apiBase, apiKey string) (int, error) {
+	cfg := appConfig().ClientConversations
+	if cfg.GCAfterDays <= 0 {
+		return 0, nil
+	}
+
+	removed, err := clientMappings.Collect(time.Duration(cfg.GCAfterDays) * 24 * time.Hour)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range removed {
+		log.Printf("🧹 Collected conversation mapping for client %s (last used %s)", m.Client, m.LastUsed.Format(time.RFC3339))
+		if cfg.DeleteRemote {
+			if err := deleteKhojConversation(apiBase, apiKey, m.ConversationID); err != nil {
+				log.Printf("Failed to delete Khoj conversation %s: %v", m.ConversationID, err)
+			}
 		}
 	}
+	return len(removed), nil
+}
 
-	return []Change{} // No changes
+var clientMappingGCOnce sync.Once
+
+// startClientMappingGC collects stale client mappings at startup and every six hours
+func startClientMappingGC(apiBase, apiKey string) {
+	if appConfig().apiConversationMode() != apiConversationsPerClient || appConfig().ClientConversations.GCAfterDays <= 0 {
+		return
+	}
+	clientMappingGCOnce.Do(func() {
+		workers.Go("client-mapping-gc", func(ctx context.Context) error {
+			ticker := time.NewTicker(6 * time.Hour)
+			defer ticker.Stop()
+			for {
+				if _, err := collectClientMappings(apiBase, apiKey); err != nil {
+					log.Printf("Client mapping cleanup failed: %v", err)
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
+		})
+	})
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// deleteKhojConversation deletes a conversation and its history on Khoj
+func deleteKhojConversation(apiBase, apiKey, convID string) error {
+	endpoint := fmt.Sprintf("%s/api/chat/history?conversation_id=%s", apiBase, url.QueryEscape(convID))
+	req, err := http.NewRequest("DELETE", endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete request: %w", err)
 	}
-	return b
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete conversation: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("conversation delete failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	sentAttachments.Forget(convID)
+	transcripts.Forget(convID)
+	return nil
 }
 
-func main() {
-	// Initialize conversation ID from environment variables and command-line flags
-	if err := initializeConversationID(); err != nil {
-		log.Fatal("Conversation ID initialization failed: ", err)
+// handleDashboardClients lists (GET) client mappings, forgets one (DELETE ?client=) or runs cleanup (POST ?gc=1)
+func handleDashboardClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := clientMappings.Forget(r.URL.Query().Get("client")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPost:
+		apiBase := os.Getenv("KHOJ_API_BASE")
+		if apiBase == "" {
+			apiBase = "https://app.khoj.dev"
+		}
+		if _, err := collectClientMappings(apiBase, os.Getenv("KHOJ_API_KEY")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Initialize systray
-	systray.Run(onReady, onExit)
+	mappings, err := clientMappings.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":       appConfig().apiConversationMode() == apiConversationsPerClient,
+		"gc_after_days": appConfig().ClientConversations.GCAfterDays,
+		"mappings":      mappings,
+	})
 }
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"khoj-provider/pkg/khojtest"
+)
+
+func TestOutputFilterWholeWords(t *testing.T) {
+	filter, err := compileOutputFilter(&OutputFilterConfig{Words: []string{"über", "c++", "foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"the über thing", "the **** thing"},
+		{"Über alles", "**** alles"},
+		{"the c++ thing", "the *** thing"},
+		{"c++", "***"},
+		{"foo foo", "*** ***"},
+		{"(foo)", "(***)"},
+		{"überall and foobar", "überall and foobar"}, // Not inside longer words
+		{"fooß", "fooß"},                             // A non-ASCII letter still joins the word
+		{"_foo", "_foo"},
+	}
+	for _, tt := range tests {
+		got, _, _ := filter.Apply(tt.text)
+		if got != tt.want {
+			t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestOutputFilterOverlappingWords(t *testing.T) {
+	tests := []struct {
+		words []string
+		text  string
+		want  string
+	}{
+		{[]string{"foo", "foobar"}, "a foobar b", "a ****** b"},
+		{[]string{"foobar", "foo"}, "a foobar b", "a ****** b"},
+		{[]string{"foo", "foobar"}, "a foo b", "a *** b"},
+		{[]string{"foo", "foobar"}, "a foobarx b", "a foobarx b"},
+		{[]string{"foo bar", "foo"}, "foo barx", "*** barx"},
+		{[]string{"foo", "foo bar"}, "foo bar", "*******"},
+		{[]string{"über", "überall"}, "Überall", "*******"},
+	}
+	for _, tt := range tests {
+		filter, err := compileOutputFilter(&OutputFilterConfig{Words: tt.words})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _, _ := filter.Apply(tt.text); got != tt.want {
+			t.Errorf("words %q: Apply(%q) = %q, want %q", tt.words, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestOutputFilterPatternsAndBlock(t *testing.T) {
+	filter, err := compileOutputFilter(&OutputFilterConfig{Patterns: []string{`(?i)\bguarantee[sd]?\b`}, Action: "block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "We guarantee it"
+	got, matches, blocked := filter.Apply(text)
+	if !blocked || matches != 1 || got != text {
+		t.Errorf("Apply(%q) = %q, %d, %v, want the text blocked with 1 match", text, got, matches, blocked)
+	}
+}
+
+func TestModerationFiltersWholeWords(t *testing.T) {
+	filters, err := compileModerationFilters(ModerationConfig{Categories: map[string]ModerationFilterConfig{
+		"harassment": {Words: []string{"über"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]bool{"the über thing": true, "überall": false} {
+		if got := filters["harassment"][0].MatchString(text); got != want {
+			t.Errorf("MatchString(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+// useConfig makes cfg the active config for the test
+func useConfig(t *testing.T, cfg *AppConfig) {
+	t.Helper()
+	previous := activeConfig.Load()
+	activeConfig.Store(cfg)
+	t.Cleanup(func() { activeConfig.Store(previous) })
+}
+
+// useFakeWin32 installs a fake Win32 API for the test
+func useFakeWin32(t *testing.T) *fakeWin32 {
+	t.Helper()
+	fake := newFakeWin32()
+	previous := win32
+	win32 = fake
+	t.Cleanup(func() { win32 = previous })
+	return fake
+}
+
+func TestHotkeyEdgeDetection(t *testing.T) {
+	fake := useFakeWin32(t)
+	hotkey, err := parseHotkey("Ctrl+Q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var edge hotkeyEdgeDetector
+	polls := []struct {
+		keys []uint16
+		want bool
+	}{
+		{nil, false},
+		{[]uint16{VK_CONTROL}, false},
+		{hotkey.Keys, true},
+		{hotkey.Keys, false}, // Held down: fires once
+		{hotkey.Keys, false},
+		{[]uint16{VK_CONTROL}, false},
+		{hotkey.Keys, true}, // Pressed again
+	}
+	for i, poll := range polls {
+		fake.SetKeys(poll.keys...)
+		if got := edge.Update(comboPressed(win32, hotkey.Keys...)); got != poll.want {
+			t.Errorf("poll %d with keys %v fired %v, want %v", i, poll.keys, got, poll.want)
+		}
+	}
+}
+
+func TestInsertionFallbackOrder(t *testing.T) {
+	t.Run("paste", func(t *testing.T) {
+		fake := useFakeWin32(t)
+		if err := sendTextCascade("hi"); err != nil {
+			t.Fatal(err)
+		}
+		if fake.Clipboard != "hi" || len(fake.Typed) != 0 || len(fake.Inputs) != 4 || fake.Inputs[1].Ki.WVk != 0x56 {
+			t.Errorf("want the text pasted with Ctrl+V, got clipboard %q, typed %q, %d inputs", fake.Clipboard, string(fake.Typed), len(fake.Inputs))
+		}
+	})
+
+	t.Run("window messages when the clipboard fails", func(t *testing.T) {
+		fake := useFakeWin32(t)
+		fake.WriteErr = errors.New("clipboard locked")
+		if err := sendTextCascade("hi"); err != nil {
+			t.Fatal(err)
+		}
+		if string(fake.Typed) != "hi" || len(fake.Inputs) != 0 {
+			t.Errorf("want the text sent as window messages, got typed %q, %d inputs", string(fake.Typed), len(fake.Inputs))
+		}
+	})
+
+	t.Run("typing without a foreground window", func(t *testing.T) {
+		fake := useFakeWin32(t)
+		fake.WriteErr = errors.New("clipboard locked")
+		fake.Foreground = 0
+		if err := sendTextCascade("hi"); err != nil {
+			t.Fatal(err)
+		}
+		var typed []rune
+		for _, input := range fake.Inputs {
+			typed = append(typed, rune(input.Ki.WScan))
+		}
+		if string(typed) != "hi" || len(fake.Typed) != 0 {
+			t.Errorf("want the text typed with SendInput, got %q typed and %q as messages", string(typed), string(fake.Typed))
+		}
+	})
+}
+
+func TestClipboardAIFlow(t *testing.T) {
+	fake := useFakeWin32(t)
+	fake.Clipboard = "The quick brown fox"
+	khoj := khojtest.NewFakeKhoj(t)
+	t.Setenv("KHOJ_API_BASE", khoj.URL)
+	t.Setenv("KHOJ_API_KEY", "khojtest")
+	previous := conversationID
+	conversationID = "c1"
+	t.Cleanup(func() { conversationID = previous })
+
+	events, unsubscribe := bus.Subscribe(topicClipboard)
+	defer unsubscribe()
+	processClipboardWithAI("Summarize this")
+
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev := <-events:
+			switch ev.Kind {
+			case "inserted":
+				done = true
+			case "failed", "blocked", "declined", "stopped":
+				t.Fatalf("clipboard AI ended with %s: %+v", ev.Kind, ev.Payload)
+			}
+		case <-timeout:
+			t.Fatal("clipboard AI did not insert an answer")
+		}
+	}
+
+	chats := khoj.ChatRequests()
+	if len(chats) != 1 || chats[0].ConversationID != "c1" || !strings.Contains(chats[0].Q, "The quick brown fox") || !strings.Contains(chats[0].Q, "Summarize this") {
+		t.Fatalf("want one request to c1 with the clipboard and the prompt, got %+v", chats)
+	}
+	if !strings.HasPrefix(fake.Clipboard, "fake answer to:") || len(fake.Inputs) != 4 {
+		t.Errorf("want the answer pasted with Ctrl+V, got clipboard %q and %d inputs", fake.Clipboard, len(fake.Inputs))
+	}
+}
+
+func TestClientMappingStore(t *testing.T) {
+	t.Chdir(t.TempDir())
+	khoj := khojtest.NewFakeKhoj(t)
+	legacy := `[{"client":"old","conversation_id":"c-old","created_at":"2020-01-01T00:00:00Z","last_used":"2020-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(legacyClientMappingsFile, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := &clientMappingStore{}
+	t.Cleanup(func() { store.closeLocked() })
+
+	first, err := store.ConversationFor(khoj.URL, "khojtest", "editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.ConversationFor(khoj.URL, "khojtest", "editor"); again != first {
+		t.Errorf("second request got conversation %q, want %q", again, first)
+	}
+	if _, err := os.Stat(legacyClientMappingsFile); !os.IsNotExist(err) {
+		t.Errorf("want %s removed after the import, got %v", legacyClientMappingsFile, err)
+	}
+
+	// Reopening reads the mappings back from the database
+	store.closeLocked()
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Client != "editor" || list[0].ConversationID != first || list[1].Client != "old" || list[1].ConversationID != "c-old" {
+		t.Fatalf("got mappings %+v, want editor then the imported old mapping", list)
+	}
+
+	previous := clientMappings
+	clientMappings = store
+	t.Cleanup(func() { clientMappings = previous })
+	useConfig(t, &AppConfig{ClientConversations: ClientConversationsConfig{GCAfterDays: 30, DeleteRemote: true}})
+
+	if n, err := collectClientMappings(khoj.URL, "khojtest"); err != nil || n != 1 {
+		t.Fatalf("collected %d mappings (%v), want the stale one", n, err)
+	}
+	deleted := false
+	for _, req := range khoj.Requests() {
+		if req.Method == "DELETE" && req.Path == "/api/chat/history" && strings.Contains(req.Query, "c-old") {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Error("want the stale Khoj conversation deleted")
+	}
+	if list, _ := store.List(); len(list) != 1 || list[0].Client != "editor" {
+		t.Errorf("got mappings %+v after cleanup, want only editor", list)
+	}
+}
+
+func TestTerminalInsertNotChunked(t *testing.T) {
+	fake := useFakeWin32(t)
+	fake.ForegroundClass = "ConsoleWindowClass"
+	useConfig(t, &AppConfig{Insertion: InsertionConfig{ChunkChars: 10}})
+
+	text := "echo one\n\necho two\n\necho three"
+	inserted, err := insertResponse(context.Background(), text, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := 0
+	for _, call := range fake.CallLog() {
+		if call == "WriteClipboard" {
+			writes++
+		}
+	}
+	if writes != 1 || fake.Clipboard != text || inserted != len(text) {
+		t.Errorf("want one paste of the whole answer, got %d clipboard writes, clipboard %q", writes, fake.Clipboard)
+	}
+}
+
+// TestPostProcessHelper is the post-process command of TestPostProcessNoisyStderr, run from the test binary
+func TestPostProcessHelper(t *testing.T) {
+	if os.Getenv("KHOJ_POST_PROCESS_HELPER") != "1" {
+		t.Skip("only run as a post-process command")
+	}
+	os.Stderr.WriteString(strings.Repeat("progress\n", 1000))
+	io.Copy(os.Stdout, os.Stdin)
+	os.Exit(0)
+}
+
+func TestPostProcessNoisyStderr(t *testing.T) {
+	cfg := &PostProcessConfig{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^TestPostProcessHelper$"},
+		Env:     map[string]string{"KHOJ_POST_PROCESS_HELPER": "1"},
+	}
+	got, err := runPostProcess(context.Background(), cfg, "the answer")
+	if err != nil || got != "the answer" {
+		t.Errorf("runPostProcess = %q, %v, want the answer despite 9 KB on stderr", got, err)
+	}
+}
+
+func TestLiveSettingsSwapWhileReading(t *testing.T) {
+	useConfig(t, &AppConfig{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = len(appConfig().Templates)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		applyLiveSettings(&AppConfig{Templates: []TemplateConfig{{Name: "fix"}}, Hotkey: "Ctrl+Q"})
+	}
+	<-done
+	if got := appConfig().Templates; len(got) != 1 || got[0].Name != "fix" {
+		t.Errorf("templates %+v after the swap, want fix", got)
+	}
+}
+
+func TestMCPExitOfReplacedSession(t *testing.T) {
+	old := &MCPSession{Name: "files"}
+	live := &MCPSession{Name: "files", Tools: []MCPTool{{Name: "read"}}}
+	m := &MCPToolManager{
+		Sessions: map[string]*MCPSession{"files": live},
+		Status:   map[string]*MCPServerStatus{"files": {Name: "files", State: "running", Tools: 1}},
+	}
+
+	m.handleExit(old, time.Now(), errors.New("killed"))
+	if m.Sessions["files"] != live || m.Status["files"].State != "running" || m.Status["files"].Crashes != 0 {
+		t.Errorf("late exit of a replaced session changed the live one: sessions %v, status %+v", m.Sessions, *m.Status["files"])
+	}
+
+	live.stopped = true
+	m.handleExit(live, time.Now(), nil)
+	if _, ok := m.Sessions["files"]; ok || m.Status["files"].State != "stopped" {
+		t.Errorf("exit of the live session left sessions %v, status %+v", m.Sessions, *m.Status["files"])
+	}
+}
+
+func TestRecoveredAnswersSurviveRestart(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Cleanup(func() { transcripts.Forget("conv-1") })
+	journal := `{"id":"s1","time":"2026-01-02T03:04:05Z","conversation_id":"conv-1","sent":"question"}
+{"id":"s1","delta":"half an "}
+{"id":"s1","delta":"answer"}
+`
+	if err := os.WriteFile(streamJournalFile, []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	(&streamJournalWriter{}).Recover()
+	if data, _ := os.ReadFile(streamJournalFile); len(data) != 0 {
+		t.Errorf("journal not emptied after recovery: %q", data)
+	}
+
+	// The next start has an empty journal and a fresh transcript
+	transcripts.Forget("conv-1")
+	(&streamJournalWriter{}).Recover()
+	got := transcripts.Exchanges("conv-1")
+	if len(got) != 1 || got[0].Received != "half an answer" || !got[0].Interrupted {
+		t.Fatalf("transcript after restart %+v, want the interrupted answer", got)
+	}
+}
+
+func TestTeamOverlayExpiry(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(overlay string) []byte {
+		data, _ := json.Marshal(signedTeamOverlay{Overlay: json.RawMessage(overlay), Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(overlay)))})
+		return data
+	}
+
+	for name, tc := range map[string]struct {
+		overlay string
+		ok      bool
+	}{
+		"current":    {`{"version":"2","expires":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`, true},
+		"expired":    {`{"version":"1","expires":"` + time.Now().Add(-time.Hour).Format(time.RFC3339) + `"}`, false},
+		"no expires": {`{"version":"1"}`, false},
+	} {
+		if _, err := verifyTeamOverlay(sign(tc.overlay), public); (err == nil) != tc.ok {
+			t.Errorf("%s: verify error %v, want ok %v", name, err, tc.ok)
+		}
+	}
+}
+
+func TestTeamDenyChecksAttachedFiles(t *testing.T) {
+	policy, err := compileTeamOverlay(TeamOverlay{Deny: []TeamDenyRule{{Pattern: "(?i)password"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeTeamMu.Lock()
+	activeTeam = policy
+	activeTeamMu.Unlock()
+	t.Cleanup(func() {
+		activeTeamMu.Lock()
+		activeTeam = nil
+		activeTeamMu.Unlock()
+	})
+
+	req := &KhojRequest{Q: "summarize this", Files: []KhojFile{{Name: "notes.txt", Content: "the password is hunter2"}}}
+	var denied *teamDeniedError
+	if err := checkTeamDenyRequest(context.Background(), req); !errors.As(err, &denied) {
+		t.Errorf("attached file with a denied word got %v, want a team policy error", err)
+	}
+	req.Files[0].Content = "nothing secret"
+	if err := checkTeamDenyRequest(context.Background(), req); err != nil {
+		t.Errorf("clean request got %v", err)
+	}
+}
+
+func TestRuneChunksKeepCharactersWhole(t *testing.T) {
+	text := strings.Repeat("añ€😀", 20)
+	chunks := runeChunks(text, 5)
+	if got := strings.Join(chunks, ""); got != text {
+		t.Fatalf("joined chunks %q, want %q", got, text)
+	}
+	for i, chunk := range chunks {
+		if !utf8.ValidString(chunk) || len(chunk) > 5+utf8.UTFMax-1 {
+			t.Errorf("chunk %d = %q is not whole characters of about 5 bytes", i, chunk)
+		}
+	}
+}
+
+func TestSchedulerKeepsLastSlotForInteractive(t *testing.T) {
+	if s := newRequestScheduler(PriorityConfig{MaxConcurrent: 2, MaxBackground: 2}); s.bgLimit != 1 {
+		t.Errorf("background limit %d with 2 slots, want 1", s.bgLimit)
+	}
+}
+
+func TestSchedulerPreemptsOnlyBetweenKhojCalls(t *testing.T) {
+	s := newRequestScheduler(PriorityConfig{MaxConcurrent: 2})
+	inCall, finishCall := make(chan struct{}), make(chan struct{})
+	cutOff := make(chan bool, 1)
+	attempts := 0
+	bgDone := make(chan error, 1)
+	go func() {
+		bgDone <- s.Run(context.Background(), classBackground, func(ctx context.Context) error {
+			if attempts++; attempts > 1 {
+				return nil
+			}
+			done := trackKhojCall(ctx)
+			close(inCall)
+			<-finishCall
+			cutOff <- ctx.Err() != nil
+			done()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	<-inCall
+
+	hold := make(chan struct{})
+	defer close(hold)
+	go s.Run(context.Background(), classInteractive, func(context.Context) error { <-hold; return nil })
+	ran := make(chan struct{})
+	go s.Run(context.Background(), classInteractive, func(context.Context) error { close(ran); return nil })
+
+	time.Sleep(50 * time.Millisecond)
+	close(finishCall)
+	if <-cutOff {
+		t.Error("background request was cancelled while Khoj was answering it")
+	}
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("interactive request never got the background request's slot")
+	}
+	if err := <-bgDone; err != nil || attempts != 2 {
+		t.Errorf("background request ended with %v after %d attempt(s), want requeued and run again", err, attempts)
+	}
+}
@@ -0,0 +1,452 @@
+// Package khojtest provides integration test fixtures for the Khoj wrapper: a fake Khoj server
+// with configurable latency and error injection, and a helper that runs the wrapper binary
+// against it on a random port. Chat requests with stream=true are answered in Khoj's streaming
+// format, one word per event. Prompts starting with /image get a generated image instead of an answer.
+//
+//	khoj := khojtest.NewFakeKhoj(t)
+//	khoj.SetLatency(200 * time.Millisecond)
+//	khoj.FailNext("/api/chat", http.StatusBadGateway, 1)
+//
+//	wrapper := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{})
+//	resp, err := http.Post(wrapper.URL+"/v1/chat/completions", "application/json", body)
+package khojtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Request is a request received by the fake Khoj server
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+// ChatRequest is the body the wrapper sends to /api/chat
+type ChatRequest struct {
+	Q              string `json:"q"`
+	ConversationID string `json:"conversation_id"`
+	Stream         bool   `json:"stream"`
+	ClientID       string `json:"client_id"`
+	Agent          string `json:"agent"`
+}
+
+// Responder produces the answer text for a chat request
+type Responder func(req ChatRequest) string
+
+// injectedError is a scripted failure for one path
+type injectedError struct {
+	status    int
+	remaining int // Negative means every request
+}
+
+// Agent is an agent listed by the fake's /api/agents
+type Agent struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	Creator   string `json:"creator,omitempty"`
+	ChatModel string `json:"chat_model,omitempty"`
+}
+
+// FakeKhoj is a fake Khoj server covering the endpoints the wrapper calls: chat, sessions, chat history, share,
+// content indexing, agents, speech and generated images
+type FakeKhoj struct {
+	// URL is the base URL to use as KHOJ_API_BASE
+	URL string
+
+	server *httptest.Server
+
+	mu          sync.Mutex
+	latency     map[string]time.Duration
+	errors      map[string]*injectedError
+	responder   Responder
+	requests    []Request
+	sessions    int
+	streamDelay time.Duration
+	agents      []Agent
+	indexed     map[string]bool // Documents uploaded to /api/content, by name
+	deleted     map[string]bool // Conversations deleted through /api/chat/history or DeleteConversation
+	imageBase   string          // Where generated images are linked; the fake itself when empty
+}
+
+// EventDelimiter ends each event in Khoj's chat stream
+const EventDelimiter = "␃🔚␗"
+
+// NewFakeKhoj starts a fake Khoj server that is closed when the test ends
+func NewFakeKhoj(t testing.TB) *FakeKhoj {
+	t.Helper()
+
+	f := &FakeKhoj{
+		latency: make(map[string]time.Duration),
+		errors:  make(map[string]*injectedError),
+		responder: func(req ChatRequest) string {
+			return "fake answer to: " + lastLine(req.Q)
+		},
+		agents:  []Agent{{Slug: "khoj", Name: "Khoj", Creator: "khoj"}},
+		indexed: make(map[string]bool),
+		deleted: make(map[string]bool),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.URL = f.server.URL
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// SetLatency delays every response by d
+func (f *FakeKhoj) SetLatency(d time.Duration) {
+	f.SetPathLatency("", d)
+}
+
+// SetPathLatency delays responses for one path, such as "/api/chat"; an empty path sets the default
+func (f *FakeKhoj) SetPathLatency(path string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency[path] = d
+}
+
+// FailNext makes the next n requests to path fail with status; n < 0 fails until ClearErrors
+func (f *FakeKhoj) FailNext(path string, status, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[path] = &injectedError{status: status, remaining: n}
+}
+
+// ClearErrors removes all injected errors
+func (f *FakeKhoj) ClearErrors() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = make(map[string]*injectedError)
+}
+
+// SetResponder replaces the function that produces chat answers
+func (f *FakeKhoj) SetResponder(r Responder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responder = r
+}
+
+// SetStreamDelay pauses between the words of streamed answers. Like Khoj, a non-streamed answer is only sent once
+// all of it is written, after the same pauses.
+func (f *FakeKhoj) SetStreamDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streamDelay = d
+}
+
+// SetAgents replaces the agents listed by /api/agents; by default only "khoj" is listed
+func (f *FakeKhoj) SetAgents(agents ...Agent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.agents = append([]Agent(nil), agents...)
+}
+
+// SetImageBase links generated images under base instead of the fake itself, as servers that keep images in
+// object storage do
+func (f *FakeKhoj) SetImageBase(base string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.imageBase = base
+}
+
+// DeleteConversation makes Khoj forget a conversation, as if it was deleted in Khoj's web app: chat requests to
+// it and its history answer 404
+func (f *FakeKhoj) DeleteConversation(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted[id] = true
+}
+
+// Requests returns a copy of every request received so far, in order
+func (f *FakeKhoj) Requests() []Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Request(nil), f.requests...)
+}
+
+// IndexedFiles returns the names of the documents indexed through /api/content and not deleted since, sorted
+func (f *FakeKhoj) IndexedFiles() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.indexed))
+	for name := range f.indexed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ChatRequests returns the decoded bodies of the /api/chat requests received so far
+func (f *FakeKhoj) ChatRequests() []ChatRequest {
+	var chats []ChatRequest
+	for _, req := range f.Requests() {
+		if req.Path != "/api/chat" {
+			continue
+		}
+		var chat ChatRequest
+		if err := json.Unmarshal(req.Body, &chat); err == nil {
+			chats = append(chats, chat)
+		}
+	}
+	return chats
+}
+
+func (f *FakeKhoj) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	f.requests = append(f.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	delay, ok := f.latency[r.URL.Path]
+	if !ok {
+		delay = f.latency[""]
+	}
+	var failStatus int
+	if inj := f.errors[r.URL.Path]; inj != nil && inj.remaining != 0 {
+		failStatus = inj.status
+		if inj.remaining > 0 {
+			inj.remaining--
+		}
+	}
+	responder := f.responder
+	streamDelay := f.streamDelay
+	agents := f.agents
+	f.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if failStatus != 0 {
+		http.Error(w, fmt.Sprintf("injected error %d", failStatus), failStatus)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/api/chat/sessions":
+		f.mu.Lock()
+		f.sessions++
+		id := fmt.Sprintf("fake-conversation-%d", f.sessions)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"conversation_id": id})
+
+	case r.URL.Path == "/api/chat/share" && r.Method == http.MethodPost:
+		id := r.URL.Query().Get("conversation_id")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "url": f.URL + "/share/chat/" + id + "/"})
+
+	case r.URL.Path == "/api/chat/share" && r.Method == http.MethodDelete:
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	case r.URL.Path == "/api/chat/history":
+		id := r.URL.Query().Get("conversation_id")
+		f.mu.Lock()
+		deleted := f.deleted[id]
+		if r.Method == http.MethodDelete {
+			f.deleted[id] = true
+		}
+		f.mu.Unlock()
+		if deleted {
+			http.Error(w, `{"detail": "Conversation not found"}`, http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "ok",
+			"response": map[string]interface{}{"conversation_id": id, "chat": []interface{}{}},
+		})
+
+	case r.URL.Path == "/api/agents":
+		json.NewEncoder(w).Encode(agents)
+
+	case r.URL.Path == "/api/chat/speech":
+		w.Header().Set("Content-Type", "audio/mpeg")
+		fmt.Fprint(w, SpeechAudio(r.URL.Query().Get("text")))
+
+	case strings.HasPrefix(r.URL.Path, "/generated/"):
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, GeneratedImage(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/generated/"), ".png")))
+
+	case r.URL.Path == "/api/content":
+		names := uploadedNames(r.Header.Get("Content-Type"), body)
+		f.mu.Lock()
+		for _, name := range names {
+			f.indexed[name] = true
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	case r.URL.Path == "/api/content/computer":
+		json.NewEncoder(w).Encode(f.IndexedFiles())
+
+	case r.URL.Path == "/api/content/file" && r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.indexed, r.URL.Query().Get("filename"))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	case r.URL.Path == "/api/chat":
+		var chat ChatRequest
+		if err := json.Unmarshal(body, &chat); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		deleted := f.deleted[chat.ConversationID]
+		imageBase := f.imageBase
+		f.mu.Unlock()
+		if imageBase == "" {
+			imageBase = f.URL
+		}
+		if deleted {
+			http.Error(w, `{"detail": "Conversation not found"}`, http.StatusNotFound)
+			return
+		}
+		if prompt, ok := strings.CutPrefix(chat.Q, "/image "); ok {
+			imageURL := imageBase + "/generated/" + url.PathEscape(prompt) + ".png"
+			if chat.Stream {
+				streamImage(w, imageURL, chat.ConversationID)
+				return
+			}
+			// The non-streaming format of older servers
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"image":           imageURL,
+				"intentType":      "text-to-image2",
+				"inferredQueries": []string{prompt},
+				"conversation_id": chat.ConversationID,
+			})
+			return
+		}
+		answer := responder(chat)
+		if chat.Stream {
+			streamAnswer(w, r, answer, chat.ConversationID, streamDelay)
+			return
+		}
+		if streamDelay > 0 {
+			select {
+			case <-time.After(time.Duration(len(strings.SplitAfter(answer, " "))) * streamDelay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"response":        answer,
+			"conversation_id": chat.ConversationID,
+			"created_by":      "khoj",
+			"by_khoj":         true,
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamAnswer writes an answer the way Khoj streams it: JSON events for the start, end and metadata, and the
+// answer itself as plain text chunks, each followed by EventDelimiter
+func streamAnswer(w http.ResponseWriter, r *http.Request, answer, conversationID string, delay time.Duration) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(event string) {
+		fmt.Fprint(w, event+EventDelimiter)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	sendEvent := func(kind string, data interface{}) {
+		event, _ := json.Marshal(map[string]interface{}{"type": kind, "data": data})
+		send(string(event))
+	}
+
+	sendEvent("start_llm_response", "")
+	for _, word := range strings.SplitAfter(answer, " ") {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		send(word)
+	}
+	sendEvent("end_llm_response", "")
+	sendEvent("metadata", map[string]string{"conversationId": conversationID})
+	sendEvent("end_response", "")
+}
+
+// streamImage streams a generated image the way Khoj does, as a generated assets event
+func streamImage(w http.ResponseWriter, imageURL, conversationID string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, ev := range []map[string]interface{}{
+		{"type": "status", "data": "Painting a picture"},
+		{"type": "generated_assets", "data": map[string][]string{"images": {imageURL}}},
+		{"type": "metadata", "data": map[string]string{"conversationId": conversationID}},
+		{"type": "end_response", "data": ""},
+	} {
+		event, _ := json.Marshal(ev)
+		fmt.Fprint(w, string(event)+EventDelimiter)
+	}
+}
+
+// GeneratedImage is the fake image the fake serves for an /image prompt
+func GeneratedImage(prompt string) string {
+	return "\x89PNG fake image: " + prompt
+}
+
+// SpeechAudio is the fake audio /api/chat/speech returns for text
+func SpeechAudio(text string) string {
+	return "ID3 fake speech: " + text
+}
+
+// uploadedNames returns the file names of a multipart /api/content upload
+func uploadedNames(contentType string, body []byte) []string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return nil
+	}
+	var names []string
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return names
+		}
+		// Not part.FileName, which drops the directories Khoj keeps in document names
+		_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if part.FormName() == "files" && disposition["filename"] != "" {
+			names = append(names, disposition["filename"])
+		}
+	}
+}
+
+// lastLine returns the last non-empty line of a prompt, which is the newest message
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
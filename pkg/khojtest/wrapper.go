@@ -0,0 +1,251 @@
+package khojtest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// WrapperOptions configures a wrapper started by StartWrapper
+type WrapperOptions struct {
+	// Binary is a prebuilt wrapper executable; when empty the wrapper is built from ModuleDir
+	Binary string
+
+	// ModuleDir is the wrapper's module root; when empty it is searched for upwards from the working directory
+	ModuleDir string
+
+	// Config is written to config.json in the wrapper's working directory when non-empty
+	Config string
+
+	// ConversationID is passed as -conversation-id; when empty the wrapper creates one through the fake
+	ConversationID string
+
+	// Env holds extra KEY=VALUE entries for the wrapper process
+	Env []string
+
+	// StartTimeout bounds the wait for /health; defaults to 15 seconds
+	StartTimeout time.Duration
+}
+
+// Wrapper is a running wrapper process bound to a random local port
+type Wrapper struct {
+	// URL is the wrapper's base URL, e.g. http://127.0.0.1:54321
+	URL string
+
+	// Dir is the wrapper's working directory, holding conversation_state.json and config.json
+	Dir string
+
+	cmd  *exec.Cmd
+	logs *syncBuffer
+	done chan struct{}
+}
+
+var (
+	buildMu    sync.Mutex
+	buildCache = make(map[string]string) // Module dir -> built binary
+)
+
+// StartWrapper runs the wrapper's headless server against khoj and stops it when the test ends
+func StartWrapper(t testing.TB, khoj *FakeKhoj, opts WrapperOptions) *Wrapper {
+	t.Helper()
+
+	binary := opts.Binary
+	if binary == "" {
+		var err error
+		if binary, err = buildWrapper(opts.ModuleDir); err != nil {
+			t.Fatalf("khojtest: %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+	if opts.Config != "" {
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(opts.Config), 0644); err != nil {
+			t.Fatalf("khojtest: failed to write config: %v", err)
+		}
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("khojtest: %v", err)
+	}
+
+	args := []string{"serve"}
+	if opts.ConversationID != "" {
+		args = []string{"-conversation-id", opts.ConversationID, "serve"}
+	}
+
+	w := &Wrapper{
+		URL:  fmt.Sprintf("http://127.0.0.1:%d", port),
+		Dir:  dir,
+		logs: &syncBuffer{},
+		done: make(chan struct{}),
+	}
+	w.cmd = exec.Command(binary, args...)
+	w.cmd.Dir = dir
+	w.cmd.Stdout = w.logs
+	w.cmd.Stderr = w.logs
+	w.cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PORT=%d", port),
+		"KHOJ_API_BASE="+khoj.URL,
+		"KHOJ_API_KEY=khojtest",
+	)
+	w.cmd.Env = append(w.cmd.Env, opts.Env...)
+
+	if err := w.cmd.Start(); err != nil {
+		t.Fatalf("khojtest: failed to start wrapper: %v", err)
+	}
+	go func() {
+		w.cmd.Wait()
+		close(w.done)
+	}()
+	t.Cleanup(func() {
+		w.Stop()
+		if t.Failed() {
+			t.Logf("khojtest: wrapper logs:\n%s", w.Logs())
+		}
+	})
+
+	timeout := opts.StartTimeout
+	if timeout == 0 {
+		timeout = 15 * time.Second
+	}
+	if err := w.waitHealthy(timeout); err != nil {
+		t.Fatalf("khojtest: %v\n%s", err, w.Logs())
+	}
+	return w
+}
+
+// Logs returns everything the wrapper has written to stdout and stderr
+func (w *Wrapper) Logs() string {
+	return w.logs.String()
+}
+
+// Stop interrupts the wrapper, killing it if it does not exit within five seconds
+func (w *Wrapper) Stop() {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	// Windows cannot deliver os.Interrupt to another process
+	if runtime.GOOS == "windows" || w.cmd.Process.Signal(os.Interrupt) != nil {
+		w.cmd.Process.Kill()
+	}
+	select {
+	case <-w.done:
+	case <-time.After(5 * time.Second):
+		w.cmd.Process.Kill()
+		<-w.done
+	}
+}
+
+func (w *Wrapper) waitHealthy(timeout time.Duration) error {
+	client := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-w.done:
+			return fmt.Errorf("wrapper exited during startup")
+		default:
+		}
+		resp, err := client.Get(w.URL + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("wrapper not healthy after %v", timeout)
+}
+
+// buildWrapper compiles the wrapper once per module directory and test process
+func buildWrapper(moduleDir string) (string, error) {
+	if moduleDir == "" {
+		var err error
+		if moduleDir, err = findModuleDir(); err != nil {
+			return "", err
+		}
+	}
+
+	buildMu.Lock()
+	defer buildMu.Unlock()
+	if binary, ok := buildCache[moduleDir]; ok {
+		return binary, nil
+	}
+
+	out, err := os.MkdirTemp("", "khojtest-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create build directory: %w", err)
+	}
+	binary := filepath.Join(out, "khoj-wrapper")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+
+	cmd := exec.Command("go", "build", "-o", binary, ".")
+	cmd.Dir = moduleDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to build wrapper: %w\n%s", err, output)
+	}
+	buildCache[moduleDir] = binary
+	return binary, nil
+}
+
+// findModuleDir walks up from the working directory to the wrapper's go.mod
+func findModuleDir() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %w", err)
+	}
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil && strings.Contains(string(data), "module khoj-provider") {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("wrapper module not found; set WrapperOptions.ModuleDir or Binary")
+		}
+		dir = parent
+	}
+}
+
+// freePort asks the OS for an unused local TCP port
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes from the process pipes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
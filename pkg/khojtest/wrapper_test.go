@@ -0,0 +1,521 @@
+package khojtest_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"khoj-provider/pkg/khojtest"
+)
+
+// chatCompletion posts one user message to the wrapper and returns the answer
+func chatCompletion(t *testing.T, w *khojtest.Wrapper, content string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":    "khoj",
+		"messages": []map[string]string{{"role": "user", "content": content}},
+	})
+	resp, err := http.Post(w.URL+"/v1/chat/completions", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat completion answered %d", resp.StatusCode)
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(completion.Choices))
+	}
+	return completion.Choices[0].Message.Content
+}
+
+func TestChatCompletion(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	if got := chatCompletion(t, w, "hello"); !strings.Contains(got, "fake answer to: user: hello") {
+		t.Errorf("got answer %q", got)
+	}
+	chats := khoj.ChatRequests()
+	if len(chats) != 1 || chats[0].ConversationID != "c1" {
+		t.Errorf("want one Khoj request to c1, got %+v", chats)
+	}
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+	khoj.FailNext("/api/chat", http.StatusBadGateway, 1)
+
+	if got := chatCompletion(t, w, "hello"); !strings.Contains(got, "fake answer to: user: hello") {
+		t.Errorf("got answer %q", got)
+	}
+	if chats := khoj.ChatRequests(); len(chats) != 2 {
+		t.Errorf("got %d Khoj requests, want the failed one and its retry", len(chats))
+	}
+}
+
+func TestRepairsLostConversation(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	khoj.DeleteConversation("c1")
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	if got := chatCompletion(t, w, "hello"); !strings.Contains(got, "fake answer to: user: hello") {
+		t.Errorf("got answer %q", got)
+	}
+	chats := khoj.ChatRequests()
+	if len(chats) != 2 || chats[0].ConversationID != "c1" || chats[1].ConversationID == "c1" {
+		t.Fatalf("want a rejected request to c1 and a retry in a new conversation, got %+v", chats)
+	}
+	newID := chats[1].ConversationID
+
+	data, err := os.ReadFile(filepath.Join(w.Dir, "conversation_state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state struct {
+		LastConversationID string `json:"last_conversation_id"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.LastConversationID != newID {
+		t.Errorf("saved conversation %q, want %q", state.LastConversationID, newID)
+	}
+
+	// Later requests go straight to the new conversation
+	chatCompletion(t, w, "again")
+	if chats := khoj.ChatRequests(); len(chats) != 3 || chats[2].ConversationID != newID {
+		t.Errorf("want the next request sent to %s, got %+v", newID, chats)
+	}
+	if n := strings.Count(w.Logs(), "Khoj AI - Conversation Repaired"); n != 1 {
+		t.Errorf("notified %d times, want once", n)
+	}
+}
+
+// completionUsage posts a chat completion, streamed or not, and returns the content and its completion_tokens
+func completionUsage(t *testing.T, w *khojtest.Wrapper, req map[string]interface{}) (string, int) {
+	t.Helper()
+	req["model"] = "khoj"
+	req["messages"] = []map[string]string{{"role": "user", "content": "count"}}
+	stream, _ := req["stream"].(bool)
+	if stream {
+		req["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(w.URL+"/v1/chat/completions", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat completion answered %d", resp.StatusCode)
+	}
+
+	type usage struct {
+		CompletionTokens int `json:"completion_tokens"`
+	}
+	if !stream {
+		var completion struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+			Usage usage `json:"usage"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+		return completion.Choices[0].Message.Content, completion.Usage.CompletionTokens
+	}
+
+	var content strings.Builder
+	tokens := -1
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *usage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("bad chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+		}
+		if chunk.Usage != nil {
+			tokens = chunk.Usage.CompletionTokens
+		}
+	}
+	if tokens < 0 {
+		t.Fatal("stream ended without usage")
+	}
+	return content.String(), tokens
+}
+
+func TestUsageCountsReturnedContent(t *testing.T) {
+	const answer = "one two three STOP four five"
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	for _, stream := range []bool{false, true} {
+		tests := []struct {
+			name string
+			req  map[string]interface{}
+		}{
+			{"stop", map[string]interface{}{"stop": " STOP"}},
+			{"max_tokens", map[string]interface{}{"max_tokens": 2}},
+		}
+		for _, tt := range tests {
+			khoj.SetResponder(func(khojtest.ChatRequest) string { return answer })
+			tt.req["stream"] = stream
+			content, tokens := completionUsage(t, w, tt.req)
+			if content == "" || content == answer {
+				t.Fatalf("%s (stream %v): got content %q, want the answer cut", tt.name, stream, content)
+			}
+
+			// The same text answered in full must count the same
+			khoj.SetResponder(func(khojtest.ChatRequest) string { return content })
+			control, want := completionUsage(t, w, map[string]interface{}{"stream": stream})
+			if control != content {
+				t.Fatalf("%s (stream %v): control answered %q, want %q", tt.name, stream, control, content)
+			}
+			if tokens != want || tokens >= 7 {
+				t.Errorf("%s (stream %v): %q counted %d completion tokens, want %d", tt.name, stream, content, tokens, want)
+			}
+		}
+	}
+}
+
+func TestUsageOfBlockedAnswer(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	khoj.SetResponder(func(khojtest.ChatRequest) string { return "one two three four five" })
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{
+		ConversationID: "c1",
+		Config:         `{"output_filter": {"words": ["three"], "action": "block"}}`,
+	})
+
+	for _, stream := range []bool{false, true} {
+		if content, tokens := completionUsage(t, w, map[string]interface{}{"stream": stream}); content != "" || tokens != 0 {
+			t.Errorf("stream %v: got %q with %d completion tokens, want nothing returned or counted", stream, content, tokens)
+		}
+	}
+}
+
+func TestForwardsZeroSampling(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+	completionUsage(t, w, map[string]interface{}{"temperature": 0, "top_p": 0})
+	completionUsage(t, w, map[string]interface{}{})
+
+	var bodies []map[string]interface{}
+	for _, req := range khoj.Requests() {
+		if req.Path != "/api/chat" {
+			continue
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(req.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("got %d Khoj requests, want 2", len(bodies))
+	}
+	for _, field := range []string{"temperature", "top_p"} {
+		if v, ok := bodies[0][field]; !ok || v != 0.0 {
+			t.Errorf("%s sent as %v (%v), want 0", field, v, ok)
+		}
+		if v, ok := bodies[1][field]; ok {
+			t.Errorf("%s sent as %v without being set", field, v)
+		}
+	}
+}
+
+func TestImageDownloadGuardsPrivateAddresses(t *testing.T) {
+	var hits atomic.Int32
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(khojtest.GeneratedImage("secret")))
+	}))
+	defer private.Close()
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	generate := func() (int, string) {
+		body := `{"prompt": "a fox", "response_format": "b64_json"}`
+		resp, err := http.Post(w.URL+"/v1/images/generations", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var images struct {
+			Data []struct {
+				B64JSON string `json:"b64_json"`
+			} `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&images)
+		if len(images.Data) != 1 {
+			return resp.StatusCode, ""
+		}
+		return resp.StatusCode, images.Data[0].B64JSON
+	}
+
+	// Images on the Khoj server itself are downloaded directly
+	if status, b64 := generate(); status != http.StatusOK || b64 == "" {
+		t.Errorf("got status %d and image %q from the Khoj server, want the image", status, b64)
+	}
+
+	// Anywhere else the url_fetch guards refuse private addresses
+	khoj.SetImageBase(private.URL)
+	if status, _ := generate(); status != http.StatusBadGateway || hits.Load() != 0 {
+		t.Errorf("got status %d and %d requests to the private address, want 502 and none", status, hits.Load())
+	}
+}
+
+// uploadFile posts a multipart upload with extra form fields and returns the response
+func uploadFile(t *testing.T, url, name, content string, fields map[string]string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	part, _ := form.CreateFormFile("file", name)
+	part.Write([]byte(content))
+	form.Close()
+	req, _ := http.NewRequest(http.MethodPost, url, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Khoj-Dashboard", "1") // Needed by the drop window, ignored by /v1/files
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDeletingAPIFileKeepsOtherIndexedDocuments(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+	const content = "The handbook lists ten holidays."
+
+	resp := uploadFile(t, w.URL+"/drop/api/files", "notes.md", content, map[string]string{"action": "index"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("drop upload answered %d", resp.StatusCode)
+	}
+
+	resp = uploadFile(t, w.URL+"/v1/files", "copy.md", content, map[string]string{"purpose": "assistants"})
+	var file struct {
+		ID    string `json:"id"`
+		XKhoj struct {
+			IndexedAs string `json:"indexed_as"`
+		} `json:"x_khoj"`
+	}
+	json.NewDecoder(resp.Body).Decode(&file)
+	resp.Body.Close()
+	if file.XKhoj.IndexedAs != "notes.md" {
+		t.Fatalf("upload indexed as %q, want the dropped notes.md", file.XKhoj.IndexedAs)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, w.URL+"/v1/files/"+file.ID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete answered %d", resp.StatusCode)
+	}
+	if indexed := khoj.IndexedFiles(); len(indexed) != 1 || indexed[0] != "notes.md" {
+		t.Errorf("Khoj holds %q after the delete, want the dropped notes.md kept", indexed)
+	}
+}
+
+func TestFilesAPIFollowsFileTools(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1", Config: `{"features": {"file_tools": false}}`})
+
+	resp := uploadFile(t, w.URL+"/v1/files", "notes.md", "hello", map[string]string{"purpose": "assistants"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || len(khoj.IndexedFiles()) != 0 {
+		t.Errorf("upload with file_tools off answered %d and indexed %q, want 404 and nothing", resp.StatusCode, khoj.IndexedFiles())
+	}
+}
+
+func TestShrunkAttachmentIsSentAgain(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1", Config: `{"token_budget": {"default": 300}}`})
+
+	resp := uploadFile(t, w.URL+"/v1/files", "handbook.md", strings.Repeat("Holidays are listed per region.\n", 200), map[string]string{"purpose": "assistants"})
+	var file struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&file)
+	resp.Body.Close()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"model": "khoj",
+		"messages": []map[string]interface{}{{"role": "user", "content": []map[string]interface{}{
+			{"type": "text", "text": "Which holidays are listed?"},
+			{"type": "file", "file": map[string]string{"file_id": file.ID}},
+		}}},
+	})
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(w.URL+"/v1/chat/completions", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("chat completion answered %d", resp.StatusCode)
+		}
+	}
+
+	var attached []int
+	for _, req := range khoj.Requests() {
+		if req.Path != "/api/chat" {
+			continue
+		}
+		var chat struct {
+			Files []struct {
+				Content string `json:"content"`
+			} `json:"files"`
+		}
+		json.Unmarshal(req.Body, &chat)
+		attached = append(attached, len(chat.Files))
+	}
+	if len(attached) != 2 || attached[0] != 1 || attached[1] != 1 {
+		t.Errorf("files attached per Khoj request %v, want the truncated file sent both times", attached)
+	}
+}
+
+func TestLineEditUsesThrowawayConversation(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	khoj.SetResponder(func(khojtest.ChatRequest) string { return "```\nfixed\n```" })
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	body := `{"filename": "main.go", "text": "a\nb\nc\n", "start": 2, "end": 2, "instruction": "fix it"}`
+	resp, err := http.Post(w.URL+"/v1/edits/lines", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("line edit answered %d", resp.StatusCode)
+	}
+
+	chats := khoj.ChatRequests()
+	if len(chats) != 1 || chats[0].ConversationID == "c1" {
+		t.Fatalf("line edit sent %+v, want one request outside the main conversation", chats)
+	}
+	deleted := false
+	for _, req := range khoj.Requests() {
+		if req.Method == http.MethodDelete && req.Path == "/api/chat/history" && strings.Contains(req.Query, chats[0].ConversationID) {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Errorf("edit conversation %s was not deleted", chats[0].ConversationID)
+	}
+}
+
+func TestHedgeWaitsForSlowAnswerKhojIsWriting(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	khoj.SetResponder(func(khojtest.ChatRequest) string { return "a slow but steady answer" })
+	khoj.SetStreamDelay(50 * time.Millisecond)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1", Config: `{"hedge": {"enabled": true, "delay": "100ms"}}`})
+
+	if got := chatCompletion(t, w, "question"); got != "a slow but steady answer" {
+		t.Errorf("answer %q", got)
+	}
+	if chats := khoj.ChatRequests(); len(chats) != 1 {
+		t.Errorf("Khoj got %d copies of a request it was answering, want 1", len(chats))
+	}
+}
+
+func TestDashboardRejectsForeignHost(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	req, _ := http.NewRequest(http.MethodGet, w.URL+"/dashboard/api/instructions", nil)
+	req.Host = "rebind.example.com" + w.URL[strings.LastIndex(w.URL, ":"):]
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request for another host answered %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestDashboardInstructionsAnswerWrittenConversation(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1"})
+
+	req, _ := http.NewRequest(http.MethodPut, w.URL+"/dashboard/api/instructions", strings.NewReader(`{"conversation_id": "other", "instructions": "Be brief"}`))
+	req.Header.Set("X-Khoj-Dashboard", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		ConversationID string `json:"conversation_id"`
+		Instructions   string `json:"instructions"`
+	}
+	json.NewDecoder(resp.Body).Decode(&got)
+	if got.ConversationID != "other" || got.Instructions != "Be brief" {
+		t.Errorf("PUT answered %+v, want the instructions written to other", got)
+	}
+}
+
+func TestReindexingShrunkFileDropsExtraParts(t *testing.T) {
+	khoj := khojtest.NewFakeKhoj(t)
+	w := khojtest.StartWrapper(t, khoj, khojtest.WrapperOptions{ConversationID: "c1", Config: `{"index": {"chunk_bytes": 100}}`})
+
+	for _, lines := range []int{12, 6} {
+		resp := uploadFile(t, w.URL+"/drop/api/files", "notes.md", strings.Repeat("a line of about forty characters here\n", lines), map[string]string{"action": "index"})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("drop upload of %d lines answered %d", lines, resp.StatusCode)
+		}
+	}
+
+	indexed := khoj.IndexedFiles()
+	sort.Strings(indexed)
+	want := []string{"notes.part-1.md", "notes.part-2.md", "notes.part-3.md"}
+	if strings.Join(indexed, ",") != strings.Join(want, ",") {
+		t.Errorf("Khoj holds %q after re-indexing the shrunk file, want %q", indexed, want)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// lazyDLL stands in for syscall.LazyDLL so the tree builds and tests on other platforms
+type lazyDLL struct {
+	Name string
+}
+
+// lazyProc is a procedure that always fails to call outside Windows
+type lazyProc struct {
+	Name string
+}
+
+func newLazyDLL(name string) *lazyDLL {
+	return &lazyDLL{Name: name}
+}
+
+// NewProc returns a stub procedure
+func (d *lazyDLL) NewProc(name string) *lazyProc {
+	return &lazyProc{Name: name}
+}
+
+// Find reports that Win32 procedures are unavailable
+func (p *lazyProc) Find() error {
+	return fmt.Errorf("%s is only available on Windows", p.Name)
+}
+
+// Call reports that Win32 procedures are unavailable
+func (p *lazyProc) Call(a ...uintptr) (uintptr, uintptr, error) {
+	return 0, 0, fmt.Errorf("%s is only available on Windows", p.Name)
+}
+
+// hideChildWindow is a no-op; only Windows opens console windows for child processes
+func hideChildWindow(cmd *exec.Cmd) {}
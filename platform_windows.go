@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Lazy DLL bindings resolve to the real loader on Windows
+type (
+	lazyDLL  = syscall.LazyDLL
+	lazyProc = syscall.LazyProc
+)
+
+func newLazyDLL(name string) *lazyDLL {
+	return syscall.NewLazyDLL(name)
+}
+
+// hideChildWindow keeps console programs started by the tray app from flashing a window
+func hideChildWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CreationFlags: 0x08000000} // CREATE_NO_WINDOW
+}
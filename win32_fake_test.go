@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// fakeWin32 is a scripted win32API for exercising the clipboard AI flow, hotkey polling and
+// text insertion fallbacks without Windows. Install it with `win32 = newFakeWin32()`.
+type fakeWin32 struct {
+	mu sync.Mutex
+
+	// Scripted behaviour
+	Clipboard        string
+	ClipboardHTML    string
+	Sequence         uint32
+	StaleWrites      int // Writes that bump Sequence but leave the old text, as if the clipboard had not settled
+	ReadErr          error
+	WriteErr         error
+	KeysDown         map[uint16]bool
+	FailSendInput    bool
+	Foreground       uintptr
+	ForegroundClass  string
+	ForegroundExe    string
+	ForegroundTitle  string
+	MessageBoxResult int
+
+	// Recorded effects, in call order
+	Calls  []string
+	Inputs []INPUT
+	Typed  []rune
+	Boxes  []string
+}
+
+func newFakeWin32() *fakeWin32 {
+	return &fakeWin32{
+		KeysDown:         make(map[uint16]bool),
+		Foreground:       1,
+		MessageBoxResult: 6, // IDYES
+	}
+}
+
+// SetKeys replaces the set of currently held virtual keys
+func (f *fakeWin32) SetKeys(vks ...uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.KeysDown = make(map[uint16]bool, len(vks))
+	for _, vk := range vks {
+		f.KeysDown[vk] = true
+	}
+}
+
+// CallLog returns a copy of the recorded call names
+func (f *fakeWin32) CallLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.Calls...)
+}
+
+func (f *fakeWin32) record(call string) {
+	f.Calls = append(f.Calls, call)
+}
+
+func (f *fakeWin32) Supported() bool {
+	return true
+}
+
+func (f *fakeWin32) ReadClipboard() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("ReadClipboard")
+	if f.ReadErr != nil {
+		return "", f.ReadErr
+	}
+	return f.Clipboard, nil
+}
+
+func (f *fakeWin32) WriteClipboard(text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("WriteClipboard")
+	if f.WriteErr != nil {
+		return f.WriteErr
+	}
+	f.Sequence++
+	if f.StaleWrites > 0 {
+		f.StaleWrites--
+		return nil
+	}
+	f.Clipboard, f.ClipboardHTML = text, ""
+	return nil
+}
+
+func (f *fakeWin32) WriteClipboardHTML(text, html string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("WriteClipboardHTML")
+	if f.WriteErr != nil {
+		return f.WriteErr
+	}
+	f.Sequence++
+	f.Clipboard, f.ClipboardHTML = text, html
+	return nil
+}
+
+func (f *fakeWin32) ClipboardSequence() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Sequence
+}
+
+func (f *fakeWin32) IsKeyDown(vk uint16) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.KeysDown[vk]
+}
+
+func (f *fakeWin32) SendInput(input INPUT) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(fmt.Sprintf("SendInput vk=0x%x scan=0x%x flags=0x%x", input.Ki.WVk, input.Ki.WScan, input.Ki.DwFlags))
+	if f.FailSendInput {
+		return false
+	}
+	f.Inputs = append(f.Inputs, input)
+	return true
+}
+
+func (f *fakeWin32) ForegroundWindow() uintptr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("ForegroundWindow")
+	return f.Foreground
+}
+
+func (f *fakeWin32) SendChar(hwnd uintptr, ch rune) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Typed = append(f.Typed, ch)
+}
+
+func (f *fakeWin32) DesktopWindow() uintptr {
+	return 0
+}
+
+func (f *fakeWin32) MessageBox(owner uintptr, title, text string, flags uintptr) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("MessageBox " + title)
+	f.Boxes = append(f.Boxes, text)
+	return f.MessageBoxResult
+}
+
+func (f *fakeWin32) WindowClass(hwnd uintptr) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("WindowClass")
+	return f.ForegroundClass
+}
+
+func (f *fakeWin32) WindowProcess(hwnd uintptr) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("WindowProcess")
+	return f.ForegroundExe
+}
+
+func (f *fakeWin32) WindowTitle(hwnd uintptr) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("WindowTitle")
+	return f.ForegroundTitle
+}